@@ -0,0 +1,58 @@
+package traktdeviceauth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ErrInvalidArgument is returned, wrapped in an *ArgumentError, when a function is called with an argument
+// which can't possibly be valid, such as an empty client id. It is returned before any request is sent.
+var ErrInvalidArgument error = errors.New("invalid argument")
+
+// ArgumentError names the argument which was rejected. It unwraps to ErrInvalidArgument.
+type ArgumentError struct {
+	Name   string // The parameter, such as "clientID" or "codeResp.DeviceCode", or "base url" for WithBaseURL.
+	Reason string
+}
+
+func (e *ArgumentError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidArgument, e.Name, e.Reason)
+}
+
+// Unwrap returns ErrInvalidArgument.
+func (e *ArgumentError) Unwrap() error {
+	return ErrInvalidArgument
+}
+
+// checkArgs returns an *ArgumentError for the first empty value in args, which alternate between parameter names
+// and values, or for a base url which isn't usable. Every exported function which sends requests calls it first.
+func (c config) checkArgs(args ...string) error {
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i+1] == "" {
+			return &ArgumentError{Name: args[i], Reason: "is empty"}
+		}
+	}
+	_, err := c.checkedBaseURL()
+	return err
+}
+
+// checkedBaseURL returns the base url, or an error if it isn't an absolute http or https url, or is rejected by
+// CheckBaseURL and WithAllowInsecureHTTP wasn't used.
+func (c config) checkedBaseURL() (string, error) {
+	base := c.baseURL()
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", &ArgumentError{Name: "base url", Reason: fmt.Sprintf("can't be parsed: %v", err)}
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", &ArgumentError{Name: "base url", Reason: fmt.Sprintf("%q isn't an absolute http or https url", base)}
+	}
+
+	if !c.allowInsecureHTTP {
+		if err := CheckBaseURL(base); err != nil {
+			return "", err
+		}
+	}
+	return base, nil
+}
@@ -0,0 +1,184 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// roundTripperFunc is an http.RoundTripper which calls itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestInvalidArguments(t *testing.T) {
+	ctx := context.Background()
+	codeResp := traktdeviceauth.CodeResponse{DeviceCode: "device-code", UserCode: "USERCODE", ExpiresIn: 600, Interval: 1}
+	noDeviceCode := traktdeviceauth.CodeResponse{UserCode: "USERCODE", ExpiresIn: 600, Interval: 1}
+
+	type call func(opts []traktdeviceauth.Option) error
+	tests := []struct {
+		name    string
+		call    call
+		wantArg string
+	}{
+		{"GenerateNewCode", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.GenerateNewCode("", opts...)
+			return err
+		}, "clientID"},
+		{"Client.GenerateNewCode", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.NewClient("", "secret", opts...).GenerateNewCode(ctx)
+			return err
+		}, "clientID"},
+		{"RequestToken without device code", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RequestToken(noDeviceCode, "client-id", "secret", opts...)
+			return err
+		}, "codeResp.DeviceCode"},
+		{"RequestToken with a zero CodeResponse", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RequestTokenContext(ctx, traktdeviceauth.CodeResponse{}, "client-id", "secret", opts...)
+			return err
+		}, "codeResp.DeviceCode"},
+		{"RequestToken without client id", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RequestToken(codeResp, "", "secret", opts...)
+			return err
+		}, "clientID"},
+		{"Client.RequestToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.NewClient("client-id", "secret", opts...).RequestToken(ctx, noDeviceCode)
+			return err
+		}, "codeResp.DeviceCode"},
+		{"PollForAuthToken without device code", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.PollForAuthToken(noDeviceCode, "client-id", "secret", opts...)
+			return err
+		}, "codeResp.DeviceCode"},
+		{"PollForAuthToken without client id", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, "", "secret", opts...)
+			return err
+		}, "clientID"},
+		{"Client.PollForAuthToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.NewClient("client-id", "secret", opts...).PollForAuthToken(ctx, traktdeviceauth.CodeResponse{})
+			return err
+		}, "codeResp.DeviceCode"},
+		{"RefreshAccessToken without refresh token", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RefreshAccessToken("", "client-id", "secret", opts...)
+			return err
+		}, "refreshToken"},
+		{"RefreshAccessToken without client id", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RefreshAccessTokenContext(ctx, "refresh", "", "secret", opts...)
+			return err
+		}, "clientID"},
+		{"Client.RefreshAccessToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.NewClient("client-id", "secret", opts...).RefreshAccessToken(ctx, "")
+			return err
+		}, "refreshToken"},
+		{"RevokeToken without access token", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.RevokeToken("", "client-id", "secret", opts...)
+		}, "accessToken"},
+		{"RevokeToken without client id", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.RevokeTokenContext(ctx, "access", "", "secret", opts...)
+		}, "clientID"},
+		{"Client.RevokeToken", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.NewClient("client-id", "secret", opts...).RevokeToken(ctx, "")
+		}, "accessToken"},
+		{"GetUserSettings without access token", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.GetUserSettings("", "client-id", opts...)
+			return err
+		}, "accessToken"},
+		{"GetUserSettings without client id", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.GetUserSettingsContext(ctx, "access", "", opts...)
+			return err
+		}, "clientID"},
+	}
+
+	var requests int32
+	transport := traktdeviceauth.WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return nil, errors.New("no requests should be sent")
+	})})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			err := tt.call([]traktdeviceauth.Option{transport})
+
+			var argErr *traktdeviceauth.ArgumentError
+			if !errors.As(err, &argErr) || !errors.Is(err, traktdeviceauth.ErrInvalidArgument) {
+				t.Fatalf("returned %v, want an *ArgumentError", err)
+			}
+			if argErr.Name != tt.wantArg {
+				t.Errorf("the error names %q, want %q", argErr.Name, tt.wantArg)
+			}
+			if n := atomic.LoadInt32(&requests); n != 0 {
+				t.Errorf("%d requests were sent", n)
+			}
+		})
+	}
+
+	// A base url which can't work is rejected by every function the same way.
+	baseURLs := []struct {
+		url  string
+		want error
+	}{
+		{"://no-scheme", traktdeviceauth.ErrInvalidArgument},
+		{"ftp://trakt.example", traktdeviceauth.ErrInvalidArgument},
+		{"https://", traktdeviceauth.ErrInvalidArgument},
+		{"/relative", traktdeviceauth.ErrInvalidArgument},
+		{"http://trakt.example", traktdeviceauth.ErrInsecureBaseURL},
+	}
+	valid := []struct {
+		name string
+		call call
+	}{
+		{"GenerateNewCode", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.GenerateNewCode("client-id", opts...)
+			return err
+		}},
+		{"RequestToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RequestToken(codeResp, "client-id", "secret", opts...)
+			return err
+		}},
+		{"PollForAuthToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.PollForAuthToken(codeResp, "client-id", "secret", opts...)
+			return err
+		}},
+		{"RefreshAccessToken", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.RefreshAccessToken("refresh", "client-id", "secret", opts...)
+			return err
+		}},
+		{"RevokeToken", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.RevokeToken("access", "client-id", "secret", opts...)
+		}},
+		{"GetUserSettings", func(opts []traktdeviceauth.Option) error {
+			_, err := traktdeviceauth.GetUserSettings("access", "client-id", opts...)
+			return err
+		}},
+		{"Ping", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.Ping(ctx, opts...)
+		}},
+		{"WaitUntilReady", func(opts []traktdeviceauth.Option) error {
+			return traktdeviceauth.WaitUntilReady(ctx, opts...)
+		}},
+	}
+	for _, fn := range valid {
+		for _, base := range baseURLs {
+			t.Run(fn.name+" "+base.url, func(t *testing.T) {
+				atomic.StoreInt32(&requests, 0)
+				err := fn.call([]traktdeviceauth.Option{transport, traktdeviceauth.WithBaseURL(base.url)})
+				if !errors.Is(err, base.want) {
+					t.Errorf("returned %v, want %v", err, base.want)
+				}
+				var argErr *traktdeviceauth.ArgumentError
+				if errors.As(err, &argErr) && argErr.Name != "base url" {
+					t.Errorf("the error names %q, want the base url", argErr.Name)
+				}
+				if n := atomic.LoadInt32(&requests); n != 0 {
+					t.Errorf("%d requests were sent", n)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package traktdeviceauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// Audit event names. These are part of the audit log format and won't change between releases.
+const (
+	AuditCodeGenerated  = "code_generated"
+	AuditTokenObtained  = "token_obtained"
+	AuditTokenRefreshed = "token_refreshed"
+	AuditTokenRevoked   = "token_revoked"
+	AuditFailure        = "failure"
+)
+
+// AuditEvent is a single line of the audit log written by WithAuditLog. It never contains client secrets,
+// device codes, or tokens.
+type AuditEvent struct {
+	Time      time.Time  `json:"time"`
+	Event     string     `json:"event"`
+	Key       string     `json:"key,omitempty"`       // The FlowManager key the event belongs to, if any.
+	Endpoint  string     `json:"endpoint,omitempty"`  // The path of the endpoint that was called.
+	DeviceID  string     `json:"device_id,omitempty"` // A fingerprint of the device code, see DeviceCodeFingerprint.
+	Scope     string     `json:"scope,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // When the device code or access token expires.
+	Reason    string     `json:"reason,omitempty"`     // The Code of the error, only set for AuditFailure.
+}
+
+// DeviceCodeFingerprint returns a short, non-reversible identifier for deviceCode which can be used to
+// correlate audit events without recording the code itself.
+func DeviceCodeFingerprint(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:8])
+}
+
+// WithAuditLog writes an AuditEvent to w as a line of JSON whenever a code is generated, a token is obtained
+// or refreshed, or a request fails. Each event is written with a single call to w, followed by a call to
+// its Flush method if it has one, so w can be a file opened with os.O_APPEND.
+//
+// Events caused by a FlowManager record the key of the flow. Writes made through the same Option are
+// serialized and errors writing to w are ignored.
+func WithAuditLog(w io.Writer) Option {
+	a := &auditLog{w: w}
+	return func(c *config) {
+		c.audit = a
+	}
+}
+
+// WithEventHook calls fn with every AuditEvent, whether or not an audit log is written, so that the events can
+// feed a metrics system. fn is called synchronously by the goroutine making the call and shouldn't block. Using
+// WithEventHook more than once calls every fn in order.
+func WithEventHook(fn func(e AuditEvent)) Option {
+	return func(c *config) {
+		// The full slice expression makes append copy, so configs built from the same options don't share hooks.
+		c.eventHooks = append(c.eventHooks[:len(c.eventHooks):len(c.eventHooks)], fn)
+	}
+}
+
+// withAuditKey sets the key recorded in audit events, such as the key of a FlowManager flow.
+func withAuditKey(key string) Option {
+	return func(c *config) {
+		c.auditKey = key
+	}
+}
+
+// auditLog serializes writes to an audit log.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// record reports e to the expvar counters and event hooks and writes it to the audit log, if they are enabled.
+// Every instrumented event passes through here.
+func (c config) record(e AuditEvent) {
+	if c.expvar {
+		countEvent(e)
+	}
+	if c.audit == nil && len(c.eventHooks) == 0 {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.Key = c.auditKey
+	for _, fn := range c.eventHooks {
+		c.observe("WithEventHook", func() { fn(e) })
+	}
+	if c.audit == nil {
+		return
+	}
+
+	b, err := codecOrDefault(c.codec).Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	c.audit.mu.Lock()
+	defer c.audit.mu.Unlock()
+
+	c.audit.w.Write(b)
+	if f, ok := c.audit.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// recordFailure writes an AuditFailure event for err, which was returned while calling endpoint.
+func (c config) recordFailure(endpoint Endpoint, deviceCode string, err error) {
+	e := AuditEvent{Event: AuditFailure, Endpoint: endpoint.String(), Reason: Code(err)}
+	if deviceCode != "" {
+		e.DeviceID = DeviceCodeFingerprint(deviceCode)
+	}
+	c.record(e)
+}
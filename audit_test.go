@@ -0,0 +1,149 @@
+package traktdeviceauth_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// auditBuffer is a goroutine-safe audit log which counts how often it was flushed.
+type auditBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	writes  int
+	flushes int
+}
+
+func (b *auditBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.writes++
+	return b.buf.Write(p)
+}
+
+func (b *auditBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushes++
+	return nil
+}
+
+// events decodes every line written to b.
+func (b *auditBuffer) events(t *testing.T) []traktdeviceauth.AuditEvent {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var events []traktdeviceauth.AuditEvent
+	lines := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for lines.Scan() {
+		var e traktdeviceauth.AuditEvent
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("%q isn't an audit event: %v", lines.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestAuditLogFullFlow(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+
+	var log auditBuffer
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithAuditLog(&log))...)
+	ctx := context.Background()
+
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cl.PollForAuthToken(ctx, codeResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := cl.RefreshAccessToken(ctx, tok.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RevokeToken(ctx, refreshed.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RefreshAccessToken(ctx, "invalid-refresh-token"); !errors.Is(err, traktdeviceauth.ErrInvalidGrant) {
+		t.Fatalf("refreshing an invalid token returned %v, want ErrInvalidGrant", err)
+	}
+
+	events := log.events(t)
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Event)
+	}
+	want := []string{
+		traktdeviceauth.AuditCodeGenerated,
+		traktdeviceauth.AuditTokenObtained,
+		traktdeviceauth.AuditTokenRefreshed,
+		traktdeviceauth.AuditTokenRevoked,
+		traktdeviceauth.AuditFailure,
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got the events %v, want %v", names, want)
+	}
+
+	fingerprint := traktdeviceauth.DeviceCodeFingerprint(codeResp.DeviceCode)
+	if e := events[0]; e.DeviceID != fingerprint || e.ExpiresAt == nil || e.Time.IsZero() {
+		t.Errorf("code_generated event %+v, want the device code's fingerprint %s and expiry", e, fingerprint)
+	}
+	if e := events[1]; e.DeviceID != fingerprint || e.ExpiresAt == nil || !e.ExpiresAt.Equal(tok.ExpiresAt) {
+		t.Errorf("token_obtained event %+v, want the device code's fingerprint and the token's expiry %v", e, tok.ExpiresAt)
+	}
+	if e := events[4]; e.Reason != traktdeviceauth.CodeInvalidGrant || e.Endpoint != traktdeviceauth.EndpointToken.String() {
+		t.Errorf("failure event %+v, want reason %s for %s", e, traktdeviceauth.CodeInvalidGrant, traktdeviceauth.EndpointToken)
+	}
+
+	out := log.buf.String()
+	for _, secret := range []string{"client-secret", codeResp.DeviceCode, tok.AccessToken, tok.RefreshToken, refreshed.AccessToken, refreshed.RefreshToken, "invalid-refresh-token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("the audit log contains %q:\n%s", secret, out)
+		}
+	}
+
+	// Every event is a single write, flushed on its own.
+	if log.writes != len(events) || log.flushes != len(events) {
+		t.Errorf("%d events were written with %d writes and %d flushes", len(events), log.writes, log.flushes)
+	}
+}
+
+func TestAuditLogFlowManagerKey(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var log auditBuffer
+	m := newFlowManager(t, srv, traktdeviceauth.WithFlowOptions(append(srv.Options(), traktdeviceauth.WithAuditLog(&log))...))
+	if _, err := m.Begin(context.Background(), "user-42"); err != nil {
+		t.Fatal(err)
+	}
+	waitForFlow(t, m, "user-42")
+
+	events := log.events(t)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want code_generated and token_obtained", len(events))
+	}
+	for _, e := range events {
+		if e.Key != "user-42" {
+			t.Errorf("%s event has the key %q, want user-42", e.Event, e.Key)
+		}
+	}
+}
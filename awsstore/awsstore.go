@@ -0,0 +1,216 @@
+// Package awsstore provides traktdeviceauth.TokenStores which keep the token in AWS Secrets Manager or in AWS Systems
+// Manager Parameter Store.
+//
+// It is a separate module so that the AWS SDK only becomes a dependency of programs which use it.
+package awsstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrAccessDenied is matched by errors.Is for errors caused by missing IAM or KMS permissions or invalid AWS
+// credentials, so that they can be told apart from a missing token.
+var ErrAccessDenied error = errors.New("access to the AWS resource was denied")
+
+// accessDeniedCodes are the AWS error codes which mean the caller isn't allowed to use the resource.
+var accessDeniedCodes = map[string]bool{
+	"AccessDeniedException":       true,
+	"AccessDenied":                true,
+	"UnrecognizedClientException": true,
+	"InvalidClientTokenId":        true,
+	"ExpiredTokenException":       true,
+	"DecryptionFailure":           true, // Returned when the KMS key can't be used.
+	"EncryptionFailure":           true,
+}
+
+// PermissionError wraps an AWS error which means access was denied. It matches ErrAccessDenied with errors.Is.
+type PermissionError struct {
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrAccessDenied, e.Err)
+}
+
+// Unwrap returns the error returned by the AWS SDK.
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrAccessDenied.
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrAccessDenied
+}
+
+// classify wraps access denied errors from the AWS SDK in a *PermissionError.
+func classify(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && accessDeniedCodes[apiErr.ErrorCode()] {
+		return &PermissionError{Err: err}
+	}
+	return err
+}
+
+// Option customizes a store.
+type Option func(*config)
+
+type config struct {
+	kmsKeyID string
+}
+
+// WithKMSKey encrypts the token with the KMS key identified by keyID, which may be a key id, alias or ARN, instead
+// of the AWS managed key. For Secrets Manager, the key is only used when the secret is created by Save.
+func WithKMSKey(keyID string) Option {
+	return func(c *config) {
+		c.kmsKeyID = keyID
+	}
+}
+
+// SecretsManagerAPI is the part of *secretsmanager.Client used by SecretsManagerStore, so that it can be mocked.
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+}
+
+// SecretsManagerStore is a traktdeviceauth.TokenStore which keeps the token as the string value of a secret, in
+// the traktdeviceauth.StoredToken format.
+type SecretsManagerStore struct {
+	api      SecretsManagerAPI
+	secretID string
+	config
+}
+
+// NewSecretsManagerStore returns a store for the secret with the name or ARN secretID. The secret is created by
+// the first Save if it doesn't exist, in which case secretID must be a name.
+func NewSecretsManagerStore(api SecretsManagerAPI, secretID string, opts ...Option) *SecretsManagerStore {
+	s := &SecretsManagerStore{api: api, secretID: secretID}
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+	return s
+}
+
+// Save implements traktdeviceauth.TokenStore by adding a new version of the secret, creating the secret if needed.
+func (s *SecretsManagerStore) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("awsstore.SecretsManagerStore.Save: %w", err)
+	}
+	value := aws.String(string(b))
+
+	_, err = s.api.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{SecretId: aws.String(s.secretID), SecretString: value})
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		input := &secretsmanager.CreateSecretInput{
+			Name:         aws.String(s.secretID),
+			SecretString: value,
+			Description:  aws.String("Trakt API token"),
+		}
+		if s.kmsKeyID != "" {
+			input.KmsKeyId = aws.String(s.kmsKeyID)
+		}
+		_, err = s.api.CreateSecret(ctx, input)
+	}
+	if err != nil {
+		return fmt.Errorf("awsstore.SecretsManagerStore.Save: %w", classify(err))
+	}
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore by reading the current version of the secret. A missing secret is
+// reported as traktdeviceauth.ErrNoStoredToken.
+func (s *SecretsManagerStore) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	out, err := s.api.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(s.secretID)})
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("awsstore.SecretsManagerStore.Load: %s: %w", s.secretID, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("awsstore.SecretsManagerStore.Load: %w", classify(err))
+	}
+
+	return decode("awsstore.SecretsManagerStore.Load", aws.ToString(out.SecretString))
+}
+
+// ParameterStoreAPI is the part of *ssm.Client used by ParameterStore, so that it can be mocked.
+type ParameterStoreAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+}
+
+// ParameterStore is a traktdeviceauth.TokenStore which keeps the token in a SecureString parameter, in the
+// traktdeviceauth.StoredToken format.
+type ParameterStore struct {
+	api  ParameterStoreAPI
+	name string
+	config
+}
+
+// NewParameterStore returns a store for the parameter with the name or ARN name. The parameter is created by the
+// first Save if it doesn't exist.
+func NewParameterStore(api ParameterStoreAPI, name string, opts ...Option) *ParameterStore {
+	s := &ParameterStore{api: api, name: name}
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+	return s
+}
+
+// Save implements traktdeviceauth.TokenStore by overwriting the parameter.
+func (s *ParameterStore) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("awsstore.ParameterStore.Save: %w", err)
+	}
+
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(s.name),
+		Value:     aws.String(string(b)),
+		Type:      ssmtypes.ParameterTypeSecureString,
+		Overwrite: aws.Bool(true),
+	}
+	if s.kmsKeyID != "" {
+		input.KeyId = aws.String(s.kmsKeyID)
+	}
+	if _, err := s.api.PutParameter(ctx, input); err != nil {
+		return fmt.Errorf("awsstore.ParameterStore.Save: %w", classify(err))
+	}
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore by reading and decrypting the parameter. A missing parameter is
+// reported as traktdeviceauth.ErrNoStoredToken.
+func (s *ParameterStore) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	out, err := s.api.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(s.name), WithDecryption: aws.Bool(true)})
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("awsstore.ParameterStore.Load: %s: %w", s.name, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("awsstore.ParameterStore.Load: %w", classify(err))
+	}
+	if out.Parameter == nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("awsstore.ParameterStore.Load: %s: %w", s.name, traktdeviceauth.ErrNoStoredToken)
+	}
+
+	return decode("awsstore.ParameterStore.Load", aws.ToString(out.Parameter.Value))
+}
+
+// decode parses a stored token, prefixing errors with op.
+func decode(op, value string) (traktdeviceauth.TokenResponse, error) {
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal([]byte(value), &st); err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return st.TokenResponse(), nil
+}
@@ -0,0 +1,211 @@
+package awsstore_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/awsstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeSecretsManager is an in-memory awsstore.SecretsManagerAPI. If err is set, every call fails with it.
+type fakeSecretsManager struct {
+	mu      sync.Mutex
+	secrets map[string][]string // Every version of every secret.
+	kmsKeys map[string]string   // The KMS key each secret was created with.
+	err     error
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{secrets: make(map[string][]string), kmsKeys: make(map[string]string)}
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	versions, ok := f.secrets[aws.ToString(in.SecretId)]
+	if !ok {
+		return nil, &smtypes.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(versions[len(versions)-1])}, nil
+}
+
+func (f *fakeSecretsManager) PutSecretValue(ctx context.Context, in *secretsmanager.PutSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	id := aws.ToString(in.SecretId)
+	if _, ok := f.secrets[id]; !ok {
+		return nil, &smtypes.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	}
+	f.secrets[id] = append(f.secrets[id], aws.ToString(in.SecretString))
+	return &secretsmanager.PutSecretValueOutput{}, nil
+}
+
+func (f *fakeSecretsManager) CreateSecret(ctx context.Context, in *secretsmanager.CreateSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	name := aws.ToString(in.Name)
+	if _, ok := f.secrets[name]; ok {
+		return nil, &smtypes.ResourceExistsException{Message: aws.String("the secret already exists")}
+	}
+	f.secrets[name] = []string{aws.ToString(in.SecretString)}
+	f.kmsKeys[name] = aws.ToString(in.KmsKeyId)
+	return &secretsmanager.CreateSecretOutput{}, nil
+}
+
+// fakeParameterStore is an in-memory awsstore.ParameterStoreAPI. If err is set, every call fails with it.
+type fakeParameterStore struct {
+	mu     sync.Mutex
+	params map[string]ssm.PutParameterInput
+	err    error
+}
+
+func newFakeParameterStore() *fakeParameterStore {
+	return &fakeParameterStore{params: make(map[string]ssm.PutParameterInput)}
+}
+
+func (f *fakeParameterStore) GetParameter(ctx context.Context, in *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	p, ok := f.params[aws.ToString(in.Name)]
+	if !ok {
+		return nil, &ssmtypes.ParameterNotFound{}
+	}
+	if p.Type == ssmtypes.ParameterTypeSecureString && !aws.ToBool(in.WithDecryption) {
+		return nil, errors.New("the fake only returns SecureString parameters decrypted")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: p.Name, Value: p.Value, Type: p.Type}}, nil
+}
+
+func (f *fakeParameterStore) PutParameter(ctx context.Context, in *ssm.PutParameterInput, _ ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	name := aws.ToString(in.Name)
+	if _, ok := f.params[name]; ok && !aws.ToBool(in.Overwrite) {
+		return nil, &ssmtypes.ParameterAlreadyExists{}
+	}
+	f.params[name] = *in
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func TestSecretsManagerStore(t *testing.T) {
+	api := newFakeSecretsManager()
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets a secret of its own.
+		return awsstore.NewSecretsManagerStore(api, t.Name())
+	})
+}
+
+func TestParameterStore(t *testing.T) {
+	api := newFakeParameterStore()
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return awsstore.NewParameterStore(api, "/"+t.Name())
+	})
+}
+
+var testToken = traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Unix(1700000000, 0)}
+
+func TestSecretsManagerStoreCreatesSecretOnce(t *testing.T) {
+	api := newFakeSecretsManager()
+	s := awsstore.NewSecretsManagerStore(api, "trakt/token", awsstore.WithKMSKey("alias/trakt"))
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := s.Save(ctx, testToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(api.secrets["trakt/token"]); n != 3 {
+		t.Errorf("the secret has %d versions, want 3", n)
+	}
+	if key := api.kmsKeys["trakt/token"]; key != "alias/trakt" {
+		t.Errorf("the secret was created with KMS key %q, want alias/trakt", key)
+	}
+}
+
+func TestParameterStoreSecureString(t *testing.T) {
+	api := newFakeParameterStore()
+	ctx := context.Background()
+
+	if err := awsstore.NewParameterStore(api, "/trakt/token").Save(ctx, testToken); err != nil {
+		t.Fatal(err)
+	}
+	p := api.params["/trakt/token"]
+	if p.Type != ssmtypes.ParameterTypeSecureString || p.KeyId != nil {
+		t.Errorf("the parameter was saved as %s with key %v, want a SecureString with the AWS managed key", p.Type, p.KeyId)
+	}
+
+	if err := awsstore.NewParameterStore(api, "/trakt/token", awsstore.WithKMSKey("alias/trakt")).Save(ctx, testToken); err != nil {
+		t.Fatal(err)
+	}
+	if key := aws.ToString(api.params["/trakt/token"].KeyId); key != "alias/trakt" {
+		t.Errorf("the parameter was saved with KMS key %q, want alias/trakt", key)
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform secretsmanager:GetSecretValue"}
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "rate exceeded"}
+
+	sm := newFakeSecretsManager()
+	ps := newFakeParameterStore()
+	stores := map[string]traktdeviceauth.TokenStore{
+		"SecretsManagerStore": awsstore.NewSecretsManagerStore(sm, "trakt/token"),
+		"ParameterStore":      awsstore.NewParameterStore(ps, "/trakt/token"),
+	}
+
+	ctx := context.Background()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			sm.err, ps.err = denied, denied
+			_, loadErr := s.Load(ctx)
+			saveErr := s.Save(ctx, testToken)
+			for _, err := range []error{loadErr, saveErr} {
+				var permErr *awsstore.PermissionError
+				if !errors.Is(err, awsstore.ErrAccessDenied) || !errors.As(err, &permErr) || errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+					t.Errorf("got %v, want a *PermissionError which isn't ErrNoStoredToken", err)
+				}
+				if !errors.Is(err, denied) {
+					t.Errorf("%v doesn't wrap the AWS error", err)
+				}
+			}
+
+			// Other AWS errors are passed through as they are.
+			sm.err, ps.err = throttled, throttled
+			_, err := s.Load(ctx)
+			if errors.Is(err, awsstore.ErrAccessDenied) || errors.Is(err, traktdeviceauth.ErrNoStoredToken) || !errors.Is(err, throttled) {
+				t.Errorf("throttling was reported as %v", err)
+			}
+		})
+	}
+}
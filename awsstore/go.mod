@@ -0,0 +1,18 @@
+module github.com/BrenekH/go-traktdeviceauth/awsstore
+
+go 1.22
+
+require (
+	github.com/BrenekH/go-traktdeviceauth v1.1.0
+	github.com/aws/aws-sdk-go-v2 v1.32.5
+	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.34.6
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.44.7
+	github.com/aws/smithy-go v1.22.1
+)
+
+require (
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.3.24 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.6.24 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
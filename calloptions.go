@@ -0,0 +1,179 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The Options in this file are meant to be passed to a single call, but like every Option they work anywhere.
+// Options are applied in order, so one passed after another Option setting the same value overrides it.
+// Nothing set by an Option outlives the call it was passed to.
+
+// WithCallTimeout limits how long the call may take in total, including retries. With PollForAuthToken
+// and DeviceAuthFlow, the limit applies to every poll separately. A zero d removes an earlier limit.
+func WithCallTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.callTimeout = d
+	}
+}
+
+// DefaultRequestTimeout is how long a single request may take unless WithRequestTimeout says otherwise, so that
+// a stalled connection can't block a call made with a context which has no deadline forever.
+const DefaultRequestTimeout = 30 * time.Second
+
+// WithRequestTimeout limits how long every single request may take, including reading its response, to d
+// instead of DefaultRequestTimeout. Unlike WithCallTimeout, it applies to every attempt separately, so a
+// retry gets the full d again, and so does every poll of PollForAuthToken and DeviceAuthFlow, whose loop
+// stays governed by the expiry of the code. A zero d removes the limit.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.requestTimeout, c.requestTimeoutSet = d, true
+	}
+}
+
+// WithCallHeader sets a header on every request made by the call. It replaces the headers set by this
+// package, including Trakt-API-Version, so use it with care.
+func WithCallHeader(key, value string) Option {
+	return func(c *config) {
+		headers := c.headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set(key, value)
+		c.headers = headers
+	}
+}
+
+// RetryPolicy controls whether requests which failed for reasons that are likely to be temporary are tried again.
+// Only network errors and the statuses mapped to ErrServerError, ErrServiceOverloaded and ErrCloudflareError are
+// retried. Rate limiting isn't, since retrying right away would only make it worse.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. Values below 2 disable retries.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles for every retry after that.
+	Backoff time.Duration
+
+	// OnRetry, if set, is called before waiting to retry a request to endpoint which failed with err. attempt
+	// is the number of the attempt about to be made, starting at 2.
+	OnRetry func(endpoint Endpoint, attempt int, wait time.Duration, err error)
+}
+
+// DefaultRetryPolicy is a reasonable RetryPolicy for programs which want retries without tuning them. It is
+// not applied unless passed to WithCallRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: time.Second}
+
+// WithCallRetryPolicy retries failed requests as described by p. Without it, requests are never retried.
+func WithCallRetryPolicy(p RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = p
+	}
+}
+
+// WithOptionalRefreshToken accepts token responses without a refresh token, for servers which mimic the Trakt
+// API but don't issue refresh tokens. Without it, such responses are rejected with a *MalformedResponseError.
+func WithOptionalRefreshToken() Option {
+	return func(c *config) {
+		c.optionalRefreshToken = true
+	}
+}
+
+// WithStrictDecoding makes the call fail if a response contains fields this package doesn't know about.
+// Trakt adds fields over time, so this is meant for tests which check that a fake API matches the real one.
+// Responses are decoded with encoding/json if the WithCodec Codec isn't a StrictCodec.
+func WithStrictDecoding() Option {
+	return func(c *config) {
+		c.strictDecoding = true
+	}
+}
+
+// send sends the request built by newReq to endpoint with do, applying the timeouts set by WithCallTimeout and
+// WithRequestTimeout and waiting out penalties recorded by WithRateLimitState.
+// newReq is called again for every retry allowed by the RetryPolicy, since a request body can only be sent once.
+func (c config) send(ctx context.Context, endpoint Endpoint, newReq func(ctx context.Context) (*http.Request, error)) ([]byte, http.Header, error) {
+	if c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+
+	backoff := c.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		if c.rateLimitState != "" {
+			if err := c.waitRateLimitState(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		b, header, err := c.attempt(ctx, endpoint, newReq)
+		c.recordAttempt(err)
+		var rateLimitErr *RateLimitError
+		if c.rateLimitState != "" && errors.As(err, &rateLimitErr) {
+			c.recordRateLimit(rateLimitErr.RetryAfter)
+		}
+		if err == nil || attempt >= c.retry.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return b, header, err
+		}
+
+		if c.retryObserver != nil {
+			c.retryObserver()
+		}
+		if c.retry.OnRetry != nil {
+			c.observe("WithCallRetryPolicy", func() { c.retry.OnRetry(endpoint, attempt+1, backoff, err) })
+		}
+		if sleepContext(ctx, backoff) != nil {
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// attempt sends the request built by newReq once, aborting it with a *RequestTimeoutError if it takes longer
+// than the WithRequestTimeout limit.
+func (c config) attempt(ctx context.Context, endpoint Endpoint, newReq func(ctx context.Context) (*http.Request, error)) ([]byte, http.Header, error) {
+	timeout := DefaultRequestTimeout
+	if c.requestTimeoutSet {
+		timeout = c.requestTimeout
+	}
+	reqCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := newReq(reqCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, header, err := c.do(endpoint, req)
+	if err != nil && reqCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, nil, &RequestTimeoutError{Endpoint: endpoint, Timeout: timeout, Err: err}
+	}
+	return b, header, err
+}
+
+// retryable reports whether err is likely to be temporary.
+func retryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrServerError) || errors.Is(err, ErrServiceOverloaded) || errors.Is(err, ErrCloudflareError) ||
+		errors.As(err, &netErr)
+}
+
+// decode decodes the JSON response body b into v with the WithCodec Codec, rejecting unknown fields if
+// WithStrictDecoding was used.
+func (c config) decode(b []byte, v interface{}) error {
+	codec := codecOrDefault(c.codec)
+	if !c.strictDecoding {
+		return codec.Unmarshal(b, v)
+	}
+
+	strict, ok := codec.(StrictCodec)
+	if !ok {
+		strict = stdCodec{}
+	}
+	return strict.UnmarshalStrict(b, v)
+}
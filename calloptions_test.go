@@ -0,0 +1,262 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestCallHeader(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithCallHeader("X-Test", "client"))...)
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithCallHeader("X-Test", "call"), traktdeviceauth.WithCallHeader("X-Other", "call")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.GenerateNewCode(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)
+	want := []struct{ test, other string }{{"call", "call"}, {"client", ""}, {"", ""}}
+	for i, w := range want {
+		if got := reqs[i].Header.Get("X-Test"); got != w.test {
+			t.Errorf("request %d: X-Test = %q, want %q", i+1, got, w.test)
+		}
+		if got := reqs[i].Header.Get("X-Other"); got != w.other {
+			t.Errorf("request %d: X-Other = %q, want %q", i+1, got, w.other)
+		}
+		if got := reqs[i].Header.Get("trakt-api-version"); got != "2" {
+			t.Errorf("request %d: trakt-api-version = %q, want 2", i+1, got)
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// Every request takes 200ms.
+	slow := traktdeviceauth.WithMiddleware(func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			return next(req)
+		}
+	})
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), slow)...)
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithCallTimeout(20*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GenerateNewCode with a short timeout returned %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := cl.GenerateNewCode(ctx); err != nil {
+		t.Fatalf("the timeout of the previous call leaked into the next: %v", err)
+	}
+
+	// A per-call timeout overrides the client's, and zero removes it.
+	limited := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), slow, traktdeviceauth.WithCallTimeout(20*time.Millisecond))...)
+	if _, err := limited.GenerateNewCode(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GenerateNewCode with the client's timeout returned %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := limited.GenerateNewCode(ctx, traktdeviceauth.WithCallTimeout(0)); err != nil {
+		t.Fatalf("GenerateNewCode without a timeout: %v", err)
+	}
+	if _, err := limited.GenerateNewCode(ctx, traktdeviceauth.WithCallTimeout(time.Second)); err != nil {
+		t.Fatalf("GenerateNewCode with a longer timeout: %v", err)
+	}
+}
+
+func TestCallRetryPolicy(t *testing.T) {
+	replay := traktdeviceauthtest.NewReplayTransport(
+		traktdeviceauthtest.FixtureServerError,
+		traktdeviceauthtest.FixtureCodeResponse,
+		traktdeviceauthtest.FixtureServerError,
+	)
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 2})); err != nil {
+		t.Fatalf("GenerateNewCode with retries: %v", err)
+	}
+	if _, err := cl.GenerateNewCode(ctx); !errors.Is(err, traktdeviceauth.ErrServerError) {
+		t.Fatalf("the retry policy of the previous call leaked into the next: %v", err)
+	}
+	if n := len(replay.Requests()); n != 3 {
+		t.Errorf("%d requests were made, want 3", n)
+	}
+
+	// A per-call policy overrides the client's.
+	replay = traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureServerError, traktdeviceauthtest.FixtureCodeResponse)
+	cl = traktdeviceauth.NewClient("client-id", "client-secret", append(replay.Options(), traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 2}))...)
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{})); !errors.Is(err, traktdeviceauth.ErrServerError) {
+		t.Fatalf("GenerateNewCode with retries disabled for the call returned %v, want ErrServerError", err)
+	}
+	if n := len(replay.Requests()); n != 1 {
+		t.Errorf("%d requests were made, want 1", n)
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	extra := traktdeviceauthtest.FixtureCodeResponse
+	extra.Body = `{"device_code":"code","user_code":"USER","verification_url":"https://trakt.tv/activate","expires_in":600,"interval":5,"qr_code":"new"}`
+	replay := traktdeviceauthtest.NewReplayTransport(extra, extra, extra)
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithStrictDecoding()); err == nil {
+		t.Fatal("GenerateNewCode with WithStrictDecoding accepted an unknown field")
+	}
+	if _, err := cl.GenerateNewCode(ctx); err != nil {
+		t.Fatalf("strict decoding leaked into the next call: %v", err)
+	}
+
+	// The fixtures match what this package knows about.
+	replay = traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse, traktdeviceauthtest.FixtureTokenResponse)
+	cl = traktdeviceauth.NewClient("client-id", "client-secret", append(replay.Options(), traktdeviceauth.WithStrictDecoding())...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stallingProxy forwards requests to srv, except for the first stall requests to endpoint, which hang until
+// the client gives up on them.
+func stallingProxy(t *testing.T, srv *traktdeviceauthtest.Server, endpoint traktdeviceauth.Endpoint, stall int32) (*httptest.Server, *int32) {
+	t.Helper()
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var stalled int32
+	p := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == endpoint.String() && atomic.AddInt32(&stalled, 1) <= stall {
+			// The server only notices the client going away once the body has been read.
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+				t.Errorf("the stalled request to %s wasn't aborted", endpoint)
+			}
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.Close)
+	return p, &stalled
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	p, _ := stallingProxy(t, srv, traktdeviceauth.EndpointDeviceCode, 1)
+	opts := append(srv.Options(), traktdeviceauth.WithBaseURL(p.URL))
+
+	// The stalled request is aborted once the limit passes, though the call's context has no deadline.
+	start := time.Now()
+	_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(opts, traktdeviceauth.WithRequestTimeout(50*time.Millisecond))...)
+	var timeoutErr *traktdeviceauth.RequestTimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GenerateNewCodeContext returned %v, want a *RequestTimeoutError matching context.DeadlineExceeded", err)
+	}
+	if timeoutErr.Endpoint != traktdeviceauth.EndpointDeviceCode || timeoutErr.Timeout != 50*time.Millisecond {
+		t.Errorf("got a timeout of %v for %s, want 50ms for %s", timeoutErr.Timeout, timeoutErr.Endpoint, traktdeviceauth.EndpointDeviceCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the stalled request took %v to be aborted", elapsed)
+	}
+	if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(opts, traktdeviceauth.WithRequestTimeout(50*time.Millisecond))...); err != nil {
+		t.Fatalf("the next request failed: %v", err)
+	}
+}
+
+func TestRequestTimeoutCallerContext(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	p, _ := stallingProxy(t, srv, traktdeviceauth.EndpointDeviceCode, 2)
+	opts := append(srv.Options(), traktdeviceauth.WithBaseURL(p.URL))
+
+	// When the caller's context ends first, its error is returned as it is.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", append(opts, traktdeviceauth.WithRequestTimeout(time.Minute))...)
+	var timeoutErr *traktdeviceauth.RequestTimeoutError
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeoutErr) {
+		t.Errorf("GenerateNewCodeContext returned %v, want the context's error", err)
+	}
+
+	// Zero removes the limit, leaving the request to the caller's context.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", append(opts, traktdeviceauth.WithRequestTimeout(0))...)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeoutErr) {
+		t.Errorf("GenerateNewCodeContext without a limit returned %v, want the context's error", err)
+	}
+}
+
+func TestRequestTimeoutRetried(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	p, stalled := stallingProxy(t, srv, traktdeviceauth.EndpointDeviceCode, 1)
+
+	// Every attempt gets the full limit, so the retry succeeds after the first attempt timed out.
+	opts := append(srv.Options(), traktdeviceauth.WithBaseURL(p.URL), traktdeviceauth.WithRequestTimeout(50*time.Millisecond),
+		traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}))
+	if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...); err != nil {
+		t.Fatalf("GenerateNewCodeContext with a retry: %v", err)
+	}
+	if n := atomic.LoadInt32(stalled); n != 2 {
+		t.Errorf("%d requests were made, want 2", n)
+	}
+}
+
+func TestRequestTimeoutPolling(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+	p, _ := stallingProxy(t, srv, traktdeviceauth.EndpointDeviceToken, 1)
+	opts := append(srv.Options(), traktdeviceauth.WithBaseURL(p.URL), traktdeviceauth.WithRequestTimeout(50*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	code, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stalled poll is counted, and the loop goes on to poll again until the code is approved.
+	var stats traktdeviceauth.PollStats
+	tok, err := traktdeviceauth.PollForAuthTokenContext(ctx, code, "client-id", "client-secret", append(opts, traktdeviceauth.WithPollStats(&stats))...)
+	if err != nil {
+		t.Fatalf("PollForAuthTokenContext after a stalled poll: %v", err)
+	}
+	if tok.AccessToken == "" {
+		t.Error("no access token was returned")
+	}
+	if stats.TimedOut != 1 || stats.Polls < 2 {
+		t.Errorf("got %d polls of which %d timed out, want 1 to time out and more to follow", stats.Polls, stats.TimedOut)
+	}
+}
@@ -0,0 +1,61 @@
+package traktdeviceauth
+
+import "context"
+
+// Client makes the calls of this package for one app, so that its client id and secret and the Options for
+// every call are set once instead of being passed to every function. A program typically creates one Client
+// when it starts and shares it. A Client never changes once it has been created, so it is safe for concurrent
+// use.
+//
+// GenerateNewCodeContext, PollForAuthTokenContext, RequestTokenContext and RefreshAccessTokenContext create a
+// Client for every call, so they behave the same as its methods.
+type Client struct {
+	clientID     string
+	clientSecret []byte
+	opts         []Option
+}
+
+// NewClient creates a Client for the app identified by clientID and clientSecret, which may be empty for public
+// clients. opts apply to every call made with the Client, such as WithBaseURL to target a fake server in tests.
+func NewClient(clientID, clientSecret string, opts ...Option) *Client {
+	return &Client{clientID: clientID, clientSecret: []byte(clientSecret), opts: append([]Option(nil), opts...)}
+}
+
+// NewClientFromCredentials creates a Client for the app identified by creds, like NewClient. The Client sends
+// creds.ClientSecret from the slice instead of copying it into a string, so wiping creds with Credentials.Wipe
+// also wipes the secret from the Client, which can't authenticate anymore afterwards. Flows and token sources
+// created by the Client's methods share the secret the same way.
+func NewClientFromCredentials(creds Credentials, opts ...Option) *Client {
+	return &Client{clientID: creds.ClientID, clientSecret: creds.ClientSecret, opts: append([]Option(nil), opts...)}
+}
+
+// ClientID returns the client id of the app the Client makes calls for.
+func (cl *Client) ClientID() string {
+	return cl.clientID
+}
+
+// options returns the Client's Options followed by opts, the Options of a single call.
+func (cl *Client) options(opts []Option) []Option {
+	if len(opts) == 0 {
+		return cl.opts
+	}
+	return append(cl.opts[:len(cl.opts):len(cl.opts)], opts...)
+}
+
+// NewDeviceAuthFlow creates a DeviceAuthFlow for the Client's app, like the package-level NewDeviceAuthFlow.
+// opts apply to the flow only, after the Client's own.
+func (cl *Client) NewDeviceAuthFlow(opts ...Option) *DeviceAuthFlow {
+	return newDeviceAuthFlow(cl.credentialsOnly(), cl.options(opts))
+}
+
+// credentialsOnly returns a Client for the same app as cl without its Options, for components which keep their
+// own. The secret is shared, not copied.
+func (cl *Client) credentialsOnly() *Client {
+	return &Client{clientID: cl.clientID, clientSecret: cl.clientSecret}
+}
+
+// GetUserSettings fetches the settings of the user accessToken belongs to, like GetUserSettingsContext. opts
+// apply to this call only, after the Client's own.
+func (cl *Client) GetUserSettings(ctx context.Context, accessToken string, opts ...Option) (UserSettings, error) {
+	return GetUserSettingsContext(ctx, accessToken, cl.clientID, cl.options(opts)...)
+}
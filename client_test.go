@@ -0,0 +1,148 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	n int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.n, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClient(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "client-id", "secret"
+	transport := &countingTransport{}
+
+	// The credentials and Options are only given once, to NewClient.
+	cl := traktdeviceauth.NewClient("client-id", "secret", append(srv.Options(), traktdeviceauth.WithHTTPClient(&http.Client{Transport: transport}))...)
+	ctx := context.Background()
+	if cl.ClientID() != "client-id" {
+		t.Errorf("ClientID returned %q", cl.ClientID())
+	}
+
+	code, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cl.PollForAuthToken(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, code); err == nil {
+		t.Error("RequestToken of a code which was already used succeeded")
+	}
+	if _, err := cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := srv.Requests()
+	if n := atomic.LoadInt32(&transport.n); n != int32(len(reqs)) || n != 4 {
+		t.Errorf("%d requests went through the WithHTTPClient client and %d reached the server, want 4", n, len(reqs))
+	}
+	for _, r := range reqs {
+		var body struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}
+		if err := json.Unmarshal(r.Body, &body); err != nil || body.ClientID != "client-id" {
+			t.Errorf("the request to %s had the body %s, want the client id", r.Path, r.Body)
+		}
+		if r.Endpoint != traktdeviceauth.EndpointDeviceCode && body.ClientSecret != "secret" {
+			t.Errorf("the request to %s had the body %s, want the client secret", r.Path, r.Body)
+		}
+	}
+}
+
+func TestClientCallOptions(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	other := traktdeviceauthtest.NewServer()
+	defer other.Close()
+
+	opts := []traktdeviceauth.Option{traktdeviceauth.WithBaseURL(srv.URL)}
+	cl := traktdeviceauth.NewClient("client-id", "secret", opts...)
+	// Changing the slice passed to NewClient doesn't change the Client.
+	opts[0] = traktdeviceauth.WithBaseURL(other.URL)
+	ctx := context.Background()
+
+	// Options passed to a method apply after the Client's own, to that call only.
+	if _, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithBaseURL(other.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.GenerateNewCode(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := len(srv.Requests()), len(other.Requests()); n != 1 || m != 1 {
+		t.Errorf("%d requests went to the Client's server and %d to the one of the call, want 1 each", n, m)
+	}
+}
+
+func TestClientMatchesPackageFunctions(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.DenyAfterPolls(0))
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "secret", srv.Options()...)
+
+	code, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		method, wrapper func() error
+	}{
+		{"RequestToken", func() error {
+			_, err := cl.RequestToken(ctx, code)
+			return err
+		}, func() error {
+			_, err := traktdeviceauth.RequestTokenContext(ctx, code, "client-id", "secret", srv.Options()...)
+			return err
+		}},
+		{"PollForAuthToken", func() error {
+			_, err := cl.PollForAuthToken(ctx, code)
+			return err
+		}, func() error {
+			_, err := traktdeviceauth.PollForAuthTokenContext(ctx, code, "client-id", "secret", srv.Options()...)
+			return err
+		}},
+		{"RefreshAccessToken", func() error {
+			_, err := cl.RefreshAccessToken(ctx, "revoked")
+			return err
+		}, func() error {
+			_, err := traktdeviceauth.RefreshAccessTokenContext(ctx, "revoked", "client-id", "secret", srv.Options()...)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methodErr, wrapperErr := tt.method(), tt.wrapper()
+			if methodErr == nil || wrapperErr == nil || methodErr.Error() != wrapperErr.Error() ||
+				traktdeviceauth.Code(methodErr) != traktdeviceauth.Code(wrapperErr) {
+				t.Errorf("the method returned %v and the package function %v, want the same error", methodErr, wrapperErr)
+			}
+		})
+	}
+
+	// The package functions are wrappers which keep their error prefixes.
+	if _, err := traktdeviceauth.GenerateNewCodeContext(ctx, "", srv.Options()...); !errors.Is(err, traktdeviceauth.ErrInvalidArgument) ||
+		!strings.HasPrefix(err.Error(), "GenerateNewCode: ") {
+		t.Errorf("GenerateNewCodeContext without a client id returned %v", err)
+	}
+}
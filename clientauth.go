@@ -0,0 +1,61 @@
+package traktdeviceauth
+
+import "encoding/base64"
+
+// ClientAuthMethod is how the client id and secret are sent to the token endpoints.
+type ClientAuthMethod int
+
+const (
+	// AuthInBody sends the client id and secret as fields of the JSON body, which is what Trakt expects.
+	AuthInBody ClientAuthMethod = iota
+
+	// AuthBasicHeader sends the client id and secret in an Authorization header using HTTP Basic authentication,
+	// as described by RFC 6749 section 2.3.1. The client id is still sent in the body, but the secret isn't.
+	AuthBasicHeader
+)
+
+// WithClientAuthMethod sets how the device token and refresh requests authenticate the client, for OAuth
+// servers other than Trakt which require a method other than AuthInBody. Clients without a secret always
+// send only their id in the body.
+func WithClientAuthMethod(m ClientAuthMethod) Option {
+	return func(c *config) {
+		c.clientAuth = m
+	}
+}
+
+// authenticate returns the request fields identifying the client. The secret is sent by post: with AuthInBody,
+// authenticate sets c.bodySecret to it, and with AuthBasicHeader, it sets c.authorization to the header sent in its
+// place. client_secret is left out entirely when clientSecret is empty, as public clients have no secret and some
+// servers reject an empty one.
+func (c *config) authenticate(clientID string, clientSecret []byte) []string {
+	if len(clientSecret) == 0 {
+		return []string{"client_id", clientID}
+	}
+
+	if c.clientAuth == AuthBasicHeader {
+		// RFC 6749 requires both values to be form encoded before they are joined.
+		creds := appendFormEncoded(nil, []byte(clientID))
+		creds = appendFormEncoded(append(creds, ':'), clientSecret)
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString(creds)
+		wipeBytes(creds)
+	} else {
+		c.bodySecret = clientSecret
+	}
+	return []string{"client_id", clientID}
+}
+
+// appendFormEncoded appends b to dst encoded like url.QueryEscape does, without turning it into a string.
+func appendFormEncoded(dst, b []byte) []byte {
+	const hex = "0123456789ABCDEF"
+	for _, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			dst = append(dst, c)
+		case c == ' ':
+			dst = append(dst, '+')
+		default:
+			dst = append(dst, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	return dst
+}
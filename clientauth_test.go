@@ -0,0 +1,192 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestClientAuthMethod(t *testing.T) {
+	// Both values need form encoding before they are joined for the header.
+	const clientID, clientSecret = "id:1", "s é&+"
+	wantHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("id%3A1:s+%C3%A9%26%2B"))
+
+	tests := []struct {
+		name       string
+		method     traktdeviceauth.ClientAuthMethod
+		wantHeader string
+		wantSecret bool
+	}{
+		{"in body", traktdeviceauth.AuthInBody, "", true},
+		{"basic header", traktdeviceauth.AuthBasicHeader, wantHeader, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.ClientID, srv.ClientSecret = clientID, clientSecret
+
+			ctx := context.Background()
+			cl := traktdeviceauth.NewClient(clientID, clientSecret, append(srv.Options(), traktdeviceauth.WithClientAuthMethod(tt.method))...)
+			codeResp, err := cl.GenerateNewCode(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := cl.RequestToken(ctx, codeResp)
+			if err != nil {
+				t.Fatalf("RequestToken: %v", err)
+			}
+			if tok, err = cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+				t.Fatalf("RefreshAccessToken: %v", err)
+			}
+			if err := cl.RevokeToken(ctx, tok.AccessToken); err != nil {
+				t.Fatalf("RevokeToken: %v", err)
+			}
+
+			for _, endpoint := range []traktdeviceauth.Endpoint{traktdeviceauth.EndpointDeviceToken, traktdeviceauth.EndpointToken, traktdeviceauth.EndpointRevoke} {
+				reqs := srv.RequestsTo(endpoint)
+				if len(reqs) != 1 {
+					t.Fatalf("%d requests to %s, want 1", len(reqs), endpoint)
+				}
+				if got := reqs[0].Header.Get("Authorization"); got != tt.wantHeader {
+					t.Errorf("%s: Authorization = %q, want %q", endpoint, got, tt.wantHeader)
+				}
+
+				var body map[string]string
+				if err := json.Unmarshal(reqs[0].Body, &body); err != nil {
+					t.Fatalf("%s: %v", endpoint, err)
+				}
+				if body["client_id"] != clientID {
+					t.Errorf("%s: client_id = %q, want %q", endpoint, body["client_id"], clientID)
+				}
+				secret, ok := body["client_secret"]
+				if ok != tt.wantSecret || (ok && secret != clientSecret) {
+					t.Errorf("%s: client_secret = %q (sent: %v), want it sent: %v", endpoint, secret, ok, tt.wantSecret)
+				}
+			}
+		})
+	}
+}
+
+func TestClientAuthMethodPublicClient(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "", append(srv.Options(), traktdeviceauth.WithClientAuthMethod(traktdeviceauth.AuthBasicHeader))...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); err != nil {
+		t.Fatal(err)
+	}
+
+	req := srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)[0]
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("a public client sent Authorization %q", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["client_secret"]; ok {
+		t.Error("a public client sent a client_secret")
+	}
+}
+
+func TestServerRejectsWrongBasicCredentials(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "wrong", append(srv.Options(), traktdeviceauth.WithClientAuthMethod(traktdeviceauth.AuthBasicHeader))...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); err == nil {
+		t.Fatal("RequestToken succeeded with the wrong secret")
+	}
+	if got := srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)[0].Status; got != http.StatusForbidden {
+		t.Errorf("the server answered %d, want 403", got)
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		wantSecret bool
+	}{
+		{"public client", "", false},
+		{"confidential client", "client-secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+
+			// Both the package functions and the Client methods take the secret.
+			ctx := context.Background()
+			codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, "client-id", tt.secret, srv.Options()...)
+			if err != nil {
+				t.Fatalf("PollForAuthToken: %v", err)
+			}
+			if tok, err = traktdeviceauth.RefreshAccessTokenContext(ctx, tok.RefreshToken, "client-id", tt.secret, srv.Options()...); err != nil {
+				t.Fatalf("RefreshAccessToken: %v", err)
+			}
+			if err := traktdeviceauth.RevokeTokenContext(ctx, tok.AccessToken, "client-id", tt.secret, srv.Options()...); err != nil {
+				t.Fatalf("RevokeToken: %v", err)
+			}
+
+			cl := traktdeviceauth.NewClient("client-id", tt.secret, srv.Options()...)
+			if codeResp, err = cl.GenerateNewCode(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if tok, err = cl.RequestToken(ctx, codeResp); err != nil {
+				t.Fatalf("Client.RequestToken: %v", err)
+			}
+			if tok, err = cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+				t.Fatalf("Client.RefreshAccessToken: %v", err)
+			}
+			if err := cl.RevokeToken(ctx, tok.AccessToken); err != nil {
+				t.Fatalf("Client.RevokeToken: %v", err)
+			}
+
+			for _, endpoint := range []traktdeviceauth.Endpoint{traktdeviceauth.EndpointDeviceToken, traktdeviceauth.EndpointToken, traktdeviceauth.EndpointRevoke} {
+				reqs := srv.RequestsTo(endpoint)
+				if len(reqs) < 2 {
+					t.Fatalf("%d requests to %s, want one from each API", len(reqs), endpoint)
+				}
+				for _, req := range reqs {
+					// An empty client_secret is rejected by some servers, so the field has to be absent.
+					var body map[string]json.RawMessage
+					if err := json.Unmarshal(req.Body, &body); err != nil {
+						t.Fatalf("%s: %v", endpoint, err)
+					}
+					secret, ok := body["client_secret"]
+					if ok != tt.wantSecret {
+						t.Errorf("%s: the body %s has client_secret: %v, want %v", endpoint, req.Body, ok, tt.wantSecret)
+					}
+					if ok && string(secret) != `"`+tt.secret+`"` {
+						t.Errorf("%s: client_secret = %s, want %q", endpoint, secret, tt.secret)
+					}
+					if string(body["client_id"]) != `"client-id"` {
+						t.Errorf("%s: client_id = %s", endpoint, body["client_id"])
+					}
+				}
+			}
+		})
+	}
+}
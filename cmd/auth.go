@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/interact"
+)
+
+// runAuth authorizes an app by printing the code for the user and polling until they approve it.
+func runAuth(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api           apiFlags
+		out           outputFlags
+		tokenPath     string
+		skip          skipIfValidFlag
+		force         bool
+		refreshFirst  bool
+		validateToken bool
+		showStats     bool
+		lang          string
+		mock          mockFlag
+		save          bool
+		store         storeFlags
+	)
+
+	fs := flag.NewFlagSet("auth", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	out.register(fs)
+	store.register(fs)
+	fs.StringVar(&tokenPath, "token-file", "", "file to save the token to (printed if empty)")
+	fs.BoolVar(&save, "save", false, "save the token to token.json in the user config directory instead of printing it")
+	fs.Var(&skip, "skip-if-valid", "reuse the token in --token-file instead of authorizing again if it is valid for at least the given `duration`, such as 720h")
+	fs.BoolVar(&force, "force", false, "authorize again even if --skip-if-valid would reuse the stored token")
+	fs.BoolVar(&refreshFirst, "refresh-first", false, "with --skip-if-valid, refresh a stored token which isn't valid for long enough without asking")
+	fs.BoolVar(&validateToken, "validate-token", false, "with --skip-if-valid, check the stored token with Trakt before reusing it")
+	fs.BoolVar(&showStats, "stats", false, "print how long the flow took and how many polls it needed to stderr once it ends")
+	fs.StringVar(&lang, "lang", "", "language of the instructions for the user, such as de or pt-BR (en, de, fr, es, pt and it are available)")
+	fs.Var(&mock, "mock", "authorize against a fake Trakt API started in-process, which approves the code (the default), denies it or lets it expire: approve, deny or expire[:duration]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+	if err := store.validate(); err != nil {
+		return err
+	}
+	if store.external() && (tokenPath != "" || save || skip.set || mock.scenario != "") {
+		return usageError("--token-file, --save, --skip-if-valid and --mock can't be used with --store " + store.kind)
+	}
+	if store.encrypted() && skip.set {
+		return usageError("--skip-if-valid can't be used with --store encrypted-file")
+	}
+	if mock.scenario != "" && (tokenPath != "" || save || out.writesFiles()) {
+		// A fake token must never replace a real one.
+		return usageError("--mock can't be used with --token-file, --save or --output to a file")
+	}
+	tokenPath, err := saveTarget(save, tokenPath)
+	if err != nil {
+		return err
+	}
+	if skip.set && tokenPath == "" {
+		return usageError("--skip-if-valid needs --token-file or --save")
+	}
+	if store.encrypted() && tokenPath == "" {
+		return usageError("--store encrypted-file needs --token-file or --save")
+	}
+
+	if skip.set && !force {
+		done, err := reuseStoredToken(ctx, &api, &out, tokenPath, skip.min, refreshFirst, validateToken, stdin, stdout, stderr)
+		if done || err != nil {
+			return err
+		}
+	}
+
+	messages := out.messages(stdout, stderr)
+	var mockOpts []traktdeviceauth.Option
+	if mock.scenario != "" {
+		var stop func()
+		mockOpts, stop = mock.start(&api, messages)
+		defer stop()
+	}
+	if err := api.prompt(stdin, messages, true); err != nil {
+		return err
+	}
+	if err := store.unlock(&api, stdin, messages); err != nil {
+		return err
+	}
+
+	var stats traktdeviceauth.PollStats
+	opts := append(api.options(), mockOpts...)
+	tR, err := interact.Run(ctx, stdin, messages, api.clientID, api.clientSecret,
+		interact.WithClientOptions(append(opts, traktdeviceauth.WithPollStats(&stats))...),
+		interact.WithLanguage(lang),
+	)
+	if showStats && !stats.StartedAt.IsZero() {
+		printStats(stderr, stats)
+	}
+	if err != nil {
+		if mock.scenario != "" {
+			return fmt.Errorf("%s: %w", mockWatermark, err)
+		}
+		return err
+	}
+
+	if err := deliverToken(ctx, &api, &out, &store, tokenPath, stdout, messages, tR); err != nil {
+		return err
+	}
+	if mock.scenario != "" {
+		fmt.Fprintf(messages, "%s: this token is fake and won't work with Trakt.\n", mockWatermark)
+	}
+	return nil
+}
+
+// deliverToken saves t to the --store if it is external or encrypted, and writes it to the token file at tokenPath
+// and the --output destinations otherwise, or as well if there are any.
+func deliverToken(ctx context.Context, api *apiFlags, out *outputFlags, store *storeFlags, tokenPath string, stdout, messages io.Writer, t traktdeviceauth.TokenResponse) error {
+	if store.external() || store.encrypted() {
+		ts, err := store.open(tokenPath, out.backups, api.clientID)
+		if err != nil {
+			return err
+		}
+		if err := ts.Save(ctx, t); err != nil {
+			return fmt.Errorf("saving the token to %s: %w", store.describe(tokenPath), err)
+		}
+		fmt.Fprintf(messages, "Saved the token to %s.\n", store.describe(tokenPath))
+		if len(out.outputs) == 0 {
+			return nil
+		}
+		tokenPath = ""
+	}
+	return out.output(stdout, messages, tokenPath, t)
+}
+
+// reuseStoredToken prints the token stored at path if it is valid for at least minRemaining, or refreshes it if it
+// isn't but has a refresh token, with the user's permission unless refreshFirst is set. done is false if a new
+// token has to be authorized instead.
+func reuseStoredToken(ctx context.Context, api *apiFlags, out *outputFlags, path string, minRemaining time.Duration, refreshFirst, validate bool, stdin io.Reader, stdout, stderr io.Writer) (done bool, err error) {
+	t, err := traktdeviceauth.LoadTokenFromFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if remaining := time.Until(t.ExpiresAt); remaining > 0 && remaining >= minRemaining {
+		if validate {
+			if err := api.prompt(stdin, stderr, false); err != nil {
+				return false, err
+			}
+			_, err := traktdeviceauth.GetUserSettingsContext(ctx, t.AccessToken, api.clientID, api.options()...)
+			if errors.Is(err, traktdeviceauth.ErrInvalidAccessToken) {
+				fmt.Fprintln(stderr, "The stored token has been revoked, authorizing again.")
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+		}
+
+		return true, out.output(stdout, stderr, "", t)
+	}
+
+	if t.RefreshToken == "" {
+		return false, nil
+	}
+	if !refreshFirst {
+		if api.noInput {
+			return false, nil
+		}
+		answer := interact.Input(bufio.NewScanner(stdin), stderr, "The stored token expires at "+t.ExpiresAt.Format(time.RFC1123)+". Refresh it instead of authorizing again? [Y/n] ")
+		if answer := strings.ToLower(answer); answer != "" && answer != "y" && answer != "yes" {
+			return false, nil
+		}
+	}
+
+	if err := api.prompt(stdin, stderr, true); err != nil {
+		return false, err
+	}
+	refreshed, err := traktdeviceauth.RefreshAccessTokenContext(ctx, t.RefreshToken, api.clientID, api.clientSecret, api.options()...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, err
+		}
+		fmt.Fprintf(stderr, "Refreshing the stored token failed (%v), authorizing again.\n", err)
+		return false, nil
+	}
+
+	fmt.Fprintln(stderr, "Refreshed the stored token.")
+	return true, out.output(stdout, stderr, path, refreshed)
+}
+
+// skipIfValidFlag is the value of --skip-if-valid, which can be given with or without a duration.
+type skipIfValidFlag struct {
+	set bool
+	min time.Duration
+}
+
+func (f *skipIfValidFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return f.min.String()
+}
+
+func (f *skipIfValidFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.set, f.min = true, 0
+	case "false":
+		f.set, f.min = false, 0
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.set, f.min = true, d
+	}
+	return nil
+}
+
+// IsBoolFlag allows --skip-if-valid to be given without a value.
+func (f *skipIfValidFlag) IsBoolFlag() bool {
+	return true
+}
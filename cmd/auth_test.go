@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestAuthSkipIfValid(t *testing.T) {
+	t.Setenv("CI", "")
+
+	tests := []struct {
+		name        string
+		expiresIn   time.Duration // Of the stored token, which is absent if 0.
+		refreshable bool
+		unknown     bool // The stored token wasn't issued by the server.
+		args        []string
+		stdin       string
+		wantReuse   bool
+		wantRefresh bool
+	}{
+		{name: "valid", expiresIn: 1000 * time.Hour, args: []string{"--skip-if-valid=720h"}, wantReuse: true},
+		{name: "valid without a minimum", expiresIn: time.Minute, args: []string{"--skip-if-valid"}, wantReuse: true},
+		{name: "valid with --force", expiresIn: 1000 * time.Hour, args: []string{"--skip-if-valid=720h", "--force"}},
+		{name: "validated", expiresIn: 1000 * time.Hour, args: []string{"--skip-if-valid=720h", "--validate-token"}, wantReuse: true},
+		{name: "revoked", expiresIn: 1000 * time.Hour, unknown: true, args: []string{"--skip-if-valid=720h", "--validate-token"}},
+		{name: "near expiry", expiresIn: time.Hour, args: []string{"--skip-if-valid=720h"}},
+		{name: "near expiry with --refresh-first", expiresIn: time.Hour, refreshable: true, args: []string{"--skip-if-valid=720h", "--refresh-first"}, wantRefresh: true},
+		{name: "expired and refresh accepted", expiresIn: -time.Hour, refreshable: true, args: []string{"--skip-if-valid", "--no-input=false"}, stdin: "y\n", wantRefresh: true},
+		{name: "expired and refresh accepted by default", expiresIn: -time.Hour, refreshable: true, args: []string{"--skip-if-valid", "--no-input=false"}, stdin: "\n", wantRefresh: true},
+		{name: "expired and refresh declined", expiresIn: -time.Hour, refreshable: true, args: []string{"--skip-if-valid", "--no-input=false"}, stdin: "n\n"},
+		{name: "expired refresh fails", expiresIn: -time.Hour, refreshable: true, unknown: true, args: []string{"--skip-if-valid", "--refresh-first"}},
+		{name: "absent", args: []string{"--skip-if-valid=720h"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Interval = 1
+
+			path := filepath.Join(t.TempDir(), "token.json")
+			var stored traktdeviceauth.TokenResponse
+			if tt.expiresIn != 0 {
+				stored = traktdeviceauth.TokenResponse{AccessToken: "unknown-access", ExpiresAt: time.Now().Add(tt.expiresIn)}
+				if !tt.unknown {
+					issued := srv.IssueToken()
+					stored.AccessToken = issued.AccessToken
+					if tt.refreshable {
+						stored.RefreshToken = issued.RefreshToken
+					}
+				} else if tt.refreshable {
+					stored.RefreshToken = "unknown-refresh"
+				}
+				if err := traktdeviceauth.NewFileTokenStore(path).Save(context.Background(), stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			args := append([]string{"auth", "--token-file", path, "--format", "json", "--client-id", "client-id", "--client-secret", "client-secret",
+				"--base-url", srv.URL, "--no-input"}, tt.args...)
+			var stdout, stderr strings.Builder
+			if err := run(ctx, args, strings.NewReader(tt.stdin), &stdout, &stderr); err != nil {
+				t.Fatalf("auth: %v\n%s", err, stderr.String())
+			}
+
+			codes := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode))
+			refreshes := len(srv.RequestsTo(traktdeviceauth.EndpointToken))
+			switch {
+			case tt.wantReuse:
+				if codes != 0 || refreshes != 0 {
+					t.Errorf("%d codes and %d refreshes, want the stored token reused", codes, refreshes)
+				}
+				if !strings.Contains(stdout.String(), stored.AccessToken) {
+					t.Errorf("auth printed %q, want the stored token", stdout.String())
+				}
+			case tt.wantRefresh:
+				if codes != 0 || refreshes != 1 {
+					t.Errorf("%d codes and %d refreshes, want the stored token refreshed", codes, refreshes)
+				}
+			default:
+				if codes != 1 {
+					t.Errorf("%d codes were generated, want a new device flow", codes)
+				}
+				if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); !tt.unknown && n != 0 {
+					t.Errorf("%d refreshes, want none", n)
+				}
+			}
+
+			saved, err := traktdeviceauth.LoadTokenFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := saved.AccessToken != stored.AccessToken; replaced == tt.wantReuse {
+				t.Errorf("the token file was replaced: %v, want %v", replaced, !tt.wantReuse)
+			}
+		})
+	}
+}
+
+func TestAuthSkipIfValidNeedsTokenFile(t *testing.T) {
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"auth", "--skip-if-valid", "--client-id", "client-id", "--client-secret", "client-secret", "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if got := exitCode(err); got != exitUsage {
+		t.Fatalf("exited with %d (%v), want %d", got, err, exitUsage)
+	}
+}
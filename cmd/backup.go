@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+const (
+	// defaultBackups is how many backups of a token file are kept unless --backups says otherwise.
+	defaultBackups = 3
+
+	// backupsUsage is the usage of --backups, which every command overwriting a token file has.
+	backupsUsage = "how many timestamped backups of the token file to keep next to it when it is overwritten, which restore rolls back to (none if 0)"
+
+	// backupTimeFormat is the format of the timestamps in the names of backups, which sort in the order the
+	// backups were taken.
+	backupTimeFormat = "20060102T150405.000000Z"
+
+	// backupExt is the extension of backups, which are named <token file>.<timestamp>.bak.
+	backupExt = ".bak"
+)
+
+// tokenBackup is a backup of a token file.
+type tokenBackup struct {
+	path  string
+	stamp string // The timestamp in the name, which restore --backup selects the backup by.
+	taken time.Time
+}
+
+// saveTokenFile saves t to path like SaveToFile, after copying the file already at path, if any, to a new
+// backup and removing all but the newest keep backups. No backups are taken if keep is 0. The file isn't
+// overwritten if it can't be backed up.
+func saveTokenFile(path string, t traktdeviceauth.TokenResponse, keep int) error {
+	if keep > 0 {
+		if err := backupTokenFile(path, time.Now(), keep); err != nil {
+			return fmt.Errorf("backing up %s before overwriting it: %w", path, err)
+		}
+	}
+	return t.SaveToFile(path)
+}
+
+// backupTokenFile copies the file at path to a backup taken at now, unless there is no such file, and prunes
+// the backups down to the newest keep. Backups are only readable by the current user, like the token file.
+func backupTokenFile(path string, now time.Time, keep int) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	name := path + "." + now.UTC().Format(backupTimeFormat) + backupExt
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		// The backup is what's left if writing the token file goes wrong, so it has to reach the disk first.
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	return pruneBackups(path, keep)
+}
+
+// pruneBackups removes all but the newest keep backups of the token file at path.
+func pruneBackups(path string, keep int) error {
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	for _, b := range backups[keep:] {
+		if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackups returns the backups of the token file at path, newest first. Files which only look like backups
+// are ignored.
+func listBackups(path string) ([]tokenBackup, error) {
+	dir, base := filepath.Split(path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []tokenBackup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, base+".") || !strings.HasSuffix(name, backupExt) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), backupExt)
+		taken, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, tokenBackup{path: filepath.Join(dir, name), stamp: stamp, taken: taken})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+	return backups, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// versionToken is the n-th version of a token file in the backup tests.
+func versionToken(n int) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  fmt.Sprintf("access-%d", n),
+		RefreshToken: fmt.Sprintf("refresh-%d", n),
+		ExpiresAt:    time.Date(2024, 6, n, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// backupTokens loads the token of every backup of path, newest first.
+func backupTokens(t *testing.T, path string) []string {
+	t.Helper()
+
+	backups, err := listBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, b := range backups {
+		tok, err := traktdeviceauth.LoadTokenFromFile(b.path)
+		if err != nil {
+			t.Fatalf("backup %s: %v", b.stamp, err)
+		}
+		tokens = append(tokens, tok.AccessToken)
+		if info, err := os.Stat(b.path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+			t.Errorf("backup %s has mode %v (%v), want 0600 like the token file", b.stamp, info.Mode().Perm(), err)
+		}
+	}
+	return tokens
+}
+
+func TestSaveTokenFileBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	for n := 1; n <= 5; n++ {
+		if err := saveTokenFile(path, versionToken(n), 3); err != nil {
+			t.Fatal(err)
+		}
+		// The timestamps have a resolution of a microsecond.
+		time.Sleep(time.Millisecond)
+	}
+
+	if got, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || got.AccessToken != "access-5" {
+		t.Errorf("the token file holds %+v (%v), want the last version", got, err)
+	}
+	// The first save had nothing to back up, and only the newest 3 of the other 4 backups are kept.
+	want := []string{"access-4", "access-3", "access-2"}
+	if got := backupTokens(t, path); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("the backups hold %v, want %v", got, want)
+	}
+
+	// Fewer backups are kept once --backups is lowered, and none are taken with 0.
+	if err := saveTokenFile(path, versionToken(6), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := backupTokens(t, path); len(got) != 1 || got[0] != "access-5" {
+		t.Errorf("the backups hold %v after keeping 1, want [access-5]", got)
+	}
+	if err := saveTokenFile(path, versionToken(7), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := backupTokens(t, path); len(got) != 1 || got[0] != "access-5" {
+		t.Errorf("the backups hold %v after saving without backups, want them unchanged", got)
+	}
+}
+
+func TestListBackupsIgnoresLookalikes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token.json")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := versionToken(1).SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := backupTokenFile(path, now.Add(time.Duration(i)*time.Hour), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"token.json.bak", "token.json.yesterday.bak", "other.json.20240601T120000.000000Z.bak", "token.json.20240601T120000.000000Z"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].stamp != "20240601T130000.000000Z" || backups[1].stamp != "20240601T120000.000000Z" {
+		t.Errorf("listBackups returned %+v, want the 2 backups, newest first", backups)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	for n := 1; n <= 3; n++ {
+		if err := saveTokenFile(path, versionToken(n), 3); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	backups, err := listBackups(path)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("%d backups (%v), want 2", len(backups), err)
+	}
+
+	restore := func(args ...string) (string, error) {
+		var stdout, stderr strings.Builder
+		err := run(context.Background(), append([]string{"restore", "--token-file", path}, args...), strings.NewReader(""), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	out, err := restore("--list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "BACKUP") || !strings.HasPrefix(lines[1], backups[0].stamp) ||
+		!strings.Contains(lines[1], versionToken(2).ExpiresAt.Format(time.RFC1123)) {
+		t.Errorf("restore --list printed:\n%s\nwant the 2 backups, newest first", out)
+	}
+
+	// Restoring the oldest backup rolls the token file back to the first version, and backs up the third.
+	if _, err := restore("--backup", backups[1].stamp); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || got.AccessToken != "access-1" {
+		t.Errorf("the token file holds %+v (%v) after the restore, want the first version", got, err)
+	}
+	if got := backupTokens(t, path); len(got) != 3 || got[0] != "access-3" {
+		t.Errorf("the backups hold %v, want the replaced version backed up first", got)
+	}
+
+	// Without --backup, the newest backup is restored, which undoes the restore.
+	time.Sleep(time.Millisecond)
+	if _, err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || got.AccessToken != "access-3" {
+		t.Errorf("the token file holds %+v (%v) after restoring the newest backup, want the third version", got, err)
+	}
+
+	if _, err := restore("--backup", "20000101T000000.000000Z"); exitCode(err) != exitUsage {
+		t.Errorf("restoring a backup which doesn't exist returned %v, want a usage error", err)
+	}
+}
+
+func TestRestoreCorruptedBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := saveTokenFile(path, versionToken(1), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTokenFile(path, versionToken(2), 3); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := listBackups(path)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("%d backups (%v), want 1", len(backups), err)
+	}
+	// A partial write, like one cut short by a full disk.
+	if err := os.WriteFile(backups[0].path, []byte(`{"access_token":"acc`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr strings.Builder
+	err = run(context.Background(), []string{"restore", "--token-file", path}, strings.NewReader(""), &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "can't be restored") {
+		t.Errorf("restoring a corrupted backup returned %v", err)
+	}
+	if got, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || got.AccessToken != "access-2" {
+		t.Errorf("the token file holds %+v (%v), want it untouched", got, err)
+	}
+
+	stdout.Reset()
+	if err := run(context.Background(), []string{"restore", "--token-file", path, "--list"}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "unreadable") {
+		t.Errorf("restore --list printed:\n%s\nwant the corrupted backup marked as unreadable", stdout.String())
+	}
+}
+
+func TestRestoreWithoutBackups(t *testing.T) {
+	path := saveToken(t, versionToken(1))
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"restore", "--token-file", path}, strings.NewReader(""), &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "no backups") {
+		t.Errorf("restore without backups returned %v", err)
+	}
+}
+
+func TestRefreshBacksUp(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+	path := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken})
+
+	// Every refresh rewrites the token file, and only the newest 2 of the replaced versions are kept.
+	var replaced []string
+	for i := 0; i < 3; i++ {
+		// Bring the expiry close again, without a backup, so the next wait refreshes the token.
+		tok, err := traktdeviceauth.LoadTokenFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok.ExpiresAt = time.Now().Add(time.Minute)
+		if err := tok.SaveToFile(path); err != nil {
+			t.Fatal(err)
+		}
+		replaced = append([]string{tok.AccessToken}, replaced...)
+
+		var stdout, stderr strings.Builder
+		err = run(context.Background(), []string{"wait", "--token-file", path, "--min-validity", "48h", "--refresh", "--backups", "2",
+			"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"},
+			strings.NewReader(""), &stdout, &stderr)
+		if err != nil {
+			t.Fatalf("wait --refresh: %v\n%s", err, stderr.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := backupTokens(t, path); strings.Join(got, " ") != strings.Join(replaced[:2], " ") {
+		t.Errorf("the backups hold %v, want %v", got, replaced[:2])
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// credentialsDirEnv is set by systemd to the directory holding the credentials passed to a unit with
+// LoadCredential= or SetCredential=.
+const credentialsDirEnv = "CREDENTIALS_DIRECTORY"
+
+// credentialPath returns the path of the systemd credential called name. ok is false if CREDENTIALS_DIRECTORY
+// isn't set, which means the program isn't running as a unit with credentials.
+func credentialPath(name string) (path string, ok bool, err error) {
+	dir := os.Getenv(credentialsDirEnv)
+	if dir == "" {
+		return "", false, nil
+	}
+	if name == "" || strings.ContainsRune(name, '/') || name == "." || name == ".." {
+		return "", false, usageError("%q isn't a valid credential name", name)
+	}
+	return filepath.Join(dir, name), true, nil
+}
+
+// readCredential returns the systemd credential called name without surrounding whitespace, such as the
+// newline of a file written with echo. ok is false if name is empty, or CREDENTIALS_DIRECTORY isn't set or has
+// no such credential.
+func readCredential(name string) (value string, ok bool, err error) {
+	if name == "" {
+		return "", false, nil
+	}
+	path, ok, err := credentialPath(name)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("reading credential %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), true, nil
+}
+
+// seedTokenFile copies the token in the systemd credential called name to path, unless path already exists.
+// Credentials are read-only, so the copy is the one which gets refreshed.
+func seedTokenFile(path, name string) error {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	credPath, ok, err := credentialPath(name)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s doesn't exist and %s isn't set to read credential %s from", path, credentialsDirEnv, name)
+	}
+	t, err := traktdeviceauth.LoadTokenFromFile(credPath)
+	if err != nil {
+		return fmt.Errorf("reading credential %s: %w", name, err)
+	}
+	return t.SaveToFile(path)
+}
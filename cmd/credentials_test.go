@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// writeCredentials creates a directory standing in for CREDENTIALS_DIRECTORY, holding the credentials in creds.
+func writeCredentials(t *testing.T, creds map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, value := range creds {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCredentialPrecedence(t *testing.T) {
+	t.Setenv("CI", "")
+	dir := writeCredentials(t, map[string]string{
+		"trakt-client-id":     "cred-id",
+		"trakt-client-secret": "cred-secret\n", // Written with echo.
+		"other-id":            "other-id",
+	})
+
+	tests := []struct {
+		name       string
+		credDir    string
+		args       []string
+		wantID     string
+		wantSecret string
+		wantUsage  bool
+	}{
+		{"flags win", dir, []string{"--client-id", "flag-id", "--client-secret", "flag-secret"}, "flag-id", "flag-secret", false},
+		{"secret command before credentials", dir, []string{"--client-secret-cmd", `printf 'cmd-secret\n'`}, "cred-id", "cmd-secret", false},
+		{"credentials", dir, nil, "cred-id", "cred-secret", false},
+		{"credentials fill in what flags don't", dir, []string{"--client-id", "flag-id"}, "flag-id", "cred-secret", false},
+		{"renamed credential", dir, []string{"--client-id-credential", "other-id"}, "other-id", "cred-secret", false},
+		{"disabled credentials", dir, []string{"--client-id-credential", "", "--client-secret-credential", ""}, "prompted-id", "prompted-secret", false},
+		{"missing credentials", dir, []string{"--client-id-credential", "missing-id", "--client-secret-credential", "missing-secret"}, "prompted-id", "prompted-secret", false},
+		{"without a credentials directory", "", nil, "prompted-id", "prompted-secret", false},
+		{"missing credentials with --no-input", dir, []string{"--client-id-credential", "missing-id", "--no-input"}, "", "", true},
+		{"invalid credential name", dir, []string{"--client-secret-credential", "../trakt-client-secret"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(credentialsDirEnv, tt.credDir)
+
+			var api apiFlags
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			api.register(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := api.prompt(strings.NewReader("prompted-id\nprompted-secret\n"), io.Discard, true)
+			if tt.wantUsage {
+				if exitCode(err) != exitUsage {
+					t.Errorf("prompt returned %v, want a usage error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if api.clientID != tt.wantID || api.clientSecret != tt.wantSecret {
+				t.Errorf("got %q and %q, want %q and %q", api.clientID, api.clientSecret, tt.wantID, tt.wantSecret)
+			}
+		})
+	}
+}
+
+func TestSeedTokenFile(t *testing.T) {
+	stored := traktdeviceauth.TokenResponse{AccessToken: "cred-access", RefreshToken: "cred-refresh", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	dir := t.TempDir()
+	if err := stored.SaveToFile(filepath.Join(dir, "trakt-token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "garbage"), []byte("not a token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("copied", func(t *testing.T) {
+		t.Setenv(credentialsDirEnv, dir)
+		path := filepath.Join(t.TempDir(), "token.json")
+		if err := seedTokenFile(path, "trakt-token"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := traktdeviceauth.LoadTokenFromFile(path)
+		if err != nil || got.AccessToken != stored.AccessToken || !got.ExpiresAt.Equal(stored.ExpiresAt) {
+			t.Errorf("the token file holds %+v (%v), want the credential", got, err)
+		}
+	})
+
+	t.Run("existing token file", func(t *testing.T) {
+		t.Setenv(credentialsDirEnv, dir)
+		// The token file has been refreshed since, so it wins over the credential.
+		refreshed := traktdeviceauth.TokenResponse{AccessToken: "refreshed", RefreshToken: "refreshed", ExpiresAt: time.Now().Add(24 * time.Hour)}
+		path := saveToken(t, refreshed)
+		if err := seedTokenFile(path, "trakt-token"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || got.AccessToken != "refreshed" {
+			t.Errorf("the token file holds %+v (%v), want it untouched", got, err)
+		}
+	})
+
+	errTests := []struct {
+		name    string
+		credDir string
+		cred    string
+		want    string
+	}{
+		{"without a credentials directory", "", "trakt-token", credentialsDirEnv + " isn't set"},
+		{"missing credential", dir, "missing", "reading credential missing"},
+		{"not a token", dir, "garbage", "reading credential garbage"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(credentialsDirEnv, tt.credDir)
+			path := filepath.Join(t.TempDir(), "token.json")
+			err := seedTokenFile(path, tt.cred)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("seedTokenFile returned %v, want an error containing %q", err, tt.want)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("a failed copy created the token file: %v", err)
+			}
+		})
+	}
+}
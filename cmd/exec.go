@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// errExecUnsupported is returned by execReplace on platforms where a process can't replace itself.
+var errExecUnsupported = errors.New("exec is not supported on this platform")
+
+// runExec makes sure the token in --token-file is valid, refreshing it if needed, and then runs the command
+// after -- with the token in its environment. The command isn't run if no valid token can be produced.
+func runExec(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api           apiFlags
+		tokenPath     string
+		minValid      time.Duration
+		exportRefresh bool
+		exportExpiry  bool
+		backups       int
+		store         storeFlags
+	)
+
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	store.register(fs)
+	fs.StringVar(&tokenPath, "token-file", "", "file holding the token, which is updated if it has to be refreshed (default: token.json in the user config directory)")
+	fs.DurationVar(&minValid, "min-valid", 5*time.Minute, "refresh the token first if it expires within this `duration`")
+	fs.BoolVar(&exportRefresh, "export-refresh-token", false, "also set TRAKT_REFRESH_TOKEN for the command")
+	fs.BoolVar(&exportExpiry, "export-expiry", false, "also set TRAKT_TOKEN_EXPIRES_AT for the command, in RFC 3339 format")
+	fs.IntVar(&backups, "backups", defaultBackups, backupsUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if err := store.validate(); err != nil {
+		return err
+	}
+	if store.external() && tokenPath != "" {
+		return usageError("--token-file can't be used with --store " + store.kind)
+	}
+	tokenPath, err := tokenFileOrDefault(tokenPath)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError("missing the command to run, which goes after --")
+	}
+	if backups < 0 {
+		return usageError("--backups can't be negative")
+	}
+
+	if store.needsClientID() {
+		if err := api.prompt(stdin, stderr, false); err != nil {
+			return err
+		}
+	}
+	if err := store.unlock(&api, stdin, stderr); err != nil {
+		return err
+	}
+	ts, err := store.open(tokenPath, backups, api.clientID)
+	if err != nil {
+		return err
+	}
+	t, err := ensureValidToken(ctx, &api, ts, store.describe(tokenPath), minValid, stdin, stderr)
+	if err != nil {
+		return err
+	}
+
+	env := append(os.Environ(), "TRAKT_ACCESS_TOKEN="+t.AccessToken)
+	if exportRefresh {
+		env = append(env, "TRAKT_REFRESH_TOKEN="+t.RefreshToken)
+	}
+	if exportExpiry {
+		env = append(env, "TRAKT_TOKEN_EXPIRES_AT="+t.ExpiresAt.Format(time.RFC3339))
+	}
+
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Replacing the process passes the standard streams and signals straight to the command, but it is only
+	// possible if they are this process's own.
+	if stdin == os.Stdin && stdout == os.Stdout && stderr == os.Stderr {
+		if err := execReplace(path, fs.Args(), env); !errors.Is(err, errExecUnsupported) {
+			return err
+		}
+	}
+	return execChild(path, fs.Args(), env, stdin, stdout, stderr)
+}
+
+// ensureValidToken loads the token from store, described by name in messages, and returns it if it is valid for
+// at least minValid. Otherwise it is refreshed and saved back to store, or an error is returned if it can't be.
+func ensureValidToken(ctx context.Context, api *apiFlags, store traktdeviceauth.TokenStore, name string, minValid time.Duration, stdin io.Reader, stderr io.Writer) (traktdeviceauth.TokenResponse, error) {
+	t, err := store.Load(ctx)
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, err
+	}
+	if time.Until(t.ExpiresAt) >= minValid {
+		return t, nil
+	}
+	if t.RefreshToken == "" {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("the token in %s expires at %s and has no refresh token, run auth again", name, t.ExpiresAt.Format(time.RFC1123))
+	}
+
+	if err := api.prompt(stdin, stderr, true); err != nil {
+		return traktdeviceauth.TokenResponse{}, err
+	}
+	refreshed, err := traktdeviceauth.RefreshAccessTokenContext(ctx, t.RefreshToken, api.clientID, api.clientSecret, api.options()...)
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("refreshing the token in %s: %w", name, err)
+	}
+	if err := store.Save(ctx, refreshed); err != nil {
+		return traktdeviceauth.TokenResponse{}, err
+	}
+	return refreshed, nil
+}
+
+// execChild runs the command at path as a subprocess, relaying SIGINT and SIGTERM to it, and returns an
+// exitError with its exit code if it doesn't succeed.
+func execChild(path string, argv, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := &exec.Cmd{Path: path, Args: argv, Env: env, Stdin: stdin, Stdout: stdout, Stderr: stderr}
+
+	// Registering also stops the signals from killing this process before the command has exited.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				// Windows can't deliver signals to other processes, so the error is ignored there.
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			// The command was killed by a signal, which shells report as 128 plus the signal number.
+			code = 128 + signalNumber(exitErr)
+		}
+		return &exitError{code: code}
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os/exec"
+
+// execReplace always returns errExecUnsupported, since the process can't be replaced on this platform.
+func execReplace(path string, argv, env []string) error {
+	return errExecUnsupported
+}
+
+// signalNumber returns 0, since processes aren't killed by numbered signals on this platform.
+func signalNumber(err *exec.ExitError) int {
+	return 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// execHelperEnv makes TestExecHelperProcess act as a command instead of a test when it is set.
+const execHelperEnv = "TRAKTAUTH_EXEC_HELPER"
+
+// helperCommand returns the command line which runs this test binary as a helper, see TestExecHelperProcess.
+func helperCommand(t *testing.T, mode string, args ...string) []string {
+	t.Setenv(execHelperEnv, "1")
+	return append([]string{os.Args[0], "-test.run=^TestExecHelperProcess$", "--", mode}, args...)
+}
+
+// TestExecHelperProcess isn't a real test. It is the command run by exec in the tests, doing what the mode
+// after -- asks for:
+//
+//	env CODE       print the token variables, copy stdin to stdout, write to stderr and exit with CODE
+//	touch PATH     create the file at PATH
+//	pid            print the process id
+//	signal CODE    print "ready" and exit with CODE once SIGINT or SIGTERM arrives
+//	die            print "ready" and wait to be killed by a signal
+//	traktauth ARGS run the program with ARGS
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv(execHelperEnv) == "" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+
+	switch args[0] {
+	case "env":
+		for _, name := range []string{"TRAKT_ACCESS_TOKEN", "TRAKT_REFRESH_TOKEN", "TRAKT_TOKEN_EXPIRES_AT"} {
+			if v, ok := os.LookupEnv(name); ok {
+				fmt.Printf("%s=%s\n", name, v)
+			}
+		}
+		io.Copy(os.Stdout, os.Stdin)
+		fmt.Fprint(os.Stderr, "to stderr")
+		code, _ := strconv.Atoi(args[1])
+		os.Exit(code)
+	case "touch":
+		os.WriteFile(args[1], nil, 0o600)
+	case "pid":
+		fmt.Print(os.Getpid())
+	case "signal":
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		fmt.Println("ready")
+		<-signals
+		code, _ := strconv.Atoi(args[1])
+		os.Exit(code)
+	case "die":
+		fmt.Println("ready")
+		time.Sleep(time.Minute)
+	case "traktauth":
+		os.Args = append([]string{"traktauth"}, args[1:]...)
+		main()
+	}
+	os.Exit(0)
+}
+
+func TestExec(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tok := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	tokenPath := saveToken(t, tok)
+	expiresAt := "TRAKT_TOKEN_EXPIRES_AT=" + tok.ExpiresAt.Format(time.RFC3339) + "\n"
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"access token only", nil, "TRAKT_ACCESS_TOKEN=access\n"},
+		{"refresh token", []string{"--export-refresh-token"}, "TRAKT_ACCESS_TOKEN=access\nTRAKT_REFRESH_TOKEN=refresh\n"},
+		{"expiry", []string{"--export-expiry"}, "TRAKT_ACCESS_TOKEN=access\n" + expiresAt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"exec", "--token-file", tokenPath, "--no-input"}, tt.flags...), "--")
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append(args, helperCommand(t, "env", "0")...), strings.NewReader("from stdin"), &stdout, &stderr)
+			if err != nil {
+				t.Fatalf("exec: %v\n%s", err, stderr.String())
+			}
+			if want := tt.want + "from stdin"; stdout.String() != want {
+				t.Errorf("the command printed %q, want %q", stdout.String(), want)
+			}
+			if stderr.String() != "to stderr" {
+				t.Errorf("the command's stderr is %q", stderr.String())
+			}
+		})
+	}
+}
+
+func TestExecExitCode(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)})
+
+	for _, code := range []int{0, 1, 7, 125} {
+		var stdout, stderr strings.Builder
+		err := run(context.Background(), append([]string{"exec", "--token-file", tokenPath, "--no-input", "--"}, helperCommand(t, "env", strconv.Itoa(code))...),
+			strings.NewReader(""), &stdout, &stderr)
+		if got := exitCode(err); got != code {
+			t.Errorf("the command exited with %d, exec returned %v which exits with %d", code, err, got)
+		}
+	}
+}
+
+func TestExecRefreshesFirst(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)})
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), append([]string{"exec", "--token-file", tokenPath, "--min-valid", "10m",
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input", "--"}, helperCommand(t, "env", "0")...),
+		strings.NewReader(""), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("exec: %v\n%s", err, stderr.String())
+	}
+
+	saved, err := traktdeviceauth.NewFileTokenStore(tokenPath).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == issued.AccessToken {
+		t.Fatal("the refreshed token wasn't saved")
+	}
+	if want := "TRAKT_ACCESS_TOKEN=" + saved.AccessToken + "\n"; stdout.String() != want {
+		t.Errorf("the command printed %q, want %q", stdout.String(), want)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refresh requests, want 1", n)
+	}
+}
+
+func TestExecWithoutValidToken(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		tokenPath string
+		want      error
+	}{
+		{"missing token file", filepath.Join(t.TempDir(), "missing.json"), os.ErrNotExist},
+		{"expired without refresh token", saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(-time.Hour)}), nil},
+		{"refresh rejected", saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "unknown", ExpiresAt: time.Now().Add(-time.Hour)}), traktdeviceauth.ErrInvalidGrant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "ran")
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append([]string{"exec", "--token-file", tt.tokenPath,
+				"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input", "--"}, helperCommand(t, "touch", marker)...),
+				strings.NewReader(""), &stdout, &stderr)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("exec returned %v, want %v", err, tt.want)
+			}
+			if _, err := os.Stat(marker); !os.IsNotExist(err) {
+				t.Error("the command was run")
+			}
+		})
+	}
+}
+
+func TestExecCommandNotFound(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)})
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"exec", "--token-file", tokenPath, "--no-input", "--", "traktauth-no-such-command"},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || exitCode(err) == 0 {
+		t.Errorf("exec of a missing command returned %v", err)
+	}
+
+	err = run(context.Background(), []string{"exec", "--token-file", tokenPath, "--no-input"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode(err) != exitUsage {
+		t.Errorf("exec without a command returned %v, want a usage error", err)
+	}
+}
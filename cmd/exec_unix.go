@@ -0,0 +1,22 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// execReplace replaces the current process with the command at path. It only returns if that fails.
+func execReplace(path string, argv, env []string) error {
+	return syscall.Exec(path, argv, env)
+}
+
+// signalNumber returns the number of the signal which killed the process, or 0 if it wasn't killed by one.
+func signalNumber(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return int(status.Signal())
+	}
+	return 0
+}
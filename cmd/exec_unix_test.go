@@ -0,0 +1,107 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestExecRelaysSignals(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)})
+
+	tests := []struct {
+		name     string
+		sig      syscall.Signal
+		mode     []string
+		wantCode int
+	}{
+		{"SIGTERM handled", syscall.SIGTERM, []string{"signal", "42"}, 42},
+		{"SIGINT handled", syscall.SIGINT, []string{"signal", "43"}, 43},
+		{"killed by SIGTERM", syscall.SIGTERM, []string{"die"}, 128 + int(syscall.SIGTERM)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A pipe which isn't os.Stdout makes exec run the command as a subprocess instead of replacing this one.
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			errs := make(chan error, 1)
+			go func() {
+				defer w.Close()
+				var stderr strings.Builder
+				errs <- run(context.Background(), append([]string{"exec", "--token-file", tokenPath, "--no-input", "--"}, helperCommand(t, tt.mode[0], tt.mode[1:]...)...),
+					strings.NewReader(""), w, &stderr)
+			}()
+
+			// exec listens for signals before it starts the command, so they can't kill the test from now on.
+			if line, err := bufio.NewReader(r).ReadString('\n'); line != "ready\n" {
+				t.Fatalf("the command printed %q (%v) instead of being ready", line, err)
+			}
+			if err := syscall.Kill(os.Getpid(), tt.sig); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-errs:
+				if got := exitCode(err); got != tt.wantCode {
+					t.Errorf("exec returned %v, exit code %d, want %d", err, got, tt.wantCode)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the signal wasn't relayed to the command")
+			}
+		})
+	}
+}
+
+// runTraktauth runs the program in a subprocess with args and its own standard streams, and returns its
+// stdout and exit code.
+func runTraktauth(t *testing.T, args ...string) (string, int, *exec.Cmd) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestExecHelperProcess$", "--", "traktauth"}, args...)...)
+	cmd.Env = append(os.Environ(), execHelperEnv+"=1")
+	var stdout strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, io.Discard
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), cmd.ProcessState.ExitCode(), cmd
+}
+
+func TestExecReplacesProcess(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)})
+
+	out, code, cmd := runTraktauth(t, append([]string{"exec", "--token-file", tokenPath, "--no-input", "--"}, helperCommand(t, "pid")...)...)
+	if code != 0 {
+		t.Fatalf("traktauth exec exited with %d", code)
+	}
+	if pid, _ := strconv.Atoi(out); pid != cmd.Process.Pid {
+		t.Errorf("the command ran as process %q, want it to replace traktauth, process %d", out, cmd.Process.Pid)
+	}
+
+	if _, code, _ := runTraktauth(t, append([]string{"exec", "--token-file", tokenPath, "--no-input", "--"}, helperCommand(t, "env", "9")...)...); code != 9 {
+		t.Errorf("traktauth exec exited with %d, want the command's 9", code)
+	}
+}
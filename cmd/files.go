@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// flowFile is the JSON document which carries a pending device code between invocations.
+type flowFile struct {
+	traktdeviceauth.PersistedFlow
+
+	Polls       int        `json:"polls"`
+	LastPollAt  *time.Time `json:"last_poll_at,omitempty"`
+	LastOutcome string     `json:"last_outcome,omitempty"` // "approved" or the traktdeviceauth.Code of the last poll's error.
+}
+
+// newFlowFile creates the flow file for codeResp, which was generated at now. Its expiry is taken from
+// codeResp.ExpiresAt, or counted from now if codeResp doesn't have it.
+func newFlowFile(codeResp traktdeviceauth.CodeResponse, now time.Time) flowFile {
+	expiresAt := codeResp.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(codeResp.ExpiresInDuration())
+	}
+	return flowFile{PersistedFlow: traktdeviceauth.PersistedFlow{
+		CodeResponse: codeResp,
+		CreatedAt:    now,
+		ExpiresAt:    expiresAt,
+	}}
+}
+
+// checkExpiry returns an exitExpired error if the device code in f has expired.
+func (f flowFile) checkExpiry() error {
+	if time.Now().After(f.ExpiresAt) {
+		return &exitError{code: exitExpired, err: fmt.Errorf("the device code expired at %s, generate a new one", f.ExpiresAt.Format(time.RFC1123))}
+	}
+	return nil
+}
+
+// readJSONFile decodes the JSON file at path into v.
+func readJSONFile(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile atomically replaces the file at path with the JSON encoding of v. The file is only
+// readable by the current user, since it usually contains secrets.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+// writeFileAtomic replaces the file at path with b, which is only readable by the current user, without ever
+// leaving it half-written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
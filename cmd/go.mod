@@ -0,0 +1,27 @@
+module github.com/BrenekH/go-traktdeviceauth/cmd
+
+go 1.22
+
+require (
+	github.com/BrenekH/go-traktdeviceauth v1.1.0
+	github.com/BrenekH/go-traktdeviceauth/keyringstore v1.1.0
+	github.com/BrenekH/go-traktdeviceauth/prommetrics v1.1.0
+	github.com/prometheus/client_golang v1.15.1
+	github.com/zalando/go-keyring v0.2.8
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/danieljoos/wincred v1.2.3 // indirect
+	github.com/godbus/dbus/v5 v5.2.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.9.0 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// watchStatus is what watch knows about the token it keeps fresh. It never holds the token itself, so that
+// it can be reported without leaking secrets. It is safe for concurrent use.
+type watchStatus struct {
+	mu            sync.Mutex
+	expiresAt     time.Time
+	lastAttemptAt time.Time
+	lastRefreshAt time.Time
+	lastErr       error
+}
+
+// newWatchStatus creates the status for watching t, before any refresh has been attempted.
+func newWatchStatus(t traktdeviceauth.TokenResponse) *watchStatus {
+	return &watchStatus{expiresAt: t.ExpiresAt}
+}
+
+// recordRefresh records a refresh attempt made at now, which resulted in t and err. t is the token in use
+// afterwards, which is the old one if the refresh failed.
+func (s *watchStatus) recordRefresh(now time.Time, t traktdeviceauth.TokenResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAttemptAt = now
+	s.lastErr = err
+	if !t.ExpiresAt.Equal(s.expiresAt) {
+		s.expiresAt = t.ExpiresAt
+		s.lastRefreshAt = now
+	}
+}
+
+// healthReport is the JSON body of /healthz and /readyz.
+type healthReport struct {
+	Status               string     `json:"status"`
+	TokenExpiresAt       time.Time  `json:"token_expires_at"`
+	LastRefreshAt        *time.Time `json:"last_refresh_at,omitempty"`
+	LastRefreshAttemptAt *time.Time `json:"last_refresh_attempt_at,omitempty"`
+	LastRefreshError     string     `json:"last_refresh_error,omitempty"` // The traktdeviceauth.Code of the error, never its message.
+}
+
+// report returns the current health report, and whether the token is ready to be used at now: it hasn't
+// expired, and the last refresh succeeded or none was needed yet.
+func (s *watchStatus) report(now time.Time) (healthReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := healthReport{
+		TokenExpiresAt:   s.expiresAt,
+		LastRefreshError: traktdeviceauth.Code(s.lastErr),
+	}
+	if !s.lastRefreshAt.IsZero() {
+		t := s.lastRefreshAt
+		r.LastRefreshAt = &t
+	}
+	if !s.lastAttemptAt.IsZero() {
+		t := s.lastAttemptAt
+		r.LastRefreshAttemptAt = &t
+	}
+
+	ready := s.lastErr == nil && now.Before(s.expiresAt)
+	return r, ready
+}
+
+// newHealthHandler serves /healthz, which succeeds as long as the process is running, and /readyz, which
+// fails with 503 Service Unavailable while status isn't ready.
+func newHealthHandler(status *watchStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report, _ := status.report(time.Now())
+		report.Status = "ok"
+		writeHealthReport(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report, ready := status.report(time.Now())
+		if !ready {
+			report.Status = "unavailable"
+			writeHealthReport(w, http.StatusServiceUnavailable, report)
+			return
+		}
+		report.Status = "ok"
+		writeHealthReport(w, http.StatusOK, report)
+	})
+	return mux
+}
+
+// writeHealthReport writes report as the JSON response with status code.
+func writeHealthReport(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// startServer serves handler on addr in the background. stop shuts the server down, waiting briefly for
+// requests in progress.
+func startServer(addr string, handler http.Handler) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ln)
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-done
+	}, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// getHealth requests path from h and decodes the report, failing the test unless it is JSON which mustn't be
+// cached.
+func getHealth(t *testing.T, h http.Handler, path string) (int, string, healthReport) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type = %q, want application/json", path, ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("%s: Cache-Control = %q, want no-store", path, cc)
+	}
+	body := w.Body.String()
+	var report healthReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("%s: %v\n%s", path, err, body)
+	}
+	return w.Code, body, report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	valid := traktdeviceauth.TokenResponse{AccessToken: "secret-access", RefreshToken: "secret-refresh", ExpiresAt: now.Add(time.Hour)}
+	refreshed := traktdeviceauth.TokenResponse{AccessToken: "secret-access-2", RefreshToken: "secret-refresh-2", ExpiresAt: now.Add(24 * time.Hour)}
+	// The message of a refresh error may hold anything, so only its code is reported.
+	refreshErr := fmt.Errorf("refreshing secret-refresh: %w", traktdeviceauth.ErrServiceOverloaded)
+
+	tests := []struct {
+		name          string
+		token         traktdeviceauth.TokenResponse
+		refresh       func(s *watchStatus)
+		wantReady     bool
+		wantExpiresAt time.Time
+		wantRefreshAt bool
+		wantAttemptAt bool
+		wantError     string
+	}{
+		{"no refresh needed yet", valid, nil, true, valid.ExpiresAt, false, false, ""},
+		{"refreshed", valid, func(s *watchStatus) { s.recordRefresh(now, refreshed, nil) }, true, refreshed.ExpiresAt, true, true, ""},
+		{"refresh failed", valid, func(s *watchStatus) { s.recordRefresh(now, valid, refreshErr) }, false, valid.ExpiresAt, false, true, traktdeviceauth.Code(refreshErr)},
+		{"refresh failed after an earlier one succeeded", valid, func(s *watchStatus) {
+			s.recordRefresh(now.Add(-time.Minute), refreshed, nil)
+			s.recordRefresh(now, refreshed, refreshErr)
+		}, false, refreshed.ExpiresAt, true, true, traktdeviceauth.Code(refreshErr)},
+		{"failed refresh retried", valid, func(s *watchStatus) {
+			s.recordRefresh(now.Add(-time.Minute), valid, refreshErr)
+			s.recordRefresh(now, refreshed, nil)
+		}, true, refreshed.ExpiresAt, true, true, ""},
+		{"expired", traktdeviceauth.TokenResponse{AccessToken: "secret-access", RefreshToken: "secret-refresh", ExpiresAt: now.Add(-time.Minute)}, nil, false, now.Add(-time.Minute), false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := newWatchStatus(tt.token)
+			if tt.refresh != nil {
+				tt.refresh(status)
+			}
+			h := newHealthHandler(status)
+
+			code, body, report := getHealth(t, h, "/healthz")
+			if code != http.StatusOK || report.Status != "ok" {
+				t.Errorf("/healthz: %d %q, want 200 ok while the process runs", code, report.Status)
+			}
+			checkNoSecrets(t, body)
+
+			code, body, report = getHealth(t, h, "/readyz")
+			wantCode, wantStatus := http.StatusOK, "ok"
+			if !tt.wantReady {
+				wantCode, wantStatus = http.StatusServiceUnavailable, "unavailable"
+			}
+			if code != wantCode || report.Status != wantStatus {
+				t.Errorf("/readyz: %d %q, want %d %q", code, report.Status, wantCode, wantStatus)
+			}
+			checkNoSecrets(t, body)
+
+			if !report.TokenExpiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("token_expires_at = %v, want %v", report.TokenExpiresAt, tt.wantExpiresAt)
+			}
+			if (report.LastRefreshAt != nil) != tt.wantRefreshAt || (report.LastRefreshAttemptAt != nil) != tt.wantAttemptAt {
+				t.Errorf("last_refresh_at = %v and last_refresh_attempt_at = %v, want set: %v and %v",
+					report.LastRefreshAt, report.LastRefreshAttemptAt, tt.wantRefreshAt, tt.wantAttemptAt)
+			}
+			if report.LastRefreshError != tt.wantError {
+				t.Errorf("last_refresh_error = %q, want %q", report.LastRefreshError, tt.wantError)
+			}
+		})
+	}
+}
+
+// checkNoSecrets fails the test if body holds anything from the tokens used by the health tests.
+func checkNoSecrets(t *testing.T, body string) {
+	t.Helper()
+	if strings.Contains(body, "secret") {
+		t.Errorf("the report leaks a token: %s", body)
+	}
+}
+
+// freeAddr returns a loopback address with a port which was free a moment ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// waitForRefreshAttempt polls the /readyz route at addr until it reports a refresh attempt, and returns the
+// status code and report.
+func waitForRefreshAttempt(t *testing.T, addr string) (int, healthReport) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/readyz")
+		if err == nil {
+			var report healthReport
+			err = json.NewDecoder(resp.Body).Decode(&report)
+			resp.Body.Close()
+			if err == nil && report.LastRefreshAttemptAt != nil {
+				return resp.StatusCode, report
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz didn't report a refresh attempt: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchHealthListen(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tests := []struct {
+		name      string
+		refresh   traktdeviceauthtest.Step
+		wantCode  int
+		wantError string
+	}{
+		{"refreshed", traktdeviceauthtest.Succeed(), http.StatusOK, ""},
+		{"refresh failing", traktdeviceauthtest.Status(http.StatusForbidden), http.StatusServiceUnavailable, traktdeviceauth.Code(traktdeviceauth.ErrForbidden)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.RefreshSequence(tt.refresh))
+			issued := srv.IssueToken()
+			tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Hour)})
+
+			// The token is due for a refresh right away, and a failed refresh isn't retried during the test.
+			addr := freeAddr(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+			go func() {
+				var stdout, stderr strings.Builder
+				errs <- run(ctx, []string{"watch", "--token-file", tokenPath, "--refresh-before", "2h", "--retry-interval", "1h",
+					"--health-listen", addr, "--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"},
+					strings.NewReader(""), &stdout, &stderr)
+			}()
+
+			code, report := waitForRefreshAttempt(t, addr)
+			if code != tt.wantCode || report.LastRefreshError != tt.wantError {
+				t.Errorf("/readyz: %d %+v, want %d with error %q", code, report, tt.wantCode, tt.wantError)
+			}
+			if (report.LastRefreshAt != nil) != (tt.wantError == "") {
+				t.Errorf("last_refresh_at = %v after the refresh", report.LastRefreshAt)
+			}
+			resp, err := http.Get("http://" + addr + "/healthz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("/healthz: %d, want 200", resp.StatusCode)
+			}
+
+			cancel()
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Errorf("watch returned %v after being stopped", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("watch didn't stop")
+			}
+			// The health server stops with the daemon.
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				t.Error("the health server is still listening after watch returned")
+			}
+		})
+	}
+}
+
+func TestWatchHealthListenInUse(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(24 * time.Hour)})
+
+	var stdout, stderr strings.Builder
+	err = run(context.Background(), []string{"watch", "--token-file", tokenPath, "--health-listen", ln.Addr().String(),
+		"--client-id", "client-id", "--client-secret", "client-secret", "--no-input"}, strings.NewReader(""), &stdout, &stderr)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("watch with a busy --health-listen address returned %v, want the listen error", err)
+	}
+}
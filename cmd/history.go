@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// runHistory prints the events recorded in an audit log written with --audit-log, to find out what happened to a
+// token after the fact. Lines which aren't audit events are skipped and counted.
+func runHistory(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		logPath string
+		since   sinceFlag
+		limit   int
+		asJSON  bool
+	)
+
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&logPath, "audit-log", "", "audit log written by the other commands with --audit-log (required)")
+	fs.Var(&since, "since", "only show events after this time, given as RFC 3339 or as a `duration` ago, such as 72h")
+	fs.IntVar(&limit, "limit", 0, "only show the most recent events, at most this many (all if 0)")
+	fs.BoolVar(&asJSON, "json", false, "print the events as a JSON array instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if logPath == "" {
+		return usageError("--audit-log is required")
+	}
+	if limit < 0 {
+		return usageError("--limit can't be negative")
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	events, skipped, err := readAuditLog(f, since.t)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", logPath, err)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(stderr, "Skipped %d lines of %s which aren't audit events.\n", skipped, logPath)
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+
+	if asJSON {
+		if events == nil {
+			events = []traktdeviceauth.AuditEvent{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	printHistory(stdout, events)
+	return nil
+}
+
+// readAuditLog returns the events in r which happened after since, in the order they were written, and how many
+// lines weren't valid events. Blank lines are ignored.
+func readAuditLog(r io.Reader, since time.Time) (events []traktdeviceauth.AuditEvent, skipped int, err error) {
+	br := bufio.NewReader(r)
+	for {
+		// ReadBytes is used instead of a Scanner so that an overly long line is skipped rather than ending the read.
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var e traktdeviceauth.AuditEvent
+			if jsonErr := json.Unmarshal(line, &e); jsonErr != nil || e.Event == "" || e.Time.IsZero() {
+				skipped++
+			} else if e.Time.After(since) {
+				events = append(events, e)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return events, skipped, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// printHistory writes events to w as a table.
+func printHistory(w io.Writer, events []traktdeviceauth.AuditEvent) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No matching events were found.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tOUTCOME\tERROR\tENDPOINT\tEXPIRES AT")
+	for _, e := range events {
+		outcome, reason := "ok", "-"
+		if e.Event == traktdeviceauth.AuditFailure {
+			outcome, reason = "failed", e.Reason
+		}
+		expiresAt := "-"
+		if e.ExpiresAt != nil {
+			expiresAt = e.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		endpoint := e.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.Event, outcome, reason, endpoint, expiresAt)
+	}
+	tw.Flush()
+}
+
+// sinceFlag is the value of --since, which is either a time or a duration before now.
+type sinceFlag struct {
+	t time.Time
+}
+
+func (f *sinceFlag) String() string {
+	if f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+func (f *sinceFlag) Set(s string) error {
+	if d, err := time.ParseDuration(s); err == nil {
+		f.t = time.Now().Add(-d)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return errors.New("expected an RFC 3339 time or a duration")
+	}
+	f.t = t
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// writeAuditLog writes a log with four events, a day apart and ending an hour ago, mixed with lines which
+// aren't events. It returns the path and the events.
+func writeAuditLog(t *testing.T) (string, []traktdeviceauth.AuditEvent) {
+	t.Helper()
+
+	start := time.Now().Add(-73 * time.Hour).Truncate(time.Second).UTC()
+	tokenExpiry := start.Add(90 * 24 * time.Hour)
+	events := []traktdeviceauth.AuditEvent{
+		{Time: start, Event: traktdeviceauth.AuditCodeGenerated, Endpoint: "/oauth/device/code", DeviceID: "0123456789abcdef"},
+		{Time: start.Add(24 * time.Hour), Event: traktdeviceauth.AuditTokenObtained, Endpoint: "/oauth/device/token", ExpiresAt: &tokenExpiry},
+		{Time: start.Add(48 * time.Hour), Event: traktdeviceauth.AuditFailure, Endpoint: "/oauth/token", Reason: traktdeviceauth.CodeServiceOverloaded},
+		{Time: start.Add(72 * time.Hour), Event: traktdeviceauth.AuditTokenRefreshed, Endpoint: "/oauth/token", ExpiresAt: &tokenExpiry},
+	}
+
+	var b strings.Builder
+	garbage := []string{
+		"",
+		"not json at all",
+		`{"foo": 1}`,
+		`{"event": "token_refreshed"}`,
+		`{"time": "2024-03-01T12:00:00Z", "event": "token_refr`,
+		"{" + strings.Repeat("x", 100000) + "}",
+	}
+	for i, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(garbage[i] + "\n")
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	// The last line may be cut short by a crash.
+	b.WriteString(garbage[4] + "\n" + garbage[5])
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, events
+}
+
+func TestHistory(t *testing.T) {
+	path, events := writeAuditLog(t)
+
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), []string{"history", "--audit-log", path}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("history: %v\n%s", err, stderr.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != len(events)+1 || strings.Fields(lines[0])[0] != "TIME" {
+		t.Fatalf("history printed\n%s\nwant a header and %d events", stdout.String(), len(events))
+	}
+	for i, e := range events {
+		fields := strings.Fields(lines[i+1])
+		outcome, reason := "ok", "-"
+		if e.Event == traktdeviceauth.AuditFailure {
+			outcome, reason = "failed", e.Reason
+		}
+		expiresAt := "-"
+		if e.ExpiresAt != nil {
+			expiresAt = e.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		want := []string{e.Time.Local().Format(time.RFC3339), e.Event, outcome, reason, e.Endpoint, expiresAt}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("row %d is %q, want %q", i, fields, want)
+		}
+	}
+	// The empty line doesn't count, but the long and the truncated ones do.
+	if want := "Skipped 5 lines"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr is %q, want it to contain %q", stderr.String(), want)
+	}
+}
+
+func TestHistoryFilters(t *testing.T) {
+	path, events := writeAuditLog(t)
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  []traktdeviceauth.AuditEvent
+	}{
+		{"all", nil, events},
+		{"since a duration ago", []string{"--since", "30h"}, events[2:]},
+		{"since a time", []string{"--since", events[0].Time.Format(time.RFC3339)}, events[1:]},
+		{"limit", []string{"--limit", "3"}, events[1:]},
+		{"since and limit", []string{"--since", "50h", "--limit", "1"}, events[3:]},
+		{"limit beyond the events", []string{"--limit", "10"}, events},
+		{"nothing matches", []string{"--since", "1m"}, []traktdeviceauth.AuditEvent{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			if err := run(context.Background(), append([]string{"history", "--audit-log", path, "--json"}, tt.flags...), strings.NewReader(""), &stdout, &stderr); err != nil {
+				t.Fatalf("history: %v\n%s", err, stderr.String())
+			}
+			var got []traktdeviceauth.AuditEvent
+			if err := json.Unmarshal([]byte(stdout.String()), &got); err != nil {
+				t.Fatalf("history printed %q: %v", stdout.String(), err)
+			}
+			if got == nil || !reflect.DeepEqual(normalizeEvents(got), normalizeEvents(tt.want)) {
+				t.Errorf("history printed %s, want %d events", stdout.String(), len(tt.want))
+			}
+		})
+	}
+
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), []string{"history", "--audit-log", path, "--since", "1m"}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "No matching events were found.\n" {
+		t.Errorf("history without matches printed %q", stdout.String())
+	}
+}
+
+// normalizeEvents drops the monotonic clock readings and locations which JSON doesn't keep.
+func normalizeEvents(events []traktdeviceauth.AuditEvent) []traktdeviceauth.AuditEvent {
+	out := make([]traktdeviceauth.AuditEvent, len(events))
+	for i, e := range events {
+		e.Time = e.Time.UTC()
+		if e.ExpiresAt != nil {
+			expiresAt := e.ExpiresAt.UTC()
+			e.ExpiresAt = &expiresAt
+		}
+		out[i] = e
+	}
+	return out
+}
+
+func TestHistoryErrors(t *testing.T) {
+	path, _ := writeAuditLog(t)
+
+	tests := []struct {
+		args     []string
+		wantCode int
+	}{
+		{[]string{"history"}, exitUsage},
+		{[]string{"history", "--audit-log", path, "--limit", "-1"}, exitUsage},
+		{[]string{"history", "--audit-log", filepath.Join(t.TempDir(), "missing.jsonl")}, 1},
+	}
+	for _, tt := range tests {
+		var stdout, stderr strings.Builder
+		if err := run(context.Background(), tt.args, strings.NewReader(""), &stdout, &stderr); exitCode(err) != tt.wantCode {
+			t.Errorf("%q returned %v, want exit code %d", tt.args, err, tt.wantCode)
+		}
+	}
+
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), []string{"history", "--audit-log", path, "--since", "last week"}, strings.NewReader(""), &stdout, &stderr); err == nil {
+		t.Error("history accepted --since 'last week'")
+	}
+}
+
+func TestHistoryOfCommands(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)})
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// The log is appended to by every command, and records failures along with successes.
+	creds := []string{"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input", "--audit-log", logPath}
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), append([]string{"code"}, creds...), strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("code: %v\n%s", err, stderr.String())
+	}
+	if err := run(context.Background(), append(append([]string{"exec", "--token-file", tokenPath, "--min-valid", "10m"}, creds...), append([]string{"--"}, helperCommand(t, "env", "0")...)...),
+		strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("exec: %v\n%s", err, stderr.String())
+	}
+	srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(403)))
+	expired := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(-time.Minute)})
+	run(context.Background(), append(append([]string{"exec", "--token-file", expired}, creds...), append([]string{"--"}, helperCommand(t, "env", "0")...)...),
+		strings.NewReader(""), &stdout, &stderr)
+
+	stdout.Reset()
+	if err := run(context.Background(), []string{"history", "--audit-log", logPath, "--json"}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	var events []traktdeviceauth.AuditEvent
+	if err := json.Unmarshal([]byte(stdout.String()), &events); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event+" "+e.Reason)
+	}
+	want := []string{"code_generated ", "token_refreshed ", "failure " + traktdeviceauth.Code(traktdeviceauth.ErrForbidden)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("history holds %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// inspection is what inspect reports about a token file. The tokens themselves are only included with --reveal.
+type inspection struct {
+	Path                    string    `json:"path"`
+	Encrypted               bool      `json:"encrypted"`
+	FormatVersion           int       `json:"format_version"`
+	TokenType               string    `json:"token_type"`
+	Scope                   string    `json:"scope"`
+	CreatedAt               time.Time `json:"created_at"`
+	ExpiresAt               time.Time `json:"expires_at"`
+	ExpiresInSeconds        int64     `json:"expires_in_seconds"` // Negative once the token has expired.
+	RefreshTokenIssuedAt    time.Time `json:"refresh_token_issued_at"`
+	AccessTokenFingerprint  string    `json:"access_token_fingerprint"`
+	RefreshTokenFingerprint string    `json:"refresh_token_fingerprint"`
+	AccessToken             string    `json:"access_token,omitempty"`
+	RefreshToken            string    `json:"refresh_token,omitempty"`
+}
+
+// runInspect prints what a token file holds without contacting Trakt, so it needs no credentials. The file is
+// given as the only argument or with --token-file. Files in older formats are migrated in memory only, and
+// encrypted files are decrypted with the passphrase, which is prompted for unless a flag gives it.
+func runInspect(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		tokenPath  string
+		asJSON     bool
+		reveal     bool
+		passphrase passphraseFlags
+		cmdShell   bool
+		noInput    bool
+	)
+
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&tokenPath, "token-file", "", "token file to inspect (default: token.json in the user config directory)")
+	fs.BoolVar(&asJSON, "json", false, "print the details as JSON instead of text")
+	fs.BoolVar(&reveal, "reveal", false, "print the access and refresh tokens in full instead of only their first and last 4 characters")
+	passphrase.register(fs, "if it is encrypted")
+	fs.BoolVar(&cmdShell, "secret-cmd-shell", false, "run --token-passphrase-cmd with the shell instead of directly")
+	fs.BoolVar(&noInput, "no-input", os.Getenv("CI") == "true", "fail instead of prompting for the passphrase (defaults to true when CI=true)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := passphrase.validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case fs.NArg() > 1:
+		return usageError("inspect takes at most one argument")
+	case fs.NArg() == 1 && tokenPath != "":
+		return usageError("the token file can't be given both as an argument and with --token-file")
+	case fs.NArg() == 1:
+		tokenPath = fs.Arg(0)
+	}
+	tokenPath, err := tokenFileOrDefault(tokenPath)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return err
+	}
+	encrypted := bytes.HasPrefix(b, []byte(encryptedTokenPrefix))
+	if encrypted {
+		secret, err := passphrase.read(stdin, stderr, noInput, cmdShell)
+		if err != nil {
+			return err
+		}
+		if b, err = decryptTokenFile(ctx, tokenPath, secret); err != nil {
+			return err
+		}
+	}
+	in, err := inspectToken(b, time.Now(), reveal)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tokenPath, err)
+	}
+	in.Path, in.Encrypted = tokenPath, encrypted
+
+	if info, err := os.Stat(tokenPath); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0o044 != 0 {
+		fmt.Fprintf(stderr, "Warning: %s has mode %04o and can be read by other users, so the token should be assumed leaked.\n",
+			tokenPath, info.Mode().Perm())
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(in)
+	}
+	printInspection(stdout, in, reveal)
+	return nil
+}
+
+// decryptTokenFile returns the token document in the token file at path, which is encrypted with passphrase.
+// Permissions aren't checked, since inspect only warns about them.
+func decryptTokenFile(ctx context.Context, path, passphrase string) ([]byte, error) {
+	var plain []byte
+	store, err := traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte(passphrase),
+		traktdeviceauth.WithAllowInsecurePermissions(), traktdeviceauth.WithFileCodec(capturingCodec{&plain}))
+	if err != nil {
+		return nil, err
+	}
+	// A document which decrypts but isn't a valid token is returned anyway, so that inspectToken explains why.
+	if _, err := store.Load(ctx); err != nil && plain == nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// capturingCodec is the JSON Codec of a token file, which keeps a copy of the document it decodes in plain.
+type capturingCodec struct {
+	plain *[]byte
+}
+
+func (c capturingCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c capturingCodec) Unmarshal(data []byte, v interface{}) error {
+	*c.plain = append([]byte(nil), data...)
+	return json.Unmarshal(data, v)
+}
+
+// inspectToken decodes the token document b, explaining why it can't be read if it isn't a token. now is used
+// for the remaining lifetime of the token, and the tokens are only included if reveal is set.
+func inspectToken(b []byte, now time.Time, reveal bool) (inspection, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return inspection{}, errors.New("the file is empty")
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return inspection{}, fmt.Errorf("the file is corrupt, it isn't valid JSON at byte %d: %v", syntaxErr.Offset, err)
+		}
+		return inspection{}, errors.New("the file is JSON, but not an object, so it can't hold a token")
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return inspection{}, fmt.Errorf("the field %s holds a JSON %s instead of a %s", typeErr.Field, typeErr.Value, typeErr.Type)
+		}
+		return inspection{}, err
+	}
+	if st.AccessToken == "" && st.RefreshToken == "" {
+		return inspection{}, errors.New("the file is JSON, but holds neither an access token nor a refresh token")
+	}
+
+	// StoredToken has already checked that the version, if any, is a supported one.
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		_ = json.Unmarshal(raw, &version)
+	}
+
+	in := inspection{
+		FormatVersion:           version,
+		TokenType:               st.TokenType,
+		Scope:                   st.Scope,
+		CreatedAt:               st.CreatedAt,
+		ExpiresAt:               st.ExpiresAt,
+		ExpiresInSeconds:        int64(st.ExpiresAt.Sub(now) / time.Second),
+		RefreshTokenIssuedAt:    st.RefreshTokenIssuedAt,
+		AccessTokenFingerprint:  tokenFingerprint(st.AccessToken),
+		RefreshTokenFingerprint: tokenFingerprint(st.RefreshToken),
+	}
+	if reveal {
+		in.AccessToken, in.RefreshToken = st.AccessToken, st.RefreshToken
+	}
+	return in, nil
+}
+
+// tokenFingerprint returns the first and last 4 characters of token, which are enough to tell tokens apart
+// without revealing them. Tokens too short to leave most of them hidden are masked entirely.
+func tokenFingerprint(token string) string {
+	switch {
+	case token == "":
+		return ""
+	case len(token) < 16:
+		return "…"
+	default:
+		return token[:4] + "…" + token[len(token)-4:]
+	}
+}
+
+// printInspection writes in to w as a table of fields.
+func printInspection(w io.Writer, in inspection, reveal bool) {
+	remaining := "expires in " + time.Duration(in.ExpiresInSeconds*int64(time.Second)).String()
+	if in.ExpiresInSeconds < 0 {
+		remaining = "expired " + time.Duration(-in.ExpiresInSeconds*int64(time.Second)).String() + " ago"
+	}
+	format := fmt.Sprintf("version %d", in.FormatVersion)
+	if in.FormatVersion < traktdeviceauth.StoredTokenVersion {
+		format += fmt.Sprintf(" (migrated to version %d when next saved)", traktdeviceauth.StoredTokenVersion)
+	}
+	if in.Encrypted {
+		format += ", encrypted with a passphrase"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", in.Path)
+	fmt.Fprintf(tw, "Format:\t%s\n", format)
+	fmt.Fprintf(tw, "Token type:\t%s\n", in.TokenType)
+	fmt.Fprintf(tw, "Scope:\t%s\n", in.Scope)
+	fmt.Fprintf(tw, "Created at:\t%s\n", in.CreatedAt.Local().Format(time.RFC1123))
+	fmt.Fprintf(tw, "Expires at:\t%s (%s)\n", in.ExpiresAt.Local().Format(time.RFC1123), remaining)
+	fmt.Fprintf(tw, "Refresh token issued at:\t%s\n", in.RefreshTokenIssuedAt.Local().Format(time.RFC1123))
+	if reveal {
+		fmt.Fprintf(tw, "Access token:\t%s\n", in.AccessToken)
+		fmt.Fprintf(tw, "Refresh token:\t%s\n", in.RefreshToken)
+	} else {
+		fmt.Fprintf(tw, "Access token:\t%s\n", in.AccessTokenFingerprint)
+		fmt.Fprintf(tw, "Refresh token:\t%s\n", in.RefreshTokenFingerprint)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestInspectEncrypted(t *testing.T) {
+	tok := traktdeviceauth.TokenResponse{AccessToken: "access-token-0123456789", RefreshToken: "refresh-token-0123456789", ExpiresAt: time.Now().Add(time.Hour)}
+	path := saveEncryptedToken(t, tok, "open sesame")
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), []string{"inspect", "--json", "--token-passphrase", "open sesame", path}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("inspect: %v\n%s", err, stderr.String())
+	}
+	var in inspection
+	if err := json.Unmarshal(stdout.Bytes(), &in); err != nil {
+		t.Fatal(err)
+	}
+	if !in.Encrypted || in.FormatVersion != traktdeviceauth.StoredTokenVersion || in.AccessTokenFingerprint != "acce…6789" {
+		t.Errorf("got %+v, want the encrypted token", in)
+	}
+
+	// Without a flag, the passphrase is prompted for.
+	stdout.Reset()
+	err := run(context.Background(), []string{"inspect", "--no-input=false", path}, strings.NewReader("open sesame\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("inspect with a prompt: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "encrypted with a passphrase") {
+		t.Errorf("the output doesn't say the file is encrypted:\n%s", stdout.String())
+	}
+}
+
+func TestInspectEncryptedWrongPassphrase(t *testing.T) {
+	path := saveEncryptedToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now()}, "open sesame")
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"inspect", "--token-passphrase", "wrong", path}, strings.NewReader(""), &stdout, &stderr)
+	if !errors.Is(err, traktdeviceauth.ErrTokenDecryption) {
+		t.Errorf("inspect returned %v, want ErrTokenDecryption", err)
+	}
+}
+
+// The tokens of inspectFixtures, long enough to be fingerprinted.
+const (
+	fixtureAccess  = "acc0123456789abcdef0123456789xyz1"
+	fixtureRefresh = "ref0123456789abcdef0123456789xyz2"
+)
+
+// inspectFixtures are the same token in every stored format, from oldest to newest, along with the version
+// inspect reports for each.
+var inspectFixtures = []struct {
+	name    string
+	version int
+	doc     string
+}{
+	{"raw token response", 0, `{"access_token":"` + fixtureAccess + `","token_type":"bearer","expires_in":7776000,"refresh_token":"` + fixtureRefresh + `","scope":"public","created_at":1717243200}`},
+	{"TokenResponse without JSON tags", 0, `{"AccessToken":"` + fixtureAccess + `","TokenType":"bearer","ExpiresAt":"2024-08-30T12:00:00Z","RefreshToken":"` + fixtureRefresh + `","Scope":"public","CreatedAt":"2024-06-01T12:00:00Z"}`},
+	{"version 0", 0, `{"access_token":"` + fixtureAccess + `","token_type":"bearer","refresh_token":"` + fixtureRefresh + `","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z"}`},
+	{"version 1", 1, `{"version":1,"access_token":"` + fixtureAccess + `","token_type":"bearer","refresh_token":"` + fixtureRefresh + `","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z"}`},
+	{"version 2", 2, `{"version":2,"access_token":"` + fixtureAccess + `","token_type":"bearer","refresh_token":"` + fixtureRefresh + `","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z"}`},
+	{"version 3", 3, `{"version":3,"access_token":"` + fixtureAccess + `","token_type":"bearer","refresh_token":"` + fixtureRefresh + `","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z"}`},
+}
+
+// writeTokenDoc writes doc to a token file readable only by its owner and returns its path.
+func writeTokenDoc(t *testing.T, doc string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// inspect runs the inspect command with args.
+func inspect(args ...string) (stdout, stderr string, err error) {
+	var out, errOut bytes.Buffer
+	err = run(context.Background(), append([]string{"inspect", "--no-input"}, args...), strings.NewReader(""), &out, &errOut)
+	return out.String(), errOut.String(), err
+}
+
+func TestInspectFormats(t *testing.T) {
+	t.Setenv("CI", "")
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	expires := time.Date(2024, 8, 30, 12, 0, 0, 0, time.UTC)
+
+	for _, f := range inspectFixtures {
+		t.Run(f.name, func(t *testing.T) {
+			path := writeTokenDoc(t, f.doc)
+
+			stdout, stderr, err := inspect("--json", path)
+			if err != nil {
+				t.Fatalf("inspect: %v\n%s", err, stderr)
+			}
+			var in inspection
+			if err := json.Unmarshal([]byte(stdout), &in); err != nil {
+				t.Fatal(err)
+			}
+			want := inspection{
+				Path:                    path,
+				FormatVersion:           f.version,
+				TokenType:               "bearer",
+				Scope:                   "public",
+				CreatedAt:               created,
+				ExpiresAt:               expires,
+				ExpiresInSeconds:        in.ExpiresInSeconds,
+				RefreshTokenIssuedAt:    created,
+				AccessTokenFingerprint:  "acc0…xyz1",
+				RefreshTokenFingerprint: "ref0…xyz2",
+			}
+			if !in.CreatedAt.Equal(created) || !in.ExpiresAt.Equal(expires) || !in.RefreshTokenIssuedAt.Equal(created) {
+				t.Errorf("got the times %v, %v and %v, want %v, %v and %v", in.CreatedAt, in.ExpiresAt, in.RefreshTokenIssuedAt, created, expires, created)
+			}
+			in.CreatedAt, in.ExpiresAt, in.RefreshTokenIssuedAt = want.CreatedAt, want.ExpiresAt, want.RefreshTokenIssuedAt
+			if in != want {
+				t.Errorf("got %+v, want %+v", in, want)
+			}
+			if d := time.Until(expires) / time.Second; in.ExpiresInSeconds < int64(d)-5 || in.ExpiresInSeconds > int64(d) {
+				t.Errorf("expires_in_seconds = %d, want about %d", in.ExpiresInSeconds, int64(d))
+			}
+			if strings.Contains(stdout, fixtureAccess) || strings.Contains(stdout, fixtureRefresh) {
+				t.Errorf("inspect --json printed the tokens without --reveal:\n%s", stdout)
+			}
+			// The file is only read, never migrated.
+			if b, err := os.ReadFile(path); err != nil || string(b) != f.doc {
+				t.Errorf("the file holds %s (%v) after inspect, want it unchanged", b, err)
+			}
+		})
+	}
+}
+
+func TestInspectText(t *testing.T) {
+	t.Setenv("CI", "")
+	path := writeTokenDoc(t, inspectFixtures[3].doc)
+
+	stdout, _, err := inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"File:", path,
+		"Format:", "version 1 (migrated to version 3 when next saved)",
+		"Token type:", "bearer",
+		"Scope:", "public",
+		"Expires at:", "expired", "ago",
+		"Access token:", "acc0…xyz1",
+		"Refresh token:", "ref0…xyz2",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("the output doesn't contain %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, fixtureAccess) || strings.Contains(stdout, fixtureRefresh) {
+		t.Errorf("inspect printed the tokens without --reveal:\n%s", stdout)
+	}
+
+	// --reveal prints them in full, both as text and JSON.
+	stdout, _, err = inspect("--reveal", path)
+	if err != nil || !strings.Contains(stdout, fixtureAccess) || !strings.Contains(stdout, fixtureRefresh) {
+		t.Errorf("inspect --reveal printed %s (%v), want the tokens", stdout, err)
+	}
+	stdout, _, err = inspect("--reveal", "--json", "--token-file", path)
+	var in inspection
+	if err != nil || json.Unmarshal([]byte(stdout), &in) != nil || in.AccessToken != fixtureAccess || in.RefreshToken != fixtureRefresh {
+		t.Errorf("inspect --reveal --json printed %s (%v), want the tokens", stdout, err)
+	}
+}
+
+func TestInspectDiagnostics(t *testing.T) {
+	t.Setenv("CI", "")
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"empty", " \n", "the file is empty"},
+		{"truncated", inspectFixtures[5].doc[:40], "the file is corrupt, it isn't valid JSON at byte"},
+		{"not an object", `["` + fixtureAccess + `"]`, "not an object"},
+		{"wrong type", `{"version":3,"access_token":42}`, "the field access_token holds a JSON number instead of a string"},
+		{"no tokens", `{"version":3,"scope":"public"}`, "holds neither an access token nor a refresh token"},
+		{"newer version", `{"version":4,"access_token":"` + fixtureAccess + `"}`, "format version 4 is newer than version 3"},
+		{"invalid version", `{"version":"three","access_token":"` + fixtureAccess + `"}`, "invalid format version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTokenDoc(t, tt.doc)
+			stdout, _, err := inspect(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.HasPrefix(err.Error(), path+": ") {
+				t.Errorf("inspect returned %v, want an error about %s containing %q", err, path, tt.want)
+			}
+			if stdout != "" {
+				t.Errorf("inspect printed %q along with the error", stdout)
+			}
+		})
+	}
+
+	if _, _, err := inspect(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("inspect of a missing file returned %v, want ErrNotExist", err)
+	}
+	if _, _, err := inspect("a.json", "b.json"); exitCode(err) != exitUsage {
+		t.Errorf("inspect with two files returned %v, want a usage error", err)
+	}
+	if _, _, err := inspect("--token-file", "a.json", "b.json"); exitCode(err) != exitUsage {
+		t.Errorf("inspect with --token-file and an argument returned %v, want a usage error", err)
+	}
+}
+
+func TestInspectPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes don't restrict readers on Windows")
+	}
+	t.Setenv("CI", "")
+	path := writeTokenDoc(t, inspectFixtures[5].doc)
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, err := inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "has mode 0644 and can be read by other users") {
+		t.Errorf("inspect warned %q, want a warning about the mode", stderr)
+	}
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"", ""},
+		{"short", "…"},
+		{"fifteen-chars-x", "…"},
+		{"sixteen-chars-xy", "sixt…s-xy"},
+		{fixtureAccess, "acc0…xyz1"},
+	}
+	for _, tt := range tests {
+		if got := tokenFingerprint(tt.token); got != tt.want {
+			t.Errorf("tokenFingerprint(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
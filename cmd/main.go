@@ -2,38 +2,298 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/interact"
+	"github.com/BrenekH/go-traktdeviceauth/opstore"
 )
 
+const usage string = `Usage: %[1]s [command] [flags]
+
+Commands:
+  auth       Authorize an app interactively in the terminal (default)
+  serve      Host a local web page which walks the user through authorization
+  code       Generate a device code and output it as JSON, for a later token or poll-once
+  token      Wait for the user to approve a code and output the token. The code is read from
+             a file argument or stdin (-), either as written by code or as a bare CodeResponse.
+  poll-once  Poll once for the device code in a flow file, for use from schedulers like cron.
+             Exits with 0 once approved, 10 if the code hasn't been entered yet, 11 if it
+             expired, 12 if it was denied, and 4 if Trakt couldn't be reached.
+  watch      Keep the token in --token-file fresh by refreshing it before it expires, as a daemon.
+             --health-listen serves /healthz and /readyz for supervisors such as Kubernetes, and
+             --metrics-listen serves Prometheus metrics.
+  exec       Run a command with a valid access token in TRAKT_ACCESS_TOKEN, refreshing the token
+             in --token-file first if needed: %[1]s exec --token-file token.json -- <command>
+  wait       Wait until --token-file holds a token valid for at least --min-validity, for ordering
+             service startup. Exits with 13 if --timeout passes first. Never starts a device flow.
+  restore    Roll --token-file back to one of the backups taken whenever it is overwritten, or list
+             them with --list.
+  inspect    Print what a token file holds, such as when the token expires, without contacting Trakt.
+             The tokens themselves are only printed with --reveal.
+  history    Print the events recorded in the file given to the other commands with --audit-log.
+  self-update
+             Replace this executable with the latest release after verifying its checksum.
+
+Run '%[1]s <command> -h' for the flags of a command.
+`
+
 func main() {
-	clientID := input("Please enter your app's client id: ")
-	clientSecret := input("Please enter your app's client secret: ")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+
+		code := 1
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
+			err = exitErr.err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			if hint := traktdeviceauth.ErrorHint(err); hint != "" {
+				fmt.Fprintln(os.Stderr, "Hint:", hint)
+			} else if errors.Is(err, opstore.ErrNotSignedIn) {
+				fmt.Fprintln(os.Stderr, "Hint: Sign in with 'op signin', or set OP_SERVICE_ACCOUNT_TOKEN to use a service account.")
+			}
+		}
+		os.Exit(code)
+	}
+}
+
+// exitError makes the program exit with code instead of 1. err is printed if it isn't nil.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
 
-	cR, err := traktdeviceauth.GenerateNewCode(clientID)
-	if err != nil {
-		panic(err)
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitUsage is the exit code for invalid arguments or input, which were rejected before contacting Trakt.
+const exitUsage = 2
+
+// usageError returns an exitUsage error with a message formatted like fmt.Sprintf.
+func usageError(format string, a ...interface{}) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, a...)}
+}
+
+// run dispatches args to the matching command. Running without a command (or with only flags) runs auth.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	command := "auth"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "auth":
+		return runAuth(ctx, args, stdin, stdout, stderr)
+	case "serve":
+		return runServe(ctx, args, stdin, stdout, stderr)
+	case "code":
+		return runCode(ctx, args, stdin, stdout, stderr)
+	case "token":
+		return runToken(ctx, args, stdin, stdout, stderr)
+	case "poll-once":
+		return runPollOnce(ctx, args, stdin, stdout, stderr)
+	case "watch":
+		return runWatch(ctx, args, stdin, stdout, stderr)
+	case "exec":
+		return runExec(ctx, args, stdin, stdout, stderr)
+	case "wait":
+		return runWait(ctx, args, stdin, stdout, stderr)
+	case "restore":
+		return runRestore(ctx, args, stdin, stdout, stderr)
+	case "inspect":
+		return runInspect(ctx, args, stdin, stdout, stderr)
+	case "history":
+		return runHistory(ctx, args, stdin, stdout, stderr)
+	case "self-update":
+		return runSelfUpdate(ctx, args, stdin, stdout, stderr)
+	case "help":
+		fmt.Fprintf(stdout, usage, os.Args[0])
+		return nil
+	default:
+		fmt.Fprintf(stderr, usage, os.Args[0])
+		return fmt.Errorf("unknown command %q", command)
 	}
+}
+
+// apiFlags are the flags shared by every command which talks to Trakt.
+type apiFlags struct {
+	clientID          string
+	clientSecret      string
+	baseURL           string
+	allowInsecureHTTP bool
+	noInput           bool
+	secretCmd         string
+	secretCmdShell    bool
+	idCredential      string
+	secretCredential  string
+	maxRetries        int
+	retryBackoff      time.Duration
+	noRetry           bool
+	rateLimitState    string
+	auditLog          string
+	log               io.Writer              // Where retries are reported.
+	audit             traktdeviceauth.Option // Writes to --audit-log, which is opened by validate.
+}
 
-	fmt.Printf("Please visit %s and enter the following code: %s\n", cR.VerificationURL, cR.UserCode)
+// register adds the API flags to fs.
+func (c *apiFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.clientID, "client-id", "", "client id of the Trakt app (prompted for if empty)")
+	fs.StringVar(&c.clientSecret, "client-secret", "", "client secret of the Trakt app (prompted for if empty)")
+	fs.StringVar(&c.baseURL, "base-url", traktdeviceauth.TraktAPIBaseUrl, "base url of the Trakt API")
+	fs.BoolVar(&c.allowInsecureHTTP, "allow-insecure-http", false, "allow a plain http base url which isn't on localhost")
+	fs.StringVar(&c.secretCmd, "client-secret-cmd", "", "command which prints the client secret, such as 'pass show trakt/client-secret'")
+	fs.BoolVar(&c.secretCmdShell, "secret-cmd-shell", false, "run --client-secret-cmd and --token-passphrase-cmd with the shell instead of directly")
+	fs.StringVar(&c.idCredential, "client-id-credential", "trakt-client-id", "systemd credential to read the client id from when $"+credentialsDirEnv+" is set and --client-id isn't (disabled if empty)")
+	fs.StringVar(&c.secretCredential, "client-secret-credential", "trakt-client-secret", "systemd credential to read the client secret from when $"+credentialsDirEnv+" is set and neither --client-secret nor --client-secret-cmd is (disabled if empty)")
+	fs.BoolVar(&c.noInput, "no-input", os.Getenv("CI") == "true", "fail instead of prompting for missing input (defaults to true when CI=true)")
+	fs.IntVar(&c.maxRetries, "max-retries", traktdeviceauth.DefaultRetryPolicy.MaxAttempts-1, "how often to retry requests which failed because of network or server errors")
+	fs.DurationVar(&c.retryBackoff, "retry-backoff", traktdeviceauth.DefaultRetryPolicy.Backoff, "wait before the first retry, which doubles for every retry after that")
+	fs.BoolVar(&c.noRetry, "no-retry", false, "never retry failed requests, the same as --max-retries 0")
+	fs.StringVar(&c.rateLimitState, "rate-limit-state", "", "file which remembers rate limiting between runs, so that later runs wait until it is over")
+	fs.StringVar(&c.auditLog, "audit-log", "", "file to append an audit event to for every code, token, refresh and failure, which history reads")
+	c.log = fs.Output()
+}
 
-	tR, err := traktdeviceauth.PollForAuthToken(cR, clientID, clientSecret)
-	if err != nil {
-		panic(err)
+// validate checks the flags for mistakes which can be caught before prompting or making requests, and opens
+// --audit-log.
+func (c *apiFlags) validate() error {
+	if c.clientSecret != "" && c.secretCmd != "" {
+		return usageError("--client-secret and --client-secret-cmd can't be used together")
 	}
 
-	fmt.Printf("AccessToken: %s\nRefreshToken: %s\nExpires at: %s", tR.AccessToken, tR.RefreshToken, tR.ExpiresAt.String())
+	if !c.allowInsecureHTTP {
+		if err := traktdeviceauth.CheckBaseURL(c.baseURL); err != nil {
+			return fmt.Errorf("--base-url: %w (use --allow-insecure-http to override)", err)
+		}
+	}
+
+	if c.auditLog != "" {
+		// The file stays open until the program exits.
+		f, err := os.OpenFile(c.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("--audit-log: %w", err)
+		}
+		c.audit = traktdeviceauth.WithAuditLog(f)
+	}
+	return nil
+}
+
+// options returns the traktdeviceauth options matching the flags.
+func (c *apiFlags) options() []traktdeviceauth.Option {
+	opts := []traktdeviceauth.Option{traktdeviceauth.WithBaseURL(c.baseURL)}
+	if c.allowInsecureHTTP {
+		opts = append(opts, traktdeviceauth.WithAllowInsecureHTTP())
+	}
+	if c.audit != nil {
+		opts = append(opts, c.audit)
+	}
+	if c.rateLimitState != "" {
+		opts = append(opts, traktdeviceauth.WithRateLimitState(c.rateLimitState), traktdeviceauth.WithOnRateLimitWait(func(wait time.Duration) {
+			fmt.Fprintf(c.log, "Trakt rate limited an earlier run, waiting %s before continuing.\n", wait.Round(time.Second))
+		}))
+	}
+	if !c.noRetry && c.maxRetries > 0 {
+		opts = append(opts, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{
+			MaxAttempts: c.maxRetries + 1,
+			Backoff:     c.retryBackoff,
+			OnRetry: func(endpoint traktdeviceauth.Endpoint, attempt int, wait time.Duration, err error) {
+				fmt.Fprintf(c.log, "Request to %s failed (%v), retrying in %s (attempt %d of %d).\n", endpoint, err, wait, attempt, c.maxRetries+1)
+			},
+		}))
+	}
+	return opts
+}
+
+// prompt asks for the credentials which weren't provided by flags, skipping the client secret unless needSecret
+// is true. Before prompting, the secret is taken from --client-secret-cmd if it was set, and both are looked for
+// among the systemd credentials of the unit. With --no-input, it returns a usage error naming the missing flags
+// instead.
+func (c *apiFlags) prompt(stdin io.Reader, w io.Writer, needSecret bool) error {
+	if needSecret && c.clientSecret == "" && c.secretCmd != "" {
+		secret, err := runSecretCommand("--client-secret-cmd", c.secretCmd, c.secretCmdShell)
+		if err != nil {
+			return err
+		}
+		c.clientSecret = secret
+	}
+	if c.clientID == "" {
+		id, _, err := readCredential(c.idCredential)
+		if err != nil {
+			return err
+		}
+		c.clientID = id
+	}
+	if needSecret && c.clientSecret == "" {
+		secret, _, err := readCredential(c.secretCredential)
+		if err != nil {
+			return err
+		}
+		c.clientSecret = secret
+	}
+
+	var missing []string
+	if c.clientID == "" {
+		missing = append(missing, "--client-id")
+	}
+	if needSecret && c.clientSecret == "" {
+		missing = append(missing, "--client-secret")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if c.noInput {
+		hint := ""
+		if os.Getenv("CI") == "true" {
+			hint = " (enabled by CI=true, use --no-input=false to allow prompts)"
+		}
+		return usageError("missing %s, which can't be prompted for with --no-input%s", strings.Join(missing, " and "), hint)
+	}
+
+	if needSecret {
+		c.clientID, c.clientSecret = interact.PromptCredentials(stdin, w, c.clientID, c.clientSecret)
+	} else {
+		c.clientID = interact.Input(bufio.NewScanner(stdin), w, "Please enter your app's client id: ")
+	}
+	return nil
+}
+
+// printToken writes the interesting parts of t to w.
+func printToken(w io.Writer, t traktdeviceauth.TokenResponse) {
+	fmt.Fprintf(w, "AccessToken: %s\nRefreshToken: %s\nExpires at: %s\n", t.AccessToken, t.RefreshToken, t.ExpiresAt.String())
 }
 
-// input mimics Python's input function, which outputs a prompt and
-// takes bytes from stdin until a newline and returns a string.
-func input(prompt string) string {
-	fmt.Print(prompt)
-	scanner := bufio.NewScanner(os.Stdin)
-	if ok := scanner.Scan(); ok {
-		return scanner.Text()
+// printStats writes a one line summary of a finished device flow to w.
+func printStats(w io.Writer, s traktdeviceauth.PollStats) {
+	outcome := "Not approved"
+	if !s.ApprovedAt.IsZero() {
+		outcome = "Approved after " + s.ApprovedAt.Sub(s.StartedAt).Round(time.Second).String()
 	}
-	return ""
+	fmt.Fprintf(w, "%s: %d polls, %d rate limited, %d retries, %s in total.\n",
+		outcome, s.Polls, s.RateLimited, s.Retries, s.FinishedAt.Sub(s.StartedAt).Round(time.Second))
 }
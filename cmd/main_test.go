@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestAPIFlagsBaseURL(t *testing.T) {
+	tests := []struct {
+		flags   apiFlags
+		wantErr bool
+	}{
+		{apiFlags{baseURL: traktdeviceauth.TraktAPIBaseUrl}, false},
+		{apiFlags{baseURL: "http://trakt.example"}, true},
+		{apiFlags{baseURL: "http://127.0.0.1:8080"}, false},
+		{apiFlags{baseURL: "http://trakt.example", allowInsecureHTTP: true}, false},
+	}
+	for _, tt := range tests {
+		err := tt.flags.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate with --base-url %s and --allow-insecure-http %v = %v, want an error: %v", tt.flags.baseURL, tt.flags.allowInsecureHTTP, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, traktdeviceauth.ErrInsecureBaseURL) {
+			t.Errorf("validate with --base-url %s = %v, want ErrInsecureBaseURL", tt.flags.baseURL, err)
+		}
+	}
+}
+
+func TestRetryFlags(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	// Each flow is run against a server which fails its first request of the kind the flow depends on.
+	flows := []struct {
+		name     string
+		endpoint traktdeviceauth.Endpoint
+		script   traktdeviceauthtest.Scenario
+		wantErr  error
+		args     func(t *testing.T, srv *traktdeviceauthtest.Server) []string
+	}{
+		{"code generation", traktdeviceauth.EndpointDeviceCode,
+			traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Succeed()),
+			traktdeviceauth.ErrServiceOverloaded,
+			func(t *testing.T, srv *traktdeviceauthtest.Server) []string {
+				return []string{"code"}
+			}},
+		{"polling", traktdeviceauth.EndpointDeviceToken,
+			traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusInternalServerError), traktdeviceauthtest.Approve(traktdeviceauthtest.Token{})),
+			traktdeviceauth.ErrServerError,
+			func(t *testing.T, srv *traktdeviceauthtest.Server) []string {
+				return []string{"auth", "--token-file", filepath.Join(t.TempDir(), "token.json"), "--format", "json"}
+			}},
+		{"refresh", traktdeviceauth.EndpointToken,
+			traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Succeed()),
+			traktdeviceauth.ErrServiceOverloaded,
+			func(t *testing.T, srv *traktdeviceauthtest.Server) []string {
+				issued := srv.IssueToken()
+				tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)})
+				return []string{"exec", "--token-file", tokenPath, "--min-valid", "10m"}
+			}},
+	}
+	tests := []struct {
+		name      string
+		flags     []string
+		wantRetry string // The wait reported for the retry, or empty if the request mustn't be retried.
+	}{
+		{"defaults", nil, "retrying in " + traktdeviceauth.DefaultRetryPolicy.Backoff.String()},
+		{"custom", []string{"--max-retries", "1", "--retry-backoff", "5ms"}, "retrying in 5ms"},
+		{"max retries 0", []string{"--max-retries", "0"}, ""},
+		{"no retry", []string{"--no-retry"}, ""},
+		{"no retry wins", []string{"--no-retry", "--max-retries", "3", "--retry-backoff", "5ms"}, ""},
+	}
+	for _, flow := range flows {
+		for _, tt := range tests {
+			t.Run(flow.name+"/"+tt.name, func(t *testing.T) {
+				srv := traktdeviceauthtest.NewServer()
+				defer srv.Close()
+				srv.Interval = 1
+				srv.Script(flow.script)
+
+				args := append(flow.args(t, srv), "--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input")
+				args = append(args, tt.flags...)
+				if flow.name == "refresh" {
+					args = append(append(args, "--"), helperCommand(t, "env", "0")...)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+				defer cancel()
+				var stdout, stderr strings.Builder
+				err := run(ctx, args, strings.NewReader(""), &stdout, &stderr)
+
+				requests := len(srv.RequestsTo(flow.endpoint))
+				if tt.wantRetry == "" {
+					if !errors.Is(err, flow.wantErr) {
+						t.Errorf("returned %v, want %v without retries", err, flow.wantErr)
+					}
+					if requests != 1 {
+						t.Errorf("%d requests to %s, want 1", requests, flow.endpoint)
+					}
+					if strings.Contains(stderr.String(), "retrying") {
+						t.Errorf("a retry was reported: %s", stderr.String())
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("returned %v, want the failed request retried\n%s", err, stderr.String())
+				}
+				if requests != 2 {
+					t.Errorf("%d requests to %s, want 2", requests, flow.endpoint)
+				}
+				// The retry is reported along with its reason.
+				if !strings.Contains(stderr.String(), tt.wantRetry) || !strings.Contains(stderr.String(), flow.wantErr.Error()) {
+					t.Errorf("stderr doesn't report the retry with %q and its reason:\n%s", tt.wantRetry, stderr.String())
+				}
+			})
+		}
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		stats traktdeviceauth.PollStats
+		want  string
+	}{
+		{"approved after 3 polls", traktdeviceauth.PollStats{StartedAt: start, ApprovedAt: start.Add(20 * time.Second), FinishedAt: start.Add(20 * time.Second), Polls: 4},
+			"Approved after 20s: 4 polls, 0 rate limited, 0 retries, 20s in total.\n"},
+		{"slowed down and retried", traktdeviceauth.PollStats{StartedAt: start, ApprovedAt: start.Add(95 * time.Second), FinishedAt: start.Add(95 * time.Second), Polls: 9, RateLimited: 2, Retries: 3},
+			"Approved after 1m35s: 9 polls, 2 rate limited, 3 retries, 1m35s in total.\n"},
+		{"denied", traktdeviceauth.PollStats{StartedAt: start, FinishedAt: start.Add(12400 * time.Millisecond), Polls: 3},
+			"Not approved: 3 polls, 0 rate limited, 0 retries, 12s in total.\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			printStats(&b, tt.stats)
+			if b.String() != tt.want {
+				t.Errorf("printStats wrote %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsFlag(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	// The durations depend on the poll interval, so only the counts are compared literally.
+	approved := regexp.MustCompile(`(?m)^Approved after (\S+): 4 polls, 0 rate limited, 0 retries, (\S+) in total\.$`)
+	denied := regexp.MustCompile(`(?m)^Not approved: 4 polls, 0 rate limited, 0 retries, (\S+) in total\.$`)
+
+	tests := []struct {
+		name    string
+		script  traktdeviceauthtest.Scenario
+		command func(t *testing.T, srv *traktdeviceauthtest.Server) []string
+		want    *regexp.Regexp
+	}{
+		{"auth approved", traktdeviceauthtest.ApproveAfterPolls(3), func(t *testing.T, srv *traktdeviceauthtest.Server) []string {
+			return []string{"auth", "--token-file", filepath.Join(t.TempDir(), "token.json"), "--format", "json"}
+		}, approved},
+		{"token denied", traktdeviceauthtest.DenyAfterPolls(3), func(t *testing.T, srv *traktdeviceauthtest.Server) []string {
+			codePath := filepath.Join(t.TempDir(), "code.json")
+			var stdout, stderr strings.Builder
+			if err := run(context.Background(), []string{"code", "--code-file", codePath, "--client-id", "client-id", "--base-url", srv.URL, "--no-input"},
+				strings.NewReader(""), &stdout, &stderr); err != nil {
+				t.Fatalf("code: %v\n%s", err, stderr.String())
+			}
+			return []string{"token", "--code-file", codePath}
+		}, denied},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Interval = 1
+			srv.Script(tt.script)
+
+			args := append(tt.command(t, srv), "--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input")
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var stdout, stderr strings.Builder
+			err := run(ctx, append(args, "--stats"), strings.NewReader(""), &stdout, &stderr)
+			if (err == nil) != (tt.want == approved) {
+				t.Fatalf("returned %v\n%s", err, stderr.String())
+			}
+
+			m := tt.want.FindStringSubmatch(stderr.String())
+			if m == nil {
+				t.Fatalf("stderr doesn't hold the summary:\n%s", stderr.String())
+			}
+			// Three polls were answered as unclaimed, each a second apart.
+			for _, s := range m[1:] {
+				if d, err := time.ParseDuration(s); err != nil || d < 3*time.Second || d > 20*time.Second {
+					t.Errorf("the summary reports %s, want about 4 polls at the interval of 1s", s)
+				}
+			}
+			if strings.Contains(stdout.String(), "polls,") {
+				t.Errorf("the summary was written to stdout: %s", stdout.String())
+			}
+
+			// Without --stats, there is no summary.
+			srv.Script(tt.script)
+			stdout.Reset()
+			stderr.Reset()
+			args = append(tt.command(t, srv), "--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input")
+			if err := run(ctx, args, strings.NewReader(""), &stdout, &stderr); (err == nil) != (tt.want == approved) {
+				t.Fatalf("returned %v without --stats\n%s", err, stderr.String())
+			}
+			if strings.Contains(stderr.String(), "polls,") {
+				t.Errorf("a summary was printed without --stats:\n%s", stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+const (
+	// mockPolls is how many polls the code stays unclaimed for in mock mode before it is approved or denied.
+	mockPolls = 3
+
+	// mockExpireAfter is how long codes last with --mock=expire.
+	mockExpireAfter = 30 * time.Second
+
+	mockWatermark = "MOCK MODE"
+)
+
+// mockFlag is the value of --mock, which can be given without a value to approve the code, or with approve,
+// deny or expire[:duration].
+type mockFlag struct {
+	scenario    string
+	expireAfter time.Duration
+}
+
+func (f *mockFlag) String() string {
+	if f == nil || f.scenario == "" {
+		return ""
+	}
+	if f.scenario == "expire" {
+		return "expire:" + f.expireAfter.String()
+	}
+	return f.scenario
+}
+
+func (f *mockFlag) Set(s string) error {
+	name, arg := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+
+	switch {
+	case s == "false":
+		*f = mockFlag{}
+	case s == "true", s == "approve":
+		*f = mockFlag{scenario: "approve"}
+	case s == "deny":
+		*f = mockFlag{scenario: "deny"}
+	case name == "expire":
+		d := mockExpireAfter
+		if name != s {
+			var err error
+			if d, err = time.ParseDuration(arg); err != nil {
+				return err
+			}
+			if d < time.Second {
+				return errors.New("codes have to last at least 1s")
+			}
+		}
+		*f = mockFlag{scenario: "expire", expireAfter: d}
+	default:
+		return errors.New("expected approve, deny or expire[:duration]")
+	}
+	return nil
+}
+
+// IsBoolFlag allows --mock to be given without a value.
+func (f *mockFlag) IsBoolFlag() bool {
+	return true
+}
+
+// start starts a fake Trakt API playing out the chosen scenario and points api at it, replacing the credentials
+// with fake ones so that nothing has to be entered. It returns the options for polling the fake API and a
+// function which shuts it down.
+func (f *mockFlag) start(api *apiFlags, w io.Writer) (opts []traktdeviceauth.Option, stop func()) {
+	server := traktdeviceauthtest.NewServer()
+	server.Interval = 1
+	server.ClientID = "mock-client-id"
+	server.ClientSecret = "mock-client-secret"
+
+	switch f.scenario {
+	case "deny":
+		server.Script(traktdeviceauthtest.DenyAfterPolls(mockPolls))
+	case "expire":
+		server.Script(traktdeviceauthtest.Sequence(traktdeviceauthtest.Unclaimed()), traktdeviceauthtest.ExpireAfter(f.expireAfter))
+	default:
+		server.Script(traktdeviceauthtest.Sequence(append(
+			repeatUnclaimed(mockPolls),
+			traktdeviceauthtest.Approve(traktdeviceauthtest.Token{
+				AccessToken:  "MOCK-ACCESS-TOKEN-NOT-VALID-WITH-TRAKT",
+				RefreshToken: "MOCK-REFRESH-TOKEN-NOT-VALID-WITH-TRAKT",
+			}),
+		)...))
+	}
+
+	api.baseURL = server.URL
+	api.allowInsecureHTTP = true
+	api.clientID = server.ClientID
+	api.clientSecret = server.ClientSecret
+	api.secretCmd = ""
+
+	fmt.Fprintf(w, "%s: authorizing against a fake Trakt API at %s (scenario %s). Nothing is sent to Trakt, and the "+
+		"code and token are fake.\n\n", mockWatermark, server.URL, f)
+	return server.Options(), server.Close
+}
+
+// repeatUnclaimed returns n unclaimed steps.
+func repeatUnclaimed(n int) []traktdeviceauthtest.Step {
+	steps := make([]traktdeviceauthtest.Step, 0, n+1)
+	for i := 0; i < n; i++ {
+		steps = append(steps, traktdeviceauthtest.Unclaimed())
+	}
+	return steps
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestMockFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    mockFlag
+		wantErr bool
+	}{
+		{"true", mockFlag{scenario: "approve"}, false},
+		{"approve", mockFlag{scenario: "approve"}, false},
+		{"deny", mockFlag{scenario: "deny"}, false},
+		{"expire", mockFlag{scenario: "expire", expireAfter: mockExpireAfter}, false},
+		{"expire:2m", mockFlag{scenario: "expire", expireAfter: 2 * time.Minute}, false},
+		{"false", mockFlag{}, false},
+		{"expire:500ms", mockFlag{}, true},
+		{"expire:soon", mockFlag{}, true},
+		{"deny:1s", mockFlag{}, true},
+		{"approved", mockFlag{}, true},
+	}
+	for _, tt := range tests {
+		var f mockFlag
+		err := f.Set(tt.value)
+		if (err != nil) != tt.wantErr || err == nil && f != tt.want {
+			t.Errorf("Set(%q) = %+v, %v, want %+v with an error: %v", tt.value, f, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMockAuth(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantErr  error
+		wantCode int
+	}{
+		// Without a value, --mock approves the code.
+		{"approve", []string{"--mock"}, nil, 0},
+		{"approve explicitly", []string{"--mock=approve"}, nil, 0},
+		{"deny", []string{"--mock=deny"}, traktdeviceauth.ErrDeviceCodeDenied, 1},
+		{"expire", []string{"--mock=expire:2s"}, traktdeviceauth.ErrDeviceCodeExpired, 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// No credentials are given, since the fake server brings its own.
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var stdout, stderr strings.Builder
+			err := run(ctx, append([]string{"auth", "--format", "json", "--no-input"}, tt.args...), strings.NewReader(""), &stdout, &stderr)
+			if code := exitCode(err); code != tt.wantCode || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("returned %v (exit %d), want %v (exit %d)\n%s", err, code, tt.wantErr, tt.wantCode, stderr.String())
+			}
+			if !strings.HasPrefix(stderr.String(), mockWatermark+": authorizing against a fake Trakt API at http://127.0.0.1:") {
+				t.Errorf("stderr doesn't start with the watermark:\n%s", stderr.String())
+			}
+
+			if tt.wantErr != nil {
+				if !strings.HasPrefix(err.Error(), mockWatermark+": ") {
+					t.Errorf("the error %q isn't marked as mock mode", err)
+				}
+				if stdout.String() != "" {
+					t.Errorf("a failed flow printed %q", stdout.String())
+				}
+				return
+			}
+
+			// Scripts parsing the output get a normal JSON token, which is obviously fake.
+			var tok traktdeviceauth.TokenResponse
+			if err := json.Unmarshal([]byte(stdout.String()), &tok); err != nil {
+				t.Fatalf("stdout isn't a JSON token: %v\n%s", err, stdout.String())
+			}
+			if !strings.HasPrefix(tok.AccessToken, "MOCK-") || !strings.HasPrefix(tok.RefreshToken, "MOCK-") {
+				t.Errorf("the token %+v doesn't look fake", tok)
+			}
+			if !strings.HasSuffix(stderr.String(), mockWatermark+": this token is fake and won't work with Trakt.\n") {
+				t.Errorf("stderr doesn't end with the fake token warning:\n%s", stderr.String())
+			}
+		})
+	}
+}
+
+func TestMockAuthErrors(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		// The flag package reports invalid values itself.
+		{"unknown scenario", []string{"--mock=maybe"}, 1},
+		{"too short expiry", []string{"--mock=expire:10ms"}, 1},
+		{"with a token file", []string{"--mock", "--token-file", "token.json"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append([]string{"auth", "--no-input"}, tt.args...), strings.NewReader(""), &stdout, &stderr)
+			if code := exitCode(err); err == nil || code != tt.wantCode {
+				t.Errorf("returned %v (exit %d), want exit %d", err, code, tt.wantCode)
+			}
+			if strings.Contains(stderr.String(), mockWatermark) {
+				t.Errorf("the fake server was started:\n%s", stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// noStdin is a stdin which fails the test if anything reads from it.
+type noStdin struct{ t *testing.T }
+
+func (r noStdin) Read([]byte) (int, error) {
+	r.t.Error("stdin was read")
+	return 0, io.EOF
+}
+
+// saveToken saves tok to a new token file and returns its path.
+func saveToken(t *testing.T, tok traktdeviceauth.TokenResponse) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := traktdeviceauth.NewFileTokenStore(path).Save(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNoInput(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	flowPath := newPollOnceFlow(t, srv)
+	expiring := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Minute)})
+	encrypted := saveEncryptedToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)}, "open sesame")
+	creds := []string{"--client-id", "client-id", "--client-secret", "client-secret"}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"auth", []string{"auth", "--token-file", filepath.Join(dir, "auth.json")}, "missing --client-id and --client-secret"},
+		{"auth without the secret", []string{"auth", "--client-id", "client-id"}, "missing --client-secret,"},
+		{"auth passphrase", append([]string{"auth", "--store", "encrypted-file", "--token-file", filepath.Join(dir, "auth.enc")}, creds...), "missing --token-passphrase"},
+		{"serve", []string{"serve", "--listen", "127.0.0.1:0"}, "missing --client-id and --client-secret"},
+		{"serve passphrase", append([]string{"serve", "--listen", "127.0.0.1:0", "--store", "encrypted-file", "--token-file", filepath.Join(dir, "serve.enc")}, creds...), "missing --token-passphrase"},
+		{"code", []string{"code"}, "missing --client-id,"},
+		{"token", []string{"token", "--code-file", flowPath}, "missing --client-id and --client-secret"},
+		{"poll-once", []string{"poll-once", "--device-code-file", flowPath}, "missing --client-id and --client-secret"},
+		{"exec", []string{"exec", "--token-file", expiring, "--", "true"}, "missing --client-id and --client-secret"},
+		{"exec passphrase", []string{"exec", "--store", "encrypted-file", "--token-file", encrypted, "--", "true"}, "missing --token-passphrase"},
+		{"wait", []string{"wait", "--refresh", "--token-file", expiring}, "missing --client-id and --client-secret"},
+		{"watch", []string{"watch", "--token-file", expiring}, "missing --client-id and --client-secret"},
+		{"inspect passphrase", []string{"inspect", encrypted}, "missing --token-passphrase"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			args := append([]string{tt.args[0], "--no-input"}, tt.args[1:]...)
+			if tt.args[0] != "inspect" {
+				args = append([]string{tt.args[0], "--no-input", "--base-url", srv.URL}, tt.args[1:]...)
+			}
+			var stdout, stderr strings.Builder
+			err := run(ctx, args, noStdin{t}, &stdout, &stderr)
+			if got := exitCode(err); got != exitUsage {
+				t.Fatalf("exited with %d (%v), want %d", got, err, exitUsage)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want it to name %q", err, tt.wantErr)
+			}
+			if ctx.Err() != nil {
+				t.Error("the command didn't fail fast")
+			}
+		})
+	}
+
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("%d requests were made, want only the one generating the code for poll-once and token", n)
+	}
+}
+
+func TestNoInputSkipsRefreshConfirmation(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Refreshing the stored token would need a confirmation, so a new one is authorized instead.
+	path := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Minute)})
+	var stdout, stderr strings.Builder
+	if err := run(ctx, []string{"auth", "--no-input", "--skip-if-valid=1h", "--token-file", path, "--client-id", "client-id", "--client-secret", "client-secret",
+		"--base-url", srv.URL}, noStdin{t}, &stdout, &stderr); err != nil {
+		t.Fatalf("auth: %v\n%s", err, stderr.String())
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 0 {
+		t.Errorf("%d refresh requests were made without confirmation", n)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d codes were generated, want 1", n)
+	}
+}
+
+func TestNoInputFromCI(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "true")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"code", "--base-url", srv.URL}, noStdin{t}, &stdout, &stderr)
+	if got := exitCode(err); got != exitUsage {
+		t.Fatalf("exited with %d (%v), want %d", got, err, exitUsage)
+	}
+	if !strings.Contains(err.Error(), "CI=true") || !strings.Contains(err.Error(), "--no-input=false") {
+		t.Errorf("got error %q, want it to explain how to allow prompts", err)
+	}
+
+	// --no-input=false overrides CI=true.
+	stdout.Reset()
+	if err := run(context.Background(), []string{"code", "--no-input=false", "--base-url", srv.URL}, strings.NewReader("client-id\n"), &stdout, &stderr); err != nil {
+		t.Fatalf("code with --no-input=false: %v", err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d codes were generated, want 1", n)
+	}
+}
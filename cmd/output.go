@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// outputFlags are the flags which choose how a command prints the token it obtained.
+type outputFlags struct {
+	format       string
+	text         string
+	templateFile string
+	tmpl         *template.Template
+	backups      int
+	outputs      outputsFlag
+	requireAll   bool
+}
+
+// register adds the output flags to fs.
+func (o *outputFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.format, "format", "text", "how to print the token: text, json, env (shell exports) or template")
+	fs.StringVar(&o.text, "template", "", "Go template to print the token with, which implies --format template. "+
+		"The fields are those of traktdeviceauth.StoredToken: .AccessToken, .TokenType, .RefreshToken, .Scope, "+
+		".CreatedAt, .ExpiresAt and .RefreshTokenIssuedAt, such as '{{.AccessToken}}|{{.ExpiresAt.Unix}}'")
+	fs.StringVar(&o.templateFile, "template-file", "", "file holding the template for --format template")
+	fs.IntVar(&o.backups, "backups", defaultBackups, backupsUsage)
+	fs.Var(&o.outputs, "output", "also write the token to this `destination`, a token file or - to print it, which can be repeated")
+	fs.BoolVar(&o.requireAll, "require-all", false, "fail if writing the token to any destination fails, instead of only if all of them do")
+}
+
+// validate checks the flags and parses the template, so that mistakes are caught before authorizing.
+func (o *outputFlags) validate() error {
+	if o.backups < 0 {
+		return usageError("--backups can't be negative")
+	}
+	if o.text != "" && o.templateFile != "" {
+		return usageError("--template and --template-file can't be used together")
+	}
+	if (o.text != "" || o.templateFile != "") && o.format == "text" {
+		o.format = "template"
+	}
+
+	seen := make(map[string]bool)
+	for _, dest := range o.outputs {
+		if seen[dest] {
+			return usageError("--output %s is given more than once", dest)
+		}
+		seen[dest] = true
+	}
+
+	switch o.format {
+	case "text", "json", "env":
+		if o.text != "" || o.templateFile != "" {
+			return usageError("--template and --template-file need --format template")
+		}
+		return nil
+	case "template":
+	default:
+		return usageError("unknown --format %q, expected text, json, env or template", o.format)
+	}
+
+	text := o.text
+	if o.templateFile != "" {
+		b, err := os.ReadFile(o.templateFile)
+		if err != nil {
+			return usageError("reading --template-file: %v", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return usageError("--format template needs --template or --template-file")
+	}
+
+	tmpl, err := template.New("token").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return usageError("parsing the template: %v", err)
+	}
+	// Fields which don't exist only fail when the template is executed, which would be after authorizing.
+	if err := tmpl.Execute(io.Discard, traktdeviceauth.StoredToken{}); err != nil {
+		return usageError("the template can't be used: %v", err)
+	}
+	o.tmpl = tmpl
+	return nil
+}
+
+// messages returns where a command should write everything but the token. Only the text format shares stdout
+// with other output, so that the others can be piped into other programs.
+func (o *outputFlags) messages(stdout, stderr io.Writer) io.Writer {
+	if o.format == "text" {
+		return stdout
+	}
+	return stderr
+}
+
+// writesFiles reports whether any --output is a file.
+func (o *outputFlags) writesFiles() bool {
+	for _, dest := range o.outputs {
+		if dest != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// output writes t to every destination, which are the token file at path if it isn't empty and those given with
+// --output, in that order. Token files are saved after backing up the file they replace. t is printed to w in
+// the chosen format if there are no destinations, or for --output -.
+//
+// With several destinations, all of them are attempted and the outcome of each is reported to messages. output
+// only fails if every destination failed, or if any did with --require-all.
+func (o *outputFlags) output(w, messages io.Writer, path string, t traktdeviceauth.TokenResponse) error {
+	var dests []string
+	if path != "" {
+		dests = append(dests, path)
+	}
+	dests = append(dests, o.outputs...)
+
+	switch len(dests) {
+	case 0:
+		return o.print(w, t)
+	case 1:
+		return o.writeTo(w, dests[0], t)
+	}
+
+	var (
+		failed  []string
+		lastErr error
+	)
+	for _, dest := range dests {
+		name := dest
+		if dest == "-" {
+			name = "stdout"
+		}
+		if err := o.writeTo(w, dest, t); err != nil {
+			fmt.Fprintf(messages, "Writing the token to %s failed: %v\n", name, err)
+			failed, lastErr = append(failed, name), err
+			continue
+		}
+		fmt.Fprintf(messages, "Wrote the token to %s.\n", name)
+	}
+
+	switch {
+	case len(failed) == len(dests):
+		return fmt.Errorf("writing the token failed for every destination, the last with: %w", lastErr)
+	case len(failed) > 0 && o.requireAll:
+		return fmt.Errorf("writing the token to %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// writeTo prints t to w if dest is -, and saves it to the token file dest otherwise.
+func (o *outputFlags) writeTo(w io.Writer, dest string, t traktdeviceauth.TokenResponse) error {
+	if dest == "-" {
+		return o.print(w, t)
+	}
+	return saveTokenFile(dest, t, o.backups)
+}
+
+// print writes t to w in the chosen format. Nothing is written if the template fails, for example because it
+// refers to a field which doesn't exist.
+func (o *outputFlags) print(w io.Writer, t traktdeviceauth.TokenResponse) error {
+	switch o.format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(traktdeviceauth.NewStoredToken(t))
+	case "template":
+		var buf bytes.Buffer
+		if err := o.tmpl.Execute(&buf, traktdeviceauth.NewStoredToken(t)); err != nil {
+			return err
+		}
+		if b := buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	case "env":
+		_, err := fmt.Fprintf(w, "export TRAKT_ACCESS_TOKEN=%s\nexport TRAKT_REFRESH_TOKEN=%s\nexport TRAKT_TOKEN_EXPIRES_AT=%s\n",
+			shellQuote(t.AccessToken), shellQuote(t.RefreshToken), shellQuote(t.ExpiresAt.Format(time.RFC3339)))
+		return err
+	default:
+		printToken(w, t)
+		return nil
+	}
+}
+
+// shellQuote quotes s for POSIX shells, so that the exports printed by --format env can be evaluated safely
+// whatever the values hold.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// outputsFlag is the value of --output, which can be given several times.
+type outputsFlag []string
+
+func (f *outputsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ", ")
+}
+
+func (f *outputsFlag) Set(s string) error {
+	if s == "" {
+		return errors.New("the destination can't be empty")
+	}
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestPrintTemplate(t *testing.T) {
+	tok := traktdeviceauth.TokenResponse{
+		AccessToken:  "access",
+		TokenType:    "bearer",
+		RefreshToken: "refresh",
+		Scope:        "public",
+		CreatedAt:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		ExpiresAt:    time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"pipe separated", "{{.AccessToken}}|{{.ExpiresAt.Unix}}", "access|1717070400\n"},
+		{"ini", "[trakt]\naccess_token={{.AccessToken}}\nrefresh_token={{.RefreshToken}}\nscope={{.Scope}}\n",
+			"[trakt]\naccess_token=access\nrefresh_token=refresh\nscope=public\n"},
+		{"time formatting", `{{.TokenType}} token created {{.CreatedAt.Format "2006-01-02"}}, expires {{.ExpiresAt.Format "Mon, 02 Jan 2006 15:04 MST"}}`,
+			"bearer token created 2024-03-01, expires Thu, 30 May 2024 12:00 UTC\n"},
+		{"quoted", `token={{printf "%q" .AccessToken}}`, "token=\"access\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := outputFlags{format: "template", text: tt.template}
+			if err := o.validate(); err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			if err := o.print(&b, tok); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("printed %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	templateFile := filepath.Join(t.TempDir(), "token.tmpl")
+	if err := os.WriteFile(templateFile, []byte("{{.AccessToken}}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		flags outputFlags
+	}{
+		{"missing field", outputFlags{format: "template", text: "{{.AccessToken}} {{.Nope}}"}},
+		{"field of a nil pointer", outputFlags{format: "template", text: "{{.Rotation.Generation}}"}},
+		{"parse error", outputFlags{format: "template", text: "{{.AccessToken"}},
+		{"no template", outputFlags{format: "template"}},
+		{"both", outputFlags{format: "template", text: "{{.AccessToken}}", templateFile: templateFile}},
+		{"other format", outputFlags{format: "json", text: "{{.AccessToken}}"}},
+		{"missing file", outputFlags{format: "template", templateFile: filepath.Join(t.TempDir(), "missing.tmpl")}},
+		{"unknown format", outputFlags{format: "yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.flags.validate(); exitCode(err) != exitUsage {
+				t.Errorf("validate returned %v, want a usage error", err)
+			}
+		})
+	}
+
+	// A template which only fails for some tokens prints nothing rather than part of its output.
+	o := outputFlags{format: "template", text: "{{.AccessToken}} {{if .RefreshToken}}{{index .RefreshToken 99}}{{end}}"}
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := o.print(&b, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh"}); err == nil || b.Len() != 0 {
+		t.Errorf("print returned %v and printed %q, want an error and nothing printed", err, b.String())
+	}
+
+	// --template and --template-file imply --format template.
+	for _, flags := range []outputFlags{{format: "text", text: "{{.AccessToken}}"}, {format: "text", templateFile: templateFile}} {
+		if err := flags.validate(); err != nil || flags.format != "template" {
+			t.Errorf("validate of %+v returned %v and format %q, want template", flags, err, flags.format)
+		}
+	}
+}
+
+func TestTokenTemplate(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(0))
+	templateFile := filepath.Join(t.TempDir(), "token.tmpl")
+	if err := os.WriteFile(templateFile, []byte("access_token={{.AccessToken}}\nexpires={{.ExpiresAt.Unix}}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	creds := []string{"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}
+	var code, codeErr strings.Builder
+	if err := run(ctx, append([]string{"code"}, creds...), strings.NewReader(""), &code, &codeErr); err != nil {
+		t.Fatalf("code: %v\n%s", err, codeErr.String())
+	}
+
+	// Only the token goes to stdout, so that it can be piped elsewhere.
+	var stdout, stderr strings.Builder
+	if err := run(ctx, append([]string{"token", "--template-file", templateFile}, append(creds, "-")...), strings.NewReader(code.String()), &stdout, &stderr); err != nil {
+		t.Fatalf("token: %v\n%s", err, stderr.String())
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "access_token=") || len(lines[0]) == len("access_token=") || !strings.HasPrefix(lines[1], "expires=") || lines[2] != "" {
+		t.Errorf("token printed %q, want only the template", stdout.String())
+	}
+
+	// A template using a field which doesn't exist fails before a code is polled for.
+	polls := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken))
+	stdout.Reset()
+	stderr.Reset()
+	err := run(ctx, append([]string{"token", "--template", "{{.AccesToken}}"}, append(creds, "-")...), strings.NewReader(code.String()), &stdout, &stderr)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != exitUsage || stdout.Len() != 0 {
+		t.Errorf("token with a misspelled field returned %v and printed %q, want a usage error", err, stdout.String())
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != polls {
+		t.Errorf("%d polls were made for an unusable template", n-polls)
+	}
+}
+
+// failingWriter fails every write, like a closed stdout.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestOutputDestinations(t *testing.T) {
+	tok := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)}
+	dir := t.TempDir()
+	// Nothing can be saved below a regular file, which makes for a destination which always fails.
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(blocker, "token.json")
+	worse := filepath.Join(blocker, "other.json")
+	exports := "export TRAKT_ACCESS_TOKEN='access'\nexport TRAKT_REFRESH_TOKEN='refresh'\nexport TRAKT_TOKEN_EXPIRES_AT='2024-05-30T12:00:00Z'\n"
+
+	tests := []struct {
+		name       string
+		path       string
+		outputs    []string
+		requireAll bool
+		stdout     io.Writer
+		// reports are the outcomes reported to messages, in order, with "ok" for a success.
+		reports []string
+		saved   []string
+		printed bool
+		wantErr string
+	}{
+		{
+			name: "all succeed", path: "a.json", outputs: []string{"b.json", "-"},
+			reports: []string{"a.json ok", "b.json ok", "stdout ok"}, saved: []string{"a.json", "b.json"}, printed: true,
+		},
+		{
+			name: "one fails", path: "a.json", outputs: []string{bad, "-"},
+			reports: []string{"a.json ok", bad + " failed", "stdout ok"}, saved: []string{"a.json"}, printed: true,
+		},
+		{
+			name: "the first fails", path: bad, outputs: []string{"a.json"},
+			reports: []string{bad + " failed", "a.json ok"}, saved: []string{"a.json"},
+		},
+		{
+			name: "stdout fails", path: "a.json", outputs: []string{"-"}, stdout: failingWriter{},
+			reports: []string{"a.json ok", "stdout failed"}, saved: []string{"a.json"},
+		},
+		{
+			name: "one fails with --require-all", path: "a.json", outputs: []string{bad, "-"}, requireAll: true,
+			reports: []string{"a.json ok", bad + " failed", "stdout ok"}, saved: []string{"a.json"}, printed: true,
+			wantErr: "writing the token to " + bad + " failed",
+		},
+		{
+			name: "all fail", path: bad, outputs: []string{worse},
+			reports: []string{bad + " failed", worse + " failed"},
+			wantErr: "writing the token failed for every destination",
+		},
+		{
+			name: "all fail with --require-all", path: bad, outputs: []string{worse}, requireAll: true,
+			reports: []string{bad + " failed", worse + " failed"},
+			wantErr: "writing the token failed for every destination",
+		},
+		{
+			// A single destination fails with its own error, without a report.
+			name: "only destination fails", path: bad,
+			wantErr: "not a directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			work := t.TempDir()
+			abs := func(p string) string {
+				if p == "-" || filepath.IsAbs(p) {
+					return p
+				}
+				return filepath.Join(work, p)
+			}
+			o := outputFlags{format: "env", requireAll: tt.requireAll}
+			for _, dest := range tt.outputs {
+				if err := o.outputs.Set(abs(dest)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := o.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var stdout strings.Builder
+			var w io.Writer = &stdout
+			if tt.stdout != nil {
+				w = tt.stdout
+			}
+			var messages strings.Builder
+			err := o.output(w, &messages, abs(tt.path), tok)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("output returned %v, want success", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("output returned %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			var reports []string
+			for _, line := range strings.Split(strings.TrimSuffix(messages.String(), "\n"), "\n") {
+				switch {
+				case line == "":
+				case strings.HasPrefix(line, "Wrote the token to "):
+					reports = append(reports, strings.TrimPrefix(strings.TrimSuffix(line, "."), "Wrote the token to ")+" ok")
+				case strings.HasPrefix(line, "Writing the token to "):
+					reports = append(reports, strings.SplitN(strings.TrimPrefix(line, "Writing the token to "), " failed: ", 2)[0]+" failed")
+				default:
+					t.Errorf("unexpected message %q", line)
+				}
+			}
+			var want []string
+			for _, r := range tt.reports {
+				if i := strings.LastIndex(r, " "); !filepath.IsAbs(r) && r[:i] != "stdout" {
+					r = abs(r[:i]) + r[i:]
+				}
+				want = append(want, r)
+			}
+			if strings.Join(reports, "\n") != strings.Join(want, "\n") {
+				t.Errorf("reported\n%s\nwant\n%s", messages.String(), strings.Join(want, "\n"))
+			}
+
+			for _, p := range tt.saved {
+				if got, err := traktdeviceauth.LoadTokenFromFile(abs(p)); err != nil || got.AccessToken != tok.AccessToken {
+					t.Errorf("%s holds %+v (%v), want the token", p, got, err)
+				}
+			}
+			if got := stdout.String(); tt.printed && got != exports || !tt.printed && got != "" {
+				t.Errorf("printed %q, want the exports: %v", got, tt.printed)
+			}
+		})
+	}
+}
+
+func TestOutputDestinationsRepeated(t *testing.T) {
+	var o outputFlags
+	for _, dest := range []string{"a.json", "-", "a.json"} {
+		if err := o.outputs.Set(dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.format = "text"
+	if err := o.validate(); exitCode(err) != exitUsage {
+		t.Errorf("validate with a repeated --output returned %v, want a usage error", err)
+	}
+	if err := o.outputs.Set(""); err == nil {
+		t.Error("an empty --output was accepted")
+	}
+}
+
+func TestTokenOutputs(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(0))
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile, copyFile, bad := filepath.Join(dir, "token.json"), filepath.Join(dir, "copy.json"), filepath.Join(blocker, "token.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	creds := []string{"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}
+
+	// One failing destination among three doesn't fail the command, unless --require-all is given. The others are
+	// written either way.
+	for _, requireAll := range []bool{false, true} {
+		var code, codeErr strings.Builder
+		if err := run(ctx, append([]string{"code"}, creds...), strings.NewReader(""), &code, &codeErr); err != nil {
+			t.Fatalf("code: %v\n%s", err, codeErr.String())
+		}
+		args := append([]string{"token", "--token-file", tokenFile, "--output", bad, "--output", copyFile, "--output", "-", "--format", "env"}, creds...)
+		if requireAll {
+			args = append(args, "--require-all")
+		}
+		var stdout, stderr strings.Builder
+		err := run(ctx, append(args, "-"), strings.NewReader(code.String()), &stdout, &stderr)
+		if requireAll && (err == nil || exitCode(err) == 0) {
+			t.Errorf("token --require-all with a failing destination succeeded")
+		} else if !requireAll && err != nil {
+			t.Errorf("token with a failing destination returned %v\n%s", err, stderr.String())
+		}
+
+		if !strings.HasPrefix(stdout.String(), "export TRAKT_ACCESS_TOKEN=") {
+			t.Errorf("token printed %q, want only the exports", stdout.String())
+		}
+		report := stderr.String()
+		order := []string{"Wrote the token to " + tokenFile, "Writing the token to " + bad + " failed", "Wrote the token to " + copyFile, "Wrote the token to stdout"}
+		last := -1
+		for _, line := range order {
+			i := strings.Index(report, line)
+			if i <= last {
+				t.Errorf("the report doesn't have %q after the previous outcome:\n%s", line, report)
+			}
+			last = i
+		}
+		saved, err := traktdeviceauth.LoadTokenFromFile(tokenFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied, err := traktdeviceauth.LoadTokenFromFile(copyFile); err != nil || copied.AccessToken != saved.AccessToken {
+			t.Errorf("the copy holds %+v (%v), want %s", copied, err, saved.AccessToken)
+		}
+		if !strings.Contains(stdout.String(), shellQuote(saved.AccessToken)) {
+			t.Errorf("the exports %q don't hold the saved token %s", stdout.String(), saved.AccessToken)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+
+	"github.com/BrenekH/go-traktdeviceauth/interact"
+)
+
+// encryptedTokenPrefix starts every encrypted token file, which is how inspect recognizes one.
+const encryptedTokenPrefix = "traktdeviceauth-encrypted-token "
+
+// passphraseFlags are the flags which give the passphrase of an encrypted token file.
+type passphraseFlags struct {
+	passphrase string
+	cmd        string
+}
+
+// register adds the passphrase flags to fs, with usage saying when they are used.
+func (p *passphraseFlags) register(fs *flag.FlagSet, when string) {
+	fs.StringVar(&p.passphrase, "token-passphrase", "", "passphrase of the encrypted token file, "+when+" (prompted for if empty)")
+	fs.StringVar(&p.cmd, "token-passphrase-cmd", "", "command which prints the passphrase of the encrypted token file, "+when+", such as 'pass show trakt/token'")
+}
+
+func (p *passphraseFlags) validate() error {
+	if p.passphrase != "" && p.cmd != "" {
+		return usageError("--token-passphrase and --token-passphrase-cmd can't be used together")
+	}
+	return nil
+}
+
+// set reports whether either flag was given.
+func (p *passphraseFlags) set() bool {
+	return p.passphrase != "" || p.cmd != ""
+}
+
+// read returns the passphrase, running --token-passphrase-cmd, with the shell if useShell is set, or prompting
+// for it on w if it wasn't given with --token-passphrase. With noInput, it returns a usage error instead of
+// prompting.
+func (p *passphraseFlags) read(stdin io.Reader, w io.Writer, noInput, useShell bool) (string, error) {
+	switch {
+	case p.passphrase != "":
+		return p.passphrase, nil
+	case p.cmd != "":
+		return runSecretCommand("--token-passphrase-cmd", p.cmd, useShell)
+	case noInput:
+		return "", usageError("missing --token-passphrase, which can't be prompted for with --no-input")
+	}
+
+	passphrase := interact.Input(bufio.NewScanner(stdin), w, "Please enter the passphrase of the token file: ")
+	if passphrase == "" {
+		return "", usageError("the passphrase can't be empty")
+	}
+	return passphrase, nil
+}
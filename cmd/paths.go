@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// appDirName is the directory holding the executable's files inside the user's config directory.
+	appDirName = "traktdeviceauth"
+
+	// defaultTokenFile is the name of the token file used when a command isn't given --token-file.
+	defaultTokenFile = "token.json"
+)
+
+// defaultPath returns where the file called name is kept by default, inside the traktdeviceauth directory of the
+// user's config directory. Every command resolves its default locations through it.
+func defaultPath(name string) (string, error) {
+	dir, err := userConfigDir(runtime.GOOS, os.Getenv)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDirName, name), nil
+}
+
+// userConfigDir is os.UserConfigDir for goos with the environment read through getenv:
+//   - $XDG_CONFIG_HOME, or ~/.config if it isn't set to an absolute path, on Unix systems
+//   - ~/Library/Application Support on macOS
+//   - %AppData% on Windows
+//   - $home/lib on Plan 9
+func userConfigDir(goos string, getenv func(string) string) (string, error) {
+	switch goos {
+	case "windows":
+		if dir := getenv("AppData"); dir != "" {
+			return dir, nil
+		}
+		return "", errors.New("%AppData% is not defined")
+	case "darwin", "ios":
+		if home := getenv("HOME"); home != "" {
+			return filepath.Join(home, "Library", "Application Support"), nil
+		}
+		return "", errors.New("$HOME is not defined")
+	case "plan9":
+		if home := getenv("home"); home != "" {
+			return filepath.Join(home, "lib"), nil
+		}
+		return "", errors.New("$home is not defined")
+	default:
+		if dir := getenv("XDG_CONFIG_HOME"); dir != "" && filepath.IsAbs(dir) {
+			return dir, nil
+		}
+		if home := getenv("HOME"); home != "" {
+			return filepath.Join(home, ".config"), nil
+		}
+		return "", errors.New("neither $XDG_CONFIG_HOME nor $HOME are defined")
+	}
+}
+
+// tokenFileOrDefault returns path, or the default token file if path is empty.
+func tokenFileOrDefault(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	return defaultPath(defaultTokenFile)
+}
+
+// saveTarget returns the file a command given --save and --token-file should save its token to, or "" if it
+// should print the token. --save picks the default token file, whose directory is created if needed. It is only
+// accessible by the current user, like the token file.
+func saveTarget(save bool, tokenPath string) (string, error) {
+	if !save {
+		return tokenPath, nil
+	}
+	if tokenPath != "" {
+		return "", usageError("--save and --token-file can't be used together")
+	}
+
+	path, err := defaultPath(defaultTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return path, os.MkdirAll(filepath.Dir(path), 0o700)
+}
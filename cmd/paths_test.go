@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestUserConfigDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		goos    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"XDG_CONFIG_HOME", "linux", map[string]string{"XDG_CONFIG_HOME": "/xdg", "HOME": "/home/user"}, "/xdg", false},
+		{"relative XDG_CONFIG_HOME", "linux", map[string]string{"XDG_CONFIG_HOME": "xdg", "HOME": "/home/user"}, filepath.Join("/home/user", ".config"), false},
+		{"HOME", "freebsd", map[string]string{"HOME": "/home/user"}, filepath.Join("/home/user", ".config"), false},
+		{"neither on Unix", "linux", nil, "", true},
+		{"macOS", "darwin", map[string]string{"HOME": "/Users/user", "XDG_CONFIG_HOME": "/xdg"}, filepath.Join("/Users/user", "Library", "Application Support"), false},
+		{"macOS without HOME", "darwin", nil, "", true},
+		{"Windows", "windows", map[string]string{"AppData": `C:\Users\user\AppData\Roaming`, "HOME": "/home/user"}, `C:\Users\user\AppData\Roaming`, false},
+		{"Windows without AppData", "windows", map[string]string{"HOME": "/home/user"}, "", true},
+		{"Plan 9", "plan9", map[string]string{"home": "/usr/user"}, filepath.Join("/usr/user", "lib"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userConfigDir(tt.goos, func(name string) string { return tt.env[name] })
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("userConfigDir = %q, %v, want %q with an error: %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUserConfigDirMatchesOS(t *testing.T) {
+	want, wantErr := os.UserConfigDir()
+	got, err := userConfigDir(runtime.GOOS, os.Getenv)
+	if got != want || (err != nil) != (wantErr != nil) {
+		t.Errorf("userConfigDir = %q, %v, want os.UserConfigDir's %q, %v", got, err, want, wantErr)
+	}
+}
+
+// setConfigHome points the user config directory at a new temporary home directory and returns the default
+// token file in it. It skips the test where the config directory isn't XDG_CONFIG_HOME or ~/.config.
+func setConfigHome(t *testing.T) string {
+	t.Helper()
+
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9":
+		t.Skipf("the config directory on %s doesn't follow XDG_CONFIG_HOME", runtime.GOOS)
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	return filepath.Join(home, ".config", appDirName, defaultTokenFile)
+}
+
+func TestDefaultTokenFile(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	tokenPath := setConfigHome(t)
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+	api := []string{"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}
+
+	// auth --save creates the directory and saves the token there.
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), append([]string{"auth", "--save"}, api...), strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("auth --save: %v\n%s", err, stderr.String())
+	}
+	saved, err := traktdeviceauth.LoadTokenFromFile(tokenPath)
+	if err != nil {
+		t.Fatalf("auth --save didn't save the token to %s: %v", tokenPath, err)
+	}
+	if strings.Contains(stdout.String(), saved.AccessToken) {
+		t.Errorf("auth --save printed the token: %s", stdout.String())
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(filepath.Dir(tokenPath)); err != nil || info.Mode().Perm() != 0o700 {
+			t.Errorf("the config directory has mode %v (%v), want 0700", info.Mode().Perm(), err)
+		}
+	}
+
+	// Commands reading a token default to the same file.
+	stdout.Reset()
+	stderr.Reset()
+	if err := run(context.Background(), []string{"wait", "--timeout", "5s"}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Errorf("wait without --token-file: %v\n%s", err, stderr.String())
+	}
+
+	// A token file given with --token-file wins over the default.
+	other := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "other", RefreshToken: "other", ExpiresAt: time.Now().Add(-time.Hour)})
+	err = run(context.Background(), []string{"wait", "--token-file", other, "--timeout", "100ms", "--interval", "10ms"}, strings.NewReader(""), &stdout, &stderr)
+	if code := exitCode(err); code != exitTimeout {
+		t.Errorf("wait for an expired --token-file returned %v (exit %d), want exit %d", err, code, exitTimeout)
+	}
+}
+
+func TestSaveWithTokenFile(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+	setConfigHome(t)
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"auth", "--save", "--token-file", filepath.Join(t.TempDir(), "token.json"), "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if code := exitCode(err); code != exitUsage {
+		t.Errorf("auth with --save and --token-file returned %v (exit %d), want a usage error", err, code)
+	}
+}
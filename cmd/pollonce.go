@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// Exit codes of poll-once, which describe the outcome of the poll.
+const (
+	exitNetwork   = 4
+	exitUnclaimed = 10
+	exitExpired   = 11
+	exitDenied    = 12
+)
+
+// runPollOnce makes exactly one token request for the device code in a flow file, so that polling can be
+// driven by an external scheduler such as cron.
+func runPollOnce(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api       apiFlags
+		out       outputFlags
+		flowPath  string
+		tokenPath string
+		save      bool
+	)
+
+	fs := flag.NewFlagSet("poll-once", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	out.register(fs)
+	fs.StringVar(&flowPath, "device-code-file", "", "flow file holding the device code to poll for (required)")
+	fs.StringVar(&tokenPath, "token-file", "", "file to save the token to once approved (printed if empty)")
+	fs.BoolVar(&save, "save", false, "save the token to token.json in the user config directory instead of printing it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+	if flowPath == "" {
+		return errors.New("--device-code-file is required")
+	}
+	tokenPath, err := saveTarget(save, tokenPath)
+	if err != nil {
+		return err
+	}
+
+	var flow flowFile
+	if err := readJSONFile(flowPath, &flow); err != nil {
+		return fmt.Errorf("reading %s: %w", flowPath, err)
+	}
+	if flow.LastOutcome == "approved" {
+		fmt.Fprintln(out.messages(stdout, stderr), "The code has already been approved.")
+		return nil
+	}
+	if err := flow.checkExpiry(); err != nil {
+		return err
+	}
+
+	if err := api.prompt(stdin, out.messages(stdout, stderr), true); err != nil {
+		return err
+	}
+
+	t, pollErr := traktdeviceauth.RequestTokenContext(ctx, flow.CodeResponse, api.clientID, api.clientSecret, api.options()...)
+
+	flow.Polls++
+	now := time.Now()
+	flow.LastPollAt = &now
+	flow.LastOutcome = traktdeviceauth.Code(pollErr)
+	if pollErr == nil {
+		flow.LastOutcome = "approved"
+	}
+	if err := writeJSONFile(flowPath, flow); err != nil {
+		return fmt.Errorf("updating %s: %w", flowPath, err)
+	}
+
+	switch code := traktdeviceauth.Code(pollErr); {
+	case pollErr == nil:
+		return out.output(stdout, out.messages(stdout, stderr), tokenPath, t)
+	case code == traktdeviceauth.CodeDeviceCodeUnclaimed, code == traktdeviceauth.CodeRateLimited:
+		fmt.Fprintln(out.messages(stdout, stderr), "The code hasn't been entered yet.")
+		return &exitError{code: exitUnclaimed}
+	case code == traktdeviceauth.CodeDeviceCodeExpired:
+		return &exitError{code: exitExpired, err: pollErr}
+	case code == traktdeviceauth.CodeDeviceCodeDenied:
+		return &exitError{code: exitDenied, err: pollErr}
+	case code == traktdeviceauth.CodeNetwork, code == traktdeviceauth.CodeTimeout:
+		return &exitError{code: exitNetwork, err: pollErr}
+	default:
+		return pollErr
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// newPollOnceFlow generates a code from srv with the code command and returns the flow file it wrote.
+func newPollOnceFlow(t *testing.T, srv *traktdeviceauthtest.Server) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "flow.json")
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), []string{"code", "--code-file", path, "--client-id", "client-id", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("code: %v\n%s", err, stderr.String())
+	}
+	return path
+}
+
+// pollOnce runs poll-once for the flow file at flowPath, saving an approved token to tokenPath.
+func pollOnce(srv *traktdeviceauthtest.Server, flowPath, tokenPath string) error {
+	var stdout, stderr strings.Builder
+	return run(context.Background(), []string{"poll-once", "--device-code-file", flowPath, "--token-file", tokenPath,
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+}
+
+// exitCode returns the exit code run's err results in.
+func exitCode(err error) int {
+	var exitErr *exitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	default:
+		return 1
+	}
+}
+
+// readFlow decodes the flow file at path.
+func readFlow(t *testing.T, path string) flowFile {
+	t.Helper()
+
+	var flow flowFile
+	if err := readJSONFile(path, &flow); err != nil {
+		t.Fatal(err)
+	}
+	return flow
+}
+
+func TestPollOnceOutcomes(t *testing.T) {
+	tests := []struct {
+		name        string
+		scenario    traktdeviceauthtest.Scenario
+		wantExits   []int
+		wantOutcome string
+	}{
+		{"approved", traktdeviceauthtest.ApproveAfterPolls(0), []int{0}, "approved"},
+		{"approved after polls", traktdeviceauthtest.ApproveAfterPolls(2), []int{exitUnclaimed, exitUnclaimed, 0}, "approved"},
+		{"denied", traktdeviceauthtest.DenyAfterPolls(1), []int{exitUnclaimed, exitDenied}, traktdeviceauth.CodeDeviceCodeDenied},
+		{"expired by the server", traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), []int{exitExpired}, traktdeviceauth.CodeDeviceCodeExpired},
+		{"rate limited", traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(429)), []int{exitUnclaimed}, traktdeviceauth.CodeRateLimited},
+		{"other failure", traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(403)), []int{1}, traktdeviceauth.CodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(tt.scenario)
+
+			flowPath := newPollOnceFlow(t, srv)
+			tokenPath := filepath.Join(t.TempDir(), "token.json")
+			for i, want := range tt.wantExits {
+				before := time.Now()
+				err := pollOnce(srv, flowPath, tokenPath)
+				if got := exitCode(err); got != want {
+					t.Fatalf("poll %d exited with %d (%v), want %d", i+1, got, err, want)
+				}
+
+				flow := readFlow(t, flowPath)
+				if flow.Polls != i+1 {
+					t.Errorf("poll %d: the flow file counts %d polls", i+1, flow.Polls)
+				}
+				if flow.LastPollAt == nil || flow.LastPollAt.Before(before.Add(-time.Second)) {
+					t.Errorf("poll %d: last_poll_at is %v, want the time of the poll", i+1, flow.LastPollAt)
+				}
+			}
+
+			if got := readFlow(t, flowPath).LastOutcome; got != tt.wantOutcome {
+				t.Errorf("last_outcome = %q, want %q", got, tt.wantOutcome)
+			}
+			if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != len(tt.wantExits) {
+				t.Errorf("%d token requests were made, want %d", n, len(tt.wantExits))
+			}
+
+			_, err := traktdeviceauth.LoadTokenFromFile(tokenPath)
+			if saved := err == nil; saved != (tt.wantOutcome == "approved") {
+				t.Errorf("token saved: %v (%v), want %v", saved, err, tt.wantOutcome == "approved")
+			}
+		})
+	}
+}
+
+func TestPollOnceAfterApproval(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	flowPath := newPollOnceFlow(t, srv)
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	for i := 0; i < 2; i++ {
+		if err := pollOnce(srv, flowPath, tokenPath); err != nil {
+			t.Fatalf("poll %d: %v", i+1, err)
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 1 {
+		t.Errorf("%d token requests were made, want 1 as the code was already approved", n)
+	}
+	if flow := readFlow(t, flowPath); flow.Polls != 1 {
+		t.Errorf("the flow file counts %d polls, want 1", flow.Polls)
+	}
+}
+
+func TestPollOnceNetworkFailure(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	flowPath := newPollOnceFlow(t, srv)
+	srv.Close()
+
+	err := pollOnce(srv, flowPath, filepath.Join(t.TempDir(), "token.json"))
+	if got := exitCode(err); got != exitNetwork {
+		t.Fatalf("exited with %d (%v), want %d", got, err, exitNetwork)
+	}
+	if got := readFlow(t, flowPath).LastOutcome; got != traktdeviceauth.CodeNetwork {
+		t.Errorf("last_outcome = %q, want %q", got, traktdeviceauth.CodeNetwork)
+	}
+}
+
+func TestPollOnceExpiredFlowFile(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	flowPath := newPollOnceFlow(t, srv)
+	flow := readFlow(t, flowPath)
+	flow.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := writeJSONFile(flowPath, flow); err != nil {
+		t.Fatal(err)
+	}
+
+	err := pollOnce(srv, flowPath, filepath.Join(t.TempDir(), "token.json"))
+	if got := exitCode(err); got != exitExpired {
+		t.Fatalf("exited with %d (%v), want %d", got, err, exitExpired)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 0 {
+		t.Errorf("%d token requests were made for an expired code, want 0", n)
+	}
+	if got := readFlow(t, flowPath).Polls; got != 0 {
+		t.Errorf("the flow file counts %d polls, want 0", got)
+	}
+}
+
+func TestPollOnceRequiresFlowFile(t *testing.T) {
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"poll-once", "--client-id", "client-id", "--client-secret", "client-secret", "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "--device-code-file") {
+		t.Fatalf("got %v, want an error about --device-code-file", err)
+	}
+}
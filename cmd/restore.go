@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// runRestore lists the backups of a token file, or rolls the token file back to one of them after checking
+// that it holds a token, which can only be done for unencrypted backups. The token being replaced is backed up
+// first, so a restore can be undone.
+func runRestore(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		tokenPath string
+		list      bool
+		stamp     string
+		backups   int
+	)
+
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&tokenPath, "token-file", "", "token file to restore (default: token.json in the user config directory)")
+	fs.BoolVar(&list, "list", false, "list the backups of the token file, newest first, instead of restoring one")
+	fs.StringVar(&stamp, "backup", "", "`timestamp` of the backup to restore, as printed by --list (the newest if empty)")
+	fs.IntVar(&backups, "backups", defaultBackups, backupsUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("restore takes no arguments")
+	}
+	if list && stamp != "" {
+		return usageError("--list and --backup can't be used together")
+	}
+	if backups < 0 {
+		return usageError("--backups can't be negative")
+	}
+	tokenPath, err := tokenFileOrDefault(tokenPath)
+	if err != nil {
+		return err
+	}
+
+	available, err := listBackups(tokenPath)
+	if err != nil {
+		return err
+	}
+	if list {
+		printBackups(stdout, available)
+		return nil
+	}
+	if len(available) == 0 {
+		return fmt.Errorf("there are no backups of %s", tokenPath)
+	}
+
+	b := available[0]
+	if stamp != "" {
+		found := false
+		for _, a := range available {
+			if a.stamp == stamp {
+				b, found = a, true
+				break
+			}
+		}
+		if !found {
+			return usageError("there is no backup of %s from %s, see restore --list", tokenPath, stamp)
+		}
+	}
+
+	if raw, err := os.ReadFile(b.path); err == nil && bytes.HasPrefix(raw, []byte(encryptedTokenPrefix)) {
+		return restoreEncrypted(stdout, tokenPath, b, raw, backups)
+	}
+	t, err := traktdeviceauth.LoadTokenFromFile(b.path)
+	if err != nil {
+		return fmt.Errorf("the backup from %s can't be restored: %w", b.stamp, err)
+	}
+	if err := saveTokenFile(tokenPath, t, backups); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Restored %s from the backup taken at %s. The token expires at %s.\n",
+		tokenPath, b.taken.Local().Format(time.RFC1123), t.ExpiresAt.Format(time.RFC1123))
+	return nil
+}
+
+// restoreEncrypted restores tokenPath from the backup b of an encrypted token file, whose contents are raw.
+// The backup is copied as it is, since it can't be checked without the passphrase.
+func restoreEncrypted(w io.Writer, tokenPath string, b tokenBackup, raw []byte, keep int) error {
+	if keep > 0 {
+		if err := backupTokenFile(tokenPath, time.Now(), keep); err != nil {
+			return fmt.Errorf("backing up %s before overwriting it: %w", tokenPath, err)
+		}
+	}
+	if err := writeFileAtomic(tokenPath, raw); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Restored %s from the encrypted backup taken at %s.\n", tokenPath, b.taken.Local().Format(time.RFC1123))
+	return nil
+}
+
+// printBackups writes a table of backups to w, with the expiry of the token in each of them.
+func printBackups(w io.Writer, backups []tokenBackup) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tTAKEN\tTOKEN EXPIRES")
+	for _, b := range backups {
+		expires := "unreadable"
+		if t, err := traktdeviceauth.LoadTokenFromFile(b.path); err == nil {
+			expires = t.ExpiresAt.Format(time.RFC1123)
+		} else if raw, err := os.ReadFile(b.path); err == nil && bytes.HasPrefix(raw, []byte(encryptedTokenPrefix)) {
+			expires = "encrypted"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", b.stamp, b.taken.Local().Format(time.RFC1123), expires)
+	}
+	tw.Flush()
+}
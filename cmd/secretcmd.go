@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// runSecretCommand runs command and returns its trimmed stdout, for reading secrets from password managers.
+// Without useShell, command is split into arguments on whitespace, respecting single and double quotes, and run
+// directly. The command's stderr is passed through so that password managers can prompt for unlocking.
+//
+// Errors never include the command's output, since it may contain the secret.
+func runSecretCommand(name, command string, useShell bool) (string, error) {
+	var args []string
+	switch {
+	case useShell && runtime.GOOS == "windows":
+		args = []string{"cmd", "/C", command}
+	case useShell:
+		args = []string{"/bin/sh", "-c", command}
+	default:
+		var err error
+		if args, err = splitCommand(command); err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("%s: the command is empty", name)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	secret := strings.TrimSpace(stdout.String())
+	if secret == "" {
+		return "", fmt.Errorf("%s: the command printed nothing", name)
+	}
+	return secret, nil
+}
+
+// splitCommand splits s into arguments on whitespace. Single and double quotes group words into one
+// argument, and a backslash escapes the next character outside of single quotes.
+func splitCommand(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in the command")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"pass show trakt/client-secret", []string{"pass", "show", "trakt/client-secret"}, false},
+		{"  op  read\t'op://vault/trakt/secret'\n", []string{"op", "read", "op://vault/trakt/secret"}, false},
+		{`echo "two words" 'it''s'`, []string{"echo", "two words", "its"}, false},
+		{`echo a\ b "c\"d" 'e\f'`, []string{"echo", "a b", `c"d`, `e\f`}, false},
+		{`echo ""`, []string{"echo", ""}, false},
+		{"", nil, false},
+		{`echo "unterminated`, nil, true},
+		{`echo trailing\`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitCommand(%q) returned error %v, want one: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRunSecretCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX system")
+	}
+
+	tests := []struct {
+		name     string
+		command  string
+		useShell bool
+		want     string
+		wantErr  string
+	}{
+		{"trimmed", `printf '  s3cret\n\n'`, false, "s3cret", ""},
+		{"quoted argument", `echo "s3cret with spaces"`, false, "s3cret with spaces", ""},
+		{"no shell", `echo s3cret | tr a-z A-Z`, false, "s3cret | tr a-z A-Z", ""},
+		{"shell", `echo s3cret | tr a-z A-Z`, true, "S3CRET", ""},
+		{"non-zero exit", `sh -c "echo s3cret; exit 3"`, false, "", "exit status 3"},
+		{"empty output", `printf '  \n'`, false, "", "printed nothing"},
+		{"empty command", "  ", false, "", "the command is empty"},
+		{"missing command", "traktdeviceauth-no-such-command", false, "", "executable file not found"},
+		{"bad quoting", `echo "s3cret`, false, "", "unterminated quote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runSecretCommand("--client-secret-cmd", tt.command, tt.useShell)
+			if tt.wantErr == "" {
+				if err != nil || got != tt.want {
+					t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("got %q, want an error", got)
+			}
+			msg := err.Error()
+			if !strings.HasPrefix(msg, "--client-secret-cmd: ") || !strings.Contains(msg, tt.wantErr) {
+				t.Errorf("got error %q, want it to name the flag and say %q", msg, tt.wantErr)
+			}
+			if strings.Contains(msg, "s3cret") {
+				t.Errorf("the error %q echoes the command's output", msg)
+			}
+		})
+	}
+}
+
+func TestClientSecretCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX system")
+	}
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+
+	flowPath := newPollOnceFlow(t, srv)
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	var stdout, stderr strings.Builder
+	if err := run(context.Background(), []string{"poll-once", "--device-code-file", flowPath, "--token-file", tokenPath,
+		"--client-id", "client-id", "--client-secret-cmd", `printf 'client-secret\n'`, "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("poll-once: %v\n%s", err, stderr.String())
+	}
+	if strings.Contains(stdout.String()+stderr.String(), "client-secret") {
+		t.Error("the secret was printed")
+	}
+
+	// A failing command stops before any request is made.
+	flowPath = newPollOnceFlow(t, srv)
+	before := len(srv.Requests())
+	err := run(context.Background(), []string{"poll-once", "--device-code-file", flowPath, "--token-file", tokenPath,
+		"--client-id", "client-id", "--client-secret-cmd", "false", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "--client-secret-cmd") {
+		t.Errorf("poll-once with a failing command returned %v, want an error naming --client-secret-cmd", err)
+	}
+	if n := len(srv.Requests()) - before; n != 0 {
+		t.Errorf("%d requests were made after the command failed", n)
+	}
+
+	// The flag can't be combined with --client-secret.
+	err = run(context.Background(), []string{"code", "--client-secret", "client-secret", "--client-secret-cmd", "true", "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if got := exitCode(err); got != exitUsage {
+		t.Errorf("both flags exited with %d (%v), want %d", got, err, exitUsage)
+	}
+}
+
+func TestPassphraseCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX system")
+	}
+
+	path := saveEncryptedToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)}, "open sesame")
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"direct", []string{"--token-passphrase-cmd", `echo "open sesame"`}, ""},
+		{"shell", []string{"--token-passphrase-cmd", `echo open sesame | cat`, "--secret-cmd-shell"}, ""},
+		{"non-zero exit", []string{"--token-passphrase-cmd", "false"}, "--token-passphrase-cmd: exit status 1"},
+		{"empty output", []string{"--token-passphrase-cmd", "true"}, "--token-passphrase-cmd: the command printed nothing"},
+		{"with --token-passphrase", []string{"--token-passphrase-cmd", "true", "--token-passphrase", "open sesame"}, "can't be used together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append(append([]string{"inspect", "--no-input"}, tt.args...), path), strings.NewReader(""), &stdout, &stderr)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("inspect: %v\n%s", err, stderr.String())
+				}
+				if strings.Contains(stdout.String(), "open sesame") {
+					t.Error("inspect printed the passphrase")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("inspect returned %v, want an error saying %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// version is the release the executable was built from, set with -ldflags "-X main.version=v1.2.3".
+var version = "development"
+
+const (
+	releasesRepo      = "BrenekH/go-traktdeviceauth"
+	checksumsAsset    = "checksums.txt"
+	maxExecutableSize = 256 << 20
+)
+
+// errChecksumMismatch is returned when a downloaded executable doesn't match the published checksum.
+var errChecksumMismatch = errors.New("the download doesn't match the published checksum")
+
+// release is the part of a GitHub release which self-update needs.
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+// releaseAsset is a file attached to a release.
+type releaseAsset struct {
+	Name        string `json:"name"`
+	DownloadURL string `json:"browser_download_url"`
+}
+
+// asset returns the asset of r called name.
+func (r release) asset(name string) (releaseAsset, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return releaseAsset{}, fmt.Errorf("release %s has no %s", r.TagName, name)
+}
+
+// runSelfUpdate replaces the running executable with the one from the latest release, or the release given
+// with --version, after checking it against the release's checksums. The executable is left alone if anything
+// goes wrong.
+func runSelfUpdate(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		checkOnly bool
+		want      string
+		apiURL    string
+	)
+
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&checkOnly, "check-only", false, "only report whether a newer release is available")
+	fs.StringVar(&want, "version", "", "install this release, such as v1.2.3, instead of the latest one")
+	fs.StringVar(&apiURL, "github-api-url", "https://api.github.com", "base url of the GitHub API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	rel, err := fetchRelease(ctx, client, apiURL, want)
+	if err != nil {
+		return err
+	}
+
+	if rel.TagName == version && want == "" {
+		fmt.Fprintf(stdout, "Already up to date at %s.\n", version)
+		return nil
+	}
+	if checkOnly {
+		fmt.Fprintf(stdout, "%s is available, this is %s.\n", rel.TagName, version)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	tmp, err := downloadVerified(ctx, client, rel, executableAssetName(runtime.GOOS, runtime.GOARCH), filepath.Dir(exe))
+	if err != nil {
+		return err
+	}
+	if err := replaceExecutable(exe, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Updated %s from %s to %s.\n", exe, version, rel.TagName)
+	return nil
+}
+
+// executableAssetName returns the name of the release asset built for goos and goarch.
+func executableAssetName(goos, goarch string) string {
+	name := "trackdeviceauth-" + goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// fetchRelease looks up the release tagged tag, or the latest release if tag is empty.
+func fetchRelease(ctx context.Context, client *http.Client, apiURL, tag string) (release, error) {
+	u := strings.TrimSuffix(apiURL, "/") + "/repos/" + releasesRepo + "/releases/latest"
+	if tag != "" {
+		u = strings.TrimSuffix(apiURL, "/") + "/repos/" + releasesRepo + "/releases/tags/" + tag
+	}
+
+	resp, err := get(ctx, client, u)
+	if err != nil {
+		return release{}, fmt.Errorf("looking up the release: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var rel release
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&rel); err != nil {
+		return release{}, fmt.Errorf("looking up the release: %w", err)
+	}
+	if rel.TagName == "" {
+		return release{}, errors.New("looking up the release: the response has no tag")
+	}
+	return rel, nil
+}
+
+// downloadVerified downloads the asset name of rel into a new file in dir and checks it against the release's
+// checksums. It returns the path of the executable file, which is removed again if anything fails.
+func downloadVerified(ctx context.Context, client *http.Client, rel release, name, dir string) (path string, err error) {
+	asset, err := rel.asset(name)
+	if err != nil {
+		return "", err
+	}
+	sums, err := rel.asset(checksumsAsset)
+	if err != nil {
+		return "", err
+	}
+	want, err := fetchChecksum(ctx, client, sums.DownloadURL, name)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := get(ctx, client, asset.DownloadURL)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	// The file is created next to the executable, so that renaming it over the executable can't cross filesystems.
+	f, err := os.CreateTemp(dir, "."+name+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, maxExecutableSize+1))
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", name, err)
+	}
+	if n > maxExecutableSize {
+		return "", fmt.Errorf("downloading %s: larger than %d bytes", name, maxExecutableSize)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return "", fmt.Errorf("%s: %w (expected %s, got %s)", name, errChecksumMismatch, want, got)
+	}
+
+	if err := f.Chmod(0o755); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// fetchChecksum returns the SHA-256 of name from the checksums file at url, which has the format written by
+// sha256sum.
+func fetchChecksum(ctx context.Context, client *http.Client, url, name string) (string, error) {
+	resp, err := get(ctx, client, url)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", checksumsAsset, err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("downloading %s: %w", checksumsAsset, err)
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// get sends a GET request to url and returns the response if its status is 200.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// replaceExecutable atomically replaces the executable at exe with the file at newPath. Windows doesn't allow
+// replacing a running executable, but does allow renaming it, so there the old executable is moved aside first
+// and moved back if the new one can't take its place.
+func replaceExecutable(exe, newPath string) error {
+	if runtime.GOOS != "windows" {
+		return os.Rename(newPath, exe)
+	}
+
+	old := exe + ".old"
+	os.Remove(old) // Left behind by an earlier update.
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		if restoreErr := os.Rename(old, exe); restoreErr != nil {
+			return fmt.Errorf("%v, and restoring %s failed: %v", err, exe, restoreErr)
+		}
+		return err
+	}
+	// Removing the old executable fails while it is running, in which case the next update removes it.
+	os.Remove(old)
+	return nil
+}
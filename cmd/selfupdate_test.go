@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// releaseServer is a stub of the GitHub releases API serving a single release, whose assets are the executable
+// for this platform and the checksums file.
+type releaseServer struct {
+	*httptest.Server
+	tag        string
+	executable []byte // The executable which is served.
+	published  []byte // The executable whose checksum is published.
+}
+
+func newReleaseServer(t *testing.T, tag string, executable, published []byte) *releaseServer {
+	t.Helper()
+
+	s := &releaseServer{tag: tag, executable: executable, published: published}
+	name := executableAssetName(runtime.GOOS, runtime.GOARCH)
+	mux := http.NewServeMux()
+	serveRelease := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(release{TagName: s.tag, Assets: []releaseAsset{
+			{Name: name, DownloadURL: s.URL + "/download/" + name},
+			{Name: checksumsAsset, DownloadURL: s.URL + "/download/" + checksumsAsset},
+		}})
+	}
+	mux.HandleFunc("/repos/"+releasesRepo+"/releases/latest", serveRelease)
+	mux.HandleFunc("/repos/"+releasesRepo+"/releases/tags/"+tag, serveRelease)
+	mux.HandleFunc("/download/"+name, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(s.executable)
+	})
+	mux.HandleFunc("/download/"+checksumsAsset, func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256(s.published)
+		fmt.Fprintf(w, "%s  other-asset\n%s  %s\n", strings.Repeat("0", 64), hex.EncodeToString(sum[:]), name)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dirEntries returns the names of the files in dir.
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestDownloadVerified(t *testing.T) {
+	good := []byte("#!/bin/sh\necho new\n")
+	name := executableAssetName(runtime.GOOS, runtime.GOARCH)
+
+	tests := []struct {
+		name       string
+		executable []byte
+		published  []byte
+		asset      string
+		wantErr    error
+	}{
+		{"good", good, good, name, nil},
+		{"corrupted", []byte("#!/bin/sh\necho evil\n"), good, name, errChecksumMismatch},
+		{"truncated", good[:5], good, name, errChecksumMismatch},
+		{"missing asset", good, good, "trackdeviceauth-plan9-mips", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newReleaseServer(t, "v1.2.3", tt.executable, tt.published)
+			rel, err := fetchRelease(context.Background(), srv.Client(), srv.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			path, err := downloadVerified(context.Background(), srv.Client(), rel, tt.asset, dir)
+			if tt.asset != name {
+				if err == nil {
+					t.Fatalf("downloadVerified of an asset the release doesn't have returned %s", path)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("downloadVerified returned %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if names := dirEntries(t, dir); len(names) != 0 {
+					t.Errorf("a failed download left %v behind", names)
+				}
+				return
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, good) {
+				t.Errorf("the downloaded file holds %q, want %q", got, good)
+			}
+			if filepath.Dir(path) != dir {
+				t.Errorf("the download is at %s, want it in %s next to the executable", path, dir)
+			}
+			if info, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm()&0o111 == 0 {
+				t.Errorf("the download isn't executable: %v %v", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestFetchChecksumMissing(t *testing.T) {
+	srv := newReleaseServer(t, "v1.2.3", nil, nil)
+	_, err := fetchChecksum(context.Background(), srv.Client(), srv.URL+"/download/"+checksumsAsset, "not-listed")
+	if err == nil || !strings.Contains(err.Error(), "no checksum for not-listed") {
+		t.Errorf("fetchChecksum of an unlisted asset returned %v", err)
+	}
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "traktauth")
+	newPath := filepath.Join(dir, ".traktauth.tmp")
+	if err := os.WriteFile(exe, []byte("old"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, []byte("new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replaceExecutable(exe, newPath); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(exe); err != nil || string(got) != "new" {
+		t.Errorf("the executable holds %q (%v), want the new one", got, err)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("the replacement left %v behind", names)
+	}
+
+	// A missing new file leaves the executable in place.
+	if err := replaceExecutable(exe, filepath.Join(dir, "missing")); err == nil {
+		t.Error("replacing the executable with a missing file succeeded")
+	}
+	if got, err := os.ReadFile(exe); err != nil || string(got) != "new" {
+		t.Errorf("a failed replacement changed the executable to %q (%v)", got, err)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	good := []byte("new executable")
+
+	tests := []struct {
+		name       string
+		version    string
+		args       []string
+		executable []byte
+		wantOut    string
+		wantErr    error
+	}{
+		{"check only", "v1.0.0", []string{"--check-only"}, good, "v1.2.3 is available, this is v1.0.0.\n", nil},
+		{"up to date", "v1.2.3", nil, good, "Already up to date at v1.2.3.\n", nil},
+		{"check only with a version", "v1.0.0", []string{"--check-only", "--version", "v1.2.3"}, good, "v1.2.3 is available, this is v1.0.0.\n", nil},
+		{"corrupted", "v1.0.0", nil, []byte("evil executable"), "", errChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newReleaseServer(t, "v1.2.3", tt.executable, good)
+			defer func(v string) { version = v }(version)
+			version = tt.version
+
+			// The test binary is the running executable, so a failed update must leave it as it was.
+			exe, err := os.Executable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.ReadFile(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entriesBefore := dirEntries(t, filepath.Dir(exe))
+
+			var stdout, stderr strings.Builder
+			err = run(context.Background(), append([]string{"self-update", "--github-api-url", srv.URL}, tt.args...),
+				strings.NewReader(""), &stdout, &stderr)
+			if !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("self-update returned %v, want %v", err, tt.wantErr)
+			}
+			if stdout.String() != tt.wantOut {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantOut)
+			}
+
+			after, err := os.ReadFile(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, after) {
+				t.Fatal("self-update changed the running executable")
+			}
+			if entries := dirEntries(t, filepath.Dir(exe)); len(entries) != len(entriesBefore) {
+				t.Errorf("self-update left files next to the executable: %v, before %v", entries, entriesBefore)
+			}
+		})
+	}
+}
+
+func TestSelfUpdateUnknownVersion(t *testing.T) {
+	srv := newReleaseServer(t, "v1.2.3", nil, nil)
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"self-update", "--github-api-url", srv.URL, "--version", "v9.9.9"},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("self-update of a release which doesn't exist returned %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/webflow"
+)
+
+// runServe hosts the webflow handler so the user can authorize from another device's browser,
+// for example a phone on the same LAN as a headless box. Approved tokens are saved and printed like auth does.
+func runServe(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api             apiFlags
+		out             outputFlags
+		store           storeFlags
+		tokenPath       string
+		save            bool
+		listen          string
+		once            bool
+		shutdownTimeout time.Duration
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	out.register(fs)
+	store.register(fs)
+	fs.StringVar(&tokenPath, "token-file", "", "file to save approved tokens to (printed if empty)")
+	fs.BoolVar(&save, "save", false, "save approved tokens to token.json in the user config directory instead of printing them")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8042", "address to serve the authorization page on")
+	fs.BoolVar(&once, "once", false, "shut down after the first approval")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for open connections when shutting down")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+	if err := store.validate(); err != nil {
+		return err
+	}
+	if store.external() && (tokenPath != "" || save) {
+		return usageError("--token-file and --save can't be used with --store " + store.kind)
+	}
+	tokenPath, err := saveTarget(save, tokenPath)
+	if err != nil {
+		return err
+	}
+	if store.encrypted() && tokenPath == "" {
+		return usageError("--store encrypted-file needs --token-file or --save")
+	}
+
+	messages := out.messages(stdout, stderr)
+	if err := api.prompt(stdin, messages, true); err != nil {
+		return err
+	}
+	if err := store.unlock(&api, stdin, messages); err != nil {
+		return err
+	}
+
+	if !isLoopback(listen) {
+		fmt.Fprintf(stderr, "Warning: %s is reachable from other machines. Anyone who can reach it can link their Trakt account to this app.\n", listen)
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Approvals are delivered one at a time, so that two of them can't write the same token file at once.
+	var (
+		mu         sync.Mutex
+		deliverErr error
+	)
+	handler := webflow.NewFlowHandler(api.clientID, api.clientSecret, func(t traktdeviceauth.TokenResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		deliverErr = deliverToken(ctx, &api, &out, &store, tokenPath, stdout, messages, t)
+		if deliverErr != nil {
+			fmt.Fprintf(stderr, "Saving the approved token failed: %v\n", deliverErr)
+		}
+		if once {
+			cancel()
+		}
+	}, webflow.WithClientOptions(api.options()...))
+	srv := &http.Server{Handler: handler}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	fmt.Fprintf(messages, "Open http://%s/ in a browser to connect your Trakt account.\n", ln.Addr())
+
+	select {
+	case err := <-serveErr:
+		handler.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+
+	err = srv.Shutdown(shutdownCtx)
+	handler.Close()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("connections were still open after %s", shutdownTimeout)
+	} else if err != nil {
+		return err
+	}
+
+	// With --once, the exit status tells whether the token was saved.
+	if once {
+		mu.Lock()
+		defer mu.Unlock()
+		return deliverErr
+	}
+	return nil
+}
+
+// isLoopback reports whether addr only listens on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestServeSavesApprovedToken(t *testing.T) {
+	// Without a script the fake server approves a code on its first poll, which happens after a second.
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	stdoutR, stdoutW := io.Pipe()
+	var stderr strings.Builder
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{"serve", "--listen", "127.0.0.1:0", "--once", "--token-file", path,
+			"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"},
+			strings.NewReader(""), stdoutW, &stderr)
+		stdoutW.Close()
+	}()
+
+	// The address is only known once serve prints it.
+	lines := bufio.NewScanner(stdoutR)
+	if !lines.Scan() {
+		t.Fatalf("serve printed nothing: %v\n%s", <-done, stderr.String())
+	}
+	line := lines.Text()
+	if !strings.HasPrefix(line, "Open http://") {
+		t.Fatalf("serve printed %q, want the address to open", line)
+	}
+	url := strings.TrimSuffix(strings.Fields(line)[1], "/")
+	go io.Copy(io.Discard, stdoutR)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /: %d %s", resp.StatusCode, page)
+	}
+	codes := srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)
+	if len(codes) != 1 {
+		t.Fatalf("%d codes were requested, want 1", len(codes))
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve: %v\n%s", err, stderr.String())
+		}
+	case <-ctx.Done():
+		t.Fatal("serve didn't shut down after the approval")
+	}
+
+	saved, err := traktdeviceauth.LoadTokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == "" || saved.RefreshToken == "" {
+		t.Errorf("the token file holds %+v", saved)
+	}
+	if _, err := client.Get(url + "/status"); err == nil {
+		t.Error("serve still answers after shutting down")
+	}
+}
+
+func TestServeWarnsAboutNonLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The cancelled context shuts serve down as soon as it listens.
+	var stdout, stderr strings.Builder
+	err := run(ctx, []string{"serve", "--listen", ":0", "--client-id", "client-id", "--client-secret", "client-secret", "--no-input"},
+		strings.NewReader(""), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "Warning: :0 is reachable from other machines") {
+		t.Errorf("serve warned %q", stderr.String())
+	}
+}
+
+func TestServeFlags(t *testing.T) {
+	tests := [][]string{
+		{"--store", "keyring", "--keyring-service", "service", "--token-file", "token.json"},
+		{"--store", "encrypted-file", "--token-passphrase", "p"},
+		{"--save", "--token-file", "token.json"},
+		{"--format", "unknown"},
+	}
+	for _, args := range tests {
+		args = append([]string{"serve", "--client-id", "client-id", "--client-secret", "client-secret", "--no-input"}, args...)
+		err := run(context.Background(), args, strings.NewReader(""), io.Discard, io.Discard)
+		var exitErr *exitError
+		if !errors.As(err, &exitErr) || exitErr.code != exitUsage {
+			t.Errorf("%v returned %v, want a usage error", args, err)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8042": true,
+		"[::1]:8042":     true,
+		"localhost:8042": true,
+		":8042":          false,
+		"0.0.0.0:8042":   false,
+		"192.168.1.2:80": false,
+		"nonsense":       false,
+	}
+	for addr, want := range tests {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
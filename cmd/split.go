@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// runCode generates a device code and outputs it as a flow file, so that another invocation of token,
+// possibly on another machine, can wait for the user to approve it.
+func runCode(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api      apiFlags
+		codePath string
+		lang     string
+	)
+
+	fs := flag.NewFlagSet("code", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	fs.StringVar(&codePath, "code-file", "", "file to write the code to (stdout if empty)")
+	fs.StringVar(&lang, "lang", "", "language of the instructions for the user, such as de or pt-BR (en, de, fr, es, pt and it are available)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+
+	// Only the client id is needed to generate a code, and stdout is reserved for the JSON document.
+	if err := api.prompt(stdin, stderr, false); err != nil {
+		return err
+	}
+
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, api.clientID, api.options()...)
+	if err != nil {
+		return err
+	}
+	flow := newFlowFile(codeResp, time.Now())
+
+	if lang != "" {
+		fmt.Fprintln(stderr, traktdeviceauth.Instructions(codeResp, lang))
+	} else {
+		fmt.Fprintf(stderr, "Please visit %s and enter the following code: %s\n", codeResp.VerificationURL, codeResp.UserCode)
+	}
+
+	if codePath == "" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(flow)
+	}
+	return writeJSONFile(codePath, flow)
+}
+
+// runToken waits for the user to approve a device code and outputs the token. The code is read from the file
+// given as the only argument or with --code-file, or from stdin if neither is given or the file is "-".
+// Both the flow files written by code and bare CodeResponse documents are accepted.
+func runToken(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api       apiFlags
+		out       outputFlags
+		codePath  string
+		tokenPath string
+		save      bool
+		showStats bool
+	)
+
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	out.register(fs)
+	fs.StringVar(&codePath, "code-file", "", "file holding the code written by the code command (read from stdin if empty or -)")
+	fs.StringVar(&tokenPath, "token-file", "", "file to save the token to once approved (printed if empty)")
+	fs.BoolVar(&save, "save", false, "save the token to token.json in the user config directory instead of printing it")
+	fs.BoolVar(&showStats, "stats", false, "print how long the flow took and how many polls it needed to stderr once it ends")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case fs.NArg() > 1:
+		return usageError("token takes at most one argument")
+	case fs.NArg() == 1 && codePath != "":
+		return usageError("the code can't be given both as an argument and with --code-file")
+	case fs.NArg() == 1:
+		codePath = fs.Arg(0)
+	}
+	tokenPath, err := saveTarget(save, tokenPath)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	if codePath == "" || codePath == "-" {
+		if api.clientID == "" || (api.clientSecret == "" && api.secretCmd == "") {
+			return usageError("--client-id and --client-secret or --client-secret-cmd are required when the code is read from stdin")
+		}
+		codePath = "stdin"
+		b, err = io.ReadAll(stdin)
+	} else {
+		b, err = os.ReadFile(codePath)
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", codePath, err)
+	}
+
+	flow, err := parseCodeDocument(b, time.Now())
+	if err != nil {
+		return usageError("reading %s: %v", codePath, err)
+	}
+	if err := flow.checkExpiry(); err != nil {
+		return err
+	}
+
+	if err := api.prompt(stdin, stderr, true); err != nil {
+		return err
+	}
+
+	// Flow files written by older versions have no ExpiresAt in the code, which PollForAuthToken needs to
+	// stop at the code's real expiry.
+	codeResp := flow.CodeResponse
+	codeResp.ExpiresAt = flow.ExpiresAt
+	codeResp.ExpiresIn = int(time.Until(flow.ExpiresAt) / time.Second)
+
+	var stats traktdeviceauth.PollStats
+	t, err := traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, api.clientID, api.clientSecret, append(api.options(), traktdeviceauth.WithPollStats(&stats))...)
+	if showStats {
+		printStats(stderr, stats)
+	}
+	if err != nil {
+		return err
+	}
+
+	return out.output(stdout, out.messages(stdout, stderr), tokenPath, t)
+}
+
+// parseCodeDocument decodes either a flow file or a bare CodeResponse, as returned by the Trakt API. A bare
+// CodeResponse without expires_at, as Trakt returns it, is assumed to have been generated at now.
+func parseCodeDocument(b []byte, now time.Time) (flowFile, error) {
+	var flow flowFile
+	if err := json.Unmarshal(b, &flow); err != nil {
+		return flowFile{}, fmt.Errorf("malformed JSON: %w", err)
+	}
+	if flow.CodeResponse.DeviceCode != "" {
+		if flow.ExpiresAt.IsZero() {
+			return flowFile{}, errors.New("missing expires_at")
+		}
+		return flow, nil
+	}
+
+	var codeResp traktdeviceauth.CodeResponse
+	if err := json.Unmarshal(b, &codeResp); err != nil {
+		return flowFile{}, fmt.Errorf("malformed JSON: %w", err)
+	}
+	if codeResp.DeviceCode == "" {
+		return flowFile{}, errors.New("missing device_code")
+	}
+	if codeResp.ExpiresIn <= 0 {
+		return flowFile{}, errors.New("missing expires_in")
+	}
+	return newFlowFile(codeResp, now), nil
+}
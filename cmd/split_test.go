@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestCodeTokenRoundTrip(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var code, codeErr strings.Builder
+	if err := run(ctx, []string{"code", "--client-id", "client-id", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &code, &codeErr); err != nil {
+		t.Fatalf("code: %v\n%s", err, codeErr.String())
+	}
+	flow, err := parseCodeDocument([]byte(code.String()), time.Now())
+	if err != nil {
+		t.Fatalf("code printed %q: %v", code.String(), err)
+	}
+	if flow.CodeResponse.UserCode == "" || time.Until(flow.ExpiresAt) < 9*time.Minute {
+		t.Errorf("code printed %+v, want a code with its absolute expiry", flow)
+	}
+	if !strings.Contains(codeErr.String(), flow.CodeResponse.UserCode) {
+		t.Errorf("the instructions on stderr don't show the code: %q", codeErr.String())
+	}
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	var stdout, stderr strings.Builder
+	if err := run(ctx, []string{"token", "--token-file", tokenPath, "--client-id", "client-id", "--client-secret", "client-secret",
+		"--base-url", srv.URL, "--no-input", "-"}, strings.NewReader(code.String()), &stdout, &stderr); err != nil {
+		t.Fatalf("token: %v\n%s", err, stderr.String())
+	}
+
+	saved, err := traktdeviceauth.LoadTokenFromFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == "" {
+		t.Error("the saved token has no access token")
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d codes were generated, want 1", n)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 2 {
+		t.Errorf("%d token requests were made, want 2", n)
+	}
+}
+
+func TestCodeTokenRoundTripWithCodeFile(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	codePath := filepath.Join(t.TempDir(), "code.json")
+	var stdout, stderr strings.Builder
+	if err := run(ctx, []string{"code", "--code-file", codePath, "--client-id", "client-id", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("code: %v\n%s", err, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("code with --code-file printed %q to stdout", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := run(ctx, []string{"token", "--code-file", codePath, "--format", "json", "--client-id", "client-id", "--client-secret", "client-secret",
+		"--base-url", srv.URL, "--no-input"}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("token: %v\n%s", err, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"access_token"`) {
+		t.Errorf("token printed %q, want the token as JSON", stdout.String())
+	}
+}
+
+func TestTokenHonorsOriginalExpiry(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The server gave the code ten minutes, but it was generated long enough ago that only two seconds are left.
+	codePath := filepath.Join(t.TempDir(), "code.json")
+	var stdout, stderr strings.Builder
+	if err := run(ctx, []string{"code", "--code-file", codePath, "--client-id", "client-id", "--base-url", srv.URL, "--no-input"},
+		strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("code: %v\n%s", err, stderr.String())
+	}
+	flow := readFlow(t, codePath)
+	flow.ExpiresAt = time.Now().Add(2 * time.Second)
+	if err := writeJSONFile(codePath, flow); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := run(ctx, []string{"token", "--code-file", codePath, "--client-id", "client-id", "--client-secret", "client-secret",
+		"--base-url", srv.URL, "--no-input"}, strings.NewReader(""), &stdout, &stderr)
+	if !errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired) {
+		t.Fatalf("token returned %v, want ErrDeviceCodeExpired", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("token polled for %s after the code expired", elapsed)
+	}
+}
+
+func TestTokenFromStdin(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Interval = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Another program started the flow with the raw API, so the document has no absolute expiry.
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := fmt.Sprintf(`{"device_code":%q,"user_code":%q,"verification_url":%q,"expires_in":600,"interval":1}`,
+		codeResp.DeviceCode, codeResp.UserCode, codeResp.VerificationURL)
+
+	var stdout, stderr strings.Builder
+	if err := run(ctx, []string{"token", "--format", "json", "--client-id", "client-id", "--client-secret", "client-secret",
+		"--base-url", srv.URL, "--no-input", "-"}, strings.NewReader(doc), &stdout, &stderr); err != nil {
+		t.Fatalf("token: %v\n%s", err, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"access_token"`) {
+		t.Errorf("token printed %q, want the token as JSON", stdout.String())
+	}
+}
+
+func TestTokenRejectsStdinDocument(t *testing.T) {
+	expired := fmt.Sprintf(`{"device_code":"code","user_code":"USER","verification_url":"https://trakt.tv/activate","expires_in":600,"interval":5,"expires_at":%q}`,
+		time.Now().Add(-time.Minute).Format(time.RFC3339))
+
+	tests := []struct {
+		name     string
+		doc      string
+		wantExit int
+		wantErr  string
+	}{
+		{"malformed JSON", `{"device_code":`, exitUsage, "malformed JSON"},
+		{"not an object", `["code"]`, exitUsage, "malformed JSON"},
+		{"empty", ``, exitUsage, "malformed JSON"},
+		{"missing device_code", `{"user_code":"USER","expires_in":600}`, exitUsage, "missing device_code"},
+		{"missing expires_in", `{"device_code":"code","user_code":"USER"}`, exitUsage, "missing expires_in"},
+		{"expired", expired, exitExpired, "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), []string{"token", "--client-id", "client-id", "--client-secret", "client-secret",
+				"--base-url", srv.URL, "--no-input", "-"}, strings.NewReader(tt.doc), &stdout, &stderr)
+			if got := exitCode(err); got != tt.wantExit {
+				t.Fatalf("exited with %d (%v), want %d", got, err, tt.wantExit)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want it to mention %q", err, tt.wantErr)
+			}
+			if n := len(srv.Requests()); n != 0 {
+				t.Errorf("%d requests were made, want none", n)
+			}
+		})
+	}
+}
+
+func TestTokenFromStdinNeedsCredentials(t *testing.T) {
+	// The credentials can't be prompted for once stdin has been read for the code.
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"token", "--client-id", "client-id", "-"},
+		strings.NewReader(`{"device_code":"code","expires_in":600}`), &stdout, &stderr)
+	if got := exitCode(err); got != exitUsage {
+		t.Fatalf("exited with %d (%v), want %d", got, err, exitUsage)
+	}
+}
+
+func TestLang(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tests := []struct {
+		command string
+		lang    string
+		want    string
+	}{
+		{"code", "de", "Öffne %s und gib den Code %s ein."},
+		{"code", "pt-BR", "Acesse %s e digite o código %s."},
+		{"code", "ja", "Visit %s and enter the code %s."},
+		{"auth", "fr", "Rendez-vous sur %s et saisissez le code %s."},
+		{"auth", "es-MX", "Visita %s e introduce el código %s."},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.command+" "+tt.lang, func(t *testing.T) {
+			t.Parallel()
+
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Interval = 1
+			srv.Script(traktdeviceauthtest.ApproveAfterPolls(0))
+
+			args := []string{tt.command, "--lang", tt.lang, "--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}
+			if tt.command == "auth" {
+				args = append(args, "--token-file", filepath.Join(t.TempDir(), "token.json"))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			var stdout, stderr strings.Builder
+			if err := run(ctx, args, strings.NewReader(""), &stdout, &stderr); err != nil {
+				t.Fatalf("%s: %v\n%s", tt.command, err, stderr.String())
+			}
+
+			if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+				t.Fatalf("%d codes were generated, want 1", n)
+			}
+			// The user codes of the fake server are random, but always 8 hex digits.
+			want := regexp.MustCompile(strings.Replace(regexp.QuoteMeta(fmt.Sprintf(tt.want, traktdeviceauthtest.VerificationURL, "USERCODE")), "USERCODE", "[0-9A-F]{8}", 1))
+			if !want.MatchString(stdout.String() + stderr.String()) {
+				t.Errorf("the instructions don't match %q:\n%s%s", want, stdout.String(), stderr.String())
+			}
+		})
+	}
+}
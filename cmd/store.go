@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/keyringstore"
+	"github.com/BrenekH/go-traktdeviceauth/opstore"
+)
+
+// storeFlags are the flags which choose where the token is kept when it isn't in a plain token file.
+type storeFlags struct {
+	kind           string
+	opVault        string
+	opItem         string
+	opAccount      string
+	keyringService string
+	passphrase     passphraseFlags
+	unlocked       string // The passphrase read by unlock, for --store encrypted-file.
+}
+
+func (f *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.kind, "store", "file", "where the token is kept: file, for --token-file, encrypted-file, for --token-file encrypted with a passphrase, 1password, for the item --op-item in --op-vault through the op CLI, or keyring, for the credential manager of the operating system")
+	fs.StringVar(&f.opVault, "op-vault", "", "1Password vault holding the token item, with --store 1password")
+	fs.StringVar(&f.opItem, "op-item", "Trakt token", "title of the 1Password item holding the token, with --store 1password")
+	fs.StringVar(&f.opAccount, "op-account", "", "1Password account to use, with --store 1password, if op is signed in to several")
+	fs.StringVar(&f.keyringService, "keyring-service", "traktdeviceauth", "service name of the keyring entry holding the token, with --store keyring, which is further named after the client id")
+	f.passphrase.register(fs, "with --store encrypted-file")
+}
+
+func (f *storeFlags) validate() error {
+	if f.kind != "1password" && (f.opVault != "" || f.opAccount != "") {
+		return usageError("--op-vault and --op-account need --store 1password")
+	}
+	if f.kind != "encrypted-file" && f.passphrase.set() {
+		return usageError("--token-passphrase and --token-passphrase-cmd need --store encrypted-file")
+	}
+	switch f.kind {
+	case "file":
+	case "encrypted-file":
+		return f.passphrase.validate()
+	case "1password":
+		if f.opVault == "" {
+			return usageError("--store 1password needs --op-vault")
+		}
+		if f.opItem == "" {
+			return usageError("--op-item can't be empty")
+		}
+	case "keyring":
+		if f.keyringService == "" {
+			return usageError("--keyring-service can't be empty")
+		}
+	default:
+		return usageError(fmt.Sprintf("unknown --store %q, it must be file, encrypted-file, 1password or keyring", f.kind))
+	}
+	return nil
+}
+
+// external reports whether the token is kept somewhere other than a token file, which may be encrypted.
+func (f *storeFlags) external() bool {
+	return f.kind != "file" && f.kind != "encrypted-file"
+}
+
+// encrypted reports whether the token file is encrypted, so that the passphrase has to be unlocked before the
+// store is opened.
+func (f *storeFlags) encrypted() bool {
+	return f.kind == "encrypted-file"
+}
+
+// unlock reads the passphrase of the token file for --store encrypted-file, with --token-passphrase-cmd run like
+// --client-secret-cmd, or by prompting on w unless api has --no-input. It does nothing for other stores.
+func (f *storeFlags) unlock(api *apiFlags, stdin io.Reader, w io.Writer) error {
+	if !f.encrypted() || f.unlocked != "" {
+		return nil
+	}
+	passphrase, err := f.passphrase.read(stdin, w, api.noInput, api.secretCmdShell)
+	if err != nil {
+		return err
+	}
+	f.unlocked = passphrase
+	return nil
+}
+
+// needsClientID reports whether the store chosen by the flags is named after the client id, which then has to
+// be known before the store is opened.
+func (f *storeFlags) needsClientID() bool {
+	return f.kind == "keyring"
+}
+
+// open returns the store chosen by the flags, which is the token file at path, keeping the given number of
+// backups, for --store file and --store encrypted-file, whose passphrase has to be unlocked first. clientID is
+// only used if needsClientID reports true.
+func (f *storeFlags) open(path string, backups int, clientID string) (traktdeviceauth.TokenStore, error) {
+	switch f.kind {
+	case "1password":
+		var opts []opstore.Option
+		if f.opAccount != "" {
+			opts = append(opts, opstore.WithAccount(f.opAccount))
+		}
+		return opstore.New(f.opVault, f.opItem, opts...), nil
+	case "keyring":
+		return keyringstore.New(f.keyringService, clientID), nil
+	case "encrypted-file":
+		store, err := traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte(f.unlocked))
+		if err != nil {
+			return nil, err
+		}
+		return tokenFile{path: path, backups: backups, encrypted: store}, nil
+	}
+	return tokenFile{path: path, backups: backups}, nil
+}
+
+// describe describes the store chosen by the flags for messages, given the token file at path for --store file.
+func (f *storeFlags) describe(path string) string {
+	switch f.kind {
+	case "1password":
+		return fmt.Sprintf("the 1Password item %q in the vault %q", f.opItem, f.opVault)
+	case "keyring":
+		return fmt.Sprintf("the keyring service %q", f.keyringService)
+	}
+	return path
+}
+
+// tokenFile is a traktdeviceauth.TokenStore for a token file, which is backed up like saveTokenFile does.
+type tokenFile struct {
+	path      string
+	backups   int
+	encrypted *traktdeviceauth.FileTokenStore // Saves and loads the file if it is encrypted.
+}
+
+func (f tokenFile) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	if f.encrypted == nil {
+		return saveTokenFile(f.path, t, f.backups)
+	}
+	if f.backups > 0 {
+		if err := backupTokenFile(f.path, time.Now(), f.backups); err != nil {
+			return fmt.Errorf("backing up %s before overwriting it: %w", f.path, err)
+		}
+	}
+	return f.encrypted.Save(ctx, t)
+}
+
+func (f tokenFile) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	if f.encrypted == nil {
+		return traktdeviceauth.LoadTokenFromFile(f.path)
+	}
+	return f.encrypted.Load(ctx)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/keyringstore"
+	"github.com/BrenekH/go-traktdeviceauth/opstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/zalando/go-keyring"
+)
+
+func TestStoreFlagsValidate(t *testing.T) {
+	tests := []struct {
+		flags   storeFlags
+		wantErr bool
+	}{
+		{storeFlags{kind: "file"}, false},
+		{storeFlags{kind: "file", opVault: "vault"}, true},
+		{storeFlags{kind: "1password", opVault: "vault", opItem: "item"}, false},
+		{storeFlags{kind: "1password", opItem: "item"}, true},
+		{storeFlags{kind: "keyring", keyringService: "service"}, false},
+		{storeFlags{kind: "keyring"}, true},
+		{storeFlags{kind: "keyring", keyringService: "service", opAccount: "account"}, true},
+		{storeFlags{kind: "unknown"}, true},
+		{storeFlags{kind: "encrypted-file"}, false},
+		{storeFlags{kind: "encrypted-file", passphrase: passphraseFlags{passphrase: "p", cmd: "echo p"}}, true},
+		{storeFlags{kind: "file", passphrase: passphraseFlags{passphrase: "p"}}, true},
+		{storeFlags{kind: "keyring", keyringService: "service", passphrase: passphraseFlags{cmd: "echo p"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.flags.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want an error: %v", tt.flags, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExecWithKeyringStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command run by exec needs a POSIX shell")
+	}
+	keyring.MockInit()
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// The token expires within --min-valid, so exec refreshes it and saves the new one to the keyring.
+	ctx := context.Background()
+	issued := srv.IssueToken()
+	store := keyringstore.New("test-service", "client-id")
+	stale := traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := store.Save(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err := run(ctx, []string{"exec", "--store", "keyring", "--keyring-service", "test-service",
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input",
+		"--", "sh", "-c", `printf %s "$TRAKT_ACCESS_TOKEN"`}, strings.NewReader(""), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("exec: %v\n%s", err, stderr.String())
+	}
+
+	saved, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == stale.AccessToken {
+		t.Fatal("the refreshed token wasn't saved to the keyring")
+	}
+	if stdout.String() != saved.AccessToken {
+		t.Errorf("the command got the token %q, want the refreshed %q", stdout.String(), saved.AccessToken)
+	}
+}
+
+func TestExecWithEmptyKeyring(t *testing.T) {
+	keyring.MockInit()
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), []string{"exec", "--store", "keyring", "--keyring-service", "empty-service",
+		"--client-id", "client-id", "--no-input", "--", "true"}, strings.NewReader(""), &stdout, &stderr)
+	if !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Fatalf("exec returned %v, want ErrNoStoredToken", err)
+	}
+}
+
+// fakeOpScript acts like the op CLI, keeping a single item in a file next to it.
+const fakeOpScript = `#!/bin/sh
+item="$(dirname "$0")/item.json"
+if [ -n "$OP_FAKE_SIGNED_OUT" ]; then
+	echo "[ERROR] 2024/06/01 12:00:00 You are not currently signed in." >&2
+	exit 1
+fi
+case "$1 $2" in
+"item get")
+	if [ ! -f "$item" ]; then
+		echo "[ERROR] 2024/06/01 12:00:00 \"$3\" isn't an item in the vault." >&2
+		exit 1
+	fi
+	cat "$item" ;;
+"item create"|"item edit")
+	sed 's/^{/{"id":"item1",/' > "$item"
+	cat "$item" ;;
+esac
+`
+
+func TestExecWithOnePasswordStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake op is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "op"), []byte(fakeOpScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("OP_FAKE_SIGNED_OUT", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// The token expires within --min-valid, so exec refreshes it and saves the new one to the item.
+	ctx := context.Background()
+	issued := srv.IssueToken()
+	store := opstore.New("Private", "Trakt token")
+	stale := traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := store.Save(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"exec", "--store", "1password", "--op-vault", "Private",
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input",
+		"--", "sh", "-c", `printf %s "$TRAKT_ACCESS_TOKEN"`}
+	var stdout, stderr bytes.Buffer
+	if err := run(ctx, args, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatalf("exec: %v\n%s", err, stderr.String())
+	}
+	saved, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == stale.AccessToken {
+		t.Fatal("the refreshed token wasn't saved to 1Password")
+	}
+	if stdout.String() != saved.AccessToken {
+		t.Errorf("the command got the token %q, want the refreshed %q", stdout.String(), saved.AccessToken)
+	}
+
+	// Without a session, exec fails with a hint to sign in rather than as if there were no token.
+	t.Setenv("OP_FAKE_SIGNED_OUT", "1")
+	err = run(ctx, args, strings.NewReader(""), &stdout, &stderr)
+	if !errors.Is(err, opstore.ErrNotSignedIn) || errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("exec while signed out returned %v, want ErrNotSignedIn", err)
+	}
+}
+
+// saveEncryptedToken saves t to a new token file encrypted with passphrase and returns its path.
+func saveEncryptedToken(t *testing.T, tok traktdeviceauth.TokenResponse, passphrase string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store, err := traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecWithEncryptedFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands run by exec and --token-passphrase-cmd need a POSIX system")
+	}
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// The token expires within --min-valid, so exec refreshes it and saves the new one, encrypted again.
+	ctx := context.Background()
+	issued := srv.IssueToken()
+	path := saveEncryptedToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)}, "open sesame")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = run(ctx, []string{"exec", "--store", "encrypted-file", "--token-file", path, "--token-passphrase-cmd", `echo "open sesame"`,
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input",
+		"--", "sh", "-c", `printf %s "$TRAKT_ACCESS_TOKEN"`}, strings.NewReader(""), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("exec: %v\n%s", err, stderr.String())
+	}
+
+	store, _ := traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte("open sesame"))
+	saved, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == issued.AccessToken {
+		t.Fatal("the refreshed token wasn't saved")
+	}
+	if stdout.String() != saved.AccessToken {
+		t.Errorf("the command got the token %q, want the refreshed %q", stdout.String(), saved.AccessToken)
+	}
+
+	// The file was backed up before it was overwritten, and restore puts the encrypted backup back as it is.
+	stdout.Reset()
+	if err := run(ctx, []string{"restore", "--list", "--token-file", path}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "encrypted") {
+		t.Errorf("restore --list doesn't show the encrypted backup:\n%s", stdout.String())
+	}
+	if err := run(ctx, []string{"restore", "--token-file", path}, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("restore left %q (%v), want the file from before exec", after, err)
+	}
+}
+
+func TestExecWithEncryptedFileFailures(t *testing.T) {
+	path := saveEncryptedToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Hour)}, "open sesame")
+
+	tests := []struct {
+		name  string
+		args  []string
+		check func(err error) bool
+	}{
+		{"wrong passphrase", []string{"--token-passphrase", "wrong"}, func(err error) bool {
+			return errors.Is(err, traktdeviceauth.ErrTokenDecryption)
+		}},
+		{"no passphrase with --no-input", nil, func(err error) bool {
+			return err != nil && strings.Contains(err.Error(), "missing --token-passphrase")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"exec", "--store", "encrypted-file", "--token-file", path, "--no-input"}, tt.args...)
+			var stdout, stderr bytes.Buffer
+			err := run(context.Background(), append(args, "--", "true"), strings.NewReader(""), &stdout, &stderr)
+			if !tt.check(err) {
+				t.Errorf("exec returned %v", err)
+			}
+		})
+	}
+}
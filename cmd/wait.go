@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// exitTimeout is the exit code of wait when no valid token appeared before --timeout.
+const exitTimeout = 13
+
+// waitRefreshRetryInterval is how long wait leaves between refreshes of the same token which failed for a
+// reason other than Trakt rejecting the refresh token.
+const waitRefreshRetryInterval = 30 * time.Second
+
+// runWait blocks until the token in --token-file is valid for at least --min-validity, for ordering service
+// startup after authorization. It never starts a device flow itself, so it is safe to run unattended.
+func runWait(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api         apiFlags
+		tokenPath   string
+		minValidity time.Duration
+		timeout     time.Duration
+		interval    time.Duration
+		refresh     bool
+		backups     int
+	)
+
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	fs.StringVar(&tokenPath, "token-file", "", "file to wait for a valid token in (default: token.json in the user config directory)")
+	fs.DurationVar(&minValidity, "min-validity", 0, "only accept a token which is valid for at least this `duration`")
+	fs.DurationVar(&timeout, "timeout", 0, fmt.Sprintf("give up and exit with %d after this `duration` (wait forever if 0)", exitTimeout))
+	fs.DurationVar(&interval, "interval", time.Second, "how often to check the token file")
+	fs.BoolVar(&refresh, "refresh", false, "refresh a token which isn't valid for long enough and save it back to --token-file")
+	fs.IntVar(&backups, "backups", defaultBackups, backupsUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	tokenPath, err := tokenFileOrDefault(tokenPath)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return usageError("--interval must be positive")
+	}
+	if backups < 0 {
+		return usageError("--backups can't be negative")
+	}
+
+	// The credentials are only needed for refreshing, and are asked for up front so that no prompt shows up
+	// in the middle of waiting.
+	if refresh {
+		if err := api.prompt(stdin, stderr, true); err != nil {
+			return err
+		}
+	}
+
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	w := tokenWaiter{api: &api, path: tokenPath, minValidity: minValidity, interval: interval, refresh: refresh, backups: backups, log: stderr}
+	t, err := w.wait(waitCtx)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return &exitError{code: exitTimeout, err: fmt.Errorf("no token valid for at least %s appeared in %s within %s", minValidity, tokenPath, timeout)}
+		}
+		return err
+	}
+
+	fmt.Fprintf(stdout, "The token in %s is valid until %s.\n", tokenPath, t.ExpiresAt.Format(time.RFC1123))
+	return nil
+}
+
+// tokenWaiter checks a token file until it holds a valid token, for runWait.
+type tokenWaiter struct {
+	api         *apiFlags
+	path        string
+	minValidity time.Duration
+	interval    time.Duration
+	refresh     bool
+	backups     int
+	log         io.Writer
+
+	rejected    string    // A refresh token which Trakt rejected, and won't be tried again.
+	lastFailure time.Time // When refreshing last failed for another reason.
+}
+
+// wait returns the token in the file once it is valid for long enough, checking every interval until ctx ends.
+// A missing file is waited for, but a file which can't be read is an error.
+func (w *tokenWaiter) wait(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		t, ok, err := w.check(ctx)
+		if ok || err != nil {
+			return t, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return traktdeviceauth.TokenResponse{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// check loads the token file once and reports whether its token is valid for long enough, refreshing it first
+// if that is enabled and might help.
+func (w *tokenWaiter) check(ctx context.Context) (t traktdeviceauth.TokenResponse, ok bool, err error) {
+	t, err = traktdeviceauth.LoadTokenFromFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, false, nil
+	} else if err != nil {
+		return t, false, err
+	}
+	if time.Until(t.ExpiresAt) >= w.minValidity {
+		return t, true, nil
+	}
+
+	if !w.refresh || t.RefreshToken == "" || t.RefreshToken == w.rejected || time.Since(w.lastFailure) < waitRefreshRetryInterval {
+		return t, false, nil
+	}
+
+	refreshed, err := traktdeviceauth.RefreshAccessTokenContext(ctx, t.RefreshToken, w.api.clientID, w.api.clientSecret, w.api.options()...)
+	switch {
+	case ctx.Err() != nil:
+		return t, false, ctx.Err()
+	case errors.Is(err, traktdeviceauth.ErrInvalidGrant):
+		// Someone has to authorize again, which replaces the token in the file and ends the wait.
+		fmt.Fprintf(w.log, "The refresh token in %s was rejected, waiting for a new token: %v\n", w.path, err)
+		w.rejected = t.RefreshToken
+		return t, false, nil
+	case err != nil:
+		fmt.Fprintf(w.log, "Refreshing the token failed, retrying in %s: %v\n", waitRefreshRetryInterval, err)
+		w.lastFailure = time.Now()
+		return t, false, nil
+	}
+
+	if err := saveTokenFile(w.path, refreshed, w.backups); err != nil {
+		return refreshed, false, err
+	}
+	if time.Until(refreshed.ExpiresAt) < w.minValidity {
+		// Refreshing again wouldn't help, since Trakt hands out tokens of the same lifetime every time.
+		return refreshed, false, fmt.Errorf("even a freshly refreshed token expires at %s, within --min-validity %s", refreshed.ExpiresAt.Format(time.RFC1123), w.minValidity)
+	}
+	return refreshed, true, nil
+}
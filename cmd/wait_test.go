@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// runWaitAsync starts the wait command with args and returns a channel receiving its error, along with its
+// stdout and stderr, which may only be read once the error was received.
+func runWaitAsync(ctx context.Context, args ...string) (<-chan error, *strings.Builder, *strings.Builder) {
+	errs := make(chan error, 1)
+	var stdout, stderr strings.Builder
+	go func() {
+		errs <- run(ctx, append([]string{"wait"}, args...), strings.NewReader(""), &stdout, &stderr)
+	}()
+	return errs, &stdout, &stderr
+}
+
+func TestWaitAppearsLater(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	errs, stdout, stderr := runWaitAsync(context.Background(), "--token-file", tokenPath, "--min-validity", "1h", "--interval", "20ms", "--timeout", "10s", "--no-input")
+
+	// Neither a missing file nor a token which expires too soon ends the wait.
+	time.Sleep(100 * time.Millisecond)
+	if err := traktdeviceauth.NewFileTokenStore(tokenPath).Save(context.Background(), traktdeviceauth.TokenResponse{AccessToken: "short", ExpiresAt: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("wait returned %v before a token valid for long enough appeared", err)
+	default:
+	}
+
+	valid := traktdeviceauth.TokenResponse{AccessToken: "valid", ExpiresAt: time.Now().Add(24 * time.Hour)}
+	if err := traktdeviceauth.NewFileTokenStore(tokenPath).Save(context.Background(), valid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("wait: %v\n%s", err, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), valid.ExpiresAt.Format(time.RFC1123)) {
+			t.Errorf("wait printed %q, want the expiry of the token", stdout.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait didn't notice the token")
+	}
+}
+
+func TestWaitRefreshes(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+	tokenPath := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)})
+
+	var stdout, stderr strings.Builder
+	err := run(context.Background(), []string{"wait", "--token-file", tokenPath, "--min-validity", "1h", "--refresh", "--timeout", "10s",
+		"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}, strings.NewReader(""), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("wait: %v\n%s", err, stderr.String())
+	}
+
+	saved, err := traktdeviceauth.LoadTokenFromFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken == issued.AccessToken || time.Until(saved.ExpiresAt) < time.Hour {
+		t.Errorf("the token file holds %+v, want the refreshed token", saved)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 0 {
+		t.Errorf("wait started %d device flows", n)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	creds := []string{"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"}
+
+	tests := []struct {
+		name          string
+		tokenPath     string
+		args          []string
+		wantRefreshes int
+		wantLog       string
+	}{
+		{"missing", filepath.Join(t.TempDir(), "token.json"), nil, 0, ""},
+		{"too short without --refresh", saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Minute)}),
+			[]string{"--min-validity", "1h"}, 0, ""},
+		// A rejected refresh token isn't tried again on every check.
+		{"refresh rejected", saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "unknown", ExpiresAt: time.Now().Add(time.Minute)}),
+			[]string{"--min-validity", "1h", "--refresh"}, 1, "was rejected"},
+		// Other refresh failures are retried, but not within the same 30 seconds.
+		{"refresh failing", saveToken(t, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Minute)}),
+			[]string{"--min-validity", "1h", "--refresh", "--no-retry"}, 1, "Refreshing the token failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(srv.RequestsTo(traktdeviceauth.EndpointToken))
+			if tt.name == "refresh failing" {
+				srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(502)))
+				defer srv.Script()
+			}
+
+			start := time.Now()
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append(append([]string{"wait", "--token-file", tt.tokenPath, "--interval", "20ms", "--timeout", "300ms"}, tt.args...), creds...),
+				strings.NewReader(""), &stdout, &stderr)
+			if got := exitCode(err); got != exitTimeout {
+				t.Errorf("wait returned %v, exit code %d, want %d", err, got, exitTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("wait took %v with --timeout 300ms", elapsed)
+			}
+			if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)) - before; n != tt.wantRefreshes {
+				t.Errorf("%d refreshes, want %d", n, tt.wantRefreshes)
+			}
+			if tt.wantLog != "" && !strings.Contains(stderr.String(), tt.wantLog) {
+				t.Errorf("stderr doesn't explain the failed refresh:\n%s", stderr.String())
+			}
+		})
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 0 {
+		t.Errorf("wait started %d device flows", n)
+	}
+}
+
+func TestWaitErrors(t *testing.T) {
+	t.Setenv(credentialsDirEnv, "")
+	t.Setenv("CI", "")
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+	refreshable := saveToken(t, traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: time.Now().Add(time.Minute)})
+	corrupt := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(corrupt, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"unreadable token file", []string{"--token-file", corrupt}, 1},
+		// Trakt's tokens last three months, so no refresh can make one valid for a year.
+		{"longer than a token lasts", []string{"--token-file", refreshable, "--min-validity", "8760h", "--refresh"}, 1},
+		{"zero interval", []string{"--token-file", corrupt, "--interval", "0"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			err := run(context.Background(), append(append([]string{"wait", "--timeout", "10s"}, tt.args...),
+				"--client-id", "client-id", "--client-secret", "client-secret", "--base-url", srv.URL, "--no-input"), strings.NewReader(""), &stdout, &stderr)
+			if got := exitCode(err); got != tt.wantCode {
+				t.Errorf("wait returned %v, exit code %d, want %d", err, got, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runWatch keeps the token in --token-file fresh by refreshing it shortly before it expires, until it is
+// interrupted. It is meant to run as a daemon next to the programs which read the file.
+func runWatch(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		api           apiFlags
+		tokenPath     string
+		tokenCred     string
+		refreshBefore time.Duration
+		retryInterval time.Duration
+		healthListen  string
+		metricsListen string
+		backups       int
+		alertFailures int
+		alertWindow   time.Duration
+	)
+
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	api.register(fs)
+	fs.StringVar(&tokenPath, "token-file", "", "file holding the token to keep fresh (default: token.json in the user config directory)")
+	fs.StringVar(&tokenCred, "token-credential", "", "systemd credential to copy the initial token from if --token-file doesn't exist yet")
+	fs.DurationVar(&refreshBefore, "refresh-before", time.Hour, "refresh the token this long before it expires")
+	fs.DurationVar(&retryInterval, "retry-interval", time.Minute, "how long to wait before retrying a failed refresh")
+	fs.StringVar(&healthListen, "health-listen", "", "address to serve /healthz and /readyz on, such as 127.0.0.1:9180 (disabled if empty)")
+	fs.StringVar(&metricsListen, "metrics-listen", "", "address to serve Prometheus metrics on at /metrics, such as :9181 (disabled if empty)")
+	fs.IntVar(&backups, "backups", defaultBackups, backupsUsage)
+	fs.IntVar(&alertFailures, "alert-failures", 0, "print a warning once this many requests to Trakt, counting retries, failed within --alert-window (disabled if 0)")
+	fs.DurationVar(&alertWindow, "alert-window", time.Hour, "the sliding window for --alert-failures")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := api.validate(); err != nil {
+		return err
+	}
+	if backups < 0 {
+		return usageError("--backups can't be negative")
+	}
+	if alertFailures < 0 || alertWindow <= 0 {
+		return usageError("--alert-failures can't be negative and --alert-window must be positive")
+	}
+	tokenPath, err := tokenFileOrDefault(tokenPath)
+	if err != nil {
+		return err
+	}
+
+	if tokenCred != "" {
+		if err := seedTokenFile(tokenPath, tokenCred); err != nil {
+			return err
+		}
+	}
+	t, err := traktdeviceauth.LoadTokenFromFile(tokenPath)
+	if err != nil {
+		return err
+	}
+	if t.RefreshToken == "" {
+		return fmt.Errorf("the token in %s has no refresh token, so it can't be kept fresh", tokenPath)
+	}
+	if err := api.prompt(stdin, stderr, true); err != nil {
+		return err
+	}
+
+	status := newWatchStatus(t)
+	if healthListen != "" {
+		stop, err := startServer(healthListen, newHealthHandler(status))
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	w := watcher{api: &api, path: tokenPath, refreshBefore: refreshBefore, retryInterval: retryInterval, backups: backups, status: status, log: stderr}
+	if metricsListen != "" {
+		metrics := prommetrics.New(prommetrics.WithProfile(tokenPath))
+		metrics.SetToken(t)
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(metrics)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		stop, err := startServer(metricsListen, mux)
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		w.opts = append(w.opts, metrics.Option())
+	}
+	if alertFailures > 0 {
+		tracker := traktdeviceauth.NewErrorRateTracker(alertWindow, traktdeviceauth.ErrorRateThreshold{Failures: alertFailures}, func(s traktdeviceauth.ErrorRateStats) {
+			fmt.Fprintf(stderr, "Warning: %d of %d requests to Trakt failed within the last %s (%s).\n", s.Failures, s.Attempts, s.Window, formatCounts(s.ByCode))
+		})
+		w.opts = append(w.opts, traktdeviceauth.WithErrorRateTracker(tracker))
+	}
+	return w.run(ctx, t)
+}
+
+// formatCounts formats counts like "network: 3, server_error: 1", sorted by key.
+func formatCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s: %d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// watcher refreshes a token file for runWatch.
+type watcher struct {
+	api           *apiFlags
+	path          string
+	refreshBefore time.Duration
+	retryInterval time.Duration
+	backups       int
+	status        *watchStatus
+	log           io.Writer
+	opts          []traktdeviceauth.Option // Added to the options from the flags.
+}
+
+// run refreshes t whenever it is due until ctx ends, which isn't treated as an error. It only gives up if
+// Trakt rejects the refresh token, since the user has to authorize again then.
+func (w *watcher) run(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	next := t.ExpiresAt.Add(-w.refreshBefore)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		refreshed, err := traktdeviceauth.RefreshAccessTokenContext(ctx, t.RefreshToken, w.api.clientID, w.api.clientSecret, append(w.api.options(), w.opts...)...)
+		if err == nil {
+			// The old refresh token may have stopped working, so the new token is kept even if saving it fails.
+			t = refreshed
+			err = saveTokenFile(w.path, refreshed, w.backups)
+		}
+		w.status.recordRefresh(time.Now(), t, err)
+
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, traktdeviceauth.ErrInvalidGrant):
+			return fmt.Errorf("the refresh token in %s was rejected, run auth again: %w", w.path, err)
+		case err != nil:
+			fmt.Fprintf(w.log, "Refreshing the token failed, retrying in %s: %v\n", w.retryInterval, err)
+			next = time.Now().Add(w.retryInterval)
+		default:
+			fmt.Fprintf(w.log, "Refreshed the token, which now expires at %s.\n", t.ExpiresAt.Format(time.RFC1123))
+			next = t.ExpiresAt.Add(-w.refreshBefore)
+			if min := time.Now().Add(w.retryInterval); next.Before(min) {
+				// Tokens which are due again right away would otherwise be refreshed in a tight loop.
+				next = min
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package traktdeviceauth
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Codec encodes and decodes JSON, so that programs can use a faster or smaller implementation than
+// encoding/json, such as jsoniter. It must follow the struct tags and the json.Marshaler and json.Unmarshaler
+// methods of the types passed to it like encoding/json does.
+//
+// StoredToken implements those methods itself to version its format, and uses encoding/json for the migration
+// of old documents inside them.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// StrictCodec is a Codec which can also reject fields that the type being decoded doesn't have. WithStrictDecoding
+// uses UnmarshalStrict if the Codec implements it, and decodes with encoding/json otherwise, since it is meant
+// for tests where matching the real API matters more than the choice of decoder.
+type StrictCodec interface {
+	Codec
+	UnmarshalStrict(data []byte, v interface{}) error
+}
+
+// WithCodec makes the package decode API responses and encode the WithAuditLog and WithRateLimitState files
+// with codec instead of encoding/json.
+//
+// Request bodies are flat objects of strings which are written directly into a buffer that is wiped once it has
+// been sent, so they never go through codec. Token files use the Codec set with WithFileCodec, and a KVStore
+// the one passed to WithKVCodec.
+func WithCodec(codec Codec) Option {
+	return func(c *config) {
+		c.codec = codec
+	}
+}
+
+// stdCodec is the default Codec, which uses encoding/json.
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdCodec) UnmarshalStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// codecOrDefault returns codec, or the encoding/json Codec if it is nil.
+func codecOrDefault(codec Codec) Codec {
+	if codec == nil {
+		return stdCodec{}
+	}
+	return codec
+}
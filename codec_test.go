@@ -0,0 +1,204 @@
+package traktdeviceauth_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// recordingCodec is a Codec which uses encoding/json and records every call along with the type it was passed.
+type recordingCodec struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *recordingCodec) record(method string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf("%s %T", method, v))
+}
+
+func (c *recordingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.record("Marshal", v)
+	return json.Marshal(v)
+}
+
+func (c *recordingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.record("Unmarshal", v)
+	return json.Unmarshal(data, v)
+}
+
+// recorded returns the calls made so far and forgets them.
+func (c *recordingCodec) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.calls
+	c.calls = nil
+	return calls
+}
+
+// strictRecordingCodec is a recordingCodec which is also a StrictCodec.
+type strictRecordingCodec struct {
+	recordingCodec
+}
+
+func (c *strictRecordingCodec) UnmarshalStrict(data []byte, v interface{}) error {
+	c.record("UnmarshalStrict", v)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func TestCodecFullFlow(t *testing.T) {
+	for _, name := range []string{"default", "recording"} {
+		t.Run(name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+
+			var codec *recordingCodec
+			opts := srv.Options()
+			var fileOpts []traktdeviceauth.FileOption
+			if name == "recording" {
+				codec = &recordingCodec{}
+				opts = append(opts, traktdeviceauth.WithCodec(codec))
+				fileOpts = append(fileOpts, traktdeviceauth.WithFileCodec(codec))
+			}
+			// expect checks the calls made to codec since the last check.
+			expect := func(step string, want ...string) {
+				t.Helper()
+				if codec == nil {
+					return
+				}
+				if got := codec.recorded(); strings.Join(got, ", ") != strings.Join(want, ", ") {
+					t.Errorf("%s made the calls %q to the codec, want %q", step, got, want)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cl := traktdeviceauth.NewClient("client-id", "secret", opts...)
+
+			code, err := cl.GenerateNewCode(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect("GenerateNewCode", "Unmarshal *traktdeviceauth.CodeResponse")
+
+			tok, err := cl.PollForAuthToken(ctx, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Pending polls have no body to decode.
+			expect("PollForAuthToken", "Unmarshal *traktdeviceauth.internalTokenResponse")
+
+			refreshed, err := cl.RefreshAccessToken(ctx, tok.RefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect("RefreshAccessToken", "Unmarshal *traktdeviceauth.internalTokenResponse")
+			if refreshed.AccessToken == "" || refreshed.AccessToken == tok.AccessToken {
+				t.Errorf("refreshing %s returned the access token %q, want a new one", tok.AccessToken, refreshed.AccessToken)
+			}
+
+			s := traktdeviceauth.NewFileTokenStore(filepath.Join(t.TempDir(), "token.json"), fileOpts...)
+			if err := s.Save(ctx, refreshed); err != nil {
+				t.Fatal(err)
+			}
+			expect("Save", "Marshal traktdeviceauth.StoredToken")
+			got, err := s.Load(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect("Load", "Unmarshal *traktdeviceauth.StoredToken")
+			if got.AccessToken != refreshed.AccessToken || got.RefreshToken != refreshed.RefreshToken || !got.ExpiresAt.Equal(refreshed.ExpiresAt) {
+				t.Errorf("Load returned %+v, want %+v", got, refreshed)
+			}
+		})
+	}
+}
+
+// extraField adds a field this package doesn't know about to every successful response.
+func extraField(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		resp, err := next(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+		var doc map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&doc)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		doc["new_field"] = true
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body, resp.ContentLength = io.NopCloser(bytes.NewReader(b)), int64(len(b))
+		return resp, nil
+	}
+}
+
+func TestCodecStrictDecoding(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		codec   traktdeviceauth.Codec
+		strict  bool
+		wantErr bool
+		// calls are those the codec is expected to see.
+		calls []string
+	}{
+		{name: "default", strict: false},
+		{name: "default strict", strict: true, wantErr: true},
+		{name: "codec", codec: &recordingCodec{}, calls: []string{"Unmarshal *traktdeviceauth.CodeResponse"}},
+		// A Codec which can't reject unknown fields is bypassed for encoding/json.
+		{name: "codec strict", codec: &recordingCodec{}, strict: true, wantErr: true},
+		{name: "strict codec", codec: &strictRecordingCodec{}, calls: []string{"Unmarshal *traktdeviceauth.CodeResponse"}},
+		{name: "strict codec strict", codec: &strictRecordingCodec{}, strict: true, wantErr: true, calls: []string{"UnmarshalStrict *traktdeviceauth.CodeResponse"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append(srv.Options(), traktdeviceauth.WithMiddleware(extraField))
+			if tt.codec != nil {
+				opts = append(opts, traktdeviceauth.WithCodec(tt.codec))
+			}
+			if tt.strict {
+				opts = append(opts, traktdeviceauth.WithStrictDecoding())
+			}
+
+			_, err := traktdeviceauth.NewClient("client-id", "secret", opts...).GenerateNewCode(context.Background())
+			if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "new_field")) {
+				t.Errorf("GenerateNewCode returned %v, want an error about the unknown field", err)
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("GenerateNewCode returned %v, want the unknown field ignored", err)
+			}
+
+			var calls []string
+			switch c := tt.codec.(type) {
+			case *recordingCodec:
+				calls = c.recorded()
+			case *strictRecordingCodec:
+				calls = c.recorded()
+			}
+			if strings.Join(calls, ", ") != strings.Join(tt.calls, ", ") {
+				t.Errorf("the codec saw the calls %q, want %q", calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CodeCache shares device codes between the parts of a program which start the device flow, so that a user
+// who triggers it from two places at once is shown the same code in both. It is opt-in through WithCodeCache
+// and safe for concurrent use.
+type CodeCache struct {
+	mu       sync.Mutex
+	codes    map[string]*cachedCode // Keyed by the base url and client id.
+	approved map[string]approvedCode
+	polling  map[string]*pollingCode // Token requests in flight, keyed by device code.
+}
+
+// pollingCode counts the token requests in flight for a device code. idle is closed once the last one ends.
+type pollingCode struct {
+	n    int
+	idle chan struct{}
+}
+
+// cachedCode is a device code generated for a CodeCache, or being generated while done is open.
+type cachedCode struct {
+	done      chan struct{}
+	codeResp  CodeResponse
+	expiresAt time.Time
+	err       error
+}
+
+// approvedCode is the token a device code was exchanged for, kept until the code expires.
+type approvedCode struct {
+	token     TokenResponse
+	expiresAt time.Time
+}
+
+// NewCodeCache creates an empty CodeCache.
+func NewCodeCache() *CodeCache {
+	return &CodeCache{codes: make(map[string]*cachedCode), approved: make(map[string]approvedCode), polling: make(map[string]*pollingCode)}
+}
+
+// WithCodeCache makes GenerateNewCode return the unexpired code in cache for the same client id and base url
+// instead of generating a new one. Concurrent calls wait for a single request. The ExpiresIn of a cached code
+// is reduced to the time it has left.
+//
+// Once a code is approved, RequestToken and PollForAuthToken calls made with the same cache for that code
+// return the token instead of polling, so every part of the program waiting for the user gets it. The next
+// GenerateNewCode then generates a new code.
+func WithCodeCache(cache *CodeCache) Option {
+	return func(c *config) {
+		c.codeCache = cache
+	}
+}
+
+// WithForceNewCode makes GenerateNewCode generate a new code even if WithCodeCache holds one, and replace the
+// cached code with it.
+func WithForceNewCode() Option {
+	return func(c *config) {
+		c.forceNewCode = true
+	}
+}
+
+// get returns the cached code for key, or calls generate to obtain a new one if there is none, it expired, or
+// force is set. Callers which arrive while generate is running wait for its result.
+func (cc *CodeCache) get(ctx context.Context, key string, force bool, generate func() (CodeResponse, error)) (CodeResponse, error) {
+	for {
+		cc.mu.Lock()
+		e := cc.codes[key]
+		if e == nil || force || e.finished() && (e.err != nil || !time.Now().Before(e.expiresAt)) {
+			e = &cachedCode{done: make(chan struct{})}
+			cc.codes[key] = e
+			cc.mu.Unlock()
+
+			codeResp, err := generate()
+
+			cc.mu.Lock()
+			e.codeResp, e.err = codeResp, err
+			e.expiresAt = codeResp.expiresAt(time.Now())
+			if err != nil && cc.codes[key] == e {
+				delete(cc.codes, key)
+			}
+			close(e.done)
+			cc.mu.Unlock()
+			return codeResp, err
+		}
+		cc.mu.Unlock()
+
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return CodeResponse{}, ctx.Err()
+		}
+
+		// The caller which made the request may have given up, which says nothing about this caller's context.
+		if errors.Is(e.err, context.Canceled) || errors.Is(e.err, context.DeadlineExceeded) {
+			continue
+		}
+		if e.err != nil {
+			return CodeResponse{}, e.err
+		}
+
+		remaining := time.Until(e.expiresAt)
+		if remaining < time.Second {
+			continue
+		}
+		codeResp := e.codeResp
+		codeResp.ExpiresIn = int(remaining / time.Second)
+		return codeResp, nil
+	}
+}
+
+// finished reports whether the request for e has completed. The CodeCache's mu must be held.
+func (e *cachedCode) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// approve records that deviceCode was exchanged for t, so that it isn't handed out again and other callers
+// polling for it get t.
+func (cc *CodeCache) approve(deviceCode string, t TokenResponse) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now()
+	for key, e := range cc.codes {
+		if e.finished() && e.err == nil && e.codeResp.DeviceCode == deviceCode {
+			cc.approved[deviceCode] = approvedCode{token: t, expiresAt: e.expiresAt}
+			delete(cc.codes, key)
+		}
+	}
+	for code, a := range cc.approved {
+		if now.After(a.expiresAt) {
+			delete(cc.approved, code)
+		}
+	}
+}
+
+// token returns the token deviceCode was exchanged for, if it was approved through the cache.
+func (cc *CodeCache) token(deviceCode string) (TokenResponse, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	a, ok := cc.approved[deviceCode]
+	return a.token, ok
+}
+
+// beginPoll records that a token request for deviceCode is in flight until end is called. end may be called more
+// than once. A caller which approves the code must do so before calling end.
+func (cc *CodeCache) beginPoll(deviceCode string) (end func()) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	p := cc.polling[deviceCode]
+	if p == nil {
+		p = &pollingCode{idle: make(chan struct{})}
+		cc.polling[deviceCode] = p
+	}
+	p.n++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cc.mu.Lock()
+			defer cc.mu.Unlock()
+
+			if p.n--; p.n == 0 {
+				close(p.idle)
+				delete(cc.polling, deviceCode)
+			}
+		})
+	}
+}
+
+// settledToken waits for the other token requests for deviceCode which are in flight, and then returns the token
+// it was exchanged for, if one of them got it. Trakt answers requests which arrive while another one is being
+// approved as if the code had been approved long ago.
+func (cc *CodeCache) settledToken(ctx context.Context, deviceCode string) (TokenResponse, bool) {
+	cc.mu.Lock()
+	p := cc.polling[deviceCode]
+	cc.mu.Unlock()
+
+	if p != nil {
+		select {
+		case <-p.idle:
+		case <-ctx.Done():
+		}
+	}
+	return cc.token(deviceCode)
+}
+
+// forget removes deviceCode from the cache, for codes which can't be approved anymore.
+func (cc *CodeCache) forget(deviceCode string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for key, e := range cc.codes {
+		if e.finished() && e.codeResp.DeviceCode == deviceCode {
+			delete(cc.codes, key)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// slowCodes delays the device code requests, so that concurrent GenerateNewCode calls overlap.
+func slowCodes(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		time.Sleep(50 * time.Millisecond)
+		return next(req)
+	}
+}
+
+func TestCodeCacheConcurrent(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	cache := traktdeviceauth.NewCodeCache()
+	opts := append(srv.Options(), traktdeviceauth.WithCodeCache(cache), traktdeviceauth.WithMiddleware(slowCodes))
+
+	const callers = 20
+	codes := make([]traktdeviceauth.CodeResponse, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], errs[i] = traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range codes {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: %v", i, errs[i])
+		}
+		if codes[i].DeviceCode != codes[0].DeviceCode || codes[i].UserCode != codes[0].UserCode {
+			t.Errorf("caller %d got code %q, caller 0 got %q", i, codes[i].UserCode, codes[0].UserCode)
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d code requests for %d concurrent callers, want 1", n, callers)
+	}
+
+	// Other clients and calls without the cache get their own codes.
+	other, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "other-client-id", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncached, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.DeviceCode == codes[0].DeviceCode || uncached.DeviceCode == codes[0].DeviceCode {
+		t.Error("the cached code was shared with another client or a call without the cache")
+	}
+}
+
+func TestCodeCacheForceNew(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithCodeCache(traktdeviceauth.NewCodeCache()))...)
+	first, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced, err := cl.GenerateNewCode(ctx, traktdeviceauth.WithForceNewCode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forced.DeviceCode == first.DeviceCode {
+		t.Fatal("WithForceNewCode returned the cached code")
+	}
+
+	// The forced code replaces the cached one.
+	again, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.DeviceCode != forced.DeviceCode {
+		t.Errorf("got %q after WithForceNewCode, want the new code %q", again.UserCode, forced.UserCode)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 2 {
+		t.Errorf("%d code requests, want 2", n)
+	}
+}
+
+func TestCodeCacheExpiry(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ExpiresIn = 3
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithCodeCache(traktdeviceauth.NewCodeCache()))...)
+	first, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	cached, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.DeviceCode != first.DeviceCode || cached.ExpiresIn >= first.ExpiresIn {
+		t.Errorf("got %q expiring in %ds, want the cached code with the %ds it has left", cached.UserCode, cached.ExpiresIn, first.ExpiresIn-1)
+	}
+
+	// A code with less than a second left is replaced instead of being handed out.
+	time.Sleep(1100 * time.Millisecond)
+	fresh, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.DeviceCode == first.DeviceCode {
+		t.Error("a code which is about to expire was returned from the cache")
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 2 {
+		t.Errorf("%d code requests, want 2", n)
+	}
+}
+
+func TestCodeCacheSkipsFailures(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Succeed()))
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithCodeCache(traktdeviceauth.NewCodeCache()))...)
+	if _, err := cl.GenerateNewCode(ctx); err == nil {
+		t.Fatal("the first request didn't fail")
+	}
+	if _, err := cl.GenerateNewCode(ctx); err != nil {
+		t.Errorf("the failure was cached: %v", err)
+	}
+}
+
+func TestCodeCacheSharesApproval(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+
+	ctx := context.Background()
+	cache := traktdeviceauth.NewCodeCache()
+	opts := append(srv.Options(), traktdeviceauth.WithCodeCache(cache))
+
+	// Both parts of the program are shown the same code and wait for it.
+	const waiters = 2
+	tokens := make([]traktdeviceauth.TokenResponse, waiters)
+	errs := make([]error, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", opts...)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			tokens[i], errs[i] = traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, "client-id", "client-secret", opts...)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatalf("waiter %d: %v", i, errs[i])
+		}
+		if tokens[i].AccessToken == "" || tokens[i].AccessToken != tokens[0].AccessToken {
+			t.Errorf("waiter %d got %q, waiter 0 got %q", i, tokens[i].AccessToken, tokens[0].AccessToken)
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d code requests, want 1", n)
+	}
+
+	// An approved code is used up, so the next flow gets a new one.
+	if _, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", opts...); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 2 {
+		t.Errorf("%d code requests after the approval, want 2", n)
+	}
+}
@@ -0,0 +1,139 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// Error codes returned by Code. Unlike error messages, these strings are part of the package's compatibility
+// promise: existing codes are never renamed or reused, so they are safe to store, send to front ends,
+// and compare against.
+const (
+	CodeDeviceCodeUnclaimed       = "device_code_unclaimed"
+	CodeInvalidGrant              = "invalid_grant"
+	CodeInvalidAccessToken        = "invalid_access_token"
+	CodeInvalidDeviceCode         = "invalid_device_code"
+	CodeForbidden                 = "forbidden"
+	CodeDeviceCodeAlreadyApproved = "device_code_already_approved"
+	CodeDeviceCodeExpired         = "device_code_expired"
+	CodeDeviceCodeDenied          = "device_code_denied"
+	CodeRateLimited               = "rate_limited"
+	CodeServerError               = "server_error"
+	CodeServiceOverloaded         = "service_overloaded"
+	CodeCloudflareError           = "cloudflare_error"
+	CodeUnexpectedStatus          = "unexpected_status"
+	CodeInsecureBaseURL           = "insecure_base_url"
+	CodeInvalidArgument           = "invalid_argument"
+	CodeFlowNotFound              = "flow_not_found"
+	CodeFlowPending               = "flow_pending"
+	CodeTooManyFlows              = "too_many_flows"
+	CodeFlowCancelled             = "flow_cancelled"
+	CodeCancelled                 = "cancelled"
+	CodeTimeout                   = "timeout"
+	CodeNetwork                   = "network"
+	CodeDecodeFailed              = "decode_failed"
+	CodeMalformedResponse         = "malformed_response"
+	CodeInvalidTransition         = "invalid_transition"
+	CodeInsecurePermissions       = "insecure_permissions"
+	CodeNoStoredToken             = "no_stored_token"
+	CodeTokenNotFound             = "token_not_found"
+	CodeSchedulerClosed           = "scheduler_closed"
+	CodeStoreLocked               = "store_locked"
+	CodeUnsupportedFormatVersion  = "unsupported_format_version"
+	CodeRotationConflict          = "rotation_conflict"
+	CodeTokenDecryption           = "token_decryption"
+	CodeUnknown                   = "unknown"
+)
+
+// Code returns the stable code describing err, one of the Code* constants. Errors from other packages are
+// classified where possible, such as network failures and malformed responses, and CodeUnknown otherwise.
+// Code returns an empty string for a nil error.
+func Code(err error) string {
+	var (
+		netErr       net.Error
+		syntaxErr    *json.SyntaxError
+		unmarshalErr *json.UnmarshalTypeError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrDeviceCodeUnclaimed):
+		return CodeDeviceCodeUnclaimed
+	case errors.Is(err, ErrInvalidGrant), errors.Is(err, ErrReauthorizationRequired):
+		return CodeInvalidGrant
+	case errors.Is(err, ErrInvalidAccessToken):
+		return CodeInvalidAccessToken
+	case errors.Is(err, ErrInvalidDeviceCode):
+		return CodeInvalidDeviceCode
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, ErrDeviceCodeAlreadyApproved):
+		return CodeDeviceCodeAlreadyApproved
+	case errors.Is(err, ErrDeviceCodeExpired):
+		return CodeDeviceCodeExpired
+	case errors.Is(err, ErrDeviceCodeDenied):
+		return CodeDeviceCodeDenied
+	case errors.Is(err, ErrPollRateTooFast):
+		return CodeRateLimited
+	case errors.Is(err, ErrServerUnavailable):
+		return CodeServerError
+	case errors.Is(err, ErrNetworkUnreachable):
+		return CodeNetwork
+	case errors.Is(err, ErrServerError):
+		return CodeServerError
+	case errors.Is(err, ErrServiceOverloaded):
+		return CodeServiceOverloaded
+	case errors.Is(err, ErrCloudflareError):
+		return CodeCloudflareError
+	case errors.Is(err, ErrUnexpectedStatusCode):
+		return CodeUnexpectedStatus
+	case errors.Is(err, ErrInsecureBaseURL):
+		return CodeInsecureBaseURL
+	case errors.Is(err, ErrInvalidArgument):
+		return CodeInvalidArgument
+	case errors.Is(err, ErrFlowNotFound):
+		return CodeFlowNotFound
+	case errors.Is(err, ErrFlowPending):
+		return CodeFlowPending
+	case errors.Is(err, ErrTooManyFlows):
+		return CodeTooManyFlows
+	case errors.Is(err, ErrFlowCancelled):
+		return CodeFlowCancelled
+	case errors.Is(err, ErrInvalidTransition):
+		return CodeInvalidTransition
+	case errors.Is(err, ErrInsecurePermissions):
+		return CodeInsecurePermissions
+	case errors.Is(err, ErrNoStoredToken), errors.Is(err, ErrKeyNotFound):
+		return CodeNoStoredToken
+	case errors.Is(err, ErrTokenNotFound):
+		return CodeTokenNotFound
+	case errors.Is(err, ErrSchedulerClosed):
+		return CodeSchedulerClosed
+	case errors.Is(err, ErrStoreLocked):
+		return CodeStoreLocked
+	case errors.Is(err, ErrUnsupportedFormatVersion):
+		return CodeUnsupportedFormatVersion
+	case errors.Is(err, ErrRotationConflict):
+		return CodeRotationConflict
+	case errors.Is(err, ErrTokenDecryption):
+		return CodeTokenDecryption
+	case errors.Is(err, context.Canceled):
+		return CodeCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return CodeTimeout
+		}
+		return CodeNetwork
+	case errors.As(err, &syntaxErr), errors.As(err, &unmarshalErr):
+		return CodeDecodeFailed
+	case errors.Is(err, ErrMalformedResponse):
+		return CodeMalformedResponse
+	default:
+		return CodeUnknown
+	}
+}
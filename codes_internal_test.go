@@ -0,0 +1,125 @@
+package traktdeviceauth
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// codeConstants returns the values of the Code* constants declared in codes.go, keyed by name, so that tests
+// cover codes added later without having to be updated.
+func codeConstants(t *testing.T) map[string]string {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "codes.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(map[string]string)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ValueSpec)
+			for i, name := range spec.Names {
+				lit, ok := spec.Values[i].(*ast.BasicLit)
+				if !strings.HasPrefix(name.Name, "Code") || !ok || lit.Kind != token.STRING {
+					continue
+				}
+				value, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				codes[name.Name] = value
+			}
+		}
+	}
+	if len(codes) == 0 {
+		t.Fatal("no Code constants were found in codes.go")
+	}
+	return codes
+}
+
+func TestPublicErrorsCoverEveryCode(t *testing.T) {
+	seen := make(map[string]string)
+	for name, code := range codeConstants(t) {
+		if other, ok := seen[code]; ok {
+			t.Errorf("%s and %s are both %q", name, other, code)
+		}
+		seen[code] = name
+
+		if info, ok := publicErrors[code]; !ok || info.message == "" {
+			t.Errorf("publicErrors has no message for %s", name)
+		}
+	}
+	for code := range publicErrors {
+		if _, ok := seen[code]; !ok {
+			t.Errorf("publicErrors has an entry for %q, which isn't a Code constant", code)
+		}
+	}
+}
+
+func TestErrorHintsAreForCodes(t *testing.T) {
+	codes := make(map[string]bool)
+	for _, code := range codeConstants(t) {
+		codes[code] = true
+	}
+	for code, hint := range errorHints {
+		if !codes[code] || hint == "" {
+			t.Errorf("errorHints has the entry %q: %q", code, hint)
+		}
+	}
+}
+
+func TestCodeTestsCoverEverySentinel(t *testing.T) {
+	// Every exported error variable declared in the package must be in codeTests, so that a new sentinel can't
+	// be added without deciding on its code.
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentinels := make(map[string]bool)
+	for _, file := range pkgs["traktdeviceauth"].Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					if strings.HasPrefix(name.Name, "Err") && name.IsExported() {
+						sentinels[name.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	file, err := parser.ParseFile(fset, "codes_test.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tested := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok && strings.HasPrefix(sel.Sel.Name, "Err") {
+			tested[sel.Sel.Name] = true
+		}
+		return true
+	})
+
+	for name := range sentinels {
+		if !tested[name] {
+			t.Errorf("%s isn't in codeTests", name)
+		}
+	}
+}
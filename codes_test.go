@@ -0,0 +1,131 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// codeTests pairs errors with the code Code returns for them. Every error is also tested wrapped.
+var codeTests = []struct {
+	err  error
+	code string
+}{
+	{nil, ""},
+	{traktdeviceauth.ErrDeviceCodeUnclaimed, traktdeviceauth.CodeDeviceCodeUnclaimed},
+	{traktdeviceauth.ErrInvalidGrant, traktdeviceauth.CodeInvalidGrant},
+	{traktdeviceauth.ErrReauthorizationRequired, traktdeviceauth.CodeInvalidGrant},
+	{traktdeviceauth.ErrInvalidAccessToken, traktdeviceauth.CodeInvalidAccessToken},
+	{traktdeviceauth.ErrInvalidDeviceCode, traktdeviceauth.CodeInvalidDeviceCode},
+	{traktdeviceauth.ErrForbidden, traktdeviceauth.CodeForbidden},
+	{traktdeviceauth.ErrDeviceCodeAlreadyApproved, traktdeviceauth.CodeDeviceCodeAlreadyApproved},
+	{traktdeviceauth.ErrDeviceCodeExpired, traktdeviceauth.CodeDeviceCodeExpired},
+	{traktdeviceauth.ErrDeviceCodeDenied, traktdeviceauth.CodeDeviceCodeDenied},
+	{traktdeviceauth.ErrPollRateTooFast, traktdeviceauth.CodeRateLimited},
+	{traktdeviceauth.ErrServerError, traktdeviceauth.CodeServerError},
+	{traktdeviceauth.ErrServerUnavailable, traktdeviceauth.CodeServerError},
+	{traktdeviceauth.ErrNetworkUnreachable, traktdeviceauth.CodeNetwork},
+	{traktdeviceauth.ErrServiceOverloaded, traktdeviceauth.CodeServiceOverloaded},
+	{traktdeviceauth.ErrCloudflareError, traktdeviceauth.CodeCloudflareError},
+	{traktdeviceauth.ErrUnexpectedStatusCode, traktdeviceauth.CodeUnexpectedStatus},
+	{traktdeviceauth.ErrInsecureBaseURL, traktdeviceauth.CodeInsecureBaseURL},
+	{traktdeviceauth.ErrInvalidArgument, traktdeviceauth.CodeInvalidArgument},
+	{traktdeviceauth.ErrFlowNotFound, traktdeviceauth.CodeFlowNotFound},
+	{traktdeviceauth.ErrFlowPending, traktdeviceauth.CodeFlowPending},
+	{traktdeviceauth.ErrTooManyFlows, traktdeviceauth.CodeTooManyFlows},
+	{traktdeviceauth.ErrFlowCancelled, traktdeviceauth.CodeFlowCancelled},
+	{context.Canceled, traktdeviceauth.CodeCancelled},
+	{context.DeadlineExceeded, traktdeviceauth.CodeTimeout},
+	{&json.SyntaxError{}, traktdeviceauth.CodeDecodeFailed},
+	{&json.UnmarshalTypeError{}, traktdeviceauth.CodeDecodeFailed},
+	{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, traktdeviceauth.CodeNetwork},
+	{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, traktdeviceauth.CodeTimeout},
+	{traktdeviceauth.ErrMalformedResponse, traktdeviceauth.CodeMalformedResponse},
+	{traktdeviceauth.ErrInvalidTransition, traktdeviceauth.CodeInvalidTransition},
+	{traktdeviceauth.ErrInsecurePermissions, traktdeviceauth.CodeInsecurePermissions},
+	{traktdeviceauth.ErrNoStoredToken, traktdeviceauth.CodeNoStoredToken},
+	{traktdeviceauth.ErrKeyNotFound, traktdeviceauth.CodeNoStoredToken},
+	{traktdeviceauth.ErrTokenNotFound, traktdeviceauth.CodeTokenNotFound},
+	{traktdeviceauth.ErrSchedulerClosed, traktdeviceauth.CodeSchedulerClosed},
+	{traktdeviceauth.ErrStoreLocked, traktdeviceauth.CodeStoreLocked},
+	{traktdeviceauth.ErrUnsupportedFormatVersion, traktdeviceauth.CodeUnsupportedFormatVersion},
+	{traktdeviceauth.ErrRotationConflict, traktdeviceauth.CodeRotationConflict},
+	{traktdeviceauth.ErrTokenDecryption, traktdeviceauth.CodeTokenDecryption},
+	{errors.New("something else"), traktdeviceauth.CodeUnknown},
+}
+
+func TestCode(t *testing.T) {
+	for _, tt := range codeTests {
+		if got := traktdeviceauth.Code(tt.err); got != tt.code {
+			t.Errorf("Code(%v) = %q, want %q", tt.err, got, tt.code)
+		}
+		if tt.err == nil {
+			continue
+		}
+		if got := traktdeviceauth.Code(fmt.Errorf("wrapped: %w", tt.err)); got != tt.code {
+			t.Errorf("Code of wrapped %v = %q, want %q", tt.err, got, tt.code)
+		}
+	}
+}
+
+func TestCodeValues(t *testing.T) {
+	// The codes are a compatibility promise, so renaming one must fail this test.
+	codes := map[string]string{
+		traktdeviceauth.CodeDeviceCodeUnclaimed:       "device_code_unclaimed",
+		traktdeviceauth.CodeInvalidGrant:              "invalid_grant",
+		traktdeviceauth.CodeInvalidAccessToken:        "invalid_access_token",
+		traktdeviceauth.CodeInvalidDeviceCode:         "invalid_device_code",
+		traktdeviceauth.CodeForbidden:                 "forbidden",
+		traktdeviceauth.CodeDeviceCodeAlreadyApproved: "device_code_already_approved",
+		traktdeviceauth.CodeDeviceCodeExpired:         "device_code_expired",
+		traktdeviceauth.CodeDeviceCodeDenied:          "device_code_denied",
+		traktdeviceauth.CodeRateLimited:               "rate_limited",
+		traktdeviceauth.CodeServerError:               "server_error",
+		traktdeviceauth.CodeServiceOverloaded:         "service_overloaded",
+		traktdeviceauth.CodeCloudflareError:           "cloudflare_error",
+		traktdeviceauth.CodeUnexpectedStatus:          "unexpected_status",
+		traktdeviceauth.CodeInsecureBaseURL:           "insecure_base_url",
+		traktdeviceauth.CodeInvalidArgument:           "invalid_argument",
+		traktdeviceauth.CodeFlowNotFound:              "flow_not_found",
+		traktdeviceauth.CodeFlowPending:               "flow_pending",
+		traktdeviceauth.CodeTooManyFlows:              "too_many_flows",
+		traktdeviceauth.CodeFlowCancelled:             "flow_cancelled",
+		traktdeviceauth.CodeCancelled:                 "cancelled",
+		traktdeviceauth.CodeTimeout:                   "timeout",
+		traktdeviceauth.CodeNetwork:                   "network",
+		traktdeviceauth.CodeDecodeFailed:              "decode_failed",
+		traktdeviceauth.CodeMalformedResponse:         "malformed_response",
+		traktdeviceauth.CodeInvalidTransition:         "invalid_transition",
+		traktdeviceauth.CodeInsecurePermissions:       "insecure_permissions",
+		traktdeviceauth.CodeNoStoredToken:             "no_stored_token",
+		traktdeviceauth.CodeTokenNotFound:             "token_not_found",
+		traktdeviceauth.CodeSchedulerClosed:           "scheduler_closed",
+		traktdeviceauth.CodeStoreLocked:               "store_locked",
+		traktdeviceauth.CodeUnsupportedFormatVersion:  "unsupported_format_version",
+		traktdeviceauth.CodeRotationConflict:          "rotation_conflict",
+		traktdeviceauth.CodeTokenDecryption:           "token_decryption",
+		traktdeviceauth.CodeUnknown:                   "unknown",
+	}
+	for got, want := range codes {
+		if got != want {
+			t.Errorf("a code changed from %q to %q", want, got)
+		}
+	}
+}
+
+func TestNewPublicErrorHasMessage(t *testing.T) {
+	for _, tt := range codeTests {
+		if tt.err == nil {
+			continue
+		}
+		p := traktdeviceauth.NewPublicError(fmt.Errorf("wrapped: %w", tt.err))
+		if p.Code != tt.code || p.Message == "" {
+			t.Errorf("NewPublicError(%v) = %+v, want code %q and a message", tt.err, p, tt.code)
+		}
+	}
+}
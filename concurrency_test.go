@@ -0,0 +1,154 @@
+package traktdeviceauth_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// lockedBuffer is a bytes.Buffer which can be written to from several goroutines, so that the race detector
+// only reports races inside the package.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestConcurrentClient calls every method of one shared Client, a copy of it and the package functions with
+// the same Options from many goroutines at once. It is meant to be run with -race.
+func TestConcurrentClient(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	requests := 0
+	count := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			return next(req)
+		}
+	}
+	middleware := []traktdeviceauth.Middleware{count}
+	params := map[string]string{"device": "stress"}
+	var audit lockedBuffer
+
+	opts := append(srv.Options(),
+		traktdeviceauth.WithMiddleware(middleware...),
+		traktdeviceauth.WithExtraParams(params),
+		traktdeviceauth.WithCodeCache(traktdeviceauth.NewCodeCache()),
+		traktdeviceauth.WithAuditLog(&audit),
+		traktdeviceauth.WithRateLimitState(filepath.Join(t.TempDir(), "ratelimit.json")),
+		traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}),
+		traktdeviceauth.WithTokenSaver(func(context.Context, traktdeviceauth.TokenResponse) error { return nil }),
+	)
+	clientOpts := append([]traktdeviceauth.Option(nil), opts...)
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", clientOpts...)
+	// A Client never changes, so a copy of it works the same as the original.
+	copied := *cl
+	clients := []*traktdeviceauth.Client{cl, &copied}
+
+	// Neither the caller's Options, nor the slice and map they were created from, are shared with the calls.
+	for i := range clientOpts {
+		clientOpts[i] = nil
+	}
+	middleware[0] = nil
+
+	ctx := context.Background()
+	const goroutines = 8
+	errs := make(chan error, 1000)
+	var wg sync.WaitGroup
+	// The caller keeps changing the map it passed to WithExtraParams while the calls run.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			params["device"] = strings.Repeat("x", i)
+		}
+	}()
+	for i := 0; i < goroutines; i++ {
+		cl := clients[i%len(clients)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codeResp, err := cl.GenerateNewCode(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := cl.RequestToken(ctx, codeResp); err != nil {
+				errs <- err
+			}
+			tok, err := cl.PollForAuthToken(ctx, codeResp)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for _, flow := range []*traktdeviceauth.DeviceAuthFlow{cl.NewDeviceAuthFlow(), traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", opts...)} {
+				if err := flow.Start(ctx); err != nil {
+					errs <- err
+					continue
+				}
+				if _, err := flow.Wait(ctx); err != nil {
+					errs <- err
+				}
+			}
+
+			issued := srv.IssueToken()
+			if _, err := cl.RefreshAccessToken(ctx, issued.RefreshToken); err != nil {
+				errs <- err
+			}
+			if _, err := traktdeviceauth.RefreshAccessTokenContext(ctx, srv.IssueToken().RefreshToken, "client-id", "client-secret", opts...); err != nil {
+				errs <- err
+			}
+			if _, err := cl.GetUserSettings(ctx, tok.AccessToken); err != nil {
+				errs <- err
+			}
+			if err := cl.RevokeToken(ctx, issued.AccessToken); err != nil {
+				errs <- err
+			}
+			if id := cl.ClientID(); id != "client-id" {
+				errs <- fmt.Errorf("ClientID returned %q", id)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if requests == 0 {
+		t.Error("the middleware saw no requests, want the copy made by WithMiddleware to be used")
+	}
+	for _, req := range srv.RequestsTo(traktdeviceauth.EndpointDeviceCode) {
+		if !strings.Contains(string(req.Body), `"device":"stress"`) {
+			t.Errorf("a code request was sent with %s, want the params as they were when the Option was created", req.Body)
+		}
+	}
+	if !strings.Contains(audit.String(), "code_generated") {
+		t.Errorf("the audit log is missing the generated codes:\n%s", audit.String())
+	}
+}
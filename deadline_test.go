@@ -0,0 +1,106 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// promptly is how long a call may take to fail once waiting would outlast its deadline. It is far below both
+// the deadlines and the waits in these tests, so a call which sleeps before failing is caught.
+const promptly = 2 * time.Second
+
+// deadlineContext returns a context whose deadline is 5 seconds away, well before the waits in these tests.
+func deadlineContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestPollForAuthTokenRetryAfterPastDeadline(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(60))))
+
+	ctx := deadlineContext(t)
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, "client-id", "client-secret", srv.Options()...)
+	if elapsed := time.Since(start); elapsed > promptly {
+		t.Errorf("polling took %s to fail, want it to give up once Retry-After passed the deadline", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 1 {
+		t.Errorf("%d polls were made, want 1", n)
+	}
+}
+
+func TestDeviceAuthFlowIntervalPastDeadline(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	ctx := deadlineContext(t)
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithPollInterval(time.Minute))...)
+	if err := f.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := f.Wait(ctx)
+	if elapsed := time.Since(start); elapsed > promptly {
+		t.Errorf("Wait took %s to fail, want it to give up once the interval passed the deadline", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRetryBackoffPastDeadline(t *testing.T) {
+	retry := traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 3, Backoff: time.Minute})
+	tests := []struct {
+		name string
+		call func(ctx context.Context, srv *traktdeviceauthtest.Server) error
+	}{
+		{"GenerateNewCode", func(ctx context.Context, srv *traktdeviceauthtest.Server) error {
+			srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable)))
+			_, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", append(srv.Options(), retry)...)
+			return err
+		}},
+		{"RefreshAccessToken", func(ctx context.Context, srv *traktdeviceauthtest.Server) error {
+			srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable)))
+			_, err := traktdeviceauth.RefreshAccessTokenContext(ctx, srv.IssueToken().RefreshToken, "client-id", "client-secret", append(srv.Options(), retry)...)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+
+			start := time.Now()
+			err := tt.call(deadlineContext(t), srv)
+			if elapsed := time.Since(start); elapsed > promptly {
+				t.Errorf("the call took %s to fail, want it to give up once the backoff passed the deadline", elapsed)
+			}
+			// The failure which would have been retried is more useful than the deadline.
+			if !errors.Is(err, traktdeviceauth.ErrServiceOverloaded) {
+				t.Errorf("got %v, want ErrServiceOverloaded", err)
+			}
+			if n := len(srv.Requests()); n != 1 {
+				t.Errorf("%d requests were made, want 1", n)
+			}
+		})
+	}
+}
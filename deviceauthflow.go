@@ -0,0 +1,559 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrInvalidTransition is returned by the methods of DeviceAuthFlow when they are called in a state which
+// doesn't allow them. The state of the flow is left unchanged.
+var ErrInvalidTransition error = errors.New("invalid device flow state transition")
+
+// DeviceAuthState is the state of a DeviceAuthFlow.
+type DeviceAuthState int
+
+const (
+	// StateIdle is the state of a new flow, before Start is called.
+	StateIdle DeviceAuthState = iota
+
+	// StateCodeRequested means Start is waiting for Trakt to generate a device code.
+	StateCodeRequested
+
+	// StateAwaitingApproval means the user needs to enter the code, and PollOnce should be called
+	// at NextPollAt to find out whether they have.
+	StateAwaitingApproval
+
+	// StateSlowingDown is like StateAwaitingApproval, except that the last poll was rate limited
+	// and the polling interval has been increased.
+	StateSlowingDown
+
+	// StateApproved means the user approved the code. Token returns the result.
+	StateApproved
+
+	// StateDenied means the user declined the code.
+	StateDenied
+
+	// StateExpired means the code expired before the user approved it.
+	StateExpired
+
+	// StateFailed means the flow ended because of an error other than a denial or expiry. Err returns it.
+	StateFailed
+
+	// StateCancelled means Cancel was called.
+	StateCancelled
+)
+
+// String returns a lowercase name for the state.
+func (s DeviceAuthState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateCodeRequested:
+		return "code_requested"
+	case StateAwaitingApproval:
+		return "awaiting_approval"
+	case StateSlowingDown:
+		return "slowing_down"
+	case StateApproved:
+		return "approved"
+	case StateDenied:
+		return "denied"
+	case StateExpired:
+		return "expired"
+	case StateFailed:
+		return "failed"
+	case StateCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// Done reports whether s is a final state, which no method can leave.
+func (s DeviceAuthState) Done() bool {
+	return s >= StateApproved
+}
+
+// waiting reports whether s is a state in which the flow can be polled.
+func (s DeviceAuthState) waiting() bool {
+	return s == StateAwaitingApproval || s == StateSlowingDown
+}
+
+// DeviceAuthFlow is a single device flow with an explicit state, for programs where the state drives
+// what is shown to the user. It can be advanced step by step with Start and PollOnce, or run to
+// completion with Wait. All of its methods are safe for concurrent use.
+type DeviceAuthFlow struct {
+	client *Client // Without Options, which are in opts.
+	opts   []Option
+
+	mu        sync.Mutex
+	state     DeviceAuthState
+	busy      bool // Whether a request is in flight.
+	cancelReq context.CancelFunc
+	codeResp  CodeResponse
+	expiresAt time.Time
+	interval  time.Duration
+	nextPoll  time.Time
+	token     TokenResponse
+	err       error
+	stats     PollStats
+
+	timer          *time.Timer   // Reused by Wait between polls, unless another Wait call has taken it.
+	wake           chan struct{} // Signalled by Nudge to wake Wait.
+	nudged         bool          // Whether Nudge moved the next poll up.
+	lastPollNudged bool          // Whether the last poll was made early because of Nudge.
+}
+
+// WithPollInterval makes PollForAuthToken and DeviceAuthFlow poll every d instead of at the interval in the
+// CodeResponse, even if d is zero. It is meant for tests against fake servers, as Trakt rate limits clients
+// which poll faster than it asked for. Other functions ignore it.
+func WithPollInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.pollInterval = d
+		c.pollIntervalSet = true
+	}
+}
+
+// WithTickSource makes PollForAuthToken and DeviceAuthFlow.Wait poll once for every value received from ticks,
+// instead of timing the polls themselves, for programs which schedule polls along with their own work and for
+// tests which step through a flow. The interval and Retry-After waits Trakt asks for are up to the caller then,
+// but the code's expiry and ctx still end the wait, and the flow still ends when Trakt denies or expires the
+// code. Closing ticks cancels the flow, which makes polling end with ErrFlowCancelled. Other functions ignore it.
+func WithTickSource(ticks <-chan time.Time) Option {
+	return func(c *config) {
+		c.tickSource = ticks
+	}
+}
+
+// NewDeviceAuthFlow creates a flow in StateIdle which authorizes a user for the app identified by clientID
+// and clientSecret.
+func NewDeviceAuthFlow(clientID, clientSecret string, opts ...Option) *DeviceAuthFlow {
+	return newDeviceAuthFlow(NewClient(clientID, clientSecret), opts)
+}
+
+// newDeviceAuthFlow creates a flow in StateIdle which makes its requests with client, which has no Options of its
+// own, and opts.
+func newDeviceAuthFlow(client *Client, opts []Option) *DeviceAuthFlow {
+	return &DeviceAuthFlow{
+		client: client,
+		opts:   append([]Option(nil), opts...),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// resumeDeviceAuthFlow creates a flow in StateAwaitingApproval for a code which was generated at issuedAt.
+func resumeDeviceAuthFlow(codeResp CodeResponse, issuedAt time.Time, client *Client, opts []Option) *DeviceAuthFlow {
+	f := newDeviceAuthFlow(client, opts)
+	f.stats.StartedAt = time.Now()
+	f.await(codeResp, issuedAt)
+	return f
+}
+
+// Start generates a device code, moving the flow from StateIdle to StateCodeRequested and then to
+// StateAwaitingApproval, or StateFailed if the code couldn't be generated. If ctx ends before the code
+// is generated, ctx's error is returned and the flow goes back to StateIdle.
+func (f *DeviceAuthFlow) Start(ctx context.Context) error {
+	f.mu.Lock()
+	if f.state != StateIdle {
+		defer f.mu.Unlock()
+		return f.invalid("start")
+	}
+	f.state = StateCodeRequested
+	f.stats.StartedAt = time.Now()
+	reqCtx := f.beginRequest(ctx)
+	f.mu.Unlock()
+
+	codeResp, err := f.client.GenerateNewCode(reqCtx, f.opts...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.endRequest()
+	if f.state == StateCancelled {
+		return ErrFlowCancelled
+	}
+	if err != nil && ctx.Err() != nil {
+		f.state = StateIdle
+		return err
+	}
+	if err != nil {
+		f.fail(StateFailed, err)
+		return err
+	}
+
+	f.await(codeResp, time.Now())
+	return nil
+}
+
+// PollOnce asks Trakt whether the user has approved the code, once, and returns the resulting state.
+// It is only valid in StateAwaitingApproval and StateSlowingDown, and shouldn't be called before NextPollAt.
+//
+// If a hook set by WithTokenSaver fails, the flow still moves to StateApproved, and the *HookError is returned.
+// An unclaimed code leaves the flow in StateAwaitingApproval, a rate limited poll moves it to StateSlowingDown
+// and pushes NextPollAt back, a poll whose request timed out (see WithRequestTimeout) leaves the state as it
+// was, and anything else ends the flow. If the wait after a rate limited poll would last until the code expires,
+// the flow ends in StateExpired right away instead, and a *BackoffError is returned. If ctx ends before the poll
+// completes, ctx's error is returned and the state doesn't change.
+func (f *DeviceAuthFlow) PollOnce(ctx context.Context) (DeviceAuthState, error) {
+	f.mu.Lock()
+	if !f.state.waiting() || f.busy {
+		defer f.mu.Unlock()
+		return f.state, f.invalid("poll")
+	}
+	if time.Now().After(f.expiresAt) {
+		defer f.mu.Unlock()
+		f.fail(StateExpired, ErrDeviceCodeExpired)
+		return f.state, f.err
+	}
+	codeResp := f.codeResp
+	f.lastPollNudged, f.nudged = f.nudged, false
+	f.stats.Polls++
+	reqCtx := f.beginRequest(ctx)
+	f.mu.Unlock()
+
+	t, err := f.client.RequestToken(reqCtx, codeResp, append(f.opts[:len(f.opts):len(f.opts)], withRetryObserver(f.countRetry))...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.endRequest()
+	if f.state == StateCancelled {
+		return f.state, ErrFlowCancelled
+	}
+
+	var (
+		rateLimitErr *RateLimitError
+		hookErr      *HookError
+		timeoutErr   *RequestTimeoutError
+	)
+	switch {
+	case err == nil:
+		f.approve(t)
+		return f.state, nil
+	case errors.As(err, &hookErr):
+		// The code was approved, but a hook couldn't handle the token. The token is still good.
+		f.approve(t)
+		return f.state, err
+	case errors.Is(err, ErrDeviceCodeUnclaimed):
+		f.state = StateAwaitingApproval
+		f.nextPoll = time.Now().Add(f.interval)
+		return f.state, nil
+	case errors.As(err, &rateLimitErr):
+		// As RFC 8628 asks for slow_down errors, the interval grows by 5 seconds for the rest of the flow.
+		f.interval += 5 * time.Second
+		f.stats.RateLimited++
+		wait := f.interval
+		if rateLimitErr.RetryAfter > wait {
+			wait = rateLimitErr.RetryAfter
+		}
+		now := time.Now()
+		if !now.Add(wait).Before(f.expiresAt) {
+			// Waiting would only end in the code expiring, so the caller can generate a new one right away.
+			f.fail(StateExpired, &BackoffError{Wait: wait, Remaining: f.expiresAt.Sub(now)})
+			return f.state, f.err
+		}
+		f.state = StateSlowingDown
+		f.nextPoll = now.Add(wait)
+		return f.state, nil
+	case errors.As(err, &timeoutErr) && ctx.Err() == nil:
+		// A stalled request says nothing about the code, so the flow polls again at the next interval.
+		f.stats.TimedOut++
+		f.nextPoll = time.Now().Add(f.interval)
+		return f.state, nil
+	case ctx.Err() != nil:
+		return f.state, err
+	case errors.Is(err, ErrDeviceCodeDenied):
+		f.fail(StateDenied, err)
+	case errors.Is(err, ErrDeviceCodeExpired):
+		f.fail(StateExpired, err)
+	default:
+		f.fail(StateFailed, err)
+	}
+	return f.state, err
+}
+
+// Wait polls at the interval Trakt asked for, or whenever the WithTickSource channel delivers a value, until
+// the flow ends, and returns the token if the user approved the code. Nudge makes it poll early. It is only
+// valid in StateAwaitingApproval and StateSlowingDown. If ctx ends first, or its deadline comes before the next
+// poll is due, ctx's error is returned and the flow is left in its current state, so Wait can be called again
+// later.
+func (f *DeviceAuthFlow) Wait(ctx context.Context) (TokenResponse, error) {
+	f.mu.Lock()
+	if !f.state.waiting() {
+		defer f.mu.Unlock()
+		return TokenResponse{}, f.invalid("wait")
+	}
+	f.mu.Unlock()
+
+	ticks := newConfig(f.opts).tickSource
+	timer := f.takeTimer()
+	defer f.putTimer(timer)
+	for {
+		var err error
+		if ticks != nil {
+			err = f.awaitTick(ctx, ticks)
+		} else {
+			err = f.sleepUntilNextPoll(ctx, timer)
+		}
+		if err != nil {
+			return TokenResponse{}, err
+		}
+
+		state, err := f.PollOnce(ctx)
+		if state == StateApproved {
+			return f.Token(), err
+		}
+		if err != nil {
+			return TokenResponse{}, err
+		}
+	}
+}
+
+// Nudge makes the next poll due right away and wakes Wait to make it, for example when the user says they have
+// entered the code. It reports whether the poll was moved up.
+//
+// Polling early breaks the interval Trakt asked for, so Nudge limits it to one poll in a row: it does nothing
+// if the last poll was already nudged, or the next one already is, and the poll after a nudged one keeps to the
+// interval again. It also does nothing while the flow is slowing down, while a poll is in flight, and in every
+// state other than StateAwaitingApproval, including after the flow has ended.
+func (f *DeviceAuthFlow) Nudge() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.state != StateAwaitingApproval || f.busy || f.nudged || f.lastPollNudged || !f.nextPoll.After(now) {
+		return false
+	}
+	f.nudged = true
+	f.nextPoll = now
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+		// Wait is already due to wake up.
+	}
+	return true
+}
+
+// Cancel ends the flow in StateCancelled, aborting any request in flight. It is valid in every state
+// which isn't final.
+func (f *DeviceAuthFlow) Cancel() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.state.Done() {
+		return f.invalid("cancel")
+	}
+
+	f.fail(StateCancelled, ErrFlowCancelled)
+	if f.cancelReq != nil {
+		f.cancelReq()
+	}
+	return nil
+}
+
+// State returns the current state of the flow.
+func (f *DeviceAuthFlow) State() DeviceAuthState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state
+}
+
+// CodeResponse returns the device code generated by Start. It is the zero value before Start succeeds.
+func (f *DeviceAuthFlow) CodeResponse() CodeResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.codeResp
+}
+
+// ExpiresAt returns when the device code expires. It is the zero value before Start succeeds.
+func (f *DeviceAuthFlow) ExpiresAt() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.expiresAt
+}
+
+// NextPollAt returns when PollOnce may next be called without polling too quickly.
+func (f *DeviceAuthFlow) NextPollAt() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.nextPoll
+}
+
+// Token returns the token obtained once the flow reaches StateApproved, and the zero value before that.
+func (f *DeviceAuthFlow) Token() TokenResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.token
+}
+
+// Stats returns the statistics of the flow so far.
+func (f *DeviceAuthFlow) Stats() PollStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stats
+}
+
+// Err returns why the flow ended in StateDenied, StateExpired, StateFailed or StateCancelled, and nil otherwise.
+func (f *DeviceAuthFlow) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+// sleepUntilNextPoll waits until NextPollAt, which Nudge can move up while it waits. It returns ctx's error
+// if ctx ends, or if its deadline comes before the poll is due.
+//
+// timer must be stopped with its channel drained, and is left that way on every return path, so that it can be
+// reset for the next wait on every Go version instead of allocating a timer for each one.
+func (f *DeviceAuthFlow) sleepUntilNextPoll(ctx context.Context, timer *time.Timer) error {
+	for {
+		d := time.Until(f.NextPollAt())
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+			return context.DeadlineExceeded
+		}
+		if d <= 0 {
+			return ctx.Err()
+		}
+
+		timer.Reset(d)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			stopTimer(timer)
+			return ctx.Err()
+		case <-f.wake:
+			stopTimer(timer)
+		}
+	}
+}
+
+// takeTimer returns a stopped timer for Wait to sleep with. It is the flow's own timer unless another Wait call
+// is using it, in which case a new one is created.
+func (f *DeviceAuthFlow) takeTimer() *time.Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	timer := f.timer
+	f.timer = nil
+	if timer == nil {
+		timer = time.NewTimer(math.MaxInt64)
+		timer.Stop()
+	}
+	return timer
+}
+
+// putTimer gives a timer taken with takeTimer back to the flow, stopped with its channel drained.
+func (f *DeviceAuthFlow) putTimer(timer *time.Timer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.timer = timer
+}
+
+// stopTimer stops timer and drains its channel if it fired before it could be stopped.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// awaitTick waits for a value from the WithTickSource channel ticks, or for the code to expire, after which
+// PollOnce ends the flow without making a request. It cancels the flow and returns ErrFlowCancelled if ticks is
+// closed.
+func (f *DeviceAuthFlow) awaitTick(ctx context.Context, ticks <-chan time.Time) error {
+	expiry := time.NewTimer(time.Until(f.ExpiresAt()))
+	defer expiry.Stop()
+
+	select {
+	case _, ok := <-ticks:
+		if !ok {
+			// Cancel only fails if the flow has already ended, which Wait finds out on its own.
+			_ = f.Cancel()
+			return ErrFlowCancelled
+		}
+		return nil
+	case <-expiry.C:
+		return nil
+	case <-ctx.Done():
+		if !time.Now().Before(f.ExpiresAt()) {
+			// PollForAuthToken's deadline is the code's expiry.
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// await moves the flow to StateAwaitingApproval for codeResp, which was generated at issuedAt, or at least counts
+// its expiry from then if it has no ExpiresAt. f.mu must be held unless f hasn't been shared yet.
+func (f *DeviceAuthFlow) await(codeResp CodeResponse, issuedAt time.Time) {
+	f.codeResp = codeResp
+	f.expiresAt = codeResp.expiresAt(issuedAt)
+	f.interval = codeResp.IntervalDuration()
+	if c := newConfig(f.opts); c.pollIntervalSet {
+		f.interval = c.pollInterval
+	}
+	f.nextPoll = issuedAt.Add(f.interval)
+	f.state = StateAwaitingApproval
+}
+
+// beginRequest marks a request as in flight and returns the context it should use, which Cancel aborts.
+// f.mu must be held.
+func (f *DeviceAuthFlow) beginRequest(ctx context.Context) context.Context {
+	f.busy = true
+	ctx, f.cancelReq = context.WithCancel(ctx)
+	return ctx
+}
+
+// endRequest marks the request started by beginRequest as finished. f.mu must be held.
+func (f *DeviceAuthFlow) endRequest() {
+	f.busy = false
+	f.cancelReq()
+	f.cancelReq = nil
+}
+
+// approve ends the flow in StateApproved with t. f.mu must be held.
+func (f *DeviceAuthFlow) approve(t TokenResponse) {
+	f.token = t
+	f.state = StateApproved
+	f.stats.ApprovedAt = time.Now()
+	f.stats.FinishedAt = f.stats.ApprovedAt
+}
+
+// fail ends the flow in state because of err. f.mu must be held.
+func (f *DeviceAuthFlow) fail(state DeviceAuthState, err error) {
+	f.state = state
+	f.err = err
+	f.stats.FinishedAt = time.Now()
+}
+
+// countRetry counts a retried request in the flow's statistics.
+func (f *DeviceAuthFlow) countRetry() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stats.Retries++
+}
+
+// invalid returns the error for attempting action in the current state. f.mu must be held.
+func (f *DeviceAuthFlow) invalid(action string) error {
+	if f.busy {
+		return fmt.Errorf("%w: cannot %s while a request is in flight", ErrInvalidTransition, action)
+	}
+	return fmt.Errorf("%w: cannot %s in state %s", ErrInvalidTransition, action, f.state)
+}
@@ -0,0 +1,110 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitingFlow returns a flow awaiting approval of a code which it would next poll for after wait.
+func waitingFlow(wait time.Duration) *DeviceAuthFlow {
+	codeResp := CodeResponse{DeviceCode: "code", UserCode: "USER", ExpiresIn: 600, Interval: 5}
+	f := resumeDeviceAuthFlow(codeResp, time.Now(), NewClient("client-id", ""), []Option{WithPollInterval(wait)})
+	f.nextPoll = time.Now().Add(wait)
+	return f
+}
+
+func TestWaitStopsTimerOnEarlyCancel(t *testing.T) {
+	f := waitingFlow(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := f.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait returned %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait took %v to notice the cancellation", elapsed)
+	}
+
+	// Wait hands its timer back to the flow, and a stopped timer can't be stopped again.
+	if f.timer == nil {
+		t.Fatal("Wait didn't give its timer back")
+	}
+	if f.timer.Stop() {
+		t.Error("the timer was still running after Wait returned")
+	}
+	select {
+	case <-f.timer.C:
+		t.Error("the timer's channel wasn't drained")
+	default:
+	}
+	if f.State() != StateAwaitingApproval {
+		t.Errorf("state is %v after the cancellation, want %v", f.State(), StateAwaitingApproval)
+	}
+}
+
+func TestWaitReusesTimer(t *testing.T) {
+	f := waitingFlow(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f.Wait(ctx)
+	timer := f.timer
+	f.Wait(ctx)
+	if f.timer != timer {
+		t.Error("the second Wait call didn't reuse the flow's timer")
+	}
+
+	// Concurrent Wait calls each need a timer of their own.
+	if taken := f.takeTimer(); taken != timer || f.takeTimer() == timer {
+		t.Error("takeTimer handed out the flow's timer twice")
+	}
+}
+
+func TestSleepUntilNextPollDoesNotAllocate(t *testing.T) {
+	f := waitingFlow(0)
+	timer := f.takeTimer()
+	ctx := context.Background()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		f.nextPoll = time.Now().Add(time.Microsecond)
+		if err := f.sleepUntilNextPoll(ctx, timer); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("sleepUntilNextPoll made %v allocations per wait, want 0", allocs)
+	}
+}
+
+// BenchmarkPollWait compares waiting for each poll with time.After, as the poll loop used to, against resetting the
+// flow's timer, as sleepUntilNextPoll does.
+func BenchmarkPollWait(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("time.After", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			select {
+			case <-time.After(time.Microsecond):
+			case <-ctx.Done():
+				b.Fatal(ctx.Err())
+			}
+		}
+	})
+
+	b.Run("reused timer", func(b *testing.B) {
+		f := waitingFlow(0)
+		timer := f.takeTimer()
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.nextPoll = time.Now().Add(time.Microsecond)
+			if err := f.sleepUntilNextPoll(ctx, timer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,705 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// allStates are every DeviceAuthState, in order.
+var allStates = []traktdeviceauth.DeviceAuthState{
+	traktdeviceauth.StateIdle,
+	traktdeviceauth.StateCodeRequested,
+	traktdeviceauth.StateAwaitingApproval,
+	traktdeviceauth.StateSlowingDown,
+	traktdeviceauth.StateApproved,
+	traktdeviceauth.StateDenied,
+	traktdeviceauth.StateExpired,
+	traktdeviceauth.StateFailed,
+	traktdeviceauth.StateCancelled,
+}
+
+// flowPaths are the responses which take a new flow to each state other than StateCodeRequested and
+// StateCancelled: the first answers Start and the others answer one PollOnce each.
+var flowPaths = map[traktdeviceauth.DeviceAuthState][]traktdeviceauthtest.Fixture{
+	traktdeviceauth.StateIdle:             nil,
+	traktdeviceauth.StateAwaitingApproval: {traktdeviceauthtest.FixtureCodeResponse},
+	traktdeviceauth.StateSlowingDown:      {traktdeviceauthtest.FixtureCodeResponse, traktdeviceauthtest.FixtureSlowDown},
+	traktdeviceauth.StateApproved:         {traktdeviceauthtest.FixtureCodeResponse, traktdeviceauthtest.FixtureTokenResponse},
+	traktdeviceauth.StateDenied:           {traktdeviceauthtest.FixtureCodeResponse, traktdeviceauthtest.FixtureDenied},
+	traktdeviceauth.StateExpired:          {traktdeviceauthtest.FixtureCodeResponse, traktdeviceauthtest.FixtureExpired},
+	traktdeviceauth.StateFailed:           {traktdeviceauthtest.FixtureForbidden},
+}
+
+// flowIn returns a flow in state whose next request is answered with next, if it isn't empty.
+func flowIn(t *testing.T, state traktdeviceauth.DeviceAuthState, next ...traktdeviceauthtest.Fixture) (*traktdeviceauth.DeviceAuthFlow, *traktdeviceauthtest.ReplayTransport) {
+	t.Helper()
+
+	path := flowPaths[state]
+	if state == traktdeviceauth.StateCancelled {
+		path = flowPaths[traktdeviceauth.StateAwaitingApproval]
+	}
+	replay := traktdeviceauthtest.NewReplayTransport(append(append([]traktdeviceauthtest.Fixture(nil), path...), next...)...)
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append(replay.Options(), traktdeviceauth.WithPollInterval(0))...)
+
+	ctx := context.Background()
+	for i := range path {
+		if i == 0 {
+			f.Start(ctx)
+		} else {
+			f.PollOnce(ctx)
+		}
+	}
+	if state == traktdeviceauth.StateCancelled {
+		if err := f.Cancel(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.State(); got != state {
+		t.Fatalf("the flow is in %s, want %s", got, state)
+	}
+	return f, replay
+}
+
+// flowAction calls one of the methods which advance a DeviceAuthFlow.
+type flowAction struct {
+	name string
+	call func(ctx context.Context, f *traktdeviceauth.DeviceAuthFlow) error
+}
+
+var (
+	actionStart = flowAction{"Start", func(ctx context.Context, f *traktdeviceauth.DeviceAuthFlow) error {
+		return f.Start(ctx)
+	}}
+	actionPollOnce = flowAction{"PollOnce", func(ctx context.Context, f *traktdeviceauth.DeviceAuthFlow) error {
+		_, err := f.PollOnce(ctx)
+		return err
+	}}
+	actionWait = flowAction{"Wait", func(ctx context.Context, f *traktdeviceauth.DeviceAuthFlow) error {
+		_, err := f.Wait(ctx)
+		return err
+	}}
+	actionCancel = flowAction{"Cancel", func(ctx context.Context, f *traktdeviceauth.DeviceAuthFlow) error {
+		return f.Cancel()
+	}}
+)
+
+func TestDeviceAuthFlowTransitions(t *testing.T) {
+	tests := []struct {
+		from    traktdeviceauth.DeviceAuthState
+		action  flowAction
+		next    []traktdeviceauthtest.Fixture
+		want    traktdeviceauth.DeviceAuthState
+		wantErr error
+	}{
+		{traktdeviceauth.StateIdle, actionStart, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureCodeResponse}, traktdeviceauth.StateAwaitingApproval, nil},
+		{traktdeviceauth.StateIdle, actionStart, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureForbidden}, traktdeviceauth.StateFailed, traktdeviceauth.ErrForbidden},
+		{traktdeviceauth.StateIdle, actionStart, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureServerError}, traktdeviceauth.StateFailed, traktdeviceauth.ErrServerError},
+		{traktdeviceauth.StateIdle, actionCancel, nil, traktdeviceauth.StateCancelled, nil},
+
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixturePending}, traktdeviceauth.StateAwaitingApproval, nil},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureSlowDown}, traktdeviceauth.StateSlowingDown, nil},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureTokenResponse}, traktdeviceauth.StateApproved, nil},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureDenied}, traktdeviceauth.StateDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureExpired}, traktdeviceauth.StateExpired, traktdeviceauth.ErrDeviceCodeExpired},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureInvalidDeviceCode}, traktdeviceauth.StateFailed, traktdeviceauth.ErrInvalidDeviceCode},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureAlreadyUsed}, traktdeviceauth.StateFailed, traktdeviceauth.ErrDeviceCodeAlreadyApproved},
+		{traktdeviceauth.StateAwaitingApproval, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureServerError}, traktdeviceauth.StateFailed, traktdeviceauth.ErrServerError},
+		{traktdeviceauth.StateAwaitingApproval, actionWait, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixturePending, traktdeviceauthtest.FixtureTokenResponse}, traktdeviceauth.StateApproved, nil},
+		{traktdeviceauth.StateAwaitingApproval, actionWait, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureDenied}, traktdeviceauth.StateDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{traktdeviceauth.StateAwaitingApproval, actionCancel, nil, traktdeviceauth.StateCancelled, nil},
+
+		{traktdeviceauth.StateSlowingDown, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixturePending}, traktdeviceauth.StateAwaitingApproval, nil},
+		{traktdeviceauth.StateSlowingDown, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureSlowDown}, traktdeviceauth.StateSlowingDown, nil},
+		{traktdeviceauth.StateSlowingDown, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureTokenResponse}, traktdeviceauth.StateApproved, nil},
+		{traktdeviceauth.StateSlowingDown, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureDenied}, traktdeviceauth.StateDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{traktdeviceauth.StateSlowingDown, actionPollOnce, []traktdeviceauthtest.Fixture{traktdeviceauthtest.FixtureExpired}, traktdeviceauth.StateExpired, traktdeviceauth.ErrDeviceCodeExpired},
+		{traktdeviceauth.StateSlowingDown, actionCancel, nil, traktdeviceauth.StateCancelled, nil},
+	}
+	for _, tt := range tests {
+		name := tt.from.String() + " " + tt.action.name
+		if len(tt.next) > 0 {
+			name += " " + http.StatusText(tt.next[len(tt.next)-1].Status)
+		}
+		t.Run(name, func(t *testing.T) {
+			f, replay := flowIn(t, tt.from, tt.next...)
+
+			err := tt.action.call(context.Background(), f)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("%s returned %v", tt.action.name, err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s returned %v, want %v", tt.action.name, err, tt.wantErr)
+			}
+			if got := f.State(); got != tt.want {
+				t.Errorf("the flow moved to %s, want %s", got, tt.want)
+			}
+			if n := replay.Remaining(); n != 0 {
+				t.Errorf("%d responses weren't requested", n)
+			}
+
+			switch tt.want {
+			case traktdeviceauth.StateApproved:
+				if f.Token().AccessToken == "" || f.Err() != nil {
+					t.Errorf("the approved flow has the token %+v and the error %v", f.Token(), f.Err())
+				}
+			case traktdeviceauth.StateCancelled:
+				if !errors.Is(f.Err(), traktdeviceauth.ErrFlowCancelled) {
+					t.Errorf("Err() = %v, want ErrFlowCancelled", f.Err())
+				}
+			case traktdeviceauth.StateDenied, traktdeviceauth.StateExpired, traktdeviceauth.StateFailed:
+				if !errors.Is(f.Err(), tt.wantErr) {
+					t.Errorf("Err() = %v, want %v", f.Err(), tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceAuthFlowInvalidTransitions(t *testing.T) {
+	// Every pair of a state and a method not covered by TestDeviceAuthFlowTransitions is invalid, leaves the
+	// state as it was, and doesn't make a request.
+	valid := map[traktdeviceauth.DeviceAuthState][]string{
+		traktdeviceauth.StateIdle:             {"Start", "Cancel"},
+		traktdeviceauth.StateAwaitingApproval: {"PollOnce", "Wait", "Cancel"},
+		traktdeviceauth.StateSlowingDown:      {"PollOnce", "Wait", "Cancel"},
+	}
+	for _, state := range allStates {
+		if state == traktdeviceauth.StateCodeRequested {
+			continue // See TestDeviceAuthFlowWhileCodeRequested.
+		}
+		for _, action := range []flowAction{actionStart, actionPollOnce, actionWait, actionCancel} {
+			isValid := false
+			for _, name := range valid[state] {
+				isValid = isValid || name == action.name
+			}
+			if isValid {
+				continue
+			}
+
+			t.Run(state.String()+" "+action.name, func(t *testing.T) {
+				f, replay := flowIn(t, state)
+				before := len(replay.Requests())
+				errBefore := f.Err()
+
+				if err := action.call(context.Background(), f); !errors.Is(err, traktdeviceauth.ErrInvalidTransition) {
+					t.Errorf("%s returned %v, want ErrInvalidTransition", action.name, err)
+				}
+				if got := f.State(); got != state {
+					t.Errorf("the flow moved to %s", got)
+				}
+				if f.Err() != errBefore {
+					t.Errorf("Err() changed from %v to %v", errBefore, f.Err())
+				}
+				if n := len(replay.Requests()) - before; n != 0 {
+					t.Errorf("%d requests were made", n)
+				}
+			})
+		}
+	}
+}
+
+func TestDeviceAuthFlowWhileCodeRequested(t *testing.T) {
+	// The code request is held until the test has tried every method.
+	release := make(chan struct{})
+	requested := make(chan struct{})
+	hold := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			close(requested)
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			return next(req)
+		}
+	}
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse)
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append([]traktdeviceauth.Option{traktdeviceauth.WithMiddleware(hold)}, replay.Options()...)...)
+
+	started := make(chan error, 1)
+	go func() { started <- f.Start(context.Background()) }()
+	<-requested
+
+	if got := f.State(); got != traktdeviceauth.StateCodeRequested {
+		t.Fatalf("the flow is in %s while its code is requested", got)
+	}
+	for _, action := range []flowAction{actionStart, actionPollOnce, actionWait} {
+		if err := action.call(context.Background(), f); !errors.Is(err, traktdeviceauth.ErrInvalidTransition) {
+			t.Errorf("%s returned %v, want ErrInvalidTransition", action.name, err)
+		}
+	}
+
+	// Cancelling aborts the request.
+	if err := f.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-started:
+		if !errors.Is(err, traktdeviceauth.ErrFlowCancelled) {
+			t.Errorf("Start returned %v, want ErrFlowCancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Cancel")
+	}
+	close(release)
+	if got := f.State(); got != traktdeviceauth.StateCancelled {
+		t.Errorf("the flow is in %s, want cancelled", got)
+	}
+}
+
+func TestDeviceAuthFlowStartCancelledContext(t *testing.T) {
+	// A Start interrupted by its context leaves the flow idle, so that it can be started again. The replay
+	// transport answers regardless of the context, unlike a real request.
+	checkCtx := traktdeviceauth.RequestEditor(func(req *http.Request) error { return req.Context().Err() })
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse)
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append([]traktdeviceauth.Option{traktdeviceauth.WithMiddleware(checkCtx)}, replay.Options()...)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.Start(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start returned %v, want context.Canceled", err)
+	}
+	if got := f.State(); got != traktdeviceauth.StateIdle {
+		t.Fatalf("the flow is in %s, want idle", got)
+	}
+	if err := f.Start(context.Background()); err != nil || f.State() != traktdeviceauth.StateAwaitingApproval {
+		t.Errorf("starting again returned %v in %s", err, f.State())
+	}
+}
+
+func TestDeviceAuthFlowPollAfterExpiry(t *testing.T) {
+	// A code which has already expired ends the flow without asking Trakt.
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.Fixture{
+		Status: http.StatusOK,
+		Body:   `{"device_code":"code","user_code":"USER","verification_url":"https://trakt.tv/activate","expires_in":0,"interval":1}`,
+	})
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", replay.Options()...)
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	state, err := f.PollOnce(context.Background())
+	if state != traktdeviceauth.StateExpired || !errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired) {
+		t.Errorf("PollOnce returned %s and %v, want expired", state, err)
+	}
+	if n := len(replay.Requests()); n != 1 {
+		t.Errorf("%d requests were made, want only the code request", n)
+	}
+}
+
+func TestDeviceAuthStateString(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, state := range allStates {
+		s := state.String()
+		if s == "unknown" || seen[s] {
+			t.Errorf("%d has the name %q", int(state), s)
+		}
+		seen[s] = true
+		if want := state >= traktdeviceauth.StateApproved; state.Done() != want {
+			t.Errorf("%s.Done() = %v, want %v", s, state.Done(), want)
+		}
+	}
+	if s := traktdeviceauth.DeviceAuthState(len(allStates)).String(); s != "unknown" {
+		t.Errorf("an undefined state is called %q", s)
+	}
+}
+
+// waitForRequests waits until srv has received n requests to endpoint.
+func waitForRequests(t *testing.T, srv *traktdeviceauthtest.Server, endpoint traktdeviceauth.Endpoint, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.RequestsTo(endpoint)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests to %s, want %d", len(srv.RequestsTo(endpoint)), endpoint, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeviceAuthFlowNudge(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+
+	// The flow has no clock to fake, so the interval is an hour long instead: every poll made during the test
+	// which isn't nudged is made by PollOnce.
+	flow := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithPollInterval(time.Hour))...)
+	if flow.Nudge() {
+		t.Error("Nudge of an idle flow returned true")
+	}
+	ctx := context.Background()
+	if err := flow.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !flow.Nudge() {
+		t.Fatal("Nudge of a new flow returned false")
+	}
+	if flow.NextPollAt().After(time.Now()) {
+		t.Errorf("the next poll is at %v after Nudge, want it due", flow.NextPollAt())
+	}
+	if flow.Nudge() {
+		t.Error("a second Nudge before the poll returned true")
+	}
+
+	type result struct {
+		t   traktdeviceauth.TokenResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		tok, err := flow.Wait(ctx)
+		done <- result{tok, err}
+	}()
+
+	// The nudged poll is made right away, and the next one keeps to the interval again.
+	waitForRequests(t, srv, traktdeviceauth.EndpointDeviceToken, 1)
+	for flow.NextPollAt().Before(time.Now()) {
+		time.Sleep(time.Millisecond)
+	}
+	if next := time.Until(flow.NextPollAt()); next < 59*time.Minute {
+		t.Errorf("the poll after a nudged one is due in %v, want the interval of an hour", next)
+	}
+	if flow.Nudge() {
+		t.Error("Nudge right after a nudged poll returned true, want only one early poll in a row")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 1 {
+		t.Errorf("%d polls after a rejected Nudge, want 1", n)
+	}
+
+	// Once a poll has been made on schedule, Nudge works again and wakes Wait.
+	if state, err := flow.PollOnce(ctx); state != traktdeviceauth.StateAwaitingApproval || err != nil {
+		t.Fatalf("PollOnce returned %v, %v", state, err)
+	}
+	if !flow.Nudge() {
+		t.Fatal("Nudge after a poll on schedule returned false")
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || r.t.AccessToken == "" {
+			t.Errorf("Wait returned %+v, %v, want the token", r.t, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't poll after Nudge")
+	}
+
+	if flow.Nudge() {
+		t.Error("Nudge of an approved flow returned true")
+	}
+}
+
+func TestDeviceAuthFlowNudgeWhileSlowingDown(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(30))))
+
+	flow := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithPollInterval(time.Second))...)
+	if err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := flow.PollOnce(context.Background()); state != traktdeviceauth.StateSlowingDown {
+		t.Fatalf("the rate limited poll left the flow in %v", state)
+	}
+	// Trakt asked the flow to back off, so it mustn't poll early.
+	if flow.Nudge() {
+		t.Error("Nudge while slowing down returned true")
+	}
+}
+
+func TestDeviceAuthFlowBackoffOutlastingCode(t *testing.T) {
+	// The server's code lifetime stands in for a clock near the end of the window: nothing sleeps, so a flow
+	// which waited for the rate limit would hit the test's deadline instead of returning.
+	tests := []struct {
+		name      string
+		expiresIn int
+		step      traktdeviceauthtest.Step
+		want      traktdeviceauth.DeviceAuthState
+	}{
+		{"Retry-After past the expiry", 45, traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(120)), traktdeviceauth.StateExpired},
+		{"Retry-After at the expiry", 45, traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(45)), traktdeviceauth.StateExpired},
+		{"grown interval past the expiry", 4, traktdeviceauthtest.Status(http.StatusTooManyRequests), traktdeviceauth.StateExpired},
+		{"Retry-After within the lifetime", 600, traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(120)), traktdeviceauth.StateSlowingDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.ExpiresIn = tt.expiresIn
+			srv.Script(traktdeviceauthtest.Sequence(tt.step))
+
+			flow := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", srv.Options()...)
+			if err := flow.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			state, err := flow.PollOnce(context.Background())
+			if state != tt.want {
+				t.Fatalf("PollOnce left the flow in %s (%v), want %s", state, err, tt.want)
+			}
+			if tt.want == traktdeviceauth.StateSlowingDown {
+				if err != nil || !flow.NextPollAt().After(time.Now().Add(100*time.Second)) {
+					t.Errorf("PollOnce returned %v and a next poll at %v, want the Retry-After respected", err, flow.NextPollAt())
+				}
+				return
+			}
+
+			var backoffErr *traktdeviceauth.BackoffError
+			if !errors.As(err, &backoffErr) || !errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired) || !errors.Is(err, traktdeviceauth.ErrPollRateTooFast) {
+				t.Fatalf("PollOnce returned %v, want a *BackoffError matching ErrDeviceCodeExpired and ErrPollRateTooFast", err)
+			}
+			if backoffErr.Wait < backoffErr.Remaining || backoffErr.Remaining > time.Duration(tt.expiresIn)*time.Second {
+				t.Errorf("the error records a wait of %v with %v left", backoffErr.Wait, backoffErr.Remaining)
+			}
+			if got := traktdeviceauth.Code(err); got != traktdeviceauth.CodeDeviceCodeExpired {
+				t.Errorf("Code(err) = %s, want %s", got, traktdeviceauth.CodeDeviceCodeExpired)
+			}
+		})
+	}
+}
+
+func TestPollForAuthTokenBackoffOutlastingCode(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ExpiresIn = 45
+	srv.Script(traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(120))))
+
+	code, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = traktdeviceauth.PollForAuthTokenContext(ctx, code, "client-id", "client-secret", srv.Options()...)
+	var backoffErr *traktdeviceauth.BackoffError
+	if !errors.As(err, &backoffErr) || time.Since(start) > time.Second {
+		t.Errorf("PollForAuthTokenContext returned %v after %v, want a *BackoffError right away", err, time.Since(start))
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 1 {
+		t.Errorf("%d polls were made, want 1", n)
+	}
+}
+
+// tick sends a tick to the WithTickSource channel ticks, failing the test if the poll loop doesn't take it.
+func tick(t *testing.T, ticks chan<- time.Time) {
+	t.Helper()
+
+	select {
+	case ticks <- time.Now():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poll loop didn't take the tick")
+	}
+}
+
+// expectNoPoll fails the test if the n-th poll is made within a short while.
+func expectNoPoll(t *testing.T, srv *traktdeviceauthtest.Server, n int) {
+	t.Helper()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); got >= n {
+		t.Fatalf("%d polls were made without a tick, want %d", got, n-1)
+	}
+}
+
+// newTickFlow returns a started flow against srv which polls on every value from the returned channel. Its
+// interval is an hour, so any poll made without a tick shows up.
+func newTickFlow(t *testing.T, srv *traktdeviceauthtest.Server) (*traktdeviceauth.DeviceAuthFlow, chan time.Time) {
+	t.Helper()
+
+	ticks := make(chan time.Time)
+	flow := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret",
+		append(srv.Options(), traktdeviceauth.WithPollInterval(time.Hour), traktdeviceauth.WithTickSource(ticks))...)
+	if err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return flow, ticks
+}
+
+// waitResult is what DeviceAuthFlow.Wait returned.
+type waitResult struct {
+	t   traktdeviceauth.TokenResponse
+	err error
+}
+
+// waitInBackground calls flow.Wait with ctx in a goroutine and sends its result to the returned channel.
+func waitInBackground(ctx context.Context, flow *traktdeviceauth.DeviceAuthFlow) chan waitResult {
+	done := make(chan waitResult, 1)
+	go func() {
+		t, err := flow.Wait(ctx)
+		done <- waitResult{t, err}
+	}()
+	return done
+}
+
+// receiveResult waits for the result of waitInBackground.
+func receiveResult(t *testing.T, done chan waitResult) waitResult {
+	t.Helper()
+
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return")
+		return waitResult{}
+	}
+}
+
+func TestTickSourceApproves(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+	flow, ticks := newTickFlow(t, srv)
+	done := waitInBackground(context.Background(), flow)
+
+	// Every tick makes exactly one poll, and nothing else does.
+	expectNoPoll(t, srv, 1)
+	for n := 1; n <= 2; n++ {
+		tick(t, ticks)
+		waitForRequests(t, srv, traktdeviceauth.EndpointDeviceToken, n)
+		expectNoPoll(t, srv, n+1)
+		if state := flow.State(); state != traktdeviceauth.StateAwaitingApproval {
+			t.Fatalf("the flow is in %s after %d unclaimed polls", state, n)
+		}
+	}
+	tick(t, ticks)
+	if r := receiveResult(t, done); r.err != nil || r.t.AccessToken == "" {
+		t.Fatalf("Wait returned %+v, %v, want the token", r.t, r.err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 3 {
+		t.Errorf("%d polls were made for 3 ticks", n)
+	}
+}
+
+func TestTickSourceTerminalStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		scenario  traktdeviceauthtest.Scenario
+		wantState traktdeviceauth.DeviceAuthState
+		wantErr   error
+	}{
+		{"denied", traktdeviceauthtest.DenyAfterPolls(1), traktdeviceauth.StateDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{"expired", traktdeviceauthtest.Sequence(traktdeviceauthtest.Unclaimed(), traktdeviceauthtest.Expire()), traktdeviceauth.StateExpired, traktdeviceauth.ErrDeviceCodeExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(tt.scenario)
+			flow, ticks := newTickFlow(t, srv)
+			done := waitInBackground(context.Background(), flow)
+
+			tick(t, ticks)
+			tick(t, ticks)
+			if r := receiveResult(t, done); !errors.Is(r.err, tt.wantErr) || flow.State() != tt.wantState {
+				t.Errorf("Wait returned %v in %s, want %v in %s", r.err, flow.State(), tt.wantErr, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestTickSourceIgnoresRetryAfter(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(30)), traktdeviceauthtest.Approve(traktdeviceauthtest.Token{})))
+	// The interval of newTickFlow would outlast the code once it grows, so this flow keeps the server's.
+	ticks := make(chan time.Time)
+	flow := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithTickSource(ticks))...)
+	if err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	done := waitInBackground(context.Background(), flow)
+
+	// Waiting out Retry-After is up to whoever sends the ticks.
+	tick(t, ticks)
+	waitForRequests(t, srv, traktdeviceauth.EndpointDeviceToken, 1)
+	if state := flow.State(); state != traktdeviceauth.StateSlowingDown {
+		t.Fatalf("the rate limited poll left the flow in %s", state)
+	}
+	tick(t, ticks)
+	if r := receiveResult(t, done); r.err != nil {
+		t.Fatalf("Wait returned %v, want the token", r.err)
+	}
+}
+
+func TestTickSourceClosed(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(5))
+	flow, ticks := newTickFlow(t, srv)
+	done := waitInBackground(context.Background(), flow)
+
+	tick(t, ticks)
+	close(ticks)
+	if r := receiveResult(t, done); !errors.Is(r.err, traktdeviceauth.ErrFlowCancelled) || flow.State() != traktdeviceauth.StateCancelled {
+		t.Errorf("Wait returned %v in %s after the ticks were closed, want ErrFlowCancelled in %s", r.err, flow.State(), traktdeviceauth.StateCancelled)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 1 {
+		t.Errorf("%d polls were made for 1 tick", n)
+	}
+}
+
+func TestTickSourceDeadlines(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ExpiresIn = 1
+	flow, ticks := newTickFlow(t, srv)
+
+	// A context which ends leaves the flow waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := waitInBackground(ctx, flow)
+	cancel()
+	if r := receiveResult(t, done); !errors.Is(r.err, context.Canceled) || flow.State() != traktdeviceauth.StateAwaitingApproval {
+		t.Fatalf("Wait returned %v in %s, want Canceled with the flow still waiting", r.err, flow.State())
+	}
+
+	// The code expires without any ticks, ending the flow without a poll.
+	done = waitInBackground(context.Background(), flow)
+	if r := receiveResult(t, done); !errors.Is(r.err, traktdeviceauth.ErrDeviceCodeExpired) || flow.State() != traktdeviceauth.StateExpired {
+		t.Errorf("Wait returned %v in %s, want the code to expire", r.err, flow.State())
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 0 {
+		t.Errorf("%d polls were made without ticks", n)
+	}
+	select {
+	case ticks <- time.Now():
+		t.Error("a tick was taken after the flow ended")
+	default:
+	}
+}
+
+func TestTickSourcePollForAuthToken(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+	code, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticks := make(chan time.Time)
+	done := make(chan error, 1)
+	go func() {
+		_, err := traktdeviceauth.PollForAuthTokenContext(context.Background(), code, "client-id", "client-secret",
+			append(srv.Options(), traktdeviceauth.WithPollInterval(time.Hour), traktdeviceauth.WithTickSource(ticks))...)
+		done <- err
+	}()
+	expectNoPoll(t, srv, 1)
+	tick(t, ticks)
+	tick(t, ticks)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("PollForAuthTokenContext returned %v, want the token", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PollForAuthTokenContext didn't return")
+	}
+}
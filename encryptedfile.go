@@ -0,0 +1,275 @@
+package traktdeviceauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrTokenDecryption is returned, wrapped with the reason, when an encrypted token file can't be decrypted,
+// because it was encrypted with another key or passphrase, it has been corrupted or truncated, or it isn't
+// encrypted at all.
+var ErrTokenDecryption error = errors.New("the token file can't be decrypted")
+
+// encryptedTokenMagic starts every encrypted token file, followed by the version of the envelope, such as v1,
+// the parameters of the key derivation in version 2, and the nonce and the ciphertext encoded in base64,
+// separated by spaces.
+const encryptedTokenMagic = "traktdeviceauth-encrypted-token"
+
+// encryptedTokenVersion is the newest version of the envelope which encryptingCodec understands. Files
+// encrypted with a key are version 1, and files encrypted with a passphrase are version 2.
+const encryptedTokenVersion = 2
+
+const (
+	// passphraseKDF names the key derivation of version 2 files, whose parameters are written as
+	// pbkdf2-sha256:<iterations>:<salt in base64>.
+	passphraseKDF = "pbkdf2-sha256"
+
+	// maxPassphraseIterations bounds the iterations read from a file, so that a corrupted count can't keep
+	// Load busy for hours.
+	maxPassphraseIterations = 10_000_000
+
+	// passphraseSaltSize is the size of the random salt of a new passphrase encrypted file.
+	passphraseSaltSize = 16
+)
+
+// passphraseIterations is the number of PBKDF2 iterations for new passphrase encrypted files, which tests
+// lower to stay fast.
+var passphraseIterations = 600_000
+
+// NewEncryptedFileTokenStore returns a FileTokenStore which encrypts the file at path with AES-256-GCM, using
+// key, which must be 32 random bytes, for servers which have no keyring but shouldn't keep refresh tokens on disk
+// in plain text. The token is a StoredToken like in an unencrypted file, so it is versioned the same way, and
+// opts work the same, with a WithFileCodec Codec encoding the token before it is encrypted.
+//
+// Loading a file which was encrypted with another key, or which has been corrupted, fails with an error
+// wrapping ErrTokenDecryption instead of returning a damaged token.
+func NewEncryptedFileTokenStore(path string, key []byte, opts ...FileOption) (*FileTokenStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("NewEncryptedFileTokenStore: %w", &ArgumentError{Name: "key", Reason: fmt.Sprintf("is %d bytes long instead of 32", len(key))})
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("NewEncryptedFileTokenStore: %w", err)
+	}
+	return newEncryptedFileTokenStore(path, encryptingCodec{aead: aead}, opts), nil
+}
+
+// NewPassphraseEncryptedFileTokenStore is like NewEncryptedFileTokenStore, but derives the key from passphrase
+// with PBKDF2-HMAC-SHA256 and a random salt, which are kept in the file, for people who would rather remember a
+// passphrase than keep a key somewhere. Deriving the key takes a noticeable fraction of a second on purpose, so
+// it is only done once per salt and store.
+//
+// Files encrypted with a key can't be loaded with a passphrase, and the other way around, which fails with an
+// error wrapping ErrTokenDecryption that says so.
+func NewPassphraseEncryptedFileTokenStore(path string, passphrase []byte, opts ...FileOption) (*FileTokenStore, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("NewPassphraseEncryptedFileTokenStore: %w", &ArgumentError{Name: "passphrase", Reason: "is empty"})
+	}
+	key := &passphraseKey{passphrase: append([]byte(nil), passphrase...)}
+	return newEncryptedFileTokenStore(path, encryptingCodec{key: key}, opts), nil
+}
+
+// newEncryptedFileTokenStore returns a FileTokenStore with codec, which encrypts what the Codec of opts encodes.
+func newEncryptedFileTokenStore(path string, codec encryptingCodec, opts []FileOption) *FileTokenStore {
+	var c fileConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	codec.inner = codecOrDefault(c.codec)
+	return NewFileTokenStore(path, append(opts[:len(opts):len(opts)], WithFileCodec(codec))...)
+}
+
+// newAEAD returns AES-256-GCM with key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptingCodec is the Codec of an encrypted token file, which encrypts what inner encodes with either aead,
+// for files encrypted with a key, or a key derived by key, for files encrypted with a passphrase.
+type encryptingCodec struct {
+	aead  cipher.AEAD
+	key   *passphraseKey
+	inner Codec
+}
+
+func (c encryptingCodec) Marshal(v interface{}) ([]byte, error) {
+	plain, err := c.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(plain)
+
+	header, aead := encryptedTokenMagic+" v1", c.aead
+	if c.key != nil {
+		if header, aead, err = c.key.sealing(); err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	payload := aead.Seal(nonce, nonce, plain, []byte(header))
+	return []byte(header + " " + base64.StdEncoding.EncodeToString(payload)), nil
+}
+
+func (c encryptingCodec) Unmarshal(data []byte, v interface{}) error {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || fields[0] != encryptedTokenMagic {
+		return fmt.Errorf("%w: it isn't an encrypted token file", ErrTokenDecryption)
+	}
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "v") {
+		return fmt.Errorf("%w: it is truncated or corrupted", ErrTokenDecryption)
+	}
+	version, err := strconv.Atoi(fields[1][1:])
+	if err != nil || version < 1 {
+		return fmt.Errorf("%w: it is truncated or corrupted", ErrTokenDecryption)
+	}
+	if version > encryptedTokenVersion {
+		return fmt.Errorf("the encrypted token file has version %d, which is newer than version %d: %w", version, encryptedTokenVersion, ErrUnsupportedFormatVersion)
+	}
+
+	// Everything before the payload is the header, which was authenticated along with the token.
+	last := len(fields) - 1
+	aead, err := c.opening(version, fields[2:last])
+	if err != nil {
+		return err
+	}
+	payload, err := base64.StdEncoding.DecodeString(fields[last])
+	if err != nil || len(payload) < aead.NonceSize()+aead.Overhead() {
+		return fmt.Errorf("%w: it is truncated or corrupted", ErrTokenDecryption)
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(strings.Join(fields[:last], " ")))
+	if err != nil {
+		if c.key != nil {
+			return fmt.Errorf("%w: it was encrypted with another passphrase, or has been corrupted", ErrTokenDecryption)
+		}
+		return fmt.Errorf("%w: it was encrypted with another key, or has been corrupted", ErrTokenDecryption)
+	}
+	defer wipeBytes(plain)
+	return c.inner.Unmarshal(plain, v)
+}
+
+// opening returns the AEAD which opens a file of the given version, whose header has params between the version
+// and the payload.
+func (c encryptingCodec) opening(version int, params []string) (cipher.AEAD, error) {
+	switch {
+	case version == 1 && len(params) == 0:
+		if c.key != nil {
+			return nil, fmt.Errorf("%w: it was encrypted with a key instead of a passphrase", ErrTokenDecryption)
+		}
+		return c.aead, nil
+	case version == 2 && len(params) == 1:
+		if c.key == nil {
+			return nil, fmt.Errorf("%w: it was encrypted with a passphrase instead of a key", ErrTokenDecryption)
+		}
+		salt, iterations, ok := parseKDFParams(params[0])
+		if !ok {
+			return nil, fmt.Errorf("%w: it is truncated or corrupted", ErrTokenDecryption)
+		}
+		return c.key.derive(salt, iterations)
+	}
+	return nil, fmt.Errorf("%w: it is truncated or corrupted", ErrTokenDecryption)
+}
+
+// parseKDFParams parses the key derivation parameters of a version 2 header.
+func parseKDFParams(s string) (salt []byte, iterations int, ok bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != passphraseKDF {
+		return nil, 0, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 || iterations > maxPassphraseIterations {
+		return nil, 0, false
+	}
+	salt, err = base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 {
+		return nil, 0, false
+	}
+	return salt, iterations, true
+}
+
+// passphraseKey derives the keys of files encrypted with a passphrase. It remembers the last key it derived, so
+// that saving a file which was just loaded reuses its salt instead of deriving a new key.
+type passphraseKey struct {
+	passphrase []byte
+
+	mu         sync.Mutex
+	salt       []byte
+	iterations int
+	aead       cipher.AEAD
+}
+
+// derive returns the AEAD for the key derived with salt and iterations.
+func (k *passphraseKey) derive(salt []byte, iterations int) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.aead != nil && k.iterations == iterations && hmac.Equal(k.salt, salt) {
+		return k.aead, nil
+	}
+	key := pbkdf2SHA256(k.passphrase, salt, iterations)
+	defer wipeBytes(key)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	k.salt, k.iterations, k.aead = append([]byte(nil), salt...), iterations, aead
+	return aead, nil
+}
+
+// sealing returns the header and the AEAD for saving a file, with the last key derived, or a new one with a
+// random salt.
+func (k *passphraseKey) sealing() (string, cipher.AEAD, error) {
+	k.mu.Lock()
+	salt, iterations := k.salt, k.iterations
+	k.mu.Unlock()
+
+	if salt == nil {
+		salt, iterations = make([]byte, passphraseSaltSize), passphraseIterations
+		if _, err := rand.Read(salt); err != nil {
+			return "", nil, err
+		}
+	}
+	aead, err := k.derive(salt, iterations)
+	if err != nil {
+		return "", nil, err
+	}
+	header := fmt.Sprintf("%s v2 %s:%d:%s", encryptedTokenMagic, passphraseKDF, iterations, base64.StdEncoding.EncodeToString(salt))
+	return header, aead, nil
+}
+
+// pbkdf2SHA256 derives a 32-byte key from passphrase and salt with PBKDF2-HMAC-SHA256 from RFC 8018, which
+// needs only the first block of its output.
+func pbkdf2SHA256(passphrase, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	wipeBytes(u)
+	return key
+}
@@ -0,0 +1,52 @@
+package traktdeviceauth
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func init() {
+	// Deriving keys with the real number of iterations would make every passphrase test take a fraction of a second.
+	passphraseIterations = 1000
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// The first 32 bytes of the PBKDF2-HMAC-SHA256 test vectors of RFC 7914, section 11.
+	tests := []struct {
+		passphrase, salt string
+		iterations       int
+		want             string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.passphrase), []byte(tt.salt), tt.iterations)); got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.passphrase, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestParseKDFParams(t *testing.T) {
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{"pbkdf2-sha256:1000:c2FsdA==", true},
+		{"pbkdf2-sha256:0:c2FsdA==", false},
+		{"pbkdf2-sha256:99999999999:c2FsdA==", false},
+		{"pbkdf2-sha256:1000:", false},
+		{"pbkdf2-sha256:1000:not base64!", false},
+		{"scrypt:1000:c2FsdA==", false},
+		{"pbkdf2-sha256:1000", false},
+	}
+	for _, tt := range tests {
+		salt, iterations, ok := parseKDFParams(tt.params)
+		if ok != tt.ok {
+			t.Errorf("parseKDFParams(%q) ok = %v, want %v", tt.params, ok, tt.ok)
+		}
+		if ok && (string(salt) != "salt" || iterations != 1000) {
+			t.Errorf("parseKDFParams(%q) = %q, %d", tt.params, salt, iterations)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package traktdeviceauth_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// encryptedStores opens an encrypted store at path for each way of encrypting it.
+var encryptedStores = []struct {
+	name string
+	open func(path string) (*traktdeviceauth.FileTokenStore, error)
+}{
+	{"key", func(path string) (*traktdeviceauth.FileTokenStore, error) {
+		return traktdeviceauth.NewEncryptedFileTokenStore(path, testKey)
+	}},
+	{"passphrase", func(path string) (*traktdeviceauth.FileTokenStore, error) {
+		return traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte("correct horse battery staple"))
+	}},
+}
+
+func testToken() traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  "access-token-0123456789",
+		RefreshToken: "refresh-token-0123456789",
+		TokenType:    "bearer",
+		ExpiresAt:    time.Now().Add(24 * time.Hour).Truncate(time.Second),
+	}
+}
+
+// saveEncrypted saves testToken with a new store opened by open, returning the path of the file.
+func saveEncrypted(t *testing.T, open func(string) (*traktdeviceauth.FileTokenStore, error)) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.Background(), testToken()); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptedFileTokenStoreRoundTrip(t *testing.T) {
+	for _, tt := range encryptedStores {
+		t.Run(tt.name, func(t *testing.T) {
+			path := saveEncrypted(t, tt.open)
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte("access-token")) || bytes.Contains(b, []byte("refresh-token")) {
+				t.Fatalf("the file holds the token in plain text: %s", b)
+			}
+			if _, err := traktdeviceauth.LoadTokenFromFile(path); err == nil || !strings.Contains(err.Error(), "is encrypted") {
+				t.Errorf("LoadTokenFromFile returned %v, want an error saying the file is encrypted", err)
+			}
+
+			// A new store has to derive the key again instead of using one remembered from saving.
+			store, err := tt.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Load(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testToken()
+			if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || !got.ExpiresAt.Equal(want.ExpiresAt) {
+				t.Errorf("loaded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestEncryptedFileTokenStoreWrongSecret(t *testing.T) {
+	ctx := context.Background()
+
+	path := saveEncrypted(t, encryptedStores[0].open)
+	otherKey, _ := traktdeviceauth.NewEncryptedFileTokenStore(path, bytes.Repeat([]byte{1}, 32))
+	if _, err := otherKey.Load(ctx); !errors.Is(err, traktdeviceauth.ErrTokenDecryption) {
+		t.Errorf("loading with another key returned %v, want ErrTokenDecryption", err)
+	}
+
+	path = saveEncrypted(t, encryptedStores[1].open)
+	otherPassphrase, _ := traktdeviceauth.NewPassphraseEncryptedFileTokenStore(path, []byte("wrong"))
+	if _, err := otherPassphrase.Load(ctx); !errors.Is(err, traktdeviceauth.ErrTokenDecryption) {
+		t.Errorf("loading with another passphrase returned %v, want ErrTokenDecryption", err)
+	}
+}
+
+func TestEncryptedFileTokenStoreKindMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	path := saveEncrypted(t, encryptedStores[0].open)
+	store, _ := encryptedStores[1].open(path)
+	if _, err := store.Load(ctx); !errors.Is(err, traktdeviceauth.ErrTokenDecryption) || !strings.Contains(err.Error(), "with a key instead of a passphrase") {
+		t.Errorf("loading a key encrypted file with a passphrase returned %v", err)
+	}
+
+	path = saveEncrypted(t, encryptedStores[1].open)
+	store, _ = encryptedStores[0].open(path)
+	if _, err := store.Load(ctx); !errors.Is(err, traktdeviceauth.ErrTokenDecryption) || !strings.Contains(err.Error(), "with a passphrase instead of a key") {
+		t.Errorf("loading a passphrase encrypted file with a key returned %v", err)
+	}
+}
+
+func TestEncryptedFileTokenStoreCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		want    error
+	}{
+		{"truncated", func(b []byte) []byte { return b[:len(b)-10] }, traktdeviceauth.ErrTokenDecryption},
+		{"header only", func(b []byte) []byte { return b[:bytes.LastIndexByte(b, ' ')] }, traktdeviceauth.ErrTokenDecryption},
+		{"flipped payload", func(b []byte) []byte {
+			i := bytes.LastIndexByte(b, ' ') + 5
+			if b[i] == 'A' {
+				b[i] = 'B'
+			} else {
+				b[i] = 'A'
+			}
+			return b
+		}, traktdeviceauth.ErrTokenDecryption},
+		{"changed version", func(b []byte) []byte { return bytes.Replace(b, []byte(" v"), []byte(" v0"), 1) }, traktdeviceauth.ErrTokenDecryption},
+		{"newer version", func(b []byte) []byte { return bytes.Replace(b, []byte(" v"), []byte(" v9"), 1) }, traktdeviceauth.ErrUnsupportedFormatVersion},
+		{"not encrypted", func([]byte) []byte { return []byte(`{"access_token":"a"}`) }, traktdeviceauth.ErrTokenDecryption},
+	}
+	for _, store := range encryptedStores {
+		for _, tt := range tests {
+			t.Run(store.name+"/"+tt.name, func(t *testing.T) {
+				path := saveEncrypted(t, store.open)
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, tt.corrupt(b), 0o600); err != nil {
+					t.Fatal(err)
+				}
+
+				s, _ := store.open(path)
+				if _, err := s.Load(context.Background()); !errors.Is(err, tt.want) {
+					t.Errorf("Load returned %v, want %v", err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestPassphraseEncryptedFileTokenStoreSalt(t *testing.T) {
+	// The header, with the salt, is authenticated, so changing the salt must fail like a wrong passphrase.
+	path := saveEncrypted(t, encryptedStores[1].open)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 4 || !strings.HasPrefix(fields[2], "pbkdf2-sha256:") {
+		t.Fatalf("the header is %q, want the key derivation parameters", fields[:len(fields)-1])
+	}
+
+	store, _ := encryptedStores[1].open(path)
+	if _, err := store.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.Background(), testToken()); err != nil {
+		t.Fatal(err)
+	}
+	resaved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(resaved)); got[2] != fields[2] || got[3] == fields[3] {
+		t.Errorf("saving again changed the parameters to %q or kept the payload, want the same salt with a new nonce", got[2])
+	}
+
+	salted := strings.Replace(string(b), fields[2], "pbkdf2-sha256:1000:c2FsdHNhbHRzYWx0c2FsdA==", 1)
+	if err := os.WriteFile(path, []byte(salted), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = encryptedStores[1].open(path)
+	if _, err := store.Load(context.Background()); !errors.Is(err, traktdeviceauth.ErrTokenDecryption) {
+		t.Errorf("Load with another salt returned %v, want ErrTokenDecryption", err)
+	}
+}
+
+func TestEncryptedFileTokenStoreArguments(t *testing.T) {
+	var argErr *traktdeviceauth.ArgumentError
+	if _, err := traktdeviceauth.NewEncryptedFileTokenStore("token.enc", []byte("short")); !errors.As(err, &argErr) || argErr.Name != "key" {
+		t.Errorf("a short key returned %v, want an ArgumentError for the key", err)
+	}
+	if _, err := traktdeviceauth.NewPassphraseEncryptedFileTokenStore("token.enc", nil); !errors.As(err, &argErr) || argErr.Name != "passphrase" {
+		t.Errorf("an empty passphrase returned %v, want an ArgumentError for the passphrase", err)
+	}
+}
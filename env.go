@@ -0,0 +1,118 @@
+package traktdeviceauth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The environment variables read by ConfigFromEnv. Variables which are unset or empty are ignored, and so is
+// every other variable starting with TRAKT_.
+const (
+	// EnvBaseURL sets the base url like WithBaseURL. It has to pass CheckBaseURL.
+	EnvBaseURL = "TRAKT_API_BASE_URL"
+
+	// EnvAPIVersion sets the Trakt-API-Version header, a positive integer, instead of 2.
+	EnvAPIVersion = "TRAKT_API_VERSION"
+
+	// EnvHTTPTimeout limits every call like WithCallTimeout. It is a duration such as 30s, or a whole number
+	// of seconds.
+	EnvHTTPTimeout = "TRAKT_HTTP_TIMEOUT"
+
+	// EnvUserAgent sets the User-Agent header of every request.
+	EnvUserAgent = "TRAKT_USER_AGENT"
+
+	// EnvDebug, if true, writes a line to stderr for every request, with its method, url, status and duration.
+	// It accepts the values of strconv.ParseBool. Request and response bodies, which hold secrets, are never
+	// written.
+	EnvDebug = "TRAKT_DEBUG"
+)
+
+// ConfigFromEnv returns the Options configured by the environment variables EnvBaseURL, EnvAPIVersion,
+// EnvHTTPTimeout, EnvUserAgent and EnvDebug, for programs such as serverless functions which are configured
+// through their environment. An invalid value is reported as an *ArgumentError naming the variable, or as an
+// error wrapping ErrInsecureBaseURL for a base url which isn't https.
+//
+// Options are applied in order, so where the environment and the program set the same value, whichever
+// comes last wins. Put the Options from ConfigFromEnv first to let the program override the environment:
+//
+//	envOpts, err := traktdeviceauth.ConfigFromEnv()
+//	if err != nil {
+//		return err
+//	}
+//	opts := append(envOpts, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.DefaultRetryPolicy))
+func ConfigFromEnv() ([]Option, error) {
+	var opts []Option
+
+	if v := os.Getenv(EnvBaseURL); v != "" {
+		if _, err := (config{apiBaseURL: v}).checkedBaseURL(); err != nil {
+			var argErr *ArgumentError
+			if errors.As(err, &argErr) {
+				err = &ArgumentError{Name: EnvBaseURL, Reason: argErr.Reason}
+			} else {
+				err = fmt.Errorf("%s: %w", EnvBaseURL, err)
+			}
+			return nil, fmt.Errorf("ConfigFromEnv: %w", err)
+		}
+		opts = append(opts, WithBaseURL(v))
+	}
+
+	if v := os.Getenv(EnvAPIVersion); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return nil, fmt.Errorf("ConfigFromEnv: %w", &ArgumentError{Name: EnvAPIVersion, Reason: fmt.Sprintf("%q isn't a positive integer", v)})
+		}
+		opts = append(opts, WithCallHeader("Trakt-API-Version", v))
+	}
+
+	if v := os.Getenv(EnvHTTPTimeout); v != "" {
+		d, err := time.ParseDuration(v)
+		if n, nErr := strconv.Atoi(v); err != nil && nErr == nil {
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("ConfigFromEnv: %w", &ArgumentError{Name: EnvHTTPTimeout, Reason: fmt.Sprintf("%q isn't a positive duration, such as 30s, or number of seconds", v)})
+		}
+		opts = append(opts, WithCallTimeout(d))
+	}
+
+	if v := os.Getenv(EnvUserAgent); v != "" {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("ConfigFromEnv: %w", &ArgumentError{Name: EnvUserAgent, Reason: "contains a line break"})
+		}
+		opts = append(opts, WithCallHeader("User-Agent", v))
+	}
+
+	if v := os.Getenv(EnvDebug); v != "" {
+		debug, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("ConfigFromEnv: %w", &ArgumentError{Name: EnvDebug, Reason: fmt.Sprintf("%q isn't a boolean such as true or 0", v)})
+		}
+		if debug {
+			opts = append(opts, WithMiddleware(debugLog(os.Stderr)))
+		}
+	}
+
+	return opts, nil
+}
+
+// debugLog returns a Middleware which writes a line describing every request to w.
+func debugLog(w io.Writer) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+			elapsed := time.Since(start).Round(time.Millisecond)
+			if err != nil {
+				fmt.Fprintf(w, "traktdeviceauth: %s %s failed after %s: %v\n", req.Method, req.URL.Redacted(), elapsed, err)
+			} else {
+				fmt.Fprintf(w, "traktdeviceauth: %s %s %s in %s\n", req.Method, req.URL.Redacted(), resp.Status, elapsed)
+			}
+			return resp, err
+		}
+	}
+}
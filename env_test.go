@@ -0,0 +1,220 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// envVars are the variables read by ConfigFromEnv.
+var envVars = []string{
+	traktdeviceauth.EnvBaseURL,
+	traktdeviceauth.EnvAPIVersion,
+	traktdeviceauth.EnvHTTPTimeout,
+	traktdeviceauth.EnvUserAgent,
+	traktdeviceauth.EnvDebug,
+}
+
+// setEnv clears the variables read by ConfigFromEnv for the duration of the test, and then sets env.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	for _, name := range envVars {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name           string
+		env            map[string]string
+		wantAPIVersion string
+		wantUserAgent  string
+	}{
+		{"empty", nil, "2", ""},
+		{"partial", map[string]string{traktdeviceauth.EnvUserAgent: "my-function/1.0"}, "2", "my-function/1.0"},
+		{"full", map[string]string{
+			traktdeviceauth.EnvAPIVersion:  "3",
+			traktdeviceauth.EnvHTTPTimeout: "30s",
+			traktdeviceauth.EnvUserAgent:   "my-function/1.0",
+			traktdeviceauth.EnvDebug:       "false",
+		}, "3", "my-function/1.0"},
+		{"timeout in seconds", map[string]string{traktdeviceauth.EnvHTTPTimeout: "30"}, "2", ""},
+		{"unknown variables", map[string]string{"TRAKT_CLIENT_ID": "ignored", "TRAKT_SOMETHING_ELSE": "???"}, "2", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			opts, err := traktdeviceauth.ConfigFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := len(srv.Requests())
+			if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(srv.Options(), opts...)...); err != nil {
+				t.Fatal(err)
+			}
+			req := srv.Requests()[before]
+			if got := req.Header.Get("Trakt-API-Version"); got != tt.wantAPIVersion {
+				t.Errorf("Trakt-API-Version = %q, want %q", got, tt.wantAPIVersion)
+			}
+			if got := req.Header.Get("User-Agent"); tt.wantUserAgent != "" && got != tt.wantUserAgent {
+				t.Errorf("User-Agent = %q, want %q", got, tt.wantUserAgent)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvBaseURL(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	setEnv(t, map[string]string{traktdeviceauth.EnvBaseURL: srv.URL})
+
+	opts, err := traktdeviceauth.ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The base url comes from the environment alone.
+	if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("%d requests reached the server named by %s, want 1", n, traktdeviceauth.EnvBaseURL)
+	}
+}
+
+func TestConfigFromEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantName string
+		wantErr  error
+	}{
+		{"relative base url", map[string]string{traktdeviceauth.EnvBaseURL: "/trakt"}, traktdeviceauth.EnvBaseURL, traktdeviceauth.ErrInvalidArgument},
+		{"insecure base url", map[string]string{traktdeviceauth.EnvBaseURL: "http://api.trakt.example"}, "", traktdeviceauth.ErrInsecureBaseURL},
+		{"api version not a number", map[string]string{traktdeviceauth.EnvAPIVersion: "v2"}, traktdeviceauth.EnvAPIVersion, traktdeviceauth.ErrInvalidArgument},
+		{"api version zero", map[string]string{traktdeviceauth.EnvAPIVersion: "0"}, traktdeviceauth.EnvAPIVersion, traktdeviceauth.ErrInvalidArgument},
+		{"timeout without a unit", map[string]string{traktdeviceauth.EnvHTTPTimeout: "1.5"}, traktdeviceauth.EnvHTTPTimeout, traktdeviceauth.ErrInvalidArgument},
+		{"negative timeout", map[string]string{traktdeviceauth.EnvHTTPTimeout: "-5s"}, traktdeviceauth.EnvHTTPTimeout, traktdeviceauth.ErrInvalidArgument},
+		{"user agent with a line break", map[string]string{traktdeviceauth.EnvUserAgent: "agent\r\nX-Injected: 1"}, traktdeviceauth.EnvUserAgent, traktdeviceauth.ErrInvalidArgument},
+		{"debug not a boolean", map[string]string{traktdeviceauth.EnvDebug: "verbose"}, traktdeviceauth.EnvDebug, traktdeviceauth.ErrInvalidArgument},
+		// A valid variable doesn't hide an invalid one.
+		{"valid and invalid", map[string]string{traktdeviceauth.EnvUserAgent: "ok", traktdeviceauth.EnvDebug: "maybe"}, traktdeviceauth.EnvDebug, traktdeviceauth.ErrInvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			opts, err := traktdeviceauth.ConfigFromEnv()
+			if !errors.Is(err, tt.wantErr) || opts != nil {
+				t.Fatalf("ConfigFromEnv returned %d Options and %v, want %v", len(opts), err, tt.wantErr)
+			}
+			var argErr *traktdeviceauth.ArgumentError
+			if tt.wantName != "" && (!errors.As(err, &argErr) || argErr.Name != tt.wantName) {
+				t.Errorf("the error %v doesn't name %s", err, tt.wantName)
+			}
+			if tt.wantName == "" && !strings.Contains(err.Error(), traktdeviceauth.EnvBaseURL) {
+				t.Errorf("the error %v doesn't name %s", err, traktdeviceauth.EnvBaseURL)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvPrecedence(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	setEnv(t, map[string]string{traktdeviceauth.EnvUserAgent: "from-env"})
+	envOpts, err := traktdeviceauth.ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whichever Option comes last wins.
+	tests := []struct {
+		name string
+		opts []traktdeviceauth.Option
+		want string
+	}{
+		{"program after the environment", append(append(srv.Options(), envOpts...), traktdeviceauth.WithCallHeader("User-Agent", "from-program")), "from-program"},
+		{"environment after the program", append(append(srv.Options(), traktdeviceauth.WithCallHeader("User-Agent", "from-program")), envOpts...), "from-env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(srv.Requests())
+			if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.Requests()[before].Header.Get("User-Agent"); got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvTimeout(t *testing.T) {
+	setEnv(t, map[string]string{traktdeviceauth.EnvHTTPTimeout: "100ms"})
+	opts, err := traktdeviceauth.ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hang := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+	}
+	start := time.Now()
+	_, err = traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(opts, traktdeviceauth.WithMiddleware(hang))...)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("a hanging call returned %v after %v, want DeadlineExceeded after 100ms", err, time.Since(start))
+	}
+}
+
+func TestConfigFromEnvDebug(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	setEnv(t, map[string]string{traktdeviceauth.EnvDebug: "1"})
+
+	// The debug lines go to stderr, which is replaced by a file for the duration of the test.
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	defer func(f *os.File) { os.Stderr = f }(os.Stderr)
+	os.Stderr = stderr
+
+	opts, err := traktdeviceauth.ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(srv.Options(), opts...)...); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "traktdeviceauth: POST " + srv.URL + traktdeviceauth.EndpointDeviceCode.String() + " 200 OK in "
+	if !strings.HasPrefix(string(b), want) || strings.Count(string(b), "\n") != 1 {
+		t.Errorf("stderr holds %q, want a single line starting with %q", b, want)
+	}
+	if strings.Contains(string(b), "client-id") {
+		t.Errorf("the debug line holds the request body: %q", b)
+	}
+}
@@ -0,0 +1,146 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrorRateThreshold decides when the failures seen by an ErrorRateTracker are too many. It is exceeded when
+// either of its limits is reached. A zero limit is disabled.
+type ErrorRateThreshold struct {
+	// Failures is exceeded once at least this many attempts within the window failed.
+	Failures int
+
+	// Ratio is exceeded once at least this fraction of the attempts within the window failed, such as 0.5.
+	Ratio float64
+
+	// MinAttempts is how many attempts the window must hold before Ratio applies, so that a single failure
+	// after a quiet period doesn't count as a failure rate of 100%.
+	MinAttempts int
+}
+
+// ErrorRateStats describes the requests seen by an ErrorRateTracker within its window.
+type ErrorRateStats struct {
+	Window   time.Duration
+	Attempts int            // Every request made, including retries.
+	Failures int            // The attempts which failed.
+	ByCode   map[string]int // The failures by their Code, such as CodeNetwork or CodeInvalidGrant.
+}
+
+// ErrorRateTracker counts failed requests within a sliding window and calls a function when there are too many,
+// so that a long-running program which keeps failing to refresh tokens doesn't go unnoticed. It sees every
+// request made with WithErrorRateTracker, including those retried because of WithCallRetryPolicy,
+// and is safe for concurrent use, so one tracker is meant to be shared by all of a program's calls, such as
+// through WithRefreshOptions.
+//
+// Answers which are part of a normal device flow, such as a code which hasn't been entered yet or was denied,
+// don't count as failures, and cancelled requests aren't counted at all.
+type ErrorRateTracker struct {
+	window     time.Duration
+	threshold  ErrorRateThreshold
+	onExceeded func(stats ErrorRateStats)
+	now        func() time.Time
+
+	mu       sync.Mutex
+	attempts []trackedAttempt
+	breached bool
+}
+
+// trackedAttempt is a request seen by an ErrorRateTracker. code is empty if it succeeded.
+type trackedAttempt struct {
+	at   time.Time
+	code string
+}
+
+// NewErrorRateTracker returns an ErrorRateTracker which calls onExceeded, with the stats of the window, when the
+// requests within the last window exceed threshold. onExceeded is called once when the threshold is first
+// exceeded, and not again until the failures have dropped below it and then exceeded it again. It is called
+// from the goroutine which made the request, which is held up until it returns.
+func NewErrorRateTracker(window time.Duration, threshold ErrorRateThreshold, onExceeded func(stats ErrorRateStats)) *ErrorRateTracker {
+	return &ErrorRateTracker{window: window, threshold: threshold, onExceeded: onExceeded, now: time.Now}
+}
+
+// WithErrorRateTracker records every request in tracker.
+func WithErrorRateTracker(tracker *ErrorRateTracker) Option {
+	return func(c *config) {
+		c.errorRate = tracker
+	}
+}
+
+// Stats returns the stats of the requests within the current window.
+func (t *ErrorRateTracker) Stats() ErrorRateStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+	return t.stats()
+}
+
+// record adds a request which returned err. It returns the stats to call onExceeded with, and whether to call
+// it at all.
+func (t *ErrorRateTracker) record(err error) (ErrorRateStats, bool) {
+	if errors.Is(err, context.Canceled) {
+		return ErrorRateStats{}, false
+	}
+	code := ""
+	if err != nil && !errors.Is(err, ErrDeviceCodeUnclaimed) && !errors.Is(err, ErrDeviceCodeDenied) &&
+		!errors.Is(err, ErrDeviceCodeExpired) {
+		code = Code(err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts = append(t.attempts, trackedAttempt{at: t.now(), code: code})
+	t.prune()
+	stats := t.stats()
+
+	exceeded := t.exceeded(stats)
+	fire := exceeded && !t.breached && t.onExceeded != nil
+	t.breached = exceeded
+	return stats, fire
+}
+
+// prune drops the attempts which have left the window. t.mu must be held.
+func (t *ErrorRateTracker) prune() {
+	cutoff := t.now().Add(-t.window)
+	i := 0
+	for i < len(t.attempts) && !t.attempts[i].at.After(cutoff) {
+		i++
+	}
+	t.attempts = append(t.attempts[:0], t.attempts[i:]...)
+}
+
+// stats counts the attempts within the window. t.mu must be held.
+func (t *ErrorRateTracker) stats() ErrorRateStats {
+	stats := ErrorRateStats{Window: t.window, Attempts: len(t.attempts), ByCode: make(map[string]int)}
+	for _, a := range t.attempts {
+		if a.code != "" {
+			stats.Failures++
+			stats.ByCode[a.code]++
+		}
+	}
+	return stats
+}
+
+// exceeded reports whether stats exceed the threshold.
+func (t *ErrorRateTracker) exceeded(stats ErrorRateStats) bool {
+	th := t.threshold
+	if th.Failures > 0 && stats.Failures >= th.Failures {
+		return true
+	}
+	return th.Ratio > 0 && stats.Attempts > 0 && stats.Attempts >= th.MinAttempts &&
+		float64(stats.Failures)/float64(stats.Attempts) >= th.Ratio
+}
+
+// recordAttempt passes the outcome of a request to the WithErrorRateTracker tracker, if any.
+func (c config) recordAttempt(err error) {
+	if c.errorRate == nil {
+		return
+	}
+	if stats, fire := c.errorRate.record(err); fire {
+		c.observe("WithErrorRateTracker", func() { c.errorRate.onExceeded(stats) })
+	}
+}
@@ -0,0 +1,225 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// outage is a Middleware which answers every request with status instead of passing it on, while status isn't 0.
+type outage struct {
+	mu     sync.Mutex
+	status int
+}
+
+func (o *outage) set(status int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status = status
+}
+
+func (o *outage) middleware(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		o.mu.Lock()
+		status := o.status
+		o.mu.Unlock()
+		if status == 0 {
+			return next(req)
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader("{}")),
+			Request:    req,
+		}, nil
+	}
+}
+
+// newErrorRateTracker returns a tracker on a fake clock which sends the stats it fires with to the returned
+// channel, and the options to make requests to srv with it through an outage.
+func newErrorRateTracker(srv *traktdeviceauthtest.Server, window time.Duration, threshold traktdeviceauth.ErrorRateThreshold) (*traktdeviceauth.ErrorRateTracker, *fakeClock, *outage, <-chan traktdeviceauth.ErrorRateStats, []traktdeviceauth.Option) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	fired := make(chan traktdeviceauth.ErrorRateStats, 10)
+	tracker := traktdeviceauth.NewErrorRateTracker(window, threshold, func(stats traktdeviceauth.ErrorRateStats) {
+		fired <- stats
+	})
+	traktdeviceauth.SetErrorRateTrackerClock(tracker, clock.Now)
+
+	o := &outage{}
+	opts := append(srv.Options(), traktdeviceauth.WithErrorRateTracker(tracker), traktdeviceauth.WithMiddleware(o.middleware))
+	return tracker, clock, o, fired, opts
+}
+
+// expectFired checks whether the tracker fired since the last check, and with want if it did.
+func expectFired(t *testing.T, fired <-chan traktdeviceauth.ErrorRateStats, step string, want *traktdeviceauth.ErrorRateStats) {
+	t.Helper()
+
+	select {
+	case got := <-fired:
+		if want == nil {
+			t.Errorf("%s: the tracker fired with %+v, want it quiet", step, got)
+		} else if !reflect.DeepEqual(got, *want) {
+			t.Errorf("%s: the tracker fired with %+v, want %+v", step, got, *want)
+		}
+	default:
+		if want != nil {
+			t.Errorf("%s: the tracker didn't fire, want it to with %+v", step, *want)
+		}
+	}
+}
+
+func TestErrorRateTrackerWindow(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	tracker, clock, o, fired, opts := newErrorRateTracker(srv, time.Hour, traktdeviceauth.ErrorRateThreshold{Failures: 3})
+	cl := traktdeviceauth.NewClient("client-id", "secret", opts...)
+	refreshToken := srv.IssueToken().RefreshToken
+
+	// refreshAt makes a refresh at the given time since the start, answered with status, or normally if it is 0.
+	start := clock.Now()
+	refreshAt := func(since time.Duration, status int) {
+		t.Helper()
+		clock.Advance(start.Add(since).Sub(clock.Now()))
+		o.set(status)
+		_, err := cl.RefreshAccessToken(context.Background(), refreshToken)
+		if status == 0 && err != nil {
+			t.Fatalf("the refresh at %v failed: %v", since, err)
+		} else if status != 0 && err == nil {
+			t.Fatalf("the refresh at %v answered with %d succeeded", since, status)
+		}
+	}
+
+	refreshAt(0, http.StatusInternalServerError)
+	refreshAt(20*time.Minute, http.StatusUnauthorized)
+	expectFired(t, fired, "two failures", nil)
+
+	refreshAt(40*time.Minute, http.StatusInternalServerError)
+	expectFired(t, fired, "the third failure", &traktdeviceauth.ErrorRateStats{
+		Window:   time.Hour,
+		Attempts: 3,
+		Failures: 3,
+		ByCode:   map[string]int{traktdeviceauth.CodeServerError: 2, traktdeviceauth.CodeInvalidGrant: 1},
+	})
+
+	// The breach goes on, so the tracker stays quiet.
+	refreshAt(50*time.Minute, http.StatusInternalServerError)
+	expectFired(t, fired, "the fourth failure", nil)
+
+	// The first failure leaves the window exactly an hour later, but three are still within it.
+	refreshAt(time.Hour, 0)
+	expectFired(t, fired, "the first failure leaving the window", nil)
+	if stats := tracker.Stats(); stats.Attempts != 4 || stats.Failures != 3 {
+		t.Errorf("Stats returned %+v after the first failure left the window, want 4 attempts and 3 failures", stats)
+	}
+
+	// Once the second one has left too, the failures are below the threshold and the tracker re-arms.
+	refreshAt(time.Hour+25*time.Minute, 0)
+	expectFired(t, fired, "the second failure leaving the window", nil)
+
+	refreshAt(time.Hour+26*time.Minute, http.StatusServiceUnavailable)
+	expectFired(t, fired, "a failure after recovering", &traktdeviceauth.ErrorRateStats{
+		Window:   time.Hour,
+		Attempts: 5,
+		Failures: 3,
+		ByCode:   map[string]int{traktdeviceauth.CodeServerError: 2, traktdeviceauth.CodeServiceOverloaded: 1},
+	})
+}
+
+func TestErrorRateTrackerRatio(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	_, clock, o, fired, opts := newErrorRateTracker(srv, time.Hour, traktdeviceauth.ErrorRateThreshold{Ratio: 0.5, MinAttempts: 4})
+	cl := traktdeviceauth.NewClient("client-id", "secret", opts...)
+	refreshToken := srv.IssueToken().RefreshToken
+
+	for i, status := range []int{http.StatusInternalServerError, 0, http.StatusInternalServerError} {
+		clock.Advance(time.Minute)
+		o.set(status)
+		cl.RefreshAccessToken(context.Background(), refreshToken)
+		expectFired(t, fired, fmt.Sprintf("attempt %d", i+1), nil)
+	}
+
+	// Two failures out of three are above the ratio, but too few attempts to judge until the fourth.
+	clock.Advance(time.Minute)
+	o.set(0)
+	if _, err := cl.RefreshAccessToken(context.Background(), refreshToken); err != nil {
+		t.Fatal(err)
+	}
+	expectFired(t, fired, "attempt 4", &traktdeviceauth.ErrorRateStats{
+		Window:   time.Hour,
+		Attempts: 4,
+		Failures: 2,
+		ByCode:   map[string]int{traktdeviceauth.CodeServerError: 2},
+	})
+
+	// Successes bring the ratio down and re-arm the tracker, after which it fires again.
+	for i := 0; i < 2; i++ {
+		cl.RefreshAccessToken(context.Background(), refreshToken)
+	}
+	o.set(http.StatusInternalServerError)
+	for i := 0; i < 2; i++ {
+		cl.RefreshAccessToken(context.Background(), refreshToken)
+	}
+	expectFired(t, fired, "the second breach", &traktdeviceauth.ErrorRateStats{
+		Window:   time.Hour,
+		Attempts: 8,
+		Failures: 4,
+		ByCode:   map[string]int{traktdeviceauth.CodeServerError: 4},
+	})
+	expectFired(t, fired, "after the second breach", nil)
+}
+
+func TestErrorRateTrackerRetries(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	tracker, _, o, fired, opts := newErrorRateTracker(srv, time.Hour, traktdeviceauth.ErrorRateThreshold{Failures: 3})
+	o.set(http.StatusInternalServerError)
+
+	// A single call retried twice makes three failed attempts, each of which counts.
+	opts = append(opts, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	if _, err := traktdeviceauth.NewClient("client-id", "secret", opts...).RefreshAccessToken(context.Background(), "refresh"); err == nil {
+		t.Fatal("the refresh succeeded during an outage")
+	}
+	want := traktdeviceauth.ErrorRateStats{Window: time.Hour, Attempts: 3, Failures: 3, ByCode: map[string]int{traktdeviceauth.CodeServerError: 3}}
+	expectFired(t, fired, "a retried call", &want)
+	if got := tracker.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats returned %+v, want %+v", got, want)
+	}
+}
+
+func TestErrorRateTrackerIgnoresFlowAnswers(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.DenyAfterPolls(2))
+	tracker, _, _, fired, opts := newErrorRateTracker(srv, time.Hour, traktdeviceauth.ErrorRateThreshold{Failures: 1})
+	cl := traktdeviceauth.NewClient("client-id", "secret", opts...)
+
+	// Unentered and denied codes are answers the flow expects, not failures.
+	code, err := cl.GenerateNewCode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.PollForAuthToken(context.Background(), code); err == nil {
+		t.Fatal("polling a denied code succeeded")
+	}
+	// Cancelled requests aren't counted at all.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cl.GenerateNewCode(ctx); err == nil {
+		t.Fatal("GenerateNewCode with a cancelled context succeeded")
+	}
+
+	expectFired(t, fired, "a denied flow", nil)
+	if stats := tracker.Stats(); stats.Attempts != 4 || stats.Failures != 0 || len(stats.ByCode) != 0 {
+		t.Errorf("Stats returned %+v, want 4 attempts and no failures", stats)
+	}
+}
@@ -0,0 +1,245 @@
+package traktdeviceauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invalidGrantText is moved out of the var block to make the line lengths somewhat sane.
+const invalidGrantText string = "the provided authorization grant is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client"
+
+var (
+	ErrDeviceCodeUnclaimed       error = errors.New("the user has not yet claimed the device code")                            // 400
+	ErrInvalidGrant              error = errors.New(invalidGrantText)                                                          // 401
+	ErrInvalidAccessToken        error = errors.New("the access token is invalid, expired, or revoked")                        // 401
+	ErrInvalidDeviceCode         error = errors.New("invalid device code")                                                     // 404
+	ErrForbidden                 error = errors.New("invalid API key or unapproved application")                               // 403
+	ErrDeviceCodeAlreadyApproved error = errors.New("device code has already been approved")                                   // 409
+	ErrDeviceCodeExpired         error = errors.New("the device code has expired, please regenerate a new one")                // 410
+	ErrDeviceCodeDenied          error = errors.New("the device code was denied by the user")                                  // 418
+	ErrPollRateTooFast           error = errors.New("the API is being polled too quickly")                                     // 429
+	ErrServerError               error = errors.New("the Trakt API is reporting an internal problem, please check back later") // 500
+	ErrServiceOverloaded         error = errors.New("the servers are overloaded, please try again in 30 seconds")              // 503, 504
+	ErrCloudflareError           error = errors.New("there is an issue with Cloudflare")                                       // 520, 521, 522
+	ErrUnexpectedStatusCode      error = errors.New("unexpected status code")                                                  // Anything else
+)
+
+// StatusError is returned when Trakt responds with a status code which isn't a success. It wraps the error
+// StatusToError maps the status to, so errors.Is keeps working, and records the exact status for callers
+// which need it. Rate limiting is reported with RateLimitError instead.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error StatusToError mapped Status to.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitError is returned when Trakt responds with 429 Too Many Requests. It wraps ErrPollRateTooFast,
+// so errors.Is keeps working, and can be retrieved with errors.As to find out how long to wait.
+type RateLimitError struct {
+	// RetryAfter is how long the server asked to wait before the next request, parsed from the Retry-After
+	// header. It is zero if the header was missing or invalid.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v, retry after %v", ErrPollRateTooFast, e.RetryAfter)
+	}
+	return ErrPollRateTooFast.Error()
+}
+
+// Unwrap returns ErrPollRateTooFast.
+func (e *RateLimitError) Unwrap() error {
+	return ErrPollRateTooFast
+}
+
+// BackoffError is returned by the poll loop when Trakt rate limits it with a wait which would end after the
+// device code expires, so that no further poll could succeed. It wraps ErrDeviceCodeExpired, since a new code
+// has to be generated, and also matches ErrPollRateTooFast with errors.Is.
+type BackoffError struct {
+	// Wait is how long the next poll would have had to wait: the Retry-After header or the grown polling
+	// interval, whichever is longer.
+	Wait time.Duration
+
+	// Remaining is how long the device code had left when the poll was rate limited.
+	Remaining time.Duration
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("%v, and the next poll would be due in %v, but the code expires in %v: %v",
+		ErrPollRateTooFast, e.Wait, e.Remaining.Round(time.Second), ErrDeviceCodeExpired)
+}
+
+// Unwrap returns ErrDeviceCodeExpired.
+func (e *BackoffError) Unwrap() error {
+	return ErrDeviceCodeExpired
+}
+
+// Is reports whether target is ErrPollRateTooFast.
+func (e *BackoffError) Is(target error) bool {
+	return target == ErrPollRateTooFast
+}
+
+// RequestTimeoutError is returned when a single request took longer than the limit set by WithRequestTimeout,
+// while the context of the call still had time left. Err is the error of the aborted request, which matches
+// context.DeadlineExceeded with errors.Is. The poll loop treats it like an unclaimed code and polls again at
+// the next interval, instead of letting one stalled request end the flow.
+type RequestTimeoutError struct {
+	Endpoint Endpoint
+	Timeout  time.Duration
+	Err      error
+}
+
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("the request to %s took longer than %v: %v", e.Endpoint, e.Timeout, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *RequestTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ErrMalformedResponse is returned, wrapped in a *MalformedResponseError, when Trakt answers a token request
+// with success but the token in the response is missing required fields.
+var ErrMalformedResponse error = errors.New("the token response is malformed")
+
+// MalformedResponseError is returned instead of a token when a successful token response is missing Field or
+// has an implausible value in it, which usually means a proxy in between mangled or truncated the response.
+// Saving such a token would only lead to confusing failures later. It unwraps to ErrMalformedResponse.
+type MalformedResponseError struct {
+	Field   string // The JSON name of the field, such as "access_token".
+	Problem string // What is wrong with it, such as "is missing".
+	Body    string // The start of the response body, with the tokens in it redacted.
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("%v: %s %s in %s", ErrMalformedResponse, e.Field, e.Problem, e.Body)
+}
+
+// Unwrap returns ErrMalformedResponse.
+func (e *MalformedResponseError) Unwrap() error {
+	return ErrMalformedResponse
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date,
+// into a duration relative to now. Missing, invalid, and past values return zero.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Endpoint identifies one of the Trakt API endpoints used by this package.
+type Endpoint int
+
+const (
+	// EndpointDeviceCode is used by GenerateNewCode to acquire a device code.
+	EndpointDeviceCode Endpoint = iota
+
+	// EndpointDeviceToken is used by RequestToken and PollForAuthToken to exchange a claimed device code for a token.
+	EndpointDeviceToken
+
+	// EndpointToken is used by RefreshAccessToken to exchange a refresh token for a new token.
+	EndpointToken
+
+	// EndpointUserSettings is used by GetUserSettings to look up the account an access token belongs to.
+	EndpointUserSettings
+
+	// EndpointRevoke is used by RevokeToken to invalidate an access token.
+	EndpointRevoke
+)
+
+// String returns the path of the endpoint, relative to TraktAPIBaseUrl.
+func (e Endpoint) String() string {
+	switch e {
+	case EndpointDeviceCode:
+		return "/oauth/device/code"
+	case EndpointDeviceToken:
+		return "/oauth/device/token"
+	case EndpointToken:
+		return "/oauth/token"
+	case EndpointUserSettings:
+		return "/users/settings"
+	case EndpointRevoke:
+		return "/oauth/revoke"
+	default:
+		return fmt.Sprintf("Endpoint(%d)", int(e))
+	}
+}
+
+// StatusToError maps a status code returned by endpoint to the matching error value from this package.
+// Success statuses map to nil and statuses that Trakt does not document for endpoint map to an error
+// wrapping ErrUnexpectedStatusCode.
+//
+// StatusToError is the single source of truth for how this package interprets status codes, so fake servers
+// and code calling the Trakt API directly can use it to stay consistent with the library.
+func StatusToError(endpoint Endpoint, status int) error {
+	switch endpoint {
+	case EndpointDeviceToken:
+		switch status {
+		case 400:
+			return ErrDeviceCodeUnclaimed
+		case 404:
+			return ErrInvalidDeviceCode
+		case 409:
+			return ErrDeviceCodeAlreadyApproved
+		case 410:
+			return ErrDeviceCodeExpired
+		case 418:
+			return ErrDeviceCodeDenied
+		}
+	case EndpointToken, EndpointRevoke:
+		switch status {
+		case 401:
+			return ErrInvalidGrant
+		}
+	case EndpointUserSettings:
+		switch status {
+		case 401:
+			return ErrInvalidAccessToken
+		}
+	}
+
+	// Statuses which mean the same thing regardless of the endpoint.
+	switch status {
+	case 200:
+		return nil
+	case 403:
+		return ErrForbidden
+	case 429:
+		return ErrPollRateTooFast
+	case 500:
+		return ErrServerError
+	case 503, 504:
+		return ErrServiceOverloaded
+	case 520, 521, 522:
+		return ErrCloudflareError
+	default:
+		return fmt.Errorf("%w '%v'", ErrUnexpectedStatusCode, status)
+	}
+}
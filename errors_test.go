@@ -0,0 +1,180 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// allEndpoints are the endpoints StatusToError knows.
+var allEndpoints = []traktdeviceauth.Endpoint{
+	traktdeviceauth.EndpointDeviceCode,
+	traktdeviceauth.EndpointDeviceToken,
+	traktdeviceauth.EndpointToken,
+	traktdeviceauth.EndpointUserSettings,
+	traktdeviceauth.EndpointRevoke,
+}
+
+func TestStatusToError(t *testing.T) {
+	// Statuses which mean the same for every endpoint.
+	common := map[int]error{
+		200: nil,
+		403: traktdeviceauth.ErrForbidden,
+		429: traktdeviceauth.ErrPollRateTooFast,
+		500: traktdeviceauth.ErrServerError,
+		503: traktdeviceauth.ErrServiceOverloaded,
+		504: traktdeviceauth.ErrServiceOverloaded,
+		520: traktdeviceauth.ErrCloudflareError,
+		521: traktdeviceauth.ErrCloudflareError,
+		522: traktdeviceauth.ErrCloudflareError,
+	}
+	specific := map[traktdeviceauth.Endpoint]map[int]error{
+		traktdeviceauth.EndpointDeviceCode: {},
+		traktdeviceauth.EndpointDeviceToken: {
+			400: traktdeviceauth.ErrDeviceCodeUnclaimed,
+			404: traktdeviceauth.ErrInvalidDeviceCode,
+			409: traktdeviceauth.ErrDeviceCodeAlreadyApproved,
+			410: traktdeviceauth.ErrDeviceCodeExpired,
+			418: traktdeviceauth.ErrDeviceCodeDenied,
+		},
+		traktdeviceauth.EndpointToken:        {401: traktdeviceauth.ErrInvalidGrant},
+		traktdeviceauth.EndpointRevoke:       {401: traktdeviceauth.ErrInvalidGrant},
+		traktdeviceauth.EndpointUserSettings: {401: traktdeviceauth.ErrInvalidAccessToken},
+	}
+
+	for _, endpoint := range allEndpoints {
+		t.Run(endpoint.String(), func(t *testing.T) {
+			for status := 100; status < 600; status++ {
+				want, known := specific[endpoint][status]
+				if !known {
+					want, known = common[status]
+				}
+
+				got := traktdeviceauth.StatusToError(endpoint, status)
+				switch {
+				case !known:
+					if !errors.Is(got, traktdeviceauth.ErrUnexpectedStatusCode) || got.Error() != fmt.Sprintf("%v '%d'", traktdeviceauth.ErrUnexpectedStatusCode, status) {
+						t.Errorf("StatusToError(%d) = %v, want ErrUnexpectedStatusCode with the status", status, got)
+					}
+				case want == nil:
+					if got != nil {
+						t.Errorf("StatusToError(%d) = %v, want nil", status, got)
+					}
+				case got != want:
+					t.Errorf("StatusToError(%d) = %v, want %v", status, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestTokenUsesStatusToError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{400, traktdeviceauth.ErrDeviceCodeUnclaimed},
+		{403, traktdeviceauth.ErrForbidden},
+		{404, traktdeviceauth.ErrInvalidDeviceCode},
+		{409, traktdeviceauth.ErrDeviceCodeAlreadyApproved},
+		{410, traktdeviceauth.ErrDeviceCodeExpired},
+		{418, traktdeviceauth.ErrDeviceCodeDenied},
+		{500, traktdeviceauth.ErrServerError},
+		{503, traktdeviceauth.ErrServiceOverloaded},
+		{522, traktdeviceauth.ErrCloudflareError},
+		{599, traktdeviceauth.ErrUnexpectedStatusCode},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.Fixture{Status: tt.status})
+			cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+
+			_, err := cl.RequestToken(context.Background(), traktdeviceauth.CodeResponse{DeviceCode: "code"})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("RequestToken returned %v, want %v", err, tt.want)
+			}
+			var statusErr *traktdeviceauth.StatusError
+			if !errors.As(err, &statusErr) || statusErr.Status != tt.status {
+				t.Errorf("RequestToken returned %v, want a *StatusError with status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestRateLimitErrorRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"seconds", "7", 7 * time.Second, 7 * time.Second},
+		{"HTTP date", time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat), 118 * time.Second, 2 * time.Minute},
+		{"missing", "", 0, 0},
+	}
+	calls := []struct {
+		endpoint traktdeviceauth.Endpoint
+		call     func(cl *traktdeviceauth.Client) error
+	}{
+		{traktdeviceauth.EndpointDeviceToken, func(cl *traktdeviceauth.Client) error {
+			_, err := cl.RequestToken(context.Background(), traktdeviceauth.CodeResponse{DeviceCode: "code"})
+			return err
+		}},
+		{traktdeviceauth.EndpointToken, func(cl *traktdeviceauth.Client) error {
+			_, err := cl.RefreshAccessToken(context.Background(), "refresh-token")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		for _, c := range calls {
+			t.Run(tt.name+" "+c.endpoint.String(), func(t *testing.T) {
+				fixture := traktdeviceauthtest.Fixture{Status: http.StatusTooManyRequests, Header: http.Header{}}
+				if tt.header != "" {
+					fixture.Header.Set("Retry-After", tt.header)
+				}
+				replay := traktdeviceauthtest.NewReplayTransport(fixture)
+
+				err := c.call(traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...))
+				if !errors.Is(err, traktdeviceauth.ErrPollRateTooFast) {
+					t.Fatalf("got %v, want ErrPollRateTooFast", err)
+				}
+				var rateLimitErr *traktdeviceauth.RateLimitError
+				if !errors.As(err, &rateLimitErr) {
+					t.Fatalf("got %v, want a *RateLimitError", err)
+				}
+				if rateLimitErr.RetryAfter < tt.min || rateLimitErr.RetryAfter > tt.max {
+					t.Errorf("RetryAfter = %v, want between %v and %v", rateLimitErr.RetryAfter, tt.min, tt.max)
+				}
+			})
+		}
+	}
+}
+
+func TestPollOnceWaitsForRetryAfter(t *testing.T) {
+	// The server asks for longer than the interval, which grows to 10 seconds, so the flow waits as long as asked.
+	replay := traktdeviceauthtest.NewReplayTransport(
+		traktdeviceauthtest.FixtureCodeResponse,
+		traktdeviceauthtest.Fixture{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}},
+	)
+	f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", replay.Options()...)
+	ctx := context.Background()
+	if err := f.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	state, err := f.PollOnce(ctx)
+	if err != nil || state != traktdeviceauth.StateSlowingDown {
+		t.Fatalf("PollOnce returned %s and %v, want slowing down", state, err)
+	}
+	if wait := f.NextPollAt().Sub(start); wait < 59*time.Second || wait > 61*time.Second {
+		t.Errorf("the next poll is in %v, want 60s", wait)
+	}
+}
@@ -0,0 +1,20 @@
+package traktdeviceauth
+
+import "time"
+
+// SetRefreshSchedulerClock makes s use now and afterFunc instead of time.Now and time.AfterFunc, so that tests
+// can control time. It must be called before any token is added.
+func SetRefreshSchedulerClock(s *RefreshScheduler, now func() time.Time, afterFunc func(d time.Duration, f func()) interface{ Stop() bool }) {
+	s.now = now
+	s.afterFunc = func(d time.Duration, f func()) stoppable { return afterFunc(d, f) }
+}
+
+// SetErrorRateTrackerClock makes t use now instead of time.Now, so that tests can move requests across its window.
+func SetErrorRateTrackerClock(t *ErrorRateTracker, now func() time.Time) {
+	t.now = now
+}
+
+// SetTokenCacheClock makes c use now instead of time.Now to decide which tokens have expired.
+func SetTokenCacheClock(c *TokenCache, now func() time.Time) {
+	c.now = now
+}
@@ -0,0 +1,67 @@
+package traktdeviceauth
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Names of the counters published by WithExpvar. They won't change between releases.
+const (
+	expvarCodesGenerated = "codes_generated"
+	expvarPollAttempts   = "poll_attempts"
+	expvarApprovals      = "approvals"
+	expvarDenials        = "denials"
+	expvarRefreshes      = "refreshes"
+	expvarFailures       = "failures"
+)
+
+var (
+	expvarOnce     sync.Once
+	expvarCounters *expvar.Map
+	expvarFailed   *expvar.Map
+)
+
+// WithExpvar publishes counters for the calls made with this option under the "traktdeviceauth" expvar map,
+// which is served at /debug/vars by the expvar package's handler. The map is only published once WithExpvar
+// is first used.
+//
+// The map contains the integer counters codes_generated, poll_attempts, approvals, denials and refreshes,
+// plus a failures map counting failed requests by their Code.
+func WithExpvar() Option {
+	expvarOnce.Do(func() {
+		expvarCounters = expvar.NewMap("traktdeviceauth")
+		expvarFailed = new(expvar.Map)
+		expvarCounters.Set(expvarFailures, expvarFailed)
+		for _, name := range []string{expvarCodesGenerated, expvarPollAttempts, expvarApprovals, expvarDenials, expvarRefreshes} {
+			expvarCounters.Add(name, 0)
+		}
+	})
+
+	return func(c *config) {
+		c.expvar = true
+	}
+}
+
+// count increments the expvar counter name if WithExpvar was used.
+func (c config) count(name string) {
+	if c.expvar {
+		expvarCounters.Add(name, 1)
+	}
+}
+
+// countEvent increments the expvar counters matching e. WithExpvar must have been used.
+func countEvent(e AuditEvent) {
+	switch e.Event {
+	case AuditCodeGenerated:
+		expvarCounters.Add(expvarCodesGenerated, 1)
+	case AuditTokenObtained:
+		expvarCounters.Add(expvarApprovals, 1)
+	case AuditTokenRefreshed:
+		expvarCounters.Add(expvarRefreshes, 1)
+	case AuditFailure:
+		if e.Reason == CodeDeviceCodeDenied {
+			expvarCounters.Add(expvarDenials, 1)
+		}
+		expvarFailed.Add(e.Reason, 1)
+	}
+}
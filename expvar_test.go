@@ -0,0 +1,91 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// expvarCounts reads the counters published by WithExpvar, with the failures by code prefixed with "failures.".
+func expvarCounts(t *testing.T) map[string]int64 {
+	t.Helper()
+
+	m, ok := expvar.Get("traktdeviceauth").(*expvar.Map)
+	if !ok {
+		t.Fatal("the traktdeviceauth map isn't published")
+	}
+	counts := make(map[string]int64)
+	m.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			counts[kv.Key] = v.Value()
+		case *expvar.Map:
+			v.Do(func(failure expvar.KeyValue) {
+				counts[kv.Key+"."+failure.Key] = failure.Value.(*expvar.Int).Value()
+			})
+		}
+	})
+	return counts
+}
+
+func TestWithExpvar(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	expvarOpt := traktdeviceauth.WithExpvar()
+	before := expvarCounts(t)
+	for _, name := range []string{"codes_generated", "poll_attempts", "approvals", "denials", "refreshes"} {
+		if _, ok := before[name]; !ok {
+			t.Errorf("the counter %s isn't published", name)
+		}
+	}
+
+	// An approved flow and a refresh, then a denied flow.
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), expvarOpt)...)
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cl.PollForAuthToken(ctx, codeResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Script(traktdeviceauthtest.DenyAfterPolls(1))
+	codeResp, err = cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.PollForAuthToken(ctx, codeResp); !errors.Is(err, traktdeviceauth.ErrDeviceCodeDenied) {
+		t.Fatalf("PollForAuthToken returned %v, want ErrDeviceCodeDenied", err)
+	}
+
+	// Calls without WithExpvar aren't counted.
+	if _, err := traktdeviceauth.GenerateNewCode("client-id", srv.Options()...); err != nil {
+		t.Fatal(err)
+	}
+
+	after := expvarCounts(t)
+	want := map[string]int64{
+		"codes_generated":             2,
+		"poll_attempts":               5,
+		"approvals":                   1,
+		"denials":                     1,
+		"refreshes":                   1,
+		"failures.device_code_denied": 1,
+	}
+	for name, n := range want {
+		if got := after[name] - before[name]; got != n {
+			t.Errorf("%s grew by %d, want %d", name, got, n)
+		}
+	}
+}
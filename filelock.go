@@ -0,0 +1,66 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrStoreLocked is returned by the methods of FileTokenStore when another process or store held the lock on
+// the token file for longer than the lock timeout.
+var ErrStoreLocked error = errors.New("the token file is locked by someone else")
+
+// DefaultLockTimeout is how long a FileTokenStore waits for the lock on its token file unless WithLockTimeout
+// says otherwise.
+const DefaultLockTimeout = 10 * time.Second
+
+// lockRetryInterval is how often a lock held by someone else is tried again.
+const lockRetryInterval = 20 * time.Millisecond
+
+// lockTokenFile takes an advisory lock for the token file at path and returns the function releasing it. The
+// lock is held on a separate file, path with .lock appended, since the token file itself is replaced on every
+// save. The lock is tried until timeout passes, which is reported as ErrStoreLocked, or ctx ends.
+//
+// A shared lock is skipped if the lock file can't be opened, such as in a read-only directory, where nobody
+// can replace the token file while it is read anyway.
+func lockTokenFile(ctx context.Context, path string, exclusive bool, timeout time.Duration) (unlock func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil && !exclusive {
+		if f, err = os.Open(path + ".lock"); err != nil {
+			return func() {}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, ErrStoreLocked)
+		}
+
+		timer := time.NewTimer(lockRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			f.Close()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
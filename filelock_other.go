@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package traktdeviceauth
+
+import "os"
+
+// tryLockFile always reports the lock as taken, since files can't be locked on this platform.
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+// unlockFile does nothing, since files can't be locked on this platform.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// skipWithoutLocking skips the test on the platforms where FileTokenStore doesn't lock the file.
+func skipWithoutLocking(t *testing.T) {
+	t.Helper()
+
+	switch runtime.GOOS {
+	case "plan9", "js", "wasip1":
+		t.Skipf("FileTokenStore doesn't lock on %s", runtime.GOOS)
+	}
+}
+
+func TestFileTokenStore(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return traktdeviceauth.NewFileTokenStore(filepath.Join(t.TempDir(), "token.json"))
+	})
+}
+
+func TestFileTokenStoreConcurrentUpdates(t *testing.T) {
+	skipWithoutLocking(t)
+	path := filepath.Join(t.TempDir(), "token.json")
+
+	// Every update counts up the access token and rotates the refresh token to match, like a refresh would. An
+	// update lost to an interleaved read-modify-write shows up in the count, and a torn one in the mismatch.
+	const updaters, updates = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, updaters)
+	for i := 0; i < updaters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := traktdeviceauth.NewFileTokenStore(path)
+			for j := 0; j < updates; j++ {
+				err := s.Update(context.Background(), func(t traktdeviceauth.TokenResponse) (traktdeviceauth.TokenResponse, error) {
+					n := 0
+					if t.AccessToken != "" {
+						var err error
+						if n, err = strconv.Atoi(t.AccessToken); err != nil {
+							return t, err
+						}
+						if t.RefreshToken != "refresh-"+t.AccessToken {
+							return t, fmt.Errorf("access token %s stored with refresh token %s", t.AccessToken, t.RefreshToken)
+						}
+					}
+					n++
+					return traktdeviceauth.TokenResponse{
+						AccessToken:  strconv.Itoa(n),
+						RefreshToken: "refresh-" + strconv.Itoa(n),
+						ExpiresAt:    time.Now().Add(time.Hour),
+					}, nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	got, err := traktdeviceauth.NewFileTokenStore(path).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(updaters * updates); got.AccessToken != want || got.RefreshToken != "refresh-"+want {
+		t.Errorf("the file holds %s and %s after %d updates, want %s and refresh-%s", got.AccessToken, got.RefreshToken, updaters*updates, want, want)
+	}
+}
+
+func TestFileTokenStoreLocked(t *testing.T) {
+	skipWithoutLocking(t)
+	path := filepath.Join(t.TempDir(), "token.json")
+	stored := traktdeviceauth.TokenResponse{AccessToken: "stored", RefreshToken: "stored", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := traktdeviceauth.NewFileTokenStore(path).Save(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// One store holds the lock in Update until release is closed.
+	locked, release, done := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		done <- traktdeviceauth.NewFileTokenStore(path).Update(context.Background(), func(t traktdeviceauth.TokenResponse) (traktdeviceauth.TokenResponse, error) {
+			close(locked)
+			<-release
+			t.AccessToken = "updated"
+			return t, nil
+		})
+	}()
+	<-locked
+
+	other := traktdeviceauth.NewFileTokenStore(path, traktdeviceauth.WithLockTimeout(50*time.Millisecond))
+	if err := other.Save(context.Background(), stored); !errors.Is(err, traktdeviceauth.ErrStoreLocked) {
+		t.Errorf("Save while the file is locked returned %v, want ErrStoreLocked", err)
+	}
+	if _, err := other.Load(context.Background()); !errors.Is(err, traktdeviceauth.ErrStoreLocked) {
+		t.Errorf("Load while the file is locked returned %v, want ErrStoreLocked", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := traktdeviceauth.NewFileTokenStore(path, traktdeviceauth.WithLockTimeout(time.Hour)).Save(ctx, stored); !errors.Is(err, context.Canceled) {
+		t.Errorf("Save with a cancelled context returned %v, want Canceled", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := other.Load(context.Background()); err != nil || got.AccessToken != "updated" {
+		t.Errorf("Load after the update returned %+v, %v, want the updated token", got, err)
+	}
+}
+
+func TestFileTokenStoreUpdateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	s := traktdeviceauth.NewFileTokenStore(path)
+
+	// Without a saved token, fn is passed the zero TokenResponse.
+	errFailed := errors.New("refresh failed")
+	err := s.Update(context.Background(), func(t traktdeviceauth.TokenResponse) (traktdeviceauth.TokenResponse, error) {
+		if t != (traktdeviceauth.TokenResponse{}) {
+			return t, fmt.Errorf("passed %+v without a saved token", t)
+		}
+		return t, errFailed
+	})
+	if !errors.Is(err, errFailed) || !strings.HasPrefix(err.Error(), "FileTokenStore.Update: ") {
+		t.Errorf("Update returned %v, want the error of fn", err)
+	}
+	if _, err := s.Load(context.Background()); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load after a failed Update returned %v, want ErrNoStoredToken", err)
+	}
+}
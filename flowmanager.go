@@ -0,0 +1,356 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFlowNotFound  error = errors.New("no device flow exists for the key")
+	ErrFlowPending   error = errors.New("the device flow is still waiting for the user")
+	ErrTooManyFlows  error = errors.New("the maximum number of concurrent device flows has been reached")
+	ErrFlowCancelled error = errors.New("the device flow was cancelled")
+)
+
+// FlowState describes how far along a device flow is.
+type FlowState int
+
+const (
+	FlowPending FlowState = iota
+	FlowApproved
+	FlowDenied
+	FlowExpired
+	FlowFailed
+	FlowCancelled
+)
+
+// String returns a lowercase name for the state.
+func (s FlowState) String() string {
+	switch s {
+	case FlowPending:
+		return "pending"
+	case FlowApproved:
+		return "approved"
+	case FlowDenied:
+		return "denied"
+	case FlowExpired:
+		return "expired"
+	case FlowFailed:
+		return "failed"
+	case FlowCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// FlowStatus is a snapshot of a device flow managed by a FlowManager.
+type FlowStatus struct {
+	State        FlowState
+	CodeResponse CodeResponse
+	CreatedAt    time.Time
+	ExpiresAt    time.Time // When the device code expires.
+	FinishedAt   time.Time // Zero while State is FlowPending.
+	Err          error     // Why the flow ended, if it wasn't approved.
+}
+
+// FlowManagerOption customizes a FlowManager.
+type FlowManagerOption func(*FlowManager)
+
+// WithMaxFlows limits how many flows can be pending at once. Begin returns ErrTooManyFlows once the limit
+// is reached. The default is 100 and values less than 1 remove the limit.
+func WithMaxFlows(n int) FlowManagerOption {
+	return func(m *FlowManager) {
+		m.maxFlows = n
+	}
+}
+
+// WithFlowTTL sets how long finished flows are remembered before they are garbage collected. The default is 10 minutes.
+func WithFlowTTL(d time.Duration) FlowManagerOption {
+	return func(m *FlowManager) {
+		m.ttl = d
+	}
+}
+
+// WithFlowCallback calls fn from the flow's goroutine whenever a flow finishes. err is nil if the user approved the code.
+// A panic in fn is recovered and passed to the WithPanicHandler handler given to WithFlowOptions.
+func WithFlowCallback(fn func(key string, t TokenResponse, err error)) FlowManagerOption {
+	return func(m *FlowManager) {
+		m.callback = fn
+	}
+}
+
+// WithFlowOptions passes opts to every request made by the FlowManager.
+func WithFlowOptions(opts ...Option) FlowManagerOption {
+	return func(m *FlowManager) {
+		m.opts = append(m.opts, opts...)
+	}
+}
+
+// WithFlowStore saves the pending flows to store every time they change, so that they can be resumed
+// with FlowManager.Restore after a restart.
+func WithFlowStore(store FlowStore) FlowManagerOption {
+	return func(m *FlowManager) {
+		m.store = store
+	}
+}
+
+// FlowManager runs many device flows at once, each identified by an opaque key such as a user id.
+// All of its methods are safe for concurrent use.
+type FlowManager struct {
+	clientID     string
+	clientSecret string
+	maxFlows     int
+	ttl          time.Duration
+	callback     func(key string, t TokenResponse, err error)
+	opts         []Option
+	store        FlowStore
+	saveMu       sync.Mutex // Serializes saves so that an older snapshot can't overwrite a newer one.
+
+	mu     sync.Mutex
+	flows  map[string]*managedFlow
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// managedFlow is a single flow of a FlowManager. Its fields are guarded by FlowManager.mu.
+type managedFlow struct {
+	status FlowStatus
+	token  TokenResponse
+	cancel context.CancelFunc
+}
+
+// NewFlowManager creates a FlowManager which authorizes users for the app identified by clientID and clientSecret.
+func NewFlowManager(clientID, clientSecret string, opts ...FlowManagerOption) *FlowManager {
+	m := &FlowManager{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		maxFlows:     100,
+		ttl:          10 * time.Minute,
+		flows:        make(map[string]*managedFlow),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Begin generates a new device code for key and starts polling for it in the background. ctx only bounds
+// code generation; polling continues until the flow finishes, is cancelled, or the manager is closed.
+//
+// If key already has a pending flow, its CodeResponse is returned instead of generating a new one.
+// Use Cancel first to replace it.
+func (m *FlowManager) Begin(ctx context.Context, key string) (CodeResponse, error) {
+	m.mu.Lock()
+	m.collect()
+	if f, ok := m.flows[key]; ok && f.status.State == FlowPending {
+		m.mu.Unlock()
+		return f.status.CodeResponse, nil
+	}
+	if m.maxFlows > 0 && m.pending() >= m.maxFlows {
+		m.mu.Unlock()
+		return CodeResponse{}, ErrTooManyFlows
+	}
+	m.mu.Unlock()
+
+	codeResp, err := GenerateNewCodeContext(ctx, m.clientID, m.options(key)...)
+	if err != nil {
+		return CodeResponse{}, err
+	}
+
+	m.mu.Lock()
+	// Another call may have started a flow for key while the code was being generated.
+	if f, ok := m.flows[key]; ok && f.status.State == FlowPending {
+		m.mu.Unlock()
+		return f.status.CodeResponse, nil
+	}
+	if err := m.ctx.Err(); err != nil {
+		m.mu.Unlock()
+		return CodeResponse{}, err
+	}
+	if m.maxFlows > 0 && m.pending() >= m.maxFlows {
+		m.mu.Unlock()
+		return CodeResponse{}, ErrTooManyFlows
+	}
+
+	now := time.Now()
+	m.track(key, codeResp, now, codeResp.expiresAt(now))
+	m.mu.Unlock()
+
+	if err := m.save(ctx); err != nil {
+		return codeResp, fmt.Errorf("FlowManager.Begin: %w", err)
+	}
+	return codeResp, nil
+}
+
+// track registers a pending flow for key and starts polling for it. m.mu must be held.
+func (m *FlowManager) track(key string, codeResp CodeResponse, createdAt, expiresAt time.Time) {
+	pollCtx, cancel := context.WithCancel(m.ctx)
+	f := &managedFlow{
+		status: FlowStatus{
+			State:        FlowPending,
+			CodeResponse: codeResp,
+			CreatedAt:    createdAt,
+			ExpiresAt:    expiresAt,
+		},
+		cancel: cancel,
+	}
+	m.flows[key] = f
+
+	m.wg.Add(1)
+	go m.poll(pollCtx, key, f)
+}
+
+// Status returns a snapshot of the flow for key. ok is false if there is no such flow.
+func (m *FlowManager) Status(key string) (status FlowStatus, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.collect()
+	f, ok := m.flows[key]
+	if !ok {
+		return FlowStatus{}, false
+	}
+	return f.status, true
+}
+
+// Result returns the token obtained by the flow for key. It returns ErrFlowPending while the user hasn't
+// approved the code yet, ErrFlowNotFound for unknown keys, and the reason the flow ended otherwise.
+func (m *FlowManager) Result(key string) (TokenResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.collect()
+	f, ok := m.flows[key]
+	if !ok {
+		return TokenResponse{}, ErrFlowNotFound
+	}
+
+	switch f.status.State {
+	case FlowPending:
+		return TokenResponse{}, ErrFlowPending
+	case FlowApproved:
+		return f.token, nil
+	default:
+		return TokenResponse{}, f.status.Err
+	}
+}
+
+// Cancel stops polling for key's flow, which finishes in the FlowCancelled state. Cancel returns
+// ErrFlowNotFound if there is no such flow and does nothing to flows that have already finished.
+func (m *FlowManager) Cancel(key string) error {
+	m.mu.Lock()
+	f, ok := m.flows[key]
+	if !ok {
+		m.mu.Unlock()
+		return ErrFlowNotFound
+	}
+
+	if f.status.State != FlowPending {
+		m.mu.Unlock()
+		return nil
+	}
+	m.finish(f, FlowCancelled, ErrFlowCancelled)
+	f.cancel()
+	m.mu.Unlock()
+
+	if err := m.save(context.Background()); err != nil {
+		return fmt.Errorf("FlowManager.Cancel: %w", err)
+	}
+	return nil
+}
+
+// Close cancels every pending flow and waits for their goroutines to exit. Begin fails after Close.
+// Flows saved to a FlowStore are left in place so that they can be restored by a new manager.
+func (m *FlowManager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	for _, f := range m.flows {
+		if f.status.State == FlowPending {
+			m.finish(f, FlowCancelled, ErrFlowCancelled)
+		}
+	}
+	m.mu.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// poll waits for the user to approve f's code and records the outcome.
+func (m *FlowManager) poll(ctx context.Context, key string, f *managedFlow) {
+	defer m.wg.Done()
+	defer f.cancel()
+
+	t, err := PollForAuthTokenContext(ctx, f.status.CodeResponse, m.clientID, m.clientSecret, m.options(key)...)
+
+	m.mu.Lock()
+	// The flow may have been cancelled while polling, in which case the outcome has already been recorded.
+	var hookErr *HookError
+	if f.status.State == FlowPending {
+		switch {
+		case err == nil, errors.As(err, &hookErr):
+			// A failed hook still leaves a valid token, which is kept along with the error.
+			f.token = t
+			m.finish(f, FlowApproved, err)
+		case errors.Is(err, ErrDeviceCodeDenied):
+			m.finish(f, FlowDenied, err)
+		case errors.Is(err, ErrDeviceCodeExpired), time.Now().After(f.status.ExpiresAt):
+			m.finish(f, FlowExpired, err)
+		default:
+			m.finish(f, FlowFailed, err)
+		}
+	}
+	t, err = f.token, f.status.Err
+	m.mu.Unlock()
+
+	// There is nobody to report a failure to here. The next successful save will drop the flow
+	// and Restore would only find it expired or already used.
+	_ = m.save(context.Background())
+
+	if m.callback != nil {
+		newConfig(m.opts).observe("WithFlowCallback", func() { m.callback(key, t, err) })
+	}
+}
+
+// options returns the options used for requests made on behalf of key's flow.
+func (m *FlowManager) options(key string) []Option {
+	opts := make([]Option, 0, len(m.opts)+1)
+	opts = append(opts, m.opts...)
+	return append(opts, withAuditKey(key))
+}
+
+// finish moves f into a final state. m.mu must be held.
+func (m *FlowManager) finish(f *managedFlow, state FlowState, err error) {
+	f.status.State = state
+	f.status.Err = err
+	f.status.FinishedAt = time.Now()
+}
+
+// pending returns the number of pending flows. m.mu must be held.
+func (m *FlowManager) pending() (n int) {
+	for _, f := range m.flows {
+		if f.status.State == FlowPending {
+			n++
+		}
+	}
+	return
+}
+
+// collect forgets finished flows older than the TTL. m.mu must be held.
+func (m *FlowManager) collect() {
+	cutoff := time.Now().Add(-m.ttl)
+	for key, f := range m.flows {
+		if f.status.State != FlowPending && f.status.FinishedAt.Before(cutoff) {
+			delete(m.flows, key)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// newFlowManager returns a FlowManager polling srv every few milliseconds, which is closed when the test ends.
+func newFlowManager(t *testing.T, srv *traktdeviceauthtest.Server, opts ...traktdeviceauth.FlowManagerOption) *traktdeviceauth.FlowManager {
+	t.Helper()
+
+	clientOpts := append(srv.Options(), traktdeviceauth.WithPollInterval(5*time.Millisecond))
+	m := traktdeviceauth.NewFlowManager("client-id", "client-secret", append([]traktdeviceauth.FlowManagerOption{traktdeviceauth.WithFlowOptions(clientOpts...)}, opts...)...)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// waitForFlow waits until key's flow has finished and returns its status.
+func waitForFlow(t *testing.T, m *traktdeviceauth.FlowManager, key string) traktdeviceauth.FlowStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, ok := m.Status(key)
+		if !ok {
+			t.Fatalf("the flow for %q is gone", key)
+		}
+		if status.State != traktdeviceauth.FlowPending {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the flow for %q is still pending", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlowManagerConcurrentFlows(t *testing.T) {
+	const flows = 50
+
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(2))
+
+	var (
+		mu        sync.Mutex
+		callbacks = make(map[string]int)
+	)
+	m := newFlowManager(t, srv, traktdeviceauth.WithMaxFlows(flows), traktdeviceauth.WithFlowCallback(func(key string, tok traktdeviceauth.TokenResponse, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		callbacks[key]++
+	}))
+
+	// Every flow is begun twice at once, which must give both callers the same code.
+	var wg sync.WaitGroup
+	codes := make([][2]string, flows)
+	for i := 0; i < flows; i++ {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				codeResp, err := m.Begin(context.Background(), fmt.Sprintf("user-%d", i))
+				if err != nil {
+					t.Errorf("Begin: %v", err)
+				}
+				codes[i][j] = codeResp.UserCode
+			}(i, j)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < flows; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if status := waitForFlow(t, m, key); status.State != traktdeviceauth.FlowApproved {
+			t.Errorf("%s: the flow ended %s with %v, want approved", key, status.State, status.Err)
+		}
+		if tok, err := m.Result(key); err != nil || tok.AccessToken == "" {
+			t.Errorf("%s: Result returned %+v and %v", key, tok, err)
+		}
+		if codes[i][0] == "" || codes[i][0] != codes[i][1] {
+			t.Errorf("%s: the two Begin calls got the codes %q and %q", key, codes[i][0], codes[i][1])
+		}
+	}
+
+	// The callback runs after the status is updated, so it may still be running for the last flows.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(callbacks)
+		mu.Unlock()
+		if n == flows || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for key, n := range callbacks {
+		if n != 1 {
+			t.Errorf("%s: the callback was called %d times", key, n)
+		}
+	}
+	if len(callbacks) != flows {
+		t.Errorf("the callback was called for %d flows, want %d", len(callbacks), flows)
+	}
+}
+
+func TestFlowManagerMaxFlows(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	m := newFlowManager(t, srv, traktdeviceauth.WithMaxFlows(2))
+	ctx := context.Background()
+	for _, key := range []string{"a", "b"} {
+		if _, err := m.Begin(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Begin(ctx, "c"); !errors.Is(err, traktdeviceauth.ErrTooManyFlows) {
+		t.Fatalf("the third Begin returned %v, want ErrTooManyFlows", err)
+	}
+
+	// A cancelled flow no longer counts.
+	if err := m.Cancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Begin(ctx, "c"); err != nil {
+		t.Errorf("Begin after Cancel: %v", err)
+	}
+}
+
+func TestFlowManagerCancel(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	m := newFlowManager(t, srv)
+	if _, err := m.Begin(context.Background(), "user"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := m.Cancel("user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Result("user"); !errors.Is(err, traktdeviceauth.ErrFlowCancelled) {
+		t.Errorf("Result after Cancel returned %v, want ErrFlowCancelled", err)
+	}
+
+	// Polling stops promptly, so no more polls arrive once a poll in flight has finished.
+	time.Sleep(20 * time.Millisecond)
+	polls := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != polls {
+		t.Errorf("%d polls were made after Cancel", n-polls)
+	}
+
+	if err := m.Cancel("unknown"); !errors.Is(err, traktdeviceauth.ErrFlowNotFound) {
+		t.Errorf("Cancel of an unknown key returned %v, want ErrFlowNotFound", err)
+	}
+	if _, err := m.Result("unknown"); !errors.Is(err, traktdeviceauth.ErrFlowNotFound) {
+		t.Errorf("Result of an unknown key returned %v, want ErrFlowNotFound", err)
+	}
+}
+
+func TestFlowManagerOutcomes(t *testing.T) {
+	tests := []struct {
+		scenario traktdeviceauthtest.Scenario
+		want     traktdeviceauth.FlowState
+		wantErr  error
+	}{
+		{traktdeviceauthtest.DenyAfterPolls(1), traktdeviceauth.FlowDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), traktdeviceauth.FlowExpired, traktdeviceauth.ErrDeviceCodeExpired},
+		{traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(403)), traktdeviceauth.FlowFailed, traktdeviceauth.ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want.String(), func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(tt.scenario)
+
+			m := newFlowManager(t, srv)
+			if _, err := m.Begin(context.Background(), "user"); err != nil {
+				t.Fatal(err)
+			}
+			if status := waitForFlow(t, m, "user"); status.State != tt.want || status.FinishedAt.IsZero() {
+				t.Errorf("the flow ended %s at %v, want %s", status.State, status.FinishedAt, tt.want)
+			}
+			if _, err := m.Result("user"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Result returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFlowManagerTTL(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	m := newFlowManager(t, srv, traktdeviceauth.WithFlowTTL(20*time.Millisecond))
+	if _, err := m.Begin(context.Background(), "user"); err != nil {
+		t.Fatal(err)
+	}
+	waitForFlow(t, m, "user")
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := m.Status("user"); ok {
+		t.Error("the finished flow is still there after its TTL")
+	}
+}
+
+func TestFlowManagerClose(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	m := newFlowManager(t, srv)
+	if _, err := m.Begin(context.Background(), "user"); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	if status, _ := m.Status("user"); status.State != traktdeviceauth.FlowCancelled {
+		t.Errorf("the flow is %s after Close, want cancelled", status.State)
+	}
+	if _, err := m.Begin(context.Background(), "other"); err == nil {
+		t.Error("Begin succeeded after Close")
+	}
+}
@@ -0,0 +1,142 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PersistedFlow is the part of a pending FlowManager flow that needs to survive a restart.
+type PersistedFlow struct {
+	Key          string       `json:"key"`
+	CodeResponse CodeResponse `json:"code_response"`
+	CreatedAt    time.Time    `json:"created_at"`
+	ExpiresAt    time.Time    `json:"expires_at"` // Absolute, unlike CodeResponse.ExpiresIn.
+}
+
+// FlowStore persists the pending flows of a FlowManager. SaveFlows is always given the complete set of
+// pending flows and should replace whatever was saved before.
+type FlowStore interface {
+	SaveFlows(ctx context.Context, flows []PersistedFlow) error
+	LoadFlows(ctx context.Context) ([]PersistedFlow, error)
+}
+
+// FileFlowStore is a FlowStore which keeps the flows in a JSON file at the given path.
+// A missing file is treated as having no flows.
+type FileFlowStore string
+
+// SaveFlows implements FlowStore. The file is replaced atomically so a crash can't leave it half-written.
+func (path FileFlowStore) SaveFlows(ctx context.Context, flows []PersistedFlow) error {
+	b, err := json.Marshal(flows)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(string(path)), filepath.Base(string(path))+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), string(path))
+}
+
+// LoadFlows implements FlowStore.
+func (path FileFlowStore) LoadFlows(ctx context.Context) ([]PersistedFlow, error) {
+	b, err := os.ReadFile(string(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var flows []PersistedFlow
+	if err := json.Unmarshal(b, &flows); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return flows, nil
+}
+
+// Restore loads the flows saved by the FlowStore set with WithFlowStore and resumes polling for the ones whose
+// device code is still valid. Tokens the user approved while the manager was down are picked up by the first poll.
+// The flows which had already expired are returned as dropped. Restore does nothing without a FlowStore.
+func (m *FlowManager) Restore(ctx context.Context) (dropped []PersistedFlow, err error) {
+	if m.store == nil {
+		return nil, nil
+	}
+
+	flows, err := m.store.LoadFlows(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("FlowManager.Restore: %w", err)
+	}
+
+	m.mu.Lock()
+	now := time.Now()
+	for _, pf := range flows {
+		if !now.Before(pf.ExpiresAt) {
+			dropped = append(dropped, pf)
+			continue
+		}
+		if f, ok := m.flows[pf.Key]; ok && f.status.State == FlowPending {
+			continue
+		}
+
+		// Flows saved by older versions have no ExpiresAt in their CodeResponse, and PollForAuthToken would
+		// count their ExpiresIn from now instead of from when the code was generated.
+		codeResp := pf.CodeResponse
+		codeResp.ExpiresAt = pf.ExpiresAt
+		codeResp.ExpiresIn = int(pf.ExpiresAt.Sub(now) / time.Second)
+		m.track(pf.Key, codeResp, pf.CreatedAt, pf.ExpiresAt)
+	}
+	m.mu.Unlock()
+
+	if err := m.save(ctx); err != nil {
+		return dropped, fmt.Errorf("FlowManager.Restore: %w", err)
+	}
+	return dropped, nil
+}
+
+// save writes the pending flows to the FlowStore, if there is one.
+func (m *FlowManager) save(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	flows := make([]PersistedFlow, 0, len(m.flows))
+	for key, f := range m.flows {
+		if f.status.State == FlowPending {
+			flows = append(flows, PersistedFlow{
+				Key:          key,
+				CodeResponse: f.status.CodeResponse,
+				CreatedAt:    f.status.CreatedAt,
+				ExpiresAt:    f.status.ExpiresAt,
+			})
+		}
+	}
+	m.mu.Unlock()
+
+	if err := m.store.SaveFlows(ctx, flows); err != nil {
+		return fmt.Errorf("saving flows: %w", err)
+	}
+	return nil
+}
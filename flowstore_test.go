@@ -0,0 +1,133 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestFileFlowStore(t *testing.T) {
+	ctx := context.Background()
+	store := traktdeviceauth.FileFlowStore(filepath.Join(t.TempDir(), "flows.json"))
+
+	if flows, err := store.LoadFlows(ctx); err != nil || flows != nil {
+		t.Fatalf("LoadFlows of a missing file returned %v and %v", flows, err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	want := []traktdeviceauth.PersistedFlow{{
+		Key:          "user",
+		CodeResponse: traktdeviceauth.CodeResponse{DeviceCode: "device", UserCode: "USER", VerificationURL: "https://trakt.tv/activate", ExpiresIn: 600, Interval: 5},
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(10 * time.Minute),
+	}}
+	if err := store.SaveFlows(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.LoadFlows(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadFlows returned %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(string(store), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadFlows(ctx); err == nil {
+		t.Error("LoadFlows succeeded with a corrupt file")
+	}
+}
+
+func TestFlowManagerRestore(t *testing.T) {
+	ctx := context.Background()
+	store := traktdeviceauth.FileFlowStore(filepath.Join(t.TempDir(), "flows.json"))
+
+	// Without a script the fake server approves a code on its first poll, so the user approved the code
+	// before the first manager ever polled for it.
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	first := traktdeviceauth.NewFlowManager("client-id", "client-secret",
+		traktdeviceauth.WithFlowStore(store),
+		traktdeviceauth.WithFlowOptions(append(srv.Options(), traktdeviceauth.WithPollInterval(time.Hour))...),
+	)
+	codeResp, err := first.Begin(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 0 {
+		t.Fatalf("the first manager polled %d times", n)
+	}
+
+	// A flow whose code expired during the outage is dropped.
+	flows, err := store.LoadFlows(ctx)
+	if err != nil || len(flows) != 1 {
+		t.Fatalf("the store holds %+v and %v, want the pending flow", flows, err)
+	}
+	expired := traktdeviceauth.PersistedFlow{Key: "expired", CodeResponse: codeResp, CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := store.SaveFlows(ctx, append(flows, expired)); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newFlowManager(t, srv, traktdeviceauth.WithFlowStore(store))
+	dropped, err := second.Restore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 || dropped[0].Key != "expired" {
+		t.Errorf("Restore dropped %+v, want the expired flow", dropped)
+	}
+	if _, ok := second.Status("expired"); ok {
+		t.Error("the expired flow was restored")
+	}
+
+	status := waitForFlow(t, second, "user")
+	if status.State != traktdeviceauth.FlowApproved || status.CodeResponse.UserCode != codeResp.UserCode {
+		t.Fatalf("the restored flow ended %s for code %q, want approved for %q", status.State, status.CodeResponse.UserCode, codeResp.UserCode)
+	}
+	if !status.CreatedAt.Equal(flows[0].CreatedAt) {
+		t.Errorf("the restored flow was created at %v, want %v", status.CreatedAt, flows[0].CreatedAt)
+	}
+	if tok, err := second.Result("user"); err != nil || tok.AccessToken == "" {
+		t.Errorf("Result returned %+v and %v", tok, err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 1 {
+		t.Errorf("%d codes were generated, want 1", n)
+	}
+
+	// The finished flow is no longer saved.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		flows, err := store.LoadFlows(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(flows) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			b, _ := json.Marshal(flows)
+			t.Fatalf("the store still holds %s", b)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlowManagerRestoreWithoutStore(t *testing.T) {
+	m := traktdeviceauth.NewFlowManager("client-id", "client-secret")
+	defer m.Close()
+
+	if dropped, err := m.Restore(context.Background()); err != nil || dropped != nil {
+		t.Errorf("Restore returned %v and %v without a store", dropped, err)
+	}
+}
@@ -1,3 +1,10 @@
 module github.com/BrenekH/go-traktdeviceauth
 
 go 1.17
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/sys v0.6.0
+	golang.org/x/text v0.13.0
+)
@@ -0,0 +1,61 @@
+package traktdeviceauth
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// errorHints has a suggestion for every code returned by Code which the user can act on.
+var errorHints = map[string]string{
+	CodeDeviceCodeUnclaimed:       "Enter the code on the verification page, then wait a moment.",
+	CodeInvalidGrant:              "The saved authorization is no longer valid. Authorize the app again.",
+	CodeInvalidAccessToken:        "The access token has expired or was revoked. Refresh it or authorize the app again.",
+	CodeInvalidDeviceCode:         "Request a new code and try again.",
+	CodeForbidden:                 "Double-check the client ID and secret you copied from the Trakt API app settings page.",
+	CodeDeviceCodeAlreadyApproved: "This code has already been used. Request a new one to authorize again.",
+	CodeDeviceCodeExpired:         "The code expired before it was entered. Request a new one and enter it sooner.",
+	CodeDeviceCodeDenied:          "The authorization was declined on Trakt. Try again and choose Yes to allow access.",
+	CodeRateLimited:               "Too many requests were made to Trakt. Wait a moment before trying again.",
+	CodeServerError:               "Trakt is having problems. Try again later.",
+	CodeServiceOverloaded:         "Trakt is overloaded or down for maintenance. Try again in a few minutes.",
+	CodeCloudflareError:           "Trakt can't be reached right now. Try again in a few minutes.",
+	CodeInsecureBaseURL:           "Use an https base URL, or allow plain http explicitly for testing.",
+	CodeInvalidArgument:           "A required value such as the client ID is missing. Check the configuration.",
+	CodeFlowNotFound:              "Start a new authorization.",
+	CodeFlowPending:               "Wait for the user to enter the code.",
+	CodeTooManyFlows:              "Wait for the pending authorizations to finish, then try again.",
+	CodeTimeout:                   "Trakt took too long to respond. Check your connection and try again.",
+	CodeNetwork:                   "Check your internet connection and try again.",
+	CodeInsecurePermissions:       "Make the token file readable only by you, for example with chmod 600.",
+	CodeNoStoredToken:             "Authorize the app to save a token first.",
+	CodeStoreLocked:               "Another program is using the token file. Wait for it to finish, or stop it, then try again.",
+	CodeUnsupportedFormatVersion:  "The token was saved by a newer version of this program. Update it, or authorize the app again.",
+	CodeRotationConflict:          "Another instance refreshed the token at the same time. Load the stored token again and retry.",
+	CodeTokenDecryption:           "Check the encryption key or passphrase, or authorize the app again to replace the token file.",
+	CodeMalformedResponse:         "Trakt's response was incomplete, which is often caused by a proxy in between. Try again.",
+}
+
+// ErrorHint returns a short suggestion of what the user can do about err, suitable for showing next to the error
+// in a CLI or UI, or "" if there is nothing useful to suggest. Hints for rate limiting include the wait from the
+// Retry-After header when Trakt sent one.
+//
+// Hints are advisory and written in English. Their wording may change between releases, so use Code to make
+// decisions based on an error.
+func ErrorHint(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var backoffErr *BackoffError
+	if errors.As(err, &backoffErr) {
+		return "Trakt asked to wait longer than the code had left. Request a new code and try again later."
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) && rateLimitErr.RetryAfter > 0 {
+		return fmt.Sprintf("Too many requests were made to Trakt. Wait %d seconds before trying again.", int64(math.Ceil(rateLimitErr.RetryAfter.Seconds())))
+	}
+
+	return errorHints[Code(err)]
+}
@@ -0,0 +1,82 @@
+package traktdeviceauth_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// hintlessCodes are the codes ErrorHint has nothing to suggest for, because they describe a mistake in the
+// calling program or an outcome the user chose.
+var hintlessCodes = map[string]bool{
+	"":                                    true,
+	traktdeviceauth.CodeUnexpectedStatus:  true,
+	traktdeviceauth.CodeFlowCancelled:     true,
+	traktdeviceauth.CodeCancelled:         true,
+	traktdeviceauth.CodeDecodeFailed:      true,
+	traktdeviceauth.CodeInvalidTransition: true,
+	traktdeviceauth.CodeTokenNotFound:     true,
+	traktdeviceauth.CodeSchedulerClosed:   true,
+	traktdeviceauth.CodeUnknown:           true,
+}
+
+func TestErrorHintEveryError(t *testing.T) {
+	// codeTests has every sentinel and the network errors, so this pins which of them get a hint.
+	hints := make(map[string]string)
+	for _, tt := range codeTests {
+		got := traktdeviceauth.ErrorHint(tt.err)
+		if tt.err != nil {
+			if wrapped := traktdeviceauth.ErrorHint(fmt.Errorf("wrapped: %w", tt.err)); wrapped != got {
+				t.Errorf("ErrorHint(%v) = %q, but %q when wrapped", tt.err, got, wrapped)
+			}
+		}
+		if (got == "") != hintlessCodes[tt.code] {
+			t.Errorf("ErrorHint(%v) = %q, want a hint: %v", tt.err, got, !hintlessCodes[tt.code])
+		}
+
+		// Errors with the same code get the same hint.
+		if hint, ok := hints[tt.code]; ok && hint != got {
+			t.Errorf("ErrorHint(%v) = %q, but %q for another error with code %q", tt.err, got, hint, tt.code)
+		}
+		hints[tt.code] = got
+	}
+
+	if hint := traktdeviceauth.ErrorHint(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}); !strings.Contains(hint, "internet connection") {
+		t.Errorf("the hint for a network error is %q", hint)
+	}
+	if hint := traktdeviceauth.ErrorHint(&traktdeviceauth.RateLimitError{}); !strings.Contains(hint, "Wait a moment") {
+		t.Errorf("the hint for rate limiting without Retry-After is %q", hint)
+	}
+}
+
+func TestErrorHint(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string // A substring of the hint, or "" for none.
+	}{
+		{nil, ""},
+		{errors.New("something else"), ""},
+		{traktdeviceauth.ErrForbidden, "client ID and secret"},
+		{&traktdeviceauth.RateLimitError{RetryAfter: 1500 * time.Millisecond}, "Wait 2 seconds"},
+		{&traktdeviceauth.BackoffError{Wait: time.Minute, Remaining: time.Second}, "Request a new code"},
+		{traktdeviceauth.ErrInsecurePermissions, "chmod 600"},
+		{traktdeviceauth.ErrTokenDecryption, "encryption key or passphrase"},
+		{traktdeviceauth.ErrUnsupportedFormatVersion, "newer version"},
+		{traktdeviceauth.ErrStoreLocked, "Another program"},
+		{traktdeviceauth.ErrNoStoredToken, "Authorize the app"},
+	}
+	for _, tt := range tests {
+		got := traktdeviceauth.ErrorHint(fmt.Errorf("wrapped: %w", tt.err))
+		if tt.err == nil {
+			got = traktdeviceauth.ErrorHint(nil)
+		}
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("ErrorHint(%v) = %q, want a hint containing %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// HookError is returned when a hook which was given a new token failed. The token returned along with it
+// is valid and must not be thrown away, since Trakt may have already revoked the one it replaces.
+type HookError struct {
+	Hook string // The name of the Option which registered the hook, such as "WithOnTokenRotated".
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %v", e.Hook, e.Err)
+}
+
+// Unwrap returns the error returned by the hook.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// WithTokenSaver calls save with every token obtained by this package, whether from RequestToken, a completed
+// PollForAuthToken or DeviceAuthFlow, or RefreshAccessToken, before the token is returned. ctx is the context of
+// the call which obtained the token.
+//
+// If save returns an error or panics, the token is still returned, along with a *HookError wrapping the error
+// or a *PanicError, so that the failure isn't silently lost.
+func WithTokenSaver(save func(ctx context.Context, t TokenResponse) error) Option {
+	return func(c *config) {
+		c.tokenSaver = save
+	}
+}
+
+// saveToken passes t to the function set by WithTokenSaver, if any.
+func (c config) saveToken(ctx context.Context, t TokenResponse) error {
+	if c.tokenSaver == nil {
+		return nil
+	}
+	if err := catchPanic("WithTokenSaver", func() error { return c.tokenSaver(ctx, t) }); err != nil {
+		return &HookError{Hook: "WithTokenSaver", Err: err}
+	}
+	return nil
+}
+
+// WithOnTokenRotated calls fn whenever a refresh returns a different refresh token than the one which was used,
+// which means the old one no longer works. fn is called before the refresh returns, so the new token can be
+// stored synchronously. RefreshAccessToken only knows the refresh token it was given, so that is the only field
+// set in old.
+//
+// If fn returns an error or panics, the refresh returns the new token along with a *HookError wrapping the
+// error or a *PanicError.
+func WithOnTokenRotated(fn func(old, new TokenResponse) error) Option {
+	return func(c *config) {
+		c.onTokenRotated = fn
+	}
+}
@@ -0,0 +1,234 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestOnTokenRotated(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.RotateRefreshToken())
+	issued := srv.IssueToken()
+
+	var tr trace
+	var old, rotated traktdeviceauth.TokenResponse
+	opts := append(srv.Options(),
+		traktdeviceauth.WithOnTokenRotated(func(o, n traktdeviceauth.TokenResponse) error {
+			tr.add("rotated")
+			old, rotated = o, n
+			return nil
+		}),
+		traktdeviceauth.WithTokenSaver(func(context.Context, traktdeviceauth.TokenResponse) error {
+			tr.add("saved")
+			return nil
+		}),
+	)
+	t2, err := traktdeviceauth.RefreshAccessTokenContext(context.Background(), issued.RefreshToken, "client-id", "client-secret", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tr.get(); len(got) != 2 || got[0] != "rotated" || got[1] != "saved" {
+		t.Errorf("got hooks %v, want the rotation reported before the token is saved", got)
+	}
+	if old.RefreshToken != issued.RefreshToken || rotated != t2 || t2.RefreshToken == issued.RefreshToken {
+		t.Errorf("the hook got %+v and %+v, want the old refresh token and the new token", old, rotated)
+	}
+}
+
+func TestOnTokenRotatedNotCalledWithoutRotation(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	issued := srv.IssueToken()
+
+	called := false
+	opts := append(srv.Options(), traktdeviceauth.WithOnTokenRotated(func(_, _ traktdeviceauth.TokenResponse) error {
+		called = true
+		return nil
+	}))
+	t2, err := traktdeviceauth.RefreshAccessTokenContext(context.Background(), issued.RefreshToken, "client-id", "client-secret", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t2.RefreshToken != issued.RefreshToken {
+		t.Fatal("the server rotated the refresh token without being scripted to")
+	}
+	if called {
+		t.Error("the hook was called although the refresh token didn't change")
+	}
+}
+
+func TestOnTokenRotatedFailure(t *testing.T) {
+	errDiskFull := errors.New("disk full")
+	tests := []struct {
+		name  string
+		hook  func(old, new traktdeviceauth.TokenResponse) error
+		check func(t *testing.T, err error)
+	}{
+		{"error", func(_, _ traktdeviceauth.TokenResponse) error { return errDiskFull }, func(t *testing.T, err error) {
+			if !errors.Is(err, errDiskFull) {
+				t.Errorf("got %v, want the saver's error", err)
+			}
+		}},
+		{"panic", func(_, _ traktdeviceauth.TokenResponse) error { panic("disk full") }, func(t *testing.T, err error) {
+			var panicErr *traktdeviceauth.PanicError
+			if !errors.As(err, &panicErr) || panicErr.Hook != "WithOnTokenRotated" || panicErr.Value != "disk full" {
+				t.Errorf("got %v, want a *PanicError", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.RotateRefreshToken())
+			issued := srv.IssueToken()
+
+			saved := false
+			opts := append(srv.Options(),
+				traktdeviceauth.WithOnTokenRotated(tt.hook),
+				traktdeviceauth.WithTokenSaver(func(context.Context, traktdeviceauth.TokenResponse) error {
+					saved = true
+					return nil
+				}),
+			)
+			ctx := context.Background()
+			t2, err := traktdeviceauth.RefreshAccessTokenContext(ctx, issued.RefreshToken, "client-id", "client-secret", opts...)
+
+			var hookErr *traktdeviceauth.HookError
+			if !errors.As(err, &hookErr) || hookErr.Hook != "WithOnTokenRotated" {
+				t.Fatalf("RefreshAccessTokenContext returned %v, want a *HookError", err)
+			}
+			tt.check(t, err)
+			if saved {
+				t.Error("the token was saved after the rotation hook failed")
+			}
+
+			// The token returned along with the error is the only one which still works.
+			if t2.AccessToken == "" {
+				t.Fatal("no token was returned along with the error")
+			}
+			if _, err := traktdeviceauth.RefreshAccessTokenContext(ctx, issued.RefreshToken, "client-id", "client-secret", srv.Options()...); !errors.Is(err, traktdeviceauth.ErrInvalidGrant) {
+				t.Errorf("refreshing with the old refresh token returned %v, want ErrInvalidGrant", err)
+			}
+			if _, err := traktdeviceauth.RefreshAccessTokenContext(ctx, t2.RefreshToken, "client-id", "client-secret", srv.Options()...); err != nil {
+				t.Errorf("refreshing with the returned refresh token: %v", err)
+			}
+		})
+	}
+}
+
+// tokenPaths obtains a token from srv with opts in every way the package can, by name.
+var tokenPaths = []struct {
+	name   string
+	obtain func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error)
+}{
+	{"RequestToken", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...)
+		if err != nil {
+			return traktdeviceauth.TokenResponse{}, err
+		}
+		return traktdeviceauth.RequestTokenContext(ctx, codeResp, "client-id", "client-secret", opts...)
+	}},
+	{"PollForAuthToken", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", srv.Options()...)
+		if err != nil {
+			return traktdeviceauth.TokenResponse{}, err
+		}
+		return traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, "client-id", "client-secret", opts...)
+	}},
+	{"DeviceAuthFlow", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		f := traktdeviceauth.NewDeviceAuthFlow("client-id", "client-secret", opts...)
+		if err := f.Start(ctx); err != nil {
+			return traktdeviceauth.TokenResponse{}, err
+		}
+		return f.Wait(ctx)
+	}},
+	{"RefreshAccessToken", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		return traktdeviceauth.RefreshAccessTokenContext(ctx, srv.IssueToken().RefreshToken, "client-id", "client-secret", opts...)
+	}},
+	{"TokenSource", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		src := traktdeviceauth.NewTokenSource(expiringToken(srv, time.Minute), "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(opts...))
+		return src.Token(ctx)
+	}},
+	{"AuthTransport", func(ctx context.Context, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) (traktdeviceauth.TokenResponse, error) {
+		src := traktdeviceauth.NewTokenSource(expiringToken(srv, time.Minute), "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(opts...))
+		var hookErr error
+		client := &http.Client{Transport: traktdeviceauth.NewTransport(src, "client-id", nil,
+			traktdeviceauth.WithTransportHookErrorHandler(func(_ *http.Request, err *traktdeviceauth.HookError) { hookErr = err }))}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+traktdeviceauth.EndpointUserSettings.String(), nil)
+		if err != nil {
+			return traktdeviceauth.TokenResponse{}, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return traktdeviceauth.TokenResponse{}, err
+		}
+		resp.Body.Close()
+		t, _ := src.Token(ctx)
+		return t, hookErr
+	}},
+}
+
+func TestTokenSaver(t *testing.T) {
+	for _, path := range tokenPaths {
+		t.Run(path.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+
+			var saved []traktdeviceauth.TokenResponse
+			ctx := context.WithValue(context.Background(), ctxKey{}, path.name)
+			opts := append(srv.Options(), traktdeviceauth.WithTokenSaver(func(saveCtx context.Context, t traktdeviceauth.TokenResponse) error {
+				if saveCtx.Value(ctxKey{}) != path.name {
+					return errors.New("the saver didn't get the call's context")
+				}
+				saved = append(saved, t)
+				return nil
+			}))
+
+			tok, err := path.obtain(ctx, srv, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 1 || saved[0].AccessToken != tok.AccessToken {
+				t.Errorf("saved %+v, want only the obtained token %q", saved, tok.AccessToken)
+			}
+		})
+	}
+}
+
+func TestTokenSaverFailure(t *testing.T) {
+	errDiskFull := errors.New("disk full")
+	for _, path := range tokenPaths {
+		t.Run(path.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+
+			opts := append(srv.Options(), traktdeviceauth.WithTokenSaver(func(context.Context, traktdeviceauth.TokenResponse) error {
+				return errDiskFull
+			}))
+			tok, err := path.obtain(context.Background(), srv, opts)
+
+			var hookErr *traktdeviceauth.HookError
+			if !errors.As(err, &hookErr) || hookErr.Hook != "WithTokenSaver" || !errors.Is(err, errDiskFull) {
+				t.Fatalf("got %v, want a *HookError wrapping the saver's error", err)
+			}
+			if tok.AccessToken == "" {
+				t.Fatal("the token wasn't returned along with the error")
+			}
+			if _, err := traktdeviceauth.GetUserSettingsContext(context.Background(), tok.AccessToken, "client-id", srv.Options()...); err != nil {
+				t.Errorf("the returned token doesn't work: %v", err)
+			}
+		})
+	}
+}
+
+// ctxKey is the context key TestTokenSaver checks the saver is called with.
+type ctxKey struct{}
@@ -0,0 +1,72 @@
+package traktdeviceauth
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// instruction is the translation of the sentence returned by Instructions. The verbs use explicit argument
+// indexes, %[1]s for the url, %[2]s for the code and %[3]d for the minutes left, so that every language can
+// order them as its grammar needs.
+type instruction struct {
+	one   string // Used when the code expires in one minute.
+	other string
+}
+
+// instructionTags lists the languages of instructionTexts, in the same order. English comes first, as the
+// matcher falls back to the first tag.
+var instructionTags = []language.Tag{
+	language.English,
+	language.German,
+	language.French,
+	language.Spanish,
+	language.Portuguese,
+	language.Italian,
+}
+
+var instructionTexts = []instruction{
+	{
+		one:   "Visit %[1]s and enter the code %[2]s. The code expires in %[3]d minute.",
+		other: "Visit %[1]s and enter the code %[2]s. The code expires in %[3]d minutes.",
+	},
+	{
+		one:   "Öffne %[1]s und gib den Code %[2]s ein. Der Code läuft in %[3]d Minute ab.",
+		other: "Öffne %[1]s und gib den Code %[2]s ein. Der Code läuft in %[3]d Minuten ab.",
+	},
+	{
+		one:   "Rendez-vous sur %[1]s et saisissez le code %[2]s. Le code expire dans %[3]d minute.",
+		other: "Rendez-vous sur %[1]s et saisissez le code %[2]s. Le code expire dans %[3]d minutes.",
+	},
+	{
+		one:   "Visita %[1]s e introduce el código %[2]s. El código caduca en %[3]d minuto.",
+		other: "Visita %[1]s e introduce el código %[2]s. El código caduca en %[3]d minutos.",
+	},
+	{
+		one:   "Acesse %[1]s e digite o código %[2]s. O código expira em %[3]d minuto.",
+		other: "Acesse %[1]s e digite o código %[2]s. O código expira em %[3]d minutos.",
+	},
+	{
+		one:   "Visita %[1]s e inserisci il codice %[2]s. Il codice scade tra %[3]d minuto.",
+		other: "Visita %[1]s e inserisci il codice %[2]s. Il codice scade tra %[3]d minuti.",
+	},
+}
+
+var instructionMatcher = language.NewMatcher(instructionTags)
+
+// Instructions returns a sentence telling the user where to enter the code in codeResp and how long it is
+// valid, in the language best matching the BCP 47 tag lang, such as "de" or "pt-BR". English, German, French,
+// Spanish, Portuguese and Italian are available, and anything else falls back to English.
+func Instructions(codeResp CodeResponse, lang string) string {
+	// Parsing errors still return a usable tag, or language.Und, which the matcher answers with English.
+	tag, _ := language.Parse(lang)
+	_, i, _ := instructionMatcher.Match(tag)
+
+	minutes := int((codeResp.ExpiresInDuration() + time.Minute - 1) / time.Minute)
+	text := instructionTexts[i].other
+	if minutes == 1 {
+		text = instructionTexts[i].one
+	}
+	return fmt.Sprintf(text, codeResp.VerificationURL, codeResp.UserCode, minutes)
+}
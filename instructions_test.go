@@ -0,0 +1,67 @@
+package traktdeviceauth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestInstructions(t *testing.T) {
+	codeResp := traktdeviceauth.CodeResponse{UserCode: "5055CC52", VerificationURL: "https://trakt.tv/activate", ExpiresIn: 600}
+	const english = "Visit https://trakt.tv/activate and enter the code 5055CC52. The code expires in 10 minutes."
+	tests := []struct {
+		lang string
+		want string
+	}{
+		{"en", english},
+		{"en-GB", english},
+		{"de", "Öffne https://trakt.tv/activate und gib den Code 5055CC52 ein. Der Code läuft in 10 Minuten ab."},
+		{"de-AT", "Öffne https://trakt.tv/activate und gib den Code 5055CC52 ein. Der Code läuft in 10 Minuten ab."},
+		{"fr", "Rendez-vous sur https://trakt.tv/activate et saisissez le code 5055CC52. Le code expire dans 10 minutes."},
+		{"fr-CA", "Rendez-vous sur https://trakt.tv/activate et saisissez le code 5055CC52. Le code expire dans 10 minutes."},
+		{"es", "Visita https://trakt.tv/activate e introduce el código 5055CC52. El código caduca en 10 minutos."},
+		{"es-419", "Visita https://trakt.tv/activate e introduce el código 5055CC52. El código caduca en 10 minutos."},
+		{"pt", "Acesse https://trakt.tv/activate e digite o código 5055CC52. O código expira em 10 minutos."},
+		{"pt-BR", "Acesse https://trakt.tv/activate e digite o código 5055CC52. O código expira em 10 minutos."},
+		{"it", "Visita https://trakt.tv/activate e inserisci il codice 5055CC52. Il codice scade tra 10 minuti."},
+		// Everything else falls back to English.
+		{"ja", english},
+		{"zh-Hant-TW", english},
+		{"", english},
+		{"not a tag!", english},
+	}
+	for _, tt := range tests {
+		got := traktdeviceauth.Instructions(codeResp, tt.lang)
+		if got != tt.want {
+			t.Errorf("Instructions(%q) = %q, want %q", tt.lang, got, tt.want)
+		}
+		if !strings.Contains(got, codeResp.UserCode) || !strings.Contains(got, codeResp.VerificationURL) {
+			t.Errorf("Instructions(%q) = %q, which lacks the code or url", tt.lang, got)
+		}
+	}
+}
+
+func TestInstructionsMinutes(t *testing.T) {
+	tests := []struct {
+		expiresIn int
+		lang      string
+		want      string
+	}{
+		// The minutes are rounded up, so that the user isn't told less time than there is.
+		{61, "en", "The code expires in 2 minutes."},
+		{60, "en", "The code expires in 1 minute."},
+		{30, "en", "The code expires in 1 minute."},
+		{60, "de", "Der Code läuft in 1 Minute ab."},
+		{60, "fr", "Le code expire dans 1 minute."},
+		{60, "es", "El código caduca en 1 minuto."},
+		{60, "pt", "O código expira em 1 minuto."},
+		{60, "it", "Il codice scade tra 1 minuto."},
+	}
+	for _, tt := range tests {
+		codeResp := traktdeviceauth.CodeResponse{UserCode: "CODE", VerificationURL: "https://trakt.tv/activate", ExpiresIn: tt.expiresIn}
+		if got := traktdeviceauth.Instructions(codeResp, tt.lang); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("Instructions(%q) for a code expiring in %ds = %q, want it to end with %q", tt.lang, tt.expiresIn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package interact runs the Trakt device authentication flow in a terminal, or anything else which can be
+// represented as an io.Reader and io.Writer. It is what the traktdeviceauth command line uses and is meant to
+// be embedded in other command line programs.
+package interact
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// Option customizes Run.
+type Option func(*config)
+
+// config holds the values set by a list of Options.
+type config struct {
+	clientOpts []traktdeviceauth.Option
+	countdown  time.Duration
+	lang       string
+}
+
+// WithClientOptions passes opts to every traktdeviceauth function called by Run.
+func WithClientOptions(opts ...traktdeviceauth.Option) Option {
+	return func(c *config) {
+		c.clientOpts = append(c.clientOpts, opts...)
+	}
+}
+
+// WithCountdown rewrites a line showing how long the code remains valid every interval while waiting for the
+// user. The line is redrawn using a carriage return, so it is only suited for terminals.
+func WithCountdown(interval time.Duration) Option {
+	return func(c *config) {
+		c.countdown = interval
+	}
+}
+
+// WithLanguage prints the instructions for the user in the language best matching the BCP 47 tag lang, as
+// returned by traktdeviceauth.Instructions. Without it, they are printed in English.
+func WithLanguage(lang string) Option {
+	return func(c *config) {
+		c.lang = lang
+	}
+}
+
+// Run authorizes an app by prompting in for the client id and secret if either is empty, printing the user code
+// and verification url to out, and waiting for the user to approve the code.
+func Run(ctx context.Context, in io.Reader, out io.Writer, clientID, clientSecret string, opts ...Option) (traktdeviceauth.TokenResponse, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	clientID, clientSecret = PromptCredentials(in, out, clientID, clientSecret)
+
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, clientID, c.clientOpts...)
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, err
+	}
+
+	if c.lang != "" {
+		fmt.Fprintln(out, traktdeviceauth.Instructions(codeResp, c.lang))
+	} else {
+		fmt.Fprintf(out, "Please visit %s and enter the following code: %s\n", codeResp.VerificationURL, codeResp.UserCode)
+	}
+
+	if c.countdown > 0 {
+		stop := countdown(out, time.Now().Add(codeResp.ExpiresInDuration()), c.countdown)
+		defer stop()
+	}
+
+	return traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, clientID, clientSecret, c.clientOpts...)
+}
+
+// PromptCredentials asks for the client id and secret on out and reads them from in, but only if they're empty.
+func PromptCredentials(in io.Reader, out io.Writer, clientID, clientSecret string) (string, string) {
+	if clientID != "" && clientSecret != "" {
+		return clientID, clientSecret
+	}
+
+	scanner := bufio.NewScanner(in)
+	if clientID == "" {
+		clientID = Input(scanner, out, "Please enter your app's client id: ")
+	}
+	if clientSecret == "" {
+		clientSecret = Input(scanner, out, "Please enter your app's client secret: ")
+	}
+	return clientID, clientSecret
+}
+
+// Input mimics Python's input function, which outputs a prompt and
+// takes bytes from stdin until a newline and returns a string.
+func Input(scanner *bufio.Scanner, w io.Writer, prompt string) string {
+	fmt.Fprint(w, prompt)
+	if ok := scanner.Scan(); ok {
+		return scanner.Text()
+	}
+	return ""
+}
+
+// countdown redraws the time remaining until expiresAt on out every interval until the returned function is called,
+// which also ends the line.
+func countdown(out io.Writer, expiresAt time.Time, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			remaining := time.Until(expiresAt).Round(time.Second)
+			if remaining < 0 {
+				remaining = 0
+			}
+			fmt.Fprintf(out, "\rThe code expires in %d:%02d ", int(remaining.Minutes()), int(remaining.Seconds())%60)
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				fmt.Fprintln(out)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
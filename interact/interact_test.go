@@ -0,0 +1,148 @@
+package interact_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/interact"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// newServer returns a fake server for the client-id app, scripted with scenarios, and the options to poll it
+// every few milliseconds.
+func newServer(t *testing.T, scenarios ...traktdeviceauthtest.Scenario) (*traktdeviceauthtest.Server, interact.Option) {
+	t.Helper()
+
+	srv := traktdeviceauthtest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+	srv.Script(scenarios...)
+	return srv, interact.WithClientOptions(append(srv.Options(), traktdeviceauth.WithPollInterval(10*time.Millisecond))...)
+}
+
+func TestRun(t *testing.T) {
+	_, opt := newServer(t, traktdeviceauthtest.ApproveAfterPolls(2))
+
+	var out bytes.Buffer
+	tok, err := interact.Run(context.Background(), strings.NewReader(""), &out, "client-id", "client-secret", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken == "" {
+		t.Error("Run returned a token without an access token")
+	}
+
+	// The fake server's user codes are eight hex digits.
+	want := regexp.MustCompile(`^Please visit ` + regexp.QuoteMeta(traktdeviceauthtest.VerificationURL) + ` and enter the following code: [0-9A-F]{8}\n$`)
+	if !want.MatchString(out.String()) {
+		t.Errorf("Run printed %q, want it to match %s", out.String(), want)
+	}
+}
+
+func TestRunPromptsForCredentials(t *testing.T) {
+	_, opt := newServer(t)
+
+	var out bytes.Buffer
+	if _, err := interact.Run(context.Background(), strings.NewReader("client-id\nclient-secret\n"), &out, "", "", opt); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Please enter your app's client id: Please enter your app's client secret: Please visit "; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("Run printed %q, want it to start with %q", out.String(), want)
+	}
+}
+
+func TestRunWithLanguage(t *testing.T) {
+	_, opt := newServer(t)
+
+	var out bytes.Buffer
+	if _, err := interact.Run(context.Background(), strings.NewReader(""), &out, "client-id", "client-secret", opt, interact.WithLanguage("de-AT")); err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^Öffne ` + regexp.QuoteMeta(traktdeviceauthtest.VerificationURL) + ` und gib den Code [0-9A-F]{8} ein. Der Code läuft in 10 Minuten ab.\n$`)
+	if !want.MatchString(out.String()) {
+		t.Errorf("Run printed %q, want it to match %s", out.String(), want)
+	}
+}
+
+func TestRunWithCountdown(t *testing.T) {
+	_, opt := newServer(t, traktdeviceauthtest.ApproveAfterPolls(5))
+
+	var out bytes.Buffer
+	if _, err := interact.Run(context.Background(), strings.NewReader(""), &out, "client-id", "client-secret", opt, interact.WithCountdown(5*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The countdown line is redrawn in place and ended once the flow is over.
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 3 || lines[2] != "" {
+		t.Fatalf("Run printed %q, want the instructions and one countdown line", out.String())
+	}
+	redraws := strings.Split(lines[1], "\r")
+	if len(redraws) < 3 || redraws[0] != "" {
+		t.Fatalf("the countdown line is %q, want it redrawn several times", lines[1])
+	}
+	for _, r := range redraws[1:] {
+		if r != "The code expires in 10:00 " && r != "The code expires in 9:59 " {
+			t.Errorf("the countdown showed %q", r)
+		}
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario traktdeviceauthtest.Scenario
+		secret   string
+		want     error
+	}{
+		{"denied", traktdeviceauthtest.DenyAfterPolls(1), "client-secret", traktdeviceauth.ErrDeviceCodeDenied},
+		{"expired", traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), "client-secret", traktdeviceauth.ErrDeviceCodeExpired},
+		{"wrong secret", nil, "wrong", traktdeviceauth.ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var scenarios []traktdeviceauthtest.Scenario
+			if tt.scenario != nil {
+				scenarios = append(scenarios, tt.scenario)
+			}
+			_, opt := newServer(t, scenarios...)
+
+			var out bytes.Buffer
+			if _, err := interact.Run(context.Background(), strings.NewReader(""), &out, "client-id", tt.secret, opt); !errors.Is(err, tt.want) {
+				t.Errorf("Run returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	_, opt := newServer(t, traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	if _, err := interact.Run(ctx, strings.NewReader(""), &out, "client-id", "client-secret", opt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestInput(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("first\n"))
+	var out bytes.Buffer
+	if got := interact.Input(scanner, &out, "> "); got != "first" {
+		t.Errorf("Input returned %q, want first", got)
+	}
+	if got := interact.Input(scanner, &out, "> "); got != "" {
+		t.Errorf("Input at the end of the input returned %q, want nothing", got)
+	}
+	if out.String() != "> > " {
+		t.Errorf("Input printed %q", out.String())
+	}
+}
@@ -0,0 +1,196 @@
+// Package k8sstore provides a traktdeviceauth.TokenStore which keeps the token in a key of a Kubernetes
+// Secret, so that workloads in a cluster can mount or read the token which a refreshing daemon keeps fresh.
+//
+// It is a separate module so that client-go only becomes a dependency of programs which use it.
+package k8sstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ErrForbidden is matched by errors.Is for errors caused by the Kubernetes API refusing access to the Secret,
+// which usually means the service account lacks an RBAC rule.
+var ErrForbidden error = errors.New("access to the secret was denied")
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithKey sets the key of the Secret the token is stored under. The default is "token.json".
+func WithKey(key string) Option {
+	return func(s *Store) {
+		s.key = key
+	}
+}
+
+// WithFieldManager sets the field manager used for server-side apply. The default is "traktdeviceauth".
+func WithFieldManager(name string) Option {
+	return func(s *Store) {
+		s.fieldManager = name
+	}
+}
+
+// WithConflictRetries sets how often Save retries an apply which failed because of a conflict or because the
+// API server was busy, and how long it waits before the first retry, which doubles for every retry after
+// that. The default is 5 retries starting at 200 milliseconds.
+func WithConflictRetries(n int, backoff time.Duration) Option {
+	return func(s *Store) {
+		s.retries, s.backoff = n, backoff
+	}
+}
+
+// Store is a traktdeviceauth.TokenStore which keeps the token in a key of a Secret as a
+// traktdeviceauth.StoredToken.
+type Store struct {
+	client       kubernetes.Interface
+	namespace    string
+	name         string
+	key          string
+	fieldManager string
+	retries      int
+	backoff      time.Duration
+}
+
+// New returns a Store which keeps the token in the Secret called name in namespace, using client.
+func New(client kubernetes.Interface, namespace, name string, opts ...Option) *Store {
+	s := &Store{
+		client:       client,
+		namespace:    namespace,
+		name:         name,
+		key:          "token.json",
+		fieldManager: "traktdeviceauth",
+		retries:      5,
+		backoff:      200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewFromEnvironment is like New, but creates the client from the in-cluster configuration when running in
+// a pod, and from the kubeconfig file named by $KUBECONFIG or ~/.kube/config otherwise.
+func NewFromEnvironment(namespace, name string, opts ...Option) (*Store, error) {
+	config, err := rest.InClusterConfig()
+	if errors.Is(err, rest.ErrNotInCluster) {
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("k8sstore.NewFromEnvironment: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("k8sstore.NewFromEnvironment: %w", err)
+	}
+	return New(client, namespace, name, opts...), nil
+}
+
+// ParseSecretRef splits a reference of the form namespace/name, as given on a command line. Without a
+// namespace, the namespace of the pod is used when running in a cluster, and "default" otherwise.
+func ParseSecretRef(ref string) (namespace, name string, err error) {
+	if i := strings.IndexByte(ref, '/'); i >= 0 {
+		namespace, name = ref[:i], ref[i+1:]
+	} else {
+		namespace, name = podNamespace(), ref
+	}
+	if namespace == "" || name == "" || strings.ContainsRune(name, '/') {
+		return "", "", fmt.Errorf("k8sstore.ParseSecretRef: %q isn't of the form namespace/name", ref)
+	}
+	return namespace, name, nil
+}
+
+// podNamespace returns the namespace of the pod the program runs in, or "default" outside of a cluster.
+func podNamespace() string {
+	b, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil || len(strings.TrimSpace(string(b))) == 0 {
+		return "default"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Save implements traktdeviceauth.TokenStore. The key is written with server-side apply, which creates the
+// Secret if needed and leaves its other keys alone.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("k8sstore.Save: %w", err)
+	}
+
+	secret := corev1ac.Secret(s.name, s.namespace).
+		WithType(corev1.SecretTypeOpaque).
+		WithData(map[string][]byte{s.key: b})
+	// The store owns its key, so taking it over from whoever wrote it before is intended.
+	applyOpts := metav1.ApplyOptions{FieldManager: s.fieldManager, Force: true}
+
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		_, err = s.client.CoreV1().Secrets(s.namespace).Apply(ctx, secret, applyOpts)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.retries || !retryable(err) {
+			return fmt.Errorf("k8sstore.Save: %w", s.classify("patch", err))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("k8sstore.Save: %w", ctx.Err())
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// Load implements traktdeviceauth.TokenStore. A missing Secret or key is reported as
+// traktdeviceauth.ErrNoStoredToken.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("k8sstore.Load: %s/%s: %w", s.namespace, s.name, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("k8sstore.Load: %w", s.classify("get", err))
+	}
+
+	b, ok := secret.Data[s.key]
+	if !ok {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("k8sstore.Load: %s/%s has no key %s: %w", s.namespace, s.name, s.key, traktdeviceauth.ErrNoStoredToken)
+	}
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("k8sstore.Load: %w", err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// retryable reports whether an apply which failed with err may succeed if it is tried again.
+func retryable(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) || apierrors.IsServiceUnavailable(err)
+}
+
+// classify turns an RBAC denial of verb into an error which says which permission is missing and matches
+// ErrForbidden.
+func (s *Store) classify(verb string, err error) error {
+	if !apierrors.IsForbidden(err) {
+		return err
+	}
+	return fmt.Errorf("%w: the service account needs permission to %s secrets in namespace %s (%v)", ErrForbidden, verb, s.namespace, err)
+}
@@ -0,0 +1,239 @@
+package k8sstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/k8sstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var secretsResource = schema.GroupResource{Resource: "secrets"}
+
+func testToken(access, refresh string, expiresIn time.Duration) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{AccessToken: access, RefreshToken: refresh, ExpiresAt: time.Now().Add(expiresIn).Truncate(time.Second)}
+}
+
+// sameToken reports whether a and b hold the same token, ignoring the location of their times.
+func sameToken(a, b traktdeviceauth.TokenResponse) bool {
+	return a.AccessToken == b.AccessToken && a.RefreshToken == b.RefreshToken && a.ExpiresAt.Equal(b.ExpiresAt)
+}
+
+func TestStore(t *testing.T) {
+	client := fake.NewClientset()
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets a Secret of its own.
+		return k8sstore.New(client, "default", strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name())))
+	})
+}
+
+// patchRecorder records the apply patches sent to a fake clientset, answering the first failures of them with
+// the given errors instead of passing them on.
+type patchRecorder struct {
+	mu       sync.Mutex
+	failures []error
+	patches  []k8stesting.PatchAction
+}
+
+func (r *patchRecorder) react(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.patches = append(r.patches, action.(k8stesting.PatchAction))
+	if len(r.failures) > 0 {
+		err, r.failures = r.failures[0], r.failures[1:]
+		return true, nil, err
+	}
+	return false, nil, nil
+}
+
+func newRecordedClient(failures ...error) (*fake.Clientset, *patchRecorder) {
+	client := fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "trakt", Namespace: "apps"},
+		Data:       map[string][]byte{"other": []byte("kept")},
+	})
+	r := &patchRecorder{failures: failures}
+	client.PrependReactor("patch", "secrets", r.react)
+	return client, r
+}
+
+func TestSavePatch(t *testing.T) {
+	client, r := newRecordedClient()
+	s := k8sstore.New(client, "apps", "trakt", k8sstore.WithKey("trakt.json"), k8sstore.WithFieldManager("token-syncer"))
+
+	tok := testToken("access", "refresh", time.Hour)
+	if err := s.Save(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.patches) != 1 {
+		t.Fatalf("%d patches were sent, want 1", len(r.patches))
+	}
+	p := r.patches[0]
+	if p.GetPatchType() != types.ApplyPatchType || p.GetNamespace() != "apps" || p.GetName() != "trakt" {
+		t.Errorf("sent a %s patch to %s/%s, want a server-side apply of apps/trakt", p.GetPatchType(), p.GetNamespace(), p.GetName())
+	}
+	var patch struct {
+		Kind     string            `json:"kind"`
+		Type     string            `json:"type"`
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Data     map[string][]byte `json:"data"`
+	}
+	if err := json.Unmarshal(p.GetPatch(), &patch); err != nil {
+		t.Fatalf("%v\n%s", err, p.GetPatch())
+	}
+	if patch.Kind != "Secret" || patch.Type != string(corev1.SecretTypeOpaque) || len(patch.Data) != 1 {
+		t.Errorf("the patch is %s, want an Opaque Secret with only the token key", p.GetPatch())
+	}
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(patch.Data["trakt.json"], &st); err != nil || !sameToken(st.TokenResponse(), tok) {
+		t.Errorf("the patch stores %s (%v), want the StoredToken of %+v", patch.Data["trakt.json"], err, tok)
+	}
+	if pa, ok := p.(k8stesting.PatchActionImpl); ok && (pa.PatchOptions.FieldManager != "token-syncer" || pa.PatchOptions.Force == nil || !*pa.PatchOptions.Force) {
+		t.Errorf("the patch options are %+v, want a forced apply by token-syncer", pa.PatchOptions)
+	}
+
+	// The apply leaves the other keys of the Secret alone.
+	secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), "trakt", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["other"]) != "kept" {
+		t.Errorf("the Secret holds %v after the apply, want the other key kept", secret.Data)
+	}
+	if got, err := s.Load(context.Background()); err != nil || !sameToken(got, tok) {
+		t.Errorf("Load returned %+v, %v, want the saved token", got, err)
+	}
+}
+
+func TestSaveRetriesConflicts(t *testing.T) {
+	conflict := apierrors.NewConflict(secretsResource, "trakt", errors.New("the object has been modified"))
+	busy := apierrors.NewTooManyRequests("slow down", 0)
+
+	tests := []struct {
+		name        string
+		failures    []error
+		retries     int
+		wantErr     bool
+		wantPatches int
+	}{
+		{"two conflicts", []error{conflict, conflict}, 5, false, 3},
+		{"busy API server", []error{busy}, 5, false, 2},
+		{"more conflicts than retries", []error{conflict, conflict, conflict}, 2, true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, r := newRecordedClient(tt.failures...)
+			s := k8sstore.New(client, "apps", "trakt", k8sstore.WithConflictRetries(tt.retries, time.Millisecond))
+
+			err := s.Save(context.Background(), testToken("access", "refresh", time.Hour))
+			if (err != nil) != tt.wantErr || tt.wantErr && !apierrors.IsConflict(errors.Unwrap(err)) {
+				t.Errorf("Save returned %v, want an error: %v", err, tt.wantErr)
+			}
+			if len(r.patches) != tt.wantPatches {
+				t.Errorf("%d patches were sent, want %d", len(r.patches), tt.wantPatches)
+			}
+		})
+	}
+}
+
+func TestSaveBackoff(t *testing.T) {
+	conflict := apierrors.NewConflict(secretsResource, "trakt", errors.New("the object has been modified"))
+	client, _ := newRecordedClient(conflict, conflict, conflict)
+	s := k8sstore.New(client, "apps", "trakt", k8sstore.WithConflictRetries(5, 20*time.Millisecond))
+
+	// The waits double: 20ms, 40ms and 80ms.
+	start := time.Now()
+	if err := s.Save(context.Background(), testToken("access", "refresh", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("three retries took %v, want at least 140ms of backoff", elapsed)
+	}
+
+	// A cancelled context stops the backoff.
+	client, _ = newRecordedClient(conflict)
+	s = k8sstore.New(client, "apps", "trakt", k8sstore.WithConflictRetries(5, time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Save(ctx, testToken("access", "refresh", time.Hour)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Save with an ending context returned %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	denied := apierrors.NewForbidden(secretsResource, "trakt", errors.New("RBAC: access denied"))
+
+	client, r := newRecordedClient(denied)
+	s := k8sstore.New(client, "apps", "trakt")
+	err := s.Save(context.Background(), testToken("access", "refresh", time.Hour))
+	if !errors.Is(err, k8sstore.ErrForbidden) || !strings.Contains(err.Error(), "permission to patch secrets in namespace apps") {
+		t.Errorf("Save returned %v, want ErrForbidden naming the missing permission", err)
+	}
+	if len(r.patches) != 1 {
+		t.Errorf("%d patches were sent, want a denial not to be retried", len(r.patches))
+	}
+
+	client.PrependReactor("get", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, denied
+	})
+	if _, err := s.Load(context.Background()); !errors.Is(err, k8sstore.ErrForbidden) || !strings.Contains(err.Error(), "permission to get secrets") {
+		t.Errorf("Load returned %v, want ErrForbidden naming the missing permission", err)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	client, _ := newRecordedClient()
+	tests := []struct {
+		name   string
+		secret string
+		key    string
+	}{
+		{"missing Secret", "missing", "token.json"},
+		{"missing key", "trakt", "token.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := k8sstore.New(client, "apps", tt.secret, k8sstore.WithKey(tt.key)).Load(context.Background())
+			if !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+				t.Errorf("Load returned %v, want ErrNoStoredToken", err)
+			}
+		})
+	}
+}
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		ref           string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{"apps/trakt", "apps", "trakt", false},
+		{"trakt", "default", "trakt", false}, // Outside of a cluster.
+		{"/trakt", "", "", true},
+		{"apps/", "", "", true},
+		{"apps/trakt/token", "", "", true},
+		{"", "", "", true},
+	}
+	for _, tt := range tests {
+		namespace, name, err := k8sstore.ParseSecretRef(tt.ref)
+		if namespace != tt.wantNamespace || name != tt.wantName || (err != nil) != tt.wantErr {
+			t.Errorf("ParseSecretRef(%q) = %q, %q, %v, want %q, %q with an error: %v", tt.ref, namespace, name, err, tt.wantNamespace, tt.wantName, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/BrenekH/go-traktdeviceauth/keyringstore
+
+go 1.22
+
+require (
+	github.com/BrenekH/go-traktdeviceauth v1.1.0
+	github.com/zalando/go-keyring v0.2.8
+)
+
+require (
+	github.com/danieljoos/wincred v1.2.3 // indirect
+	github.com/godbus/dbus/v5 v5.2.2 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
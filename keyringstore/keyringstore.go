@@ -0,0 +1,136 @@
+// Package keyringstore provides a traktdeviceauth.TokenStore which keeps the token in the credential manager
+// of the operating system: the Keychain on macOS, the Secret Service on Linux and the Credential Manager on
+// Windows, through github.com/zalando/go-keyring.
+//
+// The token is a traktdeviceauth.StoredToken as JSON, stored as the secret of the entry named after a service
+// and the client id of the app, so that apps sharing a service name don't overwrite each other's tokens.
+// Tests can call keyring.MockInit to replace the credential manager with an in-memory one.
+//
+// It is a separate module so that go-keyring only becomes a dependency of programs which use it.
+package keyringstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/zalando/go-keyring"
+)
+
+// NotFoundError is returned by Load and Delete when the credential manager has no entry for the token. It
+// unwraps to traktdeviceauth.ErrNoStoredToken.
+type NotFoundError struct {
+	Service string
+	User    string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no entry for %q in the keyring service %q: %v", e.User, e.Service, traktdeviceauth.ErrNoStoredToken)
+}
+
+// Unwrap returns traktdeviceauth.ErrNoStoredToken.
+func (e *NotFoundError) Unwrap() error {
+	return traktdeviceauth.ErrNoStoredToken
+}
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithKeyring sets the keyring the token is kept in. It defaults to the credential manager of the operating
+// system.
+func WithKeyring(k keyring.Keyring) Option {
+	return func(s *Store) {
+		s.keyring = k
+	}
+}
+
+// Store is a traktdeviceauth.TokenStore which keeps the token in the credential manager of the operating
+// system. The credential manager may ask the user to unlock it, so calls can block until ctx ends.
+type Store struct {
+	service string
+	user    string
+	keyring keyring.Keyring
+}
+
+// New returns a Store for the entry of clientID under service, which is usually the name of the program.
+func New(service, clientID string, opts ...Option) *Store {
+	s := &Store{service: service, user: clientID, keyring: osKeyring{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Save implements traktdeviceauth.TokenStore by replacing the entry, which is created if it doesn't exist yet.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("keyringstore.Save: %w", err)
+	}
+
+	if err := s.do(ctx, func() error { return s.keyring.Set(s.service, s.user, string(b)) }); err != nil {
+		return fmt.Errorf("keyringstore.Save: %w", err)
+	}
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore by reading the entry. If there is none, the error is a
+// *NotFoundError.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	var secret string
+	err := s.do(ctx, func() error {
+		var err error
+		secret, err = s.keyring.Get(s.service, s.user)
+		return err
+	})
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("keyringstore.Load: %w", err)
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal([]byte(secret), &st); err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("keyringstore.Load: the entry for %q in %q: %w", s.user, s.service, err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// Delete removes the entry, for example when the user signs out. If there is none, the error is a
+// *NotFoundError.
+func (s *Store) Delete(ctx context.Context) error {
+	if err := s.do(ctx, func() error { return s.keyring.Delete(s.service, s.user) }); err != nil {
+		return fmt.Errorf("keyringstore.Delete: %w", err)
+	}
+	return nil
+}
+
+// do runs fn, which calls the keyring, turning keyring.ErrNotFound into a *NotFoundError. The keyring can't be
+// cancelled, so if ctx ends first, fn is left to finish in the background and ctx's error is returned.
+func (s *Store) do(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, keyring.ErrNotFound) {
+			return &NotFoundError{Service: s.service, User: s.user}
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// osKeyring is the default keyring, which goes through the package-level functions of go-keyring so that
+// keyring.MockInit applies to it.
+type osKeyring struct{}
+
+func (osKeyring) Set(service, user, password string) error {
+	return keyring.Set(service, user, password)
+}
+func (osKeyring) Get(service, user string) (string, error) { return keyring.Get(service, user) }
+func (osKeyring) Delete(service, user string) error        { return keyring.Delete(service, user) }
+func (osKeyring) DeleteAll(service string) error           { return keyring.DeleteAll(service) }
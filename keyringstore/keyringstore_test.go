@@ -0,0 +1,109 @@
+package keyringstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/keyringstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/zalando/go-keyring"
+)
+
+func TestStore(t *testing.T) {
+	keyring.MockInit()
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets an entry of its own.
+		return keyringstore.New("keyringstore-test", t.Name())
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	keyring.MockInit()
+	ctx := context.Background()
+	s := keyringstore.New("keyringstore-test", "missing")
+
+	_, err := s.Load(ctx)
+	var notFound *keyringstore.NotFoundError
+	if !errors.As(err, &notFound) || !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Fatalf("Load returned %v, want a *NotFoundError wrapping ErrNoStoredToken", err)
+	}
+	if notFound.Service != "keyringstore-test" || notFound.User != "missing" {
+		t.Errorf("got %+v", notFound)
+	}
+	if err := s.Delete(ctx); !errors.As(err, &notFound) {
+		t.Errorf("Delete returned %v, want a *NotFoundError", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	keyring.MockInit()
+	ctx := context.Background()
+	s := keyringstore.New("keyringstore-test", "delete")
+
+	if err := s.Save(ctx, traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load after Delete returned %v, want ErrNoStoredToken", err)
+	}
+}
+
+func TestClientIDsDontShareEntries(t *testing.T) {
+	keyring.MockInit()
+	ctx := context.Background()
+
+	a := keyringstore.New("keyringstore-test", "client-a")
+	if err := a.Save(ctx, traktdeviceauth.TokenResponse{AccessToken: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyringstore.New("keyringstore-test", "client-b").Load(ctx); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("another client id loaded %v, want ErrNoStoredToken", err)
+	}
+}
+
+func TestContextEndsBeforeKeyring(t *testing.T) {
+	keyring.MockInit()
+	ctx := context.Background()
+
+	// The keyring passed with WithKeyring blocks, so Load has to return once ctx ends.
+	k := &blockingKeyring{unblock: make(chan struct{})}
+	s := keyringstore.New("keyringstore-test", "custom", keyringstore.WithKeyring(k))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.Load(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Load with a cancelled context returned %v, want context.Canceled", err)
+	}
+	close(k.unblock)
+}
+
+// blockingKeyring is a keyring.Keyring whose calls block until unblock is closed, like a credential manager
+// waiting for the user to unlock it.
+type blockingKeyring struct {
+	unblock chan struct{}
+}
+
+func (k *blockingKeyring) Set(service, user, password string) error {
+	<-k.unblock
+	return nil
+}
+
+func (k *blockingKeyring) Get(service, user string) (string, error) {
+	<-k.unblock
+	return "", keyring.ErrNotFound
+}
+
+func (k *blockingKeyring) Delete(service, user string) error {
+	<-k.unblock
+	return nil
+}
+
+func (k *blockingKeyring) DeleteAll(service string) error {
+	<-k.unblock
+	return nil
+}
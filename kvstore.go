@@ -0,0 +1,136 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultProfile is the name under which stores that implement both TokenStore and NamedStore keep the token
+// passed to Save.
+const DefaultProfile = "default"
+
+// ErrKeyNotFound must be returned, possibly wrapped, by KV.Get for keys which don't exist.
+var ErrKeyNotFound error = errors.New("key not found")
+
+// KV is a minimal key-value store, which KVStore turns into a TokenStore. Adapting a database such as bbolt, etcd
+// or Consul only requires implementing these three methods. They must be safe for concurrent use.
+type KV interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, val []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// KVStore is a TokenStore and NamedStore on top of a KV. Each token is kept as StoredToken JSON at the key
+// prefix followed by its name, and the token passed to Save is named DefaultProfile.
+type KVStore struct {
+	kv     KV
+	prefix string
+	codec  Codec
+}
+
+// KVOption customizes a KVStore.
+type KVOption func(*KVStore)
+
+// WithKVCodec makes the KVStore encode and decode tokens with codec instead of encoding/json.
+func WithKVCodec(codec Codec) KVOption {
+	return func(s *KVStore) {
+		s.codec = codec
+	}
+}
+
+// NewKVStore returns a KVStore which keeps tokens in kv, at keys starting with keyPrefix.
+func NewKVStore(kv KV, keyPrefix string, opts ...KVOption) *KVStore {
+	s := &KVStore{kv: kv, prefix: keyPrefix}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Save implements TokenStore.
+func (s *KVStore) Save(ctx context.Context, t TokenResponse) error {
+	return s.SaveNamed(ctx, DefaultProfile, t)
+}
+
+// Load implements TokenStore.
+func (s *KVStore) Load(ctx context.Context) (TokenResponse, error) {
+	return s.LoadNamed(ctx, DefaultProfile)
+}
+
+// SaveNamed implements NamedStore.
+func (s *KVStore) SaveNamed(ctx context.Context, name string, t TokenResponse) error {
+	b, err := codecOrDefault(s.codec).Marshal(NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("KVStore.SaveNamed: %w", err)
+	}
+	if err := s.kv.Put(ctx, s.prefix+name, b); err != nil {
+		return fmt.Errorf("KVStore.SaveNamed: %w", err)
+	}
+	return nil
+}
+
+// LoadNamed implements NamedStore. A key reported as missing by the KV is returned as ErrNoStoredToken.
+func (s *KVStore) LoadNamed(ctx context.Context, name string) (TokenResponse, error) {
+	b, err := s.kv.Get(ctx, s.prefix+name)
+	if errors.Is(err, ErrKeyNotFound) {
+		return TokenResponse{}, fmt.Errorf("KVStore.LoadNamed: %s: %w", name, ErrNoStoredToken)
+	} else if err != nil {
+		return TokenResponse{}, fmt.Errorf("KVStore.LoadNamed: %w", err)
+	}
+
+	var st StoredToken
+	if err := codecOrDefault(s.codec).Unmarshal(b, &st); err != nil {
+		return TokenResponse{}, fmt.Errorf("KVStore.LoadNamed: %s: %w", name, err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// Delete removes the token called name.
+func (s *KVStore) Delete(ctx context.Context, name string) error {
+	if err := s.kv.Delete(ctx, s.prefix+name); err != nil {
+		return fmt.Errorf("KVStore.Delete: %w", err)
+	}
+	return nil
+}
+
+// MemoryKV is a KV which keeps everything in memory, for tests and programs that don't need persistence.
+// The zero value is ready to use.
+type MemoryKV struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+// Get implements KV.
+func (m *MemoryKV) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	val, ok := m.m[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// Put implements KV.
+func (m *MemoryKV) Put(ctx context.Context, key string, val []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.m == nil {
+		m.m = make(map[string][]byte)
+	}
+	m.m[key] = append([]byte(nil), val...)
+	return nil
+}
+
+// Delete implements KV.
+func (m *MemoryKV) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.m, key)
+	return nil
+}
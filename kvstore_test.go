@@ -0,0 +1,163 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestKVStore(t *testing.T) {
+	kv := &traktdeviceauth.MemoryKV{}
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets a prefix of its own.
+		return traktdeviceauth.NewKVStore(kv, t.Name()+"/")
+	})
+}
+
+func TestKVStoreNamed(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return traktdeviceauth.Named(traktdeviceauth.NewKVStore(&traktdeviceauth.MemoryKV{}, "tokens/"), "alice")
+	})
+}
+
+func TestKVStoreKeys(t *testing.T) {
+	kv := &traktdeviceauth.MemoryKV{}
+	s := traktdeviceauth.NewKVStore(kv, "trakt/")
+	ctx := context.Background()
+	tok := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Unix(1700000000, 0)}
+
+	if err := s.Save(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveNamed(ctx, "alice", tok); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"trakt/" + traktdeviceauth.DefaultProfile, "trakt/alice"} {
+		b, err := kv.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		var st traktdeviceauth.StoredToken
+		if err := json.Unmarshal(b, &st); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if st.AccessToken != "access" || st.RefreshToken != "refresh" || !st.ExpiresAt.Equal(tok.ExpiresAt) {
+			t.Errorf("%s holds %+v, want the token as a StoredToken", key, st)
+		}
+	}
+
+	if err := s.Delete(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadNamed(ctx, "alice"); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("LoadNamed after Delete returned %v, want ErrNoStoredToken", err)
+	}
+	if _, err := s.Load(ctx); err != nil {
+		t.Errorf("Delete removed another profile: %v", err)
+	}
+}
+
+// failingKV is a KV whose calls fail with err.
+type failingKV struct {
+	err error
+}
+
+func (f failingKV) Get(ctx context.Context, key string) ([]byte, error)   { return nil, f.err }
+func (f failingKV) Put(ctx context.Context, key string, val []byte) error { return f.err }
+func (f failingKV) Delete(ctx context.Context, key string) error          { return f.err }
+
+func TestKVStoreErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// Only ErrKeyNotFound, even when wrapped, means that there is no token.
+	s := traktdeviceauth.NewKVStore(failingKV{err: fmt.Errorf("bucket tokens: %w", traktdeviceauth.ErrKeyNotFound)}, "")
+	if _, err := s.Load(ctx); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load with a wrapped ErrKeyNotFound returned %v, want ErrNoStoredToken", err)
+	}
+
+	unavailable := errors.New("connection refused")
+	s = traktdeviceauth.NewKVStore(failingKV{err: unavailable}, "")
+	if _, err := s.Load(ctx); !errors.Is(err, unavailable) || errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load returned %v, want the KV's error", err)
+	}
+	if err := s.Save(ctx, traktdeviceauth.TokenResponse{AccessToken: "access"}); !errors.Is(err, unavailable) {
+		t.Errorf("Save returned %v, want the KV's error", err)
+	}
+	if err := s.Delete(ctx, "alice"); !errors.Is(err, unavailable) {
+		t.Errorf("Delete returned %v, want the KV's error", err)
+	}
+
+	kv := &traktdeviceauth.MemoryKV{}
+	if err := kv.Put(ctx, "default", []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := traktdeviceauth.NewKVStore(kv, "").Load(ctx); err == nil || errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load of a corrupt value returned %v, want a decoding error", err)
+	}
+}
+
+// countingCodec is a Codec which uses encoding/json and counts its calls.
+type countingCodec struct {
+	mu                   sync.Mutex
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.mu.Lock()
+	c.marshals++
+	c.mu.Unlock()
+	return json.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.mu.Lock()
+	c.unmarshals++
+	c.mu.Unlock()
+	return json.Unmarshal(data, v)
+}
+
+func TestKVStoreCodec(t *testing.T) {
+	codec := &countingCodec{}
+	s := traktdeviceauth.NewKVStore(&traktdeviceauth.MemoryKV{}, "", traktdeviceauth.WithKVCodec(codec))
+	ctx := context.Background()
+
+	if err := s.Save(ctx, traktdeviceauth.TokenResponse{AccessToken: "access"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if codec.marshals != 1 || codec.unmarshals != 1 {
+		t.Errorf("the codec was used for %d marshals and %d unmarshals, want 1 each", codec.marshals, codec.unmarshals)
+	}
+}
+
+func TestMemoryKVCopies(t *testing.T) {
+	var kv traktdeviceauth.MemoryKV
+	ctx := context.Background()
+
+	if _, err := kv.Get(ctx, "missing"); !errors.Is(err, traktdeviceauth.ErrKeyNotFound) {
+		t.Errorf("Get of a missing key returned %v, want ErrKeyNotFound", err)
+	}
+	if err := kv.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	val := []byte("value")
+	if err := kv.Put(ctx, "key", val); err != nil {
+		t.Fatal(err)
+	}
+	val[0] = 'X'
+	got, _ := kv.Get(ctx, "key")
+	got[1] = 'X'
+	if got, _ := kv.Get(ctx, "key"); string(got) != "value" {
+		t.Errorf("the stored value changed to %q through a slice passed to Put or returned by Get", got)
+	}
+}
@@ -0,0 +1,80 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// malformedServer answers every request with a successful response holding body.
+func malformedServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMalformedTokenResponse(t *testing.T) {
+	const refreshToken = "76ba4c5c75c96f6087f58a4de10be6c00b29ea1ddc3b2022ee2016d1363e3a7c"
+	tests := []struct {
+		name    string
+		body    string
+		field   string
+		problem string
+	}{
+		{"truncated", traktdeviceauthtest.FixtureTruncatedTokenResponse.Body, "access_token", "is missing"},
+		{"no token type", `{"access_token":"access","refresh_token":"` + refreshToken + `","created_at":1487889741}`, "token_type", "is missing"},
+		{"no refresh token", `{"access_token":"access","token_type":"bearer","created_at":1487889741}`, "refresh_token", "is missing"},
+		{"no created_at", `{"access_token":"access","token_type":"bearer","refresh_token":"` + refreshToken + `"}`, "created_at", "is missing"},
+		{"created_at in milliseconds", `{"access_token":"access","token_type":"bearer","refresh_token":"` + refreshToken + `","created_at":1487889741000}`, "created_at", "is implausible (1487889741000)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []traktdeviceauth.Option{traktdeviceauth.WithBaseURL(malformedServer(t, tt.body).URL)}
+			ctx := context.Background()
+
+			// Both ways of getting a token check the response.
+			_, pollErr := traktdeviceauth.RequestTokenContext(ctx, traktdeviceauth.CodeResponse{DeviceCode: "code", ExpiresIn: 600}, "client-id", "client-secret", opts...)
+			_, refreshErr := traktdeviceauth.RefreshAccessTokenContext(ctx, "refresh", "client-id", "client-secret", opts...)
+			for _, err := range []error{pollErr, refreshErr} {
+				var malformedErr *traktdeviceauth.MalformedResponseError
+				if !errors.As(err, &malformedErr) || !errors.Is(err, traktdeviceauth.ErrMalformedResponse) {
+					t.Fatalf("got %v, want a *MalformedResponseError", err)
+				}
+				if malformedErr.Field != tt.field || malformedErr.Problem != tt.problem {
+					t.Errorf("%s %s was reported, want %s %s", malformedErr.Field, malformedErr.Problem, tt.field, tt.problem)
+				}
+				if strings.Contains(err.Error(), refreshToken) {
+					t.Errorf("the error %q shows the refresh token", err)
+				}
+				if code := traktdeviceauth.Code(err); code != traktdeviceauth.CodeMalformedResponse {
+					t.Errorf("Code() = %q, want %q", code, traktdeviceauth.CodeMalformedResponse)
+				}
+			}
+		})
+	}
+}
+
+func TestOptionalRefreshToken(t *testing.T) {
+	srv := malformedServer(t, `{"access_token":"access","token_type":"bearer","expires_in":7776000,"created_at":1487889741}`)
+
+	tok, err := traktdeviceauth.RefreshAccessTokenContext(context.Background(), "refresh", "client-id", "client-secret",
+		traktdeviceauth.WithBaseURL(srv.URL), traktdeviceauth.WithOptionalRefreshToken())
+	if err != nil {
+		t.Fatalf("a response without a refresh token was rejected with WithOptionalRefreshToken: %v", err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "" {
+		t.Errorf("got %+v", tok)
+	}
+}
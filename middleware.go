@@ -0,0 +1,92 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"net/http"
+)
+
+// RoundTripFunc sends a single HTTP request and returns its response, like http.Client.Do.
+type RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps the RoundTripFunc used for HTTP calls. A Middleware can change the request before calling
+// next, inspect or replace the response afterwards, or return without calling next at all to short-circuit
+// the request, for example to serve it from a cache.
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+// WithMiddleware wraps every HTTP call made by this package in m. Every attempt is a separate call, so each
+// poll made by PollForAuthToken passes through the chain individually. The first Middleware is the outermost,
+// which means it sees the request first and the response last. Using WithMiddleware more than once appends
+// to the chain.
+//
+// Responses returned by the chain are handled the same way as ones from the network, including WithErrorMapper
+// and the status code mapping.
+func WithMiddleware(m ...Middleware) Option {
+	m = append([]Middleware(nil), m...)
+	return func(c *config) {
+		c.middleware = append(c.middleware[:len(c.middleware):len(c.middleware)], m...)
+	}
+}
+
+// RequestEditor adapts fn into a Middleware which calls it before every request is sent, for example to add
+// headers. If fn returns an error or panics, the request isn't sent and the error, or a *PanicError, is returned
+// instead.
+func RequestEditor(fn func(req *http.Request) error) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			if err := catchPanic("RequestEditor", func() error { return fn(req) }); err != nil {
+				return nil, err
+			}
+			return next(req)
+		}
+	}
+}
+
+// ResponseHook adapts fn into a Middleware which calls it with every response before it is handled by this
+// package. The response body must not be consumed by fn. fn is only observing, so a panic in it is passed to the
+// WithPanicHandler handler of the call and the response is handled as usual.
+func ResponseHook(fn func(resp *http.Response)) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := next(req)
+			if err == nil {
+				panicHandlerOf(req).observe("ResponseHook", func() { fn(resp) })
+			}
+			return resp, err
+		}
+	}
+}
+
+// defaultHTTPClient sends the requests of calls without WithHTTPClient. It is separate from http.DefaultClient so
+// that changes other packages make to that one don't affect this package. Requests are limited by
+// WithRequestTimeout rather than by its Timeout, which couldn't be overridden per call.
+var defaultHTTPClient = &http.Client{}
+
+// roundTripper returns the RoundTripFunc for requests, which uses the WithHTTPClient client, wrapped in the chain
+// set by WithMiddleware.
+func (c config) roundTripper() RoundTripFunc {
+	client := c.httpClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	rt := RoundTripFunc(client.Do)
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		rt = c.middleware[i](rt)
+	}
+	if c.panicHandler == nil || len(c.middleware) == 0 {
+		return rt
+	}
+	return func(req *http.Request) (*http.Response, error) {
+		// Middleware only gets the request, so the handler for panics in callbacks such as ResponseHook's travels in
+		// its context.
+		return rt(req.WithContext(context.WithValue(req.Context(), panicHandlerKey{}, c.panicHandler)))
+	}
+}
+
+// panicHandlerKey is the context key for the WithPanicHandler handler of the call which sent a request.
+type panicHandlerKey struct{}
+
+// panicHandlerOf returns a config which reports panics to the WithPanicHandler handler of the call which sent req.
+func panicHandlerOf(req *http.Request) config {
+	handler, _ := req.Context().Value(panicHandlerKey{}).(func(err *PanicError))
+	return config{panicHandler: handler}
+}
@@ -0,0 +1,126 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// trace is a goroutine-safe record of what middlewares saw.
+type trace struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (tr *trace) add(event string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.events = append(tr.events, event)
+}
+
+func (tr *trace) get() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]string(nil), tr.events...)
+}
+
+// named returns a Middleware which records name before and after calling next.
+func (tr *trace) named(name string) traktdeviceauth.Middleware {
+	return func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			tr.add(name + " request")
+			resp, err := next(req)
+			tr.add(name + " response")
+			return resp, err
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var tr trace
+	opts := append(srv.Options(),
+		traktdeviceauth.WithMiddleware(tr.named("outer"), tr.named("middle")),
+		traktdeviceauth.WithMiddleware(tr.named("inner")),
+	)
+	if _, err := traktdeviceauth.GenerateNewCode("client-id", opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"outer request", "middle request", "inner request", "inner response", "middle response", "outer response"}
+	if got := tr.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// The cache answers without calling next, so the request never reaches the server.
+	cache := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			return traktdeviceauthtest.FixtureCodeResponse.Response(req), nil
+		}
+	}
+	codeResp, err := traktdeviceauth.GenerateNewCode("client-id", append(srv.Options(), traktdeviceauth.WithMiddleware(cache))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeResp.UserCode != "5055CC52" {
+		t.Errorf("got the code %q, want the cached 5055CC52", codeResp.UserCode)
+	}
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("%d requests reached the server", n)
+	}
+
+	// A RequestEditor which fails stops the request as well.
+	errRefused := errors.New("refused")
+	editor := traktdeviceauth.RequestEditor(func(req *http.Request) error { return errRefused })
+	if _, err := traktdeviceauth.GenerateNewCode("client-id", append(srv.Options(), traktdeviceauth.WithMiddleware(editor))...); !errors.Is(err, errRefused) {
+		t.Errorf("GenerateNewCode returned %v, want the editor's error", err)
+	}
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("%d requests reached the server", n)
+	}
+}
+
+func TestMiddlewareSeesEveryAttempt(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(
+		traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Status(http.StatusInternalServerError), traktdeviceauthtest.Succeed()),
+		traktdeviceauthtest.ApproveAfterPolls(3),
+	)
+
+	var statuses []int
+	hook := traktdeviceauth.ResponseHook(func(resp *http.Response) { statuses = append(statuses, resp.StatusCode) })
+	opts := append(srv.Options(),
+		traktdeviceauth.WithMiddleware(hook),
+		traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{MaxAttempts: 3}),
+	)
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", opts...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.PollForAuthToken(ctx, codeResp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three attempts for the code, then three unclaimed polls and the one which is approved.
+	want := []int{503, 500, 200, 400, 400, 400, 200}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("the middleware saw %v, want %v", statuses, want)
+	}
+}
@@ -0,0 +1,235 @@
+// Package mobile wraps traktdeviceauth in an API that can be bound by gomobile for use in Android and iOS apps.
+//
+// gomobile can't bind channels, contexts, or structs with time.Time fields, so this package only uses strings,
+// integers, and callback interfaces. Times are unix seconds and errors are reported as the Error* codes below.
+package mobile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// Error codes reported to Callback.OnFailed. These values are stable and safe to persist or compare against.
+const (
+	ErrorUnknown              = 1
+	ErrorCancelled            = 2
+	ErrorTimeout              = 3
+	ErrorNotStarted           = 4
+	ErrorNetwork              = 5
+	ErrorForbidden            = 6
+	ErrorInvalidDeviceCode    = 7
+	ErrorDeviceCodeExpired    = 8
+	ErrorDeviceCodeDenied     = 9
+	ErrorAlreadyApproved      = 10
+	ErrorRateLimited          = 11
+	ErrorServerUnavailable    = 12
+	ErrorInvalidGrant         = 13
+	ErrorUnexpectedStatusCode = 14
+)
+
+// Callback receives the outcome of DeviceAuthSession.Poll. Exactly one of its methods is called per Poll.
+type Callback interface {
+	OnApproved(accessToken, refreshToken string, expiresAtUnix int64)
+	OnFailed(code int, message string)
+}
+
+// DeviceAuthSession runs a single device authentication flow.
+type DeviceAuthSession struct {
+	callback Callback
+	baseURL  string
+
+	mu           sync.Mutex
+	clientID     string
+	clientSecret string
+	codeResp     traktdeviceauth.CodeResponse
+	started      bool
+	poll         *poll // The Poll in progress, if any.
+
+	extraOpts []traktdeviceauth.Option // Added to every request, so that tests can poll without waiting.
+}
+
+// poll is a single call to DeviceAuthSession.Poll.
+type poll struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// NewDeviceAuthSession creates a DeviceAuthSession which reports its outcome to callback.
+func NewDeviceAuthSession(callback Callback) *DeviceAuthSession {
+	return &DeviceAuthSession{callback: callback}
+}
+
+// SetBaseURL changes the server the session talks to, for example the Trakt staging server.
+// It must be called before Start.
+func (s *DeviceAuthSession) SetBaseURL(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.baseURL = url
+}
+
+// Start generates a new device code. Afterwards, UserCode and VerificationURL should be shown to the user
+// and Poll called to wait for them to approve it.
+func (s *DeviceAuthSession) Start(clientID, clientSecret string) error {
+	s.mu.Lock()
+	opts := s.options()
+	s.mu.Unlock()
+
+	codeResp, err := traktdeviceauth.GenerateNewCode(clientID, opts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientID = clientID
+	s.clientSecret = clientSecret
+	s.codeResp = codeResp
+	s.started = true
+	return nil
+}
+
+// UserCode returns the code the user needs to enter, or an empty string if Start hasn't succeeded.
+func (s *DeviceAuthSession) UserCode() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.codeResp.UserCode
+}
+
+// VerificationURL returns the url the user needs to visit, or an empty string if Start hasn't succeeded.
+func (s *DeviceAuthSession) VerificationURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.codeResp.VerificationURL
+}
+
+// ExpiresInSeconds returns how long the code lasts after Start, in seconds.
+func (s *DeviceAuthSession) ExpiresInSeconds() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(s.codeResp.ExpiresIn)
+}
+
+// Poll waits in the background for the user to approve the code and reports the outcome to the Callback.
+// A timeoutSeconds of zero or less waits until the code expires. A Poll which is still waiting is cancelled,
+// and reports ErrorCancelled, so that only one Poll runs at a time.
+func (s *DeviceAuthSession) Poll(timeoutSeconds int64) {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		s.callback.OnFailed(ErrorNotStarted, "Start must be called before Poll")
+		return
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	}
+	ctx, cancelPoll := context.WithCancel(ctx)
+	if s.poll != nil {
+		s.poll.cancelled = true
+		s.poll.cancel()
+	}
+	p := &poll{cancel: cancelPoll}
+	s.poll = p
+
+	codeResp, clientID, clientSecret, opts := s.codeResp, s.clientID, s.clientSecret, s.options()
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		defer cancelPoll()
+
+		t, err := traktdeviceauth.PollForAuthTokenContext(ctx, codeResp, clientID, clientSecret, opts...)
+
+		s.mu.Lock()
+		cancelled := p.cancelled
+		if s.poll == p {
+			s.poll = nil
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			if cancelled {
+				s.callback.OnFailed(ErrorCancelled, "the session was cancelled")
+				return
+			}
+			// PollForAuthToken stops at the code's expiry, which isn't a timeout set by the caller.
+			if codeResp.IsExpired() && errors.Is(err, context.DeadlineExceeded) {
+				s.callback.OnFailed(ErrorDeviceCodeExpired, traktdeviceauth.ErrDeviceCodeExpired.Error())
+				return
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				s.callback.OnFailed(ErrorTimeout, err.Error())
+				return
+			}
+			s.callback.OnFailed(errorCode(err), err.Error())
+			return
+		}
+
+		s.callback.OnApproved(t.AccessToken, t.RefreshToken, t.ExpiresAt.Unix())
+	}()
+}
+
+// Cancel stops an in-progress Poll, which reports ErrorCancelled. Poll can be called again afterwards.
+func (s *DeviceAuthSession) Cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.poll != nil {
+		s.poll.cancelled = true
+		s.poll.cancel()
+		s.poll = nil
+	}
+}
+
+// options returns the traktdeviceauth options for the session. s.mu must be held.
+func (s *DeviceAuthSession) options() []traktdeviceauth.Option {
+	opts := append([]traktdeviceauth.Option(nil), s.extraOpts...)
+	if s.baseURL != "" {
+		opts = append(opts, traktdeviceauth.WithBaseURL(s.baseURL))
+	}
+	return opts
+}
+
+// errorCode converts an error returned by traktdeviceauth into one of the Error* codes.
+func errorCode(err error) int {
+	var netErr interface{ Timeout() bool }
+
+	switch {
+	case errors.Is(err, traktdeviceauth.ErrForbidden):
+		return ErrorForbidden
+	case errors.Is(err, traktdeviceauth.ErrInvalidDeviceCode):
+		return ErrorInvalidDeviceCode
+	case errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired):
+		return ErrorDeviceCodeExpired
+	case errors.Is(err, traktdeviceauth.ErrDeviceCodeDenied):
+		return ErrorDeviceCodeDenied
+	case errors.Is(err, traktdeviceauth.ErrDeviceCodeAlreadyApproved):
+		return ErrorAlreadyApproved
+	case errors.Is(err, traktdeviceauth.ErrPollRateTooFast):
+		return ErrorRateLimited
+	case errors.Is(err, traktdeviceauth.ErrServerError),
+		errors.Is(err, traktdeviceauth.ErrServiceOverloaded),
+		errors.Is(err, traktdeviceauth.ErrCloudflareError):
+		return ErrorServerUnavailable
+	case errors.Is(err, traktdeviceauth.ErrInvalidGrant):
+		return ErrorInvalidGrant
+	case errors.Is(err, traktdeviceauth.ErrUnexpectedStatusCode):
+		return ErrorUnexpectedStatusCode
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &netErr):
+		return ErrorNetwork
+	default:
+		return ErrorUnknown
+	}
+}
@@ -0,0 +1,207 @@
+package mobile
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// outcome is a single call to a Callback method.
+type outcome struct {
+	approved     bool
+	accessToken  string
+	refreshToken string
+	expiresAt    int64
+	code         int
+	message      string
+}
+
+// recorder is a Callback which sends every outcome to a channel.
+type recorder chan outcome
+
+func (r recorder) OnApproved(accessToken, refreshToken string, expiresAtUnix int64) {
+	r <- outcome{approved: true, accessToken: accessToken, refreshToken: refreshToken, expiresAt: expiresAtUnix}
+}
+
+func (r recorder) OnFailed(code int, message string) {
+	r <- outcome{code: code, message: message}
+}
+
+// next waits for the next outcome.
+func (r recorder) next(t *testing.T) outcome {
+	t.Helper()
+
+	select {
+	case o := <-r:
+		return o
+	case <-time.After(10 * time.Second):
+		t.Fatal("the callback wasn't called")
+		return outcome{}
+	}
+}
+
+// none checks that no further outcome arrives within d.
+func (r recorder) none(t *testing.T, d time.Duration) {
+	t.Helper()
+
+	select {
+	case o := <-r:
+		t.Fatalf("unexpected callback %+v", o)
+	case <-time.After(d):
+	}
+}
+
+// newSession starts a session against a fake server scripted with scenarios.
+func newSession(t *testing.T, scenarios ...traktdeviceauthtest.Scenario) (*DeviceAuthSession, recorder) {
+	t.Helper()
+
+	srv := traktdeviceauthtest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.Script(scenarios...)
+
+	rec := make(recorder, 4)
+	s := NewDeviceAuthSession(rec)
+	s.SetBaseURL(srv.URL)
+	s.extraOpts = []traktdeviceauth.Option{traktdeviceauth.WithPollInterval(20 * time.Millisecond)}
+	if err := s.Start("client-id", "client-secret"); err != nil {
+		t.Fatal(err)
+	}
+	return s, rec
+}
+
+func TestSessionApproved(t *testing.T) {
+	s, rec := newSession(t, traktdeviceauthtest.ApproveAfterPolls(2))
+	if s.UserCode() == "" || s.VerificationURL() != traktdeviceauthtest.VerificationURL {
+		t.Fatalf("got user code %q and url %q", s.UserCode(), s.VerificationURL())
+	}
+	if got := s.ExpiresInSeconds(); got != 600 {
+		t.Errorf("ExpiresInSeconds() = %d, want 600", got)
+	}
+
+	s.Poll(0)
+	o := rec.next(t)
+	if !o.approved || o.accessToken == "" || o.refreshToken == "" {
+		t.Fatalf("got %+v, want an approval with tokens", o)
+	}
+	if o.expiresAt <= time.Now().Unix() {
+		t.Errorf("expiresAt %d is in the past", o.expiresAt)
+	}
+	rec.none(t, 100*time.Millisecond)
+}
+
+func TestSessionFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario traktdeviceauthtest.Scenario
+		want     int
+	}{
+		{"denied", traktdeviceauthtest.DenyAfterPolls(1), ErrorDeviceCodeDenied},
+		{"expired by the server", traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), ErrorDeviceCodeExpired},
+		{"forbidden", traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(403)), ErrorForbidden},
+		{"server error", traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(503)), ErrorServerUnavailable},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, rec := newSession(t, tt.scenario)
+			s.Poll(0)
+			if o := rec.next(t); o.approved || o.code != tt.want {
+				t.Fatalf("got %+v, want code %d", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionCodeExpiresWhilePolling(t *testing.T) {
+	// The code expires while a poll is waiting for the server, so polling ends at the code's own deadline,
+	// which isn't a timeout set by the caller.
+	stop := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == traktdeviceauth.EndpointDeviceCode.String() {
+			io.WriteString(w, `{"device_code":"code","user_code":"USER","verification_url":"https://trakt.tv/activate","expires_in":1,"interval":1}`)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer slow.Close()
+	defer close(stop)
+
+	rec := make(recorder, 1)
+	s := NewDeviceAuthSession(rec)
+	s.SetBaseURL(slow.URL)
+	s.extraOpts = []traktdeviceauth.Option{traktdeviceauth.WithPollInterval(20 * time.Millisecond), traktdeviceauth.WithRequestTimeout(0)}
+	if err := s.Start("client-id", "client-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Poll(0)
+	if o := rec.next(t); o.code != ErrorDeviceCodeExpired {
+		t.Fatalf("got %+v, want ErrorDeviceCodeExpired", o)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	s, rec := newSession(t, traktdeviceauthtest.ApproveAfterPolls(1000))
+	s.Poll(1)
+	if o := rec.next(t); o.code != ErrorTimeout {
+		t.Fatalf("got %+v, want ErrorTimeout", o)
+	}
+}
+
+func TestSessionPollBeforeStart(t *testing.T) {
+	rec := make(recorder, 1)
+	NewDeviceAuthSession(rec).Poll(0)
+	if o := rec.next(t); o.code != ErrorNotStarted {
+		t.Fatalf("got %+v, want ErrorNotStarted", o)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	s, rec := newSession(t, traktdeviceauthtest.ApproveAfterPolls(1000))
+	s.Poll(0)
+	s.Cancel()
+	if o := rec.next(t); o.code != ErrorCancelled {
+		t.Fatalf("got %+v, want ErrorCancelled", o)
+	}
+	rec.none(t, 100*time.Millisecond)
+}
+
+func TestSessionPollAfterCancel(t *testing.T) {
+	// A failure of a new Poll must not be reported as a cancellation because an earlier Poll was cancelled.
+	s, rec := newSession(t, traktdeviceauthtest.DenyAfterPolls(3))
+	s.Poll(0)
+	s.Cancel()
+	if o := rec.next(t); o.code != ErrorCancelled {
+		t.Fatalf("got %+v, want ErrorCancelled", o)
+	}
+
+	s.Poll(0)
+	if o := rec.next(t); o.code != ErrorDeviceCodeDenied {
+		t.Fatalf("got %+v, want ErrorDeviceCodeDenied", o)
+	}
+}
+
+func TestSessionSecondPollCancelsFirst(t *testing.T) {
+	s, rec := newSession(t, traktdeviceauthtest.ApproveAfterPolls(5))
+	s.Poll(0)
+	s.Poll(0)
+
+	if o := rec.next(t); o.code != ErrorCancelled {
+		t.Fatalf("first outcome %+v, want ErrorCancelled for the first Poll", o)
+	}
+	if o := rec.next(t); !o.approved {
+		t.Fatalf("second outcome %+v, want an approval for the second Poll", o)
+	}
+	rec.none(t, 100*time.Millisecond)
+}
@@ -0,0 +1,283 @@
+// Package opstore provides a traktdeviceauth.TokenStore which keeps the token in a 1Password item, through the
+// 1Password CLI, op.
+//
+// The token is a traktdeviceauth.StoredToken as JSON in a concealed field of the item, which is a Secure Note
+// created by the first Save. The store runs op item get, op item create and op item edit, passing items to the
+// latter two on stdin so that the token never appears in the arguments of a process. op must be version 2 or
+// later, and signed in, either interactively, through the desktop app integration, or with a service account
+// token in OP_SERVICE_ACCOUNT_TOKEN, which op reads from the environment it inherits.
+package opstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// ErrNotSignedIn is wrapped by the errors of a Store when op isn't signed in to 1Password, or its session has
+// expired, so that programs can tell the user to run op signin instead of reporting a broken store.
+var ErrNotSignedIn error = errors.New("op isn't signed in to 1Password")
+
+// NotFoundError is returned by Load when the item doesn't exist, or doesn't have the token field.
+// It unwraps to traktdeviceauth.ErrNoStoredToken.
+type NotFoundError struct {
+	Vault string
+	Item  string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no item %q in the 1Password vault %q: %v", e.Item, e.Vault, traktdeviceauth.ErrNoStoredToken)
+}
+
+// Unwrap returns traktdeviceauth.ErrNoStoredToken.
+func (e *NotFoundError) Unwrap() error {
+	return traktdeviceauth.ErrNoStoredToken
+}
+
+// AuthError is returned when op fails because it isn't signed in. It unwraps to ErrNotSignedIn.
+type AuthError struct {
+	Stderr string // What op wrote to stderr.
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrNotSignedIn, e.Stderr)
+}
+
+// Unwrap returns ErrNotSignedIn.
+func (e *AuthError) Unwrap() error {
+	return ErrNotSignedIn
+}
+
+// CommandError is returned by a Runner when op couldn't be run or exited with an error.
+type CommandError struct {
+	Args     []string // The arguments op was run with.
+	ExitCode int      // -1 if op couldn't be run at all.
+	Stderr   string   // What op wrote to stderr, without surrounding whitespace.
+	Err      error    // Why op couldn't be run, such as exec.ErrNotFound, if ExitCode is -1.
+}
+
+func (e *CommandError) Error() string {
+	if e.ExitCode < 0 {
+		return fmt.Sprintf("running op %s: %v", strings.Join(e.Args, " "), e.Err)
+	}
+	return fmt.Sprintf("op %s exited with status %d: %s", strings.Join(e.Args, " "), e.ExitCode, e.Stderr)
+}
+
+// Unwrap returns Err.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Runner runs op with args, writing stdin to its standard input, and returns what it wrote to its standard output.
+// If op fails, the error must be a *CommandError holding what op wrote to stderr, since a Store tells missing
+// items and authentication problems apart by it. Tests can use a Runner which answers like op would.
+type Runner interface {
+	Run(ctx context.Context, stdin []byte, args ...string) ([]byte, error)
+}
+
+// ExecRunner is the default Runner, which runs the op executable at Path, or found in PATH if Path is empty.
+type ExecRunner struct {
+	Path string
+}
+
+// Run implements Runner.
+func (r ExecRunner) Run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	path := r.Path
+	if path == "" {
+		path = "op"
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return out, nil
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		return nil, &CommandError{Args: args, ExitCode: exitErr.ExitCode(), Stderr: strings.TrimSpace(stderr.String())}
+	case ctx.Err() != nil:
+		return nil, &CommandError{Args: args, ExitCode: -1, Err: ctx.Err()}
+	default:
+		return nil, &CommandError{Args: args, ExitCode: -1, Err: err}
+	}
+}
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithAccount selects the 1Password account op uses, by its sign-in address, email or ID, for people signed in
+// to more than one. It defaults to op's own choice, which OP_ACCOUNT can set.
+func WithAccount(account string) Option {
+	return func(s *Store) {
+		s.account = account
+	}
+}
+
+// WithField sets the label of the field holding the token. It defaults to "token".
+func WithField(label string) Option {
+	return func(s *Store) {
+		s.field = label
+	}
+}
+
+// WithRunner sets how op is run. It defaults to ExecRunner{}.
+func WithRunner(r Runner) Option {
+	return func(s *Store) {
+		s.runner = r
+	}
+}
+
+// Store is a traktdeviceauth.TokenStore which keeps the token in a concealed field of a 1Password item. Save
+// only replaces that field, so other fields and notes added to the item are kept.
+type Store struct {
+	vault   string
+	item    string
+	account string
+	field   string
+	runner  Runner
+}
+
+// New returns a Store for the item titled item in vault, both of which can also be given by their ID.
+func New(vault, item string, opts ...Option) *Store {
+	s := &Store{vault: vault, item: item, field: "token", runner: ExecRunner{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Save implements traktdeviceauth.TokenStore by setting the token field of the item, which is created if it
+// doesn't exist yet.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("opstore.Save: %w", err)
+	}
+
+	item, err := s.get(ctx)
+	if errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		item = map[string]interface{}{"title": s.item, "category": "SECURE_NOTE"}
+	} else if err != nil {
+		return fmt.Errorf("opstore.Save: %w", err)
+	}
+
+	fields, _ := item["fields"].([]interface{})
+	found := false
+	for _, f := range fields {
+		if f, ok := f.(map[string]interface{}); ok && f["label"] == s.field {
+			f["value"], f["type"] = string(b), "CONCEALED"
+			found = true
+		}
+	}
+	if !found {
+		fields = append(fields, map[string]interface{}{"id": s.field, "label": s.field, "type": "CONCEALED", "value": string(b)})
+	}
+	item["fields"] = fields
+
+	stdin, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("opstore.Save: %w", err)
+	}
+	if id, ok := item["id"].(string); ok {
+		_, err = s.run(ctx, stdin, "item", "edit", id, "--vault", s.vault, "--format", "json", "-")
+	} else {
+		_, err = s.run(ctx, stdin, "item", "create", "--vault", s.vault, "--format", "json", "-")
+	}
+	if err != nil {
+		return fmt.Errorf("opstore.Save: %w", err)
+	}
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore by reading the token field of the item. If the item or the field
+// doesn't exist, the error is a *NotFoundError.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	item, err := s.get(ctx)
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("opstore.Load: %w", err)
+	}
+
+	fields, _ := item["fields"].([]interface{})
+	for _, f := range fields {
+		f, ok := f.(map[string]interface{})
+		if !ok || f["label"] != s.field {
+			continue
+		}
+		value, _ := f["value"].(string)
+		if value == "" {
+			break
+		}
+		var st traktdeviceauth.StoredToken
+		if err := json.Unmarshal([]byte(value), &st); err != nil {
+			return traktdeviceauth.TokenResponse{}, fmt.Errorf("opstore.Load: the %s field of %q: %w", s.field, s.item, err)
+		}
+		return st.TokenResponse(), nil
+	}
+	return traktdeviceauth.TokenResponse{}, fmt.Errorf("opstore.Load: %w", &NotFoundError{Vault: s.vault, Item: s.item})
+}
+
+// get returns the item as op describes it in JSON, or a *NotFoundError if it doesn't exist.
+func (s *Store) get(ctx context.Context) (map[string]interface{}, error) {
+	out, err := s.run(ctx, nil, "item", "get", s.item, "--vault", s.vault, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var item map[string]interface{}
+	if err := json.Unmarshal(out, &item); err != nil {
+		return nil, fmt.Errorf("decoding the output of op item get: %w", err)
+	}
+	return item, nil
+}
+
+// run runs the op subcommand which starts args, such as item get, with the account if one was chosen, turning
+// failures which mean the item doesn't exist or op isn't signed in into a *NotFoundError or *AuthError.
+func (s *Store) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	if s.account != "" {
+		args = append(append(args[:2:2], "--account", s.account), args[2:]...)
+	}
+
+	out, err := s.runner.Run(ctx, stdin, args...)
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode >= 0 {
+		msg := strings.ToLower(cmdErr.Stderr)
+		switch {
+		case strings.Contains(msg, "isn't an item"):
+			return nil, &NotFoundError{Vault: s.vault, Item: s.item}
+		case isAuthMessage(msg):
+			return nil, &AuthError{Stderr: cmdErr.Stderr}
+		}
+	}
+	return out, err
+}
+
+// authMessages are parts of the messages op prints when it can't authenticate.
+var authMessages = []string{
+	"not currently signed in",
+	"not signed in",
+	"session expired",
+	"invalid session",
+	"authorization prompt dismissed",
+	"no accounts configured",
+	"service account token is invalid",
+}
+
+// isAuthMessage reports whether the lowercase stderr of op says it failed because it isn't signed in.
+func isAuthMessage(msg string) bool {
+	for _, m := range authMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package opstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/opstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// fakeOp is a Runner which answers item get, create and edit like op does, keeping the items in memory.
+type fakeOp struct {
+	mu       sync.Mutex
+	items    map[string]map[string]interface{} // By vault and title, joined by a slash.
+	signedIn bool
+	ids      int
+	calls    [][]string
+}
+
+func newFakeOp() *fakeOp {
+	return &fakeOp{items: make(map[string]map[string]interface{}), signedIn: true}
+}
+
+// put adds item to vault, as if it had been created in 1Password.
+func (op *fakeOp) put(vault string, item map[string]interface{}) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.ids++
+	item["id"] = fmt.Sprintf("item%d", op.ids)
+	op.items[vault+"/"+item["title"].(string)] = item
+}
+
+// item returns the item titled title in vault, or nil.
+func (op *fakeOp) item(vault, title string) map[string]interface{} {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.items[vault+"/"+title]
+}
+
+// recorded returns the arguments of every run so far.
+func (op *fakeOp) recorded() [][]string {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return append([][]string(nil), op.calls...)
+}
+
+func (op *fakeOp) fail(args []string, stderr string) error {
+	return &opstore.CommandError{Args: args, ExitCode: 1, Stderr: "[ERROR] 2024/06/01 12:00:00 " + stderr}
+}
+
+func (op *fakeOp) Run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.calls = append(op.calls, args)
+
+	// Flags take a value, except for -, which stands for the item on stdin.
+	var positional []string
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+			flags[args[i]] = args[i+1]
+			i++
+		} else if args[i] != "-" {
+			positional = append(positional, args[i])
+		}
+	}
+	if !op.signedIn {
+		return nil, op.fail(args, "You are not currently signed in. Please run `op signin --help` for instructions")
+	}
+	if len(positional) < 2 || positional[0] != "item" || flags["--vault"] == "" || flags["--format"] != "json" {
+		return nil, op.fail(args, "unexpected arguments")
+	}
+	vault := flags["--vault"]
+
+	switch positional[1] {
+	case "get":
+		item, ok := op.items[vault+"/"+positional[2]]
+		if !ok {
+			return nil, op.fail(args, fmt.Sprintf("%q isn't an item in the %q vault. Specify the item with its UUID, name, or domain.", positional[2], vault))
+		}
+		return json.Marshal(item)
+	case "create", "edit":
+		var item map[string]interface{}
+		if err := json.Unmarshal(stdin, &item); err != nil {
+			return nil, op.fail(args, "invalid JSON on stdin: "+err.Error())
+		}
+		title, _ := item["title"].(string)
+		if positional[1] == "create" {
+			op.ids++
+			item["id"] = fmt.Sprintf("item%d", op.ids)
+		} else {
+			old, ok := op.items[vault+"/"+title]
+			if !ok || old["id"] != positional[2] {
+				return nil, op.fail(args, fmt.Sprintf("%q isn't an item in the %q vault.", positional[2], vault))
+			}
+		}
+		op.items[vault+"/"+title] = item
+		return json.Marshal(item)
+	}
+	return nil, op.fail(args, "unknown command "+positional[1])
+}
+
+func testToken(i int) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  fmt.Sprintf("access-%d", i),
+		RefreshToken: fmt.Sprintf("refresh-%d", i),
+		ExpiresAt:    time.Unix(1700000000+int64(i), 0),
+	}
+}
+
+func TestStore(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return opstore.New("Private", "Trakt token", opstore.WithRunner(newFakeOp()))
+	})
+}
+
+func TestSave(t *testing.T) {
+	op := newFakeOp()
+	ctx := context.Background()
+	s := opstore.New("Private", "Trakt token", opstore.WithRunner(op))
+
+	for i := 1; i <= 2; i++ {
+		if err := s.Save(ctx, testToken(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first Save creates the item and the second edits it.
+	var commands []string
+	for _, args := range op.recorded() {
+		commands = append(commands, args[0]+" "+args[1])
+		for _, arg := range args {
+			if strings.Contains(arg, "access-") || strings.Contains(arg, "refresh-") {
+				t.Errorf("op was run with the token in its arguments: %q", args)
+			}
+		}
+	}
+	if want := []string{"item get", "item create", "item get", "item edit"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("op was run with %q, want %q", commands, want)
+	}
+
+	item := op.item("Private", "Trakt token")
+	if item["category"] != "SECURE_NOTE" {
+		t.Errorf("the item has the category %v, want SECURE_NOTE", item["category"])
+	}
+	fields, _ := item["fields"].([]interface{})
+	if len(fields) != 1 {
+		t.Fatalf("the item has the fields %v, want only the token", fields)
+	}
+	field := fields[0].(map[string]interface{})
+	var stored struct {
+		Version     int    `json:"version"`
+		AccessToken string `json:"access_token"`
+	}
+	if field["label"] != "token" || field["type"] != "CONCEALED" || json.Unmarshal([]byte(field["value"].(string)), &stored) != nil ||
+		stored.Version != traktdeviceauth.StoredTokenVersion || stored.AccessToken != "access-2" {
+		t.Errorf("the token field is %v, want the second token as a concealed StoredToken", field)
+	}
+}
+
+func TestSaveKeepsOtherFields(t *testing.T) {
+	op := newFakeOp()
+	ctx := context.Background()
+	op.put("Private", map[string]interface{}{
+		"title":    "Trakt",
+		"category": "LOGIN",
+		"fields": []interface{}{
+			map[string]interface{}{"id": "username", "label": "username", "type": "STRING", "value": "alice"},
+			map[string]interface{}{"id": "trakt", "label": "trakt", "type": "STRING", "value": "old"},
+		},
+	})
+	s := opstore.New("Private", "Trakt", opstore.WithRunner(op), opstore.WithField("trakt"))
+
+	if _, err := s.Load(ctx); err == nil {
+		t.Error("Load of a field which isn't a token succeeded")
+	}
+	if err := s.Save(ctx, testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load(ctx)
+	if err != nil || got.AccessToken != "access-1" {
+		t.Fatalf("Load returned %+v, %v, want the saved token", got, err)
+	}
+
+	item := op.item("Private", "Trakt")
+	fields := item["fields"].([]interface{})
+	if item["category"] != "LOGIN" || item["id"] != "item1" || len(fields) != 2 || fields[0].(map[string]interface{})["value"] != "alice" ||
+		fields[1].(map[string]interface{})["type"] != "CONCEALED" {
+		t.Errorf("the item is %v after Save, want its other fields kept and the token concealed", item)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	op := newFakeOp()
+	ctx := context.Background()
+
+	_, err := opstore.New("Private", "missing", opstore.WithRunner(op)).Load(ctx)
+	var notFound *opstore.NotFoundError
+	if !errors.As(err, &notFound) || !errors.Is(err, traktdeviceauth.ErrNoStoredToken) || errors.Is(err, opstore.ErrNotSignedIn) {
+		t.Fatalf("Load returned %v, want a *NotFoundError wrapping ErrNoStoredToken", err)
+	}
+	if notFound.Vault != "Private" || notFound.Item != "missing" {
+		t.Errorf("got %+v", notFound)
+	}
+
+	// An item without the token field doesn't hold a token either.
+	op.put("Private", map[string]interface{}{"title": "empty", "category": "SECURE_NOTE"})
+	if _, err := opstore.New("Private", "empty", opstore.WithRunner(op)).Load(ctx); !errors.As(err, &notFound) {
+		t.Errorf("Load of an item without the field returned %v, want a *NotFoundError", err)
+	}
+}
+
+func TestNotSignedIn(t *testing.T) {
+	op := newFakeOp()
+	op.signedIn = false
+	ctx := context.Background()
+	s := opstore.New("Private", "Trakt token", opstore.WithRunner(op))
+
+	_, err := s.Load(ctx)
+	var authErr *opstore.AuthError
+	if !errors.As(err, &authErr) || !errors.Is(err, opstore.ErrNotSignedIn) || errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Fatalf("Load returned %v, want an *AuthError wrapping ErrNotSignedIn", err)
+	}
+	if !strings.Contains(authErr.Stderr, "not currently signed in") {
+		t.Errorf("the AuthError holds %q, want the message of op", authErr.Stderr)
+	}
+	if err := s.Save(ctx, testToken(1)); !errors.Is(err, opstore.ErrNotSignedIn) {
+		t.Errorf("Save returned %v, want ErrNotSignedIn", err)
+	}
+	if calls := op.recorded(); len(calls) != 2 {
+		t.Errorf("op was run %d times, want Save to stop after the failed get", len(calls))
+	}
+}
+
+func TestAccount(t *testing.T) {
+	op := newFakeOp()
+	s := opstore.New("Private", "Trakt token", opstore.WithRunner(op), opstore.WithAccount("alice@example.com"))
+	if err := s.Save(context.Background(), testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range op.recorded() {
+		if len(args) < 4 || args[2] != "--account" || args[3] != "alice@example.com" {
+			t.Errorf("op was run with %q, want the account after the subcommand", args)
+		}
+	}
+}
+
+// writeFakeOp writes a shell script which acts like op, keeping a single item in a file next to it, and returns
+// its path. It fails like op does when OP_FAKE_SIGNED_OUT is set.
+func writeFakeOp(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake op is a shell script")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "op")
+	script := `#!/bin/sh
+item="$(dirname "$0")/item.json"
+if [ -n "$OP_FAKE_SIGNED_OUT" ]; then
+	echo "[ERROR] 2024/06/01 12:00:00 You are not currently signed in. Please run 'op signin --help' for instructions" >&2
+	exit 1
+fi
+case "$1 $2" in
+"item get")
+	if [ ! -f "$item" ]; then
+		echo "[ERROR] 2024/06/01 12:00:00 \"$3\" isn't an item in the \"$5\" vault." >&2
+		exit 1
+	fi
+	cat "$item" ;;
+"item create"|"item edit")
+	sed 's/^{/{"id":"item1",/' > "$item"
+	cat "$item" ;;
+*)
+	echo "[ERROR] 2024/06/01 12:00:00 unknown command \"$1 $2\"" >&2
+	exit 2 ;;
+esac
+`
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecRunner(t *testing.T) {
+	path := writeFakeOp(t)
+	ctx := context.Background()
+	s := opstore.New("Private", "Trakt token", opstore.WithRunner(opstore.ExecRunner{Path: path}))
+
+	if _, err := s.Load(ctx); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load before Save returned %v, want ErrNoStoredToken", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := s.Save(ctx, testToken(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := s.Load(ctx); err != nil || got.AccessToken != "access-2" {
+		t.Errorf("Load returned %+v, %v, want the second token", got, err)
+	}
+
+	t.Setenv("OP_FAKE_SIGNED_OUT", "1")
+	if _, err := s.Load(ctx); !errors.Is(err, opstore.ErrNotSignedIn) {
+		t.Errorf("Load while signed out returned %v, want ErrNotSignedIn", err)
+	}
+}
+
+func TestExecRunnerErrors(t *testing.T) {
+	path := writeFakeOp(t)
+	ctx := context.Background()
+
+	_, err := opstore.ExecRunner{Path: path}.Run(ctx, nil, "vault", "list")
+	var cmdErr *opstore.CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 2 || cmdErr.Stderr != `[ERROR] 2024/06/01 12:00:00 unknown command "vault list"` ||
+		!reflect.DeepEqual(cmdErr.Args, []string{"vault", "list"}) {
+		t.Errorf("Run returned %#v, want a *CommandError with the exit code and stderr of op", err)
+	}
+
+	_, err = opstore.ExecRunner{Path: "op-which-does-not-exist"}.Run(ctx, nil, "item", "get")
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != -1 || !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("Run of a missing op returned %v, want a *CommandError wrapping exec.ErrNotFound", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = opstore.ExecRunner{Path: path}.Run(cancelled, nil, "item", "get", "Trakt token")
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != -1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("Run with a cancelled context returned %v, want a *CommandError wrapping Canceled", err)
+	}
+}
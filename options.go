@@ -0,0 +1,234 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// ErrInsecureBaseURL is returned when the base url would send credentials in cleartext. See WithAllowInsecureHTTP.
+var ErrInsecureBaseURL error = errors.New("refusing to send credentials to a base url which doesn't use https")
+
+// maxResponseBodySize limits how much of a response body is read into memory.
+// Trakt's auth responses are only a few hundred bytes, so 1 MiB is plenty.
+const maxResponseBodySize = 1 << 20
+
+// Option customizes the behavior of a function in this package.
+//
+// Applying an Option never modifies the Option or anything shared, and the values passed to the With functions
+// are copied when the Option is created, so a slice of Options can be built once and passed to calls on any
+// number of goroutines at once. Options which carry state between calls, such as WithAuditLog, WithCodeCache and
+// WithRateLimitState, synchronize it internally. The exception is WithPollStats, whose PollStats is written by
+// the call, so concurrent calls each need their own.
+type Option func(*config)
+
+// ErrorMapper converts a response from endpoint into an error. body is the response body,
+// truncated to 1 MiB. Returning nil falls through to the default mapping done by StatusToError.
+type ErrorMapper func(endpoint Endpoint, status int, body []byte) error
+
+// config holds the values set by a list of Options.
+type config struct {
+	apiBaseURL           string
+	httpClient           *http.Client
+	errorMapper          ErrorMapper
+	allowInsecureHTTP    bool
+	audit                *auditLog
+	auditKey             string
+	compensateSkew       bool
+	extraParams          map[string]string
+	middleware           []Middleware
+	expvar               bool
+	callTimeout          time.Duration
+	requestTimeout       time.Duration
+	requestTimeoutSet    bool
+	headers              http.Header
+	retry                RetryPolicy
+	strictDecoding       bool
+	codec                Codec
+	errorRate            *ErrorRateTracker
+	optionalRefreshToken bool
+	onTokenRotated       func(old, new TokenResponse) error
+	tokenSaver           func(ctx context.Context, t TokenResponse) error
+	eventHooks           []func(e AuditEvent)
+	concurrency          int
+	clientAuth           ClientAuthMethod
+	authorization        string // The Authorization header set by authenticate.
+	bodySecret           []byte // The client_secret field set by authenticate.
+	pollStats            *PollStats
+	retryObserver        func()
+	codeCache            *CodeCache
+	forceNewCode         bool
+	probeCallback        func(attempt int, err error, wait time.Duration)
+	rateLimitState       string
+	onRateLimitWait      func(wait time.Duration)
+	pollInterval         time.Duration
+	pollIntervalSet      bool
+	tickSource           <-chan time.Time
+	panicHandler         func(err *PanicError)
+}
+
+// newConfig creates a config with opts applied in order.
+func newConfig(opts []Option) (c config) {
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return
+}
+
+// baseURL returns the base url set by WithBaseURL, falling back to TraktAPIBaseUrl.
+func (c config) baseURL() string {
+	if c.apiBaseURL != "" {
+		return c.apiBaseURL
+	}
+	return TraktAPIBaseUrl
+}
+
+// endpointURL returns the url of endpoint, or the error from checkedBaseURL.
+func (c config) endpointURL(endpoint Endpoint) (string, error) {
+	base, err := c.checkedBaseURL()
+	if err != nil {
+		return "", err
+	}
+	return base + endpoint.String(), nil
+}
+
+// CheckBaseURL returns an error wrapping ErrInsecureBaseURL unless rawURL uses https. Plain http is accepted
+// for localhost and loopback addresses, since that traffic never leaves the machine.
+//
+// Every function in this package applies the same check to the base url before sending a request.
+func CheckBaseURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInsecureBaseURL, err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrInsecureBaseURL, rawURL)
+}
+
+// WithBaseURL sends requests to url instead of TraktAPIBaseUrl without modifying the global value,
+// for example to target a fake server in tests.
+func WithBaseURL(url string) Option {
+	return func(c *config) {
+		c.apiBaseURL = url
+	}
+}
+
+// WithHTTPClient sends every request with client instead of the package's own client, for example to go through a
+// proxy or a custom http.RoundTripper, or to reach an httptest.Server with its Client. Middleware set with
+// WithMiddleware still wraps every request made with client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// WithErrorMapper consults mapper for every response before the built-in status mapping,
+// which allows statuses added by gateways and proxies in front of Trakt to become meaningful errors.
+// If mapper panics, the call fails with a *PanicError.
+func WithErrorMapper(mapper ErrorMapper) Option {
+	return func(c *config) {
+		c.errorMapper = mapper
+	}
+}
+
+// WithAllowInsecureHTTP allows base urls which CheckBaseURL rejects, such as plain http to another machine.
+// Client secrets and tokens are then sent in cleartext, so this should only be used for test rigs.
+func WithAllowInsecureHTTP() Option {
+	return func(c *config) {
+		c.allowInsecureHTTP = true
+	}
+}
+
+// WithClockSkewCompensation shifts the CreatedAt, ExpiresAt and RefreshTokenIssuedAt of returned tokens by their ClockSkew,
+// so that they are expressed in the local clock even when it is far off from Trakt's. This keeps
+// expiry checks against time.Now correct on devices with badly set clocks. Responses without a valid
+// Date header are left unadjusted.
+func WithClockSkewCompensation() Option {
+	return func(c *config) {
+		c.compensateSkew = true
+	}
+}
+
+// measureSkew sets t.ClockSkew from the Date header of the response t was decoded from and, if
+// WithClockSkewCompensation was used, moves t's times into the local clock.
+func (c config) measureSkew(t *TokenResponse, header http.Header) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	// The Date header only has a resolution of one second, so the local time is truncated to match.
+	t.ClockSkew = date.Sub(time.Now().Truncate(time.Second))
+	if c.compensateSkew {
+		t.CreatedAt = t.CreatedAt.Add(-t.ClockSkew)
+		t.ExpiresAt = t.ExpiresAt.Add(-t.ClockSkew)
+		t.RefreshTokenIssuedAt = t.RefreshTokenIssuedAt.Add(-t.ClockSkew)
+	}
+}
+
+// WithExtraParams adds params to the JSON body of every request to the device code, device token, and token
+// endpoints. Using WithExtraParams more than once merges the maps. Keys set by this package always win over
+// params, but an unexpected param can still make Trakt or a gateway reject the request, so only add what
+// the server is known to accept.
+func WithExtraParams(params map[string]string) Option {
+	// The map is copied now, so that changing it later doesn't race with calls using the Option.
+	own := make(map[string]string, len(params))
+	for k, v := range params {
+		own[k] = v
+	}
+
+	return func(c *config) {
+		merged := make(map[string]string, len(c.extraParams)+len(own))
+		for k, v := range c.extraParams {
+			merged[k] = v
+		}
+		for k, v := range own {
+			merged[k] = v
+		}
+		c.extraParams = merged
+	}
+}
+
+// withExtraParams appends the params from WithExtraParams which aren't already keys of fields, in sorted
+// order so that request bodies are deterministic. fields alternate between keys and values.
+func (c config) withExtraParams(fields []string) []string {
+	if len(c.extraParams) == 0 {
+		return fields
+	}
+
+	own := make(map[string]bool, len(fields)/2+1)
+	for i := 0; i < len(fields); i += 2 {
+		own[fields[i]] = true
+	}
+	if c.bodySecret != nil {
+		own["client_secret"] = true
+	}
+
+	keys := make([]string, 0, len(c.extraParams))
+	for k := range c.extraParams {
+		if !own[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	merged := append(make([]string, 0, len(fields)+2*len(keys)), fields...)
+	for _, k := range keys {
+		merged = append(merged, k, c.extraParams[k])
+	}
+	return merged
+}
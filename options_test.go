@@ -0,0 +1,377 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// errUpstreamTimeout is the error gatewayMapper maps the gateway's 599 to.
+var errUpstreamTimeout = errors.New("the gateway timed out waiting for Trakt")
+
+// gatewayMapper maps the 599 of a gateway in front of Trakt, whose body is a JSON envelope naming the cause.
+func gatewayMapper(endpoint traktdeviceauth.Endpoint, status int, body []byte) error {
+	if status != 599 {
+		return nil
+	}
+	var envelope struct {
+		Cause string `json:"cause"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Cause != "upstream_timeout" {
+		return nil
+	}
+	return errUpstreamTimeout
+}
+
+func TestWithErrorMapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture traktdeviceauthtest.Fixture
+		want    error
+	}{
+		{"mapped", traktdeviceauthtest.Fixture{Status: 599, Body: `{"cause":"upstream_timeout"}`}, errUpstreamTimeout},
+		{"unmapped gateway status", traktdeviceauthtest.Fixture{Status: 599, Body: `{"cause":"other"}`}, traktdeviceauth.ErrUnexpectedStatusCode},
+		{"fall through to the defaults", traktdeviceauthtest.FixtureDenied, traktdeviceauth.ErrDeviceCodeDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := traktdeviceauthtest.NewReplayTransport(tt.fixture)
+			cl := traktdeviceauth.NewClient("client-id", "client-secret", append(replay.Options(), traktdeviceauth.WithErrorMapper(gatewayMapper))...)
+
+			_, err := cl.RequestToken(context.Background(), traktdeviceauth.CodeResponse{DeviceCode: "code"})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("RequestToken returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithErrorMapperArguments(t *testing.T) {
+	var (
+		gotEndpoint traktdeviceauth.Endpoint
+		gotStatus   int
+		gotLen      int
+	)
+	mapper := func(endpoint traktdeviceauth.Endpoint, status int, body []byte) error {
+		gotEndpoint, gotStatus, gotLen = endpoint, status, len(body)
+		return nil
+	}
+
+	// The body passed to the mapper is limited to 1 MiB.
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.Fixture{Status: 599, Body: strings.Repeat("x", 2<<20)})
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(replay.Options(), traktdeviceauth.WithErrorMapper(mapper))...)
+	if _, err := cl.RefreshAccessToken(context.Background(), "refresh-token"); err == nil {
+		t.Fatal("RefreshAccessToken succeeded")
+	}
+	if gotEndpoint != traktdeviceauth.EndpointToken || gotStatus != 599 || gotLen != 1<<20 {
+		t.Errorf("the mapper got %s, %d and a body of %d bytes, want %s, 599 and 1 MiB", gotEndpoint, gotStatus, gotLen, traktdeviceauth.EndpointToken)
+	}
+}
+
+func TestCheckBaseURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://api.trakt.tv", false},
+		{"https://192.0.2.1:8443", false},
+		{"http://api.trakt.tv", true},
+		{"http://192.0.2.1", true},
+		{"http://localhost:8080", false},
+		{"http://127.0.0.1:8080", false},
+		{"http://[::1]:8080", false},
+		{"http://localhost.example.com", true},
+		{"ftp://api.trakt.tv", true},
+		{"://nonsense", true},
+	}
+	for _, tt := range tests {
+		err := traktdeviceauth.CheckBaseURL(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckBaseURL(%q) = %v, want an error: %v", tt.url, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, traktdeviceauth.ErrInsecureBaseURL) {
+			t.Errorf("CheckBaseURL(%q) = %v, want ErrInsecureBaseURL", tt.url, err)
+		}
+	}
+}
+
+func TestWithAllowInsecureHTTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		allow   bool
+		wantErr bool
+	}{
+		{"https", "https://trakt.example", false, false},
+		{"http to another machine", "http://trakt.example", false, true},
+		{"http to localhost", "http://localhost:8080", false, false},
+		{"http to another machine with the override", "http://trakt.example", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse)
+			opts := append(replay.Options(), traktdeviceauth.WithBaseURL(tt.baseURL))
+			if tt.allow {
+				opts = append(opts, traktdeviceauth.WithAllowInsecureHTTP())
+			}
+
+			_, err := traktdeviceauth.GenerateNewCode("client-id", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateNewCode returned %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, traktdeviceauth.ErrInsecureBaseURL) {
+					t.Errorf("got %v, want ErrInsecureBaseURL", err)
+				}
+				// The credentials must not have been sent.
+				if n := len(replay.Requests()); n != 0 {
+					t.Errorf("%d requests were sent", n)
+				}
+			}
+		})
+	}
+}
+
+// newSkewedServer returns a token endpoint whose clock is off by skew, which it reports in the Date header
+// unless date says otherwise. The tokens it issues last an hour.
+func newSkewedServer(t *testing.T, skew time.Duration, date string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().Add(skew)
+		switch date {
+		case "":
+			w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		case "absent":
+			// A nil value keeps net/http from adding its own Date header.
+			w.Header()["Date"] = nil
+		default:
+			w.Header().Set("Date", date)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"access","token_type":"bearer","expires_in":3600,"refresh_token":"refresh","scope":"public","created_at":%d}`, now.Unix())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClockSkew(t *testing.T) {
+	const tolerance = 2 * time.Second
+
+	for _, skew := range []time.Duration{-2 * time.Hour, 2 * time.Hour} {
+		t.Run(skew.String(), func(t *testing.T) {
+			srv := newSkewedServer(t, skew, "")
+			ctx := context.Background()
+
+			tok, err := traktdeviceauth.NewClient("client-id", "client-secret", traktdeviceauth.WithBaseURL(srv.URL)).RefreshAccessToken(ctx, "refresh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := tok.ClockSkew - skew; diff < -tolerance || diff > tolerance {
+				t.Errorf("ClockSkew = %v, want %v", tok.ClockSkew, skew)
+			}
+			// Without compensation, the token's times are in the server's clock.
+			if want := time.Now().Add(skew + time.Hour); tok.ExpiresAt.Sub(want) < -tolerance || tok.ExpiresAt.Sub(want) > tolerance {
+				t.Errorf("ExpiresAt = %v, want about %v", tok.ExpiresAt, want)
+			}
+			if tok.Expired() != (skew < 0) {
+				t.Errorf("Expired() = %v without compensation", tok.Expired())
+			}
+
+			tok, err = traktdeviceauth.NewClient("client-id", "client-secret", traktdeviceauth.WithBaseURL(srv.URL), traktdeviceauth.WithClockSkewCompensation()).RefreshAccessToken(ctx, "refresh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Now().Add(time.Hour); tok.ExpiresAt.Sub(want) < -tolerance || tok.ExpiresAt.Sub(want) > tolerance {
+				t.Errorf("compensated ExpiresAt = %v, want about %v", tok.ExpiresAt, want)
+			}
+			if !tok.RefreshTokenIssuedAt.Equal(tok.CreatedAt) || time.Since(tok.CreatedAt) > tolerance {
+				t.Errorf("compensated CreatedAt %v and RefreshTokenIssuedAt %v, want about now", tok.CreatedAt, tok.RefreshTokenIssuedAt)
+			}
+			if tok.Expired() {
+				t.Error("the compensated token has expired")
+			}
+		})
+	}
+}
+
+func TestClockSkewWithoutDate(t *testing.T) {
+	for _, date := range []string{"absent", "not a date"} {
+		t.Run(date, func(t *testing.T) {
+			srv := newSkewedServer(t, -2*time.Hour, date)
+
+			tok, err := traktdeviceauth.NewClient("client-id", "client-secret", traktdeviceauth.WithBaseURL(srv.URL), traktdeviceauth.WithClockSkewCompensation()).RefreshAccessToken(context.Background(), "refresh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.ClockSkew != 0 {
+				t.Errorf("ClockSkew = %v, want 0", tok.ClockSkew)
+			}
+			// The times are left as the server sent them.
+			if !tok.Expired() {
+				t.Error("the token was adjusted without a Date header")
+			}
+		})
+	}
+}
+
+func TestWithExtraParams(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	params := map[string]string{
+		"tenant":    "acme",
+		"client_id": "someone-else", // The package's own keys win.
+		"quoted":    "a \"b\"\n\\c",
+	}
+	opts := append(srv.Options(),
+		traktdeviceauth.WithExtraParams(params),
+		traktdeviceauth.WithExtraParams(map[string]string{"region": "eu"}),
+	)
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", opts...)
+	// Changing the map afterwards doesn't affect the Option.
+	params["tenant"] = "changed"
+
+	ctx := context.Background()
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cl.RequestToken(ctx, codeResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, endpoint := range []traktdeviceauth.Endpoint{traktdeviceauth.EndpointDeviceCode, traktdeviceauth.EndpointDeviceToken, traktdeviceauth.EndpointToken} {
+		reqs := srv.RequestsTo(endpoint)
+		if len(reqs) != 1 {
+			t.Fatalf("%d requests to %s, want 1", len(reqs), endpoint)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(reqs[0].Body, &body); err != nil {
+			t.Fatalf("%s: %s isn't valid JSON: %v", endpoint, reqs[0].Body, err)
+		}
+		want := map[string]string{
+			"tenant":    "acme",
+			"region":    "eu",
+			"quoted":    "a \"b\"\n\\c",
+			"client_id": "client-id",
+		}
+		for k, v := range want {
+			if body[k] != v {
+				t.Errorf("%s: %s = %q, want %q", endpoint, k, body[k], v)
+			}
+		}
+	}
+}
+
+// recordingTransport is an http.RoundTripper which records the path of every request before sending it with next.
+type recordingTransport struct {
+	next http.RoundTripper
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, req.URL.Path)
+	rt.mu.Unlock()
+	return rt.next.RoundTrip(req)
+}
+
+func (rt *recordingTransport) recorded() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]string(nil), rt.paths...)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	transport := &recordingTransport{next: http.DefaultTransport}
+
+	// Middleware sees every request before the client's transport does.
+	var middlewarePaths []string
+	record := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			if n := len(transport.recorded()); n != len(middlewarePaths) {
+				t.Errorf("the transport saw %d requests before the middleware saw %s", n, req.URL.Path)
+			}
+			middlewarePaths = append(middlewarePaths, req.URL.Path)
+			return next(req)
+		}
+	}
+	cl := traktdeviceauth.NewClient("client-id", "secret", append(srv.Options(),
+		traktdeviceauth.WithHTTPClient(&http.Client{Transport: transport}), traktdeviceauth.WithMiddleware(record))...)
+	ctx := context.Background()
+
+	code, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cl.PollForAuthToken(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err = cl.RefreshAccessToken(ctx, tok.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.GetUserSettings(ctx, tok.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RevokeToken(ctx, tok.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, r := range srv.Requests() {
+		want = append(want, r.Path)
+	}
+	got := transport.recorded()
+	if len(want) != 5 || strings.Join(got, " ") != strings.Join(want, " ") || strings.Join(middlewarePaths, " ") != strings.Join(want, " ") {
+		t.Errorf("the transport saw %q and the middleware %q, want every request the server got: %q", got, middlewarePaths, want)
+	}
+
+	// Ping goes through it as well.
+	if err := traktdeviceauth.Ping(ctx, traktdeviceauth.WithBaseURL(srv.URL), traktdeviceauth.WithHTTPClient(&http.Client{Transport: transport})); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(transport.recorded()); n != len(got)+1 {
+		t.Errorf("the transport saw %d requests after Ping, want %d", n, len(got)+1)
+	}
+}
+
+func TestWithHTTPClientTLS(t *testing.T) {
+	// A TLS server with a certificate which only its own client trusts.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"device_code":"device","user_code":"USER","verification_url":"https://trakt.tv/activate","expires_in":600,"interval":5}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", traktdeviceauth.WithBaseURL(srv.URL)); err == nil {
+		t.Error("GenerateNewCode with the default client trusted the test certificate")
+	}
+	code, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", traktdeviceauth.WithBaseURL(srv.URL), traktdeviceauth.WithHTTPClient(srv.Client()))
+	if err != nil || code.UserCode != "USER" {
+		t.Errorf("GenerateNewCode with the server's client returned %+v, %v", code, err)
+	}
+	// The global base URL is left alone.
+	if traktdeviceauth.TraktAPIBaseUrl == srv.URL {
+		t.Error("WithBaseURL changed TraktAPIBaseUrl")
+	}
+}
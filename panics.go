@@ -0,0 +1,71 @@
+package traktdeviceauth
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// PanicError is what a panic in a callback passed to this package is turned into, so that a bug in a logging
+// or metrics hook doesn't take down a flow or refresh along with it.
+//
+// Callbacks which report failures, the ones set by WithTokenSaver and WithOnTokenRotated, get the PanicError
+// returned inside a *HookError like any other failure of theirs, along with the token. The display function
+// of WithAutoReauthorization ends the reauthorization with it, and the functions passed to WithErrorMapper and
+// RequestEditor fail the request with it. Every other callback, including the one passed to ResponseHook, is
+// only observing, so a panic in one of them is passed to the WithPanicHandler handler and the operation carries
+// on.
+type PanicError struct {
+	Hook  string      // The name of the Option which registered the callback, such as "WithEventHook".
+	Value interface{} // The value passed to panic.
+	Stack []byte      // The stack of the goroutine which panicked.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s callback panicked: %v", e.Hook, e.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error, and nil otherwise.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// WithPanicHandler calls fn with every panic recovered from an observing callback, such as those set by
+// WithEventHook, WithOnRateLimitWait or WithRefreshCallback, instead of writing it and its stack to the
+// standard logger. fn itself must not panic.
+func WithPanicHandler(fn func(err *PanicError)) Option {
+	return func(c *config) {
+		c.panicHandler = fn
+	}
+}
+
+// catchPanic calls fn, the callback registered by the Option called hook, and returns its error, or a
+// *PanicError if it panics.
+func catchPanic(hook string, fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Hook: hook, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// observe calls fn, the observing callback registered by the Option called hook, and reports a panic to the
+// panic handler instead of letting it unwind.
+func (c config) observe(hook string, fn func()) {
+	err := catchPanic(hook, func() error {
+		fn()
+		return nil
+	})
+	if err == nil {
+		return
+	}
+
+	panicErr := err.(*PanicError)
+	if c.panicHandler != nil {
+		c.panicHandler(panicErr)
+		return
+	}
+	log.Printf("traktdeviceauth: %v\n%s", panicErr, panicErr.Stack)
+}
@@ -0,0 +1,302 @@
+package traktdeviceauth_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// errBoom is what the callbacks in these tests panic with.
+var errBoom = errors.New("boom")
+
+// panicHandler returns a WithPanicHandler Option sending every recovered panic to the returned channel.
+func panicHandler() (traktdeviceauth.Option, chan *traktdeviceauth.PanicError) {
+	panics := make(chan *traktdeviceauth.PanicError, 100)
+	return traktdeviceauth.WithPanicHandler(func(err *traktdeviceauth.PanicError) { panics <- err }), panics
+}
+
+// expectPanic receives a recovered panic and checks that it came from hook and holds errBoom.
+func expectPanic(t *testing.T, panics chan *traktdeviceauth.PanicError, hook string) {
+	t.Helper()
+
+	select {
+	case err := <-panics:
+		if err.Hook != hook || !errors.Is(err, errBoom) || !bytes.Contains(err.Stack, []byte("panics_test.go")) {
+			t.Errorf("recovered %v from %s with a stack of %d bytes, want errBoom from %s with the stack of the panic", err, err.Hook, len(err.Stack), hook)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no panic from %s was recovered", hook)
+	}
+}
+
+func TestPanicInFailingHooks(t *testing.T) {
+	tests := []struct {
+		hook string
+		opt  traktdeviceauth.Option
+	}{
+		{"WithTokenSaver", traktdeviceauth.WithTokenSaver(func(ctx context.Context, t traktdeviceauth.TokenResponse) error { panic(errBoom) })},
+		{"WithOnTokenRotated", traktdeviceauth.WithOnTokenRotated(func(old, new traktdeviceauth.TokenResponse) error { panic(errBoom) })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hook, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.RotateRefreshToken())
+			handler, panics := panicHandler()
+
+			// The panic fails the refresh like an error would, but the new token is still returned.
+			tok, err := traktdeviceauth.RefreshAccessTokenContext(context.Background(), srv.IssueToken().RefreshToken, "client-id", "client-secret",
+				append(srv.Options(), tt.opt, handler)...)
+			var hookErr *traktdeviceauth.HookError
+			var panicErr *traktdeviceauth.PanicError
+			if !errors.As(err, &hookErr) || hookErr.Hook != tt.hook || !errors.As(err, &panicErr) || !errors.Is(err, errBoom) {
+				t.Fatalf("the refresh returned %v, want a *HookError of %s wrapping a *PanicError", err, tt.hook)
+			}
+			if panicErr.Hook != tt.hook || len(panicErr.Stack) == 0 {
+				t.Errorf("the *PanicError is from %s with a stack of %d bytes", panicErr.Hook, len(panicErr.Stack))
+			}
+			if tok.AccessToken == "" {
+				t.Error("the refreshed token was lost")
+			}
+			// It is returned, so it isn't reported to the panic handler as well.
+			if len(panics) != 0 {
+				t.Errorf("the panic handler got %v", <-panics)
+			}
+		})
+	}
+}
+
+func TestPanicInRequestCallbacks(t *testing.T) {
+	tests := []struct {
+		hook string
+		opt  traktdeviceauth.Option
+	}{
+		{"WithErrorMapper", traktdeviceauth.WithErrorMapper(func(traktdeviceauth.Endpoint, int, []byte) error { panic(errBoom) })},
+		{"RequestEditor", traktdeviceauth.WithMiddleware(traktdeviceauth.RequestEditor(func(*http.Request) error { panic(errBoom) }))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hook, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			handler, panics := panicHandler()
+
+			// The panic fails the request like an error would.
+			_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(srv.Options(), tt.opt, handler)...)
+			var panicErr *traktdeviceauth.PanicError
+			if !errors.As(err, &panicErr) || panicErr.Hook != tt.hook || !errors.Is(err, errBoom) || len(panicErr.Stack) == 0 {
+				t.Fatalf("the call returned %v, want a *PanicError of %s", err, tt.hook)
+			}
+			if len(panics) != 0 {
+				t.Errorf("the panic handler got %v", <-panics)
+			}
+		})
+	}
+}
+
+func TestPanicInObservingCallbacks(t *testing.T) {
+	tests := []struct {
+		hook string
+		// call makes a call with opts which runs the callback of hook, and must succeed anyway.
+		call func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error
+	}{
+		{"WithEventHook", func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error {
+			opts = append(opts, traktdeviceauth.WithEventHook(func(traktdeviceauth.AuditEvent) { panic(errBoom) }))
+			_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...)
+			return err
+		}},
+		{"WithCallRetryPolicy", func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error {
+			srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusInternalServerError), traktdeviceauthtest.Succeed()))
+			opts = append(opts, traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{
+				MaxAttempts: 2,
+				Backoff:     time.Millisecond,
+				OnRetry:     func(traktdeviceauth.Endpoint, int, time.Duration, error) { panic(errBoom) },
+			}))
+			_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...)
+			return err
+		}},
+		{"WithOnRateLimitWait", func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error {
+			path := filepath.Join(t.TempDir(), "ratelimit.json")
+			state := fmt.Sprintf(`{"limited_at":%q,"retry_after_seconds":0.05}`, time.Now().Format(time.RFC3339Nano))
+			if err := os.WriteFile(path, []byte(state), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			opts = append(opts, traktdeviceauth.WithRateLimitState(path), traktdeviceauth.WithOnRateLimitWait(func(time.Duration) { panic(errBoom) }))
+			_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...)
+			return err
+		}},
+		{"ResponseHook", func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error {
+			opts = append(opts, traktdeviceauth.WithMiddleware(traktdeviceauth.ResponseHook(func(*http.Response) { panic(errBoom) })))
+			_, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", opts...)
+			return err
+		}},
+		{"WithProbeCallback", func(t *testing.T, srv *traktdeviceauthtest.Server, opts []traktdeviceauth.Option) error {
+			// The first probe finds the server overloaded.
+			var probes int32
+			unready := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&probes, 1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer unready.Close()
+			opts = append(opts, traktdeviceauth.WithBaseURL("http://"+unready.Listener.Addr().String()),
+				traktdeviceauth.WithProbeCallback(func(int, error, time.Duration) { panic(errBoom) }))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return traktdeviceauth.WaitUntilReady(ctx, opts...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hook, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			handler, panics := panicHandler()
+
+			if err := tt.call(t, srv, append(srv.Options(), handler)); err != nil {
+				t.Fatalf("the call failed with a panicking %s callback: %v", tt.hook, err)
+			}
+			expectPanic(t, panics, tt.hook)
+		})
+	}
+}
+
+func TestPanicWithoutHandler(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// Without a handler, the panic and its stack go to the standard logger.
+	var logged bytes.Buffer
+	defer func(w io.Writer, flags int) {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}(log.Writer(), log.Flags())
+	log.SetOutput(&logged)
+	log.SetFlags(0)
+
+	hook := traktdeviceauth.WithEventHook(func(traktdeviceauth.AuditEvent) { panic("boom") })
+	if _, err := traktdeviceauth.GenerateNewCodeContext(context.Background(), "client-id", append(srv.Options(), hook)...); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(logged.String(), "traktdeviceauth: WithEventHook callback panicked: boom\n") || !strings.Contains(logged.String(), "panics_test.go") {
+		t.Errorf("logged %q, want the panic along with its stack", logged.String())
+	}
+}
+
+func TestPanicInFlowCallback(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	handler, panics := panicHandler()
+
+	m := newFlowManager(t, srv, traktdeviceauth.WithFlowOptions(handler),
+		traktdeviceauth.WithFlowCallback(func(string, traktdeviceauth.TokenResponse, error) { panic(errBoom) }))
+	if _, err := m.Begin(context.Background(), "user"); err != nil {
+		t.Fatal(err)
+	}
+	expectPanic(t, panics, "WithFlowCallback")
+	if status := waitForFlow(t, m, "user"); status.State != traktdeviceauth.FlowApproved {
+		t.Errorf("the flow ended %s, want it approved", status.State)
+	}
+	if tok, err := m.Result("user"); err != nil || tok.AccessToken == "" {
+		t.Errorf("Result returned %+v, %v, want the token", tok, err)
+	}
+}
+
+func TestPanicInRefreshSchedulerCallbacks(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	handler, panics := panicHandler()
+
+	s, clock, _ := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0),
+		traktdeviceauth.WithRefreshOptions(handler),
+		traktdeviceauth.WithRefreshCallback(func(string, traktdeviceauth.TokenResponse, error) { panic(errBoom) }),
+		traktdeviceauth.WithOnRefreshTokenStale(24*time.Hour, func(string, time.Duration) { panic(errBoom) }),
+		traktdeviceauth.WithOnReauthorizationRequired(func(string, error) { panic(errBoom) }))
+
+	// The refresh callback panics, and the refreshed token is kept and refreshed again when it is due.
+	tok := issuedToken(srv, clock.Now().Add(2*time.Hour))
+	tok.CreatedAt = clock.Now()
+	if err := s.Add("user", tok); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	expectPanic(t, panics, "WithRefreshCallback")
+	refreshed, err := s.Token("user")
+	if err != nil || refreshed.AccessToken == tok.AccessToken {
+		t.Fatalf("Token returned %+v, %v, want the refreshed token", refreshed, err)
+	}
+	if status, _ := s.Status("user"); status.NextRefreshAt.IsZero() {
+		t.Error("no refresh was scheduled after the panic")
+	}
+
+	// The stale hook panics.
+	clock.Advance(24 * time.Hour)
+	expectPanic(t, panics, "WithOnRefreshTokenStale")
+
+	// A revoked token is still parked when the hook for it panics.
+	revoked := traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: clock.Now().Add(2 * time.Hour)}
+	if err := s.Add("revoked", revoked); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	expectPanic(t, panics, "WithRefreshCallback")
+	expectPanic(t, panics, "WithOnReauthorizationRequired")
+	if names := s.NeedsReauthorization(); len(names) != 1 || names[0] != "revoked" {
+		t.Errorf("NeedsReauthorization() = %v, want [revoked]", names)
+	}
+}
+
+func TestPanicInAutoReauthorization(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	handler, panics := panicHandler()
+
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0),
+		traktdeviceauth.WithRefreshOptions(handler),
+		traktdeviceauth.WithAutoReauthorization(func(string, traktdeviceauth.CodeResponse) { panic(errBoom) }))
+
+	revoked := traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: clock.Now().Add(2 * time.Hour)}
+	if err := s.Add("alice", revoked); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	waitForOutcomes(t, outcomes, 1)
+
+	// The panic ends the reauthorization, which leaves the token parked with the panic as its error.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, _ := s.Status("alice")
+		if !status.Reauthorizing {
+			var panicErr *traktdeviceauth.PanicError
+			if !status.NeedsReauthorization || !errors.As(status.Err, &panicErr) || panicErr.Hook != "WithAutoReauthorization" || !errors.Is(status.Err, errBoom) {
+				t.Errorf("the status after the panic is %+v, want it parked with the *PanicError", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reauthorization didn't end")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 0 {
+		t.Errorf("%d polls were made for a code which couldn't be shown", n)
+	}
+	// The error is in the status, so it isn't reported to the panic handler as well.
+	if len(panics) != 0 {
+		t.Errorf("the panic handler got %v", <-panics)
+	}
+}
@@ -0,0 +1,29 @@
+package traktdeviceauth
+
+import "time"
+
+// PollStats describes how a device flow went, for showing to users or logging.
+type PollStats struct {
+	StartedAt   time.Time // When Start was called, or when polling started for a resumed flow or PollForAuthToken.
+	ApprovedAt  time.Time // Zero unless the user approved the code.
+	FinishedAt  time.Time // Zero while the flow is running.
+	Polls       int       // The number of token requests, not counting retries.
+	RateLimited int       // The number of polls which Trakt asked to slow down.
+	Retries     int       // The number of requests retried because of a transient error. See WithCallRetryPolicy.
+	TimedOut    int       // The number of polls whose request took longer than WithRequestTimeout allows.
+}
+
+// WithPollStats fills in stats when PollForAuthToken returns, whether or not the code was approved.
+// Other functions ignore it. Concurrent calls must each be given their own stats.
+func WithPollStats(stats *PollStats) Option {
+	return func(c *config) {
+		c.pollStats = stats
+	}
+}
+
+// withRetryObserver calls fn before every retry made because of WithCallRetryPolicy.
+func withRetryObserver(fn func()) Option {
+	return func(c *config) {
+		c.retryObserver = fn
+	}
+}
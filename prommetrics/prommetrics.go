@@ -0,0 +1,179 @@
+// Package prommetrics exports the events of traktdeviceauth as Prometheus metrics.
+//
+// A Collector is fed by the Option returned by its Option method and registered like any other collector:
+//
+//	metrics := prommetrics.New(prommetrics.WithProfile("default"))
+//	prometheus.MustRegister(metrics)
+//	t, err := traktdeviceauth.RefreshAccessToken(refreshToken, clientID, clientSecret, metrics.Option())
+//
+// The metrics never contain tokens, codes or client credentials.
+package prommetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for the calls made with its Option. It is safe for concurrent use.
+type Collector struct {
+	codesGenerated  prometheus.Counter
+	tokensObtained  prometheus.Counter
+	refreshes       prometheus.Counter
+	refreshFailures *prometheus.CounterVec
+	failures        *prometheus.CounterVec
+	lastRefresh     prometheus.Gauge
+	expirySeconds   *prometheus.Desc
+	info            prometheus.Gauge
+
+	mu        sync.Mutex
+	expiresAt time.Time
+	now       func() time.Time
+}
+
+// Option configures a Collector.
+type Option func(*config)
+
+type config struct {
+	namespace string
+	profile   string
+}
+
+// WithNamespace replaces the "traktdeviceauth" prefix of the metric names.
+func WithNamespace(namespace string) Option {
+	return func(c *config) {
+		c.namespace = namespace
+	}
+}
+
+// WithProfile adds a profile label with the value name to every metric, and exports an info metric for it, so
+// that collectors for several tokens can be registered side by side.
+func WithProfile(name string) Option {
+	return func(c *config) {
+		c.profile = name
+	}
+}
+
+// New creates a Collector. It has to be registered with a prometheus.Registerer to be scraped.
+func New(opts ...Option) *Collector {
+	c := config{namespace: "traktdeviceauth"}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	var labels prometheus.Labels
+	if c.profile != "" {
+		labels = prometheus.Labels{"profile": c.profile}
+	}
+
+	return &Collector{
+		codesGenerated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: c.namespace, Name: "codes_generated_total", ConstLabels: labels,
+			Help: "Number of device codes generated.",
+		}),
+		tokensObtained: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: c.namespace, Name: "tokens_obtained_total", ConstLabels: labels,
+			Help: "Number of device codes which were approved and exchanged for a token.",
+		}),
+		refreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: c.namespace, Name: "refreshes_total", ConstLabels: labels,
+			Help: "Number of successful token refreshes.",
+		}),
+		refreshFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: c.namespace, Name: "refresh_failures_total", ConstLabels: labels,
+			Help: "Number of failed token refreshes, by the traktdeviceauth.Code of the error.",
+		}, []string{"code"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: c.namespace, Name: "failures_total", ConstLabels: labels,
+			Help: "Number of failed requests, by endpoint and the traktdeviceauth.Code of the error.",
+		}, []string{"endpoint", "code"}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: c.namespace, Name: "last_refresh_success_timestamp_seconds", ConstLabels: labels,
+			Help: "Unix time of the last successful token refresh.",
+		}),
+		expirySeconds: prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", "token_expiry_seconds"),
+			"Seconds until the current access token expires. Negative once it has expired.", nil, labels),
+		info: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: c.namespace, Name: "info", ConstLabels: labels,
+			Help: "Always 1, with the profile the metrics belong to as a label.",
+		}),
+		now: time.Now,
+	}
+}
+
+// Option returns the traktdeviceauth option which feeds the calls it is passed to into c.
+func (c *Collector) Option() traktdeviceauth.Option {
+	return traktdeviceauth.WithEventHook(c.Observe)
+}
+
+// Observe updates the metrics for e. It is called by the Option returned by Option.
+func (c *Collector) Observe(e traktdeviceauth.AuditEvent) {
+	switch e.Event {
+	case traktdeviceauth.AuditCodeGenerated:
+		c.codesGenerated.Inc()
+	case traktdeviceauth.AuditTokenObtained:
+		c.tokensObtained.Inc()
+		c.setExpiry(e.ExpiresAt)
+	case traktdeviceauth.AuditTokenRefreshed:
+		c.refreshes.Inc()
+		c.lastRefresh.Set(float64(e.Time.UnixNano()) / 1e9)
+		c.setExpiry(e.ExpiresAt)
+	case traktdeviceauth.AuditFailure:
+		c.failures.WithLabelValues(e.Endpoint, e.Reason).Inc()
+		if e.Endpoint == traktdeviceauth.EndpointToken.String() {
+			c.refreshFailures.WithLabelValues(e.Reason).Inc()
+		}
+	}
+}
+
+// SetToken sets the token whose expiry is exported, for tokens which were loaded from storage rather than
+// obtained through the Option.
+func (c *Collector) SetToken(t traktdeviceauth.TokenResponse) {
+	c.setExpiry(&t.ExpiresAt)
+}
+
+// setExpiry records the expiry of the current token.
+func (c *Collector) setExpiry(expiresAt *time.Time) {
+	if expiresAt == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expiresAt = *expiresAt
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.codesGenerated.Describe(ch)
+	c.tokensObtained.Describe(ch)
+	c.refreshes.Describe(ch)
+	c.refreshFailures.Describe(ch)
+	c.failures.Describe(ch)
+	c.lastRefresh.Describe(ch)
+	c.info.Describe(ch)
+	ch <- c.expirySeconds
+}
+
+// Collect implements prometheus.Collector. The expiry is only exported once a token is known.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.codesGenerated.Collect(ch)
+	c.tokensObtained.Collect(ch)
+	c.refreshes.Collect(ch)
+	c.refreshFailures.Collect(ch)
+	c.failures.Collect(ch)
+	c.lastRefresh.Collect(ch)
+
+	c.info.Set(1)
+	c.info.Collect(ch)
+
+	c.mu.Lock()
+	expiresAt := c.expiresAt
+	c.mu.Unlock()
+	if !expiresAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.expirySeconds, prometheus.GaugeValue, expiresAt.Sub(c.now()).Seconds())
+	}
+}
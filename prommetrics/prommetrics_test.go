@@ -0,0 +1,85 @@
+package prommetrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/prommetrics"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestScrapeAfterRefresh(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Succeed(), traktdeviceauthtest.Status(http.StatusUnauthorized)))
+
+	metrics := prommetrics.New(prommetrics.WithProfile("default"))
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics)
+	scrape := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer scrape.Close()
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), metrics.Option())...)
+	issued := srv.IssueToken()
+	refreshed, err := cl.RefreshAccessToken(ctx, issued.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RefreshAccessToken(ctx, refreshed.RefreshToken); err == nil {
+		t.Fatal("the second refresh succeeded, want a failure")
+	}
+
+	resp, err := http.Get(scrape.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, want := range []string{
+		`traktdeviceauth_refreshes_total{profile="default"} 1`,
+		`traktdeviceauth_refresh_failures_total{code="invalid_grant",profile="default"} 1`,
+		`traktdeviceauth_last_refresh_success_timestamp_seconds{profile="default"} `,
+		`traktdeviceauth_token_expiry_seconds{profile="default"} `,
+		`traktdeviceauth_info{profile="default"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the scrape doesn't contain %q:\n%s", want, body)
+		}
+	}
+	for _, secret := range []string{"client-secret", issued.AccessToken, issued.RefreshToken, refreshed.AccessToken, refreshed.RefreshToken} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the scrape contains the secret %q", secret)
+		}
+	}
+}
+
+func TestNoExpiryBeforeToken(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prommetrics.New(prommetrics.WithNamespace("custom")))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetName(), "custom_") {
+			t.Errorf("the metric %s doesn't use the namespace", f.GetName())
+		}
+		if f.GetName() == "custom_token_expiry_seconds" {
+			t.Error("the expiry is exported before a token is known")
+		}
+	}
+}
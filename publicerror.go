@@ -0,0 +1,97 @@
+package traktdeviceauth
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+)
+
+// PublicError is a representation of an error which is safe to send to end users, for example as the body
+// of an HTTP response relayed to a JavaScript front end. It only contains the error's Code and fixed values
+// derived from it, never the error's message, which may include urls or response bodies.
+type PublicError struct {
+	Code       string `json:"code"`
+	Status     int    `json:"status,omitempty"`      // The status Trakt responded with, if known.
+	Message    string `json:"message"`               // A human-readable description which is safe to show to end users.
+	Retryable  bool   `json:"retryable"`             // Whether trying again later could succeed.
+	RetryAfter int64  `json:"retry_after,omitempty"` // Seconds to wait before retrying, if the server said so.
+}
+
+// publicErrorInfo is the fixed part of a PublicError for a code.
+type publicErrorInfo struct {
+	message   string
+	retryable bool
+}
+
+// publicErrors has an entry for every code returned by Code.
+var publicErrors = map[string]publicErrorInfo{
+	CodeDeviceCodeUnclaimed:       {"The code hasn't been entered yet.", true},
+	CodeInvalidGrant:              {"The authorization is no longer valid. Please connect your Trakt account again.", false},
+	CodeInvalidAccessToken:        {"The authorization is no longer valid. Please connect your Trakt account again.", false},
+	CodeInvalidDeviceCode:         {"The code is not valid. Please request a new one.", false},
+	CodeForbidden:                 {"This app isn't allowed to access Trakt.", false},
+	CodeDeviceCodeAlreadyApproved: {"The code has already been used.", false},
+	CodeDeviceCodeExpired:         {"The code has expired. Please request a new one.", false},
+	CodeDeviceCodeDenied:          {"The authorization was declined.", false},
+	CodeRateLimited:               {"Too many requests were made to Trakt. Please wait a moment and try again.", true},
+	CodeServerError:               {"Trakt is having problems. Please try again later.", true},
+	CodeServiceOverloaded:         {"Trakt is overloaded. Please try again in a few seconds.", true},
+	CodeCloudflareError:           {"Trakt can't be reached right now. Please try again later.", true},
+	CodeUnexpectedStatus:          {"Trakt responded unexpectedly. Please try again later.", true},
+	CodeInsecureBaseURL:           {"The app is misconfigured.", false},
+	CodeInvalidArgument:           {"The app is misconfigured.", false},
+	CodeFlowNotFound:              {"There is no authorization in progress.", false},
+	CodeFlowPending:               {"The authorization is still waiting for approval.", true},
+	CodeTooManyFlows:              {"Too many authorizations are in progress. Please try again later.", true},
+	CodeFlowCancelled:             {"The authorization was cancelled.", false},
+	CodeCancelled:                 {"The authorization was cancelled.", false},
+	CodeTimeout:                   {"Trakt took too long to respond. Please try again.", true},
+	CodeNetwork:                   {"Trakt can't be reached. Please check your connection and try again.", true},
+	CodeDecodeFailed:              {"Trakt responded unexpectedly. Please try again later.", true},
+	CodeMalformedResponse:         {"Trakt's response was incomplete. Please try again.", true},
+	CodeInvalidTransition:         {"The authorization can't do that right now.", false},
+	CodeInsecurePermissions:       {"The saved authorization isn't stored securely.", false},
+	CodeNoStoredToken:             {"No Trakt account is connected. Please connect one.", false},
+	CodeTokenNotFound:             {"There is no authorization with that name.", false},
+	CodeSchedulerClosed:           {"The app is shutting down.", false},
+	CodeStoreLocked:               {"The saved authorization is in use by another program. Please try again.", true},
+	CodeUnsupportedFormatVersion:  {"The saved authorization was created by a newer version of the app.", false},
+	CodeRotationConflict:          {"The authorization was updated elsewhere. Please try again.", true},
+	CodeTokenDecryption:           {"The saved authorization can't be read.", false},
+	CodeUnknown:                   {"Something went wrong. Please try again.", true},
+}
+
+// NewPublicError converts err into a PublicError. It returns the zero value for a nil error.
+func NewPublicError(err error) PublicError {
+	if err == nil {
+		return PublicError{}
+	}
+
+	code := Code(err)
+	info := publicErrors[code]
+	p := PublicError{Code: code, Message: info.message, Retryable: info.retryable}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		p.Status = statusErr.Status
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		p.Status = http.StatusTooManyRequests
+		p.RetryAfter = int64(math.Ceil(rateLimitErr.RetryAfter.Seconds()))
+	}
+
+	return p
+}
+
+// Error returns Message, so that a PublicError can be passed around as an error.
+func (p PublicError) Error() string {
+	return p.Message
+}
+
+// ErrorJSON renders err as the JSON encoding of a PublicError.
+func ErrorJSON(err error) ([]byte, error) {
+	return json.Marshal(NewPublicError(err))
+}
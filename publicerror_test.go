@@ -0,0 +1,98 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestErrorJSONRoundTrip(t *testing.T) {
+	for _, tt := range codeTests {
+		if tt.err == nil {
+			continue
+		}
+		err := fmt.Errorf("wrapped: %w", tt.err)
+
+		b, jsonErr := traktdeviceauth.ErrorJSON(err)
+		if jsonErr != nil {
+			t.Fatalf("ErrorJSON(%v): %v", tt.err, jsonErr)
+		}
+		var got traktdeviceauth.PublicError
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("ErrorJSON(%v) returned %s: %v", tt.err, b, err)
+		}
+		if want := traktdeviceauth.NewPublicError(err); got != want {
+			t.Errorf("ErrorJSON(%v) decoded to %+v, want %+v", tt.err, got, want)
+		}
+		if got.Code != tt.code {
+			t.Errorf("ErrorJSON(%v) has the code %q, want %q", tt.err, got.Code, tt.code)
+		}
+	}
+
+	if p := traktdeviceauth.NewPublicError(nil); p != (traktdeviceauth.PublicError{}) {
+		t.Errorf("NewPublicError(nil) = %+v, want the zero value", p)
+	}
+}
+
+func TestNewPublicErrorStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantRetryable bool
+		wantAfter     int64
+	}{
+		{"denied", &traktdeviceauth.StatusError{Status: 418, Err: traktdeviceauth.ErrDeviceCodeDenied}, 418, false, 0},
+		{"overloaded", &traktdeviceauth.StatusError{Status: 503, Err: traktdeviceauth.ErrServiceOverloaded}, 503, true, 0},
+		{"rate limited", &traktdeviceauth.RateLimitError{RetryAfter: 1500 * time.Millisecond}, 429, true, 2},
+		{"no status", traktdeviceauth.ErrNoStoredToken, 0, false, 0},
+	}
+	for _, tt := range tests {
+		p := traktdeviceauth.NewPublicError(fmt.Errorf("wrapped: %w", tt.err))
+		if p.Status != tt.wantStatus || p.Retryable != tt.wantRetryable || p.RetryAfter != tt.wantAfter {
+			t.Errorf("%s: got %+v, want status %d, retryable %v and retry after %d", tt.name, p, tt.wantStatus, tt.wantRetryable, tt.wantAfter)
+		}
+	}
+}
+
+func TestErrorJSONHidesDetails(t *testing.T) {
+	const secret = "hunter2-secret"
+
+	// A malformed response whose body holds a token, as returned by the library.
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.Fixture{
+		Status: http.StatusOK,
+		Body:   `{"access_token":"","token_type":"bearer","refresh_token":"` + secret + `","created_at":1487889741}`,
+	})
+	_, malformed := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...).RefreshAccessToken(context.Background(), "refresh")
+	if !errors.Is(malformed, traktdeviceauth.ErrMalformedResponse) {
+		t.Fatalf("RefreshAccessToken returned %v, want ErrMalformedResponse", malformed)
+	}
+
+	errs := []error{
+		malformed,
+		&url.Error{Op: "Post", URL: "https://api.trakt.tv/oauth/token?client_secret=" + secret, Err: errors.New("connection reset")},
+		fmt.Errorf("refreshing with %s: %w", secret, traktdeviceauth.ErrInvalidGrant),
+		&traktdeviceauth.MalformedResponseError{Field: "access_token", Problem: "is missing", Body: secret},
+		errors.New(secret),
+	}
+	for _, err := range errs {
+		b, jsonErr := traktdeviceauth.ErrorJSON(err)
+		if jsonErr != nil {
+			t.Fatal(jsonErr)
+		}
+		for _, s := range []string{secret, "api.trakt.tv", "client_secret", "http"} {
+			if strings.Contains(string(b), s) {
+				t.Errorf("ErrorJSON(%v) = %s, which contains %q", err, b, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// maxRateLimitPenalty caps the penalties read by WithRateLimitState, so that a corrupted or tampered state file
+// can't stall a program indefinitely.
+const maxRateLimitPenalty = time.Hour
+
+// rateLimitState is the contents of the file written by WithRateLimitState.
+type rateLimitState struct {
+	LimitedAt         time.Time `json:"limited_at"`
+	RetryAfterSeconds float64   `json:"retry_after_seconds"`
+}
+
+// WithRateLimitState records every rate limited response in the file at path, and makes requests wait until the
+// recorded penalty is over before they are sent. This lets programs which are run again and again, such as the
+// command line, respect a rate limit which was hit by an earlier process.
+//
+// A rate limited response without a Retry-After header is recorded with a penalty of the WithPollInterval interval,
+// or DefaultPollInterval without one. Penalties which are over, longer than an hour, or can't be read are
+// ignored, and so is a missing file.
+// Failing to write the file doesn't fail the request.
+func WithRateLimitState(path string) Option {
+	return func(c *config) {
+		c.rateLimitState = path
+	}
+}
+
+// WithOnRateLimitWait calls fn before a request waits for a penalty recorded by WithRateLimitState, with the
+// time it is going to wait, so that the delay can be explained to the user.
+func WithOnRateLimitWait(fn func(wait time.Duration)) Option {
+	return func(c *config) {
+		c.onRateLimitWait = fn
+	}
+}
+
+// waitRateLimitState waits until the penalty recorded in the WithRateLimitState file is over.
+func (c config) waitRateLimitState(ctx context.Context) error {
+	b, err := os.ReadFile(c.rateLimitState)
+	if err != nil {
+		return nil
+	}
+
+	var state rateLimitState
+	if err := codecOrDefault(c.codec).Unmarshal(b, &state); err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	penalty := time.Duration(state.RetryAfterSeconds * float64(time.Second))
+	if state.LimitedAt.After(now) || penalty <= 0 || penalty > maxRateLimitPenalty {
+		return nil
+	}
+	wait := state.LimitedAt.Add(penalty).Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+
+	if c.onRateLimitWait != nil {
+		c.observe("WithOnRateLimitWait", func() { c.onRateLimitWait(wait) })
+	}
+	return sleepContext(ctx, wait)
+}
+
+// recordRateLimit writes the penalty of a rate limited response to the WithRateLimitState file. A response without
+// a Retry-After header is penalized with the poll interval, or DefaultPollInterval if there is none, so that the
+// next process still backs off.
+func (c config) recordRateLimit(retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = c.pollInterval
+		if retryAfter <= 0 {
+			retryAfter = DefaultPollInterval
+		}
+	}
+	b, err := codecOrDefault(c.codec).Marshal(rateLimitState{LimitedAt: time.Now().UTC(), RetryAfterSeconds: retryAfter.Seconds()})
+	if err != nil {
+		return
+	}
+	_ = writeFileAtomic(c.rateLimitState, append(b, '\n'))
+}
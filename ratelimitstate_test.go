@@ -0,0 +1,162 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestRateLimitStateAcrossProcesses(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(1)), traktdeviceauthtest.Succeed()))
+	statePath := filepath.Join(t.TempDir(), "ratelimit.json")
+	ctx := context.Background()
+
+	// The first process is rate limited and exits.
+	first := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithRateLimitState(statePath))...)
+	var rateLimitErr *traktdeviceauth.RateLimitError
+	if _, err := first.GenerateNewCode(ctx); !errors.As(err, &rateLimitErr) {
+		t.Fatalf("the first process got %v, want a *RateLimitError", err)
+	}
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("the rate limit wasn't recorded: %v", err)
+	}
+	var state struct {
+		LimitedAt         time.Time `json:"limited_at"`
+		RetryAfterSeconds float64   `json:"retry_after_seconds"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil || state.RetryAfterSeconds != 1 || time.Since(state.LimitedAt) > 5*time.Second {
+		t.Errorf("the state file holds %s (%v), want a penalty of 1s starting now", b, err)
+	}
+
+	// The second one waits out the rest of the penalty before its first request.
+	var waits []time.Duration
+	second := traktdeviceauth.NewClient("client-id", "client-secret", append(srv.Options(), traktdeviceauth.WithRateLimitState(statePath),
+		traktdeviceauth.WithOnRateLimitWait(func(wait time.Duration) { waits = append(waits, wait) }))...)
+	if _, err := second.GenerateNewCode(ctx); err != nil {
+		t.Fatalf("the second process: %v", err)
+	}
+	if len(waits) != 1 || waits[0] <= 0 || waits[0] > time.Second {
+		t.Errorf("the second process reported waits of %v, want one of at most 1s", waits)
+	}
+	reqs := srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)
+	if len(reqs) != 2 {
+		t.Fatalf("%d code requests, want 2", len(reqs))
+	}
+	if gap := reqs[1].Time.Sub(reqs[0].Time); gap < 900*time.Millisecond {
+		t.Errorf("the second process sent its request %v after the rate limited one, want it to wait out the 1s penalty", gap)
+	}
+
+	// Once the penalty is over, there is nothing to wait for.
+	waits = nil
+	if _, err := second.GenerateNewCode(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 0 {
+		t.Errorf("waited %v for a penalty which is over", waits)
+	}
+}
+
+func TestRateLimitStateWithoutRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []traktdeviceauth.Option
+		penalty time.Duration
+	}{
+		{"default", nil, traktdeviceauth.DefaultPollInterval},
+		{"poll interval", []traktdeviceauth.Option{traktdeviceauth.WithPollInterval(3 * time.Second)}, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusTooManyRequests)))
+			statePath := filepath.Join(t.TempDir(), "ratelimit.json")
+			opts := append(append(srv.Options(), tt.opts...), traktdeviceauth.WithRateLimitState(statePath))
+
+			if _, err := traktdeviceauth.GenerateNewCode("client-id", opts...); !errors.Is(err, traktdeviceauth.ErrPollRateTooFast) {
+				t.Fatalf("the first call got %v, want it rate limited", err)
+			}
+
+			// The next call has to wait too, even though Trakt didn't say for how long.
+			var waits []time.Duration
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id",
+				append(opts, traktdeviceauth.WithOnRateLimitWait(func(wait time.Duration) { waits = append(waits, wait) }))...)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("the second call returned %v, want it to wait out the penalty", err)
+			}
+			if len(waits) != 1 || waits[0] > tt.penalty || waits[0] < tt.penalty-time.Second {
+				t.Errorf("the second call reported waits of %v, want one of about %v", waits, tt.penalty)
+			}
+		})
+	}
+}
+
+func TestRateLimitStateIgnored(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name     string
+		contents string // Of the state file, which is absent if empty.
+	}{
+		{"missing", ""},
+		{"stale", `{"limited_at":"` + now.Add(-time.Hour).Format(time.RFC3339) + `","retry_after_seconds":60}`},
+		{"too long", `{"limited_at":"` + now.Format(time.RFC3339) + `","retry_after_seconds":7200}`},
+		{"in the future", `{"limited_at":"` + now.Add(time.Hour).Format(time.RFC3339) + `","retry_after_seconds":60}`},
+		{"negative", `{"limited_at":"` + now.Format(time.RFC3339) + `","retry_after_seconds":-60}`},
+		{"corrupt", `{"limited_at":`},
+		{"not json", "\x00\x01binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			statePath := filepath.Join(t.TempDir(), "ratelimit.json")
+			if tt.contents != "" {
+				if err := os.WriteFile(statePath, []byte(tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			waited := false
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", append(srv.Options(), traktdeviceauth.WithRateLimitState(statePath),
+				traktdeviceauth.WithOnRateLimitWait(func(time.Duration) { waited = true }))...)
+			if err != nil || waited {
+				t.Errorf("GenerateNewCode returned %v and waited: %v, want the state file ignored", err, waited)
+			}
+		})
+	}
+}
+
+func TestRateLimitStateCancelled(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	statePath := filepath.Join(t.TempDir(), "ratelimit.json")
+	state := `{"limited_at":"` + time.Now().UTC().Format(time.RFC3339) + `","retry_after_seconds":600}`
+	if err := os.WriteFile(statePath, []byte(state), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := traktdeviceauth.GenerateNewCodeContext(ctx, "client-id", append(srv.Options(), traktdeviceauth.WithRateLimitState(statePath))...)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GenerateNewCode returned %v, want it to give up waiting when ctx ends", err)
+	}
+	if n := len(srv.Requests()); n != 0 {
+		t.Errorf("%d requests were sent during the penalty", n)
+	}
+}
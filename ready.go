@@ -0,0 +1,93 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNetworkUnreachable error = errors.New("the Trakt API could not be reached over the network")
+	ErrServerUnavailable  error = errors.New("the Trakt API is reachable but not working")
+)
+
+// Ping checks whether the base url can be reached by requesting it. Any response which isn't a server error
+// counts as success, since the base url itself isn't an API endpoint. It returns the network error if there is
+// no response, and a *StatusError for server errors.
+func Ping(ctx context.Context, opts ...Option) error {
+	c := newConfig(opts)
+	base, err := c.checkedBaseURL()
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/", nil)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	req.Header.Set("Trakt-API-Version", "2")
+
+	resp, err := c.roundTripper()(req)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBodySize))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		// Server errors mean the same for every endpoint, so any of them can map the status.
+		return fmt.Errorf("Ping: %w", &StatusError{Status: resp.StatusCode, Err: StatusToError(EndpointDeviceCode, resp.StatusCode)})
+	}
+	return nil
+}
+
+// WithProbeCallback calls fn after every failed Ping made by WaitUntilReady, with the number of the attempt,
+// starting at 1, its error, and how long WaitUntilReady waits before the next one. It is meant for showing
+// something like "Waiting for the network…" while a device is starting up.
+func WithProbeCallback(fn func(attempt int, err error, wait time.Duration)) Option {
+	return func(c *config) {
+		c.probeCallback = fn
+	}
+}
+
+// WaitUntilReady calls Ping until it succeeds or ctx ends, for devices which start before their network is
+// usable. The wait between attempts starts at half a second and doubles up to 30 seconds.
+//
+// If ctx ends first, the returned error wraps ErrNetworkUnreachable if the last attempt got no response, or
+// ErrServerUnavailable if the server answered with an error. A base url which can never work is returned right
+// away.
+func WaitUntilReady(ctx context.Context, opts ...Option) error {
+	c := newConfig(opts)
+
+	wait := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := Ping(ctx, opts...)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrInsecureBaseURL) || errors.Is(err, ErrInvalidArgument) {
+			return fmt.Errorf("WaitUntilReady: %w", err)
+		}
+
+		if ctx.Err() == nil {
+			if c.probeCallback != nil {
+				c.observe("WithProbeCallback", func() { c.probeCallback(attempt, err, wait) })
+			}
+			if sleepContext(ctx, wait) == nil {
+				if wait *= 2; wait > 30*time.Second {
+					wait = 30 * time.Second
+				}
+				continue
+			}
+		}
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			return fmt.Errorf("WaitUntilReady: %w: %v", ErrServerUnavailable, err)
+		}
+		return fmt.Errorf("WaitUntilReady: %w: %v", ErrNetworkUnreachable, err)
+	}
+}
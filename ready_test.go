@@ -0,0 +1,129 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusNotFound, nil},
+		{http.StatusUnauthorized, nil},
+		{http.StatusInternalServerError, traktdeviceauth.ErrServerError},
+		{http.StatusServiceUnavailable, traktdeviceauth.ErrServiceOverloaded},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		err := traktdeviceauth.Ping(context.Background(), traktdeviceauth.WithBaseURL(srv.URL))
+		srv.Close()
+
+		if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+			t.Errorf("Ping of a server answering %d returned %v, want %v", tt.status, err, tt.wantErr)
+		}
+		var statusErr *traktdeviceauth.StatusError
+		if tt.wantErr != nil && (!errors.As(err, &statusErr) || statusErr.Status != tt.status) {
+			t.Errorf("Ping of a server answering %d returned %v, want a *StatusError", tt.status, err)
+		}
+	}
+}
+
+// refusingAddr returns a loopback address which refuses connections until something listens on it.
+func refusingAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	addr := refusingAddr(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// The server comes up after the second failed probe.
+	var waits []time.Duration
+	probe := func(attempt int, err error, wait time.Duration) {
+		waits = append(waits, wait)
+		if attempt != len(waits) || err == nil {
+			t.Errorf("probe callback for attempt %d with %v after %d probes", attempt, err, len(waits))
+		}
+		if attempt == 2 {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.Listener = ln
+			srv.Start()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := traktdeviceauth.WaitUntilReady(ctx, traktdeviceauth.WithBaseURL("http://"+addr), traktdeviceauth.WithProbeCallback(probe)); err != nil {
+		t.Fatalf("WaitUntilReady: %v", err)
+	}
+	if len(waits) != 2 || waits[0] != 500*time.Millisecond || waits[1] != time.Second {
+		t.Errorf("waited %v between probes, want [500ms 1s]", waits)
+	}
+}
+
+func TestWaitUntilReadyGivesUp(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	tests := []struct {
+		name    string
+		baseURL string
+		want    error
+		notWant error
+	}{
+		{"network unreachable", "http://" + refusingAddr(t), traktdeviceauth.ErrNetworkUnreachable, traktdeviceauth.ErrServerUnavailable},
+		{"server down", down.URL, traktdeviceauth.ErrServerUnavailable, traktdeviceauth.ErrNetworkUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+			defer cancel()
+
+			probes := 0
+			err := traktdeviceauth.WaitUntilReady(ctx, traktdeviceauth.WithBaseURL(tt.baseURL),
+				traktdeviceauth.WithProbeCallback(func(int, error, time.Duration) { probes++ }))
+			if !errors.Is(err, tt.want) || errors.Is(err, tt.notWant) {
+				t.Errorf("WaitUntilReady returned %v, want %v", err, tt.want)
+			}
+			if probes < 2 {
+				t.Errorf("%d failed probes were reported before giving up, want at least 2", probes)
+			}
+		})
+	}
+}
+
+func TestWaitUntilReadyInsecureBaseURL(t *testing.T) {
+	start := time.Now()
+	err := traktdeviceauth.WaitUntilReady(context.Background(), traktdeviceauth.WithBaseURL("http://trakt.example"))
+	if !errors.Is(err, traktdeviceauth.ErrInsecureBaseURL) {
+		t.Errorf("WaitUntilReady returned %v, want ErrInsecureBaseURL", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("WaitUntilReady retried a base url which can never work")
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/BrenekH/go-traktdeviceauth/redisstore
+
+go 1.22
+
+require (
+	github.com/BrenekH/go-traktdeviceauth v1.1.0
+	github.com/alicebob/miniredis/v2 v2.37.0
+	github.com/redis/go-redis/v9 v9.7.3
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
@@ -0,0 +1,242 @@
+// Package redisstore provides a traktdeviceauth.TokenStore which keeps the token in Redis, so that several
+// replicas of a service can share it.
+//
+// It is a separate module so that the Redis client only becomes a dependency of programs which use it.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUnavailable is matched by errors.Is for errors caused by Redis being unreachable, as opposed to a missing token.
+var ErrUnavailable error = errors.New("redis is unavailable")
+
+// ErrConflict is returned by CompareAndSwap when the stored token isn't the one the caller expected.
+var ErrConflict error = errors.New("the stored token was changed by another writer")
+
+// ConnectionError wraps an error caused by Redis being unreachable. It matches ErrUnavailable with errors.Is.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrUnavailable, e.Err)
+}
+
+// Unwrap returns the error returned by the Redis client.
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrUnavailable.
+func (e *ConnectionError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// classify wraps connectivity errors from the Redis client in a *ConnectionError.
+func classify(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, redis.ErrClosed) {
+		return &ConnectionError{Err: err}
+	}
+	return err
+}
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithKeyPrefix sets the prefix of the key the token is stored at, which is the prefix followed by "token".
+// The default prefix is "traktdeviceauth:".
+func WithKeyPrefix(prefix string) Option {
+	return func(s *Store) {
+		s.key = prefix + "token"
+	}
+}
+
+// WithTTL makes the stored token expire from Redis grace after its access token expires. A token whose
+// access token has expired can still be refreshed, so grace should cover how long the refresh token is
+// expected to stay usable.
+func WithTTL(grace time.Duration) Option {
+	return func(s *Store) {
+		s.ttl, s.grace = true, grace
+	}
+}
+
+// Store is a traktdeviceauth.TokenStore which keeps the token in a Redis string as a traktdeviceauth.StoredToken.
+type Store struct {
+	client redis.UniversalClient
+	key    string
+	ttl    bool
+	grace  time.Duration
+}
+
+// New returns a Store which uses client.
+func New(client redis.UniversalClient, opts ...Option) *Store {
+	s := &Store{client: client, key: "traktdeviceauth:token"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Key returns the Redis key the token is stored at.
+func (s *Store) Key() string {
+	return s.key
+}
+
+// Save implements traktdeviceauth.TokenStore.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("redisstore.Save: %w", err)
+	}
+	if err := s.client.Set(ctx, s.key, b, s.expiration(t)).Err(); err != nil {
+		return fmt.Errorf("redisstore.Save: %w", classify(err))
+	}
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore. A missing key is reported as traktdeviceauth.ErrNoStoredToken.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	b, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("redisstore.Load: %s: %w", s.key, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("redisstore.Load: %w", classify(err))
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("redisstore.Load: %w", err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// casScript replaces the token in KEYS[1] with ARGV[2] if the stored refresh token is ARGV[1], or if nothing is
+// stored and ARGV[1] is empty. ARGV[3] is the expiration in milliseconds, or 0 for none.
+var casScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+local expected = ''
+if cur then
+	expected = cjson.decode(cur).refresh_token or ''
+end
+if expected ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// CompareAndSwap atomically replaces the stored token with new if the stored token is still old, which is
+// decided by comparing refresh tokens. An empty old.RefreshToken means nothing must be stored yet. If another
+// writer got there first, ErrConflict is returned and the stored token is left alone.
+//
+// This makes refreshes safe between replicas: each replica loads the token, refreshes it, and only keeps its
+// result if CompareAndSwap succeeds. Otherwise it loads the token written by the replica that won.
+func (s *Store) CompareAndSwap(ctx context.Context, old, new traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(new))
+	if err != nil {
+		return fmt.Errorf("redisstore.CompareAndSwap: %w", err)
+	}
+
+	swapped, err := casScript.Run(ctx, s.client, []string{s.key}, old.RefreshToken, b, s.expiration(new).Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("redisstore.CompareAndSwap: %w", classify(err))
+	}
+	if swapped == 0 {
+		return fmt.Errorf("redisstore.CompareAndSwap: %w", ErrConflict)
+	}
+	return nil
+}
+
+// rotatedKey returns the key of the token under name for a RotatingStore: Key for
+// traktdeviceauth.DefaultProfile, and Key followed by a colon and name otherwise.
+func (s *Store) rotatedKey(name string) string {
+	if name == traktdeviceauth.DefaultProfile {
+		return s.key
+	}
+	return s.key + ":" + name
+}
+
+// LoadRotated implements traktdeviceauth.RotatingStore. A missing key is reported as
+// traktdeviceauth.ErrNoStoredToken.
+func (s *Store) LoadRotated(ctx context.Context, name string) (traktdeviceauth.RotatedToken, error) {
+	r, err := s.loadRotated(ctx, s.client, s.rotatedKey(name))
+	if err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("redisstore.LoadRotated: %w", err)
+	}
+	return r, nil
+}
+
+// Rotate implements traktdeviceauth.RotatingStore with an optimistic transaction, which fails if another writer
+// changes the key between reading and writing it.
+func (s *Store) Rotate(ctx context.Context, name string, generation int64, t traktdeviceauth.TokenResponse, grace time.Duration) (traktdeviceauth.RotatedToken, error) {
+	key := s.rotatedKey(name)
+	var next traktdeviceauth.RotatedToken
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		cur, err := s.loadRotated(ctx, tx, key)
+		if err != nil && !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+			return err
+		}
+		if cur.Generation != generation {
+			return fmt.Errorf("%s is generation %d, not %d: %w", key, cur.Generation, generation, traktdeviceauth.ErrRotationConflict)
+		}
+
+		next = cur.Next(t, time.Now(), grace)
+		b, err := json.Marshal(next.Stored())
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, b, s.expiration(t)).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("redisstore.Rotate: %s was changed by another writer: %w", key, traktdeviceauth.ErrRotationConflict)
+	} else if err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("redisstore.Rotate: %w", classify(err))
+	}
+	return next, nil
+}
+
+// loadRotated reads and decodes the token at key with c.
+func (s *Store) loadRotated(ctx context.Context, c redis.Cmdable, key string) (traktdeviceauth.RotatedToken, error) {
+	b, err := c.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("%s: %w", key, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.RotatedToken{}, classify(err)
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return traktdeviceauth.RotatedToken{}, err
+	}
+	return st.Rotated(), nil
+}
+
+// expiration returns the Redis expiration for t, or 0 if WithTTL wasn't used.
+func (s *Store) expiration(t traktdeviceauth.TokenResponse) time.Duration {
+	if !s.ttl {
+		return 0
+	}
+	d := time.Until(t.ExpiresAt) + s.grace
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
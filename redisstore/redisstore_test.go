@@ -0,0 +1,177 @@
+package redisstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/redisstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedis starts a miniredis server and returns it with a client connected to it.
+func newRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func testToken(access, refresh string, expiresIn time.Duration) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{AccessToken: access, RefreshToken: refresh, ExpiresAt: time.Now().Add(expiresIn).Truncate(time.Second)}
+}
+
+func TestStore(t *testing.T) {
+	_, client := newRedis(t)
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets a key of its own.
+		return redisstore.New(client, redisstore.WithKeyPrefix(t.Name()+":"))
+	})
+}
+
+func TestRotatingStore(t *testing.T) {
+	_, client := newRedis(t)
+	traktdeviceauthtest.TestRotatingStore(t, func(t *testing.T) traktdeviceauth.RotatingStore {
+		return redisstore.New(client, redisstore.WithKeyPrefix(t.Name()+":"))
+	})
+}
+
+func TestStoredFormat(t *testing.T) {
+	mr, client := newRedis(t)
+	s := redisstore.New(client, redisstore.WithKeyPrefix("app:"))
+	if s.Key() != "app:token" {
+		t.Fatalf("Key() = %q, want app:token", s.Key())
+	}
+
+	tok := testToken("access", "refresh", time.Hour)
+	if err := s.Save(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := mr.Get("app:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal([]byte(raw), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.AccessToken != tok.AccessToken || st.RefreshToken != tok.RefreshToken || !st.ExpiresAt.Equal(tok.ExpiresAt) {
+		t.Errorf("the key holds %+v, want %+v as a StoredToken", st, tok)
+	}
+	if ttl := mr.TTL("app:token"); ttl != 0 {
+		t.Errorf("the key expires in %v without WithTTL", ttl)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	mr, client := newRedis(t)
+	s := redisstore.New(client, redisstore.WithTTL(24*time.Hour))
+	ctx := context.Background()
+
+	if err := s.Save(ctx, testToken("access", "refresh", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(s.Key()); ttl < 24*time.Hour+59*time.Minute || ttl > 25*time.Hour {
+		t.Errorf("Save set a TTL of %v, want the token's expiry plus the grace period", ttl)
+	}
+
+	old, _ := s.Load(ctx)
+	if err := s.CompareAndSwap(ctx, old, testToken("access-2", "refresh-2", 2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(s.Key()); ttl < 25*time.Hour+59*time.Minute || ttl > 26*time.Hour {
+		t.Errorf("CompareAndSwap set a TTL of %v, want the new token's expiry plus the grace period", ttl)
+	}
+
+	mr.FastForward(27 * time.Hour)
+	if _, err := s.Load(ctx); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Load after the TTL returned %v, want ErrNoStoredToken", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	_, client := newRedis(t)
+	s := redisstore.New(client)
+	ctx := context.Background()
+	first := testToken("access-1", "refresh-1", time.Hour)
+	second := testToken("access-2", "refresh-2", time.Hour)
+
+	// An empty old token means nothing may be stored yet.
+	if err := s.CompareAndSwap(ctx, traktdeviceauth.TokenResponse{}, first); err != nil {
+		t.Fatalf("creating the token: %v", err)
+	}
+	if err := s.CompareAndSwap(ctx, traktdeviceauth.TokenResponse{}, second); !errors.Is(err, redisstore.ErrConflict) {
+		t.Fatalf("creating the token twice returned %v, want ErrConflict", err)
+	}
+
+	if err := s.CompareAndSwap(ctx, first, second); err != nil {
+		t.Fatalf("replacing the current token: %v", err)
+	}
+	// A replica which still has the first token lost the race.
+	if err := s.CompareAndSwap(ctx, first, testToken("access-3", "refresh-3", time.Hour)); !errors.Is(err, redisstore.ErrConflict) {
+		t.Fatalf("replacing a stale token returned %v, want ErrConflict", err)
+	}
+
+	got, err := s.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access-2" {
+		t.Errorf("the stored token is %q, want access-2", got.AccessToken)
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	_, client := newRedis(t)
+	s := redisstore.New(client)
+	ctx := context.Background()
+	old := testToken("access", "refresh", time.Hour)
+	if err := s.Save(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 10
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errs <- s.CompareAndSwap(ctx, old, testToken("access-new", "refresh-new", time.Hour))
+		}(i)
+	}
+	won := 0
+	for i := 0; i < writers; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			won++
+		case !errors.Is(err, redisstore.ErrConflict):
+			t.Errorf("CompareAndSwap returned %v, want nil or ErrConflict", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d writers swapped the token, want exactly 1", won)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	mr, client := newRedis(t)
+	s := redisstore.New(client)
+	ctx := context.Background()
+	mr.Close()
+
+	_, loadErr := s.Load(ctx)
+	saveErr := s.Save(ctx, testToken("access", "refresh", time.Hour))
+	casErr := s.CompareAndSwap(ctx, traktdeviceauth.TokenResponse{}, testToken("access", "refresh", time.Hour))
+	for _, err := range []error{loadErr, saveErr, casErr} {
+		var connErr *redisstore.ConnectionError
+		if !errors.Is(err, redisstore.ErrUnavailable) || !errors.As(err, &connErr) {
+			t.Errorf("got %v, want a *ConnectionError", err)
+		}
+		if errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+			t.Errorf("%v is reported as a missing token", err)
+		}
+	}
+}
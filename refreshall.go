@@ -0,0 +1,71 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// RefreshResult is the outcome of refreshing one of the tokens passed to RefreshAll.
+type RefreshResult struct {
+	Input TokenResponse // The token which was refreshed.
+	Token TokenResponse // The new token. It is valid whenever it is set, even if Err is a *HookError.
+	Err   error
+}
+
+// WithConcurrency limits how many requests RefreshAll makes at once. The default is 4 and values less than 1
+// are treated as 1. Other functions ignore it.
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		c.concurrency = n
+	}
+}
+
+// RefreshAll refreshes every token in tokens, for maintenance jobs which renew every stored token at once.
+// It returns a RefreshResult for every token, in the same order, and carries on past tokens which fail.
+//
+// opts apply to every refresh separately, so WithCallTimeout limits each refresh and WithCallRetryPolicy
+// retries each one. Trakt revokes the old refresh tokens, so pass WithTokenSaver to store every new token as
+// soon as it is obtained, rather than after RefreshAll returns.
+//
+// The returned error is only non-nil if ctx ended before every token was refreshed. The results of the tokens
+// which weren't refreshed then hold ctx's error.
+func RefreshAll(ctx context.Context, tokens []TokenResponse, creds Credentials, opts ...Option) ([]RefreshResult, error) {
+	n := newConfig(opts).concurrency
+	if n == 0 {
+		n = 4
+	} else if n < 1 {
+		n = 1
+	}
+
+	client := NewClientFromCredentials(creds, opts...)
+	results := make([]RefreshResult, len(tokens))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+
+	for i, t := range tokens {
+		results[i].Input = t
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = fmt.Errorf("RefreshAll: %w", ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *RefreshResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			r.Token, r.Err = client.RefreshAccessToken(ctx, r.Input.RefreshToken)
+			r.Token = r.Token.keepRefreshTokenIssuedAt(r.Input)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("RefreshAll: %w", err)
+	}
+	return results, nil
+}
@@ -0,0 +1,226 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+var refreshAllCreds = traktdeviceauth.Credentials{ClientID: "client-id", ClientSecret: []byte("client-secret")}
+
+func TestRefreshAll(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// Every third token was revoked, so Trakt rejects it.
+	var tokens []traktdeviceauth.TokenResponse
+	for i := 0; i < 12; i++ {
+		if i%3 == 2 {
+			tokens = append(tokens, traktdeviceauth.TokenResponse{AccessToken: fmt.Sprintf("revoked-%d", i), RefreshToken: fmt.Sprintf("revoked-%d", i)})
+			continue
+		}
+		tokens = append(tokens, issuedToken(srv, time.Now().Add(time.Hour)))
+	}
+
+	const concurrency = 3
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	saved := make(map[string]traktdeviceauth.TokenResponse)
+	slow := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			time.Sleep(10 * time.Millisecond)
+			return next(req)
+		}
+	}
+	save := func(ctx context.Context, tok traktdeviceauth.TokenResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		saved[tok.AccessToken] = tok
+		return nil
+	}
+
+	ctx := context.Background()
+	results, err := traktdeviceauth.RefreshAll(ctx, tokens, refreshAllCreds, append(srv.Options(),
+		traktdeviceauth.WithConcurrency(concurrency), traktdeviceauth.WithMiddleware(slow), traktdeviceauth.WithTokenSaver(save))...)
+	if err != nil {
+		t.Fatalf("RefreshAll returned %v, want nil since failures of single tokens are in the results", err)
+	}
+	if len(results) != len(tokens) {
+		t.Fatalf("got %d results for %d tokens", len(results), len(tokens))
+	}
+
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	for i, r := range results {
+		if r.Input != tokens[i] {
+			t.Errorf("result %d is for %+v, want the results in the order of the tokens", i, r.Input)
+		}
+		if i%3 == 2 {
+			if !errors.Is(r.Err, traktdeviceauth.ErrInvalidGrant) || r.Token != (traktdeviceauth.TokenResponse{}) {
+				t.Errorf("result %d for a revoked token is %+v, want ErrInvalidGrant without a token", i, r)
+			}
+			continue
+		}
+
+		if r.Err != nil || r.Token.AccessToken == "" || r.Token.AccessToken == r.Input.AccessToken {
+			t.Errorf("result %d is %+v, want a new token", i, r)
+			continue
+		}
+		if saved[r.Token.AccessToken] != r.Token {
+			t.Errorf("the token of result %d wasn't saved", i)
+		}
+		if _, err := cl.RefreshAccessToken(ctx, r.Token.RefreshToken); err != nil {
+			t.Errorf("the refresh token of result %d doesn't work: %v", i, err)
+		}
+	}
+	if len(saved) != 8 {
+		t.Errorf("%d tokens were saved, want the 8 refreshed ones", len(saved))
+	}
+	if maxInFlight > concurrency {
+		t.Errorf("%d refreshes were made at once, want at most %d", maxInFlight, concurrency)
+	}
+}
+
+func TestRefreshAllSaverFailure(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	tokens := []traktdeviceauth.TokenResponse{issuedToken(srv, time.Now()), issuedToken(srv, time.Now())}
+
+	diskFull := errors.New("disk full")
+	results, err := traktdeviceauth.RefreshAll(context.Background(), tokens, refreshAllCreds, append(srv.Options(),
+		traktdeviceauth.WithTokenSaver(func(ctx context.Context, tok traktdeviceauth.TokenResponse) error { return diskFull }))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		// The old refresh token has been used up, so the new token has to be returned anyway.
+		var hookErr *traktdeviceauth.HookError
+		if !errors.As(r.Err, &hookErr) || hookErr.Hook != "WithTokenSaver" || !errors.Is(r.Err, diskFull) || r.Token.AccessToken == "" {
+			t.Errorf("result %d is %+v, want the new token with a *HookError", i, r)
+		}
+	}
+}
+
+func TestRefreshAllCallTimeout(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	tokens := []traktdeviceauth.TokenResponse{issuedToken(srv, time.Now()), issuedToken(srv, time.Now()), issuedToken(srv, time.Now())}
+
+	// The first refresh hangs until its call times out.
+	var mu sync.Mutex
+	requests := 0
+	hang := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			requests++
+			first := requests == 1
+			mu.Unlock()
+			if first {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			}
+			return next(req)
+		}
+	}
+
+	start := time.Now()
+	results, err := traktdeviceauth.RefreshAll(context.Background(), tokens, refreshAllCreds, append(srv.Options(),
+		traktdeviceauth.WithConcurrency(1), traktdeviceauth.WithMiddleware(hang), traktdeviceauth.WithCallTimeout(100*time.Millisecond))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("the hanging refresh returned %v, want DeadlineExceeded", results[0].Err)
+	}
+	for i, r := range results[1:] {
+		if r.Err != nil {
+			t.Errorf("result %d: %v, want the timeout to only apply to the hanging refresh", i+1, r.Err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RefreshAll took %v", elapsed)
+	}
+}
+
+func TestRefreshAllRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       traktdeviceauth.RetryPolicy
+		wantRequests int
+		wantFirstErr error
+	}{
+		{"without retries", traktdeviceauth.RetryPolicy{}, 3, traktdeviceauth.ErrServiceOverloaded},
+		{"with retries", traktdeviceauth.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}, 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			// Only the very first refresh request fails.
+			srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Succeed()))
+			tokens := []traktdeviceauth.TokenResponse{issuedToken(srv, time.Now()), issuedToken(srv, time.Now()), issuedToken(srv, time.Now())}
+
+			results, err := traktdeviceauth.RefreshAll(context.Background(), tokens, refreshAllCreds, append(srv.Options(),
+				traktdeviceauth.WithConcurrency(1), traktdeviceauth.WithCallRetryPolicy(tt.policy))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantFirstErr == nil && results[0].Err != nil || !errors.Is(results[0].Err, tt.wantFirstErr) {
+				t.Errorf("the first refresh returned %v, want %v", results[0].Err, tt.wantFirstErr)
+			}
+			for i, r := range results[1:] {
+				if r.Err != nil {
+					t.Errorf("result %d: %v", i+1, r.Err)
+				}
+			}
+			if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != tt.wantRequests {
+				t.Errorf("%d refresh requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRefreshAllCancelled(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	tokens := []traktdeviceauth.TokenResponse{issuedToken(srv, time.Now()), issuedToken(srv, time.Now()), issuedToken(srv, time.Now())}
+
+	// The job is stopped once the first token has been refreshed and saved.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	save := func(context.Context, traktdeviceauth.TokenResponse) error {
+		cancel()
+		return nil
+	}
+
+	results, err := traktdeviceauth.RefreshAll(ctx, tokens, refreshAllCreds, append(srv.Options(),
+		traktdeviceauth.WithConcurrency(1), traktdeviceauth.WithTokenSaver(save))...)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RefreshAll returned %v, want context.Canceled", err)
+	}
+	if results[0].Err != nil || results[0].Token.AccessToken == "" {
+		t.Errorf("the first result is %+v, want the token refreshed before the cancellation", results[0])
+	}
+	for i, r := range results[1:] {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("result %d: %v, want context.Canceled", i+1, r.Err)
+		}
+	}
+}
@@ -0,0 +1,629 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotFound   error = errors.New("no token is scheduled under the name")
+	ErrSchedulerClosed error = errors.New("the refresh scheduler has been closed")
+
+	// ErrReauthorizationRequired is returned by RefreshScheduler.ValidToken for a token which was parked
+	// because Trakt rejected its refresh token. Code classifies it as CodeInvalidGrant.
+	ErrReauthorizationRequired error = errors.New("the token needs reauthorization")
+)
+
+// RefreshStatus is a snapshot of a token tracked by a RefreshScheduler.
+type RefreshStatus struct {
+	ExpiresAt     time.Time // When the current access token expires.
+	NextRefreshAt time.Time // Zero if no refresh is scheduled, because the token needs reauthorization.
+	LastRefreshAt time.Time // Zero until the token has been refreshed by the scheduler.
+	Err           error     // The error of the last refresh, if it failed.
+
+	// NeedsReauthorization is set once Trakt rejected the refresh token, after which the token is parked
+	// instead of being retried. The user has to go through the device flow again and the new token be added,
+	// which WithAutoReauthorization can do. The status is reset once a new token is in place.
+	NeedsReauthorization bool
+
+	// Reauthorizing is set while a device flow started by WithAutoReauthorization waits for the user.
+	Reauthorizing bool
+}
+
+// RefreshSchedulerOption customizes a RefreshScheduler.
+type RefreshSchedulerOption func(*RefreshScheduler)
+
+// WithRefreshWorkers limits how many refreshes are made at once. The default is 4 and values less than 1 are
+// treated as 1.
+func WithRefreshWorkers(n int) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.workers = n
+	}
+}
+
+// WithRefreshMargin sets how long before a token expires it is refreshed. The default is 1 hour.
+func WithRefreshMargin(d time.Duration) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.margin = d
+	}
+}
+
+// WithRefreshJitter spreads refreshes out by moving each one earlier by a random duration up to d, so that
+// tokens which were obtained together aren't all refreshed at the same moment. Tokens which are already due
+// are delayed by up to d instead. The default is 5 minutes.
+func WithRefreshJitter(d time.Duration) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.jitter = d
+	}
+}
+
+// WithRefreshRetryInterval sets how long to wait before retrying a refresh which failed for a reason other
+// than a rejected refresh token. The default is 1 minute.
+func WithRefreshRetryInterval(d time.Duration) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.retryInterval = d
+	}
+}
+
+// WithRefreshCallback calls fn after every refresh attempt, from a worker goroutine or from the goroutine
+// calling ValidToken. t is the token in use
+// afterwards, which is the old one if the refresh failed. err is nil on success, and wraps ErrInvalidGrant if
+// the token was parked because it needs reauthorization.
+//
+// Trakt revokes the refresh token which was used, so fn should store new tokens before returning. fn can't
+// stop the refresh, and a panic in it is recovered and passed to the WithPanicHandler handler given to
+// WithRefreshOptions.
+func WithRefreshCallback(fn func(name string, t TokenResponse, err error)) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.callback = fn
+	}
+}
+
+// WithOnReauthorizationRequired calls fn from the goroutine which made the refresh when the token under name is parked because
+// Trakt rejected its refresh token. err wraps ErrInvalidGrant. Unlike failed refreshes, which are retried,
+// this needs the user to authorize the app again.
+func WithOnReauthorizationRequired(fn func(name string, err error)) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.onReauthorizationRequired = fn
+	}
+}
+
+// WithOnRefreshTokenStale calls fn from a timer goroutine once the refresh token under name is older than
+// threshold, with its age. Tokens are refreshed long before that unless refreshes keep failing or don't rotate
+// the refresh token, and a refresh token which sits unused for very long can stop working, so fn is a chance
+// to ask the user to authorize the app again before that happens. fn is called at most once for every
+// refresh token.
+func WithOnRefreshTokenStale(threshold time.Duration, fn func(name string, age time.Duration)) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.staleAfter, s.onStale = threshold, fn
+	}
+}
+
+// WithAutoReauthorization makes the RefreshScheduler start a new device flow for tokens which need
+// reauthorization, instead of only parking them. display is called with the code, which has to be shown to
+// the user of the token under name. Once they approve it, the new token replaces the parked one, is passed
+// to the WithRefreshCallback callback so that it can be stored, and is kept fresh like any other.
+//
+// If the user doesn't approve the code in time, the token stays parked with the flow's error in its status
+// until a new token is added under its name. The same happens if display panics, with a *PanicError.
+func WithAutoReauthorization(display func(name string, codeResp CodeResponse)) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.display = display
+	}
+}
+
+// WithRefreshOptions passes opts to every refresh made by the RefreshScheduler. Options which limit the
+// request rate, such as a Middleware, apply to all tokens together, since every refresh goes through them.
+func WithRefreshOptions(opts ...Option) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.opts = append(s.opts, opts...)
+	}
+}
+
+// RefreshScheduler keeps many named tokens fresh, for example one per user of a service. Each token is
+// refreshed shortly before it expires, with jitter, by a bounded pool of workers. All of its methods are safe
+// for concurrent use.
+type RefreshScheduler struct {
+	clientID      string
+	clientSecret  string
+	workers       int
+	margin        time.Duration
+	jitter        time.Duration
+	retryInterval time.Duration
+	callback      func(name string, t TokenResponse, err error)
+	opts          []Option
+
+	onReauthorizationRequired func(name string, err error)
+	display                   func(name string, codeResp CodeResponse)
+	staleAfter                time.Duration
+	onStale                   func(name string, age time.Duration)
+	rotating                  RotatingStore
+	rotationGrace             time.Duration
+
+	sem chan struct{} // Holds a value for every refresh in progress.
+
+	now       func() time.Time                          // time.Now, except in tests.
+	afterFunc func(d time.Duration, f func()) stoppable // time.AfterFunc, except in tests.
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	tokens map[string]*scheduledToken
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// stoppable is the part of *time.Timer which RefreshScheduler uses.
+type stoppable interface {
+	Stop() bool
+}
+
+// scheduledToken is a single token of a RefreshScheduler. Its fields are guarded by RefreshScheduler.mu.
+type scheduledToken struct {
+	token      TokenResponse
+	status     RefreshStatus
+	timer      stoppable
+	staleTimer stoppable    // Fires once the refresh token is older than the WithOnRefreshTokenStale threshold.
+	refreshing *refreshCall // The refresh in progress, if any.
+}
+
+// refreshCall is a refresh of a scheduledToken in progress. Other refreshes of the same token wait for it
+// rather than using the refresh token a second time, which Trakt would reject once the first one rotated it.
+type refreshCall struct {
+	done      chan struct{} // Closed once t and err are set.
+	t         TokenResponse
+	err       error
+	abandoned bool // The refresh stopped because its context ended, without changing the token.
+}
+
+// NewRefreshScheduler creates a RefreshScheduler which refreshes tokens of the app identified by clientID
+// and clientSecret.
+func NewRefreshScheduler(clientID, clientSecret string, opts ...RefreshSchedulerOption) *RefreshScheduler {
+	s := &RefreshScheduler{
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		workers:       4,
+		margin:        time.Hour,
+		jitter:        5 * time.Minute,
+		retryInterval: time.Minute,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		tokens:        make(map[string]*scheduledToken),
+		now:           time.Now,
+		afterFunc:     func(d time.Duration, f func()) stoppable { return time.AfterFunc(d, f) },
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	s.sem = make(chan struct{}, s.workers)
+
+	return s
+}
+
+// Add starts keeping t fresh under name, replacing any token which was already added under it, including
+// one which needs reauthorization.
+func (s *RefreshScheduler) Add(name string, t TokenResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSchedulerClosed
+	}
+	if old, ok := s.tokens[name]; ok {
+		old.stop()
+	}
+
+	e := &scheduledToken{token: t, status: RefreshStatus{ExpiresAt: t.ExpiresAt}}
+	s.tokens[name] = e
+	s.schedule(name, e, s.dueAt(t.ExpiresAt))
+	s.watchStaleness(name, e)
+	return nil
+}
+
+// Remove stops refreshing the token under name. It returns ErrTokenNotFound if there is no such token.
+// A refresh which is already in progress still completes and is reported to the callback.
+func (s *RefreshScheduler) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.tokens[name]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	e.stop()
+	delete(s.tokens, name)
+	return nil
+}
+
+// Token returns the current token under name, or ErrTokenNotFound if there is no such token.
+func (s *RefreshScheduler) Token(name string) (TokenResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.tokens[name]
+	if !ok {
+		return TokenResponse{}, ErrTokenNotFound
+	}
+	return e.token, nil
+}
+
+// ValidToken returns the token under name, refreshing it first if it has expired, for example because the
+// scheduled refresh failed or hasn't run yet. ctx bounds the refresh, which is shared with any other refresh of
+// the token already in progress. The refresh is reported to the callback and rescheduled like a scheduled
+// one.
+//
+// ValidToken returns an error wrapping ErrReauthorizationRequired if the token has been parked, or if the
+// refresh parks it, and ErrTokenNotFound if there is no such token.
+func (s *RefreshScheduler) ValidToken(ctx context.Context, name string) (TokenResponse, error) {
+	s.mu.Lock()
+	e, ok := s.tokens[name]
+	switch {
+	case s.closed:
+		s.mu.Unlock()
+		return TokenResponse{}, fmt.Errorf("ValidToken: %w", ErrSchedulerClosed)
+	case !ok:
+		s.mu.Unlock()
+		return TokenResponse{}, fmt.Errorf("ValidToken: %w", ErrTokenNotFound)
+	case e.status.NeedsReauthorization:
+		err := e.status.Err
+		s.mu.Unlock()
+		return TokenResponse{}, fmt.Errorf("ValidToken: %w: %v", ErrReauthorizationRequired, err)
+	case !e.token.Expired():
+		t := e.token
+		s.mu.Unlock()
+		return t, nil
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	// Close must not wait for the caller's deadline.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	t, err := s.refresh(ctx, name, e)
+	var hookErr *HookError
+	switch {
+	case errors.Is(err, ErrInvalidGrant):
+		return TokenResponse{}, fmt.Errorf("ValidToken: %w: %v", ErrReauthorizationRequired, err)
+	case err != nil && !errors.As(err, &hookErr):
+		return TokenResponse{}, fmt.Errorf("ValidToken: %w", err)
+	}
+	// A failed hook still leaves a valid token, which is what the caller asked for.
+	return t, nil
+}
+
+// RefreshTokenAge returns how long ago the refresh token of the token under name was issued, or
+// ErrTokenNotFound if there is no such token. See TokenResponse.RefreshTokenAge.
+func (s *RefreshScheduler) RefreshTokenAge(name string) (time.Duration, error) {
+	t, err := s.Token(name)
+	if err != nil {
+		return 0, err
+	}
+	return t.refreshTokenAgeAt(s.now()), nil
+}
+
+// Status returns a snapshot of the token under name. ok is false if there is no such token.
+func (s *RefreshScheduler) Status(name string) (status RefreshStatus, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.tokens[name]
+	if !ok {
+		return RefreshStatus{}, false
+	}
+	return e.status, true
+}
+
+// NeedsReauthorization returns the sorted names of the tokens which were parked because Trakt rejected their
+// refresh token.
+func (s *RefreshScheduler) NeedsReauthorization() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name, e := range s.tokens {
+		if e.status.NeedsReauthorization {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close stops scheduling refreshes, aborts the ones in progress and waits for them to exit. Add fails after Close.
+func (s *RefreshScheduler) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, e := range s.tokens {
+		e.stop()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// dueAt returns when a token which expires at expiresAt should be refreshed. s.mu must be held.
+func (s *RefreshScheduler) dueAt(expiresAt time.Time) time.Time {
+	var jitter time.Duration
+	if s.jitter > 0 {
+		jitter = time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+
+	now := s.now()
+	at := expiresAt.Add(-s.margin - jitter)
+	if at.Before(now) {
+		// Tokens loaded after a restart are often all due at once, so they are spread out from now instead.
+		at = now.Add(jitter)
+	}
+	return at
+}
+
+// schedule refreshes e at at, unless it has been replaced or removed by then, replacing the refresh which was
+// scheduled before. s.mu must be held.
+func (s *RefreshScheduler) schedule(name string, e *scheduledToken, at time.Time) {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.status.NextRefreshAt = at
+	e.timer = s.afterFunc(at.Sub(s.now()), func() {
+		s.mu.Lock()
+		if s.closed || s.tokens[name] != e {
+			s.mu.Unlock()
+			return
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		defer s.wg.Done()
+		s.refresh(s.ctx, name, e)
+	})
+}
+
+// watchStaleness calls the WithOnRefreshTokenStale callback once the refresh token of e is older than the
+// threshold, unless it has been replaced by then. s.mu must be held.
+func (s *RefreshScheduler) watchStaleness(name string, e *scheduledToken) {
+	if s.onStale == nil {
+		return
+	}
+	if e.staleTimer != nil {
+		e.staleTimer.Stop()
+	}
+	t := e.token
+	issuedAt := t.refreshTokenIssuedAt()
+	if issuedAt.IsZero() {
+		return
+	}
+
+	e.staleTimer = s.afterFunc(issuedAt.Add(s.staleAfter).Sub(s.now()), func() {
+		s.mu.Lock()
+		if s.closed || s.tokens[name] != e || e.token.RefreshToken != t.RefreshToken {
+			s.mu.Unlock()
+			return
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		defer s.wg.Done()
+		s.observe("WithOnRefreshTokenStale", func() { s.onStale(name, t.refreshTokenAgeAt(s.now())) })
+	})
+}
+
+// refresh refreshes e with ctx once a worker is free and schedules the next refresh. If e is already being
+// refreshed, it waits for that refresh and returns its outcome instead. It returns the token in use afterwards
+// and the error of the refresh.
+func (s *RefreshScheduler) refresh(ctx context.Context, name string, e *scheduledToken) (TokenResponse, error) {
+	s.mu.Lock()
+	for e.refreshing != nil {
+		call := e.refreshing
+		s.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return TokenResponse{}, ctx.Err()
+		}
+		if !call.abandoned {
+			return call.t, call.err
+		}
+		// Whoever started the refresh gave up on it, so it is up to this one.
+		s.mu.Lock()
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	e.refreshing = call
+	old := e.token
+	s.mu.Unlock()
+	defer close(call.done)
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		s.mu.Lock()
+		e.refreshing = nil
+		call.abandoned, call.err = true, ctx.Err()
+		s.mu.Unlock()
+		return TokenResponse{}, call.err
+	}
+	defer func() { <-s.sem }()
+
+	t, err := s.refreshToken(ctx, name, old)
+
+	s.mu.Lock()
+	e.refreshing = nil
+	call.err = err
+	now := s.now()
+	next := now.Add(s.retryInterval)
+	parked := false
+	var hookErr *HookError
+	switch {
+	case err == nil, errors.As(err, &hookErr):
+		// A failed hook still leaves a valid token, which is kept along with the error.
+		e.token = t
+		e.status = RefreshStatus{ExpiresAt: t.ExpiresAt, LastRefreshAt: now, Err: err}
+		if due := s.dueAt(t.ExpiresAt); due.After(next) {
+			// Tokens which are due again right away wait for the retry interval, rather than being refreshed
+			// in a tight loop.
+			next = due
+		}
+	case ctx.Err() != nil:
+		// Either the scheduler was closed, or the caller of ValidToken gave up, in which case the refresh which
+		// was scheduled before still stands.
+		call.abandoned = true
+		s.mu.Unlock()
+		return TokenResponse{}, err
+	case errors.Is(err, ErrInvalidGrant):
+		e.status.Err = err
+		e.status.NeedsReauthorization = true
+	default:
+		e.status.Err = err
+	}
+
+	// The token may have been replaced or removed while it was being refreshed, in which case only the
+	// callback learns about the outcome.
+	if s.tokens[name] == e && !s.closed {
+		if e.status.NeedsReauthorization {
+			e.status.NextRefreshAt = time.Time{}
+			parked = true
+			if s.display != nil {
+				e.status.Reauthorizing = true
+				s.wg.Add(1)
+				go s.reauthorize(name, e)
+			}
+		} else {
+			s.schedule(name, e, next)
+			if e.token.RefreshToken != old.RefreshToken {
+				s.watchStaleness(name, e)
+			}
+		}
+	}
+	t = e.token
+	call.t = t
+	s.mu.Unlock()
+
+	if s.callback != nil {
+		s.observe("WithRefreshCallback", func() { s.callback(name, t, err) })
+	}
+	if parked && s.onReauthorizationRequired != nil {
+		s.observe("WithOnReauthorizationRequired", func() { s.onReauthorizationRequired(name, err) })
+	}
+	return t, err
+}
+
+// refreshToken refreshes old, the token under name, through the WithRotatingStore store if there is one.
+func (s *RefreshScheduler) refreshToken(ctx context.Context, name string, old TokenResponse) (TokenResponse, error) {
+	refresh := func(ctx context.Context, old TokenResponse) (TokenResponse, error) {
+		t, err := RefreshAccessTokenContext(ctx, old.RefreshToken, s.clientID, s.clientSecret, s.options(name)...)
+		return t.keepRefreshTokenIssuedAt(old), err
+	}
+	if s.rotating == nil {
+		return refresh(ctx, old)
+	}
+	return refreshRotated(ctx, s.rotating, name, s.rotationGrace, old, refresh)
+}
+
+// storeRotated saves t, a token which didn't come from a refresh, to the WithRotatingStore store as the next
+// generation of the token under name. A failure is returned as a *HookError, since t is valid anyway.
+func (s *RefreshScheduler) storeRotated(ctx context.Context, name string, t TokenResponse) error {
+	cur, err := s.rotating.LoadRotated(ctx, name)
+	if err == nil || errors.Is(err, ErrNoStoredToken) {
+		_, err = s.rotating.Rotate(ctx, name, cur.Generation, t, s.rotationGrace)
+	}
+	if err != nil {
+		return &HookError{Hook: "WithRotatingStore", Err: err}
+	}
+	return nil
+}
+
+// reauthorize runs the device flow for the parked token e and replaces it with the token the user approves.
+func (s *RefreshScheduler) reauthorize(name string, e *scheduledToken) {
+	defer s.wg.Done()
+
+	opts := s.options(name)
+	t, err := func() (TokenResponse, error) {
+		codeResp, err := GenerateNewCodeContext(s.ctx, s.clientID, opts...)
+		if err != nil {
+			return TokenResponse{}, err
+		}
+		err = catchPanic("WithAutoReauthorization", func() error {
+			s.display(name, codeResp)
+			return nil
+		})
+		if err != nil {
+			return TokenResponse{}, err
+		}
+		return PollForAuthTokenContext(s.ctx, codeResp, s.clientID, s.clientSecret, opts...)
+	}()
+	if err == nil && s.rotating != nil {
+		err = s.storeRotated(s.ctx, name, t)
+	}
+
+	s.mu.Lock()
+	e.status.Reauthorizing = false
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return
+	}
+	current := s.tokens[name] == e && !s.closed
+
+	var hookErr *HookError
+	if err != nil && !errors.As(err, &hookErr) {
+		e.status.Err = err
+		s.mu.Unlock()
+		return
+	}
+
+	// The parked token starts over as if it had just been added, unless it was replaced in the meantime.
+	e.token = t
+	e.status = RefreshStatus{ExpiresAt: t.ExpiresAt, LastRefreshAt: s.now(), Err: err}
+	if current {
+		s.schedule(name, e, s.dueAt(t.ExpiresAt))
+		s.watchStaleness(name, e)
+	}
+	s.mu.Unlock()
+
+	if s.callback != nil {
+		s.observe("WithRefreshCallback", func() { s.callback(name, t, err) })
+	}
+}
+
+// observe calls fn, one of the RefreshScheduler's callbacks, reporting a panic to the WithPanicHandler
+// handler passed to WithRefreshOptions.
+func (s *RefreshScheduler) observe(hook string, fn func()) {
+	newConfig(s.opts).observe(hook, fn)
+}
+
+// options returns the options used for refreshing the token under name.
+func (s *RefreshScheduler) options(name string) []Option {
+	opts := make([]Option, 0, len(s.opts)+1)
+	opts = append(opts, s.opts...)
+	return append(opts, withAuditKey(name))
+}
+
+// stop cancels the next refresh of e. The RefreshScheduler's mu must be held.
+func (e *scheduledToken) stop() {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	if e.staleTimer != nil {
+		e.staleTimer.Stop()
+	}
+	e.status.NextRefreshAt = time.Time{}
+}
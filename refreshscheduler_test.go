@@ -0,0 +1,640 @@
+package traktdeviceauth_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// fakeClock is a clock for a RefreshScheduler which only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+	done  bool // Fired or stopped.
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) interface{ Stop() bool } {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the functions of the timers which became due, each in a
+// goroutine of its own like time.AfterFunc does.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.done:
+		case !t.at.After(c.now):
+			t.done = true
+			go t.f()
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+// refreshOutcome is a call of the WithRefreshCallback callback.
+type refreshOutcome struct {
+	name string
+	at   time.Time // By the fake clock.
+	t    traktdeviceauth.TokenResponse
+	err  error
+}
+
+// newFakeClockScheduler creates a RefreshScheduler for srv which runs on a fake clock starting now, and
+// sends every refresh outcome to the returned channel.
+func newFakeClockScheduler(t *testing.T, srv *traktdeviceauthtest.Server, opts ...traktdeviceauth.RefreshSchedulerOption) (*traktdeviceauth.RefreshScheduler, *fakeClock, chan refreshOutcome) {
+	t.Helper()
+
+	clock := &fakeClock{now: time.Now()}
+	outcomes := make(chan refreshOutcome, 1000)
+	opts = append([]traktdeviceauth.RefreshSchedulerOption{
+		traktdeviceauth.WithRefreshOptions(srv.Options()...),
+		traktdeviceauth.WithRefreshCallback(func(name string, tok traktdeviceauth.TokenResponse, err error) {
+			outcomes <- refreshOutcome{name: name, at: clock.Now(), t: tok, err: err}
+		}),
+	}, opts...)
+	s := traktdeviceauth.NewRefreshScheduler("client-id", "client-secret", opts...)
+	traktdeviceauth.SetRefreshSchedulerClock(s, clock.Now, clock.AfterFunc)
+	t.Cleanup(func() { s.Close() })
+	return s, clock, outcomes
+}
+
+// waitForOutcomes receives n refresh outcomes.
+func waitForOutcomes(t *testing.T, outcomes chan refreshOutcome, n int) []refreshOutcome {
+	t.Helper()
+
+	got := make([]refreshOutcome, 0, n)
+	for len(got) < n {
+		select {
+		case o := <-outcomes:
+			got = append(got, o)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d refresh outcomes, want %d", len(got), n)
+		}
+	}
+	return got
+}
+
+// expectNoOutcome fails the test if a refresh is reported within a short while.
+func expectNoOutcome(t *testing.T, outcomes chan refreshOutcome) {
+	t.Helper()
+
+	select {
+	case o := <-outcomes:
+		t.Errorf("%s was refreshed at %v", o.name, o.at)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// issuedToken returns a token which srv will refresh, expiring at expiresAt.
+func issuedToken(srv *traktdeviceauthtest.Server, expiresAt time.Time) traktdeviceauth.TokenResponse {
+	issued := srv.IssueToken()
+	return traktdeviceauth.TokenResponse{AccessToken: issued.AccessToken, RefreshToken: issued.RefreshToken, ExpiresAt: expiresAt}
+}
+
+func TestRefreshSchedulerStaggered(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	const tokens, workers = 100, 4
+	const margin, jitter = time.Hour, 5 * time.Minute
+
+	// Every refresh takes a while, so that refreshes which are due together overlap.
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	slow := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			time.Sleep(5 * time.Millisecond)
+			return next(req)
+		}
+	}
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshWorkers(workers), traktdeviceauth.WithRefreshMargin(margin), traktdeviceauth.WithRefreshJitter(jitter),
+		traktdeviceauth.WithRefreshOptions(traktdeviceauth.WithMiddleware(slow)))
+
+	// The tokens expire a minute apart, starting in 2 hours.
+	start := clock.Now()
+	due := make(map[string]time.Time)
+	for i := 0; i < tokens; i++ {
+		name := fmt.Sprintf("user-%03d", i)
+		expiresAt := start.Add(2*time.Hour + time.Duration(i)*time.Minute)
+		if err := s.Add(name, issuedToken(srv, expiresAt)); err != nil {
+			t.Fatal(err)
+		}
+		status, _ := s.Status(name)
+		earliest, latest := expiresAt.Add(-margin-jitter), expiresAt.Add(-margin)
+		if status.NextRefreshAt.Before(earliest) || status.NextRefreshAt.After(latest) {
+			t.Fatalf("%s is due at %v, want between %v and %v", name, status.NextRefreshAt, earliest, latest)
+		}
+		due[name] = status.NextRefreshAt
+	}
+
+	refreshed := make(map[string]refreshOutcome)
+	for clock.Now().Before(start.Add(2*time.Hour + tokens*time.Minute)) {
+		clock.Advance(time.Minute)
+
+		n := 0
+		for name, at := range due {
+			if _, ok := refreshed[name]; !ok && !at.After(clock.Now()) {
+				n++
+			}
+		}
+		// The jitter spreads the tokens due in a minute over 5 minutes, so at most 6 can fall into one.
+		if n > 6 {
+			t.Errorf("%d tokens are due at %v, want them spread out", n, clock.Now())
+		}
+		for _, o := range waitForOutcomes(t, outcomes, n) {
+			if o.err != nil {
+				t.Fatalf("refreshing %s: %v", o.name, o.err)
+			}
+			if _, ok := refreshed[o.name]; ok {
+				t.Fatalf("%s was refreshed twice", o.name)
+			}
+			if due[o.name].After(o.at) {
+				t.Errorf("%s was refreshed at %v, before it was due at %v", o.name, o.at, due[o.name])
+			}
+			refreshed[o.name] = o
+		}
+		expectNoOutcomeYet(t, outcomes)
+	}
+
+	if len(refreshed) != tokens {
+		t.Fatalf("%d tokens were refreshed, want %d", len(refreshed), tokens)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != tokens {
+		t.Errorf("%d refresh requests, want %d", n, tokens)
+	}
+	if maxInFlight > workers {
+		t.Errorf("%d refreshes were made at once, want at most %d", maxInFlight, workers)
+	}
+	for name, o := range refreshed {
+		status, _ := s.Status(name)
+		if !status.LastRefreshAt.Equal(o.at) || !status.ExpiresAt.Equal(o.t.ExpiresAt) || status.Err != nil {
+			t.Errorf("%s has status %+v after being refreshed at %v", name, status, o.at)
+		}
+		// The new tokens last for months, so they are scheduled relative to their own expiry.
+		if earliest := o.t.ExpiresAt.Add(-margin - jitter); status.NextRefreshAt.Before(earliest) {
+			t.Errorf("%s is due again at %v, want after %v", name, status.NextRefreshAt, earliest)
+		}
+		if cur, _ := s.Token(name); cur.AccessToken != o.t.AccessToken {
+			t.Errorf("%s holds %q, want the refreshed %q", name, cur.AccessToken, o.t.AccessToken)
+		}
+	}
+}
+
+// expectNoOutcomeYet fails the test if a refresh outcome is waiting in outcomes.
+func expectNoOutcomeYet(t *testing.T, outcomes chan refreshOutcome) {
+	t.Helper()
+
+	select {
+	case o := <-outcomes:
+		t.Errorf("%s was refreshed at %v although it wasn't due", o.name, o.at)
+	default:
+	}
+}
+
+func TestRefreshSchedulerParksInvalidGrant(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var parked []string
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0), traktdeviceauth.WithRefreshRetryInterval(time.Minute),
+		traktdeviceauth.WithOnReauthorizationRequired(func(name string, err error) {
+			if !errors.Is(err, traktdeviceauth.ErrInvalidGrant) {
+				t.Errorf("%s was parked with %v, want ErrInvalidGrant", name, err)
+			}
+			mu.Lock()
+			parked = append(parked, name)
+			mu.Unlock()
+		}))
+
+	expiresAt := clock.Now().Add(2 * time.Hour)
+	revoked := traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: expiresAt}
+	for _, name := range []string{"carol", "alice"} {
+		if err := s.Add(name, revoked); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Add("bob", issuedToken(srv, expiresAt)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	for _, o := range waitForOutcomes(t, outcomes, 3) {
+		if wantParked := o.name != "bob"; errors.Is(o.err, traktdeviceauth.ErrInvalidGrant) != wantParked {
+			t.Errorf("refreshing %s: %v", o.name, o.err)
+		}
+	}
+
+	if got, want := s.NeedsReauthorization(), []string{"alice", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeedsReauthorization() = %v, want %v", got, want)
+	}
+	mu.Lock()
+	sort.Strings(parked)
+	if want := []string{"alice", "carol"}; !reflect.DeepEqual(parked, want) {
+		t.Errorf("WithOnReauthorizationRequired was called for %v, want %v", parked, want)
+	}
+	mu.Unlock()
+	status, _ := s.Status("alice")
+	if !status.NeedsReauthorization || !status.NextRefreshAt.IsZero() || !errors.Is(status.Err, traktdeviceauth.ErrInvalidGrant) {
+		t.Errorf("alice has status %+v, want it parked", status)
+	}
+	if _, err := s.ValidToken(context.Background(), "alice"); !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) {
+		t.Errorf("ValidToken of a parked token returned %v, want ErrReauthorizationRequired", err)
+	}
+
+	// Parked tokens aren't retried, however long it takes the user to come back.
+	requests := len(srv.RequestsTo(traktdeviceauth.EndpointToken))
+	for i := 0; i < 24; i++ {
+		clock.Advance(time.Hour)
+	}
+	expectNoOutcome(t, outcomes)
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != requests {
+		t.Errorf("%d more refresh requests were made for parked tokens", n-requests)
+	}
+
+	// Adding a new token, such as one from a new device flow, starts over.
+	if err := s.Add("alice", issuedToken(srv, clock.Now().Add(2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.NeedsReauthorization(), []string{"carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeedsReauthorization() after adding a new token = %v, want %v", got, want)
+	}
+	clock.Advance(time.Hour)
+	if o := waitForOutcomes(t, outcomes, 1)[0]; o.name != "alice" || o.err != nil {
+		t.Errorf("got outcome %s: %v, want the new token of alice refreshed", o.name, o.err)
+	}
+}
+
+func TestRefreshSchedulerRetriesFailures(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(http.StatusForbidden), traktdeviceauthtest.Succeed()))
+
+	const retryInterval = 10 * time.Minute
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0), traktdeviceauth.WithRefreshRetryInterval(retryInterval))
+	if err := s.Add("alice", issuedToken(srv, clock.Now().Add(2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	o := waitForOutcomes(t, outcomes, 1)[0]
+	if !errors.Is(o.err, traktdeviceauth.ErrForbidden) {
+		t.Fatalf("the first refresh returned %v, want ErrForbidden", o.err)
+	}
+	status, _ := s.Status("alice")
+	if status.NeedsReauthorization || !errors.Is(status.Err, traktdeviceauth.ErrForbidden) || !status.NextRefreshAt.Equal(clock.Now().Add(retryInterval)) {
+		t.Errorf("alice has status %+v, want a retry in %v", status, retryInterval)
+	}
+
+	clock.Advance(retryInterval - time.Minute)
+	expectNoOutcome(t, outcomes)
+	clock.Advance(time.Minute)
+	if o := waitForOutcomes(t, outcomes, 1)[0]; o.err != nil {
+		t.Fatalf("the retry returned %v", o.err)
+	}
+	if status, _ := s.Status("alice"); status.Err != nil || status.LastRefreshAt.IsZero() {
+		t.Errorf("alice has status %+v after the retry succeeded", status)
+	}
+}
+
+func TestRefreshSchedulerWorkers(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	const tokens, workers = 20, 3
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	slow := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			time.Sleep(20 * time.Millisecond)
+			return next(req)
+		}
+	}
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshWorkers(workers), traktdeviceauth.WithRefreshJitter(0),
+		traktdeviceauth.WithRefreshOptions(traktdeviceauth.WithMiddleware(slow)))
+
+	// Tokens loaded after a restart are often all due at once.
+	for i := 0; i < tokens; i++ {
+		if err := s.Add(fmt.Sprintf("user-%d", i), issuedToken(srv, clock.Now().Add(time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(0)
+	for _, o := range waitForOutcomes(t, outcomes, tokens) {
+		if o.err != nil {
+			t.Errorf("refreshing %s: %v", o.name, o.err)
+		}
+	}
+	if maxInFlight != workers {
+		t.Errorf("%d refreshes were made at once, want the %d workers busy", maxInFlight, workers)
+	}
+}
+
+func TestRefreshSchedulerAutoReauthorization(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+
+	var s *traktdeviceauth.RefreshScheduler
+	displayed := make(chan traktdeviceauth.RefreshStatus, 1)
+	var codes []traktdeviceauth.CodeResponse
+	parked := make(chan string, 10)
+	s, clock, outcomes := newFakeClockScheduler(t, srv,
+		traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0),
+		traktdeviceauth.WithOnReauthorizationRequired(func(name string, err error) { parked <- name }),
+		traktdeviceauth.WithAutoReauthorization(func(name string, codeResp traktdeviceauth.CodeResponse) {
+			codes = append(codes, codeResp)
+			status, _ := s.Status(name)
+			displayed <- status
+		}))
+
+	revoked := traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: clock.Now().Add(2 * time.Hour)}
+	if err := s.Add("alice", revoked); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if o := waitForOutcomes(t, outcomes, 1)[0]; !errors.Is(o.err, traktdeviceauth.ErrInvalidGrant) {
+		t.Fatalf("the refresh returned %v, want ErrInvalidGrant", o.err)
+	}
+
+	// The code is shown to the user while the token is parked.
+	select {
+	case status := <-displayed:
+		if !status.NeedsReauthorization || !status.Reauthorizing {
+			t.Errorf("status while showing the code is %+v, want it parked and reauthorizing", status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no code was displayed")
+	}
+	if len(codes) != 1 || codes[0].UserCode == "" {
+		t.Fatalf("displayed codes %+v, want one", codes)
+	}
+
+	// Once approved, the new token is handed to the callback and the status starts over.
+	o := waitForOutcomes(t, outcomes, 1)[0]
+	if o.err != nil || o.t.AccessToken == "" || o.t.AccessToken == revoked.AccessToken {
+		t.Fatalf("got outcome %+v after the approval, want the new token", o)
+	}
+	status, _ := s.Status("alice")
+	if status.NeedsReauthorization || status.Reauthorizing || status.Err != nil || status.NextRefreshAt.IsZero() {
+		t.Errorf("status after the approval is %+v, want it reset", status)
+	}
+	if names := s.NeedsReauthorization(); len(names) != 0 {
+		t.Errorf("NeedsReauthorization() = %v after the approval", names)
+	}
+	if tok, err := s.ValidToken(context.Background(), "alice"); err != nil || tok != o.t {
+		t.Errorf("ValidToken returned %+v, %v, want the new token", tok, err)
+	}
+	select {
+	case <-parked:
+	case <-time.After(10 * time.Second):
+		t.Error("WithOnReauthorizationRequired wasn't called")
+	}
+
+	// The new token is refreshed like any other.
+	clock.Advance(o.t.ExpiresAt.Sub(clock.Now()))
+	if o := waitForOutcomes(t, outcomes, 1)[0]; o.err != nil {
+		t.Errorf("refreshing the new token: %v", o.err)
+	}
+	if n := len(parked); n != 0 {
+		t.Errorf("WithOnReauthorizationRequired was called %d more times", n)
+	}
+}
+
+func TestRefreshSchedulerAutoReauthorizationFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  traktdeviceauthtest.Scenario
+		display func(string, traktdeviceauth.CodeResponse)
+		check   func(err error) bool
+	}{
+		{"denied", traktdeviceauthtest.DenyAfterPolls(0), func(string, traktdeviceauth.CodeResponse) {}, func(err error) bool {
+			return errors.Is(err, traktdeviceauth.ErrDeviceCodeDenied)
+		}},
+		{"display panics", traktdeviceauthtest.ApproveAfterPolls(0), func(string, traktdeviceauth.CodeResponse) { panic("no screen") }, func(err error) bool {
+			var panicErr *traktdeviceauth.PanicError
+			return errors.As(err, &panicErr) && panicErr.Hook == "WithAutoReauthorization"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(tt.script)
+
+			s, clock, outcomes := newFakeClockScheduler(t, srv, traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0),
+				traktdeviceauth.WithAutoReauthorization(tt.display))
+			if err := s.Add("alice", traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: clock.Now().Add(2 * time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(time.Hour)
+			waitForOutcomes(t, outcomes, 1)
+
+			deadline := time.Now().Add(10 * time.Second)
+			status, _ := s.Status("alice")
+			for status.Reauthorizing && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				status, _ = s.Status("alice")
+			}
+
+			// The token stays parked with the error of the flow.
+			if !status.NeedsReauthorization || status.Reauthorizing || !tt.check(status.Err) {
+				t.Errorf("status after the failed reauthorization is %+v", status)
+			}
+			if _, err := s.ValidToken(context.Background(), "alice"); !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) {
+				t.Errorf("ValidToken returned %v, want ErrReauthorizationRequired", err)
+			}
+			expectNoOutcome(t, outcomes)
+		})
+	}
+}
+
+// serverCreatedAt makes token responses report the time of clock as their created_at, as if the server ran on
+// the fake clock too.
+func serverCreatedAt(clock *fakeClock) traktdeviceauth.Middleware {
+	return func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := next(req)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				return resp, err
+			}
+			var doc map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&doc)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			doc["created_at"] = clock.Now().Unix()
+			b, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body, resp.ContentLength = io.NopCloser(bytes.NewReader(b)), int64(len(b))
+			return resp, nil
+		}
+	}
+}
+
+// staleCall is a call of the WithOnRefreshTokenStale callback.
+type staleCall struct {
+	name string
+	age  time.Duration
+}
+
+func TestRefreshSchedulerRefreshTokenAge(t *testing.T) {
+	const day, threshold = 24 * time.Hour, 30 * 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		rotate bool
+		// wantStaleAfter is how long after the refresh at day 20 the hook fires.
+		wantStaleAfter time.Duration
+		// wantAgeAfterRefresh is the age of the refresh token right after the refresh.
+		wantAgeAfterRefresh time.Duration
+	}{
+		{"rotated refresh token", true, threshold, 0},
+		{"kept refresh token", false, threshold - 20*day, 20 * day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			if tt.rotate {
+				srv.Script(traktdeviceauthtest.RotateRefreshToken())
+			}
+
+			stale := make(chan staleCall, 10)
+			// The middleware is created before the clock it uses, which newFakeClockScheduler creates.
+			var clock *fakeClock
+			s, clock, outcomes := newFakeClockScheduler(t, srv,
+				traktdeviceauth.WithRefreshMargin(time.Hour), traktdeviceauth.WithRefreshJitter(0),
+				traktdeviceauth.WithRefreshOptions(traktdeviceauth.WithMiddleware(func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+					return serverCreatedAt(clock)(next)
+				})),
+				traktdeviceauth.WithOnRefreshTokenStale(threshold, func(name string, age time.Duration) {
+					stale <- staleCall{name, age}
+				}))
+			expectNoStale := func() {
+				t.Helper()
+				select {
+				case c := <-stale:
+					t.Errorf("the refresh token of %s was reported stale at %v", c.name, c.age)
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			checkAge := func(want time.Duration) {
+				t.Helper()
+				// created_at has a resolution of a second.
+				if got, err := s.RefreshTokenAge("user"); err != nil || got < want || got > want+time.Second {
+					t.Errorf("RefreshTokenAge = %v, %v, want %v", got, err, want)
+				}
+			}
+
+			// The token was issued now, and is refreshed an hour before it expires on day 20.
+			start := clock.Now()
+			tok := issuedToken(srv, start.Add(20*day))
+			tok.CreatedAt = start
+			if err := s.Add("user", tok); err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(10 * day)
+			expectNoStale()
+			checkAge(10 * day)
+
+			clock.Advance(10 * day)
+			if o := waitForOutcomes(t, outcomes, 1)[0]; o.err != nil {
+				t.Fatal(o.err)
+			} else if rotated := o.t.RefreshToken != tok.RefreshToken; rotated != tt.rotate {
+				t.Fatalf("the refresh rotated the refresh token: %v, want %v", rotated, tt.rotate)
+			}
+			checkAge(tt.wantAgeAfterRefresh)
+
+			// The hook fires once the refresh token in use reaches the threshold, and only once.
+			clock.Advance(tt.wantStaleAfter - time.Second)
+			expectNoStale()
+			clock.Advance(2 * time.Second)
+			select {
+			case c := <-stale:
+				if c.name != "user" || c.age < threshold || c.age > threshold+2*time.Second {
+					t.Errorf("the hook was called for %s at %v, want user at %v", c.name, c.age, threshold)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the hook wasn't called at the threshold")
+			}
+			clock.Advance(day)
+			expectNoStale()
+		})
+	}
+}
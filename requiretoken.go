@@ -0,0 +1,69 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"net/http"
+)
+
+// tokenContextKey is the context key under which RequireToken stores the token.
+type tokenContextKey struct{}
+
+// TokenFromContext returns the token stored in ctx by RequireToken. ok is false if there is none.
+func TokenFromContext(ctx context.Context) (t TokenResponse, ok bool) {
+	t, ok = ctx.Value(tokenContextKey{}).(TokenResponse)
+	return t, ok
+}
+
+// RequireTokenOption customizes the handlers created by RequireToken.
+type RequireTokenOption func(*requireTokenConfig)
+
+// requireTokenConfig is the configuration built from RequireTokenOptions.
+type requireTokenConfig struct {
+	onError func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// WithTokenErrorHandler replaces the response RequireToken sends when it has no valid token. err wraps
+// ErrReauthorizationRequired if the user has to authorize the app again, and is the error of the failed
+// refresh otherwise.
+func WithTokenErrorHandler(fn func(w http.ResponseWriter, r *http.Request, err error)) RequireTokenOption {
+	return func(c *requireTokenConfig) {
+		c.onError = fn
+	}
+}
+
+// RequireToken returns net/http middleware which gets a valid token under name from s with ValidToken before
+// calling the wrapped handler, which can retrieve it with TokenFromContext. The request's context bounds the
+// refresh, if one is needed, so server timeouts and disconnecting clients cut it short.
+//
+// If there is no valid token, because it needs reauthorization or couldn't be refreshed, the wrapped handler
+// isn't called. Instead, RequireToken responds with 503 and the error as JSON, in the format of ErrorJSON,
+// unless WithTokenErrorHandler is used.
+func RequireToken(s *RefreshScheduler, name string, opts ...RequireTokenOption) func(http.Handler) http.Handler {
+	c := requireTokenConfig{onError: writeTokenError}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, err := s.ValidToken(r.Context(), name)
+			if err != nil {
+				c.onError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t)))
+		})
+	}
+}
+
+// writeTokenError is the default error response of RequireToken.
+func writeTokenError(w http.ResponseWriter, r *http.Request, err error) {
+	body, jsonErr := ErrorJSON(err)
+	if jsonErr != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(body)
+}
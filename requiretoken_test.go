@@ -0,0 +1,174 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// tokenEcho is a handler which responds with the token RequireToken passed to it.
+var tokenEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	tok, ok := traktdeviceauth.TokenFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no token in the context", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(tok.AccessToken))
+})
+
+// newRequireTokenScheduler creates a RefreshScheduler for srv which holds tok under "alice".
+func newRequireTokenScheduler(t *testing.T, srv *traktdeviceauthtest.Server, tok traktdeviceauth.TokenResponse, opts ...traktdeviceauth.Option) *traktdeviceauth.RefreshScheduler {
+	t.Helper()
+
+	s := traktdeviceauth.NewRefreshScheduler("client-id", "client-secret", traktdeviceauth.WithRefreshOptions(append(srv.Options(), opts...)...))
+	t.Cleanup(func() { s.Close() })
+	if err := s.Add("alice", tok); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRequireToken(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	valid := issuedToken(srv, time.Now().Add(24*time.Hour))
+	s := newRequireTokenScheduler(t, srv, valid)
+
+	w := httptest.NewRecorder()
+	traktdeviceauth.RequireToken(s, "alice")(tokenEcho).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != valid.AccessToken {
+		t.Errorf("got %d %q, want the stored token", w.Code, w.Body.String())
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 0 {
+		t.Errorf("%d refresh requests for a valid token", n)
+	}
+}
+
+func TestRequireTokenRefreshes(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	expired := issuedToken(srv, time.Now().Add(-time.Minute))
+	s := newRequireTokenScheduler(t, srv, expired)
+	h := traktdeviceauth.RequireToken(s, "alice")(tokenEcho)
+
+	// Concurrent requests share a single refresh, since the refresh token can only be used once.
+	const requests = 5
+	bodies := make([]string, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("request %d: %d %s", i, w.Code, w.Body.String())
+			}
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	refreshed, err := s.Token("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, body := range bodies {
+		if body != refreshed.AccessToken || body == expired.AccessToken {
+			t.Errorf("request %d got %q, want the refreshed token %q", i, body, refreshed.AccessToken)
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refresh requests, want 1", n)
+	}
+}
+
+func TestRequireTokenReauthorizationRequired(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	// The refresh token was revoked, so Trakt rejects it.
+	revoked := traktdeviceauth.TokenResponse{AccessToken: "revoked", RefreshToken: "revoked", ExpiresAt: time.Now().Add(-time.Minute)}
+	s := newRequireTokenScheduler(t, srv, revoked)
+
+	called := false
+	h := traktdeviceauth.RequireToken(s, "alice")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("request %d: %d %s, want 503 with JSON", i, w.Code, w.Header().Get("Content-Type"))
+		}
+		var body traktdeviceauth.PublicError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != traktdeviceauth.CodeInvalidGrant || body.Retryable {
+			t.Errorf("request %d: body %s (%v), want the invalid_grant PublicError", i, w.Body.String(), err)
+		}
+	}
+	if called {
+		t.Error("the handler was called without a token")
+	}
+	// The token was parked by the first request, so the second one didn't try again.
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refresh requests, want 1", n)
+	}
+}
+
+func TestRequireTokenErrorHandler(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	s := newRequireTokenScheduler(t, srv, issuedToken(srv, time.Now().Add(time.Hour)))
+
+	var gotErr error
+	onError := traktdeviceauth.WithTokenErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		http.Redirect(w, r, "/link", http.StatusFound)
+	})
+	w := httptest.NewRecorder()
+	traktdeviceauth.RequireToken(s, "bob", onError)(tokenEcho).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/link" {
+		t.Errorf("got %d to %q, want the response of the error handler", w.Code, w.Header().Get("Location"))
+	}
+	if !errors.Is(gotErr, traktdeviceauth.ErrTokenNotFound) {
+		t.Errorf("the error handler got %v, want ErrTokenNotFound", gotErr)
+	}
+}
+
+func TestRequireTokenDeadline(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	// The refresh hangs until its request is cancelled.
+	hang := func(next traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+	}
+	s := newRequireTokenScheduler(t, srv, issuedToken(srv, time.Now().Add(-time.Minute)),
+		traktdeviceauth.WithMiddleware(hang), traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	w := httptest.NewRecorder()
+	traktdeviceauth.RequireToken(s, "alice")(tokenEcho).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the request took %v, want the refresh cut short by its deadline", elapsed)
+	}
+	var body traktdeviceauth.PublicError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusServiceUnavailable || body.Code != traktdeviceauth.CodeTimeout {
+		t.Errorf("got %d %s, want 503 with the timeout code", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenFromContextWithoutToken(t *testing.T) {
+	if tok, ok := traktdeviceauth.TokenFromContext(context.Background()); ok || tok != (traktdeviceauth.TokenResponse{}) {
+		t.Errorf("TokenFromContext of an empty context returned %+v, %v", tok, ok)
+	}
+}
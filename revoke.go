@@ -0,0 +1,38 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// RevokeToken wraps RevokeTokenContext using context.Background().
+func RevokeToken(accessToken, clientID, clientSecret string, opts ...Option) error {
+	return RevokeTokenContext(context.Background(), accessToken, clientID, clientSecret, opts...)
+}
+
+// RevokeTokenContext invalidates accessToken, for example when the user signs out, so that it stops working
+// before it expires. Trakt answers an access token which is already invalid with 401, which is returned as an
+// error wrapping ErrInvalidGrant. Callers which only want the token gone can treat that as success.
+//
+// clientSecret may be empty for public clients, which have none.
+func RevokeTokenContext(ctx context.Context, accessToken, clientID, clientSecret string, opts ...Option) error {
+	return NewClient(clientID, clientSecret, opts...).RevokeToken(ctx, accessToken)
+}
+
+// RevokeToken invalidates accessToken, like RevokeTokenContext. opts apply to this call only, after the
+// Client's own.
+func (cl *Client) RevokeToken(ctx context.Context, accessToken string, opts ...Option) error {
+	c, clientID, clientSecret := newConfig(cl.options(opts)), cl.clientID, cl.clientSecret
+	if err := c.checkArgs("accessToken", accessToken, "clientID", clientID); err != nil {
+		return fmt.Errorf("RevokeToken: %w", err)
+	}
+
+	fields := append([]string{"token", accessToken}, c.authenticate(clientID, clientSecret)...)
+	if _, _, err := c.post(ctx, EndpointRevoke, fields...); err != nil {
+		c.recordFailure(EndpointRevoke, "", err)
+		return fmt.Errorf("RevokeToken: %w", err)
+	}
+
+	c.record(AuditEvent{Event: AuditTokenRevoked, Endpoint: EndpointRevoke.String()})
+	return nil
+}
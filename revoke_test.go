@@ -0,0 +1,123 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestRevokeToken(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+
+	tok := srv.IssueToken()
+	if err := traktdeviceauth.RevokeToken(tok.AccessToken, "client-id", "client-secret", srv.Options()...); err != nil {
+		t.Fatal(err)
+	}
+
+	req := srv.RequestsTo(traktdeviceauth.EndpointRevoke)[0]
+	if req.Method != http.MethodPost {
+		t.Errorf("sent %s, want POST", req.Method)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":      "application/json",
+		"Trakt-API-Version": "2",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var body map[string]string
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"token": tok.AccessToken, "client_id": "client-id", "client_secret": "client-secret"}
+	if len(body) != len(want) {
+		t.Errorf("sent %v, want %v", body, want)
+	}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("sent %s = %q, want %q", k, body[k], v)
+		}
+	}
+
+	// The revoked token no longer works, and revoking it again is answered with 401.
+	if _, err := traktdeviceauth.GetUserSettings(tok.AccessToken, "client-id", srv.Options()...); !errors.Is(err, traktdeviceauth.ErrInvalidAccessToken) {
+		t.Errorf("GetUserSettings with the revoked token returned %v, want ErrInvalidAccessToken", err)
+	}
+	err := traktdeviceauth.RevokeTokenContext(context.Background(), tok.AccessToken, "client-id", "client-secret", srv.Options()...)
+	if !errors.Is(err, traktdeviceauth.ErrInvalidGrant) {
+		t.Errorf("revoking the token again returned %v, want ErrInvalidGrant", err)
+	}
+}
+
+func TestRevokeTokenErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		secret string
+		want   error
+	}{
+		{name: "wrong secret", secret: "wrong", want: traktdeviceauth.ErrForbidden},
+		{name: "server error", status: http.StatusInternalServerError, want: traktdeviceauth.ErrServerError},
+		{name: "service unavailable", status: http.StatusServiceUnavailable, want: traktdeviceauth.ErrServiceOverloaded},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, want: traktdeviceauth.ErrServiceOverloaded},
+		{name: "cloudflare", status: 521, want: traktdeviceauth.ErrCloudflareError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+
+			o := &outage{}
+			o.set(tt.status)
+			secret := "client-secret"
+			if tt.secret != "" {
+				secret = tt.secret
+			}
+			err := traktdeviceauth.RevokeToken(srv.IssueToken().AccessToken, "client-id", secret, append(srv.Options(), traktdeviceauth.WithMiddleware(o.middleware))...)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			var statusErr *traktdeviceauth.StatusError
+			if want := tt.status; want != 0 && (!errors.As(err, &statusErr) || statusErr.Status != want) {
+				t.Errorf("got %v, want a StatusError with status %d", err, want)
+			}
+		})
+	}
+
+	if err := traktdeviceauth.RevokeToken("", "client-id", "client-secret"); err == nil {
+		t.Error("RevokeToken without an access token succeeded")
+	}
+}
+
+func TestClientRevokeToken(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	var events []traktdeviceauth.AuditEvent
+	hook := traktdeviceauth.WithEventHook(func(e traktdeviceauth.AuditEvent) { events = append(events, e) })
+	cl := traktdeviceauth.NewClient("client-id", "", srv.Options()...)
+	if err := cl.RevokeToken(context.Background(), srv.IssueToken().AccessToken, hook); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != traktdeviceauth.AuditTokenRevoked || events[0].Endpoint != traktdeviceauth.EndpointRevoke.String() {
+		t.Errorf("recorded %+v, want one token_revoked event", events)
+	}
+
+	// A public client sends no secret.
+	var body map[string]interface{}
+	if err := json.Unmarshal(srv.RequestsTo(traktdeviceauth.EndpointRevoke)[0].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["client_secret"]; ok {
+		t.Errorf("a public client sent %v, want no client_secret", body)
+	}
+}
@@ -0,0 +1,172 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRotationConflict is returned by RotatingStore.Rotate when the stored token isn't the generation the caller
+// expected, because another writer rotated it first.
+var ErrRotationConflict error = errors.New("the stored token was rotated by another writer")
+
+// RotatedToken is a token kept in a RotatingStore, along with what the store knows about its rotations.
+type RotatedToken struct {
+	Token TokenResponse
+
+	// Generation is increased by every Rotate. It is 0 for a token which was saved without Rotate.
+	Generation int64
+
+	// PreviousAccessToken is the access token Token replaced, which programs that haven't caught up with the
+	// rotation yet may keep using until PreviousValidUntil.
+	PreviousAccessToken string
+	PreviousValidUntil  time.Time
+}
+
+// Usable reports whether accessToken may be used at now, which is the case for the current access token until it
+// expires and for the previous one during the grace window after the rotation.
+func (r RotatedToken) Usable(accessToken string, now time.Time) bool {
+	if accessToken == "" {
+		return false
+	}
+	if accessToken == r.Token.AccessToken {
+		return now.Before(r.Token.ExpiresAt)
+	}
+	return accessToken == r.PreviousAccessToken && now.Before(r.PreviousValidUntil)
+}
+
+// Next returns the RotatedToken which replaces r with t at now, keeping the access token of r usable for grace.
+// It is meant for implementations of RotatingStore.
+func (r RotatedToken) Next(t TokenResponse, now time.Time, grace time.Duration) RotatedToken {
+	next := RotatedToken{Token: t, Generation: r.Generation + 1}
+	if grace > 0 && r.Token.AccessToken != "" && r.Token.AccessToken != t.AccessToken {
+		next.PreviousAccessToken, next.PreviousValidUntil = r.Token.AccessToken, now.Add(grace)
+	}
+	return next
+}
+
+// Stored returns the StoredToken which a RotatingStore saves for r.
+func (r RotatedToken) Stored() StoredToken {
+	s := NewStoredToken(r.Token)
+	s.Rotation = &StoredRotation{Generation: r.Generation, PreviousAccessToken: r.PreviousAccessToken, PreviousValidUntil: r.PreviousValidUntil}
+	return s
+}
+
+// Rotated returns the RotatedToken saved as s. A token saved without rotation is generation 0.
+func (s StoredToken) Rotated() RotatedToken {
+	r := RotatedToken{Token: s.TokenResponse()}
+	if s.Rotation != nil {
+		r.Generation, r.PreviousAccessToken, r.PreviousValidUntil = s.Rotation.Generation, s.Rotation.PreviousAccessToken, s.Rotation.PreviousValidUntil
+	}
+	return r
+}
+
+// RotatingStore keeps tokens shared by several processes, such as the replicas of a service, which each refresh
+// them. Trakt revokes a refresh token once it has been used, so replicas which refresh the same token at once
+// must agree on a single winner, and the others must adopt its token instead of refreshing again with a refresh
+// token which no longer works. Tokens are named like in a NamedStore, and stores which only hold one token keep
+// it under DefaultProfile.
+//
+// The protocol, which WithRotatingStore follows for a RefreshScheduler, is:
+//
+//  1. LoadRotated the token, remembering its Generation.
+//  2. If the stored token is newer than the one in memory, use it without refreshing.
+//  3. Otherwise refresh it, and Rotate with the remembered Generation.
+//  4. If Rotate fails with ErrRotationConflict, LoadRotated again and adopt the winner's token. If the refresh
+//     fails with ErrInvalidGrant, another writer may have used the refresh token first, so LoadRotated again
+//     for a few seconds, until the winner has stored its token, before concluding that it was revoked.
+//
+// The access token which was replaced stays in the store as RotatedToken.PreviousAccessToken for a grace window,
+// so that replicas still using it can tell that it was rotated rather than revoked.
+type RotatingStore interface {
+	// LoadRotated returns the token under name. It returns an error wrapping ErrNoStoredToken if there is none.
+	LoadRotated(ctx context.Context, name string) (RotatedToken, error)
+
+	// Rotate atomically replaces the token under name with t if it is still generation, keeping the replaced
+	// access token usable for grace, and returns what it stored. Generation 0 also matches a missing token.
+	// If the token was rotated in the meantime, Rotate changes nothing and returns an error wrapping
+	// ErrRotationConflict.
+	Rotate(ctx context.Context, name string, generation int64, t TokenResponse, grace time.Duration) (RotatedToken, error)
+}
+
+// WithRotatingStore makes a RefreshScheduler share its tokens with other processes through store, following the
+// protocol of RotatingStore: refreshes start from the token in store, their result is saved with Rotate, and a
+// scheduler which loses a race adopts the winner's token instead of refreshing again. grace is how long an
+// access token which was replaced stays usable according to the store.
+//
+// The new tokens are saved before the WithRefreshCallback callback is called, so it doesn't need to save them. A
+// refresh whose token couldn't be saved still keeps it, with a *HookError for "WithRotatingStore" in its status.
+func WithRotatingStore(store RotatingStore, grace time.Duration) RefreshSchedulerOption {
+	return func(s *RefreshScheduler) {
+		s.rotating, s.rotationGrace = store, grace
+	}
+}
+
+// refreshRotated refreshes the token under name in store, whose copy in memory is old, with refresh, following
+// the protocol of RotatingStore. It returns the token to use afterwards, which is another writer's if it won.
+func refreshRotated(ctx context.Context, store RotatingStore, name string, grace time.Duration, old TokenResponse,
+	refresh func(ctx context.Context, t TokenResponse) (TokenResponse, error)) (TokenResponse, error) {
+	cur, err := store.LoadRotated(ctx, name)
+	switch {
+	case errors.Is(err, ErrNoStoredToken):
+		cur = RotatedToken{Token: old}
+	case err != nil:
+		return TokenResponse{}, fmt.Errorf("loading the token from the rotating store: %w", err)
+	case cur.Token.RefreshToken != old.RefreshToken && cur.Token.ExpiresAt.After(old.ExpiresAt) && time.Now().Before(cur.Token.ExpiresAt):
+		// Another writer has already rotated the token.
+		return cur.Token, nil
+	}
+
+	t, err := refresh(ctx, cur.Token)
+	var hookErr *HookError
+	if err != nil && !errors.As(err, &hookErr) {
+		if errors.Is(err, ErrInvalidGrant) {
+			// The refresh token may have been used by another writer after it was loaded, which may not have
+			// stored its result yet.
+			if latest, ok := awaitRotation(ctx, store, name, cur.Generation); ok {
+				return latest.Token, nil
+			}
+		}
+		return TokenResponse{}, err
+	}
+
+	if _, rotateErr := store.Rotate(ctx, name, cur.Generation, t, grace); errors.Is(rotateErr, ErrRotationConflict) {
+		latest, loadErr := store.LoadRotated(ctx, name)
+		if loadErr != nil {
+			return t, &HookError{Hook: "WithRotatingStore", Err: fmt.Errorf("%v, and loading the winner's token failed: %w", rotateErr, loadErr)}
+		}
+		return latest.Token, nil
+	} else if rotateErr != nil {
+		return t, &HookError{Hook: "WithRotatingStore", Err: rotateErr}
+	}
+	return t, err
+}
+
+// rotationSettle is how long awaitRotation waits for another writer to store the token it rotated.
+var rotationSettle = 3 * time.Second
+
+// awaitRotation loads the token under name from store until it is newer than generation, for up to
+// rotationSettle or until ctx ends. It returns false if the token didn't change by then.
+func awaitRotation(ctx context.Context, store RotatingStore, name string, generation int64) (RotatedToken, bool) {
+	deadline := time.Now().Add(rotationSettle)
+	wait := 50 * time.Millisecond
+	for {
+		latest, err := store.LoadRotated(ctx, name)
+		if err == nil && latest.Generation != generation {
+			return latest, true
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return RotatedToken{}, false
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return RotatedToken{}, false
+		}
+		wait *= 2
+	}
+}
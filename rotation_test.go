@@ -0,0 +1,217 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestRotatedToken(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := traktdeviceauth.RotatedToken{Token: traktdeviceauth.TokenResponse{AccessToken: "first", ExpiresAt: now.Add(time.Hour)}}
+	second := first.Next(traktdeviceauth.TokenResponse{AccessToken: "second", ExpiresAt: now.Add(2 * time.Hour)}, now, time.Minute)
+
+	if second.Generation != 1 || second.PreviousAccessToken != "first" || !second.PreviousValidUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("Next returned %+v, want generation 1 keeping the first access token for a minute", second)
+	}
+	tests := []struct {
+		token string
+		at    time.Time
+		want  bool
+	}{
+		{"second", now, true},
+		{"second", now.Add(2 * time.Hour), false},
+		{"first", now.Add(time.Minute - time.Second), true},
+		{"first", now.Add(time.Minute), false},
+		{"other", now, false},
+		{"", now, false},
+	}
+	for _, tt := range tests {
+		if got := second.Usable(tt.token, tt.at); got != tt.want {
+			t.Errorf("Usable(%q, %v) = %v, want %v", tt.token, tt.at.Sub(now), got, tt.want)
+		}
+	}
+
+	// Without a grace window, or with the same access token, nothing stays usable.
+	if next := second.Next(traktdeviceauth.TokenResponse{AccessToken: "third"}, now, 0); next.PreviousAccessToken != "" || next.Generation != 2 {
+		t.Errorf("Next without grace returned %+v", next)
+	}
+	if next := second.Next(second.Token, now, time.Minute); next.PreviousAccessToken != "" {
+		t.Errorf("Next with the same access token returned %+v", next)
+	}
+
+	// The rotation survives being stored.
+	if got := second.Stored().Rotated(); got.Generation != 1 || got.PreviousAccessToken != "first" || !got.PreviousValidUntil.Equal(second.PreviousValidUntil) {
+		t.Errorf("Stored().Rotated() returned %+v, want %+v", got, second)
+	}
+}
+
+// barrierStore is a RotatingStore whose first n LoadRotated calls wait for each other, so that n writers start
+// from the same generation and race to Rotate it.
+type barrierStore struct {
+	*traktdeviceauthtest.MemoryStore
+
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+func newBarrierStore(n int) *barrierStore {
+	return &barrierStore{MemoryStore: traktdeviceauthtest.NewMemoryStore(), waiting: n, release: make(chan struct{})}
+}
+
+func (s *barrierStore) LoadRotated(ctx context.Context, name string) (traktdeviceauth.RotatedToken, error) {
+	r, err := s.MemoryStore.LoadRotated(ctx, name)
+
+	s.mu.Lock()
+	if s.waiting == 0 {
+		s.mu.Unlock()
+		return r, err
+	}
+	s.waiting--
+	if s.waiting == 0 {
+		close(s.release)
+	}
+	s.mu.Unlock()
+
+	<-s.release
+	return r, err
+}
+
+// rotationReplicas starts n RefreshSchedulers sharing store, each holding tok, which is due for a refresh, and
+// returns them along with what each refresh reported.
+func rotationReplicas(t *testing.T, srv *traktdeviceauthtest.Server, store traktdeviceauth.RotatingStore, n int, tok traktdeviceauth.TokenResponse) ([]*traktdeviceauth.RefreshScheduler, <-chan refreshOutcome) {
+	t.Helper()
+
+	outcomes := make(chan refreshOutcome, n)
+	var replicas []*traktdeviceauth.RefreshScheduler
+	for i := 0; i < n; i++ {
+		s := traktdeviceauth.NewRefreshScheduler("client-id", "secret",
+			traktdeviceauth.WithRotatingStore(store, time.Minute),
+			traktdeviceauth.WithRefreshJitter(0),
+			traktdeviceauth.WithRefreshOptions(srv.Options()...),
+			traktdeviceauth.WithRefreshCallback(func(name string, t traktdeviceauth.TokenResponse, err error) {
+				outcomes <- refreshOutcome{name: name, at: time.Now(), t: t, err: err}
+			}),
+		)
+		t.Cleanup(func() { s.Close() })
+		replicas = append(replicas, s)
+	}
+	for _, s := range replicas {
+		if err := s.Add("alice", tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return replicas, outcomes
+}
+
+// expectAdopted checks that every replica reported and holds the token in store, which is the first rotation of
+// old, keeping its access token usable.
+func expectAdopted(t *testing.T, store traktdeviceauth.RotatingStore, replicas []*traktdeviceauth.RefreshScheduler, outcomes <-chan refreshOutcome, old traktdeviceauth.TokenResponse) {
+	t.Helper()
+
+	for range replicas {
+		select {
+		case o := <-outcomes:
+			if o.err != nil {
+				t.Errorf("a replica's refresh failed: %v", o.err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("not every replica refreshed")
+		}
+	}
+
+	stored, err := store.LoadRotated(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Generation != 1 || stored.Token.AccessToken == old.AccessToken || stored.PreviousAccessToken != old.AccessToken ||
+		!stored.Usable(old.AccessToken, time.Now()) {
+		t.Errorf("the store holds %+v, want a single rotation keeping the old access token usable", stored)
+	}
+	for i, s := range replicas {
+		if got, err := s.Token("alice"); err != nil || got.AccessToken != stored.Token.AccessToken || got.RefreshToken != stored.Token.RefreshToken {
+			t.Errorf("replica %d holds %+v, %v, want the stored token %+v", i, got, err, stored.Token)
+		}
+	}
+}
+
+func TestRotatingStoreConflict(t *testing.T) {
+	// The server doesn't revoke refresh tokens, so every replica refreshes, and all but the first to Rotate
+	// conflict and adopt its token.
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	const n = 3
+	store := newBarrierStore(n)
+	old := issuedToken(srv, time.Now().Add(time.Minute))
+	if err := store.SaveNamed(context.Background(), "alice", old); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas, outcomes := rotationReplicas(t, srv, store, n, old)
+	expectAdopted(t, store, replicas, outcomes, old)
+	if refreshes := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); refreshes != n {
+		t.Errorf("%d refreshes were made, want one for each of the %d replicas", refreshes, n)
+	}
+}
+
+func TestRotatingStoreRevokedRefreshToken(t *testing.T) {
+	// The server revokes a refresh token once it has been used, so a single replica's refresh succeeds and the
+	// others, rejected with invalid_grant, wait for its token to be stored instead of giving up on theirs.
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.RotateRefreshToken())
+	const n = 3
+	store := newBarrierStore(n)
+	old := issuedToken(srv, time.Now().Add(time.Minute))
+	if err := store.SaveNamed(context.Background(), "alice", old); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas, outcomes := rotationReplicas(t, srv, store, n, old)
+	expectAdopted(t, store, replicas, outcomes, old)
+	for i, s := range replicas {
+		if names := s.NeedsReauthorization(); len(names) != 0 {
+			t.Errorf("replica %d needs reauthorization for %v after losing the race", i, names)
+		}
+	}
+}
+
+func TestRotatingStoreAlreadyRotated(t *testing.T) {
+	// A replica which finds a newer token in the store uses it without refreshing.
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	store := traktdeviceauthtest.NewMemoryStore()
+	old := issuedToken(srv, time.Now().Add(time.Minute))
+	if _, err := store.Rotate(context.Background(), "alice", 0, old, 0); err != nil {
+		t.Fatal(err)
+	}
+	newer := issuedToken(srv, time.Now().Add(time.Hour*24))
+	if _, err := store.Rotate(context.Background(), "alice", 1, newer, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Rotate(context.Background(), "alice", 1, old, 0); !errors.Is(err, traktdeviceauth.ErrRotationConflict) {
+		t.Fatalf("Rotate of an outdated generation returned %v, want ErrRotationConflict", err)
+	}
+
+	replicas, outcomes := rotationReplicas(t, srv, store, 1, old)
+	select {
+	case o := <-outcomes:
+		if o.err != nil || o.t.AccessToken != newer.AccessToken {
+			t.Errorf("the refresh reported %+v, want the stored token", o)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the token wasn't refreshed")
+	}
+	if got, _ := replicas[0].Token("alice"); got.AccessToken != newer.AccessToken {
+		t.Errorf("the replica holds %s, want the stored %s", got.AccessToken, newer.AccessToken)
+	}
+	if refreshes := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); refreshes != 0 {
+		t.Errorf("%d refreshes were made, want none", refreshes)
+	}
+}
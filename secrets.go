@@ -0,0 +1,156 @@
+package traktdeviceauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Credentials identifies a Trakt API app. ClientSecret is a byte slice instead of a string so that it
+// can be overwritten with Wipe once it is no longer needed. Pass Credentials to NewClientFromCredentials,
+// RefreshAll or StoreLoader, which send the secret from the slice without copying it into a string.
+type Credentials struct {
+	ClientID     string
+	ClientSecret []byte
+}
+
+// Wipe overwrites ClientSecret with zeros and clears the fields of c. Clients created from c with
+// NewClientFromCredentials share ClientSecret, so they can't authenticate anymore once c has been wiped.
+//
+// Wiping is best-effort. Copies of the secret made before Wipe is called, such as strings passed to the
+// functions in this package, the Authorization header sent with AuthBasicHeader, or data the Go runtime moved
+// while growing a slice, can't be reached and are only freed once the garbage collector reclaims them.
+func (c *Credentials) Wipe() {
+	wipeBytes(c.ClientSecret)
+	c.ClientID = ""
+	c.ClientSecret = nil
+}
+
+// Wipe clears the fields of t, dropping its references to the access and refresh tokens.
+//
+// Go strings are immutable, so the bytes backing the tokens can't be overwritten and remain in memory
+// until the garbage collector reclaims them. Wipe only guarantees that t itself no longer keeps them alive.
+func (t *TokenResponse) Wipe() {
+	*t = TokenResponse{}
+}
+
+// wipeBytes overwrites b with zeros.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// bodyPool holds the buffers used to build request bodies. Buffers are zero-filled before being put back,
+// so secrets from one request don't linger in a buffer waiting to be reused by another.
+var bodyPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// requestBody is a JSON request body built in a buffer from bodyPool. The buffer is wiped and returned to
+// the pool when the body is closed, which the http package does once it has finished sending the request.
+type requestBody struct {
+	mu  sync.Mutex
+	buf *bytes.Buffer
+	r   *bytes.Reader
+}
+
+// newRequestBody builds a JSON object from fields, which alternate between keys and string values, and
+// client_secret set to secret, unless it is nil. secret is written straight from the slice, so that the body
+// doesn't leave a string copy of it behind.
+func newRequestBody(fields []string, secret []byte) *requestBody {
+	buf := bodyPool.Get().(*bytes.Buffer)
+
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, fields[i])
+		buf.WriteByte(':')
+		writeJSONString(buf, fields[i+1])
+	}
+	if secret != nil {
+		if len(fields) > 1 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, "client_secret")
+		buf.WriteByte(':')
+		writeJSONBytes(buf, secret)
+	}
+	buf.WriteByte('}')
+
+	return &requestBody{buf: buf, r: bytes.NewReader(buf.Bytes())}
+}
+
+// Len returns the length of the body in bytes.
+func (b *requestBody) Len() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.r == nil {
+		return 0
+	}
+	return b.r.Size()
+}
+
+// Read implements io.Reader. It returns io.EOF once the body has been closed.
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.r == nil {
+		return 0, io.EOF
+	}
+	return b.r.Read(p)
+}
+
+// Close wipes the buffer and returns it to bodyPool. It is safe to call more than once.
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.buf == nil {
+		return nil
+	}
+
+	wipeBytes(b.buf.Bytes())
+	b.buf.Reset()
+	bodyPool.Put(b.buf)
+	b.buf, b.r = nil, nil
+	return nil
+}
+
+// writeJSONString writes s to buf as a quoted JSON string without making intermediate copies of it.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		writeJSONByte(buf, s[i])
+	}
+	buf.WriteByte('"')
+}
+
+// writeJSONBytes writes b to buf as a quoted JSON string, like writeJSONString.
+func writeJSONBytes(buf *bytes.Buffer, b []byte) {
+	buf.WriteByte('"')
+	for _, c := range b {
+		writeJSONByte(buf, c)
+	}
+	buf.WriteByte('"')
+}
+
+// writeJSONByte writes c to buf, escaped as it has to be inside a JSON string.
+func writeJSONByte(buf *bytes.Buffer, c byte) {
+	switch {
+	case c == '"' || c == '\\':
+		buf.WriteByte('\\')
+		buf.WriteByte(c)
+	case c < 0x20:
+		fmt.Fprintf(buf, `\u%04x`, c)
+	default:
+		buf.WriteByte(c)
+	}
+}
@@ -0,0 +1,65 @@
+package traktdeviceauth
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"testing"
+)
+
+func TestRequestBodyIsWipedOnClose(t *testing.T) {
+	body := newRequestBody([]string{"client_id", "id"}, []byte("client-secret"))
+	raw := body.buf.Bytes()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("the body %q isn't JSON: %v", b, err)
+	}
+	if fields["client_id"] != "id" || fields["client_secret"] != "client-secret" {
+		t.Errorf("got fields %v", fields)
+	}
+
+	body.Close()
+	for i, c := range raw {
+		if c != 0 {
+			t.Fatalf("byte %d of the pooled buffer is %q after Close", i, c)
+		}
+	}
+	if n, err := body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read after Close = %d, %v, want 0, io.EOF", n, err)
+	}
+	body.Close() // Closing twice is safe.
+}
+
+func TestRequestBodyEscaping(t *testing.T) {
+	tests := []struct {
+		fields []string
+		secret []byte
+		want   string
+	}{
+		{nil, nil, `{}`},
+		{[]string{"a", "b"}, nil, `{"a":"b"}`},
+		{nil, []byte("s"), `{"client_secret":"s"}`},
+		{[]string{"q", `"\` + "\n"}, []byte("x\"\x01"), `{"q":"\"\\\u000a","client_secret":"x\"\u0001"}`},
+	}
+	for _, tt := range tests {
+		body := newRequestBody(tt.fields, tt.secret)
+		b, _ := io.ReadAll(body)
+		body.Close()
+		if string(b) != tt.want {
+			t.Errorf("newRequestBody(%q, %q) = %s, want %s", tt.fields, tt.secret, b, tt.want)
+		}
+	}
+}
+
+func TestAppendFormEncoded(t *testing.T) {
+	for _, s := range []string{"", "plain-_.~09AZaz", "a b+c&d=e/f:g", "é\x00\xff"} {
+		if got, want := string(appendFormEncoded(nil, []byte(s))), url.QueryEscape(s); got != want {
+			t.Errorf("appendFormEncoded(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestCredentialsWipe(t *testing.T) {
+	secret := []byte("client-secret")
+	creds := traktdeviceauth.Credentials{ClientID: "client-id", ClientSecret: secret}
+	creds.Wipe()
+
+	if creds.ClientID != "" || creds.ClientSecret != nil {
+		t.Errorf("Wipe left %+v", creds)
+	}
+	for i, b := range secret {
+		if b != 0 {
+			t.Fatalf("byte %d of the secret is %q after Wipe", i, b)
+		}
+	}
+}
+
+func TestTokenResponseWipe(t *testing.T) {
+	tok := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Now()}
+	tok.Wipe()
+	if tok != (traktdeviceauth.TokenResponse{}) {
+		t.Errorf("Wipe left %+v", tok)
+	}
+}
+
+func TestClientFromCredentialsSharesSecret(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "client-id", "client-secret"
+
+	ctx := context.Background()
+	creds := traktdeviceauth.Credentials{ClientID: "client-id", ClientSecret: []byte("client-secret")}
+	cl := traktdeviceauth.NewClientFromCredentials(creds, srv.Options()...)
+
+	tok := srv.IssueToken()
+	refreshed, err := cl.RefreshAccessToken(ctx, tok.RefreshToken)
+	if err != nil {
+		t.Fatalf("refreshing before Wipe: %v", err)
+	}
+
+	creds.Wipe()
+	if _, err := cl.RefreshAccessToken(ctx, refreshed.RefreshToken); err == nil {
+		t.Fatal("the Client still authenticated after its Credentials were wiped")
+	}
+}
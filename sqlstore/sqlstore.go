@@ -0,0 +1,252 @@
+// Package sqlstore provides a traktdeviceauth.TokenStore and traktdeviceauth.NamedStore which keep tokens in a SQL
+// database through database/sql.
+//
+// The tokens are kept in a table with the following schema, which is returned by DDL:
+//
+//	CREATE TABLE IF NOT EXISTS trakt_tokens (
+//		profile    VARCHAR(255) NOT NULL PRIMARY KEY,
+//		token      TEXT NOT NULL,
+//		updated_at TIMESTAMP NOT NULL
+//	)
+//
+// profile is the name passed to SaveNamed and LoadNamed, token is a traktdeviceauth.StoredToken as JSON, and
+// updated_at is when the row was last written, in UTC. The queries only use standard SQL, so they work with any
+// driver. Drivers which use numbered placeholders, such as PostgreSQL's, need WithDollarPlaceholders.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// identifier matches the table names accepted by WithTable, which are interpolated into queries.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// DDL returns the statement which creates the token table called table if it doesn't exist.
+func DDL(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+	profile    VARCHAR(255) NOT NULL PRIMARY KEY,
+	token      TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+)`
+}
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithTable sets the name of the token table, which defaults to trakt_tokens. It may be qualified with a schema.
+func WithTable(table string) Option {
+	return func(s *Store) {
+		s.table = table
+	}
+}
+
+// WithDollarPlaceholders makes the Store write placeholders as $1, $2, and so on instead of ?, as PostgreSQL
+// drivers expect.
+func WithDollarPlaceholders() Option {
+	return func(s *Store) {
+		s.dollar = true
+	}
+}
+
+// Store keeps tokens in a SQL table, one row per profile. It is safe for concurrent use, including by several
+// processes sharing the database.
+type Store struct {
+	db     *sql.DB
+	table  string
+	dollar bool
+}
+
+// New returns a Store which uses db. Call Migrate, or run the statement from DDL, before using it.
+func New(db *sql.DB, opts ...Option) (*Store, error) {
+	s := &Store{db: db, table: "trakt_tokens"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !identifier.MatchString(s.table) {
+		return nil, fmt.Errorf("sqlstore.New: invalid table name %q", s.table)
+	}
+	return s, nil
+}
+
+// Migrate creates the token table if it doesn't exist.
+func (s *Store) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, DDL(s.table)); err != nil {
+		return fmt.Errorf("sqlstore.Migrate: %w", err)
+	}
+	return nil
+}
+
+// Save implements traktdeviceauth.TokenStore for traktdeviceauth.DefaultProfile.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	return s.SaveNamed(ctx, traktdeviceauth.DefaultProfile, t)
+}
+
+// Load implements traktdeviceauth.TokenStore for traktdeviceauth.DefaultProfile.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	return s.LoadNamed(ctx, traktdeviceauth.DefaultProfile)
+}
+
+// SaveNamed implements traktdeviceauth.NamedStore. The row is updated if it exists and inserted otherwise.
+// If another writer inserts the row in between, the update is tried again, so concurrent writers can't fail
+// on the primary key.
+func (s *Store) SaveNamed(ctx context.Context, profile string, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return fmt.Errorf("sqlstore.SaveNamed: %w", err)
+	}
+	now := time.Now().UTC()
+
+	updated, err := s.update(ctx, profile, string(b), now)
+	if err != nil || updated {
+		return err
+	}
+
+	_, insertErr := s.db.ExecContext(ctx, s.query(`INSERT INTO `+s.table+` (profile, token, updated_at) VALUES (?, ?, ?)`), profile, string(b), now)
+	if insertErr == nil {
+		return nil
+	}
+
+	// The insert most likely lost a race with another writer. Drivers report that differently, so check by updating.
+	updated, err = s.update(ctx, profile, string(b), now)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return fmt.Errorf("sqlstore.SaveNamed: %w", insertErr)
+	}
+	return nil
+}
+
+// update replaces the token of profile, reporting whether the row existed.
+func (s *Store) update(ctx context.Context, profile, token string, now time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.query(`UPDATE `+s.table+` SET token = ?, updated_at = ? WHERE profile = ?`), token, now, profile)
+	if err != nil {
+		return false, fmt.Errorf("sqlstore.SaveNamed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sqlstore.SaveNamed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// LoadNamed implements traktdeviceauth.NamedStore. A missing row is reported as traktdeviceauth.ErrNoStoredToken.
+func (s *Store) LoadNamed(ctx context.Context, profile string) (traktdeviceauth.TokenResponse, error) {
+	var token string
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT token FROM `+s.table+` WHERE profile = ?`), profile).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("sqlstore.LoadNamed: %s: %w", profile, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("sqlstore.LoadNamed: %w", err)
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal([]byte(token), &st); err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("sqlstore.LoadNamed: %w", err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// LoadRotated implements traktdeviceauth.RotatingStore. A missing row is reported as
+// traktdeviceauth.ErrNoStoredToken.
+func (s *Store) LoadRotated(ctx context.Context, profile string) (traktdeviceauth.RotatedToken, error) {
+	r, _, err := s.loadRotated(ctx, profile)
+	if err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.LoadRotated: %w", err)
+	}
+	return r, nil
+}
+
+// Rotate implements traktdeviceauth.RotatingStore. The row is only updated if it still holds the token which
+// was read, so no schema change is needed, and a row inserted by another writer in between makes the insert of
+// a new one fail, which is reported as a conflict too.
+func (s *Store) Rotate(ctx context.Context, profile string, generation int64, t traktdeviceauth.TokenResponse, grace time.Duration) (traktdeviceauth.RotatedToken, error) {
+	cur, token, err := s.loadRotated(ctx, profile)
+	if err != nil && !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %w", err)
+	}
+	if cur.Generation != generation {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %s is generation %d, not %d: %w",
+			profile, cur.Generation, generation, traktdeviceauth.ErrRotationConflict)
+	}
+
+	now := time.Now().UTC()
+	next := cur.Next(t, now, grace)
+	b, err := json.Marshal(next.Stored())
+	if err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %w", err)
+	}
+
+	var res sql.Result
+	if token != "" {
+		res, err = s.db.ExecContext(ctx, s.query(`UPDATE `+s.table+` SET token = ?, updated_at = ? WHERE profile = ? AND token = ?`), string(b), now, profile, token)
+	} else {
+		res, err = s.db.ExecContext(ctx, s.query(`INSERT INTO `+s.table+` (profile, token, updated_at) VALUES (?, ?, ?)`), profile, string(b), now)
+		if err != nil {
+			return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %v: %w", err, traktdeviceauth.ErrRotationConflict)
+		}
+	}
+	if err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %w", err)
+	} else if n == 0 {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("sqlstore.Rotate: %s was changed by another writer: %w", profile, traktdeviceauth.ErrRotationConflict)
+	}
+	return next, nil
+}
+
+// loadRotated returns the token of profile along with the row's token column, which Rotate compares against.
+func (s *Store) loadRotated(ctx context.Context, profile string) (traktdeviceauth.RotatedToken, string, error) {
+	var token string
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT token FROM `+s.table+` WHERE profile = ?`), profile).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return traktdeviceauth.RotatedToken{}, "", fmt.Errorf("%s: %w", profile, traktdeviceauth.ErrNoStoredToken)
+	} else if err != nil {
+		return traktdeviceauth.RotatedToken{}, "", err
+	}
+
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal([]byte(token), &st); err != nil {
+		return traktdeviceauth.RotatedToken{}, "", err
+	}
+	return st.Rotated(), token, nil
+}
+
+// Delete removes the token of profile. Deleting a profile which has no token isn't an error.
+func (s *Store) Delete(ctx context.Context, profile string) error {
+	if _, err := s.db.ExecContext(ctx, s.query(`DELETE FROM `+s.table+` WHERE profile = ?`), profile); err != nil {
+		return fmt.Errorf("sqlstore.Delete: %w", err)
+	}
+	return nil
+}
+
+// query rewrites the ? placeholders in q for the driver.
+func (s *Store) query(q string) string {
+	if !s.dollar {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
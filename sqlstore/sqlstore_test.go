@@ -0,0 +1,204 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/sqlstore"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openSQLite opens the SQLite database dsn, skipping the test if the driver was built without cgo.
+func openSQLite(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		if strings.Contains(err.Error(), "cgo") {
+			t.Skipf("SQLite is unavailable: %v", err)
+		}
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newStore returns a migrated Store backed by an in-memory SQLite database of its own.
+func newStore(t *testing.T, opts ...sqlstore.Option) (*sqlstore.Store, *sql.DB) {
+	t.Helper()
+
+	db := openSQLite(t, ":memory:")
+	// Every connection to :memory: opens a separate database.
+	db.SetMaxOpenConns(1)
+	s, err := sqlstore.New(db, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+func testToken(i int) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  fmt.Sprintf("access-%d", i),
+		RefreshToken: fmt.Sprintf("refresh-%d", i),
+		ExpiresAt:    time.Unix(1700000000+int64(i), 0),
+	}
+}
+
+func TestStore(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		s, _ := newStore(t)
+		return s
+	})
+}
+
+func TestNamedStore(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		s, _ := newStore(t)
+		return traktdeviceauth.Named(s, "alice")
+	})
+}
+
+func TestRotatingStore(t *testing.T) {
+	traktdeviceauthtest.TestRotatingStore(t, func(t *testing.T) traktdeviceauth.RotatingStore {
+		s, _ := newStore(t)
+		return s
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	s, db := newStore(t)
+	ctx := context.Background()
+
+	before := time.Now().UTC().Add(-time.Second)
+	for i, profile := range []string{"alice", "bob"} {
+		if err := s.SaveNamed(ctx, profile, testToken(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveNamed(ctx, "alice", testToken(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	for profile, want := range map[string]string{"alice": "access-2", "bob": "access-1"} {
+		got, err := s.LoadNamed(ctx, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AccessToken != want {
+			t.Errorf("%s has %q, want %q", profile, got.AccessToken, want)
+		}
+	}
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM trakt_tokens`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Errorf("the table has %d rows, want one per profile", rows)
+	}
+	var updatedAt time.Time
+	if err := db.QueryRow(`SELECT updated_at FROM trakt_tokens WHERE profile = 'alice'`).Scan(&updatedAt); err != nil {
+		t.Fatal(err)
+	}
+	if updatedAt.Before(before) || updatedAt.After(time.Now()) {
+		t.Errorf("updated_at is %v, want the time of the last save", updatedAt)
+	}
+
+	if err := s.Delete(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadNamed(ctx, "alice"); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("LoadNamed after Delete returned %v, want ErrNoStoredToken", err)
+	}
+	if err := s.Delete(ctx, "alice"); err != nil {
+		t.Errorf("deleting a missing profile: %v", err)
+	}
+	if _, err := s.LoadNamed(ctx, "bob"); err != nil {
+		t.Errorf("Delete removed another profile: %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+
+	s, db := newStore(t, sqlstore.WithTable("custom_tokens"), sqlstore.WithDollarPlaceholders())
+	if err := s.Save(ctx, testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Load(ctx); err != nil || got.AccessToken != "access-1" {
+		t.Fatalf("Load returned %v, %v", got, err)
+	}
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM custom_tokens`).Scan(&rows); err != nil || rows != 1 {
+		t.Errorf("custom_tokens has %d rows (%v), want 1", rows, err)
+	}
+
+	for _, table := range []string{"", "tokens; DROP TABLE users", "1tokens", "a.b.c"} {
+		if _, err := sqlstore.New(db, sqlstore.WithTable(table)); err == nil {
+			t.Errorf("New accepted the table name %q", table)
+		}
+	}
+	if _, err := sqlstore.New(db, sqlstore.WithTable("app.tokens")); err != nil {
+		t.Errorf("New rejected a table qualified with a schema: %v", err)
+	}
+}
+
+func TestConcurrentSaveLoad(t *testing.T) {
+	// A file lets several connections share the database, so writers really race to insert the row.
+	db := openSQLite(t, filepath.Join(t.TempDir(), "tokens.db")+"?_busy_timeout=10000&_journal_mode=WAL")
+	s, err := sqlstore.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, saves = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*saves*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < saves; i++ {
+				if err := s.Save(ctx, testToken(w*saves+i)); err != nil {
+					errs <- fmt.Errorf("Save: %w", err)
+				}
+				if _, err := s.Load(ctx); err != nil {
+					errs <- fmt.Errorf("Load: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM trakt_tokens`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("the table has %d rows, want 1", rows)
+	}
+}
@@ -0,0 +1,265 @@
+package traktdeviceauth
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TokenLoader loads the token under key from wherever a program keeps its tokens, for a TokenCache.
+type TokenLoader func(ctx context.Context, key string) (TokenResponse, error)
+
+// TokenCacheOption customizes a TokenCache.
+type TokenCacheOption func(*TokenCache)
+
+// WithCacheSize sets how many tokens a TokenCache holds before it evicts the least recently used one. The default
+// is 1000 and values less than 1 are treated as 1.
+func WithCacheSize(n int) TokenCacheOption {
+	return func(c *TokenCache) {
+		c.size = n
+	}
+}
+
+// WithCacheLeeway sets how long before a token expires it stops being served from a TokenCache and is loaded
+// again, so that callers always get a token with some life left. The default is 5 minutes.
+func WithCacheLeeway(d time.Duration) TokenCacheOption {
+	return func(c *TokenCache) {
+		c.leeway = d
+	}
+}
+
+// WithCacheMaxAge limits how long a token is kept in a TokenCache, however long it is valid for, so that a token
+// which was revoked or rotated by another process stops being served after at most d. There is no limit by
+// default.
+func WithCacheMaxAge(d time.Duration) TokenCacheOption {
+	return func(c *TokenCache) {
+		c.maxAge = d
+	}
+}
+
+// TokenCache keeps recently used tokens in memory in front of a slower store, for servers which hold tokens for
+// many users or tenants. Tokens are kept until shortly before they expire, and the least recently used one is
+// evicted when the cache is full. Misses are passed to a TokenLoader, and concurrent misses for the same key
+// share a single load. All of its methods are safe for concurrent use.
+//
+// The loader usually reads the caller's database. StoreLoader reads a NamedStore and refreshes tokens which are
+// about to expire, so that Get goes from the cache to the store to Trakt only as far as it has to.
+type TokenCache struct {
+	load   TokenLoader
+	size   int
+	leeway time.Duration
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List               // Of *cachedToken, most recently used first.
+	entries map[string]*list.Element // Keyed by the key of the token.
+	loads   map[string]*tokenLoad    // The loads in progress.
+}
+
+// cachedToken is a token held by a TokenCache until validUntil.
+type cachedToken struct {
+	key        string
+	token      TokenResponse
+	validUntil time.Time
+}
+
+// tokenLoad is a load of a TokenCache in progress, whose outcome is set before done is closed. invalidated is
+// set if the key was invalidated while it ran, so that its token isn't cached.
+type tokenLoad struct {
+	done        chan struct{}
+	ctx         context.Context // The context of the Get which started the load.
+	token       TokenResponse
+	err         error
+	invalidated bool
+}
+
+// NewTokenCache creates an empty TokenCache which loads the tokens it doesn't hold with load.
+func NewTokenCache(load TokenLoader, opts ...TokenCacheOption) *TokenCache {
+	c := &TokenCache{
+		load:    load,
+		size:    1000,
+		leeway:  5 * time.Minute,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		loads:   make(map[string]*tokenLoad),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.size < 1 {
+		c.size = 1
+	}
+	return c
+}
+
+// Get returns the token under key, loading it if the cache doesn't hold it or it is about to expire. A token
+// which the loader returns with less than the leeway left is returned but not cached. If the loader fails, its
+// error is returned along with whatever token it returned, and nothing is cached.
+//
+// A Get which finds a load for key in progress waits for it, or for ctx to end. If the load fails because the
+// context of the Get which started it ended, the others load the token again instead of failing with it.
+func (c *TokenCache) Get(ctx context.Context, key string) (TokenResponse, error) {
+	for {
+		c.mu.Lock()
+		if t, ok := c.lookup(key); ok {
+			c.mu.Unlock()
+			return t, nil
+		}
+		if l, ok := c.loads[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				return TokenResponse{}, fmt.Errorf("TokenCache.Get: %w", ctx.Err())
+			}
+			if l.err != nil && l.ctx.Err() != nil && ctx.Err() == nil {
+				continue
+			}
+			return l.token, l.err
+		}
+
+		l := &tokenLoad{done: make(chan struct{}), ctx: ctx}
+		c.loads[key] = l
+		c.mu.Unlock()
+
+		c.finishLoad(key, l)
+		return l.token, l.err
+	}
+}
+
+// finishLoad runs the load l of the token under key, caches its token unless it failed or the key was
+// invalidated meanwhile, and releases the Gets waiting for it.
+func (c *TokenCache) finishLoad(key string, l *tokenLoad) {
+	defer close(l.done)
+
+	err := catchPanic("NewTokenCache", func() error {
+		var err error
+		l.token, err = c.load(l.ctx, key)
+		return err
+	})
+	if err != nil {
+		l.err = fmt.Errorf("TokenCache.Get: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loads, key)
+	if l.err == nil && !l.invalidated {
+		c.store(key, l.token)
+	}
+}
+
+// Set caches t under key, replacing the token the cache held, for example once it has been refreshed
+// elsewhere. A load of key in progress doesn't replace t once it completes.
+func (c *TokenCache) Set(key string, t TokenResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l, ok := c.loads[key]; ok {
+		l.invalidated = true
+	}
+	c.remove(key)
+	c.store(key, t)
+}
+
+// Invalidate removes the token under key, so that the next Get loads it again, for example after it was
+// revoked. A load of key in progress still returns its token to the Gets waiting for it, but doesn't cache it.
+func (c *TokenCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l, ok := c.loads[key]; ok {
+		l.invalidated = true
+	}
+	c.remove(key)
+}
+
+// Len returns how many tokens the cache holds, including expired ones which haven't been evicted yet.
+func (c *TokenCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// lookup returns the token under key and marks it as the most recently used, unless there is none or it is
+// no longer valid, in which case it is removed. c.mu must be held.
+func (c *TokenCache) lookup(key string) (TokenResponse, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return TokenResponse{}, false
+	}
+	e := el.Value.(*cachedToken)
+	if !c.now().Before(e.validUntil) {
+		c.remove(key)
+		return TokenResponse{}, false
+	}
+	c.lru.MoveToFront(el)
+	return e.token, true
+}
+
+// store caches t under key, which the cache must not hold, unless it has less than the leeway left. The least
+// recently used tokens are evicted if the cache is full. c.mu must be held.
+func (c *TokenCache) store(key string, t TokenResponse) {
+	now := c.now()
+	validUntil := t.ExpiresAt.Add(-c.leeway)
+	if c.maxAge > 0 && now.Add(c.maxAge).Before(validUntil) {
+		validUntil = now.Add(c.maxAge)
+	}
+	if !now.Before(validUntil) {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cachedToken{key: key, token: t, validUntil: validUntil})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back().Value.(*cachedToken).key)
+	}
+}
+
+// remove drops the token under key, if any. c.mu must be held.
+func (c *TokenCache) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// StoreLoader returns a TokenLoader for a TokenCache which loads the token under the key from store, and
+// refreshes it first if it expires within minValid, which should be at least the leeway of the cache. The new
+// token is saved to store before it is returned, since Trakt revokes the refresh token which was used. If
+// saving it fails, the new token is returned along with the error and must not be thrown away.
+//
+// opts are passed to the refresh. StoreLoader doesn't coordinate with other processes, so tokens shared by
+// several instances of a program should only be refreshed by one of them.
+func StoreLoader(store NamedStore, creds Credentials, minValid time.Duration, opts ...Option) TokenLoader {
+	client := NewClientFromCredentials(creds, opts...)
+	return func(ctx context.Context, key string) (TokenResponse, error) {
+		t, err := store.LoadNamed(ctx, key)
+		if err != nil {
+			return TokenResponse{}, err
+		}
+		if time.Until(t.ExpiresAt) >= minValid {
+			return t, nil
+		}
+		if t.RefreshToken == "" {
+			return TokenResponse{}, fmt.Errorf("StoreLoader: %w: the token under %q expires at %s and has no refresh token",
+				ErrReauthorizationRequired, key, t.ExpiresAt.Format(time.RFC3339))
+		}
+
+		refreshed, err := client.RefreshAccessToken(ctx, t.RefreshToken)
+		var hookErr *HookError
+		if err != nil && !errors.As(err, &hookErr) {
+			return TokenResponse{}, fmt.Errorf("StoreLoader: %w", err)
+		}
+		refreshed = refreshed.keepRefreshTokenIssuedAt(t)
+		if err := store.SaveNamed(ctx, key, refreshed); err != nil {
+			return refreshed, fmt.Errorf("StoreLoader: saving the refreshed token under %q: %w", key, err)
+		}
+		return refreshed, nil
+	}
+}
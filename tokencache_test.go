@@ -0,0 +1,403 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// countingLoader is a TokenLoader which returns a token valid for an hour after the clock's time, with an access
+// token naming the key and how often it was loaded.
+type countingLoader struct {
+	clock *fakeClock
+
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func newCountingLoader(clock *fakeClock) *countingLoader {
+	return &countingLoader{clock: clock, loads: make(map[string]int)}
+}
+
+func (l *countingLoader) load(ctx context.Context, key string) (traktdeviceauth.TokenResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loads[key]++
+	return traktdeviceauth.TokenResponse{
+		AccessToken: fmt.Sprintf("%s-%d", key, l.loads[key]),
+		ExpiresAt:   l.clock.Now().Add(time.Hour),
+	}, nil
+}
+
+func (l *countingLoader) count(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads[key]
+}
+
+// newTestTokenCache returns a TokenCache on clock.
+func newTestTokenCache(clock *fakeClock, load traktdeviceauth.TokenLoader, opts ...traktdeviceauth.TokenCacheOption) *traktdeviceauth.TokenCache {
+	c := traktdeviceauth.NewTokenCache(load, opts...)
+	traktdeviceauth.SetTokenCacheClock(c, clock.Now)
+	return c
+}
+
+// expectCached checks that Get of key returns the access token want.
+func expectCached(t *testing.T, c *traktdeviceauth.TokenCache, key, want string) {
+	t.Helper()
+
+	got, err := c.Get(context.Background(), key)
+	if err != nil || got.AccessToken != want {
+		t.Errorf("Get(%q) returned %q, %v, want %q", key, got.AccessToken, err, want)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	loader := newCountingLoader(clock)
+	c := newTestTokenCache(clock, loader.load, traktdeviceauth.WithCacheLeeway(10*time.Minute))
+
+	expectCached(t, c, "a", "a-1")
+	expectCached(t, c, "a", "a-1")
+
+	// The token is served until the leeway before it expires, and loaded again from then on.
+	clock.Advance(50*time.Minute - time.Second)
+	expectCached(t, c, "a", "a-1")
+	clock.Advance(time.Second)
+	expectCached(t, c, "a", "a-2")
+	if n := loader.count("a"); n != 2 {
+		t.Errorf("the token was loaded %d times, want 2", n)
+	}
+}
+
+func TestTokenCacheMaxAge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	loader := newCountingLoader(clock)
+	c := newTestTokenCache(clock, loader.load, traktdeviceauth.WithCacheMaxAge(time.Minute))
+
+	expectCached(t, c, "a", "a-1")
+	clock.Advance(time.Minute - time.Second)
+	expectCached(t, c, "a", "a-1")
+	clock.Advance(time.Second)
+	expectCached(t, c, "a", "a-2")
+}
+
+func TestTokenCacheUncachable(t *testing.T) {
+	errLoad := errors.New("database down")
+	var loads int32
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	c := newTestTokenCache(clock, func(ctx context.Context, key string) (traktdeviceauth.TokenResponse, error) {
+		atomic.AddInt32(&loads, 1)
+		switch key {
+		case "expiring":
+			// Within the leeway, so it is returned but loaded again next time.
+			return traktdeviceauth.TokenResponse{AccessToken: key, ExpiresAt: clock.Now().Add(time.Minute)}, nil
+		default:
+			return traktdeviceauth.TokenResponse{AccessToken: "partial"}, errLoad
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		expectCached(t, c, "expiring", "expiring")
+		got, err := c.Get(context.Background(), "failing")
+		if !errors.Is(err, errLoad) || got.AccessToken != "partial" {
+			t.Errorf("Get of a failing key returned %+v, %v, want the token and error of the loader", got, err)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 4 {
+		t.Errorf("the loader was called %d times, want 4", n)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("the cache holds %d tokens, want none", n)
+	}
+}
+
+func TestTokenCacheEviction(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	loader := newCountingLoader(clock)
+	c := newTestTokenCache(clock, loader.load, traktdeviceauth.WithCacheSize(2))
+
+	expectCached(t, c, "a", "a-1")
+	expectCached(t, c, "b", "b-1")
+	// Using a makes b the least recently used, so c evicts it.
+	expectCached(t, c, "a", "a-1")
+	expectCached(t, c, "c", "c-1")
+	if n := c.Len(); n != 2 {
+		t.Errorf("the cache holds %d tokens, want 2", n)
+	}
+	expectCached(t, c, "a", "a-1")
+	expectCached(t, c, "b", "b-2")
+	// Loading b again evicted c, which was used before a.
+	expectCached(t, c, "a", "a-1")
+	expectCached(t, c, "c", "c-2")
+
+	// Sizes below 1 hold a single token.
+	single := newTestTokenCache(clock, loader.load, traktdeviceauth.WithCacheSize(0))
+	expectCached(t, single, "x", "x-1")
+	expectCached(t, single, "y", "y-1")
+	expectCached(t, single, "x", "x-2")
+	if n := single.Len(); n != 1 {
+		t.Errorf("the cache of size 0 holds %d tokens, want 1", n)
+	}
+}
+
+func TestTokenCacheInvalidateAndSet(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	loader := newCountingLoader(clock)
+	c := newTestTokenCache(clock, loader.load)
+
+	expectCached(t, c, "a", "a-1")
+	c.Invalidate("a")
+	expectCached(t, c, "a", "a-2")
+
+	c.Set("a", traktdeviceauth.TokenResponse{AccessToken: "refreshed", ExpiresAt: clock.Now().Add(time.Hour)})
+	expectCached(t, c, "a", "refreshed")
+	c.Invalidate("missing")
+	if n := loader.count("a"); n != 2 {
+		t.Errorf("the token was loaded %d times, want 2", n)
+	}
+}
+
+// blockingLoader is a TokenLoader which reports every call to started and waits for a token or an error on
+// release, or for its context to end.
+type blockingLoader struct {
+	calls   int32
+	started chan string
+	release chan error
+	expires time.Time
+}
+
+func newBlockingLoader(expires time.Time) *blockingLoader {
+	return &blockingLoader{started: make(chan string, 100), release: make(chan error), expires: expires}
+}
+
+func (l *blockingLoader) load(ctx context.Context, key string) (traktdeviceauth.TokenResponse, error) {
+	n := atomic.AddInt32(&l.calls, 1)
+	l.started <- key
+	select {
+	case err := <-l.release:
+		return traktdeviceauth.TokenResponse{AccessToken: fmt.Sprintf("%s-%d", key, n), ExpiresAt: l.expires}, err
+	case <-ctx.Done():
+		return traktdeviceauth.TokenResponse{}, ctx.Err()
+	}
+}
+
+func TestTokenCacheConcurrentMisses(t *testing.T) {
+	loader := newBlockingLoader(time.Now().Add(time.Hour))
+	c := traktdeviceauth.NewTokenCache(loader.load)
+
+	// Every Get of a but the first waits for the load the first started, while b is loaded on its own.
+	const gets = 50
+	results := make(chan string, 2*gets)
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		for i := 0; i < gets; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				got, err := c.Get(context.Background(), key)
+				if err != nil {
+					t.Error(err)
+				}
+				results <- got.AccessToken
+			}(key)
+		}
+	}
+	<-loader.started
+	<-loader.started
+	loader.release <- nil
+	loader.release <- nil
+	wg.Wait()
+	close(results)
+
+	seen := make(map[string]int)
+	for r := range results {
+		seen[r]++
+	}
+	if len(seen) != 2 || seen["a-1"]+seen["a-2"] != gets || seen["b-1"]+seen["b-2"] != gets {
+		t.Errorf("the Gets returned %v, want a single token for each key", seen)
+	}
+	if n := atomic.LoadInt32(&loader.calls); n != 2 {
+		t.Errorf("the loader was called %d times, want once for each key", n)
+	}
+}
+
+func TestTokenCacheInvalidateDuringLoad(t *testing.T) {
+	loader := newBlockingLoader(time.Now().Add(time.Hour))
+	c := traktdeviceauth.NewTokenCache(loader.load)
+
+	for _, change := range []string{"Invalidate", "Set"} {
+		t.Run(change, func(t *testing.T) {
+			key := change
+			done := make(chan traktdeviceauth.TokenResponse)
+			go func() {
+				got, _ := c.Get(context.Background(), key)
+				done <- got
+			}()
+			<-loader.started
+			if change == "Set" {
+				c.Set(key, traktdeviceauth.TokenResponse{AccessToken: "set", ExpiresAt: time.Now().Add(time.Hour)})
+			} else {
+				c.Invalidate(key)
+			}
+			loader.release <- nil
+
+			// The Get waiting for the load still gets its token, but the cache doesn't keep it.
+			if got := <-done; got.AccessToken == "" || got.AccessToken == "set" {
+				t.Errorf("the Get waiting for the load returned %q, want the loaded token", got.AccessToken)
+			}
+			if change == "Set" {
+				expectCached(t, c, key, "set")
+				return
+			}
+			// The next Get loads it again.
+			go func() {
+				got, _ := c.Get(context.Background(), key)
+				done <- got
+			}()
+			<-loader.started
+			loader.release <- nil
+			if got := <-done; got.AccessToken != key+"-2" {
+				t.Errorf("Get after Invalidate returned %q, want the token of a second load", got.AccessToken)
+			}
+		})
+	}
+}
+
+func TestTokenCacheCancelledLoad(t *testing.T) {
+	loader := newBlockingLoader(time.Now().Add(time.Hour))
+	c := traktdeviceauth.NewTokenCache(loader.load)
+
+	// The Get which starts the load is cancelled while another waits for it.
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := c.Get(leaderCtx, "a")
+		leader <- err
+	}()
+	<-loader.started
+
+	follower := make(chan traktdeviceauth.TokenResponse)
+	go func() {
+		got, err := c.Get(context.Background(), "a")
+		if err != nil {
+			t.Error(err)
+		}
+		follower <- got
+	}()
+	// A Get whose own context ends stops waiting.
+	waiterCtx, cancelWaiter := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelWaiter()
+	if _, err := c.Get(waiterCtx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get with an ended context returned %v, want DeadlineExceeded", err)
+	}
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("the cancelled Get returned %v, want Canceled", err)
+	}
+	// The follower loads the token again rather than failing with the cancellation of the leader.
+	<-loader.started
+	loader.release <- nil
+	if got := <-follower; got.AccessToken != "a-2" {
+		t.Errorf("the waiting Get returned %q, want the token of a second load", got.AccessToken)
+	}
+}
+
+func TestStoreLoader(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+	store := traktdeviceauth.NewKVStore(&traktdeviceauth.MemoryKV{}, "tenants/")
+
+	fresh := issuedToken(srv, time.Now().Add(time.Hour))
+	stale := issuedToken(srv, time.Now().Add(time.Minute))
+	for name, tok := range map[string]traktdeviceauth.TokenResponse{
+		"fresh":      fresh,
+		"stale":      stale,
+		"no-refresh": {AccessToken: "access", ExpiresAt: time.Now().Add(time.Minute)},
+	} {
+		if err := store.SaveNamed(ctx, name, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creds := traktdeviceauth.Credentials{ClientID: "client-id", ClientSecret: []byte("secret")}
+	c := traktdeviceauth.NewTokenCache(traktdeviceauth.StoreLoader(store, creds, 10*time.Minute, srv.Options()...))
+
+	// A token valid for long enough is served from the store, then from the cache.
+	for i := 0; i < 2; i++ {
+		expectCached(t, c, "fresh", fresh.AccessToken)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 0 {
+		t.Errorf("%d refreshes were made for a fresh token", n)
+	}
+
+	// One about to expire is refreshed once and saved.
+	for i := 0; i < 2; i++ {
+		got, err := c.Get(ctx, "stale")
+		if err != nil || got.AccessToken == stale.AccessToken {
+			t.Fatalf("Get of a stale token returned %+v, %v, want a refreshed token", got, err)
+		}
+	}
+	saved, err := store.LoadNamed(ctx, "stale")
+	if err != nil || saved.AccessToken == stale.AccessToken {
+		t.Errorf("the store holds %+v, %v after the refresh, want the new token", saved, err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refreshes were made, want 1", n)
+	}
+
+	if _, err := c.Get(ctx, "no-refresh"); !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) {
+		t.Errorf("Get of an expiring token without a refresh token returned %v, want ErrReauthorizationRequired", err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Errorf("Get of a missing tenant returned %v, want ErrNoStoredToken", err)
+	}
+}
+
+func BenchmarkTokenCacheGet(b *testing.B) {
+	expires := time.Now().Add(time.Hour)
+	c := traktdeviceauth.NewTokenCache(func(ctx context.Context, key string) (traktdeviceauth.TokenResponse, error) {
+		return traktdeviceauth.TokenResponse{AccessToken: key, ExpiresAt: expires}, nil
+	})
+	const keys = 100
+	ctx := context.Background()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := c.Get(ctx, strconv.Itoa(i%keys)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkTokenCacheEviction(b *testing.B) {
+	expires := time.Now().Add(time.Hour)
+	c := traktdeviceauth.NewTokenCache(func(ctx context.Context, key string) (traktdeviceauth.TokenResponse, error) {
+		return traktdeviceauth.TokenResponse{AccessToken: key, ExpiresAt: expires}, nil
+	}, traktdeviceauth.WithCacheSize(100))
+	ctx := context.Background()
+
+	// Every Get misses and evicts a token, since there are ten times as many keys as the cache holds.
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := c.Get(ctx, strconv.Itoa(i%1000)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
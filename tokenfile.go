@@ -0,0 +1,215 @@
+package traktdeviceauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// ErrInsecurePermissions is returned by LoadTokenFromFile, wrapped in a *PermissionsError, when the token file
+// can be read by users other than its owner.
+var ErrInsecurePermissions error = errors.New("token file is readable by other users")
+
+// PermissionsError is returned by LoadTokenFromFile when the token file at Path has the permission bits Mode,
+// which allow users other than its owner to read it. It unwraps to ErrInsecurePermissions.
+type PermissionsError struct {
+	Path string
+	Mode fs.FileMode
+}
+
+// Error returns the path and mode of the file along with the reason it was rejected.
+func (e *PermissionsError) Error() string {
+	return fmt.Sprintf("%s has mode %04o: %v", e.Path, e.Mode, ErrInsecurePermissions)
+}
+
+// Unwrap returns ErrInsecurePermissions.
+func (e *PermissionsError) Unwrap() error {
+	return ErrInsecurePermissions
+}
+
+// FileOption configures how LoadTokenFromFile treats the token file.
+type FileOption func(*fileConfig)
+
+type fileConfig struct {
+	allowInsecure bool
+	fixPerms      bool
+	lockTimeout   time.Duration
+	codec         Codec
+}
+
+// WithAllowInsecurePermissions makes LoadTokenFromFile load token files which can be read by other users,
+// instead of returning a *PermissionsError.
+func WithAllowInsecurePermissions() FileOption {
+	return func(c *fileConfig) {
+		c.allowInsecure = true
+	}
+}
+
+// WithFixPermissions makes LoadTokenFromFile remove the group and world permissions of token files which have
+// them, instead of returning a *PermissionsError.
+func WithFixPermissions() FileOption {
+	return func(c *fileConfig) {
+		c.fixPerms = true
+	}
+}
+
+// WithLockTimeout sets how long a FileTokenStore waits for another process or store to release the lock on the
+// token file before failing with ErrStoreLocked. The default is DefaultLockTimeout, and 0 fails right away if
+// the file is locked. LoadTokenFromFile ignores it, since it doesn't lock the file.
+func WithLockTimeout(d time.Duration) FileOption {
+	return func(c *fileConfig) {
+		c.lockTimeout = d
+	}
+}
+
+// WithFileCodec makes LoadTokenFromFile and FileTokenStore decode and encode the token file with codec instead of
+// encoding/json. Files written with it aren't indented.
+func WithFileCodec(codec Codec) FileOption {
+	return func(c *fileConfig) {
+		c.codec = codec
+	}
+}
+
+// SaveToFile atomically replaces the file at path with t as a StoredToken. The file is only readable by the current user.
+func (t TokenResponse) SaveToFile(path string) error {
+	return t.saveToFile(path, nil)
+}
+
+// saveToFile is SaveToFile with the WithFileCodec Codec, which may be nil.
+func (t TokenResponse) saveToFile(path string, codec Codec) error {
+	var (
+		b   []byte
+		err error
+	)
+	if codec == nil {
+		b, err = json.MarshalIndent(NewStoredToken(t), "", "  ")
+	} else {
+		b, err = codec.Marshal(NewStoredToken(t))
+	}
+	if err != nil {
+		return fmt.Errorf("SaveToFile: %w", err)
+	}
+
+	b = append(b, '\n')
+	err = writeFileAtomic(path, b)
+	wipeBytes(b)
+	if err != nil {
+		return fmt.Errorf("SaveToFile: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with b, so that readers see either the old or the new contents.
+// The file is only readable by the current user. The contents and the rename are synced to disk before it
+// returns, so that a crash or power loss can't leave an empty file, or the old one, behind.
+func writeFileAtomic(path string, b []byte) error {
+	// CreateTemp creates the file with mode 0600, so the contents are never readable by others, even briefly.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory dir to disk, which makes a rename into it durable. Windows can't open directories
+// for syncing, and its renames don't need it, so nothing is done there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// LoadTokenFromFile reads a token saved by SaveToFile, or by an earlier version of it. Files written before the
+// format had a version, including the raw token response of Trakt and a TokenResponse encoded with
+// encoding/json, are read too.
+//
+// On Unix, files which can be read by users other than their owner are rejected with a *PermissionsError,
+// since the token has to be assumed leaked. WithAllowInsecurePermissions and WithFixPermissions change that.
+// Windows permissions don't map to mode bits, so the check is skipped there.
+func LoadTokenFromFile(path string, opts ...FileOption) (TokenResponse, error) {
+	var c fileConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %w", err)
+	}
+	defer f.Close()
+
+	if err := c.checkPermissions(f, path); err != nil {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %w", err)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %w", err)
+	}
+	defer wipeBytes(b)
+
+	if _, ok := c.codec.(encryptingCodec); !ok && bytes.HasPrefix(b, []byte(encryptedTokenMagic)) {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %s is encrypted, so it can only be loaded with its key or passphrase through NewEncryptedFileTokenStore or NewPassphraseEncryptedFileTokenStore", path)
+	}
+
+	var st StoredToken
+	if err := codecOrDefault(c.codec).Unmarshal(b, &st); err != nil {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %s: %w", path, err)
+	}
+	return st.TokenResponse(), nil
+}
+
+// checkPermissions returns a *PermissionsError if f, which was opened from path, is readable by other users.
+// The file's mode is fixed instead if c.fixPerms is set, by taking away every permission of other users.
+func (c fileConfig) checkPermissions(f *os.File, path string) error {
+	if runtime.GOOS == "windows" || c.allowInsecure {
+		return nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0044 == 0 {
+		return nil
+	}
+	if c.fixPerms {
+		return f.Chmod(mode &^ 0077)
+	}
+	return &PermissionsError{Path: path, Mode: mode}
+}
@@ -0,0 +1,120 @@
+package traktdeviceauth_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+func TestTokenFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	// ClockSkew describes the response the token came in, so it isn't stored.
+	tok := fixtureToken
+	tok.ClockSkew = 2 * time.Second
+	if err := tok.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := traktdeviceauth.LoadTokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, fixtureToken) {
+		t.Errorf("LoadTokenFromFile returned %+v, want %+v", got, fixtureToken)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0o600 {
+			t.Errorf("the token file has mode %04o, want 0600", mode)
+		}
+	}
+	// Only the file itself is left, without the temporary file it was written through.
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("the directory holds %v (%v), want only the token file", entries, err)
+	}
+}
+
+func TestTokenFileLegacyFormats(t *testing.T) {
+	// Files written before the format had a version are read, and saved again in the current version.
+	for _, f := range formatFixtures[:3] {
+		t.Run(f.name, func(t *testing.T) {
+			path := writeTokenFile(t, f.doc, 0o600)
+			got, err := traktdeviceauth.LoadTokenFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, fixtureToken) {
+				t.Fatalf("LoadTokenFromFile returned %+v, want %+v", got, fixtureToken)
+			}
+
+			if err := got.SaveToFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if again, err := traktdeviceauth.LoadTokenFromFile(path); err != nil || !reflect.DeepEqual(again, fixtureToken) {
+				t.Errorf("loading the saved token returned %+v, %v, want %+v", again, err, fixtureToken)
+			}
+		})
+	}
+}
+
+func TestTokenFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes don't restrict readers on Windows")
+	}
+
+	path := writeTokenFile(t, formatFixtures[len(formatFixtures)-1].doc, 0o644)
+	_, err := traktdeviceauth.LoadTokenFromFile(path)
+	var permErr *traktdeviceauth.PermissionsError
+	if !errors.As(err, &permErr) || permErr.Path != path || permErr.Mode != 0o644 || !errors.Is(err, traktdeviceauth.ErrInsecurePermissions) {
+		t.Fatalf("LoadTokenFromFile returned %v, want a *PermissionsError for mode 0644", err)
+	}
+
+	if _, err := traktdeviceauth.LoadTokenFromFile(path, traktdeviceauth.WithAllowInsecurePermissions()); err != nil {
+		t.Errorf("LoadTokenFromFile with WithAllowInsecurePermissions: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+		t.Errorf("WithAllowInsecurePermissions changed the mode to %04o", info.Mode().Perm())
+	}
+
+	if _, err := traktdeviceauth.LoadTokenFromFile(path, traktdeviceauth.WithFixPermissions()); err != nil {
+		t.Errorf("LoadTokenFromFile with WithFixPermissions: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("WithFixPermissions left the mode at %04o, want 0600", info.Mode().Perm())
+	}
+	if _, err := traktdeviceauth.LoadTokenFromFile(path); err != nil {
+		t.Errorf("LoadTokenFromFile after fixing the mode: %v", err)
+	}
+
+	// Only read permissions let other users see the token.
+	for perm, insecure := range map[os.FileMode]bool{0o640: true, 0o604: true, 0o620: false, 0o400: false} {
+		path := writeTokenFile(t, formatFixtures[len(formatFixtures)-1].doc, perm)
+		if _, err := traktdeviceauth.LoadTokenFromFile(path); errors.Is(err, traktdeviceauth.ErrInsecurePermissions) != insecure || (!insecure && err != nil) {
+			t.Errorf("LoadTokenFromFile of a file with mode %04o returned %v", perm, err)
+		}
+	}
+}
+
+// writeTokenFile writes doc to a token file with mode perm and returns its path.
+func writeTokenFile(t *testing.T, doc string, perm os.FileMode) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, []byte(doc), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile's mode is subject to the umask.
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
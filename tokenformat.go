@@ -0,0 +1,184 @@
+package traktdeviceauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StoredTokenVersion is the version of the StoredToken JSON format written by this version of the package.
+// It is increased whenever the format changes, and older documents are migrated when they are loaded.
+const StoredTokenVersion = 3
+
+// ErrUnsupportedFormatVersion is returned, wrapped in a *FormatVersionError, when a stored token was written
+// in a newer format than this version of the package can read.
+var ErrUnsupportedFormatVersion error = errors.New("the stored token was written by a newer version of traktdeviceauth")
+
+// FormatVersionError is returned when decoding a StoredToken whose format Version is newer than
+// StoredTokenVersion, which usually means a newer program has rewritten the token. It unwraps to
+// ErrUnsupportedFormatVersion.
+type FormatVersionError struct {
+	Version int
+}
+
+// Error returns the version of the stored token along with the newest supported one.
+func (e *FormatVersionError) Error() string {
+	return fmt.Sprintf("format version %d is newer than version %d: %v", e.Version, StoredTokenVersion, ErrUnsupportedFormatVersion)
+}
+
+// Unwrap returns ErrUnsupportedFormatVersion.
+func (e *FormatVersionError) Unwrap() error {
+	return ErrUnsupportedFormatVersion
+}
+
+// storedTokenMigrations upgrades a StoredToken document from one format version to the next: the function at
+// index v turns version v into version v+1. Its length is always StoredTokenVersion.
+var storedTokenMigrations = []func(doc map[string]json.RawMessage) error{
+	// Version 0 is the format from before versioning, which has no version field and the same fields as
+	// version 1. It also covers what programs stored themselves before this package had a format: the raw
+	// token response of Trakt, and TokenResponse encoded before it had JSON tags.
+	0: migrateUnversionedToken,
+
+	// Version 2 added refresh_token_issued_at. The refresh token of an older document is assumed to have
+	// been issued with its access token.
+	1: func(doc map[string]json.RawMessage) error {
+		if _, ok := doc["refresh_token_issued_at"]; !ok {
+			if createdAt, ok := doc["created_at"]; ok {
+				doc["refresh_token_issued_at"] = createdAt
+			}
+		}
+		return nil
+	},
+
+	// Version 3 added rotation, which documents that weren't written by a RotatingStore don't have.
+	2: func(doc map[string]json.RawMessage) error { return nil },
+}
+
+// goFieldNames maps the names of the StoredToken fields to the names encoding/json gave them in a TokenResponse
+// without JSON tags.
+var goFieldNames = map[string]string{
+	"access_token":            "AccessToken",
+	"token_type":              "TokenType",
+	"refresh_token":           "RefreshToken",
+	"scope":                   "Scope",
+	"created_at":              "CreatedAt",
+	"expires_at":              "ExpiresAt",
+	"refresh_token_issued_at": "RefreshTokenIssuedAt",
+}
+
+// migrateUnversionedToken turns a document without a version into version 1. Fields named after the fields of
+// TokenResponse are renamed, and a raw token response from Trakt, whose created_at is in seconds since the epoch
+// and whose lifetime is given by expires_in, gets its times converted.
+func migrateUnversionedToken(doc map[string]json.RawMessage) error {
+	for name, goName := range goFieldNames {
+		if raw, ok := doc[goName]; ok {
+			if _, ok := doc[name]; !ok {
+				doc[name] = raw
+			}
+			delete(doc, goName)
+		}
+	}
+
+	var createdAt int64
+	raw, ok := doc["created_at"]
+	if !ok || json.Unmarshal(raw, &createdAt) != nil {
+		// created_at is missing or already a time.
+		return nil
+	}
+	created := time.Unix(createdAt, 0).UTC()
+	if raw, ok := doc["expires_in"]; ok {
+		var expiresIn int64
+		if err := json.Unmarshal(raw, &expiresIn); err != nil {
+			return fmt.Errorf("expires_in: %w", err)
+		}
+		if _, ok := doc["expires_at"]; !ok {
+			if err := setTime(doc, "expires_at", created.Add(time.Duration(expiresIn)*time.Second)); err != nil {
+				return err
+			}
+		}
+		delete(doc, "expires_in")
+	}
+	return setTime(doc, "created_at", created)
+}
+
+// setTime sets the field name of doc to t.
+func setTime(doc map[string]json.RawMessage, name string, t time.Time) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	doc[name] = b
+	return nil
+}
+
+// UnmarshalJSON decodes t from the JSON encoding of a TokenResponse, or any document StoredToken can decode,
+// such as a file written by SaveToFile or the raw token response of Trakt.
+func (t *TokenResponse) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var st StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	var extra struct {
+		ClockSkew time.Duration `json:"clock_skew"`
+	}
+	if err := json.Unmarshal(b, &extra); err != nil {
+		return err
+	}
+
+	*t = st.TokenResponse()
+	t.ClockSkew = extra.ClockSkew
+	return nil
+}
+
+// storedTokenFields has the fields of StoredToken without its JSON methods.
+type storedTokenFields StoredToken
+
+// MarshalJSON encodes s along with the format version, StoredTokenVersion.
+func (s StoredToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version int `json:"version"`
+		storedTokenFields
+	}{StoredTokenVersion, storedTokenFields(s)})
+}
+
+// UnmarshalJSON decodes a StoredToken in the current format or any earlier one, migrating older documents
+// first. Documents without a version are from before versioning. Newer formats are rejected with a
+// *FormatVersionError, since fields this version doesn't know about could be lost.
+func (s *StoredToken) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil || version < 0 {
+			return fmt.Errorf("the stored token has the invalid format version %s", raw)
+		}
+		delete(doc, "version")
+	}
+	if version > StoredTokenVersion {
+		return &FormatVersionError{Version: version}
+	}
+	for v := version; v < StoredTokenVersion; v++ {
+		if err := storedTokenMigrations[v](doc); err != nil {
+			return fmt.Errorf("migrating the stored token from format version %d: %w", v, err)
+		}
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(migrated)
+	return json.Unmarshal(migrated, (*storedTokenFields)(s))
+}
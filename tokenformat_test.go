@@ -0,0 +1,198 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// formatFixtures are the same token as stored in every format version so far, from oldest to newest.
+var formatFixtures = []struct {
+	name string
+	doc  string
+}{
+	{"raw token response", `{"access_token":"access","token_type":"bearer","expires_in":7776000,"refresh_token":"refresh","scope":"public","created_at":1717243200}`},
+	{"TokenResponse without JSON tags", `{"AccessToken":"access","TokenType":"bearer","ExpiresAt":"2024-08-30T12:00:00Z","RefreshToken":"refresh","Scope":"public","CreatedAt":"2024-06-01T12:00:00Z"}`},
+	{"version 0", `{"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z"}`},
+	{"version 1", `{"version":1,"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z"}`},
+	{"version 2", `{"version":2,"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z"}`},
+	{"version 3", `{"version":3,"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z"}`},
+	{"version 3 with a rotation", `{"version":3,"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z","rotation":{"generation":4,"previous_access_token":"previous","previous_valid_until":"2024-06-01T12:01:00Z"}}`},
+}
+
+// futureFixture is a token stored by a version of the package newer than this one.
+const futureFixture = `{"version":4,"access_token":"access","token_type":"bearer","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","expires_at":"2024-08-30T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z","new_field":true}`
+
+// fixtureToken is the token every fixture holds.
+var fixtureToken = traktdeviceauth.TokenResponse{
+	AccessToken:          "access",
+	TokenType:            "bearer",
+	ExpiresAt:            time.Date(2024, 8, 30, 12, 0, 0, 0, time.UTC),
+	RefreshToken:         "refresh",
+	Scope:                "public",
+	CreatedAt:            time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	RefreshTokenIssuedAt: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+}
+
+// rawCodec is a Codec which encodes any value as its doc, to store a fixture the way the Codecs of stores do.
+type rawCodec struct {
+	doc string
+}
+
+func (c rawCodec) Marshal(v interface{}) ([]byte, error)      { return []byte(c.doc), nil }
+func (c rawCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// formatStores returns a store of every kind, and a function storing a fixture into it as it is.
+func formatStores(t *testing.T) map[string]struct {
+	store traktdeviceauth.TokenStore
+	put   func(doc string)
+} {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token.json")
+	encryptedPath := filepath.Join(dir, "token.enc")
+	key := []byte(strings.Repeat("k", 32))
+	encrypted, err := traktdeviceauth.NewEncryptedFileTokenStore(encryptedPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &traktdeviceauth.MemoryKV{}
+
+	return map[string]struct {
+		store traktdeviceauth.TokenStore
+		put   func(doc string)
+	}{
+		"file": {traktdeviceauth.NewFileTokenStore(path), func(doc string) {
+			if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		"encrypted file": {encrypted, func(doc string) {
+			s, err := traktdeviceauth.NewEncryptedFileTokenStore(encryptedPath, key, traktdeviceauth.WithFileCodec(rawCodec{doc}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Save(context.Background(), traktdeviceauth.TokenResponse{}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		"named": {traktdeviceauth.Named(traktdeviceauth.NewKVStore(kv, "tokens/"), "alice"), func(doc string) {
+			if err := kv.Put(context.Background(), "tokens/alice", []byte(doc)); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+}
+
+func TestStoredTokenFormatVersions(t *testing.T) {
+	for name, s := range formatStores(t) {
+		for _, f := range formatFixtures {
+			t.Run(name+"/"+f.name, func(t *testing.T) {
+				s.put(f.doc)
+				got, err := s.store.Load(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, fixtureToken) {
+					t.Errorf("Load returned %+v, want %+v", got, fixtureToken)
+				}
+			})
+		}
+	}
+}
+
+func TestStoredTokenFormatFutureVersion(t *testing.T) {
+	for name, s := range formatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s.put(futureFixture)
+			got, err := s.store.Load(context.Background())
+			var versionErr *traktdeviceauth.FormatVersionError
+			if !errors.As(err, &versionErr) || versionErr.Version != 4 || !errors.Is(err, traktdeviceauth.ErrUnsupportedFormatVersion) {
+				t.Fatalf("Load returned %v, want a *FormatVersionError for version 4", err)
+			}
+			if got != (traktdeviceauth.TokenResponse{}) {
+				t.Errorf("Load returned %+v along with the error, want the zero TokenResponse", got)
+			}
+		})
+	}
+
+	// The newer file is left alone.
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, []byte(futureFixture), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := traktdeviceauth.LoadTokenFromFile(path); !errors.Is(err, traktdeviceauth.ErrUnsupportedFormatVersion) {
+		t.Errorf("LoadTokenFromFile returned %v, want ErrUnsupportedFormatVersion", err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != futureFixture {
+		t.Errorf("the file holds %s (%v) after loading it, want it unchanged", b, err)
+	}
+}
+
+func TestStoredTokenFormatInvalidVersion(t *testing.T) {
+	for _, version := range []string{`-1`, `"3"`, `2.5`} {
+		var st traktdeviceauth.StoredToken
+		err := json.Unmarshal([]byte(`{"version":`+version+`,"access_token":"access"}`), &st)
+		if err == nil || errors.Is(err, traktdeviceauth.ErrUnsupportedFormatVersion) {
+			t.Errorf("decoding version %s returned %v, want an invalid version error", version, err)
+		}
+	}
+}
+
+func TestStoredTokenFormatWritesCurrentVersion(t *testing.T) {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(fixtureToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil || doc.Version != traktdeviceauth.StoredTokenVersion {
+		t.Errorf("the encoded StoredToken %s has version %d (%v), want %d", b, doc.Version, err, traktdeviceauth.StoredTokenVersion)
+	}
+	if len(formatFixtures) == 0 || !strings.HasPrefix(formatFixtures[len(formatFixtures)-1].doc, `{"version":3,`) || traktdeviceauth.StoredTokenVersion != 3 {
+		t.Errorf("StoredTokenVersion is %d, add a fixture of the new version to formatFixtures", traktdeviceauth.StoredTokenVersion)
+	}
+}
+
+func TestTokenResponseJSON(t *testing.T) {
+	b, err := json.Marshal(fixtureToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"access_token":"access","token_type":"bearer","expires_at":"2024-08-30T12:00:00Z","refresh_token":"refresh","scope":"public","created_at":"2024-06-01T12:00:00Z","refresh_token_issued_at":"2024-06-01T12:00:00Z"}`
+	if string(b) != want {
+		t.Errorf("json.Marshal returned %s, want %s", b, want)
+	}
+
+	// A TokenResponse decodes from every format a StoredToken does.
+	for _, f := range formatFixtures {
+		var got traktdeviceauth.TokenResponse
+		if err := json.Unmarshal([]byte(f.doc), &got); err != nil {
+			t.Errorf("%s: %v", f.name, err)
+		} else if !reflect.DeepEqual(got, fixtureToken) {
+			t.Errorf("%s: decoded %+v, want %+v", f.name, got, fixtureToken)
+		}
+	}
+
+	// ClockSkew is only encoded when set, and survives a round trip.
+	skewed := fixtureToken
+	skewed.ClockSkew = 3 * time.Second
+	b, err = json.Marshal(skewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got traktdeviceauth.TokenResponse
+	if err := json.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, skewed) {
+		t.Errorf("the round trip of %s returned %+v, %v, want %+v", b, got, err, skewed)
+	}
+}
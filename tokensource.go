@@ -0,0 +1,219 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TokenSource returns a token which is valid for the call the caller is about to make, refreshing it first if
+// needed. Implementations must be safe for concurrent use.
+type TokenSource interface {
+	Token(ctx context.Context) (TokenResponse, error)
+}
+
+// TokenSourceOption customizes a RefreshingTokenSource.
+type TokenSourceOption func(*RefreshingTokenSource)
+
+// WithTokenSourceMargin sets how long before the token expires a RefreshingTokenSource refreshes it. The default
+// is 5 minutes.
+func WithTokenSourceMargin(d time.Duration) TokenSourceOption {
+	return func(s *RefreshingTokenSource) {
+		s.margin = d
+	}
+}
+
+// WithTokenSourceOptions passes opts to every refresh made by a RefreshingTokenSource. WithTokenSaver is the
+// usual one, since Trakt revokes the refresh token which was used, so the new token has to be saved.
+func WithTokenSourceOptions(opts ...Option) TokenSourceOption {
+	opts = append([]Option(nil), opts...)
+	return func(s *RefreshingTokenSource) {
+		s.opts = opts
+	}
+}
+
+// WithTokenSourceStore saves every token a RefreshingTokenSource refreshes to store, since Trakt revokes the
+// refresh token which was used, so store has to write tokens durably, as FileTokenStore does. A token which
+// couldn't be saved is still returned and kept, along with a *HookError for "WithTokenSourceStore".
+func WithTokenSourceStore(store TokenStore) TokenSourceOption {
+	return func(s *RefreshingTokenSource) {
+		s.store = store
+	}
+}
+
+// RefreshingTokenSource is a TokenSource which holds a single token and refreshes it when it is about to
+// expire. Only one refresh runs at a time: a Token call which finds a refresh in progress waits for it and
+// returns its token, instead of refreshing again with a refresh token which Trakt has already revoked.
+type RefreshingTokenSource struct {
+	client *Client // Without Options, which are in opts.
+	margin time.Duration
+	opts   []Option
+	store  TokenStore
+
+	refreshing chan struct{} // Holds a value while a Token call refreshes the token.
+
+	mu       sync.Mutex
+	token    TokenResponse
+	rejected error // Set once Trakt rejected the refresh token, which is never tried again.
+}
+
+// NewTokenSource creates a RefreshingTokenSource which starts with initial and refreshes it for the app
+// identified by clientID and clientSecret, which may be empty for public clients.
+func NewTokenSource(initial TokenResponse, clientID, clientSecret string, opts ...TokenSourceOption) *RefreshingTokenSource {
+	return newTokenSource(initial, NewClient(clientID, clientSecret), opts...)
+}
+
+// newTokenSource creates a RefreshingTokenSource which refreshes with client, which has no Options of its own.
+func newTokenSource(initial TokenResponse, client *Client, opts ...TokenSourceOption) *RefreshingTokenSource {
+	s := &RefreshingTokenSource{
+		client:     client,
+		margin:     5 * time.Minute,
+		refreshing: make(chan struct{}, 1),
+		token:      initial,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Token returns the token, refreshing it first if it expires within the margin. If the refresh fails while the
+// token still hasn't expired, the token is returned anyway and the next call tries again. ctx bounds the
+// refresh, or the wait for one made by another call.
+//
+// Token returns an error wrapping ErrReauthorizationRequired if the token has expired and has no refresh token.
+// Once Trakt rejects the refresh token, Token stops trying to refresh and returns such an error from then on,
+// along with the token until it expires, so that it can still be used while the user authorizes the app again.
+// If a hook set by WithTokenSaver or the WithTokenSourceStore store fails, the refreshed token is returned along
+// with the *HookError, and kept.
+func (s *RefreshingTokenSource) Token(ctx context.Context) (TokenResponse, error) {
+	if t, ok := s.fresh(); ok {
+		return t, nil
+	}
+	if t, err := s.rejection(); err != nil {
+		return t, err
+	}
+
+	select {
+	case s.refreshing <- struct{}{}:
+	case <-ctx.Done():
+		return TokenResponse{}, fmt.Errorf("RefreshingTokenSource.Token: %w", ctx.Err())
+	}
+	defer func() { <-s.refreshing }()
+
+	// Another call may have refreshed the token, or had its refresh token rejected, while this one waited.
+	if t, ok := s.fresh(); ok {
+		return t, nil
+	}
+	if t, err := s.rejection(); err != nil {
+		return t, err
+	}
+
+	s.mu.Lock()
+	old := s.token
+	s.mu.Unlock()
+	if old.RefreshToken == "" {
+		return s.fallback(old, fmt.Errorf("RefreshingTokenSource.Token: %w: the token has no refresh token", ErrReauthorizationRequired))
+	}
+
+	t, err := s.client.RefreshAccessToken(ctx, old.RefreshToken, s.opts...)
+	var hookErr *HookError
+	switch {
+	case errors.Is(err, ErrInvalidGrant):
+		s.mu.Lock()
+		s.rejected = fmt.Errorf("RefreshingTokenSource.Token: %w: %v", ErrReauthorizationRequired, err)
+		s.mu.Unlock()
+		return s.rejection()
+	case err != nil && !errors.As(err, &hookErr):
+		return s.fallback(old, fmt.Errorf("RefreshingTokenSource.Token: %w", err))
+	}
+
+	t = t.keepRefreshTokenIssuedAt(old)
+	s.mu.Lock()
+	s.token = t
+	s.mu.Unlock()
+	if s.store != nil {
+		if saveErr := s.store.Save(ctx, t); saveErr != nil && err == nil {
+			err = &HookError{Hook: "WithTokenSourceStore", Err: saveErr}
+		}
+	}
+	if err != nil {
+		return t, fmt.Errorf("RefreshingTokenSource.Token: %w", err)
+	}
+	return t, nil
+}
+
+// fresh returns the token unless it expires within the margin.
+func (s *RefreshingTokenSource) fresh() (TokenResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token, !s.token.ExpiresWithin(s.margin)
+}
+
+// rejection returns the error wrapping ErrReauthorizationRequired which Token returns once Trakt has rejected the
+// refresh token, along with the token if it hasn't expired yet, and a nil error if the refresh token wasn't rejected.
+func (s *RefreshingTokenSource) rejection() (TokenResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejected == nil || s.token.Expired() {
+		return TokenResponse{}, s.rejected
+	}
+	return s.token, s.rejected
+}
+
+// fallback returns old, whose refresh failed with err, if it hasn't expired yet, and err otherwise.
+func (s *RefreshingTokenSource) fallback(old TokenResponse, err error) (TokenResponse, error) {
+	if !old.Expired() {
+		return old, nil
+	}
+	return TokenResponse{}, err
+}
+
+// LoadOrAuthorize returns a valid token for the app of client, from store if it holds one. A stored token which
+// is about to expire is refreshed, and the device flow is run if store holds no token or its refresh token was
+// rejected, with display called to show the code to the user. Tokens which were refreshed or obtained are saved
+// to store. If saving fails, the token is returned along with the error and must not be thrown away. Since the
+// refresh token which was used is revoked, store has to write tokens durably: FileTokenStore syncs every token
+// to disk before Save returns.
+//
+// LoadOrAuthorize suits programs which start, get a token and exit. Programs which keep running can pass the
+// token to NewTokenSource with WithTokenSourceStore, so that it stays valid.
+func LoadOrAuthorize(ctx context.Context, store TokenStore, client *Client, display func(codeResp CodeResponse)) (TokenResponse, error) {
+	t, err := store.Load(ctx)
+	switch {
+	case err == nil:
+		src := newTokenSource(t, client.credentialsOnly(), WithTokenSourceOptions(client.opts...), WithTokenSourceStore(store))
+		t, err = src.Token(ctx)
+		switch {
+		case err == nil:
+			return t, nil
+		case !errors.Is(err, ErrReauthorizationRequired):
+			// A failed hook comes with a valid token.
+			return t, fmt.Errorf("LoadOrAuthorize: %w", err)
+		}
+	case !errors.Is(err, ErrNoStoredToken):
+		return TokenResponse{}, fmt.Errorf("LoadOrAuthorize: %w", err)
+	}
+
+	codeResp, err := client.GenerateNewCode(ctx)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("LoadOrAuthorize: %w", err)
+	}
+	display(codeResp)
+	t, err = client.PollForAuthToken(ctx, codeResp)
+	var hookErr *HookError
+	if err != nil && !errors.As(err, &hookErr) {
+		return TokenResponse{}, fmt.Errorf("LoadOrAuthorize: %w", err)
+	}
+	if saveErr := store.Save(ctx, t); saveErr != nil {
+		return t, fmt.Errorf("LoadOrAuthorize: saving the token: %w", saveErr)
+	}
+	if err != nil {
+		return t, fmt.Errorf("LoadOrAuthorize: %w", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,289 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// expiringToken returns a token for srv which expires in d.
+func expiringToken(srv *traktdeviceauthtest.Server, d time.Duration) traktdeviceauth.TokenResponse {
+	tok := srv.IssueToken()
+	return traktdeviceauth.TokenResponse{AccessToken: tok.AccessToken, RefreshToken: tok.RefreshToken, ExpiresAt: time.Now().Add(d)}
+}
+
+func TestTokenSourceReturnsValidTokenWithoutRefreshing(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	initial := expiringToken(srv, time.Hour)
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(srv.Options()...))
+	got, err := src.Token(context.Background())
+	if err != nil || got != initial {
+		t.Fatalf("Token() = %+v, %v, want the initial token", got, err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 0 {
+		t.Errorf("%d refreshes were made, want 0", n)
+	}
+}
+
+func TestTokenSourceRefreshesOnceConcurrently(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	initial := expiringToken(srv, time.Minute)
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(srv.Options()...))
+
+	var wg sync.WaitGroup
+	tokens := make([]traktdeviceauth.TokenResponse, 50)
+	errs := make([]error, len(tokens))
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = src.Token(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatalf("Token() returned %v", errs[i])
+		}
+		if tokens[i].AccessToken == initial.AccessToken || tokens[i] != tokens[0] {
+			t.Fatalf("goroutine %d got %+v, want the one refreshed token", i, tokens[i])
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refreshes were made, want exactly 1", n)
+	}
+}
+
+func TestTokenSourceStopsRefreshingAfterInvalidGrant(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	// The server never issued this refresh token, so it rejects it.
+	initial := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "revoked", ExpiresAt: time.Now().Add(time.Minute)}
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(srv.Options()...))
+
+	for i := 0; i < 3; i++ {
+		got, err := src.Token(context.Background())
+		if !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) {
+			t.Fatalf("call %d: Token() returned %v, want ErrReauthorizationRequired", i, err)
+		}
+		if got != initial {
+			t.Errorf("call %d: Token() = %+v, want the unexpired token", i, got)
+		}
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refreshes were made with the rejected refresh token, want 1", n)
+	}
+}
+
+func TestTokenSourceExpiredTokenWithRejectedRefreshToken(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+
+	initial := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "revoked", ExpiresAt: time.Now().Add(-time.Minute)}
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(srv.Options()...))
+
+	got, err := src.Token(context.Background())
+	if !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) || got != (traktdeviceauth.TokenResponse{}) {
+		t.Fatalf("Token() = %+v, %v, want no token and ErrReauthorizationRequired", got, err)
+	}
+}
+
+func TestTokenSourceKeepsTokenOnTransientFailure(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.RefreshSequence(traktdeviceauthtest.Status(500), traktdeviceauthtest.Succeed()))
+
+	initial := expiringToken(srv, time.Minute)
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret",
+		traktdeviceauth.WithTokenSourceOptions(append(srv.Options(), traktdeviceauth.WithCallRetryPolicy(traktdeviceauth.RetryPolicy{}))...))
+
+	// The first refresh fails, so the unexpired token is returned, and the next call tries again.
+	if got, err := src.Token(context.Background()); err != nil || got != initial {
+		t.Fatalf("Token() = %+v, %v, want the initial token", got, err)
+	}
+	got, err := src.Token(context.Background())
+	if err != nil || got.AccessToken == initial.AccessToken {
+		t.Fatalf("Token() = %+v, %v, want a refreshed token", got, err)
+	}
+}
+
+// failingSaveStore is a TokenStore whose Save always fails with err.
+type failingSaveStore struct {
+	traktdeviceauth.TokenStore
+	err error
+}
+
+func (s failingSaveStore) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	return s.err
+}
+
+func TestTokenSourceStore(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	store := traktdeviceauthtest.NewMemoryStore()
+
+	initial := expiringToken(srv, time.Minute)
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret",
+		traktdeviceauth.WithTokenSourceOptions(srv.Options()...), traktdeviceauth.WithTokenSourceStore(store))
+	got, err := src.Token(context.Background())
+	if err != nil || got.AccessToken == initial.AccessToken {
+		t.Fatalf("Token() = %+v, %v, want a refreshed token", got, err)
+	}
+	if stored, err := store.Load(context.Background()); err != nil || stored.AccessToken != got.AccessToken {
+		t.Errorf("the store holds %+v (%v), want the refreshed token", stored, err)
+	}
+}
+
+func TestTokenSourceStoreFailure(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	errSave := errors.New("disk full")
+
+	// A token which couldn't be saved is still returned, and kept.
+	initial := expiringToken(srv, time.Minute)
+	src := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret",
+		traktdeviceauth.WithTokenSourceOptions(srv.Options()...), traktdeviceauth.WithTokenSourceStore(failingSaveStore{err: errSave}))
+	got, err := src.Token(context.Background())
+	var hookErr *traktdeviceauth.HookError
+	if !errors.As(err, &hookErr) || hookErr.Hook != "WithTokenSourceStore" || !errors.Is(err, errSave) {
+		t.Fatalf("Token() returned %v, want a *HookError for WithTokenSourceStore", err)
+	}
+	if got.AccessToken == "" || got.AccessToken == initial.AccessToken {
+		t.Fatalf("Token() returned %+v along with the error, want the refreshed token", got)
+	}
+	if again, err := src.Token(context.Background()); err != nil || again != got {
+		t.Errorf("the next Token() = %+v, %v, want the kept token", again, err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != 1 {
+		t.Errorf("%d refreshes were made, want 1", n)
+	}
+}
+
+func TestLoadOrAuthorize(t *testing.T) {
+	tests := []struct {
+		name string
+		// stored returns the token to store before calling LoadOrAuthorize. The store is left empty if it is nil.
+		stored     func(srv *traktdeviceauthtest.Server) traktdeviceauth.TokenResponse
+		refreshes  int
+		authorizes bool
+		// keeps is set if the stored token is expected back as it is.
+		keeps bool
+	}{
+		{name: "empty store", authorizes: true},
+		{name: "valid token", keeps: true, stored: func(srv *traktdeviceauthtest.Server) traktdeviceauth.TokenResponse {
+			return expiringToken(srv, time.Hour)
+		}},
+		{name: "expiring token", refreshes: 1, stored: func(srv *traktdeviceauthtest.Server) traktdeviceauth.TokenResponse {
+			return expiringToken(srv, time.Minute)
+		}},
+		{name: "rejected refresh token", refreshes: 1, authorizes: true, stored: func(srv *traktdeviceauthtest.Server) traktdeviceauth.TokenResponse {
+			return traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "revoked", ExpiresAt: time.Now().Add(-time.Minute)}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			srv.Script(traktdeviceauthtest.ApproveAfterPolls(1))
+			ctx := context.Background()
+
+			dir := t.TempDir()
+			store := traktdeviceauth.NewFileTokenStore(filepath.Join(dir, "token.json"))
+			var stored traktdeviceauth.TokenResponse
+			if tt.stored != nil {
+				stored = tt.stored(srv)
+				if err := store.Save(ctx, stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var displayed int
+			cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+			got, err := traktdeviceauth.LoadOrAuthorize(ctx, store, cl, func(traktdeviceauth.CodeResponse) { displayed++ })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := 0
+			if tt.authorizes {
+				want = 1
+			}
+			if displayed != want {
+				t.Errorf("the code was displayed %d times, want %d", displayed, want)
+			}
+			if n := len(srv.RequestsTo(traktdeviceauth.EndpointToken)); n != tt.refreshes {
+				t.Errorf("%d refreshes were made, want %d", n, tt.refreshes)
+			}
+			if got.AccessToken == "" || (got.AccessToken == stored.AccessToken) != tt.keeps {
+				t.Errorf("LoadOrAuthorize returned %+v for the stored %+v", got, stored)
+			}
+			if saved, err := store.Load(ctx); err != nil || saved.AccessToken != got.AccessToken {
+				t.Errorf("the store holds %+v (%v), want the returned token", saved, err)
+			}
+			// Tokens are saved by writing a temporary file, syncing it and renaming it over the token file, which
+			// leaves nothing else behind.
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if name := e.Name(); name != "token.json" && name != "token.json.lock" {
+					t.Errorf("%s was left next to the token file", name)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadOrAuthorizeErrors(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	display := func(traktdeviceauth.CodeResponse) {}
+
+	// A store which can't be read fails without starting the device flow.
+	errLoad := errors.New("connection refused")
+	if _, err := traktdeviceauth.LoadOrAuthorize(ctx, loadErrorStore{errLoad}, cl, display); !errors.Is(err, errLoad) {
+		t.Errorf("LoadOrAuthorize returned %v, want the error of Load", err)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 0 {
+		t.Errorf("%d codes were generated after Load failed", n)
+	}
+
+	// An obtained token which couldn't be saved is returned along with the error.
+	errSave := errors.New("disk full")
+	got, err := traktdeviceauth.LoadOrAuthorize(ctx, failingSaveStore{traktdeviceauthtest.NewMemoryStore(), errSave}, cl, display)
+	if !errors.Is(err, errSave) || got.AccessToken == "" {
+		t.Errorf("LoadOrAuthorize returned %+v, %v, want the token and the error of Save", got, err)
+	}
+
+	// A denied code ends it.
+	srv.Script(traktdeviceauthtest.DenyAfterPolls(0))
+	if _, err := traktdeviceauth.LoadOrAuthorize(ctx, traktdeviceauthtest.NewMemoryStore(), cl, display); !errors.Is(err, traktdeviceauth.ErrDeviceCodeDenied) {
+		t.Errorf("LoadOrAuthorize returned %v, want ErrDeviceCodeDenied", err)
+	}
+}
+
+// loadErrorStore is a TokenStore whose Load always fails with err.
+type loadErrorStore struct {
+	err error
+}
+
+func (s loadErrorStore) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error { return nil }
+func (s loadErrorStore) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	return traktdeviceauth.TokenResponse{}, s.err
+}
@@ -0,0 +1,183 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrNoStoredToken is returned by TokenStore.Load when no token has been saved yet.
+var ErrNoStoredToken error = errors.New("no token has been stored")
+
+// TokenStore persists a single token between runs of a program.
+//
+// Load must return an error wrapping ErrNoStoredToken if nothing has been saved, and otherwise the token passed
+// to the most recent successful Save. Both methods must be safe for concurrent use. The conformance suite in
+// traktdeviceauthtest checks these rules for custom implementations.
+type TokenStore interface {
+	Save(ctx context.Context, t TokenResponse) error
+	Load(ctx context.Context) (TokenResponse, error)
+}
+
+// NamedStore persists several tokens under a name each, such as one per Trakt account or per environment.
+// The rules for TokenStore apply to every name separately.
+type NamedStore interface {
+	SaveNamed(ctx context.Context, name string, t TokenResponse) error
+	LoadNamed(ctx context.Context, name string) (TokenResponse, error)
+}
+
+// Named returns a TokenStore which saves and loads the token called name in s.
+func Named(s NamedStore, name string) TokenStore {
+	return namedStore{s: s, name: name}
+}
+
+type namedStore struct {
+	s    NamedStore
+	name string
+}
+
+func (n namedStore) Save(ctx context.Context, t TokenResponse) error {
+	return n.s.SaveNamed(ctx, n.name, t)
+}
+
+func (n namedStore) Load(ctx context.Context) (TokenResponse, error) {
+	return n.s.LoadNamed(ctx, n.name)
+}
+
+// StoredToken is the JSON representation of a TokenResponse used by SaveToFile and the TokenStores in this
+// module. Its field names are stable, and its times are encoded as RFC 3339 strings.
+//
+// The JSON carries a format version, StoredTokenVersion, so that documents written in earlier formats are
+// migrated when decoded and documents in newer formats are rejected with a *FormatVersionError. Every store
+// encoding StoredToken shares this versioning.
+type StoredToken struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token"`
+	Scope        string    `json:"scope"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+
+	// RefreshTokenIssuedAt was added in format version 2. Older documents are migrated with CreatedAt.
+	RefreshTokenIssuedAt time.Time `json:"refresh_token_issued_at"`
+
+	// Rotation was added in format version 3. It is only set by a RotatingStore, and is omitted otherwise.
+	Rotation *StoredRotation `json:"rotation,omitempty"`
+}
+
+// StoredRotation is the part of a StoredToken which a RotatingStore uses to order rotations. See RotatedToken.
+type StoredRotation struct {
+	Generation          int64     `json:"generation"`
+	PreviousAccessToken string    `json:"previous_access_token,omitempty"`
+	PreviousValidUntil  time.Time `json:"previous_valid_until"`
+}
+
+// NewStoredToken converts t into its stored representation.
+func NewStoredToken(t TokenResponse) StoredToken {
+	return StoredToken{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: t.RefreshToken,
+		Scope:        t.Scope,
+		CreatedAt:    t.CreatedAt,
+		ExpiresAt:    t.ExpiresAt,
+
+		RefreshTokenIssuedAt: t.RefreshTokenIssuedAt,
+	}
+}
+
+// TokenResponse converts s back into a TokenResponse.
+func (s StoredToken) TokenResponse() TokenResponse {
+	return TokenResponse{
+		AccessToken:  s.AccessToken,
+		TokenType:    s.TokenType,
+		RefreshToken: s.RefreshToken,
+		Scope:        s.Scope,
+		CreatedAt:    s.CreatedAt,
+		ExpiresAt:    s.ExpiresAt,
+
+		RefreshTokenIssuedAt: s.RefreshTokenIssuedAt,
+	}
+}
+
+// FileTokenStore is a TokenStore which keeps the token in a file, using SaveToFile and LoadTokenFromFile.
+//
+// Stores for the same file, in this process or others, coordinate through an advisory lock on a file next to
+// it, named like the token file with .lock appended. Save and Load hold the lock while they run, and Update
+// holds it across loading, changing and saving the token, so that two programs refreshing the same token
+// can't undo each other's rotation of the refresh token. The lock is taken with flock on Unix and LockFileEx
+// on Windows. Other platforms don't lock the file.
+type FileTokenStore struct {
+	path        string
+	opts        []FileOption
+	lockTimeout time.Duration
+	codec       Codec
+}
+
+// NewFileTokenStore returns a FileTokenStore for the file at path. opts are used when loading the file,
+// WithLockTimeout sets how long to wait for the lock, and WithFileCodec is used for saving it too.
+func NewFileTokenStore(path string, opts ...FileOption) *FileTokenStore {
+	c := fileConfig{lockTimeout: DefaultLockTimeout}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &FileTokenStore{path: path, opts: opts, lockTimeout: c.lockTimeout, codec: c.codec}
+}
+
+// Save implements TokenStore. The file is replaced atomically and synced to disk, so a crash can't leave it
+// half-written or lose a token which was saved.
+func (s *FileTokenStore) Save(ctx context.Context, t TokenResponse) error {
+	unlock, err := lockTokenFile(ctx, s.path, true, s.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("FileTokenStore.Save: %w", err)
+	}
+	defer unlock()
+
+	return t.saveToFile(s.path, s.codec)
+}
+
+// Load implements TokenStore. A missing file is reported as ErrNoStoredToken.
+func (s *FileTokenStore) Load(ctx context.Context) (TokenResponse, error) {
+	unlock, err := lockTokenFile(ctx, s.path, false, s.lockTimeout)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("FileTokenStore.Load: %w", err)
+	}
+	defer unlock()
+
+	return s.load()
+}
+
+// Update replaces the stored token with the one returned by fn, which is passed the stored token, or the zero
+// TokenResponse if none has been saved yet. No other FileTokenStore can save or load the file until Update
+// returns. If fn returns an error, the file is left alone and the error is returned.
+//
+// Update is meant for refreshing a token shared by several programs: fn can check whether someone else has
+// already refreshed it before refreshing it itself.
+func (s *FileTokenStore) Update(ctx context.Context, fn func(TokenResponse) (TokenResponse, error)) error {
+	unlock, err := lockTokenFile(ctx, s.path, true, s.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("FileTokenStore.Update: %w", err)
+	}
+	defer unlock()
+
+	t, err := s.load()
+	if err != nil && !errors.Is(err, ErrNoStoredToken) {
+		return fmt.Errorf("FileTokenStore.Update: %w", err)
+	}
+	t, err = fn(t)
+	if err != nil {
+		return fmt.Errorf("FileTokenStore.Update: %w", err)
+	}
+	return t.saveToFile(s.path, s.codec)
+}
+
+// load reads the token file without locking it.
+func (s *FileTokenStore) load() (TokenResponse, error) {
+	t, err := LoadTokenFromFile(s.path, s.opts...)
+	if errors.Is(err, os.ErrNotExist) {
+		return TokenResponse{}, fmt.Errorf("LoadTokenFromFile: %s: %w", s.path, ErrNoStoredToken)
+	}
+	return t, err
+}
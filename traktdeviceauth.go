@@ -1,236 +1,380 @@
 package traktdeviceauth
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// invalidGrantText is moved out of the var block to make the line lengths somewhat sane.
-const invalidGrantText string = "the provided authorization grant is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client"
-
-var (
-	ErrDeviceCodeUnclaimed       error = errors.New("the user has not yet claimed the device code")                            // 400
-	ErrInvalidGrant              error = errors.New(invalidGrantText)                                                          // 401
-	ErrInvalidDeviceCode         error = errors.New("invalid device code")                                                     // 404
-	ErrForbidden                 error = errors.New("invalid API key or unapproved application")                               // 403
-	ErrDeviceCodeAlreadyApproved error = errors.New("device code has already been approved")                                   // 409
-	ErrDeviceCodeExpired         error = errors.New("the device code has expired, please regenerate a new one")                // 410
-	ErrDeviceCodeDenied          error = errors.New("the device code was denied by the user")                                  // 418
-	ErrPollRateTooFast           error = errors.New("the API is being polled too quickly")                                     // 429
-	ErrServerError               error = errors.New("the Trakt API is reporting an internal problem, please check back later") // 500
-	ErrServiceOverloaded         error = errors.New("the servers are overloaded, please try again in 30 seconds")              // 503, 504
-	ErrCloudflareError           error = errors.New("there is an issue with Cloudflare")                                       // 520, 521, 522
-)
-
 // TraktAPIBaseUrl is the base url for all API requests. This shouldn't
 // need to be modified unless targetting a different server, for instance
 // the staging server (https://api-staging.trakt.tv)
+//
+// It is read without synchronization, so it must not be changed while requests are being made.
+// WithBaseURL is safe to use at any time.
 var TraktAPIBaseUrl string = "https://api.trakt.tv"
 
 // GenerateNewCode wraps GenerateNewCodeContext using context.Background().
-func GenerateNewCode(clientID string) (CodeResponse, error) {
-	return GenerateNewCodeContext(context.Background(), clientID)
+func GenerateNewCode(clientID string, opts ...Option) (CodeResponse, error) {
+	return GenerateNewCodeContext(context.Background(), clientID, opts...)
 }
 
 // GenerateNewCodeContext reaches out to the Trakt API to acquire a claimable code.
-func GenerateNewCodeContext(ctx context.Context, clientID string) (CodeResponse, error) {
-	dataBuf := bytes.NewBufferString(fmt.Sprintf(`{"client_id": "%s"}`, clientID))
+// See WithCodeCache for sharing one code between concurrent callers.
+func GenerateNewCodeContext(ctx context.Context, clientID string, opts ...Option) (CodeResponse, error) {
+	return NewClient(clientID, "", opts...).GenerateNewCode(ctx)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", TraktAPIBaseUrl+"/oauth/device/code", dataBuf)
-	if err != nil {
+// GenerateNewCode reaches out to the Trakt API to acquire a claimable code, like GenerateNewCodeContext. opts
+// apply to this call only, after the Client's own.
+func (cl *Client) GenerateNewCode(ctx context.Context, opts ...Option) (CodeResponse, error) {
+	c, clientID := newConfig(cl.options(opts)), cl.clientID
+	if err := c.checkArgs("clientID", clientID); err != nil {
 		return CodeResponse{}, fmt.Errorf("GenerateNewCode: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Trakt-API-Version", "2")
-
-	resp, err := http.DefaultClient.Do(req)
+	var (
+		codeResp CodeResponse
+		err      error
+	)
+	if c.codeCache != nil {
+		codeResp, err = c.codeCache.get(ctx, c.baseURL()+" "+clientID, c.forceNewCode, func() (CodeResponse, error) {
+			return c.generateNewCode(ctx, clientID)
+		})
+	} else {
+		codeResp, err = c.generateNewCode(ctx, clientID)
+	}
 	if err != nil {
 		return CodeResponse{}, fmt.Errorf("GenerateNewCode: %w", err)
 	}
-	defer resp.Body.Close()
-
-	switch resp.StatusCode {
-	case 200: // The code has been returned, continue on to the decode stage.
-	case 403:
-		return CodeResponse{}, ErrForbidden
-	case 500:
-		return CodeResponse{}, ErrServerError
-	case 503, 504:
-		return CodeResponse{}, ErrServiceOverloaded
-	case 520, 521, 522:
-		return CodeResponse{}, ErrCloudflareError
-	default:
-		return CodeResponse{}, fmt.Errorf("RequestToken: unexpected status code '%v'", resp.StatusCode)
-	}
+	return codeResp, nil
+}
 
-	b, err := io.ReadAll(resp.Body)
+// generateNewCode requests a new device code for clientID.
+func (c config) generateNewCode(ctx context.Context, clientID string) (CodeResponse, error) {
+	b, _, err := c.post(ctx, EndpointDeviceCode, "client_id", clientID)
 	if err != nil {
-		return CodeResponse{}, fmt.Errorf("GenerateNewCode: %w", err)
+		c.recordFailure(EndpointDeviceCode, "", err)
+		return CodeResponse{}, err
 	}
+	receivedAt := time.Now()
 
 	codeResp := CodeResponse{}
-	if err = json.Unmarshal(b, &codeResp); err != nil {
-		return CodeResponse{}, fmt.Errorf("GenerateNewCode: %w", err)
+	if err = c.decode(b, &codeResp); err != nil {
+		c.recordFailure(EndpointDeviceCode, "", err)
+		return CodeResponse{}, err
 	}
 
+	codeResp.ExpiresAt = receivedAt.Add(codeResp.ExpiresInDuration())
+	expiresAt := codeResp.ExpiresAt
+	c.record(AuditEvent{Event: AuditCodeGenerated, Endpoint: EndpointDeviceCode.String(), DeviceID: DeviceCodeFingerprint(codeResp.DeviceCode), ExpiresAt: &expiresAt})
 	return codeResp, nil
 }
 
 // PollForAuthToken wraps PollForAuthTokenContext using context.Background().
-func PollForAuthToken(codeResp CodeResponse, clientID, clientSecret string) (TokenResponse, error) {
-	return PollForAuthTokenContext(context.Background(), codeResp, clientID, clientSecret)
+func PollForAuthToken(codeResp CodeResponse, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return PollForAuthTokenContext(context.Background(), codeResp, clientID, clientSecret, opts...)
 }
 
 // PollForAuthTokenContext continuously polls for the access token from a CodeResponse.
-// The passed context is truncated using context.WithDeadline to match the CodeResponse.ExpiresIn value.
-func PollForAuthTokenContext(ctx context.Context, codeResp CodeResponse, clientID, clientSecret string) (TokenResponse, error) {
-	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*time.Duration(codeResp.ExpiresIn)))
-	defer cancel()
+// The passed context is truncated using context.WithDeadline to CodeResponse.ExpiresAt, so the time which
+// passed since the code was generated is taken into account, or to ExpiresIn from now for a code without it.
+//
+// If Trakt reports that polling is too fast, the interval is increased by 5 seconds for the rest of the flow,
+// as RFC 8628 asks for slow_down errors, and the next poll waits at least as long as the Retry-After header asks.
+// If that wait would outlast the code, a *BackoffError is returned right away instead of waiting for the code
+// to expire.
+// Use DeviceAuthFlow to observe the state of the flow while it is polling.
+//
+// If the returned error is a *HookError, the code was approved and the returned token is valid.
+func PollForAuthTokenContext(ctx context.Context, codeResp CodeResponse, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return NewClient(clientID, clientSecret, opts...).PollForAuthToken(ctx, codeResp)
+}
+
+// PollForAuthToken continuously polls for the access token from a CodeResponse, like PollForAuthTokenContext.
+// opts apply to this call only, after the Client's own.
+func (cl *Client) PollForAuthToken(ctx context.Context, codeResp CodeResponse, opts ...Option) (TokenResponse, error) {
+	opts = cl.options(opts)
+	if err := newConfig(opts).checkArgs("codeResp.DeviceCode", codeResp.DeviceCode, "clientID", cl.clientID); err != nil {
+		return TokenResponse{}, fmt.Errorf("PollForAuthToken: %w", err)
+	}
 
-	for {
-		select {
-		case <-time.After(time.Second * time.Duration(codeResp.Interval)):
-			resp, err := RequestTokenContext(ctx, codeResp, clientID, clientSecret)
-			if err == nil {
-				return resp, nil
+	f := resumeDeviceAuthFlow(codeResp, time.Now(), cl.credentialsOnly(), opts)
+	if stats := newConfig(opts).pollStats; stats != nil {
+		defer func() {
+			*stats = f.Stats()
+			if stats.FinishedAt.IsZero() {
+				// The flow is left running when ctx ends first, but as far as the caller is concerned it is over.
+				stats.FinishedAt = time.Now()
 			}
+		}()
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, f.ExpiresAt())
+	defer cancel()
 
-			if !errors.Is(err, ErrDeviceCodeUnclaimed) {
-				return TokenResponse{}, fmt.Errorf("PollForAuthToken: %w", err)
+	t, err := f.Wait(ctx)
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		return t, fmt.Errorf("PollForAuthToken: %w", err)
+	}
+	if err != nil {
+		// Wait gives up early with a bare context.DeadlineExceeded when the next poll would come too late.
+		// If the deadline is the code's own expiry, the code can't be approved anymore.
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			if deadline, _ := ctx.Deadline(); deadline.Equal(f.ExpiresAt()) {
+				newConfig(opts).recordFailure(EndpointDeviceToken, codeResp.DeviceCode, ErrDeviceCodeExpired)
+				return TokenResponse{}, fmt.Errorf("PollForAuthToken: the next poll is due after the code expires: %w", ErrDeviceCodeExpired)
 			}
-		case <-ctx.Done():
-			return TokenResponse{}, errors.New("PollForAuthToken: could not retrieve auth token, exceeded context")
 		}
+		if ctxErr := ctx.Err(); ctxErr != nil || err == context.DeadlineExceeded {
+			if ctxErr == nil {
+				ctxErr = err
+			}
+			newConfig(opts).recordFailure(EndpointDeviceToken, codeResp.DeviceCode, ctxErr)
+			return TokenResponse{}, fmt.Errorf("PollForAuthToken: could not retrieve auth token, exceeded context: %w", ctxErr)
+		}
+		return TokenResponse{}, fmt.Errorf("PollForAuthToken: %w", err)
 	}
+
+	return t, nil
 }
 
 // RequestToken wraps RequestTokenContext using context.Background().
-func RequestToken(codeResp CodeResponse, clientID, clientSecret string) (TokenResponse, error) {
-	return RequestTokenContext(context.Background(), codeResp, clientID, clientSecret)
+func RequestToken(codeResp CodeResponse, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return RequestTokenContext(context.Background(), codeResp, clientID, clientSecret, opts...)
 }
 
 // RequestTokenContext determines returns a TokenResponse if the provided code has been claimed by the user.
 // If it has not, or there is another error, it will RequestTokenContext returns a customized error value
 // which details the issue.
 //
+// If the returned error is a *HookError, the code was approved and the returned token is valid.
+// clientSecret may be empty for public clients, which have none.
+//
 // This function is provided as a convenience, but it is recommended to use PollForAuthToken unless you have
 // a very specific use case for this function.
-func RequestTokenContext(ctx context.Context, codeResp CodeResponse, clientID, clientSecret string) (TokenResponse, error) {
-	dataBuf := bytes.NewBufferString(fmt.Sprintf(`{"code": "%s", "client_id": "%s", "client_secret": "%s"}`, codeResp.DeviceCode, clientID, clientSecret))
+func RequestTokenContext(ctx context.Context, codeResp CodeResponse, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return NewClient(clientID, clientSecret, opts...).RequestToken(ctx, codeResp)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", TraktAPIBaseUrl+"/oauth/device/token", dataBuf)
-	if err != nil {
+// RequestToken returns a TokenResponse if the provided code has been claimed by the user, like
+// RequestTokenContext. opts apply to this call only, after the Client's own.
+func (cl *Client) RequestToken(ctx context.Context, codeResp CodeResponse, opts ...Option) (TokenResponse, error) {
+	c, clientID, clientSecret := newConfig(cl.options(opts)), cl.clientID, cl.clientSecret
+	if err := c.checkArgs("codeResp.DeviceCode", codeResp.DeviceCode, "clientID", clientID); err != nil {
 		return TokenResponse{}, fmt.Errorf("RequestToken: %w", err)
 	}
+	endPoll := func() {}
+	if c.codeCache != nil {
+		// Another caller sharing the code may already have been given the token.
+		if t, ok := c.codeCache.token(codeResp.DeviceCode); ok {
+			return t, nil
+		}
+		endPoll = c.codeCache.beginPoll(codeResp.DeviceCode)
+		defer endPoll()
+	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Trakt-API-Version", "2")
-
-	resp, err := http.DefaultClient.Do(req)
+	c.count(expvarPollAttempts)
+	fields := append([]string{"code", codeResp.DeviceCode}, c.authenticate(clientID, clientSecret)...)
+	b, header, err := c.post(ctx, EndpointDeviceToken, fields...)
+	if err != nil && c.codeCache != nil {
+		if errors.Is(err, ErrDeviceCodeAlreadyApproved) {
+			// The request which was approved may still be on its way back to another caller.
+			endPoll()
+			if t, ok := c.codeCache.settledToken(ctx, codeResp.DeviceCode); ok {
+				return t, nil
+			}
+		}
+		if errors.Is(err, ErrDeviceCodeDenied) || errors.Is(err, ErrDeviceCodeExpired) || errors.Is(err, ErrInvalidDeviceCode) ||
+			errors.Is(err, ErrDeviceCodeAlreadyApproved) {
+			// The code can't be approved anymore, so it mustn't be handed out again.
+			c.codeCache.forget(codeResp.DeviceCode)
+		}
+	}
 	if err != nil {
+		// Unclaimed codes are expected while polling and would drown out everything else in the audit log.
+		if !errors.Is(err, ErrDeviceCodeUnclaimed) {
+			c.recordFailure(EndpointDeviceToken, codeResp.DeviceCode, err)
+		}
 		return TokenResponse{}, fmt.Errorf("RequestToken: %w", err)
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case 200: // The access token has been returned, continue on to the decode stage.
-	case 400:
-		return TokenResponse{}, ErrDeviceCodeUnclaimed
-	case 403:
-		return TokenResponse{}, ErrForbidden
-	case 404:
-		return TokenResponse{}, ErrInvalidDeviceCode
-	case 409:
-		return TokenResponse{}, ErrDeviceCodeAlreadyApproved
-	case 410:
-		return TokenResponse{}, ErrDeviceCodeExpired
-	case 418:
-		return TokenResponse{}, ErrDeviceCodeDenied
-	case 429:
-		return TokenResponse{}, ErrPollRateTooFast
-	case 500:
-		return TokenResponse{}, ErrServerError
-	case 503, 504:
-		return TokenResponse{}, ErrServiceOverloaded
-	case 520, 521, 522:
-		return TokenResponse{}, ErrCloudflareError
-	default:
-		return TokenResponse{}, fmt.Errorf("RequestToken: unexpected status code '%v'", resp.StatusCode)
+	respStruct := internalTokenResponse{}
+	err = c.decode(b, &respStruct)
+	if err == nil {
+		err = c.checkTokenResponse(respStruct, b)
 	}
-
-	b, err := io.ReadAll(resp.Body)
+	wipeBytes(b)
 	if err != nil {
+		c.recordFailure(EndpointDeviceToken, codeResp.DeviceCode, err)
 		return TokenResponse{}, fmt.Errorf("RequestToken: %w", err)
 	}
 
-	respStruct := internalTokenResponse{}
-	if err = json.Unmarshal(b, &respStruct); err != nil {
-		return TokenResponse{}, fmt.Errorf("RequestToken: %w", err)
+	t := transformInternalTokenResponse(respStruct)
+	c.measureSkew(&t, header)
+	c.record(AuditEvent{Event: AuditTokenObtained, Endpoint: EndpointDeviceToken.String(), DeviceID: DeviceCodeFingerprint(codeResp.DeviceCode), Scope: t.Scope, ExpiresAt: &t.ExpiresAt})
+	if c.codeCache != nil {
+		c.codeCache.approve(codeResp.DeviceCode, t)
 	}
 
-	return transformInternalTokenResponse(respStruct), nil
+	if err := c.saveToken(ctx, t); err != nil {
+		return t, fmt.Errorf("RequestToken: %w", err)
+	}
+	return t, nil
 }
 
 // RefreshAccessToken wraps RefreshAccessTokenContext with a context.Background() struct.
 // Please refer to RefreshAccessTokenContext for documentation.
-func RefreshAccessToken(refreshToken, clientID, clientSecret string) (TokenResponse, error) {
-	return RefreshAccessTokenContext(context.Background(), refreshToken, clientID, clientSecret)
+func RefreshAccessToken(refreshToken, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return RefreshAccessTokenContext(context.Background(), refreshToken, clientID, clientSecret, opts...)
 }
 
 // RefreshAccessTokenContext takes the refresh token from a previous TokenResponse and creates a new one.
 // This should only be used when an AccessToken expires (after about 3 months according to Trakt).
-func RefreshAccessTokenContext(ctx context.Context, refreshToken, clientID, clientSecret string) (TokenResponse, error) {
+//
+// Trakt revokes the refresh token that was used, so the new token must be stored before the old one is discarded.
+// See WithOnTokenRotated. If the returned error is a *HookError, the returned token is still valid.
+// clientSecret may be empty for public clients, which have none.
+func RefreshAccessTokenContext(ctx context.Context, refreshToken, clientID, clientSecret string, opts ...Option) (TokenResponse, error) {
+	return NewClient(clientID, clientSecret, opts...).RefreshAccessToken(ctx, refreshToken)
+}
+
+// RefreshAccessToken takes the refresh token from a previous TokenResponse and creates a new one, like
+// RefreshAccessTokenContext. opts apply to this call only, after the Client's own.
+func (cl *Client) RefreshAccessToken(ctx context.Context, refreshToken string, opts ...Option) (TokenResponse, error) {
 	//! I have no clue if the redirect_uri I am passing in here is a good value for all requests. It may need to be moved to a function paramater.
-	dataBuf := bytes.NewBufferString(fmt.Sprintf(`{"refresh_token": "%s", "client_id": "%s", "client_secret": "%s", "redirect_uri": "urn:ietf:wg:oauth:2.0:oob", "grant_type": "refresh_token"}`, refreshToken, clientID, clientSecret))
+	c, clientID, clientSecret := newConfig(cl.options(opts)), cl.clientID, cl.clientSecret
+	if err := c.checkArgs("refreshToken", refreshToken, "clientID", clientID); err != nil {
+		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", TraktAPIBaseUrl+"/oauth/token", dataBuf)
+	fields := append([]string{"refresh_token", refreshToken}, c.authenticate(clientID, clientSecret)...)
+	b, header, err := c.post(ctx, EndpointToken, append(fields,
+		"redirect_uri", "urn:ietf:wg:oauth:2.0:oob",
+		"grant_type", "refresh_token",
+	)...)
 	if err != nil {
+		c.recordFailure(EndpointToken, "", err)
 		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	respStruct := internalTokenResponse{}
+	err = c.decode(b, &respStruct)
+	if err == nil {
+		err = c.checkTokenResponse(respStruct, b)
+	}
+	wipeBytes(b)
+	if err != nil {
+		c.recordFailure(EndpointToken, "", err)
+		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
+	}
+
+	t := transformInternalTokenResponse(respStruct)
+	c.measureSkew(&t, header)
+	c.record(AuditEvent{Event: AuditTokenRefreshed, Endpoint: EndpointToken.String(), Scope: t.Scope, ExpiresAt: &t.ExpiresAt})
+
+	if c.onTokenRotated != nil && t.RefreshToken != refreshToken {
+		err := catchPanic("WithOnTokenRotated", func() error {
+			return c.onTokenRotated(TokenResponse{RefreshToken: refreshToken}, t)
+		})
+		if err != nil {
+			return t, fmt.Errorf("RefreshToken: %w", &HookError{Hook: "WithOnTokenRotated", Err: err})
+		}
+	}
+	if err := c.saveToken(ctx, t); err != nil {
+		return t, fmt.Errorf("RefreshToken: %w", err)
+	}
+	return t, nil
+}
+
+// post sends fields, along with the client secret set by authenticate and any params from WithExtraParams, to
+// endpoint as a JSON object and returns the response body and headers. fields alternate between keys and values.
+// The request body is built in a pooled buffer which is wiped once it has been sent.
+func (c config) post(ctx context.Context, endpoint Endpoint, fields ...string) ([]byte, http.Header, error) {
+	u, err := c.endpointURL(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields = c.withExtraParams(fields)
+	return c.send(ctx, endpoint, func(ctx context.Context) (*http.Request, error) {
+		body := newRequestBody(fields, c.bodySecret)
+		req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+
+		req.ContentLength = body.Len()
+		req.Header.Set("Content-Type", "application/json")
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		return req, nil
+	})
+}
+
+// do sends req to endpoint with the headers Trakt expects and returns the response body and headers.
+// Non-success status codes are converted into errors using the configured ErrorMapper and StatusToError.
+func (c config) do(endpoint Endpoint, req *http.Request) ([]byte, http.Header, error) {
 	req.Header.Set("Trakt-API-Version", "2")
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.roundTripper()(req)
 	if err != nil {
-		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case 200: // The access token has been returned, continue on to the decode stage.
-	case 401:
-		return TokenResponse{}, ErrInvalidGrant
-	case 403:
-		return TokenResponse{}, ErrForbidden
-	case 500:
-		return TokenResponse{}, ErrServerError
-	case 503, 504:
-		return TokenResponse{}, ErrServiceOverloaded
-	case 520, 521, 522:
-		return TokenResponse{}, ErrCloudflareError
-	default:
-		return TokenResponse{}, fmt.Errorf("RefreshToken: unexpected status code '%v'", resp.StatusCode)
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
+	if c.errorMapper != nil {
+		err := catchPanic("WithErrorMapper", func() error { return c.errorMapper(endpoint, resp.StatusCode, b) })
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	respStruct := internalTokenResponse{}
-	if err = json.Unmarshal(b, &respStruct); err != nil {
-		return TokenResponse{}, fmt.Errorf("RefreshToken: %w", err)
+	if err := StatusToError(endpoint, resp.StatusCode); err != nil {
+		if errors.Is(err, ErrPollRateTooFast) {
+			return nil, nil, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		}
+		return nil, nil, &StatusError{Status: resp.StatusCode, Err: err}
 	}
 
-	return transformInternalTokenResponse(respStruct), nil
+	return b, resp.Header, nil
+}
+
+// sleepContext waits for d, or returns ctx's error as soon as ctx ends. If ctx's deadline comes before d has
+// passed, waiting would only end in failure, so context.DeadlineExceeded is returned right away instead.
+// Every wait in this package goes through it.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // transformInternalTokenResponse takes an internalTokenResponse and turns it into
@@ -241,11 +385,130 @@ func transformInternalTokenResponse(internal internalTokenResponse) (t TokenResp
 	t.TokenType = internal.TokenType
 	t.RefreshToken = internal.RefreshToken
 	t.Scope = internal.Scope
-	t.CreatedAt = time.Unix(int64(internal.CreatedAt), 0)
+	t.CreatedAt = time.Unix(internal.CreatedAt, 0)
 	t.ExpiresAt = t.CreatedAt.Add(time.Second * time.Duration(internal.ExpiresIn))
+	t.RefreshTokenIssuedAt = t.CreatedAt
 	return
 }
 
+// Bounds for the created_at of a token response. Anything outside of them is more likely to be garbage, or
+// milliseconds instead of seconds, than a clock which is that far off.
+var (
+	minPlausibleCreatedAt = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()
+	maxPlausibleCreatedAt = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()
+)
+
+// checkTokenResponse returns a *MalformedResponseError if the token response r, decoded from body, is missing
+// fields a usable token needs.
+func (c config) checkTokenResponse(r internalTokenResponse, body []byte) error {
+	field, problem := "", "is missing"
+	switch {
+	case r.AccessToken == "":
+		field = "access_token"
+	case r.TokenType == "":
+		field = "token_type"
+	case r.RefreshToken == "" && !c.optionalRefreshToken:
+		field = "refresh_token"
+	case r.CreatedAt == 0:
+		field = "created_at"
+	case r.CreatedAt < minPlausibleCreatedAt || r.CreatedAt > maxPlausibleCreatedAt:
+		field, problem = "created_at", fmt.Sprintf("is implausible (%d)", r.CreatedAt)
+	default:
+		return nil
+	}
+	return &MalformedResponseError{Field: field, Problem: problem, Body: c.redactedBody(body)}
+}
+
+// redactedBody returns the JSON token response body with the values of its tokens replaced, shortened to
+// a length which is fine for error messages and logs.
+func (c config) redactedBody(body []byte) string {
+	const maxLen = 256
+
+	codec := codecOrDefault(c.codec)
+	var doc map[string]interface{}
+	if err := codec.Unmarshal(body, &doc); err != nil {
+		return fmt.Sprintf("a body of %d bytes", len(body))
+	}
+	for k, v := range doc {
+		if s, ok := v.(string); ok && s != "" && strings.HasSuffix(k, "_token") {
+			doc[k] = "[redacted]"
+		}
+	}
+
+	b, err := codec.Marshal(doc)
+	if err != nil {
+		return fmt.Sprintf("a body of %d bytes", len(body))
+	}
+	if len(b) > maxLen {
+		return string(b[:maxLen]) + "…"
+	}
+	return string(b)
+}
+
+// Expired reports whether the access token has expired, which it has from ExpiresAt on. A token without
+// ExpiresAt counts as expired, since there is no telling whether Trakt still accepts it.
+func (t TokenResponse) Expired() bool {
+	return t.ExpiresWithin(0)
+}
+
+// ExpiresWithin reports whether the access token expires within d from now, or already has, so that it can be
+// refreshed ahead of time, such as with ExpiresWithin(24*time.Hour). Like Expired, it is true for a token without
+// ExpiresAt.
+func (t TokenResponse) ExpiresWithin(d time.Duration) bool {
+	if t.ExpiresAt.IsZero() {
+		return true
+	}
+	return !time.Now().Add(d).Before(t.ExpiresAt)
+}
+
+// TimeUntilExpiry returns how long the access token stays valid, which is negative once it has expired, and
+// zero for a token without ExpiresAt.
+func (t TokenResponse) TimeUntilExpiry() time.Duration {
+	if t.ExpiresAt.IsZero() {
+		return 0
+	}
+	return time.Until(t.ExpiresAt)
+}
+
+// Valid reports whether t holds an access token which hasn't expired.
+func (t TokenResponse) Valid() bool {
+	return t.AccessToken != "" && !t.Expired()
+}
+
+// RefreshTokenAge returns how long ago RefreshToken was issued. Trakt rotates the refresh token on every
+// refresh, but one which goes unused for very long can stop working, so an old refresh token is a sign that
+// the user may soon have to authorize the app again. Tokens without RefreshTokenIssuedAt, such as ones built
+// by hand, fall back to CreatedAt, and the age is zero if both are missing.
+func (t TokenResponse) RefreshTokenAge() time.Duration {
+	return t.refreshTokenAgeAt(time.Now())
+}
+
+// refreshTokenAgeAt returns the age of RefreshToken at now. See RefreshTokenAge.
+func (t TokenResponse) refreshTokenAgeAt(now time.Time) time.Duration {
+	issuedAt := t.refreshTokenIssuedAt()
+	if issuedAt.IsZero() {
+		return 0
+	}
+	return now.Sub(issuedAt)
+}
+
+// refreshTokenIssuedAt returns RefreshTokenIssuedAt, or CreatedAt if it isn't set.
+func (t TokenResponse) refreshTokenIssuedAt() time.Time {
+	if t.RefreshTokenIssuedAt.IsZero() {
+		return t.CreatedAt
+	}
+	return t.RefreshTokenIssuedAt
+}
+
+// keepRefreshTokenIssuedAt returns t, a refresh of old, with the issuance time of old's refresh token if the
+// refresh didn't rotate it.
+func (t TokenResponse) keepRefreshTokenIssuedAt(old TokenResponse) TokenResponse {
+	if issuedAt := old.refreshTokenIssuedAt(); t.RefreshToken == old.RefreshToken && !issuedAt.IsZero() {
+		t.RefreshTokenIssuedAt = issuedAt
+	}
+	return t
+}
+
 // CodeResponse is used to contain the results of GenerateNewCode.
 // The user should be directed to VerificationURL and instructed to enter
 // UserCode into the box presented.
@@ -254,29 +517,93 @@ type CodeResponse struct {
 	DeviceCode      string `json:"device_code"`
 	UserCode        string `json:"user_code"`
 	VerificationURL string `json:"verification_url"`
-	ExpiresIn       int    `json:"expires_in"` // How long the code will last in seconds
-	Interval        int    `json:"interval"`   // The interval in seconds that the application is allowed to poll at
+	ExpiresIn       int    `json:"expires_in"` // How long the code will last in seconds. See ExpiresInDuration.
+	Interval        int    `json:"interval"`   // The interval in seconds that the application is allowed to poll at. See IntervalDuration.
+
+	// ExpiresAt is when the code expires, measured from when Trakt's response was received, since ExpiresIn
+	// only counts from then. It is set by GenerateNewCode, and is zero for codes built by hand.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DefaultPollInterval is the polling interval used for a CodeResponse without one, as RFC 8628 prescribes.
+const DefaultPollInterval = 5 * time.Second
+
+// IntervalDuration returns Interval as a time.Duration. An Interval which is missing, zero or negative is
+// replaced with DefaultPollInterval, so a loop waiting for it never spins.
+func (c CodeResponse) IntervalDuration() time.Duration {
+	if c.Interval <= 0 {
+		return DefaultPollInterval
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// IsExpired reports whether the code has expired, after which it can't be approved anymore.
+func (c CodeResponse) IsExpired() bool {
+	return c.Remaining() <= 0
+}
+
+// Remaining returns how long the code has left before it expires, or zero if it already has, for showing a
+// countdown to the user. A code without ExpiresAt is assumed to have just been generated.
+func (c CodeResponse) Remaining() time.Duration {
+	if c.ExpiresAt.IsZero() {
+		return c.ExpiresInDuration()
+	}
+	if d := time.Until(c.ExpiresAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// expiresAt returns ExpiresAt, or if it isn't set, when the code expires if it was generated at issuedAt.
+func (c CodeResponse) expiresAt(issuedAt time.Time) time.Time {
+	if c.ExpiresAt.IsZero() {
+		return issuedAt.Add(c.ExpiresInDuration())
+	}
+	return c.ExpiresAt
+}
+
+// ExpiresInDuration returns ExpiresIn as a time.Duration. A negative ExpiresIn is treated as zero, meaning the
+// code has already expired.
+func (c CodeResponse) ExpiresInDuration() time.Duration {
+	if c.ExpiresIn <= 0 {
+		return 0
+	}
+	return time.Duration(c.ExpiresIn) * time.Second
 }
 
 // TokenResponse contains the results of RequestToken.
 // This data should persist between restarts unless you want to
 // prompt the user to authorize your app on every launch.
+//
+// Its JSON encoding uses the field names of StoredToken, with times as RFC 3339 strings, and it can be decoded
+// from anything StoredToken can, including the raw token response of Trakt. SaveToFile and the TokenStores
+// write StoredToken, which also carries a format version.
 type TokenResponse struct {
-	AccessToken  string
-	TokenType    string
-	ExpiresAt    time.Time
-	RefreshToken string
-	Scope        string
-	CreatedAt    time.Time
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	Scope        string    `json:"scope"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// RefreshTokenIssuedAt is when RefreshToken was issued, which is CreatedAt unless a refresh kept the
+	// refresh token of the token it refreshed. See RefreshTokenAge.
+	RefreshTokenIssuedAt time.Time `json:"refresh_token_issued_at"`
+
+	// ClockSkew is how far the server's clock was ahead of the local clock when the token was issued,
+	// measured from the Date header of the response. It is zero if the header was missing or invalid.
+	// See WithClockSkewCompensation.
+	ClockSkew time.Duration `json:"clock_skew,omitempty"`
 }
 
 // The internalTokenResponse struct directly maps to the output from the Trakt API.
 // It gets converted to TokenResponse to be return to the user.
+// The numeric fields are int64 so that they can't overflow while decoding on 32-bit platforms.
 type internalTokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	TokenType    string `json:"token_type"`
-	ExpiresIn    int    `json:"expires_in"`
+	ExpiresIn    int64  `json:"expires_in"`
 	RefreshToken string `json:"refresh_token"`
 	Scope        string `json:"scope"`
-	CreatedAt    int    `json:"created_at"` // The seconds since the epoch when the token was created (GMT).
+	CreatedAt    int64  `json:"created_at"` // The seconds since the epoch when the token was created (GMT).
 }
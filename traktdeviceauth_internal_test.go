@@ -0,0 +1,71 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// The wire fields must stay 64-bit on every platform. This fails to compile if they become int again.
+var (
+	_ int64 = internalTokenResponse{}.CreatedAt
+	_ int64 = internalTokenResponse{}.ExpiresIn
+)
+
+func TestDecodeTokenResponseAfter2038(t *testing.T) {
+	// 2040-01-01 doesn't fit in 32 bits, so it would overflow an int on 386 and arm.
+	const createdAt int64 = 2208988800
+	body := []byte(`{"access_token":"access","token_type":"bearer","expires_in":7776000,"refresh_token":"refresh","scope":"public","created_at":2208988800}`)
+
+	var internal internalTokenResponse
+	if err := json.Unmarshal(body, &internal); err != nil {
+		t.Fatal(err)
+	}
+	if internal.CreatedAt != createdAt {
+		t.Fatalf("created_at decoded to %d, want %d", internal.CreatedAt, createdAt)
+	}
+	if err := (config{}).checkTokenResponse(internal, body); err != nil {
+		t.Fatalf("the response was rejected: %v", err)
+	}
+
+	tok := transformInternalTokenResponse(internal)
+	if want := time.Date(2040, time.January, 1, 0, 0, 0, 0, time.UTC); !tok.CreatedAt.Equal(want) {
+		t.Errorf("CreatedAt = %v, want %v", tok.CreatedAt, want)
+	}
+	if want := time.Date(2040, time.March, 31, 0, 0, 0, 0, time.UTC); !tok.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", tok.ExpiresAt, want)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	background := context.Background()
+	cancelled, cancel := context.WithCancel(background)
+	cancel()
+	short, cancelShort := context.WithTimeout(background, time.Second)
+	defer cancelShort()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		d    time.Duration
+		want error
+	}{
+		{"no deadline", background, time.Millisecond, nil},
+		{"zero", background, 0, nil},
+		{"negative", background, -time.Second, nil},
+		{"within the deadline", short, time.Millisecond, nil},
+		{"past the deadline", short, time.Hour, context.DeadlineExceeded},
+		{"cancelled", cancelled, time.Hour, context.Canceled},
+		{"cancelled with zero", cancelled, 0, context.Canceled},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		if err := sleepContext(tt.ctx, tt.d); err != tt.want {
+			t.Errorf("%s: sleepContext returned %v, want %v", tt.name, err, tt.want)
+		}
+		if elapsed := time.Since(start); tt.d > time.Second && elapsed > 100*time.Millisecond {
+			t.Errorf("%s: sleepContext took %s, want it to return right away", tt.name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestCodeResponseDurations(t *testing.T) {
+	tests := []struct {
+		name          string
+		seconds       int
+		wantInterval  time.Duration
+		wantExpiresIn time.Duration
+	}{
+		{"missing", 0, traktdeviceauth.DefaultPollInterval, 0},
+		{"negative", -5, traktdeviceauth.DefaultPollInterval, 0},
+		{"one second", 1, time.Second, time.Second},
+		{"normal", 600, 10 * time.Minute, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := traktdeviceauth.CodeResponse{Interval: tt.seconds, ExpiresIn: tt.seconds}
+			if got := c.IntervalDuration(); got != tt.wantInterval {
+				t.Errorf("IntervalDuration() of Interval %d = %v, want %v", tt.seconds, got, tt.wantInterval)
+			}
+			if got := c.ExpiresInDuration(); got != tt.wantExpiresIn {
+				t.Errorf("ExpiresInDuration() of ExpiresIn %d = %v, want %v", tt.seconds, got, tt.wantExpiresIn)
+			}
+		})
+	}
+}
+
+func TestTokenResponseExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		zero      bool
+		// An access token is set unless noAccess is.
+		noAccess       bool
+		wantExpired    bool
+		wantWithinHour bool
+		wantValid      bool
+	}{
+		{name: "zero ExpiresAt", zero: true, wantExpired: true, wantWithinHour: true},
+		{name: "long expired", expiresIn: -24 * time.Hour, wantExpired: true, wantWithinHour: true},
+		// ExpiresAt has passed by the time it is checked, so the token counts as expired from that instant on.
+		{name: "expiring now", expiresIn: 0, wantExpired: true, wantWithinHour: true},
+		{name: "expiring within the hour", expiresIn: 30 * time.Minute, wantWithinHour: true, wantValid: true},
+		// The hour is up by the time it is checked.
+		{name: "expiring in exactly an hour", expiresIn: time.Hour, wantWithinHour: true, wantValid: true},
+		{name: "expiring in a day", expiresIn: 24 * time.Hour, wantValid: true},
+		{name: "no access token", expiresIn: 24 * time.Hour, noAccess: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok := traktdeviceauth.TokenResponse{AccessToken: "access"}
+			if tt.noAccess {
+				tok.AccessToken = ""
+			}
+			if !tt.zero {
+				tok.ExpiresAt = time.Now().Add(tt.expiresIn)
+			}
+
+			if got := tok.Expired(); got != tt.wantExpired {
+				t.Errorf("Expired() = %v, want %v", got, tt.wantExpired)
+			}
+			if got := tok.ExpiresWithin(time.Hour); got != tt.wantWithinHour {
+				t.Errorf("ExpiresWithin(time.Hour) = %v, want %v", got, tt.wantWithinHour)
+			}
+			if got := tok.ExpiresWithin(0); got != tt.wantExpired {
+				t.Errorf("ExpiresWithin(0) = %v, want the same as Expired()", got)
+			}
+			if got := tok.Valid(); got != tt.wantValid {
+				t.Errorf("Valid() = %v, want %v", got, tt.wantValid)
+			}
+
+			got := tok.TimeUntilExpiry()
+			switch {
+			case tt.zero:
+				if got != 0 {
+					t.Errorf("TimeUntilExpiry() = %v, want 0", got)
+				}
+			case got > tt.expiresIn || got < tt.expiresIn-time.Second:
+				t.Errorf("TimeUntilExpiry() = %v, want just under %v", got, tt.expiresIn)
+			}
+		})
+	}
+}
+
+func TestCodeResponseExpiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		code          traktdeviceauth.CodeResponse
+		wantExpired   bool
+		wantRemaining time.Duration
+	}{
+		{"expiring in a minute", traktdeviceauth.CodeResponse{ExpiresIn: 600, ExpiresAt: time.Now().Add(time.Minute)}, false, time.Minute},
+		{"expired", traktdeviceauth.CodeResponse{ExpiresIn: 600, ExpiresAt: time.Now().Add(-time.Minute)}, true, 0},
+		{"expiring now", traktdeviceauth.CodeResponse{ExpiresIn: 600, ExpiresAt: time.Now()}, true, 0},
+		// A code without ExpiresAt is assumed to have just been generated.
+		{"no ExpiresAt", traktdeviceauth.CodeResponse{ExpiresIn: 600}, false, 10 * time.Minute},
+		{"no ExpiresAt and no ExpiresIn", traktdeviceauth.CodeResponse{}, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.code.IsExpired(); got != tt.wantExpired {
+				t.Errorf("IsExpired() = %v, want %v", got, tt.wantExpired)
+			}
+			if got := tt.code.Remaining(); got > tt.wantRemaining || got < tt.wantRemaining-time.Second {
+				t.Errorf("Remaining() = %v, want just under %v", got, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestGenerateNewCodeExpiresAt(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ExpiresIn = 600
+
+	before := time.Now()
+	code, err := traktdeviceauth.GenerateNewCode("client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	if code.ExpiresIn != 600 {
+		t.Errorf("ExpiresIn = %d, want 600", code.ExpiresIn)
+	}
+	if code.ExpiresAt.Before(before.Add(10*time.Minute)) || code.ExpiresAt.After(after.Add(10*time.Minute)) {
+		t.Errorf("ExpiresAt = %v, want 10 minutes after the response arrived, between %v and %v", code.ExpiresAt, before.Add(10*time.Minute), after.Add(10*time.Minute))
+	}
+}
+
+func TestPollForAuthTokenStopsAtExpiresAt(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ExpiresIn = 2
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(1000))
+
+	code, err := traktdeviceauth.GenerateNewCode("client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Polling starts when half of the code's lifetime is gone, and stops when the code expires instead of
+	// counting its ExpiresIn from the start of polling.
+	time.Sleep(time.Second)
+	start := time.Now()
+	_, err = traktdeviceauth.PollForAuthToken(code, "client-id", "client-secret",
+		append(srv.Options(), traktdeviceauth.WithPollInterval(50*time.Millisecond))...)
+	if !errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PollForAuthToken returned %v, want the code to expire", err)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("polling went on for %v, past the code's expiry at %v", elapsed, code.ExpiresAt)
+	}
+}
+
+func TestPollForAuthTokenCancelLeavesNothingRunning(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	code, err := traktdeviceauth.GenerateNewCode("client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := append(srv.Options(), traktdeviceauth.WithPollInterval(5*time.Minute))
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond, cancel)
+		start := time.Now()
+		_, err := traktdeviceauth.PollForAuthTokenContext(ctx, code, "client-id", "client-secret", opts...)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("PollForAuthTokenContext returned %v, want context.Canceled", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("PollForAuthTokenContext took %v to notice the cancellation", elapsed)
+		}
+	}
+
+	// Nothing started for the long waits may outlive the calls which were cancelled.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines were left running after the cancelled polls, %d before them", after, before)
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceToken)); n != 0 {
+		t.Errorf("the cancelled polls made %d token requests, want none", n)
+	}
+}
+
+func BenchmarkPollForAuthToken(b *testing.B) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ApproveAfterPolls(10))
+	opts := append(srv.Options(), traktdeviceauth.WithPollInterval(time.Microsecond))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		code, err := traktdeviceauth.GenerateNewCode("client-id", opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := traktdeviceauth.PollForAuthToken(code, "client-id", "client-secret", opts...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
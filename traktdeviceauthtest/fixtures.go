@@ -0,0 +1,110 @@
+package traktdeviceauthtest
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Fixture is a canned Trakt API response. The exported fixtures are modelled on responses from the real API
+// and must not be modified; copy one and change the copy instead.
+type Fixture struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// Response builds an *http.Response for req from f. Every call returns a fresh body and header.
+func (f Fixture) Response(req *http.Request) *http.Response {
+	header := f.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(f.Status) + " " + http.StatusText(f.Status),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(f.Body)),
+		ContentLength: int64(len(f.Body)),
+		Request:       req,
+	}
+}
+
+// Successful responses.
+var (
+	// FixtureCodeResponse is a device code, as returned by the device code endpoint.
+	FixtureCodeResponse = Fixture{Status: http.StatusOK, Body: `{"device_code":"d9c126a7706328d808914cfd1e40274b6e009f684b1aca271b9b3f90b3630d64","user_code":"5055CC52","verification_url":"https://trakt.tv/activate","expires_in":600,"interval":5}`}
+
+	// FixtureTokenResponse is a token, as returned by the device token and token endpoints.
+	FixtureTokenResponse = Fixture{Status: http.StatusOK, Body: `{"access_token":"dbaf9757982a9e738f05d249b7b5b4a266b3a139049317c4909f2f263572c781","token_type":"bearer","expires_in":7776000,"refresh_token":"76ba4c5c75c96f6087f58a4de10be6c00b29ea1ddc3b2022ee2016d1363e3a7c","scope":"public","created_at":1487889741}`}
+
+	// FixtureTruncatedTokenResponse is a successful token response whose access token is empty, like one served
+	// by a proxy which cached a partial body. It is rejected with a *traktdeviceauth.MalformedResponseError.
+	FixtureTruncatedTokenResponse = Fixture{Status: http.StatusOK, Body: `{"access_token":"","token_type":"bearer","expires_in":7776000,"refresh_token":"76ba4c5c75c96f6087f58a4de10be6c00b29ea1ddc3b2022ee2016d1363e3a7c","scope":"public","created_at":1487889741}`}
+
+	// FixtureUserSettings is the account of the user FixtureTokenResponse belongs to, as returned by the
+	// user settings endpoint.
+	FixtureUserSettings = Fixture{Status: http.StatusOK, Body: `{"user":{"username":"justin","private":false,"name":"Justin Nemeth","vip":true,"vip_ep":false,"ids":{"slug":"justin"}},"account":{"timezone":"America/Los_Angeles","date_format":"mdy","time_24hr":false,"cover_image":null}}`}
+)
+
+// Error responses of the device token endpoint. Trakt answers them with an empty body.
+var (
+	// FixturePending means the user hasn't entered the code yet.
+	FixturePending = Fixture{Status: http.StatusBadRequest}
+
+	// FixtureInvalidDeviceCode means the device code wasn't recognized.
+	FixtureInvalidDeviceCode = Fixture{Status: http.StatusNotFound}
+
+	// FixtureAlreadyUsed means the device code has already been exchanged for a token.
+	FixtureAlreadyUsed = Fixture{Status: http.StatusConflict}
+
+	// FixtureExpired means the device code expired before the user entered it.
+	FixtureExpired = Fixture{Status: http.StatusGone}
+
+	// FixtureDenied means the user declined the authorization.
+	FixtureDenied = Fixture{Status: http.StatusTeapot}
+
+	// FixtureSlowDown means the device code was polled faster than the interval allows.
+	FixtureSlowDown = Fixture{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"5"}}}
+)
+
+// Error responses shared by the other endpoints.
+var (
+	// FixtureInvalidGrant is the token endpoint's answer to a refresh token which is invalid, expired or revoked.
+	FixtureInvalidGrant = Fixture{Status: http.StatusUnauthorized, Body: `{"error":"invalid_grant","error_description":"The provided authorization grant is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client."}`}
+
+	// FixtureInvalidAccessToken is the answer to a request made with an invalid or expired access token.
+	FixtureInvalidAccessToken = Fixture{Status: http.StatusUnauthorized}
+
+	// FixtureForbidden means the client id or secret is invalid.
+	FixtureForbidden = Fixture{Status: http.StatusForbidden}
+
+	// FixtureRateLimited is the answer to a request which exceeded Trakt's rate limit.
+	FixtureRateLimited = Fixture{Status: http.StatusTooManyRequests, Header: http.Header{
+		"Retry-After":        {"1"},
+		"X-Ratelimit":        {`{"name":"UNAUTHED_API_GET_LIMIT","period":300,"limit":1000,"remaining":0,"until":"2020-10-10T00:24:00Z"}`},
+		"X-Ratelimit-Limit":  {"1000"},
+		"X-Ratelimit-Period": {"300"},
+	}}
+
+	// FixtureServerError means Trakt failed to process the request.
+	FixtureServerError = Fixture{Status: http.StatusInternalServerError}
+
+	// FixtureServiceUnavailable means Trakt is overloaded or down for maintenance.
+	FixtureServiceUnavailable = Fixture{Status: http.StatusServiceUnavailable}
+
+	// FixtureCloudflareError is the HTML page Cloudflare serves when it can't reach Trakt.
+	FixtureCloudflareError = Fixture{
+		Status: 520,
+		Header: http.Header{"Content-Type": {"text/html; charset=UTF-8"}, "Server": {"cloudflare"}},
+		Body:   "<!DOCTYPE html>\n<html><head><title>api.trakt.tv | 520: Web server is returning an unknown error</title></head><body><h1>Web server is returning an unknown error</h1></body></html>\n",
+	}
+)
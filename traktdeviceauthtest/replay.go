@@ -0,0 +1,104 @@
+package traktdeviceauthtest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// ReplayTransport is an http.RoundTripper which answers requests with a scripted sequence of Fixtures entirely
+// in memory, for unit tests which don't need the behavior of a Server. Once the fixtures run out, requests fail
+// with an error, so that unexpected requests are noticed.
+type ReplayTransport struct {
+	mu       sync.Mutex
+	fixtures []Fixture
+	requests []Request
+}
+
+// NewReplayTransport returns a ReplayTransport which answers the n-th request with the n-th fixture.
+func NewReplayTransport(fixtures ...Fixture) *ReplayTransport {
+	return &ReplayTransport{fixtures: fixtures}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var b []byte
+	if req.Body != nil {
+		var err error
+		b, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(t.requests)
+	r := Request{
+		Endpoint: endpointOf(req.URL.Path),
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Header:   req.Header.Clone(),
+		Body:     b,
+		Time:     time.Now(),
+	}
+	if n >= len(t.fixtures) {
+		t.requests = append(t.requests, r)
+		return nil, fmt.Errorf("ReplayTransport: no fixture for request %d to %s", n+1, req.URL.Path)
+	}
+
+	r.Status = t.fixtures[n].Status
+	t.requests = append(t.requests, r)
+	return t.fixtures[n].Response(req), nil
+}
+
+// Options returns the traktdeviceauth options which route every request to t instead of the network.
+func (t *ReplayTransport) Options() []traktdeviceauth.Option {
+	return []traktdeviceauth.Option{traktdeviceauth.WithMiddleware(func(traktdeviceauth.RoundTripFunc) traktdeviceauth.RoundTripFunc {
+		return t.RoundTrip
+	})}
+}
+
+// Requests returns every request t received, in the order they arrived. Requests which found no fixture
+// are included with a Status of 0.
+func (t *ReplayTransport) Requests() []Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Request(nil), t.requests...)
+}
+
+// Remaining returns how many fixtures haven't been served yet.
+func (t *ReplayTransport) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.requests) >= len(t.fixtures) {
+		return 0
+	}
+	return len(t.fixtures) - len(t.requests)
+}
+
+// endpointOf returns the endpoint whose path path ends with, or -1 if there is none.
+func endpointOf(path string) traktdeviceauth.Endpoint {
+	endpoints := []traktdeviceauth.Endpoint{
+		traktdeviceauth.EndpointDeviceCode,
+		traktdeviceauth.EndpointDeviceToken,
+		traktdeviceauth.EndpointToken,
+		traktdeviceauth.EndpointUserSettings,
+		traktdeviceauth.EndpointRevoke,
+	}
+	for _, e := range endpoints {
+		if strings.HasSuffix(path, e.String()) {
+			return e
+		}
+	}
+	return -1
+}
@@ -0,0 +1,166 @@
+package traktdeviceauthtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestReplayTransportFlow(t *testing.T) {
+	replay := traktdeviceauthtest.NewReplayTransport(
+		traktdeviceauthtest.FixtureCodeResponse,
+		traktdeviceauthtest.FixturePending,
+		traktdeviceauthtest.FixtureTokenResponse,
+		traktdeviceauthtest.FixtureUserSettings,
+	)
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeResp.UserCode != "5055CC52" || codeResp.ExpiresIn != 600 || codeResp.Interval != 5 {
+		t.Errorf("got code %+v, want the fixture's", codeResp)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); !errors.Is(err, traktdeviceauth.ErrDeviceCodeUnclaimed) {
+		t.Fatalf("first poll returned %v, want ErrDeviceCodeUnclaimed", err)
+	}
+	tok, err := cl.RequestToken(ctx, codeResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.RefreshToken == "" || !tok.ExpiresAt.Equal(time.Unix(1487889741+7776000, 0)) {
+		t.Errorf("got token %+v, want the fixture's", tok)
+	}
+	settings, err := cl.GetUserSettings(ctx, tok.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.User.Username != "justin" {
+		t.Errorf("got user %q, want justin", settings.User.Username)
+	}
+
+	if n := replay.Remaining(); n != 0 {
+		t.Errorf("%d fixtures remain, want 0", n)
+	}
+	reqs := replay.Requests()
+	want := []traktdeviceauth.Endpoint{traktdeviceauth.EndpointDeviceCode, traktdeviceauth.EndpointDeviceToken, traktdeviceauth.EndpointDeviceToken, traktdeviceauth.EndpointUserSettings}
+	if len(reqs) != len(want) {
+		t.Fatalf("%d requests were recorded, want %d", len(reqs), len(want))
+	}
+	for i, r := range reqs {
+		if r.Endpoint != want[i] {
+			t.Errorf("request %d went to %s, want %s", i+1, r.Endpoint, want[i])
+		}
+	}
+	if reqs[1].Method != http.MethodPost || len(reqs[1].Body) == 0 || reqs[1].Status != http.StatusBadRequest {
+		t.Errorf("the first poll was recorded as %+v", reqs[1])
+	}
+}
+
+func TestReplayTransportRunsOut(t *testing.T) {
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse)
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+
+	ctx := context.Background()
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); err == nil {
+		t.Fatal("a request without a fixture succeeded")
+	}
+
+	reqs := replay.Requests()
+	if len(reqs) != 2 || reqs[1].Status != 0 {
+		t.Errorf("got requests %+v, want the unanswered one recorded with status 0", reqs)
+	}
+	if n := replay.Remaining(); n != 0 {
+		t.Errorf("%d fixtures remain, want 0", n)
+	}
+}
+
+func TestFixtureErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture traktdeviceauthtest.Fixture
+		want    error
+	}{
+		{"pending", traktdeviceauthtest.FixturePending, traktdeviceauth.ErrDeviceCodeUnclaimed},
+		{"invalid device code", traktdeviceauthtest.FixtureInvalidDeviceCode, traktdeviceauth.ErrInvalidDeviceCode},
+		{"already used", traktdeviceauthtest.FixtureAlreadyUsed, traktdeviceauth.ErrDeviceCodeAlreadyApproved},
+		{"expired", traktdeviceauthtest.FixtureExpired, traktdeviceauth.ErrDeviceCodeExpired},
+		{"denied", traktdeviceauthtest.FixtureDenied, traktdeviceauth.ErrDeviceCodeDenied},
+		{"slow down", traktdeviceauthtest.FixtureSlowDown, traktdeviceauth.ErrPollRateTooFast},
+		{"rate limited", traktdeviceauthtest.FixtureRateLimited, traktdeviceauth.ErrPollRateTooFast},
+		{"forbidden", traktdeviceauthtest.FixtureForbidden, traktdeviceauth.ErrForbidden},
+		{"server error", traktdeviceauthtest.FixtureServerError, traktdeviceauth.ErrServerError},
+		{"service unavailable", traktdeviceauthtest.FixtureServiceUnavailable, traktdeviceauth.ErrServiceOverloaded},
+		{"cloudflare", traktdeviceauthtest.FixtureCloudflareError, traktdeviceauth.ErrCloudflareError},
+		{"truncated token", traktdeviceauthtest.FixtureTruncatedTokenResponse, traktdeviceauth.ErrMalformedResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureCodeResponse, tt.fixture)
+			cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+
+			ctx := context.Background()
+			codeResp, err := cl.GenerateNewCode(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cl.RequestToken(ctx, codeResp); !errors.Is(err, tt.want) {
+				t.Errorf("RequestToken returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixtureRefreshErrors(t *testing.T) {
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureInvalidGrant, traktdeviceauthtest.FixtureInvalidAccessToken)
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", replay.Options()...)
+
+	ctx := context.Background()
+	if _, err := cl.RefreshAccessToken(ctx, "refresh"); !errors.Is(err, traktdeviceauth.ErrInvalidGrant) {
+		t.Errorf("RefreshAccessToken returned %v, want ErrInvalidGrant", err)
+	}
+	if _, err := cl.GetUserSettings(ctx, "access"); !errors.Is(err, traktdeviceauth.ErrInvalidAccessToken) {
+		t.Errorf("GetUserSettings returned %v, want ErrInvalidAccessToken", err)
+	}
+}
+
+func TestFixtureResponse(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/device/token", nil)
+	f := traktdeviceauthtest.FixtureSlowDown
+
+	first := f.Response(req)
+	first.Header.Set("Retry-After", "60")
+	b, _ := io.ReadAll(first.Body)
+
+	second := f.Response(req)
+	if got := second.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("changing a response's header changed the fixture: Retry-After = %q", got)
+	}
+	if second.StatusCode != http.StatusTooManyRequests || second.Header.Get("Content-Type") != "application/json" || second.Request != req {
+		t.Errorf("got response %+v", second)
+	}
+	if len(b) != 0 || f.Header.Get("Content-Type") != "" {
+		t.Error("building a response changed the fixture")
+	}
+
+	code := traktdeviceauthtest.FixtureCodeResponse
+	for i := 0; i < 2; i++ {
+		b, _ := io.ReadAll(code.Response(req).Body)
+		if string(b) != code.Body {
+			t.Fatalf("response %d has body %q, want a fresh copy of the fixture's", i+1, b)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package traktdeviceauthtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// MemoryStore is a traktdeviceauth.TokenStore, NamedStore and RotatingStore which keeps tokens in memory, for
+// testing code which shares tokens through a store, such as several RefreshSchedulers using
+// WithRotatingStore. Tokens are kept as StoredToken JSON, so they are encoded like a real store would. It is
+// safe for concurrent use.
+type MemoryStore struct {
+	mu   sync.Mutex
+	docs map[string][]byte
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[string][]byte)}
+}
+
+// Save implements traktdeviceauth.TokenStore for traktdeviceauth.DefaultProfile.
+func (s *MemoryStore) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	return s.SaveNamed(ctx, traktdeviceauth.DefaultProfile, t)
+}
+
+// Load implements traktdeviceauth.TokenStore for traktdeviceauth.DefaultProfile.
+func (s *MemoryStore) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	return s.LoadNamed(ctx, traktdeviceauth.DefaultProfile)
+}
+
+// SaveNamed implements traktdeviceauth.NamedStore. Like real stores, it saves the token without rotation, as
+// generation 0.
+func (s *MemoryStore) SaveNamed(ctx context.Context, name string, t traktdeviceauth.TokenResponse) error {
+	b, err := json.Marshal(traktdeviceauth.NewStoredToken(t))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[name] = b
+	return nil
+}
+
+// LoadNamed implements traktdeviceauth.NamedStore.
+func (s *MemoryStore) LoadNamed(ctx context.Context, name string) (traktdeviceauth.TokenResponse, error) {
+	r, err := s.LoadRotated(ctx, name)
+	return r.Token, err
+}
+
+// LoadRotated implements traktdeviceauth.RotatingStore.
+func (s *MemoryStore) LoadRotated(ctx context.Context, name string) (traktdeviceauth.RotatedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(name)
+}
+
+// Rotate implements traktdeviceauth.RotatingStore.
+func (s *MemoryStore) Rotate(ctx context.Context, name string, generation int64, t traktdeviceauth.TokenResponse, grace time.Duration) (traktdeviceauth.RotatedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, err := s.load(name)
+	if err != nil && !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		return traktdeviceauth.RotatedToken{}, err
+	}
+	if cur.Generation != generation {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("%s is generation %d, not %d: %w", name, cur.Generation, generation, traktdeviceauth.ErrRotationConflict)
+	}
+
+	next := cur.Next(t, time.Now(), grace)
+	b, err := json.Marshal(next.Stored())
+	if err != nil {
+		return traktdeviceauth.RotatedToken{}, err
+	}
+	s.docs[name] = b
+	return next, nil
+}
+
+// load decodes the token under name. s.mu must be held.
+func (s *MemoryStore) load(name string) (traktdeviceauth.RotatedToken, error) {
+	b, ok := s.docs[name]
+	if !ok {
+		return traktdeviceauth.RotatedToken{}, fmt.Errorf("%s: %w", name, traktdeviceauth.ErrNoStoredToken)
+	}
+	var st traktdeviceauth.StoredToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return traktdeviceauth.RotatedToken{}, err
+	}
+	return st.Rotated(), nil
+}
+
+// TestRotatingStore checks that the RotatingStores created by newStore follow the rules documented on
+// traktdeviceauth.RotatingStore, including that exactly one of several concurrent Rotates of the same
+// generation wins. newStore is called once per subtest and must return an empty store.
+func TestRotatingStore(t *testing.T, newStore func(t *testing.T) traktdeviceauth.RotatingStore) {
+	ctx := context.Background()
+	const name = "rotating"
+
+	t.Run("LoadEmpty", func(t *testing.T) {
+		_, err := newStore(t).LoadRotated(ctx, name)
+		if !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+			t.Fatalf("LoadRotated on an empty store returned %v, want an error wrapping ErrNoStoredToken", err)
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Rotate(ctx, name, 0, storeToken(1), time.Hour); err != nil {
+			t.Fatalf("Rotate of an empty store: %v", err)
+		}
+		if _, err := s.Rotate(ctx, name, 1, storeToken(2), time.Hour); err != nil {
+			t.Fatalf("Rotate of generation 1: %v", err)
+		}
+
+		got, err := s.LoadRotated(ctx, name)
+		if err != nil {
+			t.Fatalf("LoadRotated: %v", err)
+		}
+		checkToken(t, got.Token, storeToken(2))
+		if got.Generation != 2 {
+			t.Fatalf("LoadRotated returned generation %d, want 2", got.Generation)
+		}
+		if got.PreviousAccessToken != storeToken(1).AccessToken || !got.Usable(storeToken(1).AccessToken, time.Now()) {
+			t.Fatalf("LoadRotated returned the previous access token %q valid until %s, want %q for an hour",
+				got.PreviousAccessToken, got.PreviousValidUntil, storeToken(1).AccessToken)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Rotate(ctx, name, 0, storeToken(1), 0); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		_, err := s.Rotate(ctx, name, 0, storeToken(2), 0)
+		if !errors.Is(err, traktdeviceauth.ErrRotationConflict) {
+			t.Fatalf("Rotate of a stale generation returned %v, want an error wrapping ErrRotationConflict", err)
+		}
+
+		got, err := s.LoadRotated(ctx, name)
+		if err != nil {
+			t.Fatalf("LoadRotated: %v", err)
+		}
+		checkToken(t, got.Token, storeToken(1))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Rotate(ctx, name, 0, storeToken(0), 0); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+
+		var (
+			wg   sync.WaitGroup
+			wins int32
+		)
+		for i := 1; i <= 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := s.Rotate(ctx, name, 1, storeToken(i), 0)
+				switch {
+				case err == nil:
+					atomic.AddInt32(&wins, 1)
+				case !errors.Is(err, traktdeviceauth.ErrRotationConflict):
+					t.Errorf("concurrent Rotate: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if wins != 1 {
+			t.Fatalf("%d concurrent Rotates of the same generation succeeded, want 1", wins)
+		}
+		got, err := s.LoadRotated(ctx, name)
+		if err != nil {
+			t.Fatalf("LoadRotated: %v", err)
+		}
+		if got.Generation != 2 {
+			t.Fatalf("LoadRotated returned generation %d, want 2", got.Generation)
+		}
+	})
+}
@@ -0,0 +1,20 @@
+package traktdeviceauthtest_test
+
+import (
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return traktdeviceauthtest.NewMemoryStore()
+	})
+}
+
+func TestMemoryStoreRotation(t *testing.T) {
+	traktdeviceauthtest.TestRotatingStore(t, func(t *testing.T) traktdeviceauth.RotatingStore {
+		return traktdeviceauthtest.NewMemoryStore()
+	})
+}
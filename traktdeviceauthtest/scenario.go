@@ -0,0 +1,160 @@
+package traktdeviceauthtest
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A Scenario changes how a Server answers requests. Scenarios are applied in order by Server.Script.
+type Scenario func(*script)
+
+// script is the set of behaviors configured by Scenarios.
+type script struct {
+	polls         []Step
+	codes         []Step
+	refreshes     []Step
+	expireAfter   time.Duration
+	rotateRefresh bool
+}
+
+// Step is a scripted answer to a single request.
+type Step struct {
+	status  int
+	header  http.Header
+	body    string
+	token   *Token
+	outcome codeState
+}
+
+// StepOption customizes a Step created by Status.
+type StepOption func(*Step)
+
+// Status answers a request with status and an empty JSON body.
+func Status(status int, opts ...StepOption) Step {
+	s := Step{status: status, header: http.Header{}}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// RetryAfter sets the Retry-After header of a Step to the given number of seconds.
+func RetryAfter(seconds int) StepOption {
+	return func(s *Step) {
+		s.header.Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
+// Header sets an arbitrary response header on a Step.
+func Header(key, value string) StepOption {
+	return func(s *Step) {
+		s.header.Set(key, value)
+	}
+}
+
+// Body replaces the response body of a Step.
+func Body(body string) StepOption {
+	return func(s *Step) {
+		s.body = body
+	}
+}
+
+// Succeed answers a request the way the Server would without a script.
+func Succeed() Step {
+	return Step{}
+}
+
+// Unclaimed answers a poll with 400, meaning the user has not entered the code yet.
+func Unclaimed() Step {
+	return Status(http.StatusBadRequest)
+}
+
+// Approve answers a poll with token. Zero-value fields of token are filled in by the Server.
+// Every later poll of the same device code is answered with 409.
+func Approve(token Token) Step {
+	return Step{token: &token, outcome: codeApproved}
+}
+
+// Deny answers a poll with 418, as if the user declined the authorization.
+// Every later poll of the same device code is answered the same way.
+func Deny() Step {
+	return Step{status: http.StatusTeapot, header: http.Header{}, outcome: codeDenied}
+}
+
+// Expire answers a poll with 410, as if the device code had expired.
+// Every later poll of the same device code is answered the same way.
+func Expire() Step {
+	return Step{status: http.StatusGone, header: http.Header{}, outcome: codeExpired}
+}
+
+// Sequence answers the n-th poll of each device code with the n-th step.
+// Once the steps run out, the last step is repeated.
+func Sequence(steps ...Step) Scenario {
+	return func(s *script) {
+		s.polls = steps
+	}
+}
+
+// ApproveAfterPolls answers the first n polls of each device code as unclaimed and approves the next one.
+func ApproveAfterPolls(n int) Scenario {
+	return Sequence(append(repeat(Unclaimed(), n), Approve(Token{}))...)
+}
+
+// DenyAfterPolls answers the first n polls of each device code as unclaimed and denies the next one.
+func DenyAfterPolls(n int) Scenario {
+	return Sequence(append(repeat(Unclaimed(), n), Deny())...)
+}
+
+// ExpireAfter makes device codes expire d after they were generated. The lifetime reported in the
+// code response is adjusted to match.
+func ExpireAfter(d time.Duration) Scenario {
+	return func(s *script) {
+		s.expireAfter = d
+	}
+}
+
+// CodeSequence answers the n-th request for a device code with the n-th step, repeating the last one.
+// Use Succeed for requests that should generate a code normally.
+func CodeSequence(steps ...Step) Scenario {
+	return func(s *script) {
+		s.codes = steps
+	}
+}
+
+// RefreshSequence answers the n-th refresh request with the n-th step, repeating the last one.
+// Use Succeed for requests that should refresh normally.
+func RefreshSequence(steps ...Step) Scenario {
+	return func(s *script) {
+		s.refreshes = steps
+	}
+}
+
+// RotateRefreshToken issues a new refresh token on every refresh and revokes the one that was used,
+// which is how the real Trakt API behaves.
+func RotateRefreshToken() Scenario {
+	return func(s *script) {
+		s.rotateRefresh = true
+	}
+}
+
+// repeat returns a slice containing n copies of step.
+func repeat(step Step, n int) []Step {
+	steps := make([]Step, 0, n+1)
+	for i := 0; i < n; i++ {
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// stepAt returns the step for the n-th (zero-based) request, repeating the last step once they run out.
+// ok is false if there are no steps at all.
+func stepAt(steps []Step, n int) (step Step, ok bool) {
+	if len(steps) == 0 {
+		return Step{}, false
+	}
+	if n >= len(steps) {
+		n = len(steps) - 1
+	}
+	return steps[n], true
+}
@@ -0,0 +1,180 @@
+package traktdeviceauthtest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// pollStatuses generates a code on srv, polls it n times and returns the statuses the polls were answered with.
+func pollStatuses(t *testing.T, srv *traktdeviceauthtest.Server, n int) []int {
+	t.Helper()
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		cl.RequestToken(ctx, codeResp)
+	}
+
+	var statuses []int
+	for _, r := range srv.RequestsTo(traktdeviceauth.EndpointDeviceToken) {
+		statuses = append(statuses, r.Status)
+	}
+	return statuses
+}
+
+func TestScenarioStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario traktdeviceauthtest.Scenario
+		polls    int
+		want     []int
+	}{
+		{"without a script", nil, 2, []int{200, 409}},
+		{"approve after polls", traktdeviceauthtest.ApproveAfterPolls(3), 5, []int{400, 400, 400, 200, 409}},
+		{"deny after polls", traktdeviceauthtest.DenyAfterPolls(2), 4, []int{400, 400, 418, 418}},
+		{"expire", traktdeviceauthtest.Sequence(traktdeviceauthtest.Unclaimed(), traktdeviceauthtest.Expire()), 3, []int{400, 410, 410}},
+		{"last step repeats", traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable)), 3, []int{503, 503, 503}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := traktdeviceauthtest.NewServer()
+			defer srv.Close()
+			if tt.scenario != nil {
+				srv.Script(tt.scenario)
+			}
+
+			if got := pollStatuses(t, srv, tt.polls); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the polls were answered with %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequenceRateLimitThenApprove(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.Sequence(
+		traktdeviceauthtest.Status(http.StatusTooManyRequests, traktdeviceauthtest.RetryAfter(7)),
+		traktdeviceauthtest.Unclaimed(),
+		traktdeviceauthtest.Approve(traktdeviceauthtest.Token{AccessToken: "scripted-access-token"}),
+	))
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cl.RequestToken(ctx, codeResp)
+	var rateLimitErr *traktdeviceauth.RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter != 7*time.Second {
+		t.Fatalf("the first poll returned %v, want a RateLimitError with Retry-After 7s", err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); !errors.Is(err, traktdeviceauth.ErrDeviceCodeUnclaimed) {
+		t.Fatalf("the second poll returned %v, want ErrDeviceCodeUnclaimed", err)
+	}
+	tok, err := cl.RequestToken(ctx, codeResp)
+	if err != nil || tok.AccessToken != "scripted-access-token" || tok.RefreshToken == "" {
+		t.Fatalf("the third poll returned %+v and %v, want the scripted token with the rest filled in", tok, err)
+	}
+}
+
+func TestExpireAfter(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.ExpireAfter(30 * time.Second))
+
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	codeResp, err := cl.GenerateNewCode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeResp.ExpiresIn != 30 {
+		t.Errorf("ExpiresIn = %d, want 30", codeResp.ExpiresIn)
+	}
+
+	srv.Script(traktdeviceauthtest.ExpireAfter(50*time.Millisecond), traktdeviceauthtest.ApproveAfterPolls(1000))
+	codeResp, err = cl.GenerateNewCode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cl.RequestToken(context.Background(), codeResp); !errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired) {
+		t.Errorf("polling an expired code returned %v, want ErrDeviceCodeExpired", err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	for _, rotate := range []bool{false, true} {
+		srv := traktdeviceauthtest.NewServer()
+		if rotate {
+			srv.Script(traktdeviceauthtest.RotateRefreshToken())
+		}
+
+		ctx := context.Background()
+		cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+		issued := srv.IssueToken()
+		refreshed, err := cl.RefreshAccessToken(ctx, issued.RefreshToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated := refreshed.RefreshToken != issued.RefreshToken; rotated != rotate {
+			t.Errorf("rotate %v: the refresh token was rotated: %v", rotate, rotated)
+		}
+
+		_, err = cl.RefreshAccessToken(ctx, issued.RefreshToken)
+		if rejected := errors.Is(err, traktdeviceauth.ErrInvalidGrant); rejected != rotate {
+			t.Errorf("rotate %v: reusing the old refresh token returned %v", rotate, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.Script(traktdeviceauthtest.CodeSequence(traktdeviceauthtest.Status(http.StatusServiceUnavailable), traktdeviceauthtest.Succeed()))
+
+	ctx := context.Background()
+	cl := traktdeviceauth.NewClient("client-id", "client-secret", srv.Options()...)
+	if _, err := cl.GenerateNewCode(ctx); !errors.Is(err, traktdeviceauth.ErrServiceOverloaded) {
+		t.Fatalf("the first code request returned %v, want ErrServiceOverloaded", err)
+	}
+	codeResp, err := cl.GenerateNewCode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.RequestToken(ctx, codeResp); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		endpoint traktdeviceauth.Endpoint
+		method   string
+		status   int
+	}
+	var got []entry
+	for _, r := range srv.Requests() {
+		got = append(got, entry{r.Endpoint, r.Method, r.Status})
+	}
+	want := []entry{
+		{traktdeviceauth.EndpointDeviceCode, http.MethodPost, 503},
+		{traktdeviceauth.EndpointDeviceCode, http.MethodPost, 200},
+		{traktdeviceauth.EndpointDeviceToken, http.MethodPost, 200},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("the request log is %v, want %v", got, want)
+	}
+}
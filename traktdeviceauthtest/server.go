@@ -0,0 +1,403 @@
+// Package traktdeviceauthtest provides a fake Trakt API for testing code built on traktdeviceauth.
+package traktdeviceauthtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// VerificationURL is the verification url handed out with every device code.
+const VerificationURL string = "https://trakt.tv/activate"
+
+// codeState tracks whether a device code has reached a terminal state.
+type codeState int
+
+const (
+	codePending codeState = iota
+	codeApproved
+	codeDenied
+	codeExpired
+)
+
+// deviceCode is the server-side record of a generated device code.
+type deviceCode struct {
+	userCode  string
+	expiresAt time.Time
+	polls     int
+	state     codeState
+}
+
+// Token is the JSON body the Trakt API returns from the token endpoints.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// Request is a request received by the Server, along with the status it was answered with.
+type Request struct {
+	Endpoint traktdeviceauth.Endpoint
+	Method   string
+	Path     string
+	Header   http.Header
+	Body     []byte
+	Status   int
+	Time     time.Time
+}
+
+// Server is a fake Trakt API serving the device authentication endpoints.
+// Without a script, every device code is approved on its first poll.
+type Server struct {
+	*httptest.Server
+
+	// ClientID and ClientSecret are checked against incoming requests when set, whether they are sent in the
+	// request body or in a Basic Authorization header. Mismatches are answered with 403.
+	ClientID     string
+	ClientSecret string
+
+	// UserSettings is returned by the user settings endpoint for every access token issued by the Server.
+	UserSettings traktdeviceauth.UserSettings
+
+	// ExpiresIn and Interval are reported in every code response. ExpiresIn defaults to 600 seconds
+	// and Interval defaults to 0. Since clients treat a zero interval as the default of 5 seconds, Options
+	// includes WithPollInterval with Interval, so that tests don't have to sleep between polls. Set Interval
+	// before calling Options.
+	ExpiresIn int
+	Interval  int
+
+	mu            sync.Mutex
+	script        script
+	codes         map[string]*deviceCode
+	refreshTokens map[string]bool
+	accessTokens  map[string]bool
+	codeRequests  int
+	refreshes     int
+	requests      []Request
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		ExpiresIn: 600,
+		UserSettings: traktdeviceauth.UserSettings{
+			User: traktdeviceauth.UserProfile{
+				Username: "fakeuser",
+				Name:     "Fake User",
+				IDs:      traktdeviceauth.UserIDs{Slug: "fakeuser"},
+			},
+			Account: traktdeviceauth.AccountSettings{Timezone: "UTC"},
+		},
+		codes:         make(map[string]*deviceCode),
+		refreshTokens: make(map[string]bool),
+		accessTokens:  make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(traktdeviceauth.EndpointDeviceCode.String(), s.handleDeviceCode)
+	mux.HandleFunc(traktdeviceauth.EndpointDeviceToken.String(), s.handleDeviceToken)
+	mux.HandleFunc(traktdeviceauth.EndpointToken.String(), s.handleToken)
+	mux.HandleFunc(traktdeviceauth.EndpointUserSettings.String(), s.handleUserSettings)
+	mux.HandleFunc(traktdeviceauth.EndpointRevoke.String(), s.handleRevoke)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Options returns the traktdeviceauth options needed to send requests to the Server and to poll it at Interval.
+func (s *Server) Options() []traktdeviceauth.Option {
+	s.mu.Lock()
+	interval := time.Duration(s.Interval) * time.Second
+	s.mu.Unlock()
+
+	return []traktdeviceauth.Option{traktdeviceauth.WithBaseURL(s.URL), traktdeviceauth.WithPollInterval(interval)}
+}
+
+// Script replaces the Server's behavior with the given scenarios, applied in order.
+func (s *Server) Script(scenarios ...Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = script{}
+	for _, scenario := range scenarios {
+		scenario(&s.script)
+	}
+}
+
+// Requests returns every request received by the Server, in the order they arrived.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsTo returns the requests received for endpoint, in the order they arrived.
+func (s *Server) RequestsTo(endpoint traktdeviceauth.Endpoint) []Request {
+	var reqs []Request
+	for _, r := range s.Requests() {
+		if r.Endpoint == endpoint {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// IssueToken creates a token which the Server will accept for refreshing, as if it had been obtained
+// through a device flow.
+func (s *Server) IssueToken() Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issueToken(Token{})
+}
+
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ClientID string `json:"client_id"`
+	}
+	s.serve(w, r, traktdeviceauth.EndpointDeviceCode, &body, func() (int, http.Header, interface{}) {
+		if s.ClientID != "" && body.ClientID != s.ClientID {
+			return http.StatusForbidden, nil, nil
+		}
+
+		s.codeRequests++
+		if step, ok := stepAt(s.script.codes, s.codeRequests-1); ok && step.status != 0 {
+			return step.status, step.header, step.body
+		}
+
+		lifetime := time.Duration(s.ExpiresIn) * time.Second
+		if s.script.expireAfter > 0 {
+			lifetime = s.script.expireAfter
+		}
+
+		code := randomHex(32)
+		userCode := strings.ToUpper(randomHex(4))
+		s.codes[code] = &deviceCode{userCode: userCode, expiresAt: time.Now().Add(lifetime)}
+
+		// CodeResponse.ExpiresAt is set by the client, so it isn't part of Trakt's response.
+		return http.StatusOK, nil, map[string]interface{}{
+			"device_code":      code,
+			"user_code":        userCode,
+			"verification_url": VerificationURL,
+			"expires_in":       int(lifetime / time.Second),
+			"interval":         s.Interval,
+		}
+	})
+}
+
+func (s *Server) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code         string `json:"code"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	s.serve(w, r, traktdeviceauth.EndpointDeviceToken, &body, func() (int, http.Header, interface{}) {
+		if !s.credentialsMatch(r, body.ClientID, body.ClientSecret) {
+			return http.StatusForbidden, nil, nil
+		}
+
+		code, ok := s.codes[body.Code]
+		if !ok {
+			return http.StatusNotFound, nil, nil
+		}
+
+		if code.state == codePending && time.Now().After(code.expiresAt) {
+			code.state = codeExpired
+		}
+
+		switch code.state {
+		case codeApproved:
+			return http.StatusConflict, nil, nil
+		case codeDenied:
+			return http.StatusTeapot, nil, nil
+		case codeExpired:
+			return http.StatusGone, nil, nil
+		}
+
+		code.polls++
+		step, ok := stepAt(s.script.polls, code.polls-1)
+		if !ok || (step.status == 0 && step.token == nil) {
+			step = Approve(Token{})
+		}
+
+		code.state = step.outcome
+		if step.token != nil {
+			return http.StatusOK, nil, s.issueToken(*step.token)
+		}
+		return step.status, step.header, step.body
+	})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		GrantType    string `json:"grant_type"`
+	}
+	s.serve(w, r, traktdeviceauth.EndpointToken, &body, func() (int, http.Header, interface{}) {
+		if !s.credentialsMatch(r, body.ClientID, body.ClientSecret) {
+			return http.StatusForbidden, nil, nil
+		}
+
+		s.refreshes++
+		if step, ok := stepAt(s.script.refreshes, s.refreshes-1); ok && step.status != 0 {
+			return step.status, step.header, step.body
+		}
+
+		if body.GrantType != "refresh_token" || !s.refreshTokens[body.RefreshToken] {
+			return http.StatusUnauthorized, nil, nil
+		}
+
+		next := Token{}
+		if s.script.rotateRefresh {
+			delete(s.refreshTokens, body.RefreshToken)
+		} else {
+			next.RefreshToken = body.RefreshToken
+		}
+
+		return http.StatusOK, nil, s.issueToken(next)
+	})
+}
+
+func (s *Server) handleUserSettings(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, traktdeviceauth.EndpointUserSettings, nil, func() (int, http.Header, interface{}) {
+		if s.ClientID != "" && r.Header.Get("Trakt-API-Key") != s.ClientID {
+			return http.StatusForbidden, nil, nil
+		}
+
+		accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !s.accessTokens[accessToken] {
+			return http.StatusUnauthorized, nil, nil
+		}
+
+		return http.StatusOK, nil, s.UserSettings
+	})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token        string `json:"token"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	s.serve(w, r, traktdeviceauth.EndpointRevoke, &body, func() (int, http.Header, interface{}) {
+		if !s.credentialsMatch(r, body.ClientID, body.ClientSecret) {
+			return http.StatusForbidden, nil, nil
+		}
+
+		if !s.accessTokens[body.Token] {
+			return http.StatusUnauthorized, nil, nil
+		}
+		delete(s.accessTokens, body.Token)
+		return http.StatusOK, nil, struct{}{}
+	})
+}
+
+// serve decodes the request body into body (if it isn't nil), records the request and writes the response
+// produced by respond, which is called with s.mu held. POST is the only accepted method unless body is nil,
+// in which case it is GET.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, endpoint traktdeviceauth.Endpoint, body interface{}, respond func() (int, http.Header, interface{})) {
+	b, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, header, resp := http.StatusMethodNotAllowed, http.Header(nil), interface{}(nil)
+	switch {
+	case body == nil && r.Method == http.MethodGet:
+		status, header, resp = respond()
+	case body != nil && r.Method == http.MethodPost:
+		status, header, resp = http.StatusBadRequest, nil, nil
+		if err := json.Unmarshal(b, body); err == nil {
+			status, header, resp = respond()
+		}
+	}
+
+	s.requests = append(s.requests, Request{
+		Endpoint: endpoint,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Header:   r.Header.Clone(),
+		Body:     b,
+		Status:   status,
+		Time:     time.Now(),
+	})
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	switch resp := resp.(type) {
+	case nil:
+	case string:
+		io.WriteString(w, resp)
+	default:
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// credentialsMatch reports whether the client id and secret match the ones configured on the Server. They are
+// taken from r's Basic Authorization header if it has one, and from the request body otherwise. The header values
+// are form encoded as RFC 6749 requires, and a client_id sent in the body as well must agree with the header's.
+func (s *Server) credentialsMatch(r *http.Request, clientID, clientSecret string) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		headerID, errID := url.QueryUnescape(user)
+		headerSecret, errSecret := url.QueryUnescape(pass)
+		if errID != nil || errSecret != nil || clientSecret != "" || (clientID != "" && clientID != headerID) {
+			return false
+		}
+		clientID, clientSecret = headerID, headerSecret
+	}
+	return (s.ClientID == "" || clientID == s.ClientID) && (s.ClientSecret == "" || clientSecret == s.ClientSecret)
+}
+
+// issueToken fills in the zero-value fields of t and registers its access and refresh tokens. s.mu must be held.
+func (s *Server) issueToken(t Token) Token {
+	if t.AccessToken == "" {
+		t.AccessToken = randomHex(32)
+	}
+	if t.TokenType == "" {
+		t.TokenType = "bearer"
+	}
+	if t.ExpiresIn == 0 {
+		t.ExpiresIn = 7776000 // 3 months
+	}
+	if t.RefreshToken == "" {
+		t.RefreshToken = randomHex(32)
+	}
+	if t.Scope == "" {
+		t.Scope = "public"
+	}
+	if t.CreatedAt == 0 {
+		t.CreatedAt = time.Now().Unix()
+	}
+
+	s.refreshTokens[t.RefreshToken] = true
+	s.accessTokens[t.AccessToken] = true
+	return t
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
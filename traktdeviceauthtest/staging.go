@@ -0,0 +1,190 @@
+package traktdeviceauthtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// StagingBaseURL is the base url of the Trakt staging API, which has its own apps and accounts.
+const StagingBaseURL string = "https://api-staging.trakt.tv"
+
+// The environment variables TestStaging reads the credentials of a staging app from.
+const (
+	StagingClientIDEnv     = "TRAKT_STAGING_CLIENT_ID"
+	StagingClientSecretEnv = "TRAKT_STAGING_CLIENT_SECRET"
+)
+
+// Approver is called by TestStaging with the device code, which someone has to approve before the code
+// expires. It may return before the code is approved, since TestStaging polls for the token afterwards.
+type Approver func(ctx context.Context, codeResp traktdeviceauth.CodeResponse) error
+
+// StagingOption customizes TestStaging.
+type StagingOption func(*stagingConfig)
+
+// stagingConfig is the configuration built from StagingOptions.
+type stagingConfig struct {
+	baseURL  string
+	approver Approver
+	timeout  time.Duration
+	opts     []traktdeviceauth.Option
+}
+
+// WithApprover replaces how TestStaging hands the code to whoever approves it, for example to drive a
+// scripted browser. By default, the instructions are printed to stderr for a human.
+func WithApprover(a Approver) StagingOption {
+	return func(c *stagingConfig) {
+		c.approver = a
+	}
+}
+
+// WithApprovalTimeout limits how long TestStaging waits for the code to be approved. By default it waits
+// until the code expires.
+func WithApprovalTimeout(d time.Duration) StagingOption {
+	return func(c *stagingConfig) {
+		c.timeout = d
+	}
+}
+
+// WithStagingBaseURL points TestStaging at another API than StagingBaseURL, such as a Server in a test of
+// the harness itself.
+func WithStagingBaseURL(url string) StagingOption {
+	return func(c *stagingConfig) {
+		c.baseURL = url
+	}
+}
+
+// WithStagingClientOptions passes opts to every request TestStaging makes, after the option setting the base
+// url.
+func WithStagingClientOptions(opts ...traktdeviceauth.Option) StagingOption {
+	return func(c *stagingConfig) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// TestStaging runs the whole device flow against the Trakt staging API and checks the results along the way:
+// it generates a code, hands it to the Approver, polls for the token, fetches the user's settings with it,
+// refreshes it, checks the refreshed token, and finally revokes it and checks that it was rejected. Whatever
+// token is current when the test ends is revoked, even if a step failed.
+//
+// The test is skipped unless TRAKT_STAGING_CLIENT_ID and TRAKT_STAGING_CLIENT_SECRET are set, so that it can
+// sit next to ordinary tests and only run in jobs which provide the credentials:
+//
+//	func TestTraktStaging(t *testing.T) {
+//		traktdeviceauthtest.TestStaging(t)
+//	}
+func TestStaging(t *testing.T, opts ...StagingOption) {
+	clientID, clientSecret := os.Getenv(StagingClientIDEnv), os.Getenv(StagingClientSecretEnv)
+	if clientID == "" || clientSecret == "" {
+		t.Skipf("set %s and %s to run against the Trakt staging API", StagingClientIDEnv, StagingClientSecretEnv)
+	}
+
+	c := stagingConfig{baseURL: StagingBaseURL, approver: printApproval}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	clientOpts := append([]traktdeviceauth.Option{traktdeviceauth.WithBaseURL(c.baseURL)}, c.opts...)
+	ctx := context.Background()
+
+	var current traktdeviceauth.TokenResponse
+	t.Cleanup(func() {
+		if current.AccessToken == "" {
+			return
+		}
+		if err := traktdeviceauth.RevokeTokenContext(ctx, current.AccessToken, clientID, clientSecret, clientOpts...); err != nil {
+			t.Errorf("RevokeToken while cleaning up: %v", err)
+		}
+	})
+
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(ctx, clientID, clientOpts...)
+	if err != nil {
+		t.Fatalf("GenerateNewCode: %v", err)
+	}
+	if codeResp.DeviceCode == "" || codeResp.UserCode == "" || codeResp.VerificationURL == "" {
+		t.Fatalf("GenerateNewCode returned an incomplete code: %+v", codeResp)
+	}
+	if codeResp.ExpiresIn <= 0 || codeResp.Interval <= 0 {
+		t.Fatalf("GenerateNewCode returned expires_in %d and interval %d, want both positive", codeResp.ExpiresIn, codeResp.Interval)
+	}
+
+	if err := c.approver(ctx, codeResp); err != nil {
+		t.Fatalf("approving the code: %v", err)
+	}
+
+	pollCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	current, err = traktdeviceauth.PollForAuthTokenContext(pollCtx, codeResp, clientID, clientSecret, clientOpts...)
+	if err != nil {
+		t.Fatalf("PollForAuthToken: %v", err)
+	}
+	checkStagingToken(t, "PollForAuthToken", current)
+	checkStagingUser(t, ctx, current, clientID, clientOpts)
+
+	refreshed, err := traktdeviceauth.RefreshAccessTokenContext(ctx, current.RefreshToken, clientID, clientSecret, clientOpts...)
+	if err != nil {
+		t.Fatalf("RefreshAccessToken: %v", err)
+	}
+	old := current
+	current = refreshed
+	checkStagingToken(t, "RefreshAccessToken", refreshed)
+	if refreshed.AccessToken == old.AccessToken || refreshed.RefreshToken == old.RefreshToken {
+		t.Errorf("RefreshAccessToken returned the same access or refresh token as before")
+	}
+	checkStagingUser(t, ctx, refreshed, clientID, clientOpts)
+
+	if err := traktdeviceauth.RevokeTokenContext(ctx, refreshed.AccessToken, clientID, clientSecret, clientOpts...); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	current = traktdeviceauth.TokenResponse{}
+	_, err = traktdeviceauth.GetUserSettingsContext(ctx, refreshed.AccessToken, clientID, clientOpts...)
+	if !errors.Is(err, traktdeviceauth.ErrInvalidAccessToken) {
+		t.Errorf("GetUserSettings with the revoked token returned %v, want an error wrapping ErrInvalidAccessToken", err)
+	}
+}
+
+// checkStagingToken fails t if the token returned by step is incomplete or already expired.
+func checkStagingToken(t *testing.T, step string, tok traktdeviceauth.TokenResponse) {
+	t.Helper()
+
+	if tok.AccessToken == "" || tok.RefreshToken == "" {
+		t.Fatalf("%s returned a token without an access or refresh token", step)
+	}
+	if !strings.EqualFold(tok.TokenType, "bearer") {
+		t.Errorf("%s returned token type %q, want bearer", step, tok.TokenType)
+	}
+	if !tok.ExpiresAt.After(time.Now()) {
+		t.Errorf("%s returned a token which expired at %s", step, tok.ExpiresAt)
+	}
+	if tok.CreatedAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("%s returned a token created in the future, at %s", step, tok.CreatedAt)
+	}
+}
+
+// checkStagingUser fails t if the user settings can't be fetched with tok.
+func checkStagingUser(t *testing.T, ctx context.Context, tok traktdeviceauth.TokenResponse, clientID string, opts []traktdeviceauth.Option) {
+	t.Helper()
+
+	settings, err := traktdeviceauth.GetUserSettingsContext(ctx, tok.AccessToken, clientID, opts...)
+	if err != nil {
+		t.Fatalf("GetUserSettings: %v", err)
+	}
+	if settings.User.Username == "" {
+		t.Errorf("GetUserSettings returned a user without a username")
+	}
+}
+
+// printApproval is the default Approver, which asks whoever watches the test output to approve the code.
+func printApproval(ctx context.Context, codeResp traktdeviceauth.CodeResponse) error {
+	_, err := fmt.Fprintf(os.Stderr, "\nThe Trakt staging test is waiting for approval. %s\n\n", traktdeviceauth.Instructions(codeResp, "en"))
+	return err
+}
@@ -0,0 +1,66 @@
+package traktdeviceauthtest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestStagingSkippedWithoutCredentials(t *testing.T) {
+	t.Setenv(traktdeviceauthtest.StagingClientIDEnv, "")
+	t.Setenv(traktdeviceauthtest.StagingClientSecretEnv, "")
+
+	approved, skipped := false, false
+	t.Run("staging", func(t *testing.T) {
+		defer func() { skipped = t.Skipped() }()
+		traktdeviceauthtest.TestStaging(t, traktdeviceauthtest.WithApprover(func(context.Context, traktdeviceauth.CodeResponse) error {
+			approved = true
+			return nil
+		}))
+	})
+	if !skipped || approved {
+		t.Errorf("without credentials, the harness ran (skipped: %v, approver called: %v)", skipped, approved)
+	}
+}
+
+func TestStagingAgainstServer(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID, srv.ClientSecret = "staging-id", "staging-secret"
+	// Like Trakt, the Server reports an interval and rotates refresh tokens.
+	srv.Interval = 1
+	srv.Script(traktdeviceauthtest.RotateRefreshToken())
+	t.Setenv(traktdeviceauthtest.StagingClientIDEnv, srv.ClientID)
+	t.Setenv(traktdeviceauthtest.StagingClientSecretEnv, srv.ClientSecret)
+
+	var approvedCode traktdeviceauth.CodeResponse
+	traktdeviceauthtest.TestStaging(t,
+		traktdeviceauthtest.WithStagingBaseURL(srv.URL),
+		traktdeviceauthtest.WithStagingClientOptions(traktdeviceauth.WithPollInterval(0)),
+		traktdeviceauthtest.WithApprover(func(ctx context.Context, codeResp traktdeviceauth.CodeResponse) error {
+			approvedCode = codeResp
+			return nil
+		}),
+	)
+
+	if approvedCode.UserCode == "" {
+		t.Error("the approver wasn't given the code")
+	}
+	// Every step of the flow was exercised once, and the revoked token was checked to be rejected.
+	for _, want := range []struct {
+		endpoint traktdeviceauth.Endpoint
+		n        int
+	}{
+		{traktdeviceauth.EndpointDeviceCode, 1},
+		{traktdeviceauth.EndpointDeviceToken, 1},
+		{traktdeviceauth.EndpointToken, 1},
+		{traktdeviceauth.EndpointUserSettings, 3},
+		{traktdeviceauth.EndpointRevoke, 1},
+	} {
+		if n := len(srv.RequestsTo(want.endpoint)); n != want.n {
+			t.Errorf("%d requests to %s, want %d", n, want.endpoint, want.n)
+		}
+	}
+}
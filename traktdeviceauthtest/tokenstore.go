@@ -0,0 +1,112 @@
+package traktdeviceauthtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// TestTokenStore checks that the TokenStores created by newStore follow the rules documented on
+// traktdeviceauth.TokenStore. newStore is called once per subtest and must return an empty store.
+// Call it from a test of the package implementing the store:
+//
+//	func TestMyStore(t *testing.T) {
+//		traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+//			return mystore.New(...)
+//		})
+//	}
+func TestTokenStore(t *testing.T, newStore func(t *testing.T) traktdeviceauth.TokenStore) {
+	ctx := context.Background()
+
+	t.Run("LoadEmpty", func(t *testing.T) {
+		_, err := newStore(t).Load(ctx)
+		if !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+			t.Fatalf("Load on an empty store returned %v, want an error wrapping ErrNoStoredToken", err)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		s := newStore(t)
+		want := storeToken(1)
+		if err := s.Save(ctx, want); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		got, err := s.Load(ctx)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		checkToken(t, got, want)
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		s := newStore(t)
+		for i := 1; i <= 3; i++ {
+			if err := s.Save(ctx, storeToken(i)); err != nil {
+				t.Fatalf("Save %d: %v", i, err)
+			}
+		}
+		got, err := s.Load(ctx)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		checkToken(t, got, storeToken(3))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Save(ctx, storeToken(0)); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 8; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				if err := s.Save(ctx, storeToken(i)); err != nil {
+					t.Errorf("concurrent Save: %v", err)
+				}
+			}(i)
+			go func() {
+				defer wg.Done()
+				got, err := s.Load(ctx)
+				if err != nil {
+					t.Errorf("concurrent Load: %v", err)
+				} else if got.AccessToken == "" || got.RefreshToken != "refresh-"+got.AccessToken[len("access-"):] {
+					t.Errorf("concurrent Load returned a torn token: %+v", got)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+// storeToken returns a distinct token for each i, with times truncated to whole seconds so that stores
+// which don't keep sub-second precision still compare equal.
+func storeToken(i int) traktdeviceauth.TokenResponse {
+	created := time.Date(2021, 6, 1, 12, 0, i, 0, time.UTC)
+	suffix := string(rune('a' + i))
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  "access-" + suffix,
+		TokenType:    "bearer",
+		RefreshToken: "refresh-" + suffix,
+		Scope:        "public",
+		CreatedAt:    created,
+		ExpiresAt:    created.Add(90 * 24 * time.Hour),
+	}
+}
+
+// checkToken fails t if got doesn't match want. Times are compared with Equal, since stores may change
+// their location.
+func checkToken(t *testing.T, got, want traktdeviceauth.TokenResponse) {
+	t.Helper()
+
+	if got.AccessToken != want.AccessToken || got.TokenType != want.TokenType || got.RefreshToken != want.RefreshToken ||
+		got.Scope != want.Scope || !got.CreatedAt.Equal(want.CreatedAt) || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Fatalf("Load returned %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/BrenekH/go-traktdeviceauth/traktoauth2
+
+go 1.23.0
+
+require (
+	github.com/BrenekH/go-traktdeviceauth v1.1.0
+	golang.org/x/oauth2 v0.27.0
+)
+
+require (
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
@@ -0,0 +1,111 @@
+// Package traktoauth2 converts tokens between traktdeviceauth and golang.org/x/oauth2, for programs which pass
+// tokens to HTTP clients built on oauth2, or which adopt traktdeviceauth with tokens they already stored as
+// oauth2 tokens.
+//
+// It is a separate module so that golang.org/x/oauth2 only becomes a dependency of programs which use it.
+package traktoauth2
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"golang.org/x/oauth2"
+)
+
+// The extras of an oauth2.Token which carry the fields of a TokenResponse that oauth2.Token has no field for.
+// scope and created_at are named like in Trakt's token responses, so tokens which oauth2 obtained from Trakt
+// itself carry them too. Token stores the times as time.Time, so that they keep their precision, while those
+// tokens hold created_at as seconds since the epoch.
+const (
+	extraScope                = "scope"
+	extraCreatedAt            = "created_at"
+	extraRefreshTokenIssuedAt = "refresh_token_issued_at"
+	extraClockSkew            = "clock_skew" // A time.Duration.
+)
+
+// Token returns t as an oauth2.Token. The fields of t which oauth2.Token has no field for, such as Scope, are
+// kept in its extras, where TokenResponse finds them again. Extras aren't part of the JSON encoding of an
+// oauth2.Token, so they are lost if it is stored that way.
+func Token(t traktdeviceauth.TokenResponse) *oauth2.Token {
+	extra := map[string]interface{}{extraScope: t.Scope}
+	if !t.CreatedAt.IsZero() {
+		extra[extraCreatedAt] = t.CreatedAt
+	}
+	if !t.RefreshTokenIssuedAt.IsZero() {
+		extra[extraRefreshTokenIssuedAt] = t.RefreshTokenIssuedAt
+	}
+	if t.ClockSkew != 0 {
+		extra[extraClockSkew] = t.ClockSkew
+	}
+
+	tok := &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.ExpiresAt,
+	}
+	return tok.WithExtra(extra)
+}
+
+// TokenResponse returns tok as a TokenResponse, reading Scope and CreatedAt from the extras of tok, whether Token
+// put them there or oauth2 took them from a token response. Fields without an extra are left zero, except for
+// RefreshTokenIssuedAt, which falls back to CreatedAt. A nil tok returns the zero TokenResponse.
+func TokenResponse(tok *oauth2.Token) traktdeviceauth.TokenResponse {
+	if tok == nil {
+		return traktdeviceauth.TokenResponse{}
+	}
+
+	t := traktdeviceauth.TokenResponse{
+		AccessToken:  tok.AccessToken,
+		TokenType:    tok.TokenType,
+		RefreshToken: tok.RefreshToken,
+		ExpiresAt:    tok.Expiry,
+	}
+	if scope, ok := tok.Extra(extraScope).(string); ok {
+		t.Scope = scope
+	}
+	if created, ok := extraTime(tok.Extra(extraCreatedAt)); ok {
+		t.CreatedAt = created
+	}
+	t.RefreshTokenIssuedAt = t.CreatedAt
+	if issued, ok := extraTime(tok.Extra(extraRefreshTokenIssuedAt)); ok {
+		t.RefreshTokenIssuedAt = issued
+	}
+	if skew, ok := tok.Extra(extraClockSkew).(time.Duration); ok {
+		t.ClockSkew = skew
+	}
+	return t
+}
+
+// extraTime returns v as a time, which is either a time.Time put there by Token or seconds since the epoch.
+func extraTime(v interface{}) (time.Time, bool) {
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
+	if secs, ok := extraInt(v); ok {
+		return time.Unix(secs, 0), true
+	}
+	return time.Time{}, false
+}
+
+// extraInt returns v as an integer, accepting the types oauth2 and encoding/json decode numbers as.
+func extraInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
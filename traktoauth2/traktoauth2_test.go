@@ -0,0 +1,105 @@
+package traktoauth2_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktoauth2"
+	"golang.org/x/oauth2"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// The times have fractions of a second, which the round trip has to keep.
+	created := time.Date(2024, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	now := time.Now()
+	tests := []struct {
+		name string
+		tok  traktdeviceauth.TokenResponse
+	}{
+		{"full", traktdeviceauth.TokenResponse{
+			AccessToken:          "access",
+			TokenType:            "bearer",
+			ExpiresAt:            created.Add(90 * 24 * time.Hour),
+			RefreshToken:         "refresh",
+			Scope:                "public",
+			CreatedAt:            created,
+			RefreshTokenIssuedAt: created.Add(-time.Hour),
+			ClockSkew:            3 * time.Second,
+		}},
+		{"refresh token issued with the access token", traktdeviceauth.TokenResponse{
+			AccessToken: "access", TokenType: "bearer", RefreshToken: "refresh", Scope: "public",
+			ExpiresAt: created.Add(time.Hour), CreatedAt: created, RefreshTokenIssuedAt: created,
+		}},
+		{"refreshed just now", traktdeviceauth.TokenResponse{
+			AccessToken: "access", TokenType: "bearer", RefreshToken: "refresh", Scope: "public",
+			ExpiresAt: now.Add(90 * 24 * time.Hour), CreatedAt: now, RefreshTokenIssuedAt: now,
+		}},
+		{"access token only", traktdeviceauth.TokenResponse{AccessToken: "access", ExpiresAt: created}},
+		{"zero", traktdeviceauth.TokenResponse{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok := traktoauth2.Token(tt.tok)
+			if tok.AccessToken != tt.tok.AccessToken || tok.TokenType != tt.tok.TokenType || tok.RefreshToken != tt.tok.RefreshToken || !tok.Expiry.Equal(tt.tok.ExpiresAt) {
+				t.Errorf("Token returned %+v for %+v", tok, tt.tok)
+			}
+			if got := traktoauth2.TokenResponse(tok); !equal(got, tt.tok) {
+				t.Errorf("the round trip returned %+v, want %+v", got, tt.tok)
+			}
+		})
+	}
+
+	if got := traktoauth2.TokenResponse(nil); !equal(got, traktdeviceauth.TokenResponse{}) {
+		t.Errorf("TokenResponse(nil) = %+v, want the zero TokenResponse", got)
+	}
+}
+
+func TestTokenResponseFromOAuth2(t *testing.T) {
+	// A token which oauth2 obtained from Trakt keeps Trakt's scope and created_at in its extras.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access","token_type":"bearer","expires_in":7776000,"refresh_token":"refresh","scope":"public","created_at":1717243200}`))
+	}))
+	defer srv.Close()
+
+	conf := &oauth2.Config{ClientID: "client-id", ClientSecret: "secret", Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}
+	tok, err := conf.Exchange(context.Background(), "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := traktoauth2.TokenResponse(tok)
+	created := time.Unix(1717243200, 0)
+	want := traktdeviceauth.TokenResponse{
+		AccessToken:          "access",
+		TokenType:            "bearer",
+		ExpiresAt:            tok.Expiry,
+		RefreshToken:         "refresh",
+		Scope:                "public",
+		CreatedAt:            created,
+		RefreshTokenIssuedAt: created,
+	}
+	if !equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestTokenResponseWithoutExtras(t *testing.T) {
+	expiry := time.Date(2024, 8, 30, 12, 0, 0, 0, time.UTC)
+	got := traktoauth2.TokenResponse(&oauth2.Token{AccessToken: "access", TokenType: "Bearer", RefreshToken: "refresh", Expiry: expiry})
+	want := traktdeviceauth.TokenResponse{AccessToken: "access", TokenType: "Bearer", RefreshToken: "refresh", ExpiresAt: expiry}
+	if !equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// equal reports whether a and b hold the same token, comparing times with Equal.
+func equal(a, b traktdeviceauth.TokenResponse) bool {
+	return a.AccessToken == b.AccessToken && a.TokenType == b.TokenType && a.RefreshToken == b.RefreshToken && a.Scope == b.Scope &&
+		a.ExpiresAt.Equal(b.ExpiresAt) && a.CreatedAt.Equal(b.CreatedAt) && a.RefreshTokenIssuedAt.Equal(b.RefreshTokenIssuedAt) &&
+		a.ClockSkew == b.ClockSkew
+}
@@ -0,0 +1,85 @@
+package traktdeviceauth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// TransportOption customizes the http.RoundTripper returned by NewTransport.
+type TransportOption func(*transport)
+
+// WithTransportHookErrorHandler calls fn with the *HookError which source returns along with a refreshed token
+// when one of its hooks fails, such as the WithTokenSourceStore store, instead of writing it to the standard
+// logger. The request is sent with the refreshed token either way. fn is called from the goroutine sending the
+// request, so it must be safe for concurrent use.
+func WithTransportHookErrorHandler(fn func(req *http.Request, err *HookError)) TransportOption {
+	return func(t *transport) {
+		t.hookErrorHandler = fn
+	}
+}
+
+// NewTransport returns an http.RoundTripper which authorizes every request to the Trakt API with a token from
+// source, and sets the Trakt-API-Key header to clientID and Trakt-API-Version to 2, before sending it with
+// base, or http.DefaultTransport if base is nil. The token is fetched for every request, with the request's
+// context, so a refreshed token is used as soon as source has it.
+//
+// The caller's request isn't modified, since the headers are set on a copy. If source fails, the request isn't
+// sent and the error is returned by the http.Client, wrapped in a *url.Error. A *HookError doesn't count as a
+// failure, since the token it comes with is valid: the request is sent, and the error is passed to the
+// WithTransportHookErrorHandler handler. Neither does an error wrapping ErrReauthorizationRequired which comes
+// with a token, as RefreshingTokenSource returns after Trakt rejects the refresh token: requests are sent with
+// the token until it expires, and fail with the error from then on.
+func NewTransport(source TokenSource, clientID string, base http.RoundTripper, opts ...TransportOption) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &transport{source: source, clientID: clientID, base: base}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// transport is the http.RoundTripper returned by NewTransport.
+type transport struct {
+	source           TokenSource
+	clientID         string
+	base             http.RoundTripper
+	hookErrorHandler func(req *http.Request, err *HookError)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.source.Token(req.Context())
+	var hookErr *HookError
+	switch {
+	case errors.As(err, &hookErr) && tok.AccessToken != "":
+		t.reportHookError(req, hookErr)
+	case errors.Is(err, ErrReauthorizationRequired) && tok.AccessToken != "":
+		// The refresh token was rejected, but the access token keeps working until it expires.
+	case err != nil:
+		// A RoundTripper must close the body even when it doesn't send the request.
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("NewTransport: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	req.Header.Set("Trakt-API-Key", t.clientID)
+	req.Header.Set("Trakt-API-Version", "2")
+	return t.base.RoundTrip(req)
+}
+
+// reportHookError passes err, which source returned along with the token for req, to the
+// WithTransportHookErrorHandler handler, or writes it to the standard logger if there is none.
+func (t *transport) reportHookError(req *http.Request, err *HookError) {
+	if t.hookErrorHandler != nil {
+		t.hookErrorHandler(req, err)
+		return
+	}
+	log.Printf("traktdeviceauth: sending %s %s despite a failed hook: %v", req.Method, req.URL.Redacted(), err)
+}
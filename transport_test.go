@@ -0,0 +1,159 @@
+package traktdeviceauth_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+// sourceFunc is a TokenSource backed by a function.
+type sourceFunc func(ctx context.Context) (traktdeviceauth.TokenResponse, error)
+
+func (f sourceFunc) Token(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	return f(ctx)
+}
+
+// headerServer answers every request with the Authorization, Trakt-API-Key and Trakt-API-Version headers it
+// received, and counts the requests.
+func headerServer(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		io.WriteString(w, strings.Join([]string{r.Header.Get("Authorization"), r.Header.Get("Trakt-API-Key"), r.Header.Get("Trakt-API-Version")}, "|"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+// send sends req with client and returns the response body.
+func send(t *testing.T, client *http.Client, req *http.Request) (string, error) {
+	t.Helper()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestTransportSetsHeaders(t *testing.T) {
+	srv, _ := headerServer(t)
+
+	var calls int32
+	source := sourceFunc(func(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+		// Every request fetches the token again, so refreshed tokens are picked up.
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return traktdeviceauth.TokenResponse{AccessToken: "first"}, nil
+		}
+		return traktdeviceauth.TokenResponse{AccessToken: "second"}, nil
+	})
+	client := &http.Client{Transport: traktdeviceauth.NewTransport(source, "client-id", nil)}
+
+	for _, want := range []string{"Bearer first|client-id|2", "Bearer second|client-id|2"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		got, err := send(t, client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("the server received %q, want %q", got, want)
+		}
+		if len(req.Header) != 0 {
+			t.Errorf("the caller's request was modified: %v", req.Header)
+		}
+	}
+}
+
+func TestTransportSourceFailure(t *testing.T) {
+	srv, n := headerServer(t)
+
+	source := sourceFunc(func(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+		return traktdeviceauth.TokenResponse{}, traktdeviceauth.ErrReauthorizationRequired
+	})
+	client := &http.Client{Transport: traktdeviceauth.NewTransport(source, "client-id", nil)}
+
+	body := &closeRecorder{Reader: strings.NewReader("body")}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, body)
+	if _, err := send(t, client, req); !errors.Is(err, traktdeviceauth.ErrReauthorizationRequired) {
+		t.Fatalf("got %v, want ErrReauthorizationRequired", err)
+	}
+	if atomic.LoadInt32(n) != 0 {
+		t.Error("the request was sent without a token")
+	}
+	if !body.closed {
+		t.Error("the request body wasn't closed")
+	}
+}
+
+func TestTransportSendsDespiteHookError(t *testing.T) {
+	srv, _ := headerServer(t)
+
+	hookErr := &traktdeviceauth.HookError{Hook: "WithTokenSourceStore", Err: errors.New("disk full")}
+	source := sourceFunc(func(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+		return traktdeviceauth.TokenResponse{AccessToken: "refreshed"}, hookErr
+	})
+	var reported *traktdeviceauth.HookError
+	client := &http.Client{Transport: traktdeviceauth.NewTransport(source, "client-id", nil,
+		traktdeviceauth.WithTransportHookErrorHandler(func(req *http.Request, err *traktdeviceauth.HookError) { reported = err }))}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	got, err := send(t, client, req)
+	if err != nil {
+		t.Fatalf("the request failed: %v", err)
+	}
+	if got != "Bearer refreshed|client-id|2" {
+		t.Errorf("the server received %q", got)
+	}
+	if reported != hookErr {
+		t.Errorf("the handler got %v, want %v", reported, hookErr)
+	}
+}
+
+func TestTransportSendsWithRejectedRefreshToken(t *testing.T) {
+	srv, n := headerServer(t)
+	trakt := traktdeviceauthtest.NewServer()
+	defer trakt.Close()
+
+	// The fake Trakt server never issued this refresh token, so it rejects it, but the access token is still valid.
+	initial := traktdeviceauth.TokenResponse{AccessToken: "access", RefreshToken: "revoked", ExpiresAt: time.Now().Add(time.Minute)}
+	source := traktdeviceauth.NewTokenSource(initial, "client-id", "client-secret", traktdeviceauth.WithTokenSourceOptions(trakt.Options()...))
+	client := &http.Client{Transport: traktdeviceauth.NewTransport(source, "client-id", nil)}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		got, err := send(t, client, req)
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		if got != "Bearer access|client-id|2" {
+			t.Errorf("the server received %q", got)
+		}
+	}
+	if atomic.LoadInt32(n) != 2 {
+		t.Errorf("%d requests were sent, want 2", atomic.LoadInt32(n))
+	}
+}
+
+// closeRecorder is a request body which records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
@@ -0,0 +1,82 @@
+package traktdeviceauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// UserSettings is the subset of the response from GET /users/settings which identifies the account
+// that authorized an access token.
+type UserSettings struct {
+	User    UserProfile     `json:"user"`
+	Account AccountSettings `json:"account"`
+}
+
+// UserProfile describes a Trakt user.
+type UserProfile struct {
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Private  bool      `json:"private"`
+	VIP      bool      `json:"vip"`
+	VIPEP    bool      `json:"vip_ep"` // VIP Executive Producer
+	VIPOG    bool      `json:"vip_og"` // VIP Original Gangster
+	VIPYears int       `json:"vip_years"`
+	IDs      UserIDs   `json:"ids"`
+	JoinedAt time.Time `json:"joined_at"`
+	Location string    `json:"location"`
+}
+
+// UserIDs are the identifiers of a Trakt user. Unlike the username, Slug is safe to use in URLs.
+type UserIDs struct {
+	Slug string `json:"slug"`
+	UUID string `json:"uuid"`
+}
+
+// AccountSettings are the account preferences of a Trakt user.
+type AccountSettings struct {
+	Timezone   string `json:"timezone"` // IANA time zone name, such as America/Los_Angeles
+	DateFormat string `json:"date_format"`
+	Time24Hr   bool   `json:"time_24hr"`
+}
+
+// GetUserSettings wraps GetUserSettingsContext using context.Background().
+func GetUserSettings(accessToken, clientID string, opts ...Option) (UserSettings, error) {
+	return GetUserSettingsContext(context.Background(), accessToken, clientID, opts...)
+}
+
+// GetUserSettingsContext returns the settings of the account accessToken belongs to, which is useful for showing
+// who was just authorized and for telling multiple accounts apart.
+func GetUserSettingsContext(ctx context.Context, accessToken, clientID string, opts ...Option) (UserSettings, error) {
+	c := newConfig(opts)
+	if err := c.checkArgs("accessToken", accessToken, "clientID", clientID); err != nil {
+		return UserSettings{}, fmt.Errorf("GetUserSettings: %w", err)
+	}
+
+	u, err := c.endpointURL(EndpointUserSettings)
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("GetUserSettings: %w", err)
+	}
+
+	b, _, err := c.send(ctx, EndpointUserSettings, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Trakt-API-Key", clientID)
+		return req, nil
+	})
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("GetUserSettings: %w", err)
+	}
+
+	settings := UserSettings{}
+	if err = c.decode(b, &settings); err != nil {
+		return UserSettings{}, fmt.Errorf("GetUserSettings: %w", err)
+	}
+
+	return settings, nil
+}
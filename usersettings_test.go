@@ -0,0 +1,88 @@
+package traktdeviceauth_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+)
+
+func TestGetUserSettings(t *testing.T) {
+	replay := traktdeviceauthtest.NewReplayTransport(traktdeviceauthtest.FixtureUserSettings)
+	settings, err := traktdeviceauth.GetUserSettings("access-token", "client-id", replay.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.User.Username != "justin" || settings.User.Name != "Justin Nemeth" || settings.User.IDs.Slug != "justin" {
+		t.Errorf("got user %+v", settings.User)
+	}
+	if !settings.User.VIP || settings.User.VIPEP {
+		t.Errorf("got VIP %v and VIP EP %v, want true and false", settings.User.VIP, settings.User.VIPEP)
+	}
+	if settings.Account.Timezone != "America/Los_Angeles" {
+		t.Errorf("Timezone = %q, want America/Los_Angeles", settings.Account.Timezone)
+	}
+
+	req := replay.Requests()[0]
+	if req.Method != http.MethodGet || req.Path != traktdeviceauth.EndpointUserSettings.String() {
+		t.Errorf("sent %s %s", req.Method, req.Path)
+	}
+	for name, want := range map[string]string{
+		"Authorization":     "Bearer access-token",
+		"Trakt-API-Key":     "client-id",
+		"Trakt-API-Version": "2",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGetUserSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture traktdeviceauthtest.Fixture
+		want    error
+	}{
+		{"invalid access token", traktdeviceauthtest.FixtureInvalidAccessToken, traktdeviceauth.ErrInvalidAccessToken},
+		{"forbidden", traktdeviceauthtest.FixtureForbidden, traktdeviceauth.ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := traktdeviceauthtest.NewReplayTransport(tt.fixture)
+			_, err := traktdeviceauth.GetUserSettings("access-token", "client-id", replay.Options()...)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			var statusErr *traktdeviceauth.StatusError
+			if !errors.As(err, &statusErr) || statusErr.Status != tt.fixture.Status {
+				t.Errorf("got %v, want a StatusError with status %d", err, tt.fixture.Status)
+			}
+		})
+	}
+}
+
+func TestGetUserSettingsFromServer(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	srv.ClientID = "client-id"
+
+	tok := srv.IssueToken()
+	settings, err := traktdeviceauth.GetUserSettings(tok.AccessToken, "client-id", srv.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.User.IDs.Slug != srv.UserSettings.User.IDs.Slug {
+		t.Errorf("got slug %q, want %q", settings.User.IDs.Slug, srv.UserSettings.User.IDs.Slug)
+	}
+
+	if _, err := traktdeviceauth.GetUserSettings("unknown", "client-id", srv.Options()...); !errors.Is(err, traktdeviceauth.ErrInvalidAccessToken) {
+		t.Errorf("an unknown token returned %v, want ErrInvalidAccessToken", err)
+	}
+	if _, err := traktdeviceauth.GetUserSettings(tok.AccessToken, "other-client", srv.Options()...); !errors.Is(err, traktdeviceauth.ErrForbidden) {
+		t.Errorf("another client id returned %v, want ErrForbidden", err)
+	}
+}
@@ -0,0 +1,336 @@
+// Package vaultstore provides a traktdeviceauth.TokenStore which keeps the token in a HashiCorp Vault KV version 2
+// secrets engine.
+//
+// The store talks to Vault's HTTP API directly instead of through the Vault client library, so that using it
+// doesn't add any dependencies. It reads VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE like the Vault CLI does.
+package vaultstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// ErrVersionConflict is returned by Save when WithCheckAndSet is used and the secret was written by someone else
+// since this Store last read or wrote it.
+var ErrVersionConflict error = errors.New("the secret was changed by another writer")
+
+// NotFoundError is returned by Load when the secret doesn't exist or its latest version was deleted.
+// It unwraps to traktdeviceauth.ErrNoStoredToken.
+type NotFoundError struct {
+	Mount string
+	Path  string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no secret at %s/data/%s: %v", e.Mount, e.Path, traktdeviceauth.ErrNoStoredToken)
+}
+
+// Unwrap returns traktdeviceauth.ErrNoStoredToken.
+func (e *NotFoundError) Unwrap() error {
+	return traktdeviceauth.ErrNoStoredToken
+}
+
+// ResponseError is returned when Vault answers with an unexpected status.
+type ResponseError struct {
+	Status int
+	Errors []string // The messages Vault included in the response, if any.
+}
+
+func (e *ResponseError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault responded with status %d", e.Status)
+	}
+	return fmt.Sprintf("vault responded with status %d: %s", e.Status, strings.Join(e.Errors, "; "))
+}
+
+// Auth obtains a Vault token for the Store.
+type Auth interface {
+	login(ctx context.Context, s *Store) (string, error)
+}
+
+type tokenAuth string
+
+func (a tokenAuth) login(ctx context.Context, s *Store) (string, error) {
+	return string(a), nil
+}
+
+// TokenAuth authenticates with a Vault token. An empty token falls back to the VAULT_TOKEN environment variable.
+func TokenAuth(token string) Auth {
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return tokenAuth(token)
+}
+
+type appRoleAuth struct {
+	mount, roleID, secretID string
+}
+
+func (a appRoleAuth) login(ctx context.Context, s *Store) (string, error) {
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": a.roleID, "secret_id": a.secretID}
+	if _, err := s.request(ctx, "POST", "auth/"+a.mount+"/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("approle login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("approle login: vault didn't return a token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// AppRoleAuth authenticates with the AppRole auth method mounted at "approle". The token it obtains is reused
+// until Vault rejects it, at which point the Store logs in again.
+func AppRoleAuth(roleID, secretID string) Auth {
+	return AppRoleAuthAt("approle", roleID, secretID)
+}
+
+// AppRoleAuthAt is like AppRoleAuth for an AppRole auth method mounted at mount.
+func AppRoleAuthAt(mount, roleID, secretID string) Auth {
+	return appRoleAuth{mount: strings.Trim(mount, "/"), roleID: roleID, secretID: secretID}
+}
+
+// Option customizes a Store.
+type Option func(*Store)
+
+// WithAddress sets the address of the Vault server, such as https://vault.example.com:8200.
+// It defaults to VAULT_ADDR, or http://127.0.0.1:8200 if that isn't set.
+func WithAddress(addr string) Option {
+	return func(s *Store) {
+		s.addr = strings.TrimRight(addr, "/")
+	}
+}
+
+// WithNamespace sets the Vault Enterprise namespace of requests. It defaults to VAULT_NAMESPACE.
+func WithNamespace(namespace string) Option {
+	return func(s *Store) {
+		s.namespace = namespace
+	}
+}
+
+// WithHTTPClient sets the http.Client used to talk to Vault, for example to trust a private CA.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Store) {
+		s.client = c
+	}
+}
+
+// WithCheckAndSet makes Save fail with ErrVersionConflict if the secret has been written since this Store last
+// read or wrote it, using KV version 2's check-and-set. Before the first Load, Save only succeeds if the secret
+// doesn't exist yet.
+func WithCheckAndSet() Option {
+	return func(s *Store) {
+		s.cas = true
+	}
+}
+
+// Store is a traktdeviceauth.TokenStore which keeps the token as a secret in a KV version 2 secrets engine.
+// Every Save creates a new version of the secret. The token is stored with the field names of
+// traktdeviceauth.StoredToken.
+type Store struct {
+	addr      string
+	namespace string
+	client    *http.Client
+	mount     string
+	path      string
+	auth      Auth
+	cas       bool
+
+	mu      sync.Mutex
+	token   string
+	version int // The version of the secret last read or written.
+}
+
+// New returns a Store for the secret at path in the KV version 2 engine mounted at mount, such as "secret".
+func New(mount, path string, auth Auth, opts ...Option) *Store {
+	s := &Store{
+		addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    http.DefaultClient,
+		mount:     strings.Trim(mount, "/"),
+		path:      strings.Trim(path, "/"),
+		auth:      auth,
+	}
+	if s.addr == "" {
+		s.addr = "http://127.0.0.1:8200"
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// kvData is the body of KV version 2 reads and writes.
+type kvData struct {
+	Data     *traktdeviceauth.StoredToken `json:"data"`
+	Options  map[string]int               `json:"options,omitempty"`
+	Metadata *struct {
+		Version int `json:"version"`
+	} `json:"metadata,omitempty"`
+}
+
+// Save implements traktdeviceauth.TokenStore by writing a new version of the secret.
+func (s *Store) Save(ctx context.Context, t traktdeviceauth.TokenResponse) error {
+	st := traktdeviceauth.NewStoredToken(t)
+	body := kvData{Data: &st}
+
+	s.mu.Lock()
+	if s.cas {
+		body.Options = map[string]int{"cas": s.version}
+	}
+	s.mu.Unlock()
+
+	var resp struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	status, err := s.authed(ctx, "POST", body, &resp)
+	if status == http.StatusBadRequest && s.cas {
+		return fmt.Errorf("vaultstore.Save: %w", ErrVersionConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("vaultstore.Save: %w", err)
+	}
+
+	s.mu.Lock()
+	s.version = resp.Data.Version
+	s.mu.Unlock()
+	return nil
+}
+
+// Load implements traktdeviceauth.TokenStore by reading the latest version of the secret. If the secret doesn't
+// exist, or its latest version was deleted or destroyed, the error is a *NotFoundError.
+func (s *Store) Load(ctx context.Context) (traktdeviceauth.TokenResponse, error) {
+	var resp struct {
+		Data kvData `json:"data"`
+	}
+	status, err := s.authed(ctx, "GET", nil, &resp)
+	if status == http.StatusNotFound || (err == nil && resp.Data.Data == nil) {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("vaultstore.Load: %w", &NotFoundError{Mount: s.mount, Path: s.path})
+	}
+	if err != nil {
+		return traktdeviceauth.TokenResponse{}, fmt.Errorf("vaultstore.Load: %w", err)
+	}
+
+	if resp.Data.Metadata != nil {
+		s.mu.Lock()
+		s.version = resp.Data.Metadata.Version
+		s.mu.Unlock()
+	}
+	return resp.Data.Data.TokenResponse(), nil
+}
+
+// authed sends a request for the secret with the Vault token, logging in first if there is none yet, and again
+// if Vault rejects the token.
+func (s *Store) authed(ctx context.Context, method string, body, v interface{}) (int, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := s.vaultToken(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		status, err := s.request(ctx, method, s.mount+"/data/"+s.path, token, body, v)
+		if status != http.StatusForbidden || attempt > 0 {
+			return status, err
+		}
+
+		if _, ok := s.auth.(tokenAuth); ok {
+			return status, err
+		}
+		s.mu.Lock()
+		if s.token == token {
+			s.token = ""
+		}
+		s.mu.Unlock()
+	}
+}
+
+// vaultToken returns the Vault token, logging in if there is none.
+func (s *Store) vaultToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if token != "" {
+		return token, nil
+	}
+
+	token, err := s.auth.login(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	return token, nil
+}
+
+// request sends body as JSON to the Vault API at path and decodes the response into v. Non-2xx responses are
+// returned as a *ResponseError along with their status.
+func (s *Store) request(ctx context.Context, method, path, token string, body, v interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	u := s.addr + "/v1/" + (&url.URL{Path: path}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respErr := &ResponseError{Status: resp.StatusCode}
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(b, &errBody) == nil {
+			respErr.Errors = errBody.Errors
+		}
+		return resp.StatusCode, respErr
+	}
+
+	if v == nil || len(b) == 0 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(b, v)
+}
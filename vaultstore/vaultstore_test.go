@@ -0,0 +1,306 @@
+package vaultstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/BrenekH/go-traktdeviceauth/vaultstore"
+)
+
+// fakeVault is an HTTP-level fake of a KV version 2 engine mounted at "secret" and an AppRole auth method mounted
+// at "approle", which accepts the role "role" with the secret "secret".
+type fakeVault struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	tokens    map[string]bool
+	secrets   map[string][]json.RawMessage // Every version of every secret, nil for deleted versions.
+	logins    int
+	namespace string // Of the last request.
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{tokens: map[string]bool{"root": true}, secrets: make(map[string][]json.RawMessage)}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serve))
+	t.Cleanup(v.Close)
+	return v
+}
+
+// revoke makes Vault reject token from now on.
+func (v *fakeVault) revoke(token string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.tokens, token)
+}
+
+// state returns how often AppRole logins succeeded, the namespace of the last request and the versions of the
+// secret at path.
+func (v *fakeVault) state(path string) (logins int, namespace string, versions []json.RawMessage) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.logins, v.namespace, append([]json.RawMessage(nil), v.secrets[path]...)
+}
+
+// deleteLatest soft-deletes the latest version of the secret at path, like vault kv delete.
+func (v *fakeVault) deleteLatest(path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.secrets[path][len(v.secrets[path])-1] = nil
+}
+
+func (v *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.namespace = r.Header.Get("X-Vault-Namespace")
+
+	if r.URL.Path == "/v1/auth/approle/login" && r.Method == http.MethodPost {
+		var body struct {
+			RoleID   string `json:"role_id"`
+			SecretID string `json:"secret_id"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.RoleID != "role" || body.SecretID != "secret" {
+			vaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		v.logins++
+		token := fmt.Sprintf("approle-token-%d", v.logins)
+		v.tokens[token] = true
+		fmt.Fprintf(w, `{"auth":{"client_token":%q}}`, token)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+	if path == r.URL.Path {
+		vaultError(w, http.StatusNotFound)
+		return
+	}
+	if !v.tokens[r.Header.Get("X-Vault-Token")] {
+		vaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	versions := v.secrets[path]
+	switch r.Method {
+	case http.MethodGet:
+		if len(versions) == 0 {
+			vaultError(w, http.StatusNotFound)
+			return
+		}
+		latest := versions[len(versions)-1]
+		if latest == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"data":{"data":null,"metadata":{"version":%d,"deletion_time":"2024-01-01T00:00:00Z"}}}`, len(versions))
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"data":%s,"metadata":{"version":%d}}}`, latest, len(versions))
+	case http.MethodPost:
+		var body struct {
+			Data    json.RawMessage `json:"data"`
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Data) == 0 {
+			vaultError(w, http.StatusBadRequest, "no data provided")
+			return
+		}
+		if body.Options.CAS != nil && *body.Options.CAS != len(versions) {
+			vaultError(w, http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		v.secrets[path] = append(versions, body.Data)
+		fmt.Fprintf(w, `{"data":{"version":%d}}`, len(v.secrets[path]))
+	default:
+		vaultError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// vaultError answers with status and a body like Vault's.
+func vaultError(w http.ResponseWriter, status int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errs})
+}
+
+func testToken(i int) traktdeviceauth.TokenResponse {
+	return traktdeviceauth.TokenResponse{
+		AccessToken:  fmt.Sprintf("access-%d", i),
+		RefreshToken: fmt.Sprintf("refresh-%d", i),
+		ExpiresAt:    time.Unix(1700000000+int64(i), 0),
+	}
+}
+
+func TestStore(t *testing.T) {
+	v := newFakeVault(t)
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		// Every subtest gets a secret of its own.
+		return vaultstore.New("secret", t.Name(), vaultstore.TokenAuth("root"), vaultstore.WithAddress(v.URL))
+	})
+}
+
+func TestStoreWithAppRole(t *testing.T) {
+	v := newFakeVault(t)
+	traktdeviceauthtest.TestTokenStore(t, func(t *testing.T) traktdeviceauth.TokenStore {
+		return vaultstore.New("/secret/", "/"+t.Name()+"/", vaultstore.AppRoleAuth("role", "secret"), vaultstore.WithAddress(v.URL+"/"))
+	})
+}
+
+func TestVersions(t *testing.T) {
+	v := newFakeVault(t)
+	ctx := context.Background()
+	s := vaultstore.New("secret", "trakt", vaultstore.TokenAuth("root"), vaultstore.WithAddress(v.URL))
+
+	for i := 1; i <= 3; i++ {
+		if err := s.Save(ctx, testToken(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, versions := v.state("trakt")
+	if len(versions) != 3 {
+		t.Fatalf("%d versions were written, want 3", len(versions))
+	}
+
+	var stored traktdeviceauth.StoredToken
+	if err := json.Unmarshal(versions[2], &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != "access-3" || stored.RefreshToken != "refresh-3" || !stored.ExpiresAt.Equal(testToken(3).ExpiresAt) {
+		t.Errorf("the secret holds %+v, want the third token with the field names of StoredToken", stored)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	v := newFakeVault(t)
+	ctx := context.Background()
+	s := vaultstore.New("secret", "missing", vaultstore.TokenAuth("root"), vaultstore.WithAddress(v.URL))
+
+	_, err := s.Load(ctx)
+	var notFound *vaultstore.NotFoundError
+	if !errors.As(err, &notFound) || !errors.Is(err, traktdeviceauth.ErrNoStoredToken) {
+		t.Fatalf("Load returned %v, want a *NotFoundError wrapping ErrNoStoredToken", err)
+	}
+	if notFound.Mount != "secret" || notFound.Path != "missing" {
+		t.Errorf("got %+v", notFound)
+	}
+
+	// A secret whose latest version was deleted doesn't hold a token either.
+	if err := s.Save(ctx, testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	v.deleteLatest("missing")
+	if _, err := s.Load(ctx); !errors.As(err, &notFound) {
+		t.Errorf("Load after deleting the latest version returned %v, want a *NotFoundError", err)
+	}
+}
+
+func TestCheckAndSet(t *testing.T) {
+	v := newFakeVault(t)
+	ctx := context.Background()
+	newStore := func() *vaultstore.Store {
+		return vaultstore.New("secret", "trakt", vaultstore.TokenAuth("root"), vaultstore.WithAddress(v.URL), vaultstore.WithCheckAndSet())
+	}
+
+	first, second := newStore(), newStore()
+	if err := first.Save(ctx, testToken(1)); err != nil {
+		t.Fatalf("creating the secret: %v", err)
+	}
+	// second hasn't read the secret, so it would overwrite a token it doesn't know about.
+	if err := second.Save(ctx, testToken(2)); !errors.Is(err, vaultstore.ErrVersionConflict) {
+		t.Fatalf("Save without reading returned %v, want ErrVersionConflict", err)
+	}
+	if _, err := second.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Save(ctx, testToken(2)); err != nil {
+		t.Fatalf("Save after reading: %v", err)
+	}
+	if err := first.Save(ctx, testToken(3)); !errors.Is(err, vaultstore.ErrVersionConflict) {
+		t.Fatalf("Save of a stale version returned %v, want ErrVersionConflict", err)
+	}
+
+	got, err := first.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access-2" {
+		t.Errorf("the secret holds %q, want access-2", got.AccessToken)
+	}
+}
+
+func TestAppRoleLogsInAgain(t *testing.T) {
+	v := newFakeVault(t)
+	ctx := context.Background()
+	s := vaultstore.New("secret", "trakt", vaultstore.AppRoleAuth("role", "secret"), vaultstore.WithAddress(v.URL))
+
+	if err := s.Save(ctx, testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if logins, _, _ := v.state(""); logins != 1 {
+		t.Fatalf("logged in %d times, want the token reused", logins)
+	}
+
+	v.revoke("approle-token-1")
+	if _, err := s.Load(ctx); err != nil {
+		t.Fatalf("Load after the token was revoked: %v", err)
+	}
+	if logins, _, _ := v.state(""); logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	v := newFakeVault(t)
+	ctx := context.Background()
+
+	s := vaultstore.New("secret", "trakt", vaultstore.TokenAuth("wrong"), vaultstore.WithAddress(v.URL))
+	_, err := s.Load(ctx)
+	var respErr *vaultstore.ResponseError
+	if !errors.As(err, &respErr) || respErr.Status != http.StatusForbidden || len(respErr.Errors) != 1 || respErr.Errors[0] != "permission denied" {
+		t.Errorf("Load with a wrong token returned %v, want a 403 *ResponseError", err)
+	}
+
+	s = vaultstore.New("secret", "trakt", vaultstore.AppRoleAuth("role", "wrong"), vaultstore.WithAddress(v.URL))
+	err = s.Save(ctx, testToken(1))
+	if !errors.As(err, &respErr) || respErr.Status != http.StatusBadRequest || !strings.Contains(err.Error(), "approle login") {
+		t.Errorf("Save with a wrong secret id returned %v, want a failed approle login", err)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	v := newFakeVault(t)
+	t.Setenv("VAULT_ADDR", v.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	t.Setenv("VAULT_NAMESPACE", "team")
+
+	ctx := context.Background()
+	s := vaultstore.New("secret", "trakt", vaultstore.TokenAuth(""))
+	if err := s.Save(ctx, testToken(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, namespace, _ := v.state(""); namespace != "team" {
+		t.Errorf("the request had namespace %q, want team", namespace)
+	}
+
+	s = vaultstore.New("secret", "trakt", vaultstore.TokenAuth(""), vaultstore.WithNamespace("other"))
+	if _, err := s.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, namespace, _ := v.state(""); namespace != "other" {
+		t.Errorf("the request had namespace %q, want other", namespace)
+	}
+}
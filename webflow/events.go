@@ -0,0 +1,112 @@
+package webflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Names of the Server-Sent Events written by the events route. Each event's data is a JSON encoded Status.
+const (
+	EventCode     string = "code"     // The code the user needs to enter. Always the first event of a stream.
+	EventWaiting  string = "waiting"  // The flow is waiting for the user to enter the code.
+	EventApproved string = "approved" // The user approved the code and onToken has been called.
+	EventDenied   string = "denied"   // The user denied the code.
+	EventExpired  string = "expired"  // The code expired before the user approved it.
+	EventFailed   string = "failed"   // Polling stopped because of an error, which is included in the Status.
+)
+
+// WithHeartbeatInterval changes how often the events route writes a comment to keep proxies from closing
+// an idle connection. The default is 15 seconds.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(h *FlowHandler) {
+		h.heartbeat = d
+	}
+}
+
+// handleEvents streams the state of the visitor's flow as Server-Sent Events. The stream ends once the flow
+// finishes, is replaced by a new one, or the client disconnects. Clients should close their EventSource after
+// receiving a terminal event, otherwise the browser will reconnect and replay it.
+func (h *FlowHandler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h.mu.Lock()
+	f, ok := h.flows[sessionID(r)]
+	h.mu.Unlock()
+	if !ok {
+		http.Error(w, "no device flow has been started for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream.
+	w.WriteHeader(http.StatusOK)
+
+	status, _ := h.flowStatus(f)
+	writeEvent(w, EventCode, status)
+	if status.State == StatePending {
+		writeEvent(w, EventWaiting, status)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			status, replaced := h.flowStatus(f)
+			if !replaced {
+				writeEvent(w, terminalEvent(status.State), status)
+				flusher.Flush()
+			}
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// flowStatus returns the status of f and whether it has been replaced by a new flow.
+func (h *FlowHandler) flowStatus(f *flow) (Status, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return f.status(), f.replaced
+}
+
+// terminalEvent returns the name of the event which announces that a flow ended in state.
+func terminalEvent(state State) string {
+	switch state {
+	case StateApproved:
+		return EventApproved
+	case StateDenied:
+		return EventDenied
+	case StateExpired:
+		return EventExpired
+	default:
+		return EventFailed
+	}
+}
+
+// writeEvent writes a single Server-Sent Event with status as its data.
+func writeEvent(w http.ResponseWriter, name string, status Status) {
+	b, _ := json.Marshal(status)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+}
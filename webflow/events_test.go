@@ -0,0 +1,148 @@
+package webflow_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/BrenekH/go-traktdeviceauth/webflow"
+)
+
+// event is a Server-Sent Event, or a heartbeat comment if name is empty.
+type event struct {
+	name   string
+	status webflow.Status
+}
+
+// openEvents starts a flow on a server running h and opens its event stream, which is closed when ctx ends.
+func openEvents(ctx context.Context, t *testing.T, h http.Handler) *http.Response {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cookie := sessionCookie(serve(h, http.MethodGet, "/", ""))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	return resp
+}
+
+// readEvents sends the events of the stream to the returned channel, which is closed when the stream ends.
+func readEvents(t *testing.T, resp *http.Response) <-chan event {
+	events := make(chan event, 100)
+	go func() {
+		defer close(events)
+
+		var e event
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, ": "):
+				events <- event{}
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.status); err != nil {
+					t.Errorf("event %q has invalid data: %v", e.name, err)
+				}
+			case line == "" && e.name != "":
+				events <- e
+				e = event{}
+			}
+		}
+	}()
+	return events
+}
+
+func TestEventsEndWithOutcome(t *testing.T) {
+	tests := []struct {
+		scenario traktdeviceauthtest.Scenario
+		want     []string
+	}{
+		{traktdeviceauthtest.ApproveAfterPolls(3), []string{webflow.EventCode, webflow.EventWaiting, webflow.EventApproved}},
+		{traktdeviceauthtest.DenyAfterPolls(2), []string{webflow.EventCode, webflow.EventWaiting, webflow.EventDenied}},
+		{traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), []string{webflow.EventCode, webflow.EventWaiting, webflow.EventExpired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want[2], func(t *testing.T) {
+			h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{tt.scenario}, webflow.WithHeartbeatInterval(time.Hour))
+
+			var names []string
+			var last event
+			for e := range readEvents(t, openEvents(context.Background(), t, h)) {
+				names, last = append(names, e.name), e
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("got the events %v, want %v", names, tt.want)
+			}
+			if last.status.UserCode == "" {
+				t.Errorf("the last event has no user code: %+v", last.status)
+			}
+		})
+	}
+}
+
+func TestEventsHeartbeatAndDisconnect(t *testing.T) {
+	h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)}, webflow.WithHeartbeatInterval(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := readEvents(t, openEvents(ctx, t, h))
+	for _, want := range []string{webflow.EventCode, webflow.EventWaiting, ""} {
+		select {
+		case e := <-events:
+			if e.name != want {
+				t.Fatalf("got the event %q, want %q", e.name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the event %q didn't arrive", want)
+		}
+	}
+
+	// Disconnecting ends the stream instead of leaving it waiting for the flow.
+	cancel()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("the stream didn't end after the client disconnected")
+		}
+	}
+}
+
+func TestEventsWithoutFlow(t *testing.T) {
+	h, _, _ := newHandler(t, nil)
+
+	if w := serve(h, http.MethodGet, "/events", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /events without a session: %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodPost, "/events", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /events: %d, want 405", w.Code)
+	}
+}
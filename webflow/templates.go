@@ -0,0 +1,95 @@
+package webflow
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// defaultTemplate is the page rendered when WithTemplate is not used.
+var defaultTemplate = template.Must(template.ParseFS(templates, "templates/page.html"))
+
+// PageData is the data passed to the page template.
+type PageData struct {
+	// State is the state of the visitor's flow. The page is usually rendered while it is StatePending,
+	// but visitors returning to a finished flow will see the other states as well.
+	State State
+
+	// UserCode is the code the visitor needs to enter at ActivationURL.
+	UserCode string
+
+	// ActivationURL is the page on Trakt's website where the code is entered.
+	ActivationURL string
+
+	// ExpiresAt is when the code expires.
+	ExpiresAt time.Time
+
+	// QRCode is a data URI of a PNG QR code linking to ActivationURL, suitable for an img tag's src attribute.
+	// It is empty if the QR code could not be generated.
+	QRCode template.URL
+
+	// Error describes what went wrong when State is StateFailed.
+	Error string
+}
+
+// WithTemplate renders t instead of the built-in page. t is executed with a PageData and
+// may use the JSON and event routes described in the package documentation.
+func WithTemplate(t *template.Template) Option {
+	return func(h *FlowHandler) {
+		h.template = t
+	}
+}
+
+// WithoutHTML disables the page, leaving only the JSON and event routes for single-page apps which render
+// their own UI. In this mode flows are started with POST /new, which responds with the new flow's Status
+// instead of redirecting to the page.
+func WithoutHTML() Option {
+	return func(h *FlowHandler) {
+		h.template = nil
+	}
+}
+
+// WithErrorLog sets the logger used to report errors that can't be shown to visitors, such as failures to
+// execute the page template. The default is the standard logger.
+func WithErrorLog(l *log.Logger) Option {
+	return func(h *FlowHandler) {
+		h.errorLog = l
+	}
+}
+
+// renderPage executes the page template with status. The output is buffered so that template errors result
+// in a 500 instead of a half-written page.
+func (h *FlowHandler) renderPage(w http.ResponseWriter, status Status) {
+	data := PageData{
+		State:         status.State,
+		UserCode:      status.UserCode,
+		ActivationURL: status.VerificationURL,
+		ExpiresAt:     status.ExpiresAt,
+		Error:         status.Error,
+	}
+
+	if png, err := qrcode.Encode(status.VerificationURL, qrcode.Medium, 256); err == nil {
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	} else {
+		h.errorLog.Printf("webflow: generating QR code: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := h.template.Execute(&buf, data); err != nil {
+		h.errorLog.Printf("webflow: executing page template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
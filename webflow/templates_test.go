@@ -0,0 +1,78 @@
+package webflow_test
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/BrenekH/go-traktdeviceauth/webflow"
+)
+
+func TestDefaultTemplate(t *testing.T) {
+	h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)})
+
+	w := serve(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /: %d %s", w.Code, w.Body)
+	}
+	s := status(t, h, sessionCookie(w).Value)
+
+	page := w.Body.String()
+	for _, want := range []string{
+		`<strong id="code" style="font-size: 2em; letter-spacing: 0.1em">` + s.UserCode + `</strong>`,
+		`<a href="` + traktdeviceauthtest.VerificationURL + `"`,
+		`<img src="data:image/png;base64,`,
+		`datetime="` + s.ExpiresAt.Format(time.RFC3339) + `"`,
+		`new EventSource("events")`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the page doesn't contain %q", want)
+		}
+	}
+}
+
+func TestCustomTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("page").Parse(
+		`<p class="code">{{.UserCode}}</p><a href="{{.ActivationURL}}">{{.State}}</a><img src="{{.QRCode}}"><time>{{.ExpiresAt.Unix}}</time>`))
+	h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)}, webflow.WithTemplate(tmpl))
+
+	w := serve(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /: %d %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", ct)
+	}
+	s := status(t, h, sessionCookie(w).Value)
+
+	want := `<p class="code">` + s.UserCode + `</p><a href="` + traktdeviceauthtest.VerificationURL + `">pending</a><img src="data:image/png;base64,`
+	if page := w.Body.String(); !strings.HasPrefix(page, want) || !strings.HasSuffix(page, "<time>"+strconv.FormatInt(s.ExpiresAt.Unix(), 10)+"</time>") {
+		t.Errorf("the page is %q, want it to start with %q and end with the expiry", page, want)
+	}
+}
+
+func TestTemplateErrorIs500(t *testing.T) {
+	// Calling a method on a missing field fails while the template is executed, after some output was produced.
+	tmpl := template.Must(template.New("page").Parse(`<p>{{.UserCode}}</p>{{.Missing.Field}}`))
+
+	var logged bytes.Buffer
+	h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)},
+		webflow.WithTemplate(tmpl), webflow.WithErrorLog(log.New(&logged, "", 0)))
+
+	w := serve(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /: %d, want 500", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "<p>") {
+		t.Errorf("the partial page was sent: %q", w.Body.String())
+	}
+	if !strings.Contains(logged.String(), "executing page template") {
+		t.Errorf("the error wasn't logged, the log is %q", logged.String())
+	}
+}
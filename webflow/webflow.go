@@ -0,0 +1,400 @@
+// Package webflow provides an http.Handler which runs the Trakt device authentication flow for web UIs.
+//
+// The handler is meant to be mounted below a prefix with http.StripPrefix, for example:
+//
+//	mux.Handle("/trakt/auth/", http.StripPrefix("/trakt/auth", webflow.NewFlowHandler(clientID, clientSecret, onToken)))
+//
+// It serves the following routes, relative to the prefix:
+//
+//	GET  /        a page showing the user code, activation link, QR code and expiry (see WithTemplate)
+//	GET  /status  the state of the visitor's flow as JSON
+//	POST /new     discards the visitor's flow and starts a new one
+//	GET  /events  a stream of Server-Sent Events describing the visitor's flow
+package webflow
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+)
+
+// sessionCookie is the name of the cookie used to associate visitors with their flow.
+const sessionCookie string = "traktdeviceauth_session"
+
+// errClosed is returned when a flow is started after FlowHandler.Close.
+var errClosed error = errors.New("the flow handler has been closed")
+
+// State describes how far along a flow is.
+type State string
+
+const (
+	StatePending  State = "pending"
+	StateApproved State = "approved"
+	StateDenied   State = "denied"
+	StateExpired  State = "expired"
+	StateFailed   State = "failed"
+)
+
+// Status is the JSON document served by the status route.
+type Status struct {
+	State           State     `json:"state"`
+	UserCode        string    `json:"user_code"`
+	VerificationURL string    `json:"verification_url"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Option customizes a FlowHandler.
+type Option func(*FlowHandler)
+
+// WithClientOptions passes opts to every traktdeviceauth function called by the handler.
+func WithClientOptions(opts ...traktdeviceauth.Option) Option {
+	return func(h *FlowHandler) {
+		h.clientOpts = append(h.clientOpts, opts...)
+	}
+}
+
+// WithMaxFlows limits how many flows can be pending at once, since every visitor without a session gets a new
+// device code from Trakt. Once the limit is reached, visitors who don't have a pending flow get a 503 response
+// until some of the flows finish. The default is 100 and values less than 1 remove the limit.
+func WithMaxFlows(n int) Option {
+	return func(h *FlowHandler) {
+		h.maxFlows = n
+	}
+}
+
+// WithSecureCookie marks the session cookie as Secure even for requests which didn't arrive over TLS, for
+// handlers behind a proxy which terminates TLS. Requests which did arrive over TLS always get a Secure cookie.
+func WithSecureCookie() Option {
+	return func(h *FlowHandler) {
+		h.secureCookie = true
+	}
+}
+
+// FlowHandler runs one device flow per visitor, identified by a session cookie.
+// Polling happens server-side, so visitors can close the page without interrupting it.
+type FlowHandler struct {
+	clientID     string
+	clientSecret string
+	onToken      func(traktdeviceauth.TokenResponse)
+	clientOpts   []traktdeviceauth.Option
+	heartbeat    time.Duration
+	template     *template.Template
+	errorLog     *log.Logger
+	maxFlows     int
+	secureCookie bool
+	mux          *http.ServeMux
+
+	mu       sync.Mutex
+	flows    map[string]*flow
+	starting int // Flows whose code is being generated, which count against maxFlows.
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// flow is a single visitor's device flow. Its fields are guarded by FlowHandler.mu.
+type flow struct {
+	codeResp  traktdeviceauth.CodeResponse
+	expiresAt time.Time
+	state     State
+	err       error
+	cancel    context.CancelFunc
+	replaced  bool
+	done      chan struct{} // Closed once state is no longer StatePending.
+}
+
+// NewFlowHandler creates a FlowHandler. onToken is called from a background goroutine every time a visitor
+// approves their code. A panic in onToken is recovered and written to the error log.
+func NewFlowHandler(clientID, clientSecret string, onToken func(traktdeviceauth.TokenResponse), opts ...Option) *FlowHandler {
+	h := &FlowHandler{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		onToken:      onToken,
+		heartbeat:    15 * time.Second,
+		template:     defaultTemplate,
+		errorLog:     log.Default(),
+		maxFlows:     100,
+		flows:        make(map[string]*flow),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("/", h.handlePage)
+	h.mux.HandleFunc("/status", h.handleStatus)
+	h.mux.HandleFunc("/new", h.handleNew)
+	h.mux.HandleFunc("/events", h.handleEvents)
+
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *FlowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close cancels every in-flight poll and waits for them to stop. Requests made after Close fail with 503.
+func (h *FlowHandler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+
+	h.cancel()
+	h.wg.Wait()
+	return nil
+}
+
+func (h *FlowHandler) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || h.template == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.currentOrNew(w, r)
+	if err != nil {
+		h.writeStartError(w, err)
+		return
+	}
+
+	h.renderPage(w, status)
+}
+
+func (h *FlowHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, ok := h.status(sessionID(r))
+	if !ok {
+		http.Error(w, "no device flow has been started for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *FlowHandler) handleNew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.start(w, r)
+	if err != nil {
+		h.writeStartError(w, err)
+		return
+	}
+
+	if h.template == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	// http.Redirect would resolve "./" against the path after http.StripPrefix, so let the browser resolve it instead.
+	w.Header().Set("Location", "./")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// currentOrNew returns the status of the visitor's flow, starting a new one if they don't have one yet.
+func (h *FlowHandler) currentOrNew(w http.ResponseWriter, r *http.Request) (Status, error) {
+	if status, ok := h.status(sessionID(r)); ok {
+		return status, nil
+	}
+	return h.start(w, r)
+}
+
+// start generates a new device code for the visitor, replacing any existing flow, and begins polling for it.
+func (h *FlowHandler) start(w http.ResponseWriter, r *http.Request) (Status, error) {
+	id := sessionID(r)
+	if err := h.reserve(id); err != nil {
+		return Status{}, err
+	}
+
+	codeResp, err := traktdeviceauth.GenerateNewCodeContext(r.Context(), h.clientID, h.clientOpts...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.starting--
+	if err != nil {
+		return Status{}, err
+	}
+	if h.closed {
+		return Status{}, errClosed
+	}
+
+	if id == "" {
+		id = newSessionID()
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, Secure: h.secureCookie || r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	}
+
+	h.prune()
+	if old, ok := h.flows[id]; ok {
+		old.replaced = true
+		old.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	f := &flow{
+		codeResp:  codeResp,
+		expiresAt: codeResp.ExpiresAt,
+		state:     StatePending,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	h.flows[id] = f
+
+	h.wg.Add(1)
+	go h.poll(ctx, f)
+
+	return f.status(), nil
+}
+
+// reserve counts a flow for session id as starting, or returns traktdeviceauth.ErrTooManyFlows if that would
+// exceed maxFlows. A visitor replacing their own pending flow doesn't add one.
+func (h *FlowHandler) reserve(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return errClosed
+	}
+
+	h.prune()
+	n := h.starting
+	for fid, f := range h.flows {
+		if f.state == StatePending && fid != id {
+			n++
+		}
+	}
+	if h.maxFlows > 0 && n >= h.maxFlows {
+		return traktdeviceauth.ErrTooManyFlows
+	}
+	h.starting++
+	return nil
+}
+
+// poll waits for the user to approve f and records the outcome.
+func (h *FlowHandler) poll(ctx context.Context, f *flow) {
+	defer h.wg.Done()
+	defer f.cancel()
+
+	t, err := traktdeviceauth.PollForAuthTokenContext(ctx, f.codeResp, h.clientID, h.clientSecret, h.clientOpts...)
+
+	var hookErr *traktdeviceauth.HookError
+	h.mu.Lock()
+	switch {
+	case err == nil, errors.As(err, &hookErr):
+		f.state = StateApproved
+	case errors.Is(err, traktdeviceauth.ErrDeviceCodeDenied):
+		f.state = StateDenied
+	case errors.Is(err, traktdeviceauth.ErrDeviceCodeExpired), time.Now().After(f.expiresAt):
+		f.state = StateExpired
+	default:
+		f.state = StateFailed
+	}
+	f.err = err
+	approved := f.state == StateApproved
+	close(f.done)
+	h.mu.Unlock()
+
+	if approved && h.onToken != nil {
+		h.callOnToken(t)
+	}
+}
+
+// callOnToken passes t to onToken, logging a panic in it to the error log instead of crashing the program
+// from the flow's goroutine.
+func (h *FlowHandler) callOnToken(t traktdeviceauth.TokenResponse) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.errorLog.Printf("webflow: onToken panicked: %v\n%s", v, debug.Stack())
+		}
+	}()
+	h.onToken(t)
+}
+
+// status returns the status of the flow belonging to session id.
+func (h *FlowHandler) status(id string) (Status, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, ok := h.flows[id]
+	if !ok {
+		return Status{}, false
+	}
+	return f.status(), true
+}
+
+// prune forgets flows which have finished and whose code has expired. h.mu must be held.
+func (h *FlowHandler) prune() {
+	now := time.Now()
+	for id, f := range h.flows {
+		if f.state != StatePending && now.After(f.expiresAt) {
+			delete(h.flows, id)
+		}
+	}
+}
+
+// writeStartError reports a failure to start a flow.
+func (h *FlowHandler) writeStartError(w http.ResponseWriter, err error) {
+	if err == errClosed || err == traktdeviceauth.ErrTooManyFlows {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "could not start a device flow: "+err.Error(), http.StatusBadGateway)
+}
+
+// status converts f into a Status. FlowHandler.mu must be held.
+func (f *flow) status() Status {
+	s := Status{
+		State:           f.state,
+		UserCode:        f.codeResp.UserCode,
+		VerificationURL: f.codeResp.VerificationURL,
+		ExpiresAt:       f.expiresAt,
+	}
+	if f.err != nil {
+		s.Error = f.err.Error()
+	}
+	return s
+}
+
+// sessionID returns the visitor's session id, or an empty string if they don't have one.
+func sessionID(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// newSessionID returns a random, unguessable session id.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,321 @@
+package webflow_test
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrenekH/go-traktdeviceauth"
+	"github.com/BrenekH/go-traktdeviceauth/traktdeviceauthtest"
+	"github.com/BrenekH/go-traktdeviceauth/webflow"
+)
+
+// newHandler creates a FlowHandler against a fake server scripted with scenarios. Approved tokens are sent
+// to the returned channel.
+func newHandler(t *testing.T, scenarios []traktdeviceauthtest.Scenario, opts ...webflow.Option) (*webflow.FlowHandler, *traktdeviceauthtest.Server, chan traktdeviceauth.TokenResponse) {
+	t.Helper()
+
+	srv := traktdeviceauthtest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.Script(scenarios...)
+
+	tokens := make(chan traktdeviceauth.TokenResponse, 10)
+	clientOpts := append(srv.Options(), traktdeviceauth.WithPollInterval(20*time.Millisecond))
+	opts = append([]webflow.Option{webflow.WithClientOptions(clientOpts...), webflow.WithErrorLog(log.New(io.Discard, "", 0))}, opts...)
+	h := webflow.NewFlowHandler("client-id", "client-secret", func(t traktdeviceauth.TokenResponse) { tokens <- t }, opts...)
+	t.Cleanup(func() { h.Close() })
+	return h, srv, tokens
+}
+
+// serve sends a request for target to h, with the session cookie if it isn't empty.
+func serve(h http.Handler, method, target, session string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: "traktdeviceauth_session", Value: session})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// sessionCookie returns the session cookie set by a response, or nil.
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "traktdeviceauth_session" {
+			return c
+		}
+	}
+	return nil
+}
+
+// status fetches the status of session's flow.
+func status(t *testing.T, h http.Handler, session string) webflow.Status {
+	t.Helper()
+
+	w := serve(h, http.MethodGet, "/status", session)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /status: %d %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var s webflow.Status
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitForState polls the status route until session's flow reaches want.
+func waitForState(t *testing.T, h http.Handler, session string, want webflow.State) webflow.Status {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := status(t, h, session)
+		if s.State == want {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state is %q, want %q", s.State, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPageStartsFlowAndApproves(t *testing.T) {
+	h, _, tokens := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(3)})
+
+	w := serve(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /: %d %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("got session cookie %v, want an HttpOnly one", cookie)
+	}
+
+	s := status(t, h, cookie.Value)
+	if s.State != webflow.StatePending || s.UserCode == "" || s.VerificationURL != traktdeviceauthtest.VerificationURL {
+		t.Fatalf("got status %+v, want a pending flow with a code", s)
+	}
+	page := w.Body.String()
+	if !strings.Contains(page, s.UserCode) || !strings.Contains(page, s.VerificationURL) {
+		t.Errorf("the page doesn't show the code %q and url %q", s.UserCode, s.VerificationURL)
+	}
+
+	waitForState(t, h, cookie.Value, webflow.StateApproved)
+	select {
+	case tok := <-tokens:
+		if tok.AccessToken == "" {
+			t.Error("onToken got a token without an access token")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("onToken wasn't called")
+	}
+
+	// Returning to the page shows the same flow instead of starting a new one.
+	w = serve(h, http.MethodGet, "/", cookie.Value)
+	if w.Code != http.StatusOK || sessionCookie(w) != nil {
+		t.Errorf("returning visitor got %d and cookie %v", w.Code, sessionCookie(w))
+	}
+	if !strings.Contains(w.Body.String(), "Your Trakt account has been connected.") {
+		t.Error("the page doesn't show the approval")
+	}
+}
+
+func TestStatusWithoutFlow(t *testing.T) {
+	h, _, _ := newHandler(t, nil)
+
+	if w := serve(h, http.MethodGet, "/status", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /status without a session: %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/status", "unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /status with an unknown session: %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodPost, "/status", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status: %d, want 405", w.Code)
+	}
+}
+
+func TestTerminalStates(t *testing.T) {
+	tests := []struct {
+		scenario traktdeviceauthtest.Scenario
+		want     webflow.State
+	}{
+		{traktdeviceauthtest.DenyAfterPolls(1), webflow.StateDenied},
+		{traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire()), webflow.StateExpired},
+		{traktdeviceauthtest.Sequence(traktdeviceauthtest.Status(http.StatusForbidden)), webflow.StateFailed},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.want), func(t *testing.T) {
+			t.Parallel()
+
+			h, _, tokens := newHandler(t, []traktdeviceauthtest.Scenario{tt.scenario})
+			cookie := sessionCookie(serve(h, http.MethodGet, "/", ""))
+			s := waitForState(t, h, cookie.Value, tt.want)
+			if tt.want == webflow.StateFailed && s.Error == "" {
+				t.Error("a failed flow has no error")
+			}
+			if len(tokens) != 0 {
+				t.Error("onToken was called")
+			}
+
+			if w := serve(h, http.MethodGet, "/", cookie.Value); !strings.Contains(w.Body.String(), "Get a new code") {
+				t.Error("the page doesn't offer a new code")
+			}
+		})
+	}
+}
+
+func TestNewReplacesFlow(t *testing.T) {
+	h, srv, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.Sequence(traktdeviceauthtest.Expire())})
+
+	cookie := sessionCookie(serve(h, http.MethodGet, "/", ""))
+	old := waitForState(t, h, cookie.Value, webflow.StateExpired)
+
+	w := serve(h, http.MethodPost, "/new", cookie.Value)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "./" {
+		t.Fatalf("POST /new: %d to %q, want a redirect to ./", w.Code, w.Header().Get("Location"))
+	}
+	if s := status(t, h, cookie.Value); s.UserCode == old.UserCode {
+		t.Error("POST /new kept the old code")
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 2 {
+		t.Errorf("%d codes were generated, want 2", n)
+	}
+	if w := serve(h, http.MethodGet, "/new", cookie.Value); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /new: %d, want 405", w.Code)
+	}
+}
+
+func TestWithoutHTML(t *testing.T) {
+	h, _, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)}, webflow.WithoutHTML())
+
+	if w := serve(h, http.MethodGet, "/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /: %d, want 404", w.Code)
+	}
+
+	w := serve(h, http.MethodPost, "/new", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /new: %d %s", w.Code, w.Body)
+	}
+	var s webflow.Status
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.State != webflow.StatePending || s.UserCode == "" || time.Until(s.ExpiresAt) < 9*time.Minute {
+		t.Errorf("got status %+v, want a fresh pending flow", s)
+	}
+}
+
+func TestMaxFlows(t *testing.T) {
+	h, srv, _ := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)}, webflow.WithMaxFlows(2))
+
+	first := sessionCookie(serve(h, http.MethodGet, "/", ""))
+	if second := sessionCookie(serve(h, http.MethodGet, "/", "")); first == nil || second == nil {
+		t.Fatal("the first two visitors didn't get a flow")
+	}
+
+	w := serve(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusServiceUnavailable || sessionCookie(w) != nil {
+		t.Fatalf("third visitor got %d and cookie %v, want 503 without a cookie", w.Code, sessionCookie(w))
+	}
+	if n := len(srv.RequestsTo(traktdeviceauth.EndpointDeviceCode)); n != 2 {
+		t.Errorf("%d codes were requested from Trakt, want 2", n)
+	}
+
+	// A visitor who already has a flow can still replace it.
+	if w := serve(h, http.MethodPost, "/new", first.Value); w.Code != http.StatusSeeOther {
+		t.Errorf("POST /new by an existing visitor: %d, want 303", w.Code)
+	}
+}
+
+func TestSecureCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		opts   []webflow.Option
+		want   bool
+	}{
+		{"http", "http://example.com/", nil, false},
+		{"https", "https://example.com/", nil, true},
+		{"http with WithSecureCookie", "http://example.com/", []webflow.Option{webflow.WithSecureCookie()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newHandler(t, nil, tt.opts...)
+			cookie := sessionCookie(serve(h, http.MethodGet, tt.target, ""))
+			if cookie == nil {
+				t.Fatal("no session cookie was set")
+			}
+			if cookie.Secure != tt.want {
+				t.Errorf("Secure = %v, want %v", cookie.Secure, tt.want)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	h, _, tokens := newHandler(t, []traktdeviceauthtest.Scenario{traktdeviceauthtest.ApproveAfterPolls(1000)})
+
+	cookie := sessionCookie(serve(h, http.MethodGet, "/", ""))
+	h.Close()
+
+	if s := status(t, h, cookie.Value); s.State != webflow.StateFailed {
+		t.Errorf("state after Close is %q, want %q", s.State, webflow.StateFailed)
+	}
+	if w := serve(h, http.MethodGet, "/", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET / after Close: %d, want 503", w.Code)
+	}
+	if len(tokens) != 0 {
+		t.Error("onToken was called")
+	}
+}
+
+// logLines is an io.Writer for a log.Logger, sending every line written to it to the channel.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func TestOnTokenPanic(t *testing.T) {
+	srv := traktdeviceauthtest.NewServer()
+	defer srv.Close()
+	logged := make(logLines, 10)
+	clientOpts := append(srv.Options(), traktdeviceauth.WithPollInterval(20*time.Millisecond))
+	h := webflow.NewFlowHandler("client-id", "client-secret", func(traktdeviceauth.TokenResponse) { panic("boom") },
+		webflow.WithClientOptions(clientOpts...), webflow.WithErrorLog(log.New(logged, "", 0)))
+	defer h.Close()
+
+	// The panic is logged, and the visitor still sees their account connected.
+	cookie := sessionCookie(serve(h, http.MethodGet, "/", ""))
+	if cookie == nil {
+		t.Fatal("no session cookie was set")
+	}
+	waitForState(t, h, cookie.Value, webflow.StateApproved)
+	select {
+	case line := <-logged:
+		if !strings.HasPrefix(line, "webflow: onToken panicked: boom\n") || !strings.Contains(line, "webflow_test.go") {
+			t.Errorf("logged %q, want the panic along with its stack", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panic wasn't logged")
+	}
+
+	// The handler keeps serving new flows.
+	if w := serve(h, http.MethodGet, "/", ""); w.Code != http.StatusOK || sessionCookie(w) == nil {
+		t.Errorf("a new visitor got %d and cookie %v after the panic", w.Code, sessionCookie(w))
+	}
+}